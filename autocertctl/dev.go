@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	defaultCluster   = "autocert-dev"
+	defaultInitImage = "cr.smallstep.com/smallstep/autocert-init"
+	// initBinding is the name of the ClusterRoleBinding giving the installer
+	// cluster-admin while it runs.
+	initBinding = "autocert-init-binding"
+	// exampleNamespace is the namespace of the hello-mtls example.
+	exampleNamespace = "default"
+)
+
+// initBindingManifest lets the autocert-init pod, running as the default
+// service account, install autocert.
+var initBindingManifest = `apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: ` + initBinding + `
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: cluster-admin
+subjects:
+- kind: ServiceAccount
+  name: default
+  namespace: default
+`
+
+// exampleApps are the hello-mtls apps deployed in the cluster: the Go server
+// and the client calling it.
+var exampleApps = []string{"server", "client"}
+
+// commander runs the external tools.
+type commander interface {
+	// lookPath returns an error if the tool is not installed.
+	lookPath(name string) error
+	// output runs a command and returns its standard output.
+	output(ctx context.Context, name string, args ...string) (string, error)
+	// run runs a command with the given standard input, streaming its
+	// output.
+	run(ctx context.Context, stdin []byte, name string, args ...string) error
+	// start starts a command in the background, until the context is
+	// canceled, and returns its standard output.
+	start(ctx context.Context, name string, args ...string) (io.Reader, error)
+}
+
+// devEnv is a local development environment: a kind cluster with step-ca
+// and autocert installed, running the hello-mtls example.
+type devEnv struct {
+	cluster   string
+	initImage string
+	repo      string
+	example   bool
+	cmd       commander
+	out       io.Writer
+}
+
+func newDevEnv(name string, args []string) (*devEnv, error) {
+	e := &devEnv{
+		cmd: execCommander{out: os.Stderr},
+		out: os.Stdout,
+	}
+	fs := flag.NewFlagSet("autocertctl dev "+name, flag.ContinueOnError)
+	fs.StringVar(&e.cluster, "name", defaultCluster, "the `name` of the kind cluster")
+	fs.StringVar(&e.initImage, "init-image", defaultInitImage, "the `image` installing step-ca and autocert")
+	fs.StringVar(&e.repo, "repo", ".", "the `directory` of the autocert repository, where the examples are built from")
+	fs.BoolVar(&e.example, "example", true, "deploy the hello-mtls example")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	return e, nil
+}
+
+func devUp(ctx context.Context, args []string) error {
+	e, err := newDevEnv("up", args)
+	if err != nil {
+		return err
+	}
+	return e.up(ctx)
+}
+
+func devDown(ctx context.Context, args []string) error {
+	e, err := newDevEnv("down", args)
+	if err != nil {
+		return err
+	}
+	return e.down(ctx)
+}
+
+// up creates the cluster, installs autocert and deploys the example. Steps
+// already done, like a cluster already created, are skipped, so up can be
+// run again after a failure.
+func (e *devEnv) up(ctx context.Context) error {
+	tools := []string{"kind", "kubectl"}
+	if e.example {
+		tools = append(tools, "docker")
+		if _, err := os.Stat(e.exampleDir(exampleApps[0])); err != nil {
+			return fmt.Errorf("hello-mtls example not found, run from the autocert repository or set -repo: %w", err)
+		}
+	}
+	for _, tool := range tools {
+		if err := e.cmd.lookPath(tool); err != nil {
+			return fmt.Errorf("%s is required: %w", tool, err)
+		}
+	}
+
+	clusters, err := e.cmd.output(ctx, "kind", "get", "clusters")
+	if err != nil {
+		return fmt.Errorf("list kind clusters: %w", err)
+	}
+	if slices.Contains(strings.Fields(clusters), e.cluster) {
+		e.step("Using kind cluster %s", e.cluster)
+	} else {
+		e.step("Creating kind cluster %s", e.cluster)
+		if err := e.cmd.run(ctx, nil, "kind", "create", "cluster", "--name", e.cluster, "--wait", "2m"); err != nil {
+			return fmt.Errorf("create kind cluster: %w", err)
+		}
+	}
+
+	if _, err := e.cmd.output(ctx, "kubectl", e.kubectl("-n", "step", "get", "deployment", "autocert")...); err == nil {
+		e.step("Using the autocert installed in the cluster")
+	} else if err := e.install(ctx); err != nil {
+		return err
+	}
+
+	if err := e.cmd.run(ctx, nil, "kubectl", e.kubectl("label", "namespace", exampleNamespace, "autocert.step.sm=enabled", "--overwrite")...); err != nil {
+		return fmt.Errorf("enable autocert in namespace %s: %w", exampleNamespace, err)
+	}
+
+	if e.example {
+		if err := e.deployExample(ctx); err != nil {
+			return err
+		}
+	}
+
+	e.step("Ready, follow the mTLS requests of the client with:")
+	fmt.Fprintf(e.out, "\n  kubectl --context kind-%s logs -f deployment/hello-mtls-client\n\n", e.cluster)
+	return nil
+}
+
+// install runs the autocert-init installer, with cluster-admin granted only
+// while it runs.
+func (e *devEnv) install(ctx context.Context) (err error) {
+	e.step("Installing step-ca and autocert")
+	if err := e.cmd.run(ctx, []byte(initBindingManifest), "kubectl", e.kubectl("apply", "-f", "-")...); err != nil {
+		return fmt.Errorf("grant cluster-admin to the installer: %w", err)
+	}
+	defer func() {
+		if derr := e.cmd.run(ctx, nil, "kubectl", e.kubectl("delete", "clusterrolebinding", initBinding, "--ignore-not-found")...); derr != nil && err == nil {
+			err = fmt.Errorf("revoke cluster-admin from the installer: %w", derr)
+		}
+	}()
+	if err := e.cmd.run(ctx, nil, "kubectl", e.kubectl("run", "autocert-init", "--rm", "--attach", "--restart", "Never",
+		"--pod-running-timeout", "5m", "--image", e.initImage)...); err != nil {
+		return fmt.Errorf("install autocert: %w", err)
+	}
+	return nil
+}
+
+// deployExample builds the hello-mtls images, loads them in the cluster and
+// waits for the apps to run with their certificates.
+func (e *devEnv) deployExample(ctx context.Context) error {
+	for _, app := range exampleApps {
+		dir := e.exampleDir(app)
+		image := "hello-mtls-" + app + "-go:latest"
+		e.step("Deploying hello-mtls %s", app)
+		if err := e.cmd.run(ctx, nil, "docker", "build", "-f", filepath.Join(dir, "Dockerfile."+app), "-t", image, e.repo); err != nil {
+			return fmt.Errorf("build %s: %w", image, err)
+		}
+		if err := e.cmd.run(ctx, nil, "kind", "load", "docker-image", image, "--name", e.cluster); err != nil {
+			return fmt.Errorf("load %s: %w", image, err)
+		}
+		if err := e.cmd.run(ctx, nil, "kubectl", e.kubectl("-n", exampleNamespace, "apply", "-f", filepath.Join(dir, "hello-mtls."+app+".yaml"))...); err != nil {
+			return fmt.Errorf("deploy hello-mtls %s: %w", app, err)
+		}
+	}
+	for _, deployment := range []string{"hello-mtls", "hello-mtls-client"} {
+		if err := e.cmd.run(ctx, nil, "kubectl", e.kubectl("-n", exampleNamespace, "rollout", "status", "deployment/"+deployment, "--timeout", "5m")...); err != nil {
+			return fmt.Errorf("wait for %s: %w", deployment, err)
+		}
+	}
+	return nil
+}
+
+// down deletes the cluster.
+func (e *devEnv) down(ctx context.Context) error {
+	e.step("Deleting kind cluster %s", e.cluster)
+	if err := e.cmd.run(ctx, nil, "kind", "delete", "cluster", "--name", e.cluster); err != nil {
+		return fmt.Errorf("delete kind cluster: %w", err)
+	}
+	return nil
+}
+
+// kubectl returns the arguments of a kubectl command on the cluster, whatever
+// the current context.
+func (e *devEnv) kubectl(args ...string) []string {
+	return append([]string{"--context", "kind-" + e.cluster}, args...)
+}
+
+func (e *devEnv) exampleDir(app string) string {
+	return filepath.Join(e.repo, "examples", "hello-mtls", "go", app)
+}
+
+func (e *devEnv) step(format string, args ...any) {
+	fmt.Fprintf(e.out, "==> "+format+"\n", args...)
+}
+
+// execCommander runs the tools installed on the host, streaming their output
+// to out.
+type execCommander struct {
+	out io.Writer
+}
+
+func (execCommander) lookPath(name string) error {
+	_, err := exec.LookPath(name)
+	return err
+}
+
+func (c execCommander) output(ctx context.Context, name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), err
+}
+
+func (c execCommander) run(ctx context.Context, stdin []byte, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stdout = c.out
+	cmd.Stderr = c.out
+	return cmd.Run()
+}
+
+func (c execCommander) start(ctx context.Context, name string, args ...string) (io.Reader, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = c.out
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go cmd.Wait() //nolint:errcheck // the command is killed with the context
+	return out, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCommander records the commands and returns the configured outputs and
+// errors, by command line prefix.
+type fakeCommander struct {
+	missing  string
+	outputs  map[string]string
+	failures map[string]error
+	commands []string
+	stdin    map[string]string
+}
+
+func (f *fakeCommander) lookPath(name string) error {
+	if name == f.missing {
+		return errors.New("executable file not found in $PATH")
+	}
+	return nil
+}
+
+func (f *fakeCommander) record(stdin []byte, name string, args []string) (string, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	f.commands = append(f.commands, line)
+	if stdin != nil {
+		if f.stdin == nil {
+			f.stdin = make(map[string]string)
+		}
+		f.stdin[line] = string(stdin)
+	}
+	for prefix, err := range f.failures {
+		if strings.HasPrefix(line, prefix) {
+			return "", err
+		}
+	}
+	return f.outputs[line], nil
+}
+
+func (f *fakeCommander) output(_ context.Context, name string, args ...string) (string, error) {
+	return f.record(nil, name, args)
+}
+
+func (f *fakeCommander) run(_ context.Context, stdin []byte, name string, args ...string) error {
+	_, err := f.record(stdin, name, args)
+	return err
+}
+
+func (f *fakeCommander) start(_ context.Context, name string, args ...string) (io.Reader, error) {
+	out, err := f.record(nil, name, args)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(out), nil
+}
+
+func testRepo(t *testing.T) string {
+	dir := t.TempDir()
+	for _, app := range exampleApps {
+		if err := os.MkdirAll(filepath.Join(dir, "examples", "hello-mtls", "go", app), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDevUp(t *testing.T) {
+	repo := testRepo(t)
+	f := &fakeCommander{
+		failures: map[string]error{
+			"kubectl --context kind-dev -n step get deployment autocert": errors.New("not found"),
+		},
+	}
+	e := &devEnv{cluster: "dev", initImage: defaultInitImage, repo: repo, example: true, cmd: f, out: io.Discard}
+	if err := e.up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	server := filepath.Join(repo, "examples/hello-mtls/go/server")
+	client := filepath.Join(repo, "examples/hello-mtls/go/client")
+	want := []string{
+		"kind get clusters",
+		"kind create cluster --name dev --wait 2m",
+		"kubectl --context kind-dev -n step get deployment autocert",
+		"kubectl --context kind-dev apply -f -",
+		"kubectl --context kind-dev run autocert-init --rm --attach --restart Never --pod-running-timeout 5m --image " + defaultInitImage,
+		"kubectl --context kind-dev delete clusterrolebinding autocert-init-binding --ignore-not-found",
+		"kubectl --context kind-dev label namespace default autocert.step.sm=enabled --overwrite",
+		"docker build -f " + server + "/Dockerfile.server -t hello-mtls-server-go:latest " + repo,
+		"kind load docker-image hello-mtls-server-go:latest --name dev",
+		"kubectl --context kind-dev -n default apply -f " + server + "/hello-mtls.server.yaml",
+		"docker build -f " + client + "/Dockerfile.client -t hello-mtls-client-go:latest " + repo,
+		"kind load docker-image hello-mtls-client-go:latest --name dev",
+		"kubectl --context kind-dev -n default apply -f " + client + "/hello-mtls.client.yaml",
+		"kubectl --context kind-dev -n default rollout status deployment/hello-mtls --timeout 5m",
+		"kubectl --context kind-dev -n default rollout status deployment/hello-mtls-client --timeout 5m",
+	}
+	if strings.Join(f.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(f.commands, "\n"), strings.Join(want, "\n"))
+	}
+	if s := f.stdin["kubectl --context kind-dev apply -f -"]; !strings.Contains(s, "name: cluster-admin") {
+		t.Errorf("apply stdin = %q, want the installer binding", s)
+	}
+}
+
+func TestDevUpExisting(t *testing.T) {
+	f := &fakeCommander{
+		outputs: map[string]string{"kind get clusters": "kind\ndev\n"},
+	}
+	e := &devEnv{cluster: "dev", initImage: defaultInitImage, example: false, cmd: f, out: io.Discard}
+	if err := e.up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"kind get clusters",
+		"kubectl --context kind-dev -n step get deployment autocert",
+		"kubectl --context kind-dev label namespace default autocert.step.sm=enabled --overwrite",
+	}
+	if strings.Join(f.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(f.commands, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDevUpErrors(t *testing.T) {
+	t.Run("missing tool", func(t *testing.T) {
+		e := &devEnv{cluster: "dev", repo: testRepo(t), example: true, cmd: &fakeCommander{missing: "docker"}, out: io.Discard}
+		if err := e.up(context.Background()); err == nil || !strings.Contains(err.Error(), "docker is required") {
+			t.Errorf("up() = %v, want docker is required", err)
+		}
+	})
+
+	t.Run("missing example", func(t *testing.T) {
+		e := &devEnv{cluster: "dev", repo: t.TempDir(), example: true, cmd: &fakeCommander{}, out: io.Discard}
+		if err := e.up(context.Background()); err == nil || !strings.Contains(err.Error(), "-repo") {
+			t.Errorf("up() = %v, want an error suggesting -repo", err)
+		}
+	})
+
+	t.Run("installer fails", func(t *testing.T) {
+		f := &fakeCommander{
+			outputs: map[string]string{"kind get clusters": "dev\n"},
+			failures: map[string]error{
+				"kubectl --context kind-dev -n step get": errors.New("not found"),
+				"kubectl --context kind-dev run":         errors.New("exit status 1"),
+			},
+		}
+		e := &devEnv{cluster: "dev", initImage: defaultInitImage, cmd: f, out: io.Discard}
+		if err := e.up(context.Background()); err == nil || !strings.Contains(err.Error(), "install autocert") {
+			t.Errorf("up() = %v, want install autocert error", err)
+		}
+		if last := f.commands[len(f.commands)-1]; !strings.Contains(last, "delete clusterrolebinding "+initBinding) {
+			t.Errorf("last command = %q, want the installer binding deleted", last)
+		}
+	})
+}
+
+func TestNewDevEnv(t *testing.T) {
+	e, err := newDevEnv("up", []string{"-name", "test", "-example=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.cluster != "test" || e.example || e.initImage != defaultInitImage || e.repo != "." {
+		t.Errorf("newDevEnv() = %+v", e)
+	}
+	if _, err := newDevEnv("up", []string{"extra"}); err == nil {
+		t.Error("newDevEnv() with arguments should fail")
+	}
+}
@@ -0,0 +1,61 @@
+// Command autocertctl helps working with autocert. It manages a local
+// development environment:
+//
+//	autocertctl dev up     # kind cluster with step-ca, autocert and hello-mtls
+//	autocertctl dev down   # delete the cluster
+//
+// Run it from a checkout of the repository, the examples are built from
+// source.
+//
+// It also rotates the provisioner credentials of an installed controller
+// without downtime:
+//
+//	autocertctl rotate-provisioner start -name autocert-2 -kid <kid> -password-file <file>
+//	autocertctl rotate-provisioner activate   # mint the tokens with the new provisioner
+//	autocertctl rotate-provisioner finish     # remove the old credentials
+//	autocertctl rotate-provisioner abort      # or remove the new ones
+//	autocertctl rotate-provisioner status
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const usage = `Usage: autocertctl dev up [flags]
+       autocertctl dev down [flags]
+       autocertctl rotate-provisioner start|activate|finish|abort|status [flags]
+
+Run "autocertctl dev up -h" or "autocertctl rotate-provisioner start -h" for
+the flags.`
+
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch command := os.Args[1] + " " + os.Args[2]; command {
+	case "dev up":
+		err = devUp(ctx, os.Args[3:])
+	case "dev down":
+		err = devDown(ctx, os.Args[3:])
+	case "rotate-provisioner start", "rotate-provisioner activate", "rotate-provisioner finish",
+		"rotate-provisioner abort", "rotate-provisioner status":
+		err = rotateProvisioner(ctx, os.Args[2], os.Args[3:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "autocertctl:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/smallstep/autocert/pkg/controller"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// configKey is the key of the configuration in the ConfigMap of the
+	// controller.
+	configKey = "config.yaml"
+	// nextProvisionerKey is the key of the next provisioner in the
+	// configuration.
+	nextProvisionerKey = "nextProvisioner"
+	// nextPasswordKey is the key of the password of the next provisioner in
+	// the password Secret.
+	nextPasswordKey = "next-password"
+	// defaultRotationTimeout is how long a step waits for the rollout of the
+	// controller.
+	defaultRotationTimeout = 5 * time.Minute
+)
+
+// rotation rotates the provisioner credentials of a running controller in
+// steps, each one rolled out and verified before the next:
+//
+//   - start adds the new credentials next to the current ones, the new
+//     controller pods don't start if they don't work.
+//   - activate mints the tokens with the new credentials.
+//   - finish makes the new credentials the only ones.
+//   - abort removes the new credentials.
+type rotation struct {
+	kubeContext  string
+	namespace    string
+	deployment   string
+	configMap    string
+	secret       string
+	service      string
+	reader       string
+	webhook      string
+	name         string
+	kid          string
+	passwordFile string
+	timeout      time.Duration
+	cmd          commander
+	out          io.Writer
+}
+
+func newRotation(name string, args []string) (*rotation, error) {
+	r := &rotation{
+		cmd: execCommander{out: os.Stderr},
+		out: os.Stdout,
+	}
+	fs := flag.NewFlagSet("autocertctl rotate-provisioner "+name, flag.ContinueOnError)
+	fs.StringVar(&r.kubeContext, "context", "", "the kubectl `context`, defaults to the current one")
+	fs.StringVar(&r.namespace, "namespace", "step", "the `namespace` of autocert")
+	fs.StringVar(&r.deployment, "deployment", "autocert", "the `name` of the Deployment of the controller")
+	fs.StringVar(&r.configMap, "configmap", "autocert-config", "the `name` of the ConfigMap of the controller")
+	fs.StringVar(&r.secret, "secret", "autocert-password", "the `name` of the Secret with the provisioner password")
+	fs.StringVar(&r.service, "service", "autocert", "the `name` of the Service of the controller")
+	fs.StringVar(&r.reader, "reader", "", "the `name` of a service account of the namespace allowed to get /provisioner, required with endpointAuth")
+	fs.StringVar(&r.webhook, "webhook-config", "autocert-webhook-config", "the `name` of the MutatingWebhookConfiguration with the CA of the controller, used with -reader")
+	fs.DurationVar(&r.timeout, "timeout", defaultRotationTimeout, "how long to wait for the rollout of the controller")
+	if name == "start" {
+		fs.StringVar(&r.name, "name", "", "the `name` of the new provisioner")
+		fs.StringVar(&r.kid, "kid", "", "the key ID of the new provisioner")
+		fs.StringVar(&r.passwordFile, "password-file", "", "the `file` with the password of the new provisioner")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	if name == "start" && (r.name == "" || r.kid == "" || r.passwordFile == "") {
+		return nil, errors.New("-name, -kid and -password-file are required")
+	}
+	return r, nil
+}
+
+func rotateProvisioner(ctx context.Context, step string, args []string) error {
+	r, err := newRotation(step, args)
+	if err != nil {
+		return err
+	}
+	switch step {
+	case "start":
+		return r.start(ctx)
+	case "activate":
+		return r.activate(ctx)
+	case "finish":
+		return r.finish(ctx)
+	case "abort":
+		return r.abort(ctx)
+	case "status":
+		s, err := r.status(ctx)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(r.out, string(b))
+		return nil
+	default:
+		return fmt.Errorf("unknown step %q", step)
+	}
+}
+
+// controllerConfig is the part of the configuration of the controller
+// changed by a rotation.
+type controllerConfig struct {
+	ProvisionerName         string                     `json:"provisionerName"`
+	ProvisionerPasswordPath string                     `json:"provisionerPasswordPath"`
+	NextProvisioner         controller.NextProvisioner `json:"nextProvisioner"`
+}
+
+// passwordPath returns the path of the password of the current provisioner.
+func (c controllerConfig) passwordPath() string {
+	return (&controller.Config{ProvisionerPasswordPath: c.ProvisionerPasswordPath}).GetProvisionerPasswordPath()
+}
+
+// start stores the new password next to the current one, adds the new
+// provisioner to the configuration and checks the controller loaded it.
+func (r *rotation) start(ctx context.Context) error {
+	password, err := os.ReadFile(r.passwordFile)
+	if err != nil {
+		return err
+	}
+	password = bytes.TrimRight(password, " \t\r\n")
+	if len(password) == 0 {
+		return fmt.Errorf("%s is empty", r.passwordFile)
+	}
+	text, config, err := r.config(ctx)
+	if err != nil {
+		return err
+	}
+	if config.NextProvisioner.Name != "" {
+		return fmt.Errorf("a rotation to provisioner %s is in progress, finish or abort it first", config.NextProvisioner.Name)
+	}
+
+	r.step("Storing the password of provisioner %s in secret %s", r.name, r.secret)
+	patch, err := json.Marshal(map[string]any{"stringData": map[string]string{nextPasswordKey: string(password)}})
+	if err != nil {
+		return err
+	}
+	if err := r.cmd.run(ctx, patch, "kubectl", r.kubectl("patch", "secret", r.secret, "--type", "merge", "--patch-file", "/dev/stdin")...); err != nil {
+		return fmt.Errorf("store the password: %w", err)
+	}
+
+	next := controller.NextProvisioner{
+		Name:         r.name,
+		Kid:          r.kid,
+		PasswordPath: path.Join(path.Dir(config.passwordPath()), nextPasswordKey),
+	}
+	if err := r.updateConfig(ctx, setBlock(text, nextProvisionerKey, nextProvisionerBlock(next))); err != nil {
+		return err
+	}
+	if err := r.restart(ctx); err != nil {
+		return err
+	}
+	return r.verify(ctx, func(s controller.ProvisionerStatus) error {
+		if err := checkCredential("next", s.Next, next.Name, next.Kid); err != nil {
+			return err
+		}
+		r.step("Provisioner %s loaded, run activate to mint the tokens with it", next.Name)
+		return nil
+	})
+}
+
+// activate mints the tokens with the new provisioner.
+func (r *rotation) activate(ctx context.Context) error {
+	text, config, err := r.config(ctx)
+	if err != nil {
+		return err
+	}
+	next := config.NextProvisioner
+	if next.Name == "" {
+		return errors.New("no rotation in progress, run start first")
+	}
+	next.Active = true
+	if err := r.updateConfig(ctx, setBlock(text, nextProvisionerKey, nextProvisionerBlock(next))); err != nil {
+		return err
+	}
+	if err := r.restart(ctx); err != nil {
+		return err
+	}
+	return r.verify(ctx, func(s controller.ProvisionerStatus) error {
+		if s.Active != "next" {
+			return fmt.Errorf("the controller mints the tokens with the %s provisioner", s.Active)
+		}
+		r.step("Tokens minted with provisioner %s, run finish to remove the old credentials", next.Name)
+		return nil
+	})
+}
+
+// finish replaces the current credentials with the new ones.
+func (r *rotation) finish(ctx context.Context) error {
+	text, config, err := r.config(ctx)
+	if err != nil {
+		return err
+	}
+	next := config.NextProvisioner
+	if next.Name == "" {
+		return errors.New("no rotation in progress, run start first")
+	}
+	if !next.Active {
+		return errors.New("the new provisioner is not active, run activate first")
+	}
+
+	r.step("Replacing the password in secret %s", r.secret)
+	var secret struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := r.get(ctx, &secret, "secret", r.secret); err != nil {
+		return err
+	}
+	nextKey, currentKey := path.Base(next.PasswordPath), path.Base(config.passwordPath())
+	if _, ok := secret.Data[nextKey]; !ok {
+		return fmt.Errorf("secret %s has no key %s", r.secret, nextKey)
+	}
+	patch, err := json.Marshal([]map[string]string{
+		{"op": "add", "path": "/data/" + currentKey, "value": secret.Data[nextKey]},
+		{"op": "remove", "path": "/data/" + nextKey},
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.cmd.run(ctx, patch, "kubectl", r.kubectl("patch", "secret", r.secret, "--type", "json", "--patch-file", "/dev/stdin")...); err != nil {
+		return fmt.Errorf("replace the password: %w", err)
+	}
+
+	text = removeBlock(text, nextProvisionerKey)
+	if config.ProvisionerName != "" {
+		text = setValue(text, "provisionerName", next.Name)
+	}
+	if err := r.updateConfig(ctx, text); err != nil {
+		return err
+	}
+	r.step("Rolling out deployment %s with provisioner %s", r.deployment, next.Name)
+	if err := r.cmd.run(ctx, nil, "kubectl", r.kubectl("set", "env", "deployment/"+r.deployment,
+		"PROVISIONER_NAME="+next.Name, "PROVISIONER_KID="+next.Kid)...); err != nil {
+		return fmt.Errorf("set the provisioner of deployment %s: %w", r.deployment, err)
+	}
+	if err := r.wait(ctx); err != nil {
+		return err
+	}
+	return r.verify(ctx, func(s controller.ProvisionerStatus) error {
+		if s.Next != nil {
+			return fmt.Errorf("the controller still has a next provisioner %s", s.Next.Name)
+		}
+		if err := checkCredential("current", s.Current, next.Name, next.Kid); err != nil {
+			return err
+		}
+		r.step("Rotation finished, remove the old provisioner from the CA once the certificates bootstrapped with its tokens are issued")
+		return nil
+	})
+}
+
+// abort removes the new provisioner and its password.
+func (r *rotation) abort(ctx context.Context) error {
+	text, config, err := r.config(ctx)
+	if err != nil {
+		return err
+	}
+	next := config.NextProvisioner
+	if next.Name == "" {
+		return errors.New("no rotation in progress")
+	}
+	if err := r.updateConfig(ctx, removeBlock(text, nextProvisionerKey)); err != nil {
+		return err
+	}
+	if err := r.restart(ctx); err != nil {
+		return err
+	}
+	r.step("Removing the password of provisioner %s from secret %s", next.Name, r.secret)
+	patch, err := json.Marshal([]map[string]string{{"op": "remove", "path": "/data/" + path.Base(next.PasswordPath)}})
+	if err != nil {
+		return err
+	}
+	if err := r.cmd.run(ctx, patch, "kubectl", r.kubectl("patch", "secret", r.secret, "--type", "json", "--patch-file", "/dev/stdin")...); err != nil {
+		return fmt.Errorf("remove the password: %w", err)
+	}
+	return r.verify(ctx, func(s controller.ProvisionerStatus) error {
+		if s.Next != nil {
+			return fmt.Errorf("the controller still has a next provisioner %s", s.Next.Name)
+		}
+		r.step("Rotation aborted")
+		return nil
+	})
+}
+
+// config returns the configuration of the controller, as text and parsed.
+func (r *rotation) config(ctx context.Context) (string, *controllerConfig, error) {
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := r.get(ctx, &cm, "configmap", r.configMap); err != nil {
+		return "", nil, err
+	}
+	text, ok := cm.Data[configKey]
+	if !ok {
+		return "", nil, fmt.Errorf("configmap %s has no key %s", r.configMap, configKey)
+	}
+	var config controllerConfig
+	if err := yaml.Unmarshal([]byte(text), &config); err != nil {
+		return "", nil, fmt.Errorf("parse configmap %s: %w", r.configMap, err)
+	}
+	return text, &config, nil
+}
+
+// updateConfig replaces the configuration of the controller.
+func (r *rotation) updateConfig(ctx context.Context, text string) error {
+	r.step("Updating configmap %s", r.configMap)
+	patch, err := json.Marshal(map[string]any{"data": map[string]string{configKey: text}})
+	if err != nil {
+		return err
+	}
+	if err := r.cmd.run(ctx, patch, "kubectl", r.kubectl("patch", "configmap", r.configMap, "--type", "merge", "--patch-file", "/dev/stdin")...); err != nil {
+		return fmt.Errorf("update configmap %s: %w", r.configMap, err)
+	}
+	return nil
+}
+
+// restart rolls out the controller with its new configuration. The old pods
+// keep serving if the new ones don't start.
+func (r *rotation) restart(ctx context.Context) error {
+	r.step("Restarting deployment %s", r.deployment)
+	if err := r.cmd.run(ctx, nil, "kubectl", r.kubectl("rollout", "restart", "deployment/"+r.deployment)...); err != nil {
+		return fmt.Errorf("restart deployment %s: %w", r.deployment, err)
+	}
+	return r.wait(ctx)
+}
+
+func (r *rotation) wait(ctx context.Context) error {
+	if err := r.cmd.run(ctx, nil, "kubectl", r.kubectl("rollout", "status", "deployment/"+r.deployment, "--timeout", r.timeout.String())...); err != nil {
+		return fmt.Errorf("wait for deployment %s, the previous pods keep running, check the logs of the new ones: %w", r.deployment, err)
+	}
+	return nil
+}
+
+// status returns the provisioners of the controller, through the API server
+// proxy. The API server doesn't forward the credentials of the caller, so with
+// a reader, required when endpointAuth protects /provisioner, the controller
+// is reached with a port forward and the token of the reader instead.
+func (r *rotation) status(ctx context.Context) (controller.ProvisionerStatus, error) {
+	var s controller.ProvisionerStatus
+	var out string
+	var err error
+	if r.reader != "" {
+		out, err = r.forwardedStatus(ctx)
+	} else {
+		out, err = r.cmd.output(ctx, "kubectl", r.kubectl("get", "--raw",
+			"/api/v1/namespaces/"+r.namespace+"/services/https:"+r.service+":443/proxy/provisioner")...)
+	}
+	if err != nil {
+		return s, fmt.Errorf("get the provisioners of the controller: %w", err)
+	}
+	if err := json.Unmarshal([]byte(out), &s); err != nil {
+		return s, fmt.Errorf("parse the provisioners of the controller: %w", err)
+	}
+	return s, nil
+}
+
+// forwardedStatus gets /provisioner through a port forward to the Service of
+// the controller, with a short-lived token of the reader. The certificate of
+// the controller is verified with the CA bundle of the webhook configuration.
+func (r *rotation) forwardedStatus(ctx context.Context) (string, error) {
+	token, err := r.cmd.output(ctx, "kubectl", r.kubectl("create", "token", r.reader, "--duration", "10m")...)
+	if err != nil {
+		return "", fmt.Errorf("create a token for %s: %w", r.reader, err)
+	}
+	bundle, err := r.cmd.output(ctx, "kubectl", r.kubectl("get", "mutatingwebhookconfiguration", r.webhook,
+		"-o", "jsonpath={.webhooks[0].clientConfig.caBundle}")...)
+	if err != nil {
+		return "", fmt.Errorf("get the CA of the controller: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if pem, err := base64.StdEncoding.DecodeString(strings.TrimSpace(bundle)); err != nil || !roots.AppendCertsFromPEM(pem) {
+		return "", fmt.Errorf("mutatingwebhookconfiguration %s has no CA bundle", r.webhook)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stdout, err := r.cmd.start(ctx, "kubectl", r.kubectl("port-forward", "service/"+r.service, ":443")...)
+	if err != nil {
+		return "", fmt.Errorf("forward a port to service %s: %w", r.service, err)
+	}
+	addr, err := forwardedAddress(stdout)
+	if err != nil {
+		return "", fmt.Errorf("forward a port to service %s: %w", r.service, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+addr+"/provisioner", http.NoBody)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(token))
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:    roots,
+			ServerName: r.service + "." + r.namespace + ".svc",
+			MinVersion: tls.VersionTLS12,
+		}},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+// forwardedAddress returns the local address of a port forward, from the
+// output of kubectl port-forward:
+//
+//	Forwarding from 127.0.0.1:38461 -> 4443
+func forwardedAddress(out io.Reader) (string, error) {
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		if rest, ok := strings.CutPrefix(scanner.Text(), "Forwarding from "); ok {
+			addr, _, _ := strings.Cut(rest, " ")
+			return addr, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("kubectl port-forward exited")
+}
+
+// verify checks the provisioners of the controller after a step.
+func (r *rotation) verify(ctx context.Context, check func(controller.ProvisionerStatus) error) error {
+	s, err := r.status(ctx)
+	if err != nil {
+		return err
+	}
+	if err := check(s); err != nil {
+		return fmt.Errorf("verify the controller: %w", err)
+	}
+	return nil
+}
+
+// checkCredential returns an error if the provisioner loaded by the
+// controller is not the expected one, or not on the CA.
+func checkCredential(which string, c *controller.CredentialStatus, name, kid string) error {
+	switch {
+	case c == nil:
+		return fmt.Errorf("the controller has no %s provisioner", which)
+	case c.Name != name || c.Kid != kid:
+		return fmt.Errorf("the %s provisioner is %s (%s), want %s (%s)", which, c.Name, c.Kid, name, kid)
+	case c.Error != "":
+		return fmt.Errorf("check provisioner %s on the CA: %s", name, c.Error)
+	case !c.OnCA:
+		return fmt.Errorf("provisioner %s (%s) is not on the CA", name, kid)
+	}
+	return nil
+}
+
+// get decodes an object of the namespace.
+func (r *rotation) get(ctx context.Context, v any, kind, name string) error {
+	out, err := r.cmd.output(ctx, "kubectl", r.kubectl("get", kind, name, "-o", "json")...)
+	if err != nil {
+		return fmt.Errorf("get %s %s: %w", kind, name, err)
+	}
+	if err := json.Unmarshal([]byte(out), v); err != nil {
+		return fmt.Errorf("parse %s %s: %w", kind, name, err)
+	}
+	return nil
+}
+
+// kubectl returns the arguments of a kubectl command in the namespace of
+// autocert.
+func (r *rotation) kubectl(args ...string) []string {
+	prefix := []string{"-n", r.namespace}
+	if r.kubeContext != "" {
+		prefix = append([]string{"--context", r.kubeContext}, prefix...)
+	}
+	return append(prefix, args...)
+}
+
+func (r *rotation) step(format string, args ...any) {
+	fmt.Fprintf(r.out, "==> "+format+"\n", args...)
+}
+
+// nextProvisionerBlock returns the configuration of the next provisioner.
+// The values are JSON strings, valid YAML whatever they contain.
+func nextProvisionerBlock(n controller.NextProvisioner) string {
+	quote := func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+	return fmt.Sprintf("%s:\n  name: %s\n  kid: %s\n  passwordPath: %s\n  active: %t\n",
+		nextProvisionerKey, quote(n.Name), quote(n.Kid), quote(n.PasswordPath), n.Active)
+}
+
+// removeBlock removes a top-level key and its indented lines from a YAML
+// document, keeping the rest of it as written.
+func removeBlock(text, key string) string {
+	var b strings.Builder
+	inBlock := false
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, key+":"):
+			inBlock = true
+			continue
+		case inBlock && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") || strings.TrimSpace(line) == ""):
+			continue
+		}
+		inBlock = false
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// setBlock replaces a top-level key of a YAML document with block, or adds
+// it at the end.
+func setBlock(text, key, block string) string {
+	text = removeBlock(text, key)
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text + block
+}
+
+// setValue replaces the value of a top-level scalar key of a YAML document.
+func setValue(text, key, value string) string {
+	b, _ := json.Marshal(value)
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, key+":") {
+			lines[i] = key + ": " + string(b)
+			if strings.HasSuffix(line, "\n") {
+				lines[i] += "\n"
+			}
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/autocert/pkg/controller"
+)
+
+const testConfig = `logFormat: json
+caUrl: https://ca.step.svc.cluster.local
+renewer:
+  name: autocert-renewer
+`
+
+func configMapJSON(t *testing.T, config string) string {
+	t.Helper()
+	b, err := json.Marshal(map[string]any{"data": map[string]string{configKey: config}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func statusJSON(t *testing.T, s controller.ProvisionerStatus) string {
+	t.Helper()
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+const (
+	getConfigMap = "kubectl -n step get configmap autocert-config -o json"
+	getStatus    = "kubectl -n step get --raw /api/v1/namespaces/step/services/https:autocert:443/proxy/provisioner"
+	patchConfig  = "kubectl -n step patch configmap autocert-config --type merge --patch-file /dev/stdin"
+	patchSecret  = "kubectl -n step patch secret autocert-password --type merge --patch-file /dev/stdin"
+	jsonSecret   = "kubectl -n step patch secret autocert-password --type json --patch-file /dev/stdin"
+	restart      = "kubectl -n step rollout restart deployment/autocert"
+	rolloutWait  = "kubectl -n step rollout status deployment/autocert --timeout 5m0s"
+)
+
+// patchedConfig returns the configuration written by the ConfigMap patch.
+func patchedConfig(t *testing.T, f *fakeCommander) string {
+	t.Helper()
+	var patch struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(f.stdin[patchConfig]), &patch); err != nil {
+		t.Fatal(err)
+	}
+	return patch.Data[configKey]
+}
+
+func testRotation(f *fakeCommander) *rotation {
+	return &rotation{
+		namespace:  "step",
+		deployment: "autocert",
+		configMap:  "autocert-config",
+		secret:     "autocert-password",
+		service:    "autocert",
+		timeout:    defaultRotationTimeout,
+		cmd:        f,
+		out:        io.Discard,
+	}
+}
+
+func TestRotationStart(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeCommander{outputs: map[string]string{
+		getConfigMap: configMapJSON(t, testConfig),
+		getStatus: statusJSON(t, controller.ProvisionerStatus{
+			Active:  "current",
+			Current: &controller.CredentialStatus{Name: "autocert", Kid: "old", OnCA: true},
+			Next:    &controller.CredentialStatus{Name: "autocert-2", Kid: "new", OnCA: true},
+		}),
+	}}
+	r := testRotation(f)
+	r.name, r.kid, r.passwordFile = "autocert-2", "new", passwordFile
+	if err := r.start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{getConfigMap, patchSecret, patchConfig, restart, rolloutWait, getStatus}
+	if strings.Join(f.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(f.commands, "\n"), strings.Join(want, "\n"))
+	}
+	if s := f.stdin[patchSecret]; s != `{"stringData":{"next-password":"s3cr3t"}}` {
+		t.Errorf("secret patch = %s", s)
+	}
+	wantConfig := testConfig + `nextProvisioner:
+  name: "autocert-2"
+  kid: "new"
+  passwordPath: "/home/step/password/next-password"
+  active: false
+`
+	if got := patchedConfig(t, f); got != wantConfig {
+		t.Errorf("config:\n%s\nwant:\n%s", got, wantConfig)
+	}
+
+	// The new provisioner must be on the CA.
+	f.outputs[getStatus] = statusJSON(t, controller.ProvisionerStatus{
+		Active: "current",
+		Next:   &controller.CredentialStatus{Name: "autocert-2", Kid: "new"},
+	})
+	if err := r.start(context.Background()); err == nil || !strings.Contains(err.Error(), "not on the CA") {
+		t.Errorf("start() = %v, want not on the CA", err)
+	}
+
+	// Only one rotation at a time.
+	f.outputs[getConfigMap] = configMapJSON(t, patchedConfig(t, f))
+	if err := r.start(context.Background()); err == nil || !strings.Contains(err.Error(), "in progress") {
+		t.Errorf("start() = %v, want a rotation in progress", err)
+	}
+}
+
+func TestRotationActivateFinish(t *testing.T) {
+	config := "provisionerName: autocert\n" + testConfig + nextProvisionerBlock(controller.NextProvisioner{
+		Name: "autocert-2", Kid: "new", PasswordPath: "/home/step/password/next-password",
+	})
+	f := &fakeCommander{outputs: map[string]string{
+		getConfigMap: configMapJSON(t, config),
+		getStatus:    statusJSON(t, controller.ProvisionerStatus{Active: "next"}),
+	}}
+	r := testRotation(f)
+	if err := r.finish(context.Background()); err == nil || !strings.Contains(err.Error(), "activate") {
+		t.Errorf("finish() before activate = %v, want an error", err)
+	}
+	f.commands = nil
+
+	if err := r.activate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{getConfigMap, patchConfig, restart, rolloutWait, getStatus}
+	if strings.Join(f.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(f.commands, "\n"), strings.Join(want, "\n"))
+	}
+	activated := patchedConfig(t, f)
+	if !strings.Contains(activated, "  active: true\n") || strings.Count(activated, nextProvisionerKey) != 1 {
+		t.Errorf("activated config:\n%s", activated)
+	}
+
+	f.commands = nil
+	f.outputs[getConfigMap] = configMapJSON(t, activated)
+	f.outputs["kubectl -n step get secret autocert-password -o json"] = `{"data":{"password":"b2xk","next-password":"bmV3"}}`
+	f.outputs[getStatus] = statusJSON(t, controller.ProvisionerStatus{
+		Active:  "current",
+		Current: &controller.CredentialStatus{Name: "autocert-2", Kid: "new", OnCA: true},
+	})
+	if err := r.finish(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		getConfigMap,
+		"kubectl -n step get secret autocert-password -o json",
+		jsonSecret,
+		patchConfig,
+		"kubectl -n step set env deployment/autocert PROVISIONER_NAME=autocert-2 PROVISIONER_KID=new",
+		rolloutWait,
+		getStatus,
+	}
+	if strings.Join(f.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(f.commands, "\n"), strings.Join(want, "\n"))
+	}
+	if s := f.stdin[jsonSecret]; s != `[{"op":"add","path":"/data/password","value":"bmV3"},{"op":"remove","path":"/data/next-password"}]` {
+		t.Errorf("secret patch = %s", s)
+	}
+	if got, want := patchedConfig(t, f), "provisionerName: \"autocert-2\"\n"+testConfig; got != want {
+		t.Errorf("config:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRotationAbort(t *testing.T) {
+	config := testConfig + nextProvisionerBlock(controller.NextProvisioner{
+		Name: "autocert-2", Kid: "new", PasswordPath: "/home/step/password/next-password",
+	})
+	f := &fakeCommander{outputs: map[string]string{
+		getConfigMap: configMapJSON(t, config),
+		getStatus:    statusJSON(t, controller.ProvisionerStatus{Active: "current"}),
+	}}
+	if err := testRotation(f).abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{getConfigMap, patchConfig, restart, rolloutWait, jsonSecret, getStatus}
+	if strings.Join(f.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(f.commands, "\n"), strings.Join(want, "\n"))
+	}
+	if got := patchedConfig(t, f); got != testConfig {
+		t.Errorf("config:\n%s\nwant:\n%s", got, testConfig)
+	}
+}
+
+func TestRemoveBlock(t *testing.T) {
+	text := "a: 1\nnextProvisioner:\n  name: x\n\n  kid: y\nb:\n  c: 2\nnextProvisionerName: z"
+	if got, want := removeBlock(text, "nextProvisioner"), "a: 1\nb:\n  c: 2\nnextProvisionerName: z"; got != want {
+		t.Errorf("removeBlock() = %q, want %q", got, want)
+	}
+	if got, want := setBlock("a: 1", "b", "b: 2\n"), "a: 1\nb: 2\n"; got != want {
+		t.Errorf("setBlock() = %q, want %q", got, want)
+	}
+}
+
+func TestNewRotation(t *testing.T) {
+	r, err := newRotation("start", []string{"-name", "autocert-2", "-kid", "new", "-password-file", "pw", "-context", "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(r.kubectl("get", "pods"), " "); got != "--context prod -n step get pods" {
+		t.Errorf("kubectl() = %s", got)
+	}
+	if _, err := newRotation("start", []string{"-name", "autocert-2"}); err == nil {
+		t.Error("newRotation() without -kid and -password-file should fail")
+	}
+	if _, err := newRotation("activate", []string{"-name", "autocert-2"}); err == nil {
+		t.Error("newRotation() with -name should fail out of start")
+	}
+}
+
+// controllerServer returns a TLS server for the Service of the controller and
+// the base64 PEM of its CA, like in the webhook configuration.
+func controllerServer(t *testing.T, handler http.Handler) (*httptest.Server, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "autocert.step.svc"},
+		DNSNames:     []string{"autocert.step.svc"},
+		NotBefore:    ca.NotBefore,
+		NotAfter:     ca.NotAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{leafDER}, PrivateKey: key}}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return srv, base64.StdEncoding.EncodeToString(bundle)
+}
+
+func TestRotationStatusReader(t *testing.T) {
+	want := controller.ProvisionerStatus{Active: "current", Current: &controller.CredentialStatus{Name: "autocert", Kid: "old", OnCA: true}}
+	srv, bundle := controllerServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/provisioner" || r.Header.Get("Authorization") != "Bearer reader-token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(statusJSON(t, want))) //nolint:errcheck // test server
+	}))
+
+	const (
+		createToken = "kubectl -n step create token dashboard --duration 10m"
+		getBundle   = "kubectl -n step get mutatingwebhookconfiguration autocert-webhook-config -o jsonpath={.webhooks[0].clientConfig.caBundle}"
+		portForward = "kubectl -n step port-forward service/autocert :443"
+	)
+	f := &fakeCommander{outputs: map[string]string{
+		createToken: "reader-token\n",
+		getBundle:   bundle,
+		portForward: "Forwarding from " + srv.Listener.Addr().String() + " -> 4443\nForwarding from [::1]:0 -> 4443\n",
+	}}
+	r := testRotation(f)
+	r.reader = "dashboard"
+	r.webhook = "autocert-webhook-config"
+	got, err := r.status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Active != want.Active || got.Current == nil || *got.Current != *want.Current {
+		t.Errorf("status() = %+v, want %+v", got, want)
+	}
+	if cmds := []string{createToken, getBundle, portForward}; strings.Join(f.commands, "\n") != strings.Join(cmds, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(f.commands, "\n"), strings.Join(cmds, "\n"))
+	}
+
+	f.outputs[createToken] = "other-token\n"
+	if _, err := r.status(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("status() with a token not allowed = %v, want 401", err)
+	}
+}
@@ -1,31 +1,735 @@
 #!/bin/sh
 
+# Versions of the environment variables set by the controller supported by this
+# bootstrapper. Controllers that don't set AUTOCERT_PROTOCOL use version 1.
+PROTOCOL_VERSION=25
+MIN_PROTOCOL_VERSION=1
 
-if [ -f "$STEP_ROOT" ] && [ -f "$CRT" ] && [ -f "$KEY" ];
+# Exit codes, shared with the renewer, so kubectl describe tells why the
+# bootstrap failed. Timeouts of the bootstrap phases have their own codes, see
+# run_phase.
+EXIT_ERROR=1
+EXIT_CONFIG=2
+EXIT_UNREACHABLE=3
+EXIT_TOKEN_INVALID=4
+EXIT_POLICY_DENIED=5
+
+# The termination message of the container, shown by kubectl describe.
+TERMINATION_LOG=${TERMINATION_LOG:-/dev/termination-log}
+
+# fail CODE MESSAGE logs the reason of a failure, writes it to the termination
+# log, and exits with the given code.
+fail() {
+    echo "$2" >&2
+    echo "$2" > "$TERMINATION_LOG" 2>/dev/null
+    exit $1
+}
+
+# curl_error STATUS HTTP_CODE prints the exit code matching the exit status of
+# curl -f: HTTP_CODE if the server rejected the request, EXIT_UNREACHABLE if it
+# couldn't be reached.
+curl_error() {
+    case "$1" in
+        22) echo $2 ;;
+        6|7|28|35|52|56) echo $EXIT_UNREACHABLE ;;
+        *) echo $EXIT_ERROR ;;
+    esac
+}
+
+# ca_error OUTPUT prints the exit code matching the error output of step ca.
+ca_error() {
+    case "$1" in
+        *"connection refused"*|*"no such host"*|*"i/o timeout"*|*"network is unreachable"*|*"no route to host"*|*"connection reset"*)
+            echo $EXIT_UNREACHABLE ;;
+        *"not authorized"*|*"nauthorized"*|*"necessary authorization"*|*"token"*)
+            echo $EXIT_TOKEN_INVALID ;;
+        *"policy"*|*"not allowed"*|*"orbidden"*)
+            echo $EXIT_POLICY_DENIED ;;
+        *)
+            echo $EXIT_ERROR ;;
+    esac
+}
+
+if [ "${AUTOCERT_PROTOCOL:-1}" -gt "$PROTOCOL_VERSION" ]
+then
+    fail $EXIT_CONFIG "The controller uses protocol version $AUTOCERT_PROTOCOL but this bootstrapper only supports versions $MIN_PROTOCOL_VERSION to $PROTOCOL_VERSION, upgrade the bootstrapper image"
+fi
+if [ "${AUTOCERT_PROTOCOL:-1}" -lt "$MIN_PROTOCOL_VERSION" ]
+then
+    fail $EXIT_CONFIG "The controller uses protocol version $AUTOCERT_PROTOCOL but this bootstrapper only supports versions $MIN_PROTOCOL_VERSION to $PROTOCOL_VERSION, upgrade the controller"
+fi
+if [ -z "$CRT" ] || [ -z "$KEY" ] || [ -z "$STEP_ROOT" ] || [ -z "$COMMON_NAME" ]
 then
-    echo "Found existing $STEP_ROOT, $CRT, and $KEY, skipping bootstrap"
-    exit 0
+    fail $EXIT_CONFIG "\$CRT, \$KEY, \$STEP_ROOT and \$COMMON_NAME must be set"
 fi
 
-# Download the root certificate and set permissions
-if [ "$DURATION" == "" ];
+CERTS_DIR=$(dirname $CRT)
+LOCK_FILE="$CERTS_DIR/.lock"
+VERSION_FILE="$CERTS_DIR/.version"
+
+# rsa_file FILE prints the name of the RSA counterpart of a file of a
+# dual-stack pod, site-rsa.crt for site.crt. The renewer uses the same names.
+rsa_file() {
+    case "$(basename "$1")" in
+        *.*) echo "${1%.*}-rsa.${1##*.}" ;;
+        *) echo "$1-rsa" ;;
+    esac
+}
+
+# The RSA certificate and key written next to the ECDSA ones when
+# DUAL_STACK is true.
+RSA_CRT=${RSA_CRT:-$(rsa_file "$CRT")}
+RSA_KEY=${RSA_KEY:-$(rsa_file "$KEY")}
+
+# keystore_file FILE EXT prints the name of the keystore of a certificate,
+# site.p12 for site.crt. The renewer uses the same names.
+keystore_file() {
+    case "$(basename "$1")" in
+        *.*) echo "${1%.*}.$2" ;;
+        *) echo "$1.$2" ;;
+    esac
+}
+
+# The keystore and truststore written next to the PEM files when
+# KEYSTORE_FORMAT is pkcs12 or jks, protected by KEYSTORE_PASSWORD.
+case "$KEYSTORE_FORMAT" in
+    pkcs12) KEYSTORE_EXT=p12 ;;
+    jks) KEYSTORE_EXT=jks ;;
+    ""|pem) KEYSTORE_FORMAT="" ;;
+    *) fail $EXIT_CONFIG "Unknown keystore format $KEYSTORE_FORMAT, use pkcs12, jks or pem" ;;
+esac
+if [ -n "$KEYSTORE_FORMAT" ]
 then
-    step ca certificate $COMMON_NAME $CRT $KEY
-else
-    step ca certificate --not-after $DURATION $COMMON_NAME $CRT $KEY
+    KEYSTORE=$(keystore_file "$CRT" $KEYSTORE_EXT)
+    TRUSTSTORE="$CERTS_DIR/truststore.$KEYSTORE_EXT"
+fi
+
+# The flags of the key generated for the certificate, the default P-256 key
+# unless KEY_TYPE is set from the key-type and key-size annotations.
+KEY_FLAGS=""
+if [ -n "$KEY_TYPE" ]
+then
+    KEY_FLAGS="--kty $KEY_TYPE${KEY_CURVE:+ --curve $KEY_CURVE}${KEY_SIZE:+ --size $KEY_SIZE}"
+fi
+
+# Timeouts of the bootstrap phases, in seconds, 0 to wait forever. They can be
+# set in the env of the bootstrapper template of the autocert-config ConfigMap.
+#   - token: getting a bootstrap token or submitting a CertificateSigningRequest
+#     to the controller.
+#   - sign: downloading the root certificate and getting the certificate from
+#     the CA.
+#   - write: writing the certificate, key and root to the volume.
+AUTOCERT_TOKEN_TIMEOUT=${AUTOCERT_TOKEN_TIMEOUT:-120}
+AUTOCERT_SIGN_TIMEOUT=${AUTOCERT_SIGN_TIMEOUT:-300}
+AUTOCERT_WRITE_TIMEOUT=${AUTOCERT_WRITE_TIMEOUT:-60}
+
+# Exit codes of the phases timing out, so a bootstrapper stuck on the
+# controller, on the CA or on the disk can be told apart from the pod status.
+EXIT_TOKEN_TIMEOUT=10
+EXIT_SIGN_TIMEOUT=11
+EXIT_WRITE_TIMEOUT=12
+
+# run_phase PHASE COMMAND... runs a command of a bootstrap phase, killed after
+# the timeout of the phase. If it times out the bootstrapper exits with the
+# exit code of the phase, otherwise the status of the command is returned.
+run_phase() {
+    PHASE=$1
+    shift
+    case "$PHASE" in
+        token) LIMIT=$AUTOCERT_TOKEN_TIMEOUT; CODE=$EXIT_TOKEN_TIMEOUT ;;
+        sign) LIMIT=$AUTOCERT_SIGN_TIMEOUT; CODE=$EXIT_SIGN_TIMEOUT ;;
+        write) LIMIT=$AUTOCERT_WRITE_TIMEOUT; CODE=$EXIT_WRITE_TIMEOUT ;;
+    esac
+    set_state "$PHASE"
+    if [ "$LIMIT" -eq 0 ]
+    then
+        "$@"
+        return $?
+    fi
+    # GNU timeout runs in its own process group, its PID is recorded so the
+    # parent bootstrapper can terminate it.
+    timeout "$LIMIT" "$@" &
+    echo $! > "$STATE_FILE.pid" 2>/dev/null
+    wait $!
+    STATUS=$?
+    # GNU timeout exits with 124, busybox with the status of the killed
+    # command, 143 for SIGTERM.
+    if [ $STATUS -eq 124 ] || [ $STATUS -eq 143 ]
+    then
+        fail $CODE "Timed out after ${LIMIT}s in the $PHASE phase running $1"
+    fi
+    return $STATUS
+}
+
+# step_ca ARGS... runs step ca in the sign phase, and fails with the exit code
+# matching its error.
+step_ca() {
+    OUTPUT=$(run_phase sign step ca "$@" 2>&1)
+    STATUS=$?
+    if [ -n "$OUTPUT" ]
+    then
+        echo "$OUTPUT"
+    fi
+    # run_phase exits the command substitution subshell on timeouts.
+    if [ $STATUS -eq $EXIT_SIGN_TIMEOUT ]
+    then
+        exit $STATUS
+    fi
+    if [ $STATUS -ne 0 ]
+    then
+        fail "$(ca_error "$OUTPUT")" "Error running step ca $1: $(echo "$OUTPUT" | tail -n 1)"
+    fi
+}
+
+# token_expired succeeds if STEP_TOKEN is missing, or expires in less than
+# TOKEN_EXPIRY_MARGIN seconds, too soon to be redeemed.
+TOKEN_EXPIRY_MARGIN=${TOKEN_EXPIRY_MARGIN:-30}
+token_expired() {
+    if [ -z "$STEP_TOKEN" ]
+    then
+        return 0
+    fi
+    EXP=$(echo "$STEP_TOKEN" | step crypto jwt inspect --insecure 2>/dev/null | \
+        sed -n 's/.*"exp": *\([0-9]*\).*/\1/p' | head -n 1)
+    [ -n "$EXP" ] && [ "$EXP" -le $(( $(date +%s) + TOKEN_EXPIRY_MARGIN )) ]
+}
+
+# write_files sets the ownership and permissions of the new certificate, key
+# and root, and renames them into place. It's run by a child bootstrapper so
+# the write phase can be timed out as a whole.
+write_files() {
+    TMP_FILES="$CRT.tmp $KEY.tmp"
+    if [ "$DUAL_STACK" = "true" ]
+    then
+        TMP_FILES="$TMP_FILES $RSA_CRT.tmp $RSA_KEY.tmp"
+    fi
+    if [ -n "$KEYSTORE_FORMAT" ]
+    then
+        TMP_FILES="$TMP_FILES $KEYSTORE.tmp $TRUSTSTORE.tmp"
+    fi
+
+    # Never rename an empty file into place: on a full volume, step may leave
+    # a truncated key behind, and applications would load an empty key.
+    for TMP_FILE in $TMP_FILES
+    do
+        if [ ! -s "$TMP_FILE" ]
+        then
+            rm -f $TMP_FILES
+            fail $EXIT_ERROR "$TMP_FILE is empty, check that the certificates volume is not full or read-only"
+        fi
+    done
+
+    if [ -n "$OWNER" ]
+    then
+        chown "$OWNER" $TMP_FILES $STEP_ROOT
+    fi
+
+    if [ -n "$MODE" ]
+    then
+        chmod "$MODE" $TMP_FILES $STEP_ROOT
+    elif [ -n "$UMASK" ]
+    then
+        # Apply the umask to the default file mode (0666) so the permissions
+        # don't depend on how step creates the files.
+        chmod "$(printf '%o' $(( 0666 & ~0$UMASK )))" $TMP_FILES $STEP_ROOT
+    else
+        chmod 644 $TMP_FILES $STEP_ROOT
+    fi
+
+    if [ "$DUAL_STACK" = "true" ]
+    then
+        mv -f "$RSA_KEY.tmp" $RSA_KEY
+        mv -f "$RSA_CRT.tmp" $RSA_CRT
+    fi
+    if [ -n "$KEYSTORE_FORMAT" ]
+    then
+        mv -f "$TRUSTSTORE.tmp" $TRUSTSTORE
+        mv -f "$KEYSTORE.tmp" $KEYSTORE
+    fi
+    mv -f "$KEY.tmp" $KEY
+    mv -f "$CRT.tmp" $CRT
+
+    # Bump the version of the certificates directory so readers can tell when a
+    # complete set of files has been written.
+    VERSION=$(( $(cat "$VERSION_FILE" 2>/dev/null || echo 0) + 1 ))
+    echo $VERSION > "$VERSION_FILE.tmp"
+    mv -f "$VERSION_FILE.tmp" "$VERSION_FILE"
+
+    # Remove write permissions from the certificates and the directory holding
+    # them, so an application bug can't overwrite or delete the key material.
+    # The renewer runs as root and is still able to replace the files. When
+    # running as non-root, the directory belongs to root and is left writable
+    # by the fsGroup of the pod, so the renewer can replace the files.
+    if [ "$READ_ONLY" = "true" ]
+    then
+        chmod a-w $CRT $KEY $STEP_ROOT
+        if [ "$DUAL_STACK" = "true" ]
+        then
+            chmod a-w $RSA_CRT $RSA_KEY
+        fi
+        if [ -n "$KEYSTORE_FORMAT" ]
+        then
+            chmod a-w $KEYSTORE $TRUSTSTORE
+        fi
+        if [ -O "$(dirname $CRT)" ]
+        then
+            chmod a-w "$(dirname $CRT)"
+        fi
+    fi
+}
+
+# Retries of failed bootstraps, set by the controller for pods with
+# restartPolicy Never: the kubelet doesn't restart their bootstrapper, so a
+# transient error would fail the pod for good. The first retry waits
+# AUTOCERT_BOOTSTRAP_BACKOFF seconds, doubled after each one up to 5 minutes.
+AUTOCERT_BOOTSTRAP_RETRIES=${AUTOCERT_BOOTSTRAP_RETRIES:-0}
+AUTOCERT_BOOTSTRAP_BACKOFF=${AUTOCERT_BOOTSTRAP_BACKOFF:-10}
+MAX_BOOTSTRAP_BACKOFF=300
+
+# retryable CODE succeeds if a bootstrap that exited with CODE can succeed on
+# a retry: configuration errors, invalid tokens and policy denials don't go
+# away on their own.
+retryable() {
+    case "$1" in
+        $EXIT_CONFIG|$EXIT_TOKEN_INVALID|$EXIT_POLICY_DENIED) return 1 ;;
+        *) return 0 ;;
+    esac
+}
+
+# The state of the bootstrap, read by dump_state. It's written by the child
+# bootstrappers, and by the command substitution subshells of run_phase.
+STATE_FILE=${AUTOCERT_STATE_FILE:-/tmp/.autocert-bootstrapper}
+
+# set_state PHASE [ERROR] records the current phase of the bootstrap and when
+# it started. The last error, retried, is kept until another one is recorded.
+set_state() {
+    LAST_ERROR=${2:-$(sed -n 3p "$STATE_FILE" 2>/dev/null)}
+    printf '%s\n%s\n%s\n' "$1" "$(date +%s)" "$LAST_ERROR" > "$STATE_FILE" 2>/dev/null
+}
+
+# json_string VALUE prints VALUE as a JSON string.
+json_string() {
+    printf '"%s"' "$(printf '%s' "$1" | sed 's/\\/\\\\/g; s/"/\\"/g' | tr -d '\n')"
+}
+
+# dump_state prints the configuration and the state of the bootstrap to stdout
+# as a single JSON line, on SIGUSR1.
+dump_state() {
+    SERIAL=""
+    NOT_AFTER=""
+    if [ -s "$CRT" ]
+    then
+        INSPECT=$(step certificate inspect "$CRT" --format json 2>/dev/null)
+        SERIAL=$(echo "$INSPECT" | sed -n 's/.*"serial_number": *"\([^"]*\)".*/\1/p' | head -n 1)
+        NOT_AFTER=$(echo "$INSPECT" | sed -n 's/.*"end": *"\([^"]*\)".*/\1/p' | head -n 1)
+    fi
+    echo "{\"time\":$(json_string "$(date -u +%Y-%m-%dT%H:%M:%SZ)")," \
+        "\"protocol\":${AUTOCERT_PROTOCOL:-1}," \
+        "\"config\":{\"caURL\":$(json_string "$STEP_CA_URL"),\"failoverURLs\":$(json_string "$STEP_CA_FAILOVER_URLS")," \
+        "\"commonName\":$(json_string "$COMMON_NAME"),\"sans\":$(json_string "$AUTOCERT_SANS")," \
+        "\"certFile\":$(json_string "$CRT"),\"keyFile\":$(json_string "$KEY"),\"rootFile\":$(json_string "$STEP_ROOT")," \
+        "\"dualStack\":$(json_string "$DUAL_STACK"),\"keyFlags\":$(json_string "$KEY_FLAGS"),\"keystoreFormat\":$(json_string "$KEYSTORE_FORMAT")," \
+        "\"timeouts\":{\"token\":$AUTOCERT_TOKEN_TIMEOUT,\"sign\":$AUTOCERT_SIGN_TIMEOUT,\"write\":$AUTOCERT_WRITE_TIMEOUT}," \
+        "\"retries\":$AUTOCERT_BOOTSTRAP_RETRIES}," \
+        "\"attempt\":${ATTEMPT:-0}," \
+        "\"phase\":$(json_string "$(sed -n 1p "$STATE_FILE" 2>/dev/null)")," \
+        "\"phaseSince\":$(json_string "$(sed -n 2p "$STATE_FILE" 2>/dev/null)")," \
+        "\"lastError\":$(json_string "$(sed -n 3p "$STATE_FILE" 2>/dev/null)")," \
+        "\"certificate\":{\"serial\":$(json_string "$SERIAL"),\"notAfter\":$(json_string "$NOT_AFTER")}}"
+}
+
+# The child bootstrapper running the write phase, see write_files. The parent
+# holds the lock.
+if [ "$1" = "write-files" ]
+then
+    write_files
+    exit $?
+fi
+
+# The bootstrap runs in a child bootstrapper. When the pod is deleted, the
+# kubelet only signals the first process of the container, and a shell defers
+# its traps until the command in flight returns, so this one stays in wait and
+# terminates the step and curl commands of the child right away. The lock is
+# released when the child exits. It also dumps the state on SIGUSR1 while the
+# child is stuck, and runs a new child to retry failed bootstraps.
+if [ "$1" != "bootstrap" ]
+then
+    terminate() {
+        STOPPING=true
+        trap "" TERM INT
+        kill -TERM 0 $(cat "$STATE_FILE.pid" 2>/dev/null) 2>/dev/null
+    }
+    trap terminate TERM INT
+    trap dump_state USR1
+    rm -f "$STATE_FILE" "$STATE_FILE.pid"
+    ATTEMPT=0
+    BACKOFF=$AUTOCERT_BOOTSTRAP_BACKOFF
+    while true
+    do
+        "$0" bootstrap &
+        CHILD=$!
+        # wait returns as soon as a trap runs, keep waiting for the child to
+        # exit.
+        while true
+        do
+            wait $CHILD
+            STATUS=$?
+            if ! kill -0 $CHILD 2>/dev/null
+            then
+                break
+            fi
+        done
+        if [ $STATUS -eq 0 ] || [ "$STOPPING" = "true" ] || [ $ATTEMPT -ge "$AUTOCERT_BOOTSTRAP_RETRIES" ] || ! retryable $STATUS
+        then
+            break
+        fi
+        ATTEMPT=$((ATTEMPT + 1))
+        echo "Bootstrap failed with exit code $STATUS, retrying in ${BACKOFF}s ($ATTEMPT of $AUTOCERT_BOOTSTRAP_RETRIES)"
+        set_state backoff
+        # Sleep in the background, so terminate runs right away.
+        sleep $BACKOFF &
+        SLEEP=$!
+        while kill -0 $SLEEP 2>/dev/null && [ "$STOPPING" != "true" ]
+        do
+            wait $SLEEP
+        done
+        if [ "$STOPPING" = "true" ]
+        then
+            break
+        fi
+        BACKOFF=$((BACKOFF * 2))
+        if [ $BACKOFF -gt $MAX_BOOTSTRAP_BACKOFF ]
+        then
+            BACKOFF=$MAX_BOOTSTRAP_BACKOFF
+        fi
+    done
+    # The termination message of a failed attempt doesn't apply anymore.
+    if [ $STATUS -eq 0 ] && [ $ATTEMPT -gt 0 ]
+    then
+        : > "$TERMINATION_LOG" 2>/dev/null
+    fi
+    if [ "$STOPPING" = "true" ]
+    then
+        rm -f "$CRT.tmp" "$KEY.tmp" "$RSA_CRT.tmp" "$RSA_KEY.tmp"
+        echo "Bootstrap interrupted, exiting"
+        exit 143
+    fi
+    exit $STATUS
+fi
+
+# Hold an advisory lock on the certificates directory until the script exits,
+# so other writers sharing the volume (like the renewer) never interleave
+# their writes with ours.
+set_state lock
+exec 9>"$LOCK_FILE"
+flock 9
+
+# Empty files, left by a write to a full volume, are replaced.
+if [ -s "$STEP_ROOT" ] && [ -s "$CRT" ] && [ -s "$KEY" ];
+then
+    if [ "$DUAL_STACK" != "true" ]
+    then
+        echo "Found existing $STEP_ROOT, $CRT, and $KEY, skipping bootstrap"
+        exit 0
+    fi
+    if [ -s "$RSA_CRT" ] && [ -s "$RSA_KEY" ]
+    then
+        echo "Found existing $STEP_ROOT, $CRT, $KEY, $RSA_CRT, and $RSA_KEY, skipping bootstrap"
+        exit 0
+    fi
+fi
+
+# With failover URLs, use the first CA answering its health check, or the CA
+# at STEP_CA_URL if none does. The check only tests that the CA is reachable,
+# it is authenticated by step with the root certificate as usual.
+if [ -n "$STEP_CA_FAILOVER_URLS" ]
+then
+    set_state health
+    for URL in $STEP_CA_URL $(echo "$STEP_CA_FAILOVER_URLS" | tr ',' ' ')
+    do
+        if curl -sSfk --max-time 5 -o /dev/null "$URL/health"
+        then
+            if [ "$URL" != "$STEP_CA_URL" ]
+            then
+                echo "CA at $STEP_CA_URL is not healthy, using $URL"
+                STEP_CA_URL=$URL
+                export STEP_CA_URL
+            fi
+            break
+        fi
+    done
 fi
 
-step ca root $STEP_ROOT
+# fetch_root downloads the root certificate from the CA, unless running in
+# air-gapped mode, where the roots must come from the controller.
+fetch_root() {
+    if [ "$AUTOCERT_AIR_GAPPED" = "true" ]
+    then
+        fail $EXIT_CONFIG "Air-gapped mode: refusing to download the root certificate from the CA, check the roots in the rootCAPath of the controller"
+    fi
+    step_ca root $STEP_ROOT
+}
 
-if [ -n "$OWNER" ]
+# Write the root certificate provided by the controller, if any. This saves
+# the round trips to the CA to download it, which matters for workloads that
+# scale from zero. The root is only used if it matches the fingerprint. In
+# air-gapped mode the roots must be provided, and a mismatch is an error.
+if [ "$AUTOCERT_AIR_GAPPED" = "true" ] && [ -z "$STEP_ROOT_PEM" ]
 then
-    chown "$OWNER" $CRT $KEY $STEP_ROOT
+    fail $EXIT_CONFIG "Air-gapped mode: \$STEP_ROOT_PEM must be set"
+fi
+if [ -n "$STEP_ROOT_PEM" ]
+then
+    echo "$STEP_ROOT_PEM" > $STEP_ROOT
+    if [ "$(step certificate fingerprint $STEP_ROOT)" != "$STEP_FINGERPRINT" ]
+    then
+        rm -f $STEP_ROOT
+        if [ "$AUTOCERT_AIR_GAPPED" = "true" ]
+        then
+            fail $EXIT_CONFIG "Air-gapped mode: root certificate does not match fingerprint $STEP_FINGERPRINT"
+        fi
+        echo "Root certificate does not match fingerprint $STEP_FINGERPRINT, downloading it"
+    fi
 fi
 
-if [ -n "$MODE" ]
+if [ -n "$AUTOCERT_CSR_URL" ]
 then
-    chmod "$MODE" $CRT $KEY $STEP_ROOT
+    # Get the certificate through a Kubernetes CertificateSigningRequest,
+    # signed once it's approved. The name of the request is kept in the
+    # certificates directory so a restarted bootstrapper keeps waiting for the
+    # same request, with the same key.
+    CSR_FILE="$CERTS_DIR/.csr"
+    CSR_NAME_FILE="$CERTS_DIR/.csr-name"
+    # Requests are authenticated with the service account token of the pod,
+    # the claim alone is readable by anyone allowed to get the pod.
+    AUTH_HEADER=""
+    if [ -n "$AUTOCERT_CLAIM_TOKEN" ]
+    then
+        AUTH_HEADER="Authorization: Bearer $(cat "$AUTOCERT_CLAIM_TOKEN")"
+    fi
+    if [ ! -f "$STEP_ROOT" ]
+    then
+        fetch_root
+    fi
+    if [ ! -f "$CSR_NAME_FILE" ]
+    then
+        rm -f "$CSR_FILE" "$KEY.tmp"
+        SAN_FLAGS=""
+        for SAN in $(echo "$AUTOCERT_SANS" | tr ',' ' ')
+        do
+            SAN_FLAGS="$SAN_FLAGS --san $SAN"
+        done
+        step certificate create --csr --no-password --insecure $KEY_FLAGS $SAN_FLAGS $COMMON_NAME "$CSR_FILE" "$KEY.tmp"
+        CSR_NAME=$(run_phase token curl -sSf --retry 5 --retry-connrefused --cacert $STEP_ROOT \
+            -H "Autocert-Claim: $AUTOCERT_CLAIM" ${AUTH_HEADER:+-H "$AUTH_HEADER"} \
+            --data-binary @"$CSR_FILE" "$AUTOCERT_CSR_URL")
+        STATUS=$?
+        # run_phase exits the command substitution subshell on timeouts.
+        if [ $STATUS -eq $EXIT_TOKEN_TIMEOUT ]
+        then
+            exit $STATUS
+        fi
+        if [ $STATUS -ne 0 ] || [ -z "$CSR_NAME" ]
+        then
+            fail "$(curl_error $STATUS $EXIT_TOKEN_INVALID)" "Error submitting certificate signing request to $AUTOCERT_CSR_URL"
+        fi
+        echo "$CSR_NAME" > "$CSR_NAME_FILE"
+    fi
+    CSR_NAME=$(cat "$CSR_NAME_FILE")
+
+    echo "Waiting for the approval of CertificateSigningRequest $CSR_NAME (kubectl certificate approve $CSR_NAME)"
+    while true
+    do
+        # The projected token is rotated, read it again on every request.
+        if [ -n "$AUTOCERT_CLAIM_TOKEN" ]
+        then
+            AUTH_HEADER="Authorization: Bearer $(cat "$AUTOCERT_CLAIM_TOKEN")"
+        fi
+        STATUS=$(curl -sS --cacert $STEP_ROOT -o "$CRT.tmp" -w '%{http_code}' \
+            -H "Autocert-Claim: $AUTOCERT_CLAIM" ${AUTH_HEADER:+-H "$AUTH_HEADER"} "$AUTOCERT_CSR_URL?name=$CSR_NAME")
+        case "$STATUS" in
+            200)
+                break
+                ;;
+            403)
+                REASON=$(cat "$CRT.tmp")
+                rm -f "$CRT.tmp" "$KEY.tmp" "$CSR_FILE" "$CSR_NAME_FILE"
+                fail $EXIT_POLICY_DENIED "$REASON"
+                ;;
+            *)
+                set_state approval "CertificateSigningRequest $CSR_NAME not approved yet (HTTP $STATUS)"
+                ;;
+        esac
+        sleep 5
+    done
+    rm -f "$CSR_FILE" "$CSR_NAME_FILE"
 else
-    chmod 644 $CRT $KEY $STEP_ROOT
+    # With serviceAccountAuth, the certificate request is authenticated with
+    # the projected service account token of the pod, validated by the CA
+    # itself: the controller mints no bootstrap token.
+    if [ -n "$AUTOCERT_CA_TOKEN" ]
+    then
+        if [ ! -f "$AUTOCERT_CA_TOKEN" ]
+        then
+            fail $EXIT_CONFIG "Service account token $AUTOCERT_CA_TOKEN not found"
+        fi
+        if [ ! -f "$STEP_ROOT" ]
+        then
+            fetch_root
+        fi
+        rm -f "$CERTS_DIR/.csr" "$KEY.tmp"
+        SAN_FLAGS=""
+        for SAN in $(echo "$AUTOCERT_SANS" | tr ',' ' ')
+        do
+            SAN_FLAGS="$SAN_FLAGS --san $SAN"
+        done
+        step certificate create --csr --no-password --insecure $KEY_FLAGS $SAN_FLAGS $COMMON_NAME "$CERTS_DIR/.csr" "$KEY.tmp"
+        STEP_TOKEN=$(cat "$AUTOCERT_CA_TOKEN")
+        export STEP_TOKEN
+    fi
+
+    # If the pod was admitted before its bootstrap token was generated,
+    # exchange the claim set by the controller for a token.
+    if [ -z "$STEP_TOKEN" ] && [ -n "$AUTOCERT_TOKEN_URL" ]
+    then
+        if [ ! -f "$STEP_ROOT" ]
+        then
+            fetch_root
+        fi
+        # Tokens bound to the pod are only given to the pod presenting its
+        # service account token, for its own certificate request: the key is
+        # generated first and the CA rejects the token with any other
+        # request.
+        # Claims are redeemed with the service account token of the pod, the
+        # claim alone is readable by anyone allowed to get the pod.
+        BIND_HEADER=""
+        if [ -n "$AUTOCERT_CLAIM_TOKEN" ]
+        then
+            BIND_HEADER="Authorization: Bearer $(cat "$AUTOCERT_CLAIM_TOKEN")"
+        fi
+        BODY="{\"claim\":\"$AUTOCERT_CLAIM\"}"
+        if [ -n "$AUTOCERT_BIND_TOKEN" ]
+        then
+            CSR_FILE="$CERTS_DIR/.csr"
+            rm -f "$CSR_FILE" "$KEY.tmp"
+            SAN_FLAGS=""
+            for SAN in $(echo "$AUTOCERT_SANS" | tr ',' ' ')
+            do
+                SAN_FLAGS="$SAN_FLAGS --san $SAN"
+            done
+            step certificate create --csr --no-password --insecure $KEY_FLAGS $SAN_FLAGS $COMMON_NAME "$CSR_FILE" "$KEY.tmp"
+            BIND_HEADER="Authorization: Bearer $(cat "$AUTOCERT_BIND_TOKEN")"
+            BODY="{\"claim\":\"$AUTOCERT_CLAIM\",\"csr\":\"$(awk '{printf "%s\\n", $0}' "$CSR_FILE")\"}"
+        fi
+        echo "Fetching bootstrap token from $AUTOCERT_TOKEN_URL"
+        STEP_TOKEN=$(run_phase token curl -sSf --retry 5 --retry-connrefused --cacert $STEP_ROOT \
+            -H "Content-Type: application/json" ${BIND_HEADER:+-H "$BIND_HEADER"} \
+            -d "$BODY" "$AUTOCERT_TOKEN_URL")
+        STATUS=$?
+        if [ $STATUS -eq $EXIT_TOKEN_TIMEOUT ]
+        then
+            exit $STATUS
+        fi
+        if [ $STATUS -ne 0 ] || [ -z "$STEP_TOKEN" ]
+        then
+            # Claims expire too, re-mint the token if the controller allows it.
+            if [ -z "$AUTOCERT_REMINT_URL" ]
+            then
+                fail "$(curl_error $STATUS $EXIT_TOKEN_INVALID)" "Error fetching bootstrap token from $AUTOCERT_TOKEN_URL"
+            fi
+            echo "Error fetching bootstrap token from $AUTOCERT_TOKEN_URL"
+            set_state token "Error fetching bootstrap token from $AUTOCERT_TOKEN_URL"
+            STEP_TOKEN=""
+        fi
+        export STEP_TOKEN
+
+        # Check the token was bound to this pod before redeeming it.
+        if [ -n "$AUTOCERT_BIND_TOKEN" ]
+        then
+            TOKEN_POD_UID=$(echo "$STEP_TOKEN" | step crypto jwt inspect --insecure | \
+                sed -n 's/.*"podUID": *"\([^"]*\)".*/\1/p' | head -n 1)
+            if [ "$TOKEN_POD_UID" != "$POD_UID" ]
+            then
+                fail $EXIT_TOKEN_INVALID "Bootstrap token is bound to pod $TOKEN_POD_UID, not to this pod $POD_UID"
+            fi
+        fi
+    fi
+
+    # Pods that sat pending longer than the token lifetime find their token
+    # expired, or its secret deleted. Get a new one from the controller,
+    # authenticated with the service account token of the pod.
+    if [ -n "$AUTOCERT_REMINT_URL" ] && token_expired
+    then
+        if [ ! -f "$STEP_ROOT" ]
+        then
+            fetch_root
+        fi
+        echo "Bootstrap token is missing or expired, getting a new one from $AUTOCERT_REMINT_URL"
+        STEP_TOKEN=$(run_phase token curl -sSf --retry 5 --retry-connrefused --cacert $STEP_ROOT \
+            -H "Content-Type: application/json" -H "Authorization: Bearer $(cat "$AUTOCERT_SA_TOKEN")" \
+            -d "{\"claim\":\"$AUTOCERT_REMINT_CLAIM\"}" "$AUTOCERT_REMINT_URL")
+        STATUS=$?
+        if [ $STATUS -eq $EXIT_TOKEN_TIMEOUT ]
+        then
+            exit $STATUS
+        fi
+        if [ $STATUS -ne 0 ] || [ -z "$STEP_TOKEN" ]
+        then
+            fail "$(curl_error $STATUS $EXIT_TOKEN_INVALID)" "Error getting a new bootstrap token from $AUTOCERT_REMINT_URL"
+        fi
+        export STEP_TOKEN
+    fi
+
+    # Get the certificate. Files are written under temporary names and
+    # renamed into place, so readers never see partial files. Bound tokens
+    # are redeemed with the certificate request sent to the controller, and
+    # service account tokens with the one created above.
+    if { [ -n "$AUTOCERT_BIND_TOKEN" ] || [ -n "$AUTOCERT_CA_TOKEN" ]; } && [ -f "$CERTS_DIR/.csr" ]
+    then
+        rm -f "$CRT.tmp"
+        if [ "$DURATION" == "" ];
+        then
+            step_ca sign "$CERTS_DIR/.csr" "$CRT.tmp"
+        else
+            step_ca sign --not-after $DURATION "$CERTS_DIR/.csr" "$CRT.tmp"
+        fi
+        rm -f "$CERTS_DIR/.csr"
+    else
+        rm -f "$CRT.tmp" "$KEY.tmp"
+        if [ "$DURATION" == "" ];
+        then
+            step_ca certificate $KEY_FLAGS $COMMON_NAME "$CRT.tmp" "$KEY.tmp"
+        else
+            step_ca certificate $KEY_FLAGS --not-after $DURATION $COMMON_NAME "$CRT.tmp" "$KEY.tmp"
+        fi
+    fi
+fi
+
+if [ ! -f "$STEP_ROOT" ]
+then
+    fetch_root
+fi
+
+# Get the RSA certificate of dual-stack pods by re-keying the new ECDSA
+# certificate, so both have the same identity and lifetime.
+if [ "$DUAL_STACK" = "true" ]
+then
+    rm -f "$RSA_CRT.tmp" "$RSA_KEY.tmp"
+    step_ca rekey "$CRT.tmp" "$KEY.tmp" --kty RSA --size 2048 \
+        --out-cert "$RSA_CRT.tmp" --out-key "$RSA_KEY.tmp" --force
+fi
+
+# Encode the keystores of pods annotated with autocert.step.sm/format, from
+# the new certificate and key.
+if [ -n "$KEYSTORE_FORMAT" ]
+then
+    rm -f "$KEYSTORE.tmp" "$TRUSTSTORE.tmp"
+    if ! "$(dirname "$0")/keystore" "$CRT.tmp" "$KEY.tmp" "$STEP_ROOT" "$KEYSTORE.tmp" "$TRUSTSTORE.tmp"
+    then
+        fail $EXIT_ERROR "Error writing the $KEYSTORE_FORMAT keystores"
+    fi
 fi
 
+# Write the files, with the lock still held.
+export CRT KEY STEP_ROOT OWNER MODE UMASK VERSION_FILE READ_ONLY DUAL_STACK RSA_CRT RSA_KEY KEYSTORE_FORMAT KEYSTORE TRUSTSTORE
+run_phase write "$0" write-files
@@ -0,0 +1,15 @@
+module github.com/smallstep/autocert/bootstrapper/keystore
+
+go 1.25.0
+
+require github.com/smallstep/autocert/pkg/keystore v0.1.0
+
+require (
+	filippo.io/edwards25519 v1.2.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	go.step.sm/crypto v0.77.2 // indirect
+	golang.org/x/crypto v0.49.0 // indirect
+	golang.org/x/sys v0.42.0 // indirect
+)
+
+replace github.com/smallstep/autocert/pkg/keystore => ../../pkg/keystore
@@ -0,0 +1,39 @@
+// Command keystore encodes the certificate, key and root written by the
+// bootstrapper as the keystore and truststore of $KEYSTORE_FORMAT, pkcs12 or
+// jks, protected by $KEYSTORE_PASSWORD. It's called by bootstrapper.sh, which
+// renames the files into place along with the PEM files.
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/smallstep/autocert/pkg/keystore"
+)
+
+func main() {
+	if len(os.Args) != 6 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <crt> <key> <root> <keystore> <truststore>\n", os.Args[0])
+		os.Exit(2)
+	}
+	if err := run(os.Getenv(keystore.FormatEnvVar), os.Args[1], os.Args[2], os.Args[3], os.Args[4], os.Args[5]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(format, certFile, keyFile, rootFile, keyStoreFile, trustStoreFile string) error {
+	key, chain, roots, err := keystore.Load(certFile, keyFile, rootFile)
+	if err != nil {
+		return err
+	}
+	keyStore, trustStore, err := keystore.Encode(format, key, chain, roots, keystore.Password(), time.Now())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyStoreFile, keyStore, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(trustStoreFile, trustStore, 0o600)
+}
@@ -0,0 +1,110 @@
+// Command dashboard generates the reference Grafana dashboard showing the
+// per-namespace certificate stats exported by the autocert controller.
+//
+// Panels are described in Go and rendered with the dashboard.json.tmpl
+// template, so new metrics get a consistent panel with a single line:
+//
+//	go run ./dashboard -o install/grafana/autocert-namespaces.json
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/template"
+)
+
+//go:generate go run . -o ../install/grafana/autocert-namespaces.json
+
+//go:embed dashboard.json.tmpl
+var dashboardTemplate string
+
+// panel is a Grafana time series panel plotting one query per namespace.
+type panel struct {
+	Title       string
+	Description string
+	Expr        string
+	// Threshold colors the panel red from the given value, if not zero.
+	Threshold float64
+}
+
+// panels are laid out two per row, in order.
+var panels = []panel{
+	{
+		Title:       "Active certificates",
+		Description: "Unexpired certificates reported by the renewers of the namespace.",
+		Expr:        `sum by (namespace) (autocert_namespace_certificates{namespace=~"$namespace"})`,
+	},
+	{
+		Title:       "Expiring soon",
+		Description: "Certificates expiring within the expiringSoon threshold of the controller.",
+		Expr:        `sum by (namespace) (autocert_namespace_certificates_expiring_soon{namespace=~"$namespace"})`,
+		Threshold:   1,
+	},
+	{
+		Title:       "Failing renewals",
+		Description: "Certificates whose last renewal attempt failed.",
+		Expr:        `sum by (namespace) (autocert_namespace_renewals_failing{namespace=~"$namespace"})`,
+		Threshold:   1,
+	},
+	{
+		Title:       "Failing renewals ratio",
+		Description: "Share of the certificates of the namespace whose last renewal attempt failed.",
+		Expr:        `sum by (namespace) (autocert_namespace_renewals_failing{namespace=~"$namespace"}) / sum by (namespace) (autocert_namespace_certificates{namespace=~"$namespace"})`,
+		Threshold:   0.1,
+	},
+	{
+		Title:       "Stale certificates",
+		Description: "Certificates found about to expire by the renewer watchdog while their renewals keep failing, over the last hour.",
+		Expr:        `sum by (namespace) (increase(autocert_stale_certificates_total{namespace=~"$namespace"}[1h]))`,
+		Threshold:   1,
+	},
+}
+
+// render returns the dashboard JSON, indented.
+func render(panels []panel) ([]byte, error) {
+	tmpl, err := template.New("dashboard").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"x": func(i int) int { return (i % 2) * 12 },
+		"y": func(i int) int { return (i / 2) * 8 },
+	}).Parse(dashboardTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw bytes.Buffer
+	if err := tmpl.Execute(&raw, panels); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, raw.Bytes(), "", "  "); err != nil {
+		return nil, fmt.Errorf("invalid dashboard JSON: %w", err)
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+func main() {
+	output := flag.String("o", "", "write the dashboard to `file` instead of the standard output")
+	flag.Parse()
+
+	b, err := render(panels)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *output == "" {
+		os.Stdout.Write(b) //nolint:errcheck // nothing to do on write errors
+		return
+	}
+	if err := os.WriteFile(*output, b, 0o644); err != nil { //nolint:gosec // the dashboard is not secret
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestDashboardUpToDate(t *testing.T) {
+	want, err := render(panels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile("../install/grafana/autocert-namespaces.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("install/grafana/autocert-namespaces.json is out of date, run make generate")
+	}
+}
@@ -0,0 +1,249 @@
+#!/usr/bin/env python3
+"""End-to-end tests checking that the hello-mtls examples pick up renewed
+certificates without restarting.
+
+Every example runs against a temporary AUTOCERT_DIR holding certificates
+issued by a test CA. The test replaces the certificate the way the renewer
+does, writing new files and renaming them over the old ones, and waits for the
+example to use it: servers must present it in new handshakes, and clients must
+authenticate with it to a test server.
+
+Examples whose runtime or dependencies are missing are skipped. Run with:
+
+    python3 -m unittest discover -s examples/hello-mtls/e2e -p '*_test.py' -v
+"""
+import http.server
+import importlib.util
+import os
+import shutil
+import socket
+import ssl
+import subprocess
+import sys
+import tempfile
+import threading
+import time
+import unittest
+
+EXAMPLES_DIR = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
+
+# How long an example has to pick up a renewed certificate. Examples check for
+# renewals every few seconds.
+ROTATION_TIMEOUT = 60
+
+# SERVERS are the server examples: the command to run, relative to the example
+# directory, and the executables and python modules it needs. Servers listen on
+# $PORT.
+SERVERS = {
+    'node': (['node', 'server.js'], ['node'], []),
+    'py-gunicorn': (['gunicorn', '--config', 'gunicorn.conf', '--pythonpath', '.', 'server:app'],
+                    ['gunicorn'], ['flask']),
+}
+
+# CLIENTS are the client examples. Clients request $HELLO_MTLS_URL every few
+# seconds.
+CLIENTS = {
+    'node': (['node', 'client.js'], ['node'], []),
+    'py-gunicorn': ([sys.executable, 'client.py'], [], []),
+}
+
+
+def missing(executables, modules):
+    """Returns the executables and modules that are not installed."""
+    return ([e for e in executables if shutil.which(e) is None] +
+            [m for m in modules if importlib.util.find_spec(m) is None])
+
+
+def openssl(*args):
+    subprocess.run(['openssl'] + list(args), check=True, capture_output=True)
+
+
+def free_port():
+    with socket.socket() as s:
+        s.bind(('127.0.0.1', 0))
+        return s.getsockname()[1]
+
+
+class CA:
+    """A test CA issuing ECDSA certificates for localhost, valid for server
+    and client authentication."""
+
+    def __init__(self, dir):
+        self.dir = dir
+        self.root = os.path.join(dir, 'root.crt')
+        self.root_key = os.path.join(dir, 'root.key')
+        self.serial = 0
+        openssl('req', '-x509', '-new', '-nodes', '-newkey', 'ec', '-pkeyopt', 'ec_paramgen_curve:P-256',
+                '-subj', '/CN=Test Root CA', '-days', '1', '-keyout', self.root_key, '-out', self.root)
+
+    def issue(self, name):
+        """Returns the paths of a new certificate and key with the given
+        common name."""
+        self.serial += 1
+        base = os.path.join(self.dir, '%s-%d' % (name, self.serial))
+        ext = base + '.ext'
+        with open(ext, 'w') as f:
+            f.write('subjectAltName = DNS:localhost, IP:127.0.0.1\n'
+                    'extendedKeyUsage = serverAuth, clientAuth\n')
+        openssl('req', '-new', '-nodes', '-newkey', 'ec', '-pkeyopt', 'ec_paramgen_curve:P-256',
+                '-subj', '/CN=' + name, '-keyout', base + '.key', '-out', base + '.csr')
+        openssl('x509', '-req', '-in', base + '.csr', '-CA', self.root, '-CAkey', self.root_key,
+                '-set_serial', str(self.serial), '-days', '1', '-extfile', ext, '-out', base + '.crt')
+        return base + '.crt', base + '.key'
+
+    def context(self, purpose, cert):
+        """Returns an SSL context trusting the CA and using the given
+        certificate."""
+        ctx = ssl.create_default_context(purpose, cafile=self.root)
+        if purpose == ssl.Purpose.CLIENT_AUTH:
+            ctx.verify_mode = ssl.CERT_REQUIRED
+        ctx.load_cert_chain(*cert)
+        return ctx
+
+
+def install(autocert_dir, cert):
+    """Installs a certificate and its key like the renewer: the key first,
+    then the certificate, each written to a temporary file renamed over the
+    current one."""
+    for src, name in ((cert[1], 'site.key'), (cert[0], 'site.crt')):
+        dst = os.path.join(autocert_dir, name)
+        shutil.copyfile(src, dst + '.tmp')
+        os.replace(dst + '.tmp', dst)
+
+
+def der(path):
+    with open(path) as f:
+        return ssl.PEM_cert_to_DER_cert(f.read())
+
+
+class RotationTest(unittest.TestCase):
+
+    def setUp(self):
+        if shutil.which('openssl') is None:
+            self.skipTest('openssl is not installed')
+        self.tmp = tempfile.mkdtemp(prefix='hello-mtls-e2e-')
+        self.addCleanup(shutil.rmtree, self.tmp, ignore_errors=True)
+        self.ca = CA(self.tmp)
+        self.autocert_dir = os.path.join(self.tmp, 'autocert')
+        os.mkdir(self.autocert_dir)
+        shutil.copyfile(self.ca.root, os.path.join(self.autocert_dir, 'root.crt'))
+
+    def start(self, example, command, **env):
+        """Starts an example with the test AUTOCERT_DIR, and stops it at the
+        end of the test."""
+        self.log = os.path.join(self.tmp, 'output.log')
+        log = open(self.log, 'w')
+        self.addCleanup(log.close)
+        proc = subprocess.Popen(command, cwd=os.path.join(EXAMPLES_DIR, example), stdout=log,
+                                stderr=subprocess.STDOUT,
+                                env=dict(os.environ, AUTOCERT_DIR=self.autocert_dir,
+                                         PYTHONDONTWRITEBYTECODE='1', **env))
+
+        def stop():
+            proc.terminate()
+            try:
+                proc.wait(10)
+            except subprocess.TimeoutExpired:
+                proc.kill()
+                proc.wait()
+        self.addCleanup(stop)
+        return proc
+
+    def wait(self, condition, timeout, message):
+        """Waits for a condition, and fails with the output of the example if
+        it's not met in time."""
+        deadline = time.monotonic() + timeout
+        while time.monotonic() < deadline:
+            if condition():
+                return
+            time.sleep(0.5)
+        self.fail_with_output(message)
+
+    def fail_with_output(self, message):
+        """Fails the test, with the output of the example."""
+        with open(self.log) as f:
+            self.fail('%s, output:\n%s' % (message, f.read()))
+
+    def check_server(self, example):
+        command, executables, modules = SERVERS[example]
+        if missing(executables, modules):
+            self.skipTest('missing %s' % ', '.join(missing(executables, modules)))
+
+        first, second = self.ca.issue('server'), self.ca.issue('server')
+        install(self.autocert_dir, first)
+        port = free_port()
+        proc = self.start(example, command, PORT=str(port))
+        client = self.ca.context(ssl.Purpose.SERVER_AUTH, self.ca.issue('client'))
+
+        def peer():
+            try:
+                with socket.create_connection(('127.0.0.1', port), timeout=5) as sock:
+                    with client.wrap_socket(sock, server_hostname='localhost') as tls:
+                        return tls.getpeercert(binary_form=True)
+            except OSError:
+                if proc.poll() is not None:
+                    self.fail_with_output('server exited')
+                return None
+
+        self.wait(lambda: peer() is not None, 30, 'server did not start')
+        self.assertEqual(peer(), der(first[0]))
+
+        install(self.autocert_dir, second)
+        self.wait(lambda: peer() == der(second[0]), ROTATION_TIMEOUT,
+             'server did not pick up the renewed certificate')
+
+    def check_client(self, example):
+        command, executables, modules = CLIENTS[example]
+        if missing(executables, modules):
+            self.skipTest('missing %s' % ', '.join(missing(executables, modules)))
+
+        first, second = self.ca.issue('client'), self.ca.issue('client')
+        install(self.autocert_dir, first)
+
+        # A test server recording the certificates clients authenticate with.
+        seen = []
+
+        class Handler(http.server.BaseHTTPRequestHandler):
+            def do_GET(self):
+                seen.append(self.connection.getpeercert(binary_form=True))
+                self.send_response(200)
+                self.end_headers()
+                self.wfile.write(b'Hello, client!\n')
+
+            def log_message(self, *args):
+                pass
+
+        server = http.server.ThreadingHTTPServer(('127.0.0.1', 0), Handler)
+        ctx = self.ca.context(ssl.Purpose.CLIENT_AUTH, self.ca.issue('server'))
+        server.socket = ctx.wrap_socket(server.socket, server_side=True)
+        threading.Thread(target=server.serve_forever, daemon=True).start()
+        self.addCleanup(server.server_close)
+        self.addCleanup(server.shutdown)
+
+        proc = self.start(example, command, HELLO_MTLS_URL='https://localhost:%d/' % server.server_port)
+
+        def client_used(cert):
+            if proc.poll() is not None:
+                self.fail_with_output('client exited')
+            return der(cert[0]) in seen
+
+        self.wait(lambda: client_used(first), 30, 'client did not connect')
+        install(self.autocert_dir, second)
+        self.wait(lambda: client_used(second), ROTATION_TIMEOUT,
+             'client did not pick up the renewed certificate')
+
+    def test_node_server(self):
+        self.check_server('node')
+
+    def test_node_client(self):
+        self.check_client('node')
+
+    def test_py_gunicorn_server(self):
+        self.check_server('py-gunicorn')
+
+    def test_py_gunicorn_client(self):
+        self.check_client('py-gunicorn')
+
+
+if __name__ == '__main__':
+    unittest.main()
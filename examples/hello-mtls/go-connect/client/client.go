@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+
+	hellov1 "github.com/smallstep/autocert/examples/hello-mtls/go-connect/gen/hello/v1"
+	"github.com/smallstep/autocert/examples/hello-mtls/go-connect/gen/hello/v1/hellov1connect"
+)
+
+const (
+	autocertFile     = "/var/run/autocert.step.sm/site.crt"
+	autocertKey      = "/var/run/autocert.step.sm/site.key"
+	autocertRoot     = "/var/run/autocert.step.sm/root.crt"
+	requestFrequency = 5 * time.Second
+	tickFrequency    = 15 * time.Second
+)
+
+// Uses techniques from https://diogomonica.com/2017/01/11/hitless-tls-certificate-rotation-in-go/
+// to automatically rotate certificates when they're renewed.
+
+type rotator struct {
+	sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func (r *rotator) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.certificate, nil
+}
+
+func (r *rotator) loadCertificate(certFile, keyFile string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	c, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.certificate = &c
+
+	return nil
+}
+
+func loadRootCertPool() (*x509.CertPool, error) {
+	root, err := os.ReadFile(autocertRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(root); !ok {
+		return nil, errors.New("missing or invalid root certificate")
+	}
+
+	return pool, nil
+}
+
+// clientOptions returns the options selecting the protocol set in
+// HELLO_MTLS_PROTOCOL: connect (the default), grpc or grpcweb.
+func clientOptions() ([]connect.ClientOption, error) {
+	switch p := os.Getenv("HELLO_MTLS_PROTOCOL"); p {
+	case "", "connect":
+		return nil, nil
+	case "grpc":
+		return []connect.ClientOption{connect.WithGRPC()}, nil
+	case "grpcweb":
+		return []connect.ClientOption{connect.WithGRPCWeb()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", p)
+	}
+}
+
+func sayHello(c hellov1connect.GreeterServiceClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	r, err := c.SayHello(ctx, connect.NewRequest(&hellov1.SayHelloRequest{Name: "world"}))
+	if err != nil {
+		return err
+	}
+	log.Printf("Greeting: %s", r.Msg.GetMessage()) //nolint:gosec // intentional logging of server greeting response
+	return nil
+}
+
+func sayHelloAgain(c hellov1connect.GreeterServiceClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	r, err := c.SayHelloAgain(ctx, connect.NewRequest(&hellov1.SayHelloAgainRequest{Name: "world"}))
+	if err != nil {
+		return err
+	}
+	log.Printf("Greeting: %s", r.Msg.GetMessage()) //nolint:gosec // intentional logging of server greeting response
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	// Read the root certificate for our CA from disk
+	roots, err := loadRootCertPool()
+	if err != nil {
+		return err
+	}
+
+	// Load certificate
+	r := &rotator{}
+	if err := r.loadCertificate(autocertFile, autocertKey); err != nil {
+		return fmt.Errorf("error loading certificate and key: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs:          roots,
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+		// GetClientCertificate is called on every TLS handshake, not on
+		// every request: HTTP/2 multiplexes all requests on a single
+		// long-lived connection.
+		GetClientCertificate: r.getClientCertificate,
+	}
+
+	// Setting TLSClientConfig disables HTTP/2 in the standard transport
+	// unless ForceAttemptHTTP2 is set. The gRPC protocol doesn't work
+	// without it, and Connect silently falls back to HTTP/1.1.
+	transport := &http.Transport{
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   tickFrequency,
+	}
+
+	// Schedule periodic re-load of certificate
+	// A real implementation can use something like
+	// https://github.com/fsnotify/fsnotify
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(tickFrequency)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Println("Checking for new certificate...")
+				if err := r.loadCertificate(autocertFile, autocertKey); err != nil {
+					log.Println("Error loading certificate and key", err)
+				}
+				// Force a new handshake, so the server sees the
+				// renewed certificate before the old one expires.
+				transport.CloseIdleConnections()
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	opts, err := clientOptions()
+	if err != nil {
+		return err
+	}
+
+	// Set up a client for the server, HELLO_MTLS_URL must be an https URL.
+	client := hellov1connect.NewGreeterServiceClient(&http.Client{Transport: transport}, os.Getenv("HELLO_MTLS_URL"), opts...)
+
+	for {
+		if err := sayHello(client); err != nil {
+			return fmt.Errorf("could not greet: %w", err)
+		}
+		if err := sayHelloAgain(client); err != nil {
+			return fmt.Errorf("could not greet: %w", err)
+		}
+		time.Sleep(requestFrequency)
+	}
+}
@@ -0,0 +1,13 @@
+module github.com/smallstep/autocert/examples/hello-mtls/go-connect
+
+go 1.25.0
+
+require (
+	connectrpc.com/connect v1.18.1
+	google.golang.org/protobuf v1.36.6
+)
+
+tool (
+	connectrpc.com/connect/cmd/protoc-gen-connect-go
+	google.golang.org/protobuf/cmd/protoc-gen-go
+)
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+
+	hellov1 "github.com/smallstep/autocert/examples/hello-mtls/go-connect/gen/hello/v1"
+	"github.com/smallstep/autocert/examples/hello-mtls/go-connect/gen/hello/v1/hellov1connect"
+)
+
+const (
+	autocertFile  = "/var/run/autocert.step.sm/site.crt"
+	autocertKey   = "/var/run/autocert.step.sm/site.key"
+	autocertRoot  = "/var/run/autocert.step.sm/root.crt"
+	tickFrequency = 15 * time.Second
+)
+
+// Uses techniques from https://diogomonica.com/2017/01/11/hitless-tls-certificate-rotation-in-go/
+// to automatically rotate certificates when they're renewed.
+
+type rotator struct {
+	sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func (r *rotator) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.certificate, nil
+}
+
+func (r *rotator) loadCertificate(certFile, keyFile string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	c, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.certificate = &c
+
+	return nil
+}
+
+func loadRootCertPool() (*x509.CertPool, error) {
+	root, err := os.ReadFile(autocertRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(root); !ok {
+		return nil, errors.New("missing or invalid root certificate")
+	}
+
+	return pool, nil
+}
+
+type peerKey struct{}
+
+// withPeer stores the verified client certificate in the request context.
+// Unlike grpc-go, Connect handlers are plain net/http handlers and don't
+// expose the TLS connection state, so it must be captured by a middleware.
+func withPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), peerKey{}, r.TLS.VerifiedChains[0][0]))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func peerName(ctx context.Context) string {
+	if crt, ok := ctx.Value(peerKey{}).(*x509.Certificate); ok {
+		return crt.Subject.CommonName
+	}
+	return "unknown"
+}
+
+// Greeter is a service that sends greetings.
+type Greeter struct{}
+
+// SayHello sends a greeting.
+func (g *Greeter) SayHello(ctx context.Context, req *connect.Request[hellov1.SayHelloRequest]) (*connect.Response[hellov1.SayHelloResponse], error) {
+	return connect.NewResponse(&hellov1.SayHelloResponse{
+		Message: "Hello " + req.Msg.GetName() + " (" + peerName(ctx) + ", " + req.Peer().Protocol + ")",
+	}), nil
+}
+
+// SayHelloAgain sends another greeting.
+func (g *Greeter) SayHelloAgain(ctx context.Context, req *connect.Request[hellov1.SayHelloAgainRequest]) (*connect.Response[hellov1.SayHelloAgainResponse], error) {
+	return connect.NewResponse(&hellov1.SayHelloAgainResponse{
+		Message: "Hello again " + req.Msg.GetName() + " (" + peerName(ctx) + ", " + req.Peer().Protocol + ")",
+	}), nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	roots, err := loadRootCertPool()
+	if err != nil {
+		return err
+	}
+
+	// Load certificate
+	r := &rotator{}
+	if err := r.loadCertificate(autocertFile, autocertKey); err != nil {
+		return fmt.Errorf("error loading certificate and key: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		ClientCAs:        roots,
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+		GetCertificate: r.getCertificate,
+		// Clients using the gRPC protocol require HTTP/2, Connect and
+		// gRPC-Web clients also work over HTTP/1.1. ServeTLS adds these
+		// when NextProtos is empty, they're set explicitly for clarity.
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	// Schedule periodic re-load of certificate
+	// A real implementation can use something like
+	// https://github.com/fsnotify/fsnotify
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(tickFrequency)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Println("Checking for new certificate...")
+				if err := r.loadCertificate(autocertFile, autocertKey); err != nil {
+					log.Println("Error loading certificate and key", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	// The handler serves the Connect, gRPC and gRPC-Web protocols.
+	mux := http.NewServeMux()
+	mux.Handle(hellov1connect.NewGreeterServiceHandler(&Greeter{}))
+
+	srv := &http.Server{
+		Addr:              ":443",
+		Handler:           withPeer(mux),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Println("Listening on :443")
+	// The certificate and key are provided by GetCertificate.
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+
+	return nil
+}
@@ -3,18 +3,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"errors"
 	"fmt"
 	"log"
 	"os"
-	"sync"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 
-	"github.com/smallstep/autocert/examples/hello-mtls/go-grpc/hello"
+	hellov1 "github.com/smallstep/autocert/examples/hello-mtls/go-grpc/gen/hello/v1"
+	"github.com/smallstep/autocert/pkg/rotator"
 )
 
 const (
@@ -22,72 +20,29 @@ const (
 	autocertKey      = "/var/run/autocert.step.sm/site.key"
 	autocertRoot     = "/var/run/autocert.step.sm/root.crt"
 	requestFrequency = 5 * time.Second
-	tickFrequency    = 15 * time.Second
 )
 
-// Uses techniques from https://diogomonica.com/2017/01/11/hitless-tls-certificate-rotation-in-go/
-// to automatically rotate certificates when they're renewed.
-
-type rotator struct {
-	sync.RWMutex
-	certificate *tls.Certificate
-}
-
-func (r *rotator) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
-	r.RLock()
-	defer r.RUnlock()
-	return r.certificate, nil
-}
-
-func (r *rotator) loadCertificate(certFile, keyFile string) error {
-	r.Lock()
-	defer r.Unlock()
-
-	c, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
-	}
-
-	r.certificate = &c
-
-	return nil
-}
-
-func loadRootCertPool() (*x509.CertPool, error) {
-	root, err := os.ReadFile(autocertRoot)
-	if err != nil {
-		return nil, err
-	}
-
-	pool := x509.NewCertPool()
-	if ok := pool.AppendCertsFromPEM(root); !ok {
-		return nil, errors.New("missing or invalid root certificate")
-	}
-
-	return pool, nil
-}
-
-func sayHello(c hello.GreeterClient) error {
+func sayHello(c hellov1.GreeterServiceClient) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	r, err := c.SayHello(ctx, &hello.HelloRequest{Name: "world"})
+	r, err := c.SayHello(ctx, &hellov1.SayHelloRequest{Name: "world"})
 	if err != nil {
 		return err
 	}
-	log.Printf("Greeting: %s", r.Message) //nolint:gosec // intentional logging of server greeting response
+	log.Printf("Greeting: %s", r.GetMessage()) //nolint:gosec // intentional logging of server greeting response
 	return nil
 }
 
-func sayHelloAgain(c hello.GreeterClient) error {
+func sayHelloAgain(c hellov1.GreeterServiceClient) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	r, err := c.SayHelloAgain(ctx, &hello.HelloRequest{Name: "world"})
+	r, err := c.SayHelloAgain(ctx, &hellov1.SayHelloAgainRequest{Name: "world"})
 	if err != nil {
 		return err
 	}
-	log.Printf("Greeting: %s", r.Message) //nolint:gosec // intentional logging of server greeting response
+	log.Printf("Greeting: %s", r.GetMessage()) //nolint:gosec // intentional logging of server greeting response
 	return nil
 }
 
@@ -99,20 +54,23 @@ func main() {
 }
 
 func run() error {
-	// Read the root certificate for our CA from disk
-	roots, err := loadRootCertPool()
+	// Load the root and the certificate, and reload them when they're
+	// renewed.
+	roots, err := rotator.LoadRoots(autocertRoot)
 	if err != nil {
 		return err
 	}
+	roots.Watch()
+	defer roots.Close()
 
-	// Load certificate
-	r := &rotator{}
-	if err := r.loadCertificate(autocertFile, autocertKey); err != nil {
+	r, err := rotator.New(autocertFile, autocertKey)
+	if err != nil {
 		return fmt.Errorf("error loading certificate and key: %w", err)
 	}
+	r.Watch()
+	defer r.Close()
 
-	tlsConfig := &tls.Config{
-		RootCAs:          roots,
+	tlsConfig := roots.ClientConfig(&tls.Config{
 		MinVersion:       tls.VersionTLS12,
 		CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
 		CipherSuites: []uint16{
@@ -125,29 +83,8 @@ func run() error {
 		// In this example keep alives will cause the certificate to
 		// only be called once, but if we disable them,
 		// GetClientCertificate will be called on every request.
-		GetClientCertificate: r.getClientCertificate,
-	}
-
-	// Schedule periodic re-load of certificate
-	// A real implementation can use something like
-	// https://github.com/fsnotify/fsnotify
-	done := make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(tickFrequency)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				fmt.Println("Checking for new certificate...")
-				if err := r.loadCertificate(autocertFile, autocertKey); err != nil {
-					log.Println("Error loading certificate and key", err)
-				}
-			case <-done:
-				return
-			}
-		}
-	}()
-	defer close(done)
+		GetClientCertificate: r.GetClientCertificate,
+	})
 
 	// Set up a connection to the server.
 	address := os.Getenv("HELLO_MTLS_URL")
@@ -156,7 +93,7 @@ func run() error {
 		return fmt.Errorf("did not connect: %w", err)
 	}
 	defer conn.Close() //nolint:errcheck // close errors are unactionable in defer
-	client := hello.NewGreeterClient(conn)
+	client := hellov1.NewGreeterServiceClient(conn)
 
 	for {
 		if err := sayHello(client); err != nil {
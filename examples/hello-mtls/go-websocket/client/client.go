@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/smallstep/autocert/pkg/rotator"
+)
+
+const (
+	autocertFile = "/var/run/autocert.step.sm/site.crt"
+	autocertKey  = "/var/run/autocert.step.sm/site.key"
+	autocertRoot = "/var/run/autocert.step.sm/root.crt"
+	// redialMargin is how long before the connection certificates expire
+	// the client re-dials.
+	redialMargin = 2 * time.Minute
+	retryDelay   = 5 * time.Second
+)
+
+// message is the JSON message sent by the server.
+type message struct {
+	Type    string `json:"type"`
+	Message string `json:"message,omitempty"`
+}
+
+// session is a WebSocket connection and the events that end it.
+type session struct {
+	ws     *websocket.Conn
+	expiry time.Time
+	goaway chan struct{}
+	closed chan struct{}
+}
+
+func loadRootCertPool() (*x509.CertPool, error) {
+	root, err := os.ReadFile(autocertRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(root); !ok {
+		return nil, errors.New("missing or invalid root certificate")
+	}
+
+	return pool, nil
+}
+
+// dial opens a new WebSocket connection. The TLS connection is established
+// explicitly, instead of with websocket.Dial, to learn when the certificates
+// it was established with expire.
+func dial(rawURL string, tlsConfig *tls.Config, r *rotator.Rotator) (*session, error) {
+	config, err := websocket.NewConfig(rawURL, "https://hello-mtls-client")
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", host, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close() //nolint:errcheck,gosec // the handshake error is more relevant
+		return nil, err
+	}
+
+	s := &session{
+		ws:     ws,
+		expiry: rotator.Expiry(conn.ConnectionState(), r.Leaf()),
+		goaway: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.closed)
+		for {
+			var msg message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			switch msg.Type {
+			case "goaway":
+				log.Println("Server asked to re-dial")
+				close(s.goaway)
+			default:
+				log.Printf("Greeting: %s", msg.Message) //nolint:gosec // intentional logging of server greeting response
+			}
+		}
+	}()
+	return s, nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	// Read the root certificate for our CA from disk
+	roots, err := loadRootCertPool()
+	if err != nil {
+		return err
+	}
+
+	r, err := rotator.New(autocertFile, autocertKey)
+	if err != nil {
+		return fmt.Errorf("error loading certificate and key: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx, rotator.DefaultInterval)
+
+	rotated := make(chan struct{}, 1)
+	r.OnRotate(func(*tls.Certificate) {
+		select {
+		case rotated <- struct{}{}:
+		default:
+		}
+	})
+
+	tlsConfig := &tls.Config{
+		RootCAs:          roots,
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+		GetClientCertificate: r.GetClientCertificate,
+	}
+
+	address := os.Getenv("HELLO_MTLS_URL")
+	current, err := dial(address, tlsConfig, r)
+	if err != nil {
+		return fmt.Errorf("did not connect: %w", err)
+	}
+
+	for {
+		redial := time.NewTimer(time.Until(current.expiry.Add(-redialMargin)))
+		select {
+		case <-redial.C:
+			log.Println("Certificates are about to expire, re-dialing")
+		case <-rotated:
+			log.Println("Certificate rotated, re-dialing")
+		case <-current.goaway:
+		case <-current.closed:
+			log.Println("Connection closed, re-dialing")
+		}
+		redial.Stop()
+
+		// Make before break: open the new connection before closing the
+		// old one, so no messages are missed while re-dialing.
+		next, err := dial(address, tlsConfig, r)
+		for err != nil {
+			log.Printf("Error re-dialing: %v", err)
+			time.Sleep(retryDelay)
+			next, err = dial(address, tlsConfig, r)
+		}
+		current.ws.Close() //nolint:errcheck,gosec // the old connection is no longer used
+		current = next
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/smallstep/autocert/pkg/rotator"
+)
+
+const (
+	autocertFile     = "/var/run/autocert.step.sm/site.crt"
+	autocertKey      = "/var/run/autocert.step.sm/site.key"
+	autocertRoot     = "/var/run/autocert.step.sm/root.crt"
+	messageFrequency = 5 * time.Second
+	// drainGrace is how long a client has to re-dial after being asked to,
+	// before the server closes the connection.
+	drainGrace = 30 * time.Second
+)
+
+// message is the JSON message sent to clients. A "goaway" message asks the
+// client to open a new connection and close this one.
+type message struct {
+	Type    string `json:"type"`
+	Message string `json:"message,omitempty"`
+}
+
+func loadRootCertPool() (*x509.CertPool, error) {
+	root, err := os.ReadFile(autocertRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(root); !ok {
+		return nil, errors.New("missing or invalid root certificate")
+	}
+
+	return pool, nil
+}
+
+// handler sends a greeting to the client every few seconds. Connections are
+// drained before the client or server certificate expires, and when the
+// server certificate is rotated.
+func handler(r *rotator.Rotator, tracker *rotator.Tracker) websocket.Handler {
+	return func(ws *websocket.Conn) {
+		defer ws.Close() //nolint:errcheck // close errors are unactionable in defer
+
+		state := ws.Request().TLS
+		name := state.PeerCertificates[0].Subject.CommonName
+		expiry := rotator.Expiry(*state, r.Leaf())
+		log.Printf("%s connected, certificates expire at %s", name, expiry.Format(time.RFC3339))
+
+		drain := make(chan struct{})
+		untrack := tracker.Track(expiry, func() { close(drain) })
+		defer untrack()
+
+		// Reads are only used to detect the client closing the connection.
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var msg message
+			for websocket.JSON.Receive(ws, &msg) == nil {
+			}
+		}()
+
+		ticker := time.NewTicker(messageFrequency)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := websocket.JSON.Send(ws, message{Type: "hello", Message: "Hello, " + name + "!"}); err != nil {
+					log.Printf("error writing to %s: %v", name, err)
+					return
+				}
+			case <-drain:
+				log.Printf("draining connection from %s", name)
+				if err := websocket.JSON.Send(ws, message{Type: "goaway"}); err != nil {
+					return
+				}
+				select {
+				case <-closed:
+				case <-time.After(drainGrace):
+					log.Printf("%s did not re-dial in time, closing connection", name)
+				}
+				return
+			case <-closed:
+				log.Printf("%s disconnected", name)
+				return
+			}
+		}
+	}
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	roots, err := loadRootCertPool()
+	if err != nil {
+		return err
+	}
+
+	r, err := rotator.New(autocertFile, autocertKey)
+	if err != nil {
+		return fmt.Errorf("error loading certificate and key: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx, rotator.DefaultInterval)
+
+	// Ask every client to re-dial when the server certificate is rotated,
+	// spread over 30 seconds so they don't all reconnect at once.
+	tracker := &rotator.Tracker{Jitter: 30 * time.Second}
+	r.OnRotate(func(*tls.Certificate) {
+		log.Printf("certificate rotated, draining %d connections", tracker.Len())
+		tracker.DrainAll()
+	})
+
+	srv := &http.Server{
+		Addr:    ":443",
+		Handler: handler(r, tracker),
+		TLSConfig: &tls.Config{
+			ClientAuth:       tls.RequireAndVerifyClientCert,
+			ClientCAs:        roots,
+			MinVersion:       tls.VersionTLS12,
+			CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+			CipherSuites: []uint16{
+				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			},
+			GetCertificate: r.GetCertificate,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Println("Listening on :443")
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+
+	return nil
+}
@@ -2,16 +2,15 @@ package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
-	"sync"
 	"time"
+
+	"github.com/smallstep/autocert/pkg/rotator"
 )
 
 const (
@@ -19,48 +18,8 @@ const (
 	autocertKey      = "/var/run/autocert.step.sm/site.key"
 	autocertRoot     = "/var/run/autocert.step.sm/root.crt"
 	requestFrequency = 5 * time.Second
-	tickFrequency    = 15 * time.Second
 )
 
-type rotator struct {
-	sync.RWMutex
-	certificate *tls.Certificate
-}
-
-func (r *rotator) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
-	r.RLock()
-	defer r.RUnlock()
-	return r.certificate, nil
-}
-
-func (r *rotator) loadCertificate(certFile, keyFile string) error {
-	r.Lock()
-	defer r.Unlock()
-
-	c, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
-	}
-
-	r.certificate = &c
-
-	return nil
-}
-
-func loadRootCertPool() (*x509.CertPool, error) {
-	root, err := os.ReadFile(autocertRoot)
-	if err != nil {
-		return nil, err
-	}
-
-	pool := x509.NewCertPool()
-	if ok := pool.AppendCertsFromPEM(root); !ok {
-		return nil, errors.New("missing or invalid root certificate")
-	}
-
-	return pool, nil
-}
-
 func main() {
 	if err := run(); err != nil {
 		log.Println(err)
@@ -71,23 +30,26 @@ func main() {
 func run() error {
 	url := os.Getenv("HELLO_MTLS_URL")
 
-	// Read the root certificate for our CA from disk
-	roots, err := loadRootCertPool()
+	// Load the root and the certificate, and reload them when they're
+	// renewed.
+	roots, err := rotator.LoadRoots(autocertRoot)
 	if err != nil {
 		return err
 	}
+	roots.Watch()
+	defer roots.Close()
 
-	// Load certificate
-	r := &rotator{}
-	if err := r.loadCertificate(autocertFile, autocertKey); err != nil {
+	r, err := rotator.New(autocertFile, autocertKey)
+	if err != nil {
 		return fmt.Errorf("error loading certificate and key: %w", err)
 	}
+	r.Watch()
+	defer r.Close()
 
-	// Create an HTTPS client using our cert, key & pool
+	// Create an HTTPS client using our cert, key & roots
 	client := &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs:          roots,
+			TLSClientConfig: roots.ClientConfig(&tls.Config{
 				MinVersion:       tls.VersionTLS12,
 				CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
 				CipherSuites: []uint16{
@@ -100,35 +62,13 @@ func run() error {
 				// In this example keep alives will cause the certificate to
 				// only be called once, but if we disable them,
 				// GetClientCertificate will be called on every request.
-				GetClientCertificate: r.getClientCertificate,
-			},
+				GetClientCertificate: r.GetClientCertificate,
+			}),
 			// Add this line to get the certificate on every request.
 			// DisableKeepAlives: true,
 		},
 	}
 
-	// Schedule periodic re-load of certificate
-	// A real implementation can use something like
-	// https://github.com/fsnotify/fsnotify
-	done := make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(tickFrequency)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				fmt.Println("Checking for new certificate...")
-				err := r.loadCertificate(autocertFile, autocertKey)
-				if err != nil {
-					log.Println("Error loading certificate and key", err)
-				}
-			case <-done:
-				return
-			}
-		}
-	}()
-	defer close(done)
-
 	for {
 		// Make request
 		r, err := client.Get(url) //nolint:gosec // URL comes from trusted environment configuration
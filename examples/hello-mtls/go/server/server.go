@@ -1,65 +1,24 @@
 package main
 
 import (
+	"cmp"
 	"crypto/tls"
-	"crypto/x509"
-	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"sync"
 	"time"
-)
 
-const (
-	autocertFile  = "/var/run/autocert.step.sm/site.crt"
-	autocertKey   = "/var/run/autocert.step.sm/site.key"
-	autocertRoot  = "/var/run/autocert.step.sm/root.crt"
-	tickFrequency = 15 * time.Second
+	"github.com/smallstep/autocert/pkg/rotator"
 )
 
-// Uses techniques from https://diogomonica.com/2017/01/11/hitless-tls-certificate-rotation-in-go/
-// to automatically rotate certificates when they're renewed.
-
-type rotator struct {
-	sync.RWMutex
-	certificate *tls.Certificate
-}
-
-func (r *rotator) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-	r.RLock()
-	defer r.RUnlock()
-	return r.certificate, nil
-}
-
-func (r *rotator) loadCertificate(certFile, keyFile string) error {
-	r.Lock()
-	defer r.Unlock()
-
-	c, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
-	}
-
-	r.certificate = &c
-
-	return nil
-}
-
-func loadRootCertPool() (*x509.CertPool, error) {
-	root, err := os.ReadFile(autocertRoot)
-	if err != nil {
-		return nil, err
-	}
-
-	pool := x509.NewCertPool()
-	if ok := pool.AppendCertsFromPEM(root); !ok {
-		return nil, errors.New("missing or invalid root certificate")
-	}
-
-	return pool, nil
-}
+// The files of the certificate, set by autocert with the
+// autocert.step.sm/identity-env annotation.
+var (
+	autocertFile = cmp.Or(os.Getenv("AUTOCERT_CERT_PATH"), "/var/run/autocert.step.sm/site.crt")
+	autocertKey  = cmp.Or(os.Getenv("AUTOCERT_KEY_PATH"), "/var/run/autocert.step.sm/site.key")
+	autocertRoot = cmp.Or(os.Getenv("AUTOCERT_ROOT_PATH"), "/var/run/autocert.step.sm/root.crt")
+)
 
 func main() {
 	if err := run(); err != nil {
@@ -82,15 +41,24 @@ func run() error {
 		fmt.Fprintf(w, "Ok\n") //nolint:errcheck // write errors are unactionable
 	})
 
-	roots, err := loadRootCertPool()
+	// Load the root and the certificate, and reload them when they're
+	// renewed.
+	roots, err := rotator.LoadRoots(autocertRoot)
 	if err != nil {
 		return err
 	}
+	roots.Watch()
+	defer roots.Close()
+
+	r, err := rotator.New(autocertFile, autocertKey)
+	if err != nil {
+		return fmt.Errorf("error loading certificate and key: %w", err)
+	}
+	r.Watch()
+	defer r.Close()
 
-	r := &rotator{}
-	cfg := &tls.Config{
+	cfg := roots.ServerConfig(&tls.Config{
 		ClientAuth:               tls.RequireAndVerifyClientCert,
-		ClientCAs:                roots,
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
 		PreferServerCipherSuites: true,
@@ -98,8 +66,8 @@ func run() error {
 			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
 			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 		},
-		GetCertificate: r.getCertificate,
-	}
+		GetCertificate: r.GetCertificate,
+	})
 	srv := &http.Server{
 		Addr:              ":443",
 		Handler:           mux,
@@ -107,33 +75,6 @@ func run() error {
 		ReadHeaderTimeout: 30 * time.Second,
 	}
 
-	// Load certificate
-	err = r.loadCertificate(autocertFile, autocertKey)
-	if err != nil {
-		return fmt.Errorf("error loading certificate and key: %w", err)
-	}
-
-	// Schedule periodic re-load of certificate
-	// A real implementation can use something like
-	// https://github.com/fsnotify/fsnotify
-	done := make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(tickFrequency)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				fmt.Println("Checking for new certificate...")
-				if err := r.loadCertificate(autocertFile, autocertKey); err != nil {
-					log.Println("Error loading certificate and key", err)
-				}
-			case <-done:
-				return
-			}
-		}
-	}()
-	defer close(done)
-
 	log.Println("Listening no :443")
 
 	// Start serving HTTPS
@@ -0,0 +1,18 @@
+package com.smallstep.hellomtls;
+
+import org.springframework.boot.SpringApplication;
+import org.springframework.boot.autoconfigure.SpringBootApplication;
+import org.springframework.scheduling.annotation.EnableScheduling;
+
+/**
+ * An mTLS server and client using the PKCS#12 keystores written by autocert.
+ * The {@code server} and {@code client} profiles select the role.
+ */
+@SpringBootApplication
+@EnableScheduling
+public class Application {
+
+    public static void main(String[] args) {
+        SpringApplication.run(Application.class, args);
+    }
+}
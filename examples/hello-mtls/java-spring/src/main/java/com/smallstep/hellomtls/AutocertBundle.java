@@ -0,0 +1,117 @@
+package com.smallstep.hellomtls;
+
+import java.io.IOException;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.attribute.FileTime;
+import java.util.Objects;
+
+import org.apache.commons.logging.Log;
+import org.apache.commons.logging.LogFactory;
+import org.springframework.beans.factory.annotation.Value;
+import org.springframework.boot.autoconfigure.ssl.SslBundleRegistrar;
+import org.springframework.boot.ssl.SslBundle;
+import org.springframework.boot.ssl.SslBundleKey;
+import org.springframework.boot.ssl.SslBundleRegistry;
+import org.springframework.boot.ssl.SslOptions;
+import org.springframework.boot.ssl.jks.JksSslStoreBundle;
+import org.springframework.boot.ssl.jks.JksSslStoreDetails;
+import org.springframework.context.annotation.Bean;
+import org.springframework.context.annotation.Configuration;
+import org.springframework.context.annotation.Lazy;
+import org.springframework.scheduling.annotation.Scheduled;
+
+/**
+ * Registers the keystores written by autocert as the {@code autocert} SSL
+ * bundle, and updates the bundle when autocert renews the certificate.
+ *
+ * <p>
+ * autocert writes {@code site.p12}, holding the certificate chain and its
+ * key, and {@code truststore.p12}, holding the root certificate. They are
+ * replaced on every renewal, so the keystore is polled and the bundle is
+ * updated when it changes. Updating the bundle makes the embedded server and
+ * the client use the new certificate for new connections, without restarting.
+ */
+@Configuration(proxyBeanMethods = false)
+public class AutocertBundle {
+
+    /** The name of the SSL bundle. */
+    public static final String NAME = "autocert";
+
+    private static final Log log = LogFactory.getLog(AutocertBundle.class);
+
+    private final Path keyStore;
+
+    private final Path trustStore;
+
+    private final String password;
+
+    private final SslBundleRegistry registry;
+
+    private FileTime loaded;
+
+    public AutocertBundle(@Value("${autocert.dir}") Path dir, @Value("${autocert.password}") String password,
+            @Lazy SslBundleRegistry registry) {
+        this.keyStore = dir.resolve("site.p12");
+        this.trustStore = dir.resolve("truststore.p12");
+        this.password = password;
+        this.registry = registry;
+    }
+
+    @Bean
+    SslBundleRegistrar autocertBundleRegistrar() {
+        return (registry) -> {
+            this.loaded = lastModified();
+            registry.registerBundle(NAME, load());
+        };
+    }
+
+    /**
+     * Updates the bundle if the keystore changed. On error, the current
+     * bundle is kept and loading is retried on the next check: autocert might
+     * still be writing the renewed keystores.
+     */
+    @Scheduled(fixedDelayString = "${autocert.reload-interval}", initialDelayString = "${autocert.reload-interval}")
+    void reload() {
+        FileTime modified = lastModified();
+        if (modified == null || Objects.equals(modified, this.loaded)) {
+            return;
+        }
+        try {
+            this.registry.updateBundle(NAME, load());
+            this.loaded = modified;
+            log.info("Reloaded certificate from " + this.keyStore);
+        }
+        catch (RuntimeException ex) {
+            log.warn("Error reloading certificate from " + this.keyStore + ": " + ex.getMessage());
+        }
+    }
+
+    /**
+     * Loads the keystores. The key and trust managers are created so that
+     * invalid keystores fail here, and not on the next handshake.
+     */
+    private SslBundle load() {
+        JksSslStoreBundle stores = new JksSslStoreBundle(store(this.keyStore), store(this.trustStore));
+        SslBundle bundle = SslBundle.of(stores, SslBundleKey.NONE, SslOptions.of(
+                new String[] { "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+                        "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256" },
+                new String[] { "TLSv1.2" }));
+        bundle.getManagers().getKeyManagerFactory();
+        bundle.getManagers().getTrustManagerFactory();
+        return bundle;
+    }
+
+    private JksSslStoreDetails store(Path path) {
+        return new JksSslStoreDetails("PKCS12", null, path.toUri().toString(), this.password);
+    }
+
+    private FileTime lastModified() {
+        try {
+            return Files.getLastModifiedTime(this.keyStore);
+        }
+        catch (IOException ex) {
+            return null;
+        }
+    }
+}
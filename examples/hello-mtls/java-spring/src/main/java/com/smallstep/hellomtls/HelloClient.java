@@ -0,0 +1,75 @@
+package com.smallstep.hellomtls;
+
+import java.time.Instant;
+import java.util.Arrays;
+
+import javax.net.ssl.SSLException;
+
+import io.netty.handler.ssl.SslContext;
+import io.netty.handler.ssl.SslContextBuilder;
+import org.apache.commons.logging.Log;
+import org.apache.commons.logging.LogFactory;
+import reactor.netty.http.client.HttpClient;
+import reactor.netty.resources.ConnectionProvider;
+
+import org.springframework.beans.factory.annotation.Value;
+import org.springframework.boot.ssl.SslBundle;
+import org.springframework.boot.ssl.SslBundles;
+import org.springframework.context.annotation.Profile;
+import org.springframework.http.client.reactive.ReactorClientHttpConnector;
+import org.springframework.scheduling.annotation.Scheduled;
+import org.springframework.stereotype.Component;
+import org.springframework.web.reactive.function.client.WebClient;
+
+/**
+ * Requests the server every five seconds with a WebClient authenticating with
+ * the autocert certificate. The WebClient is rebuilt when the bundle is
+ * updated, and doesn't pool connections, so every request uses the current
+ * certificate.
+ */
+@Profile("client")
+@Component
+public class HelloClient {
+
+    private static final Log log = LogFactory.getLog(HelloClient.class);
+
+    private final String url;
+
+    private volatile WebClient client;
+
+    public HelloClient(@Value("${hello-mtls.url}") String url, SslBundles bundles) throws SSLException {
+        this.url = url;
+        this.client = build(bundles.getBundle(AutocertBundle.NAME));
+        bundles.addBundleUpdateHandler(AutocertBundle.NAME, (bundle) -> {
+            try {
+                this.client = build(bundle);
+            }
+            catch (SSLException ex) {
+                log.warn("Error using renewed certificate: " + ex.getMessage());
+            }
+        });
+    }
+
+    private static WebClient build(SslBundle bundle) throws SSLException {
+        SslContext context = SslContextBuilder.forClient()
+            .keyManager(bundle.getManagers().getKeyManagerFactory())
+            .trustManager(bundle.getManagers().getTrustManagerFactory())
+            .protocols(bundle.getOptions().getEnabledProtocols())
+            .ciphers(Arrays.asList(bundle.getOptions().getCiphers()))
+            .build();
+        HttpClient http = HttpClient.create(ConnectionProvider.newConnection())
+            .secure((spec) -> spec.sslContext(context));
+        return WebClient.builder().clientConnector(new ReactorClientHttpConnector(http)).build();
+    }
+
+    @Scheduled(fixedDelay = 5000)
+    void hello() {
+        try {
+            String body = this.client.get().uri(this.url).retrieve().bodyToMono(String.class).block();
+            System.out.print(Instant.now() + ": " + body);
+        }
+        catch (RuntimeException ex) {
+            log.warn("Error requesting " + this.url + ": " + ex.getMessage());
+        }
+    }
+}
@@ -0,0 +1,24 @@
+package com.smallstep.hellomtls;
+
+import java.security.cert.X509Certificate;
+
+import jakarta.servlet.http.HttpServletRequest;
+
+import org.springframework.context.annotation.Profile;
+import org.springframework.web.bind.annotation.GetMapping;
+import org.springframework.web.bind.annotation.RestController;
+
+/**
+ * Greets clients by the subject of their certificate.
+ */
+@Profile("server")
+@RestController
+public class HelloController {
+
+    @GetMapping("/")
+    public String hello(HttpServletRequest request) {
+        X509Certificate[] chain = (X509Certificate[]) request
+            .getAttribute("jakarta.servlet.request.X509Certificate");
+        return "Hello, " + chain[0].getSubjectX500Principal().getName() + "!\n";
+    }
+}
@@ -0,0 +1,49 @@
+// Loads the certificate written by autocert and reloads it when it's renewed.
+//
+// autocert renews certificates in place: the renewer writes the new files
+// under temporary names and renames them over the old ones. fs.watch follows
+// the replaced inode and stops firing after the first renewal, so the files
+// are polled with fs.watchFile, which stats the paths.
+const fs = require('fs');
+const path = require('path');
+
+const dir = process.env.AUTOCERT_DIR || '/var/run/autocert.step.sm';
+
+const files = {
+    ca: path.join(dir, 'root.crt'),
+    key: path.join(dir, 'site.key'),
+    cert: path.join(dir, 'site.crt'),
+};
+
+// How often the certificate is checked for changes, in milliseconds.
+const interval = 5000;
+
+// load returns the current root, key and certificate.
+function load() {
+    return {
+        ca: fs.readFileSync(files.ca),
+        key: fs.readFileSync(files.key),
+        cert: fs.readFileSync(files.cert),
+    };
+}
+
+// watch calls onRenew with the new root, key and certificate every time the
+// certificate changes. The certificate is written after the key, so both are
+// read once it changes. onRenew should validate them, for instance with
+// tls.createSecureContext, and keep the current ones if it fails: a
+// re-issuance replacing the key might not be complete yet, and the next
+// change of the certificate retries.
+function watch(onRenew) {
+    fs.watchFile(files.cert, { interval: interval }, (curr, prev) => {
+        if (curr.mtimeMs === prev.mtimeMs && curr.ino === prev.ino) {
+            return;
+        }
+        try {
+            onRenew(load());
+        } catch (e) {
+            process.stderr.write('error reloading certificate: ' + e.message + '\n');
+        }
+    });
+}
+
+module.exports = { files, load, watch };
@@ -1,43 +1,48 @@
-const fs = require('fs'); 
-const https = require('https'); 
+const https = require('https');
+const tls = require('tls');
+const autocert = require('./autocert');
 
 const config = {
-    ca: '/var/run/autocert.step.sm/root.crt',
-    key: '/var/run/autocert.step.sm/site.key',
-    cert: '/var/run/autocert.step.sm/site.crt',
     url: process.env.HELLO_MTLS_URL,
     requestFrequency: 5000
 };
 
-var options = { 
-    ca: fs.readFileSync(config.ca), 
-    key: fs.readFileSync(config.key),
-    cert: fs.readFileSync(config.cert),
-    ciphers: 'ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-ECDSA-AES128-GCM-SHA256',
-    minVersion: 'TLSv1.2',
-    maxVersion: 'TLSv1.2',
-    // Not necessary as it defaults to true
-    rejectUnauthorized: true
-};
+let files = autocert.load();
 
-fs.watch(config.cert, (event, filename) => {
-    if (event == 'change') {
-        options.cert = fs.readFileSync(config.cert);
-    }
+// Use the renewed certificate for the next requests. The files are checked
+// first, so a partial write keeps the current certificate.
+autocert.watch((renewed) => {
+    tls.createSecureContext(renewed);
+    files = renewed;
+    console.log('Reloaded certificate');
 });
 
 function loop() {
-    var req = https.request(config.url, options, function(res) { 
+    // The agent pools connections by TLS options, so a new certificate
+    // opens a new connection, authenticated with it.
+    const req = https.request(config.url, {
+        ca: files.ca,
+        key: files.key,
+        cert: files.cert,
+        ciphers: 'ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-ECDSA-AES128-GCM-SHA256',
+        minVersion: 'TLSv1.2',
+        maxVersion: 'TLSv1.2',
+        // Not necessary as it defaults to true
+        rejectUnauthorized: true
+    }, (res) => {
+        let body = '';
         res.on('data', (data) => {
-            process.stdout.write(options.cert)
-            process.stdout.write(data)
+            body += data;
+        });
+        res.on('end', () => {
+            process.stdout.write(new Date().toISOString() + ': ' + body);
             setTimeout(loop, config.requestFrequency);
-        }); 
-    }); 
+        });
+    });
     req.on('error', (e) => {
         process.stderr.write('error: ' + e.message + '\n');
         setTimeout(loop, config.requestFrequency);
-    })
+    });
     req.end();
 }
 
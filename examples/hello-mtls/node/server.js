@@ -1,42 +1,44 @@
 const https = require('https');
 const tls = require('tls');
-const fs = require('fs');
+const autocert = require('./autocert');
 
-var config = {
-    ca: '/var/run/autocert.step.sm/root.crt',
-    key: '/var/run/autocert.step.sm/site.key',
-    cert: '/var/run/autocert.step.sm/site.crt',
+const config = {
+    port: process.env.PORT || 443,
     ciphers: 'ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-ECDSA-AES128-GCM-SHA256',
     minVersion: 'TLSv1.2',
     maxVersion: 'TLSv1.2'
 };
 
-function createSecureContext() {
-    return tls.createSecureContext({
-        ca: fs.readFileSync(config.ca),
-        key: fs.readFileSync(config.key),
-        cert: fs.readFileSync(config.cert),
+function secureContextOptions(files) {
+    return {
+        ca: files.ca,
+        key: files.key,
+        cert: files.cert,
         ciphers: config.ciphers,
-    });
+        minVersion: config.minVersion,
+        maxVersion: config.maxVersion,
+    };
 }
 
-var ctx = createSecureContext()
-
-fs.watch(config.cert, (event, filename) => {
-    if (event == 'change') {
-        ctx = createSecureContext();
-    }
-});
-
-https.createServer({
+const server = https.createServer({
+    ...secureContextOptions(autocert.load()),
     requestCert: true,
     rejectUnauthorized: true,
-    SNICallback: (servername, cb) => {
-        cb(null, ctx);
-    }
 }, (req, res) => {
+    const cert = req.socket.getPeerCertificate();
     res.writeHead(200);
-    res.end('hello nodejs\n');
-}).listen(443);
+    res.end('Hello, ' + cert.subject.CN + '!\n');
+});
+
+// Use the renewed certificate for new connections. The files are checked
+// first, so a partial write keeps the current certificate.
+autocert.watch((files) => {
+    const options = secureContextOptions(files);
+    tls.createSecureContext(options);
+    server.setSecureContext(options);
+    console.log('Reloaded certificate');
+});
+
+server.listen(config.port);
 
-console.log("Listening on :443 ...");
\ No newline at end of file
+console.log('Listening on :' + config.port + ' ...');
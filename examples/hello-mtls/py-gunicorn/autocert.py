@@ -0,0 +1,69 @@
+"""Loads the certificate written by autocert into an ssl.SSLContext and
+reloads it when it's renewed.
+
+autocert renews certificates in place: the renewer writes the new files under
+temporary names and renames them over the old ones. The certificate is polled
+for changes, which works with any file system and doesn't need third party
+packages.
+"""
+import logging
+import os
+import ssl
+import threading
+
+AUTOCERT_DIR = os.environ.get('AUTOCERT_DIR', '/var/run/autocert.step.sm')
+
+ca_certs = os.path.join(AUTOCERT_DIR, 'root.crt')
+cert_file = os.path.join(AUTOCERT_DIR, 'site.crt')
+key_file = os.path.join(AUTOCERT_DIR, 'site.key')
+
+# How often the certificate is checked for changes, in seconds.
+INTERVAL = 5
+
+
+def _stat(path):
+    try:
+        st = os.stat(path)
+    except OSError:
+        return None
+    return (st.st_ino, st.st_mtime_ns, st.st_size)
+
+
+class Reloader(threading.Thread):
+    """Reloads the certificate and key of an SSLContext when they change.
+
+    The files are loaded in a scratch context first: load_cert_chain replaces
+    the certificate before it checks the key, so loading a partially written
+    renewal directly would leave the context with a certificate that doesn't
+    match its key. On error the current certificate is kept, and loading is
+    retried on the next check.
+    """
+
+    def __init__(self, ctx, purpose=ssl.Purpose.CLIENT_AUTH, interval=INTERVAL):
+        super().__init__(daemon=True)
+        self.ctx = ctx
+        self.purpose = purpose
+        self.interval = interval
+        self.loaded = _stat(cert_file)
+        self.stopped = threading.Event()
+
+    def reload(self):
+        """Loads the certificate if it changed, and returns whether it did."""
+        current = _stat(cert_file)
+        if current is None or current == self.loaded:
+            return False
+        ssl.create_default_context(self.purpose).load_cert_chain(cert_file, key_file)
+        self.ctx.load_cert_chain(cert_file, key_file)
+        self.loaded = current
+        return True
+
+    def run(self):
+        while not self.stopped.wait(self.interval):
+            try:
+                if self.reload():
+                    logging.info("reloaded certificate")
+            except (OSError, ssl.SSLError) as err:
+                logging.warning("error reloading certificate: %s", err)
+
+    def stop(self):
+        self.stopped.set()
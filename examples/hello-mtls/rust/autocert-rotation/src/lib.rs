@@ -0,0 +1,283 @@
+//! Loads the certificate and key written by autocert and reloads them when
+//! they are renewed, so rustls servers and clients rotate certificates
+//! without restarting. This is a port of the Go
+//! [`pkg/rotator`](https://github.com/smallstep/autocert/tree/master/pkg/rotator)
+//! package, and follows its API:
+//!
+//! ```no_run
+//! let rotator = autocert_rotation::Rotator::new(
+//!     autocert_rotation::CERT_FILE,
+//!     autocert_rotation::KEY_FILE,
+//! )?;
+//! rotator.run(autocert_rotation::DEFAULT_INTERVAL);
+//! let config = rustls::ServerConfig::builder()
+//!     .with_no_client_auth()
+//!     .with_cert_resolver(rotator.clone());
+//! # Ok::<(), autocert_rotation::Error>(())
+//! ```
+
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, RwLock};
+use std::thread;
+use std::time::Duration;
+
+use rustls::client::ResolvesClientCert;
+use rustls::crypto::CryptoProvider;
+use rustls::server::{ClientHello, ResolvesServerCert};
+use rustls::sign::CertifiedKey;
+use rustls::{RootCertStore, SignatureScheme};
+use rustls_pki_types::pem::PemObject;
+use rustls_pki_types::{CertificateDer, PrivateKeyDer};
+
+/// The certificate written by autocert.
+pub const CERT_FILE: &str = "/var/run/autocert.step.sm/site.crt";
+/// The private key written by autocert.
+pub const KEY_FILE: &str = "/var/run/autocert.step.sm/site.key";
+/// The root certificate written by autocert.
+pub const ROOT_FILE: &str = "/var/run/autocert.step.sm/root.crt";
+
+/// The default interval between checks for a renewed certificate.
+pub const DEFAULT_INTERVAL: Duration = Duration::from_secs(15);
+
+/// The errors returned by this crate.
+pub type Error = Box<dyn std::error::Error + Send + Sync>;
+
+/// Holds the current certificate and key, and reloads them from disk when
+/// they change. It can be used as the certificate resolver of both rustls
+/// servers and clients.
+#[derive(Debug)]
+pub struct Rotator {
+    cert_file: PathBuf,
+    key_file: PathBuf,
+    provider: Arc<CryptoProvider>,
+    current: RwLock<Arc<CertifiedKey>>,
+}
+
+impl Rotator {
+    /// Returns a Rotator for the given certificate and key files, using the
+    /// process-wide default crypto provider, or ring if none is installed.
+    /// The files are loaded immediately.
+    pub fn new(cert_file: impl AsRef<Path>, key_file: impl AsRef<Path>) -> Result<Arc<Self>, Error> {
+        let provider = CryptoProvider::get_default()
+            .cloned()
+            .unwrap_or_else(|| Arc::new(rustls::crypto::ring::default_provider()));
+        let current = load(cert_file.as_ref(), key_file.as_ref(), &provider)?;
+        Ok(Arc::new(Self {
+            cert_file: cert_file.as_ref().to_path_buf(),
+            key_file: key_file.as_ref().to_path_buf(),
+            provider,
+            current: RwLock::new(Arc::new(current)),
+        }))
+    }
+
+    /// Reads the certificate and key files and replaces the current
+    /// certificate if it has changed. It returns whether the certificate was
+    /// rotated. On error the current certificate is kept.
+    pub fn reload(&self) -> Result<bool, Error> {
+        let loaded = load(&self.cert_file, &self.key_file, &self.provider)?;
+        let mut current = self.current.write().unwrap_or_else(|e| e.into_inner());
+        if current.cert.first() == loaded.cert.first() {
+            return Ok(false);
+        }
+        *current = Arc::new(loaded);
+        Ok(true)
+    }
+
+    /// Returns the current certificate and key.
+    pub fn certificate(&self) -> Arc<CertifiedKey> {
+        self.current.read().unwrap_or_else(|e| e.into_inner()).clone()
+    }
+
+    /// Reloads the certificate every interval in a background thread.
+    /// Errors are ignored and the current certificate is kept, so a partially
+    /// written renewal is picked up on the next check.
+    pub fn run(self: &Arc<Self>, interval: Duration) -> thread::JoinHandle<()> {
+        let rotator = Arc::clone(self);
+        thread::spawn(move || loop {
+            thread::sleep(interval);
+            let _ = rotator.reload();
+        })
+    }
+}
+
+impl ResolvesServerCert for Rotator {
+    fn resolve(&self, _: ClientHello<'_>) -> Option<Arc<CertifiedKey>> {
+        Some(self.certificate())
+    }
+}
+
+impl ResolvesClientCert for Rotator {
+    fn resolve(&self, _: &[&[u8]], _: &[SignatureScheme]) -> Option<Arc<CertifiedKey>> {
+        Some(self.certificate())
+    }
+
+    fn has_certs(&self) -> bool {
+        true
+    }
+}
+
+/// Loads a certificate chain and its key, and checks they match.
+fn load(cert_file: &Path, key_file: &Path, provider: &CryptoProvider) -> Result<CertifiedKey, Error> {
+    let chain = CertificateDer::pem_file_iter(cert_file)?.collect::<Result<Vec<_>, _>>()?;
+    if chain.is_empty() {
+        return Err(format!("{} does not contain a PEM certificate", cert_file.display()).into());
+    }
+    let key = PrivateKeyDer::from_pem_file(key_file)?;
+    Ok(CertifiedKey::from_der(chain, key, provider)?)
+}
+
+/// Loads the root certificates in the given PEM file, usually ROOT_FILE, to
+/// verify peers.
+pub fn load_roots(root_file: impl AsRef<Path>) -> Result<RootCertStore, Error> {
+    let mut roots = RootCertStore::empty();
+    for cert in CertificateDer::pem_file_iter(root_file.as_ref())? {
+        roots.add(cert?)?;
+    }
+    if roots.is_empty() {
+        return Err(format!("{} does not contain a PEM certificate", root_file.as_ref().display()).into());
+    }
+    Ok(roots)
+}
+
+/// Returns the ring crypto provider restricted to the cipher suites used by
+/// the hello-mtls examples: TLS 1.3, and TLS 1.2 with ECDHE and ECDSA.
+pub fn provider() -> CryptoProvider {
+    use rustls::crypto::ring::{cipher_suite, default_provider};
+    CryptoProvider {
+        cipher_suites: vec![
+            cipher_suite::TLS13_AES_128_GCM_SHA256,
+            cipher_suite::TLS13_AES_256_GCM_SHA384,
+            cipher_suite::TLS13_CHACHA20_POLY1305_SHA256,
+            cipher_suite::TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+            cipher_suite::TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+        ],
+        ..default_provider()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use rustls::server::WebPkiClientVerifier;
+    use rustls::{ClientConfig, ClientConnection, ServerConfig, ServerConnection, StreamOwned};
+    use std::fs;
+    use std::net::{TcpListener, TcpStream};
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    const TESTDATA: &str = concat!(env!("CARGO_MANIFEST_DIR"), "/testdata");
+
+    /// Returns a new directory holding site.crt and site.key, copied from the
+    /// given test certificate.
+    fn certs_dir(name: &str) -> PathBuf {
+        static COUNT: AtomicUsize = AtomicUsize::new(0);
+        let dir = std::env::temp_dir().join(format!(
+            "autocert-rotation-{}-{}",
+            std::process::id(),
+            COUNT.fetch_add(1, Ordering::SeqCst)
+        ));
+        fs::create_dir_all(&dir).unwrap();
+        install(&dir, name);
+        dir
+    }
+
+    /// Replaces site.crt and site.key with the given test certificate.
+    fn install(dir: &Path, name: &str) {
+        fs::copy(Path::new(TESTDATA).join(format!("{name}.crt")), dir.join("site.crt")).unwrap();
+        fs::copy(Path::new(TESTDATA).join(format!("{name}.key")), dir.join("site.key")).unwrap();
+    }
+
+    fn leaf(name: &str) -> CertificateDer<'static> {
+        CertificateDer::from_pem_file(Path::new(TESTDATA).join(format!("{name}.crt"))).unwrap()
+    }
+
+    #[test]
+    fn reloads_renewed_certificates() {
+        let dir = certs_dir("site1");
+        let rotator = Rotator::new(dir.join("site.crt"), dir.join("site.key")).unwrap();
+        assert_eq!(rotator.certificate().cert[0], leaf("site1"));
+        assert!(!rotator.reload().unwrap());
+
+        install(&dir, "site2");
+        assert!(rotator.reload().unwrap());
+        assert_eq!(rotator.certificate().cert[0], leaf("site2"));
+
+        // A partially written renewal keeps the current certificate.
+        fs::copy(Path::new(TESTDATA).join("site1.crt"), dir.join("site.crt")).unwrap();
+        assert!(rotator.reload().is_err());
+        assert_eq!(rotator.certificate().cert[0], leaf("site2"));
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn rejects_mismatched_keys() {
+        let dir = certs_dir("site1");
+        fs::copy(Path::new(TESTDATA).join("site2.key"), dir.join("site.key")).unwrap();
+        assert!(Rotator::new(dir.join("site.crt"), dir.join("site.key")).is_err());
+        assert!(Rotator::new(dir.join("missing.crt"), dir.join("site.key")).is_err());
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn handshakes_with_the_current_certificate() {
+        let roots = Arc::new(load_roots(Path::new(TESTDATA).join("root.crt")).unwrap());
+        let provider = Arc::new(provider());
+
+        let server_dir = certs_dir("site1");
+        let server = Rotator::new(server_dir.join("site.crt"), server_dir.join("site.key")).unwrap();
+        let verifier = WebPkiClientVerifier::builder_with_provider(roots.clone(), provider.clone())
+            .build()
+            .unwrap();
+        let server_config = Arc::new(
+            ServerConfig::builder_with_provider(provider.clone())
+                .with_safe_default_protocol_versions()
+                .unwrap()
+                .with_client_cert_verifier(verifier)
+                .with_cert_resolver(server.clone()),
+        );
+
+        let client_dir = certs_dir("site2");
+        let client = Rotator::new(client_dir.join("site.crt"), client_dir.join("site.key")).unwrap();
+        let client_config = Arc::new(
+            ClientConfig::builder_with_provider(provider)
+                .with_safe_default_protocol_versions()
+                .unwrap()
+                .with_root_certificates(roots)
+                .with_client_cert_resolver(client.clone()),
+        );
+
+        // handshake returns the certificates seen by the client and the
+        // server.
+        let handshake = || {
+            let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+            let addr = listener.local_addr().unwrap();
+            let server_config = server_config.clone();
+            let accept = std::thread::spawn(move || {
+                let (stream, _) = listener.accept().unwrap();
+                let mut tls = StreamOwned::new(ServerConnection::new(server_config).unwrap(), stream);
+                while tls.conn.is_handshaking() {
+                    tls.conn.complete_io(&mut tls.sock).unwrap();
+                }
+                tls.conn.peer_certificates().unwrap()[0].clone().into_owned()
+            });
+            let conn = ClientConnection::new(client_config.clone(), "localhost".try_into().unwrap()).unwrap();
+            let mut tls = StreamOwned::new(conn, TcpStream::connect(addr).unwrap());
+            while tls.conn.is_handshaking() {
+                tls.conn.complete_io(&mut tls.sock).unwrap();
+            }
+            let seen_by_client = tls.conn.peer_certificates().unwrap()[0].clone().into_owned();
+            (seen_by_client, accept.join().unwrap())
+        };
+
+        assert_eq!(handshake(), (leaf("site1"), leaf("site2")));
+
+        // Renewed certificates are used by the next handshakes.
+        install(&server_dir, "site2");
+        install(&client_dir, "site1");
+        assert!(server.reload().unwrap());
+        assert!(client.reload().unwrap());
+        assert_eq!(handshake(), (leaf("site2"), leaf("site1")));
+
+        fs::remove_dir_all(server_dir).unwrap();
+        fs::remove_dir_all(client_dir).unwrap();
+    }
+}
@@ -0,0 +1,96 @@
+//! An mTLS client using the certificate written by autocert, reloaded when
+//! it's renewed. It requests HELLO_MTLS_URL every five seconds.
+
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use autocert_rotation::{load_roots, provider, Error, Rotator, CERT_FILE, DEFAULT_INTERVAL, KEY_FILE, ROOT_FILE};
+use rustls::ClientConfig;
+use rustls_pki_types::ServerName;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+use tokio_rustls::TlsConnector;
+
+const REQUEST_FREQUENCY: Duration = Duration::from_secs(5);
+
+#[tokio::main]
+async fn main() {
+    if let Err(err) = run().await {
+        eprintln!("{err}");
+        std::process::exit(1);
+    }
+}
+
+async fn run() -> Result<(), Error> {
+    let url = std::env::var("HELLO_MTLS_URL")?;
+    let (host, port, path) = parse_url(&url)?;
+
+    // Load the certificate, and reload it periodically. Every request opens
+    // a new connection, so the renewed certificate is sent as soon as it's
+    // loaded.
+    let rotator =
+        Rotator::new(CERT_FILE, KEY_FILE).map_err(|err| format!("error loading certificate and key: {err}"))?;
+    rotator.run(DEFAULT_INTERVAL);
+
+    // Trust only our CA.
+    let roots = load_roots(ROOT_FILE)?;
+    let config = ClientConfig::builder_with_provider(Arc::new(provider()))
+        .with_safe_default_protocol_versions()?
+        .with_root_certificates(roots)
+        .with_client_cert_resolver(rotator);
+    let connector = TlsConnector::from(Arc::new(config));
+    let server_name = ServerName::try_from(host.clone())?;
+
+    loop {
+        let stream = TcpStream::connect((host.as_str(), port)).await?;
+        let mut stream = connector.connect(server_name.clone(), stream).await?;
+        let request = format!("GET {path} HTTP/1.1\r\nHost: {host}\r\nConnection: close\r\n\r\n");
+        stream.write_all(request.as_bytes()).await?;
+
+        let mut response = String::new();
+        stream.read_to_string(&mut response).await?;
+        let body = response
+            .split_once("\r\n\r\n")
+            .map(|(_, body)| body)
+            .unwrap_or_default();
+
+        let now = SystemTime::now().duration_since(UNIX_EPOCH)?.as_secs();
+        println!("{now}: {}", body.trim_end());
+
+        tokio::time::sleep(REQUEST_FREQUENCY).await;
+    }
+}
+
+/// Splits an https URL into its host, port and path.
+fn parse_url(url: &str) -> Result<(String, u16, String), Error> {
+    let rest = url
+        .strip_prefix("https://")
+        .ok_or_else(|| format!("{url} is not an https URL"))?;
+    let (authority, path) = match rest.find('/') {
+        Some(i) => (&rest[..i], &rest[i..]),
+        None => (rest, "/"),
+    };
+    let (host, port) = match authority.rsplit_once(':') {
+        Some((host, port)) => (host, port.parse()?),
+        None => (authority, 443),
+    };
+    Ok((host.to_string(), port, path.to_string()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::parse_url;
+
+    #[test]
+    fn parses_urls() {
+        assert_eq!(
+            parse_url("https://hello-mtls.default.svc.cluster.local").unwrap(),
+            ("hello-mtls.default.svc.cluster.local".to_string(), 443, "/".to_string())
+        );
+        assert_eq!(
+            parse_url("https://hello-mtls:8443/healthz").unwrap(),
+            ("hello-mtls".to_string(), 8443, "/healthz".to_string())
+        );
+        assert!(parse_url("http://hello-mtls").is_err());
+    }
+}
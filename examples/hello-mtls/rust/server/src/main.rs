@@ -0,0 +1,98 @@
+//! An mTLS server using the certificate written by autocert, reloaded when
+//! it's renewed. It greets clients by the name in their certificate.
+
+use std::sync::Arc;
+
+use autocert_rotation::{load_roots, provider, Error, Rotator, CERT_FILE, DEFAULT_INTERVAL, KEY_FILE, ROOT_FILE};
+use rustls::server::WebPkiClientVerifier;
+use rustls::ServerConfig;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream};
+use tokio_rustls::TlsAcceptor;
+
+#[tokio::main]
+async fn main() {
+    if let Err(err) = run().await {
+        eprintln!("{err}");
+        std::process::exit(1);
+    }
+}
+
+async fn run() -> Result<(), Error> {
+    // Load the certificate, and reload it periodically. New handshakes use
+    // the renewed certificate.
+    let rotator =
+        Rotator::new(CERT_FILE, KEY_FILE).map_err(|err| format!("error loading certificate and key: {err}"))?;
+    rotator.run(DEFAULT_INTERVAL);
+
+    // Require client certificates issued by our CA.
+    let provider = Arc::new(provider());
+    let roots = load_roots(ROOT_FILE)?;
+    let verifier = WebPkiClientVerifier::builder_with_provider(Arc::new(roots), provider.clone()).build()?;
+    let config = ServerConfig::builder_with_provider(provider)
+        .with_safe_default_protocol_versions()?
+        .with_client_cert_verifier(verifier)
+        .with_cert_resolver(rotator);
+    let acceptor = TlsAcceptor::from(Arc::new(config));
+
+    let listener = TcpListener::bind("0.0.0.0:443").await?;
+    println!("Listening on :443");
+    loop {
+        let (stream, _) = listener.accept().await?;
+        let acceptor = acceptor.clone();
+        tokio::spawn(async move {
+            if let Err(err) = handle(acceptor, stream).await {
+                eprintln!("Error handling connection: {err}");
+            }
+        });
+    }
+}
+
+/// Serves one HTTP/1.1 request and closes the connection.
+async fn handle(acceptor: TlsAcceptor, stream: TcpStream) -> Result<(), Error> {
+    let mut stream = acceptor.accept(stream).await?;
+
+    let mut request = Vec::new();
+    let mut buf = [0; 1024];
+    while !request.windows(4).any(|w| w == b"\r\n\r\n") {
+        let n = stream.read(&mut buf).await?;
+        if n == 0 || request.len() > 8192 {
+            return Err("invalid request".into());
+        }
+        request.extend_from_slice(&buf[..n]);
+    }
+    let path = String::from_utf8_lossy(&request)
+        .split_whitespace()
+        .nth(1)
+        .unwrap_or("/")
+        .to_string();
+
+    let body = if path == "/healthz" {
+        "Ok\n".to_string()
+    } else {
+        // The name is taken from the client certificate, verified during the
+        // handshake.
+        let name = stream
+            .get_ref()
+            .1
+            .peer_certificates()
+            .and_then(|certs| certs.first())
+            .and_then(|cert| {
+                webpki::EndEntityCert::try_from(cert)
+                    .ok()
+                    .and_then(|cert| cert.valid_dns_names().next().map(str::to_string))
+            });
+        match name {
+            Some(name) => format!("Hello, {name}!\n"),
+            None => "Unauthenticated\n".to_string(),
+        }
+    };
+
+    let response = format!(
+        "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{body}",
+        body.len()
+    );
+    stream.write_all(response.as_bytes()).await?;
+    stream.shutdown().await?;
+    Ok(())
+}
@@ -0,0 +1,152 @@
+// Command mtls-proxy is an identity-aware reverse proxy for applications that
+// can't do mTLS themselves. Deployed as a sidecar next to the application, it
+// terminates mTLS with the certificate issued by autocert, rejects clients
+// that are not in its allowlist, and forwards the requests over plain HTTP on
+// localhost with the identity of the client in the X-Client-Identity header.
+//
+// The certificate is reloaded when autocert renews it. With -metrics, the
+// requests are counted by client identity, and with -access-log they are
+// logged with the TLS metadata of their connection.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/autocert"
+	"github.com/smallstep/autocert/pkg/rotator"
+)
+
+const (
+	autocertFile = "/var/run/autocert.step.sm/site.crt"
+	autocertKey  = "/var/run/autocert.step.sm/site.key"
+	autocertRoot = "/var/run/autocert.step.sm/root.crt"
+)
+
+// env returns the value of the given environment variable, or def if it's
+// not set. It allows configuring the proxy from the pod spec.
+func env(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var (
+		listen   = flag.String("listen", env("PROXY_LISTEN", ":8443"), "the `address` to listen on")
+		upstream = flag.String("upstream", env("PROXY_UPSTREAM", "http://127.0.0.1:8080"), "the `URL` of the application")
+		allow    = flag.String("allow", env("PROXY_ALLOW", ""), "comma-separated `patterns` of the allowed client names, all of them if empty")
+		certFile = flag.String("cert", env("PROXY_CERT", autocertFile), "the certificate `file`")
+		keyFile  = flag.String("key", env("PROXY_KEY", autocertKey), "the private key `file`")
+		rootFile = flag.String("root", env("PROXY_ROOT", autocertRoot), "the root certificate `file` used to verify clients")
+		metrics  = flag.String("metrics", env("PROXY_METRICS", ""), "the `address` serving the request metrics on /metrics, disabled if empty")
+		peers    = flag.String("metrics-peers", env("PROXY_METRICS_PEERS", ""), "comma-separated `patterns` of the client names labeling the metrics, the first 100 if empty")
+		logging  = flag.Bool("access-log", env("PROXY_ACCESS_LOG", "") == "true", "log the requests as JSON lines on stdout")
+	)
+	flag.Parse()
+
+	u, err := url.Parse(*upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid upstream %q", *upstream)
+	}
+	allowed, err := parseAllowlist(*allow)
+	if err != nil {
+		return fmt.Errorf("invalid allowlist %q: %w", *allow, err)
+	}
+	metricsPeers, err := parseAllowlist(*peers)
+	if err != nil {
+		return fmt.Errorf("invalid metrics peers %q: %w", *peers, err)
+	}
+
+	root, err := os.ReadFile(*rootFile)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(root) {
+		return errors.New("missing or invalid root certificate")
+	}
+
+	r, err := rotator.New(*certFile, *keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate and key: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go r.Run(ctx, rotator.DefaultInterval)
+
+	handler := newProxy(u, allowed)
+	var metricsSrv *http.Server
+	if *metrics != "" {
+		m := autocert.NewServerMetrics(autocert.WithPeerAllowlist(metricsPeers...))
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(m)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		metricsSrv = &http.Server{Addr: *metrics, Handler: mux, ReadHeaderTimeout: 30 * time.Second}
+		handler = m.Middleware(handler)
+	}
+	if *logging {
+		logger := logrus.New()
+		logger.SetOutput(os.Stdout)
+		logger.SetFormatter(&logrus.JSONFormatter{})
+		handler = autocert.NewAccessLog(autocert.WithAccessLogger(logger)).Middleware(handler)
+	}
+
+	srv := &http.Server{
+		Addr:    *listen,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			ClientAuth:     tls.RequireAndVerifyClientCert,
+			ClientCAs:      roots,
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: r.GetCertificate,
+		},
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx) //nolint:errcheck // the server is exiting
+		if metricsSrv != nil {
+			metricsSrv.Shutdown(shutdownCtx) //nolint:errcheck // the server is exiting
+		}
+	}()
+	if metricsSrv != nil {
+		go func() {
+			if err := metricsSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("error serving metrics: %v", err)
+			}
+		}()
+	}
+
+	log.Printf("proxying %s to %s", *listen, u)
+	if err := srv.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
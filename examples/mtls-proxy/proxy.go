@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/x509"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	// identityHeader carries the common name of the client certificate.
+	identityHeader = "X-Client-Identity"
+	// namesHeader carries the comma-separated DNS and URI names of the
+	// client certificate.
+	namesHeader = "X-Client-Names"
+)
+
+// allowlist holds the patterns of the peers allowed through the proxy, like
+// *.payments.svc.cluster.local. An empty allowlist allows every client with a
+// certificate issued by the cluster CA.
+type allowlist []string
+
+// parseAllowlist parses a comma-separated list of patterns.
+func parseAllowlist(s string) (allowlist, error) {
+	var a allowlist
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+		a = append(a, pattern)
+	}
+	return a, nil
+}
+
+// allowed returns whether one of the given names matches the allowlist.
+func (a allowlist) allowed(names []string) bool {
+	if len(a) == 0 {
+		return true
+	}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, pattern := range a {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sans returns the DNS and URI names of a client certificate.
+func sans(crt *x509.Certificate) []string {
+	names := slices.Clone(crt.DNSNames)
+	for _, u := range crt.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// newProxy returns a handler forwarding the requests of allowed peers to
+// upstream, with the identity of the peer in the X-Client-Identity and
+// X-Client-Names headers. Identity headers sent by clients are always
+// dropped, so the upstream can trust them.
+func newProxy(upstream *url.URL, allow allowlist) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstream)
+			r.SetXForwarded()
+			r.Out.Header.Del(identityHeader)
+			r.Out.Header.Del(namesHeader)
+
+			crt := r.In.TLS.PeerCertificates[0]
+			r.Out.Header.Set(identityHeader, crt.Subject.CommonName)
+			if names := sans(crt); len(names) > 0 {
+				r.Out.Header.Set(namesHeader, strings.Join(names, ","))
+			}
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		crt := r.TLS.PeerCertificates[0]
+		if !allow.allowed(append(sans(crt), crt.Subject.CommonName)) {
+			log.Printf("denied %s %s from %q", r.Method, r.URL.Path, crt.Subject.CommonName)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
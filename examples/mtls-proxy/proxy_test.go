@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	a, err := parseAllowlist("*.payments.svc.cluster.local, spiffe://cluster.local/ns/ops/sa/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		names []string
+		want  bool
+	}{
+		{[]string{"api.payments.svc.cluster.local"}, true},
+		{[]string{"API.Payments.svc.cluster.local."}, true},
+		{[]string{"web.default.svc.cluster.local", "spiffe://cluster.local/ns/ops/sa/backup"}, true},
+		{[]string{"web.default.svc.cluster.local"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := a.allowed(tt.names); got != tt.want {
+			t.Errorf("allowed(%v) = %v, want %v", tt.names, got, tt.want)
+		}
+	}
+
+	if a, _ := parseAllowlist(""); !a.allowed([]string{"anything"}) {
+		t.Error("an empty allowlist should allow every client")
+	}
+	if _, err := parseAllowlist("[bad"); err == nil {
+		t.Error("parseAllowlist() with an invalid pattern should fail")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(identityHeader)+"|"+r.Header.Get(namesHeader)) //nolint:errcheck // test server
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	allow, _ := parseAllowlist("*.payments.svc")
+	proxy := newProxy(u, allow)
+
+	peer := func(cn string, dnsNames ...string) *tls.ConnectionState {
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{
+			Subject:  pkix.Name{CommonName: cn},
+			DNSNames: dnsNames,
+		}}}
+	}
+	tests := []struct {
+		name     string
+		tls      *tls.ConnectionState
+		wantCode int
+		wantBody string
+	}{
+		{"allowed", peer("api.payments.svc", "api.payments.svc", "api"), http.StatusOK, "api.payments.svc|api.payments.svc,api"},
+		{"allowed by SAN", peer("api", "api.payments.svc"), http.StatusOK, "api|api.payments.svc"},
+		{"forbidden", peer("web.default.svc"), http.StatusForbidden, ""},
+		{"no certificate", nil, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "https://proxy/", http.NoBody)
+			req.TLS = tt.tls
+			req.Header.Set(identityHeader, "spoofed")
+			req.Header.Set(namesHeader, "spoofed")
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusOK && rec.Body.String() != tt.wantBody {
+				t.Errorf("upstream got %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -10,6 +10,12 @@ fi
 
 STEPPATH=/home/step
 
+# The names of the CA and the configuration of the controller use the domain
+# of the cluster.
+CLUSTER_DOMAIN=${CLUSTER_DOMAIN:-cluster.local}
+CA_DNS=${CA_DNS:-ca.step.svc.$CLUSTER_DOMAIN,127.0.0.1}
+CA_URL=${CA_URL:-ca.step.svc.$CLUSTER_DOMAIN}
+
 CA_PASSWORD=$(head /dev/urandom | tr -dc A-Za-z0-9 | head -c 32 ; echo '')
 AUTOCERT_PASSWORD=$(head /dev/urandom | tr -dc A-Za-z0-9 | head -c 32 ; echo '')
 
@@ -76,6 +82,14 @@ if [ $? -ne 0 ]; then
     exit 1
 fi
 
+if [ "$NETWORK_POLICIES" = true ] ; then
+    echo -n "Checking for permission to create network policies in step namespace: "
+    kubectl auth can-i create networkpolicies.networking.k8s.io --namespace step
+    if [ $? -ne 0 ]; then
+        permission_error "create network policies"
+    fi
+fi
+
 # Setting this here on purpose, after the above section which explicitly checks
 # for and handles exit errors.
 set -e
@@ -116,7 +130,8 @@ kubectl -n step rollout status deployment/ca
 echo
 echo -e "\e[1mDeploying autocert...\e[0m"
 
-kubectl apply -f https://raw.githubusercontent.com/smallstep/autocert/master/install/02-autocert.yaml
+curl -sSfL https://raw.githubusercontent.com/smallstep/autocert/master/install/02-autocert.yaml | \
+  sed "s/cluster\.local/${CLUSTER_DOMAIN}/g" | kubectl apply -f -
 kubectl apply -f https://raw.githubusercontent.com/smallstep/autocert/master/install/03-rbac.yaml
 kubectl -n step rollout status deployment/autocert
 
@@ -150,6 +165,101 @@ webhooks:
         autocert.step.sm: enabled
 EOF
 
+# network_policies prints least-privilege NetworkPolicies for the CA and the
+# controller. The CA only accepts connections from the controller and from
+# namespaces with autocert enabled, where the renewers run. The controller only
+# connects to the CA, the API server and DNS, but accepts webhook connections
+# from anywhere, as neither the API server nor the bootstrappers can be
+# selected by labels.
+function network_policies {
+  local ca_port="${CA_ADDRESS##*:}"
+  local selector="kubernetes.io/service-name=kubernetes"
+  local api_port
+  local api_ips
+  api_port=$(kubectl get endpointslices -n default -l "$selector" \
+    -o jsonpath='{.items[0].ports[0].port}')
+  api_ips=$(kubectl get endpointslices -n default -l "$selector" \
+    -o jsonpath='{range .items[*].endpoints[*].addresses[*]}{@}{"\n"}{end}' | sort -u)
+  if [ -z "$api_port" ] || [ -z "$api_ips" ]; then
+    echo "Unable to find the API server endpoints" >&2
+    return 1
+  fi
+
+  local api_blocks=""
+  for ip in $api_ips; do
+    case "$ip" in
+      *:*) api_blocks="$api_blocks    - ipBlock: {cidr: $ip/128}"$'\n' ;;
+      *) api_blocks="$api_blocks    - ipBlock: {cidr: $ip/32}"$'\n' ;;
+    esac
+  done
+
+  cat <<EOF
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: ca
+  namespace: step
+  labels: {app: ca}
+spec:
+  podSelector:
+    matchLabels: {app: ca}
+  policyTypes: [Ingress, Egress]
+  ingress:
+  - from:
+    - podSelector:
+        matchLabels: {app: autocert}
+    - namespaceSelector:
+        matchLabels: {autocert.step.sm: enabled}
+    ports:
+    - {protocol: TCP, port: $ca_port}
+  egress:
+  - to:
+    - namespaceSelector: {}
+      podSelector:
+        matchLabels: {k8s-app: kube-dns}
+    ports:
+    - {protocol: UDP, port: 53}
+    - {protocol: TCP, port: 53}
+---
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: autocert
+  namespace: step
+  labels: {app: autocert}
+spec:
+  podSelector:
+    matchLabels: {app: autocert}
+  policyTypes: [Ingress, Egress]
+  ingress:
+  - ports:
+    - {protocol: TCP, port: 4443}
+  egress:
+  - to:
+    - podSelector:
+        matchLabels: {app: ca}
+    ports:
+    - {protocol: TCP, port: $ca_port}
+  - to:
+${api_blocks}    ports:
+    - {protocol: TCP, port: $api_port}
+  - to:
+    - namespaceSelector: {}
+      podSelector:
+        matchLabels: {k8s-app: kube-dns}
+    ports:
+    - {protocol: UDP, port: 53}
+    - {protocol: TCP, port: 53}
+EOF
+}
+
+if [ "$NETWORK_POLICIES" = true ] ; then
+  echo
+  echo -e "\e[1mCreating network policies...\e[0m"
+  POLICIES=$(network_policies)
+  echo "$POLICIES" | kubectl apply -f -
+fi
+
 FINGERPRINT=$(step certificate fingerprint $(step path)/certs/root_ca.crt)
 
 echo
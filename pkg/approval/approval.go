@@ -0,0 +1,174 @@
+// Package approval defines the extension point used by the autocert
+// controller to approve the issuance of high-value identities held by an
+// approval gate, so automated approvals, like a chat-ops bot or a change
+// management system, can be plugged in without forking the controller.
+//
+// Issuances held by a gate are CertificateSigningRequests pending approval.
+// Without an approver, they are approved by hand with
+// `kubectl certificate approve`. Approvers are registered by name from an init
+// function, like database/sql drivers, and referenced by the approver field of
+// a gate:
+//
+//	func init() {
+//		approval.Register("change-ticket", approval.Func(func(ctx context.Context, req approval.Request) (approval.Decision, error) {
+//			return tickets.Check(ctx, req.Namespace, req.CommonName)
+//		}))
+//	}
+//
+// Approvals can also be delegated to an HTTP service with Webhook.
+package approval
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Request describes an issuance pending approval.
+type Request struct {
+	// Name is the name of the CertificateSigningRequest.
+	Name string `json:"name"`
+	// Gate is the name of the approval gate holding the issuance.
+	Gate string `json:"gate"`
+	// Namespace is the namespace of the pod.
+	Namespace string `json:"namespace"`
+	// CommonName is the common name of the certificate.
+	CommonName string `json:"commonName"`
+	// SANs are the names included in the certificate.
+	SANs []string `json:"sans"`
+}
+
+// Status is the outcome of a review.
+type Status string
+
+// Review outcomes.
+const (
+	Pending  Status = "pending"
+	Approved Status = "approved"
+	Denied   Status = "denied"
+)
+
+// Decision is the result of a review. Reason is recorded in the
+// CertificateSigningRequest conditions and, for denials, returned to the pod.
+type Decision struct {
+	Status Status `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Approver reviews issuances pending approval. It is called every time the
+// pod checks on its issuance, so it must return Pending until a decision is
+// made, and should be fast.
+type Approver interface {
+	Review(ctx context.Context, req Request) (Decision, error)
+}
+
+// Func is an adapter to use ordinary functions as approvers.
+type Func func(ctx context.Context, req Request) (Decision, error)
+
+// Review calls f(ctx, req).
+func (f Func) Review(ctx context.Context, req Request) (Decision, error) {
+	return f(ctx, req)
+}
+
+var (
+	mu        sync.RWMutex
+	approvers = make(map[string]Approver)
+)
+
+// Register makes an approver available by the provided name. It panics if
+// Register is called twice with the same name or if a is nil.
+func Register(name string, a Approver) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if a == nil {
+		panic("approval: Register approver is nil")
+	}
+	if _, dup := approvers[name]; dup {
+		panic("approval: Register called twice for approver " + name)
+	}
+	approvers[name] = a
+}
+
+// Lookup returns the approver registered with the given name.
+func Lookup(name string) (Approver, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	a, ok := approvers[name]
+	if !ok {
+		return nil, fmt.Errorf("approver %q is not registered", name)
+	}
+	return a, nil
+}
+
+// Names returns the sorted names of the registered approvers.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(approvers))
+	for name := range approvers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// maxWebhookResponseSize limits the size of a webhook response.
+const maxWebhookResponseSize = 4096
+
+// Webhook is an approver delegating decisions to an HTTP service, like a
+// chat-ops bot asking for approval in a channel. Each review POSTs the
+// Request as JSON to URL, and the service responds with a Decision:
+//
+//	{"status": "approved", "reason": "approved by @jane in #payments-oncall"}
+//
+// The service must respond with a pending status until a decision is made.
+type Webhook struct {
+	URL string
+	// Client is the HTTP client used, defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Review implements Approver.
+func (w *Webhook) Review(ctx context.Context, req Request) (Decision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return Decision{}, fmt.Errorf("approval webhook: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return Decision{}, fmt.Errorf("approval webhook: %s", resp.Status)
+	}
+	var d Decision
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponseSize)).Decode(&d); err != nil {
+		return Decision{}, fmt.Errorf("approval webhook: invalid response: %w", err)
+	}
+	switch d.Status {
+	case Pending, Approved, Denied:
+		return d, nil
+	default:
+		return Decision{}, fmt.Errorf("approval webhook: invalid status %q", d.Status)
+	}
+}
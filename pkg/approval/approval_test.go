@@ -0,0 +1,76 @@
+package approval
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	Register("test-approve", Func(func(ctx context.Context, req Request) (Decision, error) {
+		return Decision{Status: Approved}, nil
+	}))
+
+	a, err := Lookup("test-approve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := a.Review(context.Background(), Request{}); err != nil || d.Status != Approved {
+		t.Errorf("Review() = %v, %v, want approved", d, err)
+	}
+	if _, err := Lookup("test-missing"); err == nil {
+		t.Error("Lookup() of an unregistered approver should fail")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Register() twice should panic")
+		}
+	}()
+	Register("test-approve", Func(func(ctx context.Context, req Request) (Decision, error) {
+		return Decision{}, nil
+	}))
+}
+
+func TestWebhook(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch req.CommonName {
+		case "api.payments.svc":
+			w.Write([]byte(`{"status":"approved","reason":"approved by jane"}`)) //nolint:errcheck // test server
+		case "web.payments.svc":
+			w.Write([]byte(`{"status":"pending"}`)) //nolint:errcheck // test server
+		case "bad.payments.svc":
+			w.Write([]byte(`{"status":"maybe"}`)) //nolint:errcheck // test server
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	w := &Webhook{URL: srv.URL}
+	tests := []struct {
+		commonName string
+		want       Decision
+		wantErr    bool
+	}{
+		{"api.payments.svc", Decision{Status: Approved, Reason: "approved by jane"}, false},
+		{"web.payments.svc", Decision{Status: Pending}, false},
+		{"bad.payments.svc", Decision{}, true},
+		{"down.payments.svc", Decision{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.commonName, func(t *testing.T) {
+			got, err := w.Review(context.Background(), Request{CommonName: tt.commonName})
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("Review() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
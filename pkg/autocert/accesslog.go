@@ -0,0 +1,106 @@
+package autocert
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessLog logs the requests of an HTTP server with the TLS metadata of
+// their connection, so "which client called with which certificate" doesn't
+// need a log line hand-rolled in every service:
+//
+//	accessLog := autocert.NewAccessLog()
+//	http.ListenAndServeTLS(":443", "", "", accessLog.Middleware(mux))
+//
+// Each request is logged once served, at the info level, with its method,
+// path, status code, response size and duration, and the fields of
+// TLSFields. Query strings are not logged, they may hold secrets.
+type AccessLog struct {
+	logger log.FieldLogger
+	tls    bool
+}
+
+// AccessLogOption configures an AccessLog.
+type AccessLogOption func(*AccessLog)
+
+// WithAccessLogger sets the logger of the requests, defaults to the standard
+// logrus logger.
+func WithAccessLogger(logger log.FieldLogger) AccessLogOption {
+	return func(a *AccessLog) {
+		a.logger = logger
+	}
+}
+
+// WithTLSFields sets whether the TLS metadata of the connections is logged,
+// defaults to true.
+func WithTLSFields(enabled bool) AccessLogOption {
+	return func(a *AccessLog) {
+		a.tls = enabled
+	}
+}
+
+// NewAccessLog returns the access log of a server.
+func NewAccessLog(opts ...AccessLogOption) *AccessLog {
+	a := &AccessLog{
+		logger: log.StandardLogger(),
+		tls:    true,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// TLSFields returns the TLS metadata of a connection as log fields: the
+// negotiated version and cipher suite, whether the session was resumed, and
+// the identity and serial number of the client certificate, if any. It
+// returns no fields for plain HTTP connections.
+func TLSFields(state *tls.ConnectionState) log.Fields {
+	if state == nil {
+		return log.Fields{}
+	}
+	fields := log.Fields{
+		"tlsVersion": tls.VersionName(state.Version),
+		"cipher":     tls.CipherSuiteName(state.CipherSuite),
+		"resumed":    state.DidResume,
+	}
+	if identity := PeerIdentity(state); identity != "" {
+		fields["peer"] = identity
+	}
+	// The serial is the one of the certificate presented, verified or not,
+	// to trace clients servers accept without verifying them.
+	if len(state.PeerCertificates) > 0 {
+		fields["serial"] = state.PeerCertificates[0].SerialNumber.String()
+	}
+	return fields
+}
+
+// Middleware returns an HTTP handler logging the requests served by next.
+func (a *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			code := rec.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+			fields := log.Fields{}
+			if a.tls {
+				fields = TLSFields(r.TLS)
+			}
+			fields["method"] = r.Method
+			fields["path"] = r.URL.Path
+			fields["proto"] = r.Proto
+			fields["remote"] = r.RemoteAddr
+			fields["status"] = code
+			fields["bytes"] = rec.bytes
+			fields["duration"] = time.Since(start).String()
+			a.logger.WithFields(fields).Info("Request served")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
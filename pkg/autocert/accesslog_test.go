@@ -0,0 +1,109 @@
+package autocert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestAccessLog_Middleware(t *testing.T) {
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.crt)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok")) //nolint:errcheck // test server
+	})
+	newServer := func(opts ...AccessLogOption) (*httptest.Server, *logtest.Hook) {
+		logger, hook := logtest.NewNullLogger()
+		srv := httptest.NewUnstartedServer(NewAccessLog(append([]AccessLogOption{WithAccessLogger(logger)}, opts...)...).Middleware(handler))
+		srv.TLS = &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, "payments.default.svc")},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    pool,
+		}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv, hook
+	}
+	clientCert := ca.issue(t, "web.default.svc")
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{clientCert},
+		MinVersion:   tls.VersionTLS13,
+	}}}
+	do := func(srv *httptest.Server, method, path string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	srv, hook := newServer()
+	do(srv, http.MethodGet, "/charge?token=s3cret")
+	do(srv, http.MethodDelete, "/charge")
+	entries := hook.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("logged %d entries, want 2", len(entries))
+	}
+	crt, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := log.Fields{
+		"method":     http.MethodGet,
+		"path":       "/charge",
+		"proto":      "HTTP/1.1",
+		"status":     http.StatusOK,
+		"bytes":      int64(2),
+		"tlsVersion": "TLS 1.3",
+		"resumed":    false,
+		"peer":       "web.default.svc",
+		"serial":     crt.SerialNumber.String(),
+	}
+	for k, v := range want {
+		if got := entries[0].Data[k]; got != v {
+			t.Errorf("%s = %v, want %v", k, got, v)
+		}
+	}
+	if cipher, _ := entries[0].Data["cipher"].(string); !strings.HasPrefix(cipher, "TLS_") {
+		t.Errorf("cipher = %q, want a TLS 1.3 suite", cipher)
+	}
+	if entries[0].Level != log.InfoLevel || entries[0].Data["remote"] == "" || entries[0].Data["duration"] == "" {
+		t.Errorf("entry = %+v", entries[0])
+	}
+	if got := entries[1].Data["status"]; got != http.StatusForbidden {
+		t.Errorf("status = %v, want 403", got)
+	}
+
+	srv, hook = newServer(WithTLSFields(false))
+	do(srv, http.MethodGet, "/")
+	if e := hook.LastEntry(); e == nil || e.Data["tlsVersion"] != nil || e.Data["peer"] != nil || e.Data["status"] != http.StatusOK {
+		t.Errorf("entry without TLS fields = %+v", e)
+	}
+}
+
+func TestTLSFields(t *testing.T) {
+	if got := TLSFields(nil); len(got) != 0 {
+		t.Errorf("TLSFields(nil) = %v, want none", got)
+	}
+	got := TLSFields(&tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, DidResume: true})
+	if got["tlsVersion"] != "TLS 1.2" || got["cipher"] != "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256" || got["resumed"] != true || got["peer"] != nil || got["serial"] != nil {
+		t.Errorf("TLSFields() = %v", got)
+	}
+}
@@ -0,0 +1,175 @@
+package autocert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// MaxBypass is the longest a bypass can be valid for, from the time the
+// bypass list is loaded.
+const MaxBypass = 90 * 24 * time.Hour
+
+// BypassedHandshakes counts the handshakes with the peers of the bypass list,
+// by peer and result: "bypassed", or "expired" when the bypass has expired
+// and the autocert root is required again. Register it to export it:
+//
+//	prometheus.MustRegister(autocert.BypassedHandshakes)
+var BypassedHandshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "autocert_client_bypassed_handshakes_total",
+	Help: "Number of TLS handshakes with peers in the bypass list, by peer and result.",
+}, []string{"peer", "result"})
+
+// Bypass lets a client talk to a legacy service, not on autocert yet, until
+// a deadline. The certificate of the peer may be issued by the system roots
+// instead of the autocert root, and its identity isn't asserted: only its
+// host name is verified, as with any HTTPS client.
+type Bypass struct {
+	// Peer is the host name of the legacy service, as in the URLs.
+	Peer string `json:"peer"`
+	// Until is when the bypass expires. It's required, so migrations don't
+	// leave bypasses behind.
+	Until time.Time `json:"until"`
+	// Reason is logged with the warnings, like a ticket tracking the
+	// migration.
+	Reason string `json:"reason,omitempty"`
+}
+
+// LoadBypassList reads a YAML or JSON list of bypasses, like a ConfigMap
+// mounted in the pod:
+//
+//   - peer: billing.legacy.example.com
+//     until: 2024-06-30T00:00:00Z
+//     reason: BILL-123 migrating billing to autocert
+func LoadBypassList(filename string) ([]Bypass, error) {
+	b, err := os.ReadFile(filename) //nolint:gosec // path comes from the application
+	if err != nil {
+		return nil, fmt.Errorf("read bypass list: %w", err)
+	}
+	var list []Bypass
+	if err := yaml.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("parse bypass list %s: %w", filename, err)
+	}
+	return list, nil
+}
+
+// WithBypass lets the client talk to the given legacy services until their
+// bypass expires. See Bypass.
+func WithBypass(list ...Bypass) Option {
+	return func(o *options) {
+		o.bypass = append(o.bypass, list...)
+	}
+}
+
+// validateBypass returns an error if a bypass is not time-boxed.
+func validateBypass(list []Bypass, now time.Time) error {
+	var errs []error
+	for _, b := range list {
+		switch {
+		case b.Peer == "":
+			errs = append(errs, errors.New("bypass without a peer"))
+		case b.Until.IsZero():
+			errs = append(errs, fmt.Errorf("bypass for %s has no expiry", b.Peer))
+		case b.Until.Sub(now) > MaxBypass:
+			errs = append(errs, fmt.Errorf("bypass for %s expires after %s, more than %s from now", b.Peer, b.Until.Format(time.RFC3339), MaxBypass))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// bypassVerifier asserts the identity of the peers, except for the peers of
+// the bypass list. crypto/tls verifies the chains with both the autocert and
+// the system roots, so the chains of the other peers must end at an autocert
+// root.
+type bypassVerifier struct {
+	roots    []*x509.Certificate
+	identity func(tls.ConnectionState) error
+	bypass   map[string]Bypass
+	now      func() time.Time
+}
+
+func newBypassVerifier(roots []*x509.Certificate, identity func(tls.ConnectionState) error, list []Bypass, now func() time.Time) *bypassVerifier {
+	v := &bypassVerifier{
+		roots:    roots,
+		identity: identity,
+		bypass:   make(map[string]Bypass, len(list)),
+		now:      now,
+	}
+	for _, b := range list {
+		v.bypass[normalizePeer(b.Peer)] = b
+	}
+	return v
+}
+
+func normalizePeer(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// VerifyConnection implements tls.Config.VerifyConnection.
+func (v *bypassVerifier) VerifyConnection(cs tls.ConnectionState) error {
+	peer := normalizePeer(cs.ServerName)
+	if b, ok := v.bypass[peer]; ok {
+		ctxLog := log.WithFields(log.Fields{
+			"peer":   peer,
+			"until":  b.Until.Format(time.RFC3339),
+			"reason": b.Reason,
+		})
+		if v.now().Before(b.Until) {
+			ctxLog.Warn("Bypassing autocert identity verification for legacy peer")
+			BypassedHandshakes.WithLabelValues(peer, "bypassed").Inc()
+			return nil
+		}
+		ctxLog.Warn("Bypass for legacy peer expired, verifying it with the autocert root")
+		BypassedHandshakes.WithLabelValues(peer, "expired").Inc()
+	}
+
+	if !v.autocertChain(cs.VerifiedChains) {
+		return errors.New("server certificate is not issued by the autocert root")
+	}
+	return v.identity(cs)
+}
+
+// autocertChain returns whether one of the chains ends at an autocert root.
+func (v *bypassVerifier) autocertChain(chains [][]*x509.Certificate) bool {
+	for _, chain := range chains {
+		if len(chain) == 0 {
+			continue
+		}
+		last := chain[len(chain)-1]
+		for _, root := range v.roots {
+			if last.Equal(root) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseRoots returns the certificates of a PEM bundle.
+func parseRoots(b []byte) ([]*x509.Certificate, error) {
+	var roots []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return roots, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, crt)
+	}
+}
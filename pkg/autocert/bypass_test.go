@@ -0,0 +1,139 @@
+package autocert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// legacyServer starts a server with a certificate for name from another CA,
+// not requiring client certificates.
+func legacyServer(t *testing.T, ca *testCA, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, name)}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// dial connects to srv with the given server name.
+func dial(config *tls.Config, srv *httptest.Server, serverName string) error {
+	config = config.Clone()
+	config.ServerName = serverName
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), config)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestNewTLSConfigBypass(t *testing.T) {
+	ca, legacyCA := newTestCA(t), newTestCA(t)
+	payments := ca.server(t, "payments.default.svc")
+	admin := ca.server(t, "admin.default.svc")
+	billing := legacyServer(t, legacyCA, "billing.legacy.example.com")
+	reports := legacyServer(t, legacyCA, "reports.legacy.example.com")
+
+	now := time.Now()
+	systemRoots := x509.NewCertPool()
+	systemRoots.AddCert(legacyCA.crt)
+	testRoots := func(o *options) {
+		o.systemRoots = systemRoots
+		o.now = func() time.Time { return now }
+	}
+	config, err := NewTLSConfig("payments.default.svc",
+		ca.writeFiles(t, ca.issue(t, "client.default.svc")),
+		WithBypass(Bypass{Peer: "Billing.Legacy.Example.com.", Until: now.Add(time.Hour), Reason: "BILL-123"}),
+		testRoots)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dial(config, payments, "payments.default.svc"); err != nil {
+		t.Errorf("dial() payments error = %v", err)
+	}
+	if err := dial(config, admin, "admin.default.svc"); err == nil {
+		t.Error("dial() admin should fail the identity assertion")
+	}
+	if err := dial(config, billing, "billing.legacy.example.com"); err != nil {
+		t.Errorf("dial() billing error = %v", err)
+	}
+	if got := counterValue(t, BypassedHandshakes.WithLabelValues("billing.legacy.example.com", "bypassed")); got != 1 {
+		t.Errorf("bypassed handshakes = %v, want 1", got)
+	}
+	// The host name is still verified.
+	if err := dial(config, billing, "other.legacy.example.com"); err == nil {
+		t.Error("dial() billing with another name should fail")
+	}
+	// Peers not in the list need the autocert root, even with a certificate
+	// from the system roots.
+	if err := dial(config, reports, "reports.legacy.example.com"); err == nil {
+		t.Error("dial() reports should fail")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err := dial(config, billing, "billing.legacy.example.com"); err == nil {
+		t.Error("dial() billing with an expired bypass should fail")
+	}
+	if got := counterValue(t, BypassedHandshakes.WithLabelValues("billing.legacy.example.com", "expired")); got != 1 {
+		t.Errorf("expired handshakes = %v, want 1", got)
+	}
+}
+
+func TestNewTLSConfigBypassErrors(t *testing.T) {
+	ca := newTestCA(t)
+	files := ca.writeFiles(t, ca.issue(t, "client.default.svc"))
+	tests := map[string]Bypass{
+		"no peer":   {Until: time.Now().Add(time.Hour)},
+		"no expiry": {Peer: "billing.legacy.example.com"},
+		"too long":  {Peer: "billing.legacy.example.com", Until: time.Now().Add(MaxBypass + time.Hour)},
+	}
+	for name, b := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewTLSConfig("payments.default.svc", files, WithBypass(b)); err == nil {
+				t.Error("NewTLSConfig() should fail")
+			}
+		})
+	}
+}
+
+func TestLoadBypassList(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bypass.yaml")
+	data := `- peer: billing.legacy.example.com
+  until: 2024-06-30T00:00:00Z
+  reason: BILL-123
+`
+	if err := os.WriteFile(filename, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := LoadBypassList(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Bypass{Peer: "billing.legacy.example.com", Until: time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC), Reason: "BILL-123"}
+	if len(list) != 1 || list[0].Peer != want.Peer || !list[0].Until.Equal(want.Until) || list[0].Reason != want.Reason {
+		t.Errorf("LoadBypassList() = %+v, want [%+v]", list, want)
+	}
+
+	if _, err := LoadBypassList(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadBypassList() with a missing file should fail")
+	}
+}
@@ -0,0 +1,203 @@
+// Package autocert builds mTLS clients from the certificate, key and root
+// written by autocert, asserting the identity of the services they talk to.
+//
+// A certificate issued by the CA only proves that the server is one of the
+// services of the cluster. Clients created with NewClient also require the
+// certificate of the server to be issued to the expected service, so a
+// request redirected or resolved to another service sharing the root fails:
+//
+//	client, err := autocert.NewClient("payments.default.svc.cluster.local")
+//	if err != nil {
+//		return err
+//	}
+//	resp, err := client.Get("https://payments.default.svc.cluster.local/charge")
+//
+// Servers can export their requests by client identity with ServerMetrics,
+// and log them with the TLS metadata of their connection with AccessLog.
+package autocert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smallstep/autocert/pkg/rotator"
+)
+
+// Default files written by autocert.
+const (
+	DefaultCertFile = "/var/run/autocert.step.sm/site.crt"
+	DefaultKeyFile  = "/var/run/autocert.step.sm/site.key"
+	DefaultRootFile = "/var/run/autocert.step.sm/root.crt"
+)
+
+// IdentityError is returned when the certificate of a server is not issued to
+// the expected identity.
+type IdentityError struct {
+	Expected string
+	// Names are the DNS names and URIs of the certificate.
+	Names []string
+}
+
+func (e *IdentityError) Error() string {
+	return fmt.Sprintf("server certificate is issued to %s, not to %s", strings.Join(e.Names, ", "), e.Expected)
+}
+
+// Option configures a client.
+type Option func(*options)
+
+type options struct {
+	certFile string
+	keyFile  string
+	rootFile string
+	bypass   []Bypass
+	// constrainedIssuer is the domain the intermediate of the server must be
+	// constrained to, if set.
+	constrainedIssuer string
+	// systemRoots replaces the system roots for the peers of the bypass
+	// list, in tests.
+	systemRoots *x509.CertPool
+	now         func() time.Time
+}
+
+// WithFiles sets the certificate, key and root files, for containers mounting
+// the certificates volume elsewhere.
+func WithFiles(certFile, keyFile, rootFile string) Option {
+	return func(o *options) {
+		o.certFile, o.keyFile, o.rootFile = certFile, keyFile, rootFile
+	}
+}
+
+// NewClient returns an HTTP client authenticating with the certificate of the
+// pod, and only accepting servers with a certificate issued by the root of
+// the pod to expectedIdentity: a DNS name, like hello.default.svc, or a URI,
+// like spiffe://cluster.local/ns/default/sa/hello. The host name of the URLs
+// is verified as usual.
+//
+// The certificate of the pod is reloaded when it's renewed. The root is read
+// once.
+func NewClient(expectedIdentity string, opts ...Option) (*http.Client, error) {
+	config, err := NewTLSConfig(expectedIdentity, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = config
+	return &http.Client{Transport: tr}, nil
+}
+
+// NewTLSConfig returns the TLS configuration of NewClient, for gRPC or other
+// protocols.
+func NewTLSConfig(expectedIdentity string, opts ...Option) (*tls.Config, error) {
+	if expectedIdentity == "" {
+		return nil, errors.New("expected identity is empty")
+	}
+	o := &options{certFile: DefaultCertFile, keyFile: DefaultKeyFile, rootFile: DefaultRootFile, now: time.Now}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := validateBypass(o.bypass, o.now()); err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(o.rootFile)
+	if err != nil {
+		return nil, fmt.Errorf("read root certificate: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s does not contain a PEM certificate", o.rootFile)
+	}
+	r, err := rotator.New(o.certFile, o.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	reload := &lazyReload{rotator: r, last: time.Now()}
+
+	verify := VerifyIdentity(expectedIdentity)
+	if o.constrainedIssuer != "" {
+		identity, issuer := verify, VerifyConstrainedIssuer(o.constrainedIssuer)
+		verify = func(cs tls.ConnectionState) error {
+			if err := identity(cs); err != nil {
+				return err
+			}
+			return issuer(cs)
+		}
+	}
+	config := &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		RootCAs:              roots,
+		GetClientCertificate: reload.GetClientCertificate,
+		VerifyConnection:     verify,
+	}
+	if len(o.bypass) > 0 {
+		autocertRoots, err := parseRoots(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse root certificate: %w", err)
+		}
+		pool := o.systemRoots
+		if pool == nil {
+			if pool, err = x509.SystemCertPool(); err != nil {
+				return nil, fmt.Errorf("load system roots for the bypass list: %w", err)
+			}
+		}
+		pool = pool.Clone()
+		pool.AppendCertsFromPEM(b)
+		config.RootCAs = pool
+		config.VerifyConnection = newBypassVerifier(autocertRoots, verify, o.bypass, o.now).VerifyConnection
+	}
+	return config, nil
+}
+
+// VerifyIdentity returns a function, for tls.Config.VerifyConnection,
+// returning an *IdentityError if the certificate of the peer is not issued to
+// the given DNS name or URI. It must be used along with the usual
+// verification of the certificate chain.
+func VerifyIdentity(expected string) func(tls.ConnectionState) error {
+	expected = strings.TrimSuffix(expected, ".")
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return &IdentityError{Expected: expected}
+		}
+		leaf := cs.PeerCertificates[0]
+		names := slices.Clone(leaf.DNSNames)
+		for _, u := range leaf.URIs {
+			names = append(names, u.String())
+		}
+		for _, name := range names {
+			if strings.EqualFold(strings.TrimSuffix(name, "."), expected) {
+				return nil
+			}
+		}
+		return &IdentityError{Expected: expected, Names: names}
+	}
+}
+
+// lazyReload reloads the certificate of the pod on handshakes, at most every
+// rotator.DefaultInterval, so clients don't need a goroutine to pick up
+// renewals.
+type lazyReload struct {
+	rotator *rotator.Rotator
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (l *lazyReload) GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	if time.Since(l.last) >= rotator.DefaultInterval {
+		l.last = time.Now()
+		// On errors, like a renewal being written, the current certificate
+		// is kept.
+		_, _ = l.rotator.Reload()
+	}
+	l.mu.Unlock()
+	return l.rotator.GetClientCertificate(info)
+}
@@ -0,0 +1,149 @@
+package autocert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	crt *x509.Certificate
+	key *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{crt: crt, key: key}
+}
+
+// issue returns a certificate for the given name, valid for 127.0.0.1.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.crt, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeFiles writes a certificate, its key and the root of the CA as autocert
+// does, and returns the options to use them.
+func (ca *testCA) writeFiles(t *testing.T, cert tls.Certificate) Option {
+	t.Helper()
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"site.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+		"site.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		"root.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.crt.Raw}),
+	}
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return WithFiles(filepath.Join(dir, "site.crt"), filepath.Join(dir, "site.key"), filepath.Join(dir, "root.crt"))
+}
+
+func (ca *testCA) server(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.crt)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name)) //nolint:errcheck // test server
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, name)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestNewClient(t *testing.T) {
+	ca := newTestCA(t)
+	payments := ca.server(t, "payments.default.svc")
+	admin := ca.server(t, "admin.default.svc")
+
+	client, err := NewClient("payments.default.svc.", ca.writeFiles(t, ca.issue(t, "client.default.svc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(payments.URL)
+	if err != nil {
+		t.Fatalf("Get() payments error = %v", err)
+	}
+	resp.Body.Close()
+
+	// Another service with a certificate from the same CA is refused.
+	_, err = client.Get(admin.URL)
+	var ierr *IdentityError
+	if !errors.As(err, &ierr) || ierr.Expected != "payments.default.svc" || len(ierr.Names) != 1 || ierr.Names[0] != "admin.default.svc" {
+		t.Errorf("Get() admin error = %v, want an IdentityError", err)
+	}
+}
+
+func TestNewClientErrors(t *testing.T) {
+	ca := newTestCA(t)
+	files := ca.writeFiles(t, ca.issue(t, "client.default.svc"))
+	if _, err := NewClient("", files); err == nil {
+		t.Error("NewClient() without identity should fail")
+	}
+	if _, err := NewClient("payments.default.svc", WithFiles("missing.crt", "missing.key", "missing-root.crt")); err == nil {
+		t.Error("NewClient() with missing files should fail")
+	}
+}
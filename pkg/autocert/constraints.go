@@ -0,0 +1,71 @@
+package autocert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// ConstraintError is returned when the certificate of a peer is not issued
+// under an intermediate constrained to the expected domain.
+type ConstraintError struct {
+	Domain string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("certificate is not issued by an intermediate constrained to %s", e.Domain)
+}
+
+// WithConstrainedIssuer also requires the certificate of the server to be
+// issued under an intermediate only permitted to sign DNS names in domain,
+// like the intermediate of a tenant, see VerifyConstrainedIssuer.
+func WithConstrainedIssuer(domain string) Option {
+	return func(o *options) {
+		o.constrainedIssuer = domain
+	}
+}
+
+// VerifyConstrainedIssuer returns a function, for tls.Config.VerifyConnection,
+// returning a *ConstraintError unless one of the verified chains of the peer
+// has an intermediate whose permitted DNS domains are all domain or its
+// subdomains. crypto/x509 already rejects names outside the constraints of a
+// chain; this asserts the chain is constrained at all, so certificates of
+// the tenant can't come from an unconstrained intermediate of the same root.
+//
+// It must be used along with the usual verification of the certificate
+// chain, which sets tls.ConnectionState.VerifiedChains. Servers can use it
+// to verify the certificates of their clients.
+func VerifyConstrainedIssuer(domain string) func(tls.ConnectionState) error {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	return func(cs tls.ConnectionState) error {
+		for _, chain := range cs.VerifiedChains {
+			// The leaf and the root are not intermediates.
+			if len(chain) < 3 {
+				continue
+			}
+			for _, crt := range chain[1 : len(chain)-1] {
+				if constrainedTo(crt, domain) {
+					return nil
+				}
+			}
+		}
+		return &ConstraintError{Domain: domain}
+	}
+}
+
+// constrainedTo returns whether a CA is only permitted to sign DNS names in
+// domain.
+func constrainedTo(crt *x509.Certificate, domain string) bool {
+	if !crt.IsCA || len(crt.PermittedDNSDomains) == 0 {
+		return false
+	}
+	for _, permitted := range crt.PermittedDNSDomains {
+		// A leading dot only permits subdomains, which are still in domain.
+		permitted = strings.ToLower(strings.TrimPrefix(permitted, "."))
+		if permitted != domain && !strings.HasSuffix(permitted, "."+domain) {
+			return false
+		}
+	}
+	return true
+}
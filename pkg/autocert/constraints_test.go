@@ -0,0 +1,117 @@
+package autocert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// intermediate returns a CA issued by ca, permitted to sign the given DNS
+// domains and 127.0.0.1.
+func (ca *testCA) intermediate(t *testing.T, domains ...string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "Test Intermediate CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		PermittedDNSDomains:   domains,
+	}
+	if len(domains) > 0 {
+		tmpl.PermittedIPRanges = []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.crt, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{crt: crt, key: key}
+}
+
+func TestVerifyConstrainedIssuer(t *testing.T) {
+	root := newTestCA(t)
+	leaf := &x509.Certificate{DNSNames: []string{"api.team-a.svc.cluster.local"}}
+	tests := []struct {
+		name    string
+		chain   []*x509.Certificate
+		domain  string
+		wantErr bool
+	}{
+		{"constrained", []*x509.Certificate{leaf, root.intermediate(t, "team-a.svc.cluster.local").crt, root.crt}, "team-a.svc.cluster.local", false},
+		{"subdomains", []*x509.Certificate{leaf, root.intermediate(t, ".team-a.svc.cluster.local").crt, root.crt}, "team-a.svc.cluster.local.", false},
+		{"narrower", []*x509.Certificate{leaf, root.intermediate(t, "api.team-a.svc.cluster.local").crt, root.crt}, "team-a.svc.cluster.local", false},
+		{"other tenant", []*x509.Certificate{leaf, root.intermediate(t, "team-b.svc.cluster.local").crt, root.crt}, "team-a.svc.cluster.local", true},
+		{"wider", []*x509.Certificate{leaf, root.intermediate(t, "team-a.svc.cluster.local", "example.com").crt, root.crt}, "team-a.svc.cluster.local", true},
+		{"unconstrained", []*x509.Certificate{leaf, root.intermediate(t).crt, root.crt}, "team-a.svc.cluster.local", true},
+		{"root", []*x509.Certificate{leaf, root.crt}, "team-a.svc.cluster.local", true},
+		{"not verified", nil, "team-a.svc.cluster.local", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := tls.ConnectionState{}
+			if tt.chain != nil {
+				cs.VerifiedChains = [][]*x509.Certificate{tt.chain}
+			}
+			err := VerifyConstrainedIssuer(tt.domain)(cs)
+			var cerr *ConstraintError
+			if tt.wantErr != errors.As(err, &cerr) {
+				t.Errorf("VerifyConstrainedIssuer() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewClientConstrainedIssuer(t *testing.T) {
+	root := newTestCA(t)
+	tenant := root.intermediate(t, "team-a.svc.cluster.local")
+	server := func(ca *testCA, name string, chain ...*x509.Certificate) *httptest.Server {
+		crt := ca.issue(t, name)
+		for _, c := range chain {
+			crt.Certificate = append(crt.Certificate, c.Raw)
+		}
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{crt}}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	constrained := server(tenant, "api.team-a.svc.cluster.local", tenant.crt)
+	unconstrained := server(root, "api.team-a.svc.cluster.local")
+
+	client, err := NewClient("api.team-a.svc.cluster.local",
+		root.writeFiles(t, root.issue(t, "client.team-a.svc.cluster.local")),
+		WithConstrainedIssuer("team-a.svc.cluster.local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(constrained.URL)
+	if err != nil {
+		t.Fatalf("request to a server of the tenant = %v", err)
+	}
+	resp.Body.Close()
+
+	var cerr *ConstraintError
+	if _, err := client.Get(unconstrained.URL); !errors.As(err, &cerr) {
+		t.Errorf("request to a server with an unconstrained certificate = %v, want a ConstraintError", err)
+	}
+}
@@ -0,0 +1,274 @@
+package autocert
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Peer labels of the requests not labeled with the identity of their client.
+const (
+	// PeerUnauthenticated labels the requests without a verified client
+	// certificate.
+	PeerUnauthenticated = "unauthenticated"
+	// PeerOther labels the requests of clients not in the allowlist, or
+	// seen once the limit of peers is reached.
+	PeerOther = "other"
+)
+
+// DefaultMaxPeers is the default number of client identities labeling the
+// metrics of a ServerMetrics.
+const DefaultMaxPeers = 100
+
+// ServerMetrics exports the requests of an HTTP or gRPC server by client
+// identity, as proven by its certificate, so every caller of a service gets
+// its traffic, errors and latency without instrumenting the callers. It's a
+// prometheus.Collector, register it to export it:
+//
+//	metrics := autocert.NewServerMetrics()
+//	prometheus.MustRegister(metrics)
+//	http.ListenAndServeTLS(":443", "", "", metrics.Middleware(mux))
+//
+// The number of identities is bounded, as each adds series: clients outside
+// the allowlist, and clients seen once the limit is reached, are labeled
+// "other".
+type ServerMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+
+	allowlist []string
+	maxPeers  int
+
+	mu       sync.Mutex
+	peers    map[string]bool
+	overflow bool
+}
+
+// MetricsOption configures a ServerMetrics.
+type MetricsOption func(*ServerMetrics)
+
+// WithPeerAllowlist only labels the metrics with the identities matching the
+// given patterns, DNS names or URIs like spiffe://cluster.local/ns/payments/sa/*.
+// In patterns, * matches any sequence of characters except /, and identities
+// are compared case-insensitively.
+func WithPeerAllowlist(identities ...string) MetricsOption {
+	return func(m *ServerMetrics) {
+		m.allowlist = append(m.allowlist, identities...)
+	}
+}
+
+// WithMaxPeers sets the number of identities labeling the metrics, defaults
+// to DefaultMaxPeers.
+func WithMaxPeers(n int) MetricsOption {
+	return func(m *ServerMetrics) {
+		m.maxPeers = n
+	}
+}
+
+// NewServerMetrics returns the request metrics of a server.
+func NewServerMetrics(opts ...MetricsOption) *ServerMetrics {
+	m := &ServerMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "autocert_server_requests_total",
+			Help: "Number of requests served, by protocol, client identity, method and code.",
+		}, []string{"protocol", "peer", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "autocert_server_request_duration_seconds",
+			Help:    "Time spent serving requests, by protocol, client identity and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"protocol", "peer", "method"}),
+		maxPeers: DefaultMaxPeers,
+		peers:    map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.maxPeers <= 0 {
+		m.maxPeers = DefaultMaxPeers
+	}
+	return m
+}
+
+// Describe implements prometheus.Collector.
+func (m *ServerMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *ServerMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.duration.Collect(ch)
+}
+
+// PeerIdentity returns the identity of the verified certificate of the peer
+// of a connection: its first URI, like a SPIFFE ID, its first DNS name, or
+// its common name. It returns "" if the peer has no verified certificate.
+func PeerIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := state.VerifiedChains[0][0]
+	switch {
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String()
+	case len(leaf.DNSNames) > 0:
+		return strings.TrimSuffix(leaf.DNSNames[0], ".")
+	default:
+		return leaf.Subject.CommonName
+	}
+}
+
+// peerLabel returns the label of the client with the given identity.
+func (m *ServerMetrics) peerLabel(identity string) string {
+	if identity == "" {
+		return PeerUnauthenticated
+	}
+	if len(m.allowlist) > 0 && !allowedPeer(m.allowlist, identity) {
+		return PeerOther
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.peers[identity] {
+		return identity
+	}
+	if len(m.peers) >= m.maxPeers {
+		if !m.overflow {
+			m.overflow = true
+			log.WithField("maxPeers", m.maxPeers).Warn("Too many client identities, the next ones are labeled other")
+		}
+		return PeerOther
+	}
+	m.peers[identity] = true
+	return identity
+}
+
+func allowedPeer(allowlist []string, identity string) bool {
+	identity = strings.ToLower(identity)
+	for _, pattern := range allowlist {
+		if ok, _ := path.Match(strings.ToLower(strings.TrimSuffix(pattern, ".")), identity); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// observe records a request.
+func (m *ServerMetrics) observe(protocol, identity, method, code string, elapsed time.Duration) {
+	label := m.peerLabel(identity)
+	m.requests.WithLabelValues(protocol, label, method, code).Inc()
+	m.duration.WithLabelValues(protocol, label, method).Observe(elapsed.Seconds())
+}
+
+// Middleware returns an HTTP handler recording the requests served by next.
+// Requests are labeled with their method, not their path, whose values are
+// unbounded.
+func (m *ServerMetrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			code := rec.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+			m.observe("http", PeerIdentity(r.TLS), httpMethod(r.Method), strconv.Itoa(code), time.Since(start))
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// httpMethod returns the label of a request method, other for the unknown
+// ones.
+func httpMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// statusRecorder records the status code and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	// Informational responses are followed by the final one.
+	if r.status == 0 && code >= http.StatusOK {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (r *statusRecorder) Flush() {
+	_ = http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the original writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor recording the unary
+// calls, by full method name and status code.
+func (m *ServerMetrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.observe("grpc", grpcPeerIdentity(ctx), info.FullMethod, status.Code(err).String(), time.Since(start))
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns a gRPC interceptor recording the streams,
+// by full method name and status code, once they end.
+func (m *ServerMetrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		m.observe("grpc", grpcPeerIdentity(ss.Context()), info.FullMethod, status.Code(err).String(), time.Since(start))
+		return err
+	}
+}
+
+// grpcPeerIdentity returns the identity of the client of a call, "" if it
+// has no verified certificate.
+func grpcPeerIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+	return PeerIdentity(&info.State)
+}
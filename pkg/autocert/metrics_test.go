@@ -0,0 +1,155 @@
+package autocert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestPeerIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/default/sa/web")
+	chain := func(crt *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{crt}}}
+	}
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		want  string
+	}{
+		{"no tls", nil, ""},
+		{"not verified", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{DNSNames: []string{"web.default.svc"}}}}, ""},
+		{"uri", chain(&x509.Certificate{URIs: []*url.URL{spiffe}, DNSNames: []string{"web.default.svc"}}), "spiffe://cluster.local/ns/default/sa/web"},
+		{"dns", chain(&x509.Certificate{DNSNames: []string{"web.default.svc.", "web"}}), "web.default.svc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PeerIdentity(tt.state); got != tt.want {
+				t.Errorf("PeerIdentity() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerMetrics_peerLabel(t *testing.T) {
+	m := NewServerMetrics(WithPeerAllowlist("spiffe://cluster.local/ns/payments/sa/*", "Web.default.svc."), WithMaxPeers(2))
+	tests := []struct {
+		identity, want string
+	}{
+		{"", PeerUnauthenticated},
+		{"web.default.svc", "web.default.svc"},
+		{"batch.default.svc", PeerOther},
+		{"spiffe://cluster.local/ns/payments/sa/api", "spiffe://cluster.local/ns/payments/sa/api"},
+		// Over the limit of peers.
+		{"spiffe://cluster.local/ns/payments/sa/worker", PeerOther},
+		{"web.default.svc", "web.default.svc"},
+	}
+	for _, tt := range tests {
+		if got := m.peerLabel(tt.identity); got != tt.want {
+			t.Errorf("peerLabel(%q) = %q, want %q", tt.identity, got, tt.want)
+		}
+	}
+}
+
+func TestServerMetrics_Middleware(t *testing.T) {
+	ca := newTestCA(t)
+	m := NewServerMetrics()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.crt)
+	srv := httptest.NewUnstartedServer(m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok")) //nolint:errcheck // test server
+	})))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "payments.default.svc")},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	client := func(cert ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: cert,
+			MinVersion:   tls.VersionTLS12,
+		}}}
+	}
+	do := func(c *http.Client, method string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	web := client(ca.issue(t, "web.default.svc"))
+	do(web, http.MethodGet)
+	do(web, http.MethodGet)
+	do(web, http.MethodDelete)
+	do(client(), http.MethodPost)
+
+	for _, tt := range []struct {
+		labels []string
+		want   float64
+	}{
+		{[]string{"http", "web.default.svc", "GET", "200"}, 2},
+		{[]string{"http", "web.default.svc", "DELETE", "403"}, 1},
+		{[]string{"http", PeerUnauthenticated, "POST", "200"}, 1},
+	} {
+		if got := counterValue(t, m.requests.WithLabelValues(tt.labels...)); got != tt.want {
+			t.Errorf("autocert_server_requests_total%v = %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestServerMetrics_UnaryServerInterceptor(t *testing.T) {
+	m := NewServerMetrics()
+	crt := &x509.Certificate{DNSNames: []string{"web.default.svc"}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{crt}}},
+	}})
+	info := &grpc.UnaryServerInfo{FullMethod: "/hello.v1.GreeterService/SayHello"}
+	interceptor := m.UnaryServerInterceptor()
+
+	ok := func(context.Context, any) (any, error) { return "hello", nil }
+	denied := func(context.Context, any) (any, error) { return nil, status.Error(codes.PermissionDenied, "no") }
+	if _, err := interceptor(ctx, nil, info, ok); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := interceptor(ctx, nil, info, denied); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("interceptor() error = %v, want the error of the handler", err)
+	}
+	if _, err := interceptor(context.Background(), nil, info, ok); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		labels []string
+		want   float64
+	}{
+		{[]string{"grpc", "web.default.svc", info.FullMethod, "OK"}, 1},
+		{[]string{"grpc", "web.default.svc", info.FullMethod, "PermissionDenied"}, 1},
+		{[]string{"grpc", PeerUnauthenticated, info.FullMethod, "OK"}, 1},
+	} {
+		if got := counterValue(t, m.requests.WithLabelValues(tt.labels...)); got != tt.want {
+			t.Errorf("autocert_server_requests_total%v = %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+}
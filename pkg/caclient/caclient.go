@@ -0,0 +1,147 @@
+// Package caclient selects the CA to talk to among several URLs, for CAs
+// deployed active/passive, for instance across availability zones. The first
+// URL is the active CA, used whenever it's healthy, and the following ones
+// are used in order while it's not.
+package caclient
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/ca"
+)
+
+// DefaultInterval is how often Run health-checks the CAs.
+const DefaultInterval = 30 * time.Second
+
+// checkTimeout bounds each health check.
+const checkTimeout = 5 * time.Second
+
+// Pool holds a client for each URL of the CA, in order of preference, and
+// tracks which ones are healthy.
+type Pool struct {
+	mu      sync.Mutex
+	urls    []string
+	clients []*ca.Client
+	healthy []bool
+	// check returns an error if the CA of the client is not healthy.
+	check func(ctx context.Context, client *ca.Client) error
+}
+
+// New returns a pool with a client for each URL, created with the given
+// options. All the CAs are considered healthy until checked.
+func New(urls []string, opts ...ca.ClientOption) (*Pool, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no CA URL")
+	}
+	p := &Pool{
+		urls: urls,
+		check: func(ctx context.Context, client *ca.Client) error {
+			_, err := client.HealthWithContext(ctx)
+			return err
+		},
+	}
+	for _, u := range urls {
+		client, err := ca.NewClient(u, opts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create CA client for %s", u)
+		}
+		p.clients = append(p.clients, client)
+		p.healthy = append(p.healthy, true)
+	}
+	return p, nil
+}
+
+// Reload replaces the clients of the pool with clients created with the
+// given options, like a root file with new roots, keeping the health of the
+// CAs. The clients returned before keep working with the previous options.
+func (p *Pool) Reload(opts ...ca.ClientOption) error {
+	clients := make([]*ca.Client, 0, len(p.urls))
+	for _, u := range p.urls {
+		client, err := ca.NewClient(u, opts...)
+		if err != nil {
+			return errors.Wrapf(err, "create CA client for %s", u)
+		}
+		clients = append(clients, client)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients = clients
+	return nil
+}
+
+// Client returns the client of the first healthy CA, or of the first CA if
+// none is healthy.
+func (p *Pool) Client() *ca.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, ok := range p.healthy {
+		if ok {
+			return p.clients[i]
+		}
+	}
+	return p.clients[0]
+}
+
+// Failed records the error of a request made with one of the clients of the
+// pool. If the CA couldn't be reached, it's considered unhealthy until the
+// next successful health check, so the next request goes to another CA.
+// Errors returned by the CA itself, like an expired certificate, don't
+// change its health.
+func (p *Pool) Failed(client *ca.Client, err error) {
+	var nerr net.Error
+	if !errors.As(err, &nerr) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.clients {
+		if c == client {
+			p.healthy[i] = false
+		}
+	}
+}
+
+// Check health-checks every CA, and returns the number of healthy ones.
+func (p *Pool) Check(ctx context.Context) int {
+	p.mu.Lock()
+	clients := p.clients
+	p.mu.Unlock()
+
+	healthy := make([]bool, len(clients))
+	n := 0
+	for i, client := range clients {
+		cctx, cancel := context.WithTimeout(ctx, checkTimeout)
+		healthy[i] = p.check(cctx, client) == nil
+		cancel()
+		if healthy[i] {
+			n++
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.healthy = healthy
+	return n
+}
+
+// Run health-checks every CA at the given interval until the context is
+// canceled. Pools with a single CA are not checked.
+func (p *Pool) Run(ctx context.Context, interval time.Duration) {
+	if len(p.clients) < 2 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package caclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/smallstep/certificates/ca"
+)
+
+func TestPool(t *testing.T) {
+	p, err := New([]string{"https://ca-a.example.com", "https://ca-b.example.com", "https://ca-c.example.com"}, ca.WithTransport(http.DefaultTransport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthy := map[string]bool{}
+	p.check = func(_ context.Context, client *ca.Client) error {
+		if !healthy[client.GetCaURL()] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	current := func() string {
+		return p.Client().GetCaURL()
+	}
+
+	if got := current(); got != "https://ca-a.example.com" {
+		t.Errorf("Client() before checking = %s, want the active CA", got)
+	}
+
+	// Errors returned by the CA don't fail over.
+	p.Failed(p.Client(), errors.New("certificate expired"))
+	if got := current(); got != "https://ca-a.example.com" {
+		t.Errorf("Client() after a CA error = %s, want the active CA", got)
+	}
+
+	// Connection errors fail over to the next CA until the next check.
+	p.Failed(p.Client(), &net.OpError{Op: "dial", Err: errors.New("connection refused")})
+	if got := current(); got != "https://ca-b.example.com" {
+		t.Errorf("Client() after a connection error = %s, want the next CA", got)
+	}
+
+	healthy["https://ca-c.example.com"] = true
+	if n := p.Check(context.Background()); n != 1 {
+		t.Errorf("Check() = %d, want 1", n)
+	}
+	if got := current(); got != "https://ca-c.example.com" {
+		t.Errorf("Client() = %s, want the healthy CA", got)
+	}
+
+	healthy["https://ca-a.example.com"] = true
+	p.Check(context.Background())
+	if got := current(); got != "https://ca-a.example.com" {
+		t.Errorf("Client() after the active CA recovered = %s, want it", got)
+	}
+
+	// The active CA is used when none is healthy.
+	clear(healthy)
+	if n := p.Check(context.Background()); n != 0 {
+		t.Errorf("Check() = %d, want 0", n)
+	}
+	if got := current(); got != "https://ca-a.example.com" {
+		t.Errorf("Client() with no healthy CA = %s, want the active CA", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(nil); err == nil {
+		t.Error("New() without URLs succeeded")
+	}
+}
+
+func TestPool_Reload(t *testing.T) {
+	p, err := New([]string{"https://ca-a.example.com", "https://ca-b.example.com"}, ca.WithTransport(http.DefaultTransport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Failed(p.Client(), &net.OpError{Op: "dial", Err: errors.New("connection refused")})
+	before := p.Client()
+	if err := p.Reload(ca.WithTransport(http.DefaultTransport)); err != nil {
+		t.Fatal(err)
+	}
+	after := p.Client()
+	if after == before || after.GetCaURL() != "https://ca-b.example.com" {
+		t.Errorf("Client() after Reload() = %s, want a new client of the healthy CA", after.GetCaURL())
+	}
+	if err := p.Reload(ca.WithRootFile("missing.crt")); err == nil {
+		t.Error("Reload() with a missing root succeeded")
+	}
+	if p.Client() != after {
+		t.Error("Reload() replaced the clients on error")
+	}
+}
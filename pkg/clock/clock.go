@@ -0,0 +1,40 @@
+// Package clock abstracts the passing of time, so schedulers like the
+// renewer can be tested deterministically with a fake clock from the
+// clocktest package instead of sleeping.
+package clock
+
+import "time"
+
+// Clock tells the time and creates timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a timer firing after d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single-use timer, like time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, it returns false if the timer
+	// already fired or was stopped.
+	Stop() bool
+}
+
+// Real is the clock of the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+
+func (t realTimer) Stop() bool { return t.t.Stop() }
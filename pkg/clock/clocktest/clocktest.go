@@ -0,0 +1,115 @@
+// Package clocktest provides a fake clock for tests.
+package clocktest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/smallstep/autocert/pkg/clock"
+)
+
+// Fake is a clock that only moves when Advance is called.
+type Fake struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*timer
+}
+
+var _ clock.Clock = (*Fake)(nil)
+
+// NewFake returns a fake clock set at now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the time of the fake clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTimer creates a timer firing when the clock is advanced by d. Timers
+// with a non-positive duration fire immediately.
+func (f *Fake) NewTimer(d time.Duration) clock.Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &timer{
+		fake: f,
+		at:   f.now.Add(d),
+		c:    make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.c <- f.now
+		return t
+	}
+	f.timers = append(f.timers, t)
+	f.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers due by then.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.at.After(f.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- f.now
+	}
+	f.timers = pending
+}
+
+// AdvanceTo moves the clock forward to t, if it's in the future.
+func (f *Fake) AdvanceTo(t time.Time) {
+	if d := t.Sub(f.Now()); d > 0 {
+		f.Advance(d)
+	}
+}
+
+// BlockUntil blocks until n timers are waiting to fire. It's used to wait
+// for the code under test to reach a wait before advancing the clock.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
+
+// Pending returns the number of timers waiting to fire.
+func (f *Fake) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+type timer struct {
+	fake *Fake
+	at   time.Time
+	c    chan time.Time
+}
+
+func (t *timer) C() <-chan time.Time { return t.c }
+
+func (t *timer) Stop() bool {
+	f := t.fake
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, other := range f.timers {
+		if other == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
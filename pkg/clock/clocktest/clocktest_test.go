@@ -0,0 +1,48 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	f := NewFake(start)
+
+	fired := make(chan time.Time)
+	go func() {
+		timer := f.NewTimer(time.Minute)
+		fired <- <-timer.C()
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(30 * time.Second)
+	select {
+	case <-fired:
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	f.Advance(30 * time.Second)
+	if got := <-fired; !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("timer fired at %v, want %v", got, start.Add(time.Minute))
+	}
+	if f.Pending() != 0 {
+		t.Errorf("Pending() = %d, want 0", f.Pending())
+	}
+
+	stopped := f.NewTimer(time.Hour)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("Stop() should return true only the first time")
+	}
+	f.AdvanceTo(start.Add(2 * time.Hour))
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+
+	if immediate := f.NewTimer(-time.Second); len(immediate.C()) != 1 {
+		t.Error("timer with a negative duration should fire immediately")
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/smallstep/autocert/pkg/clock
+
+go 1.25.0
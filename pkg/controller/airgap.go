@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.step.sm/crypto/pemutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// airGappedEnvVar tells the bootstrapper to only use the roots injected by
+// the controller, and never download them from the CA.
+const airGappedEnvVar = "AUTOCERT_AIR_GAPPED"
+
+// digestPattern matches images pinned by digest.
+var digestPattern = regexp.MustCompile(`@sha256:[0-9a-f]{64}$`)
+
+// AirGapped configures the controller for environments without access to
+// external networks. The roots are read from the rootCAPath ConfigMap and
+// injected in the bootstrappers, which never download them from the CA, the
+// images are pinned by digest, and the connections of the controller to
+// unexpected hosts are aborted.
+type AirGapped struct {
+	Enabled bool `yaml:"enabled"`
+	// AllowedHosts are the hosts the controller may connect to besides the
+	// CA and the API server, like the webhooks of approval gates.
+	AllowedHosts []string `yaml:"allowedHosts"`
+}
+
+// validateAirGapped returns an error if the configuration requires network
+// access not allowed in air-gapped mode.
+func validateAirGapped(c *Config) error {
+	if !c.AirGapped.Enabled {
+		return nil
+	}
+	if v := envProtocolVersions[airGappedEnvVar]; c.GetProtocolVersion() < v {
+		return fmt.Errorf("airGapped requires protocolVersion %d or later", v)
+	}
+	for name, image := range map[string]string{
+		"bootstrapper": c.Bootstrapper.Image,
+		"renewer":      c.Renewer.Image,
+	} {
+		if !digestPattern.MatchString(image) {
+			return fmt.Errorf("airGapped requires the %s image to be pinned by digest, like image@sha256:<digest>, got %q", name, image)
+		}
+	}
+	allowed := c.AirGapped.hosts(c)
+	for _, g := range c.ApprovalGates {
+		if g.Webhook == "" {
+			continue
+		}
+		if u, err := url.Parse(g.Webhook); err == nil && !hostAllowed(allowed, u.Hostname()) {
+			return fmt.Errorf("airGapped does not allow the webhook of approval gate %q, add %q to airGapped.allowedHosts", g.Name, u.Hostname())
+		}
+	}
+	return nil
+}
+
+// hosts returns the hosts the controller may connect to: the CA, the API
+// server and the allowed hosts.
+func (a AirGapped) hosts(c *Config) []string {
+	hosts := slices.Clone(a.AllowedHosts)
+	for _, caURL := range append([]string{c.CaURL}, c.CAService.FallbackURLs...) {
+		if u, err := url.Parse(caURL); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	if c.CAService.Name != "" {
+		hosts = append(hosts, c.CAService.host(c.GetClusterDomain()))
+	}
+	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// hostAllowed returns whether host is one of the allowed hosts.
+func hostAllowed(allowed []string, host string) bool {
+	return slices.ContainsFunc(allowed, func(h string) bool {
+		return strings.EqualFold(strings.TrimSuffix(h, "."), strings.TrimSuffix(host, "."))
+	})
+}
+
+// egressGuard is an http.RoundTripper aborting the requests to hosts not
+// allowed in air-gapped mode.
+type egressGuard struct {
+	next    http.RoundTripper
+	allowed []string
+}
+
+func (g *egressGuard) RoundTrip(r *http.Request) (*http.Response, error) {
+	if host := r.URL.Hostname(); !hostAllowed(g.allowed, host) {
+		log.WithFields(log.Fields{
+			"audit": true,
+			"host":  host,
+		}).Error("Air-gapped mode: blocked unexpected connection")
+		return nil, errors.Errorf("air-gapped mode: unexpected connection to %s blocked, add it to airGapped.allowedHosts if it's expected", net.JoinHostPort(host, r.URL.Port()))
+	}
+	return g.next.RoundTrip(r)
+}
+
+// guardEgress makes the default HTTP client, used by approval webhooks and
+// SAN resolvers, abort the requests to hosts not allowed in air-gapped mode.
+// The Kubernetes and CA clients have their own transports.
+func guardEgress(config *Config) {
+	if !config.AirGapped.Enabled {
+		return
+	}
+	http.DefaultTransport = &egressGuard{
+		next:    http.DefaultTransport,
+		allowed: config.AirGapped.hosts(config),
+	}
+}
+
+// airGappedEnv returns the environment variables configuring a bootstrapper
+// in air-gapped mode: every root in the rootCAPath ConfigMap, so roots being
+// rotated are trusted as well, and the flag forbidding downloads.
+func airGappedEnv(config *Config) ([]corev1.EnvVar, error) {
+	roots, err := pemutil.ReadCertificateBundle(config.GetRootCAPath())
+	if err != nil {
+		return nil, errors.Wrap(err, "air-gapped roots")
+	}
+	var bundle []byte
+	for _, crt := range roots {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})...)
+	}
+	return []corev1.EnvVar{
+		{
+			Name:  "STEP_ROOT_PEM",
+			Value: string(bundle),
+		},
+		{
+			Name:  airGappedEnvVar,
+			Value: "true",
+		},
+	}, nil
+}
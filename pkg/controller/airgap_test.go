@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidateAirGapped(t *testing.T) {
+	const digest = "@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	pinned := func(c Config) Config {
+		c.AirGapped.Enabled = true
+		c.CaURL = "https://ca.step.svc"
+		c.Bootstrapper = corev1.Container{Image: "registry.local/autocert-bootstrapper" + digest}
+		c.Renewer = corev1.Container{Image: "registry.local/autocert-renewer" + digest}
+		return c
+	}
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"disabled", Config{Bootstrapper: corev1.Container{Image: "smallstep/autocert-bootstrapper:latest"}}, false},
+		{"pinned", pinned(Config{}), false},
+		{"old protocol", pinned(Config{ProtocolVersion: 7}), true},
+		{"bootstrapper tag", func() Config {
+			c := pinned(Config{})
+			c.Bootstrapper.Image = "registry.local/autocert-bootstrapper:0.19.0"
+			return c
+		}(), true},
+		{"renewer short digest", func() Config {
+			c := pinned(Config{})
+			c.Renewer.Image = "registry.local/autocert-renewer@sha256:0123"
+			return c
+		}(), true},
+		{"webhook not allowed", pinned(Config{ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}, Webhook: "https://approvals.example.com/autocert"}}}), true},
+		{"webhook allowed", pinned(Config{
+			ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}, Webhook: "https://approvals.example.com/autocert"}},
+			AirGapped:     AirGapped{AllowedHosts: []string{"approvals.example.com"}},
+		}), false},
+		{"webhook on ca host", pinned(Config{ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}, Webhook: "https://ca.step.svc:8443/approve"}}}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateAirGapped(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateAirGapped() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEgressGuard(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	allowed := &http.Client{Transport: &egressGuard{next: http.DefaultTransport, allowed: []string{"127.0.0.1"}}}
+	resp, err := allowed.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("allowed host: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("allowed host: status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	blocked := &http.Client{Transport: &egressGuard{next: http.DefaultTransport, allowed: []string{"ca.step.svc"}}}
+	if _, err := blocked.Get(srv.URL); err == nil || !strings.Contains(err.Error(), "airGapped.allowedHosts") {
+		t.Errorf("blocked host: error = %v, want an air-gapped error", err)
+	}
+}
+
+func TestAirGappedEnv(t *testing.T) {
+	var bundle []byte
+	for _, name := range []string{"Root A", "Root B"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	path := filepath.Join(t.TempDir(), "root_ca.crt")
+	if err := os.WriteFile(path, bundle, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := airGappedEnv(&Config{RootCAPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []corev1.EnvVar{
+		{Name: "STEP_ROOT_PEM", Value: string(bundle)},
+		{Name: airGappedEnvVar, Value: "true"},
+	}
+	if len(env) != len(want) || env[0] != want[0] || env[1] != want[1] {
+		t.Errorf("airGappedEnv() = %v, want %v", env, want)
+	}
+
+	if _, err := airGappedEnv(&Config{RootCAPath: filepath.Join(t.TempDir(), "missing.crt")}); err == nil {
+		t.Error("airGappedEnv() with a missing root file: expected an error")
+	}
+}
@@ -0,0 +1,289 @@
+package controller
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annotationError is an invalid annotation of a pod.
+type annotationError struct {
+	Key    string
+	Value  string
+	Reason string
+	// Format describes the expected value.
+	Format string
+}
+
+func (e *annotationError) Error() string {
+	msg := fmt.Sprintf("annotation %s=%q: %s", e.Key, e.Value, e.Reason)
+	if e.Format != "" {
+		msg += ", use " + e.Format
+	}
+	return msg
+}
+
+// annotationErrors are the invalid annotations of a pod.
+type annotationErrors []*annotationError
+
+func (e annotationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// status returns the status of the admission response denying the pod, with
+// the path of each invalid annotation, like the API server validation errors.
+func (e annotationErrors) status() *metav1.Status {
+	causes := make([]metav1.StatusCause, len(e))
+	for i, err := range e {
+		causes[i] = metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: err.Error(),
+			Field:   "metadata.annotations[" + err.Key + "]",
+		}
+	}
+	return &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: e.Error(),
+		Reason:  metav1.StatusReasonInvalid,
+		Code:    http.StatusUnprocessableEntity,
+		Details: &metav1.StatusDetails{Causes: causes},
+	}
+}
+
+// podAnnotations are the autocert annotations of a pod.
+type podAnnotations struct {
+	CommonName       string
+	SANs             string
+	Duration         string
+	Owner            string
+	Mode             string
+	Umask            string
+	First            bool
+	BootstrapperOnly bool
+	ReadOnly         bool
+	ExternalSecret   string
+	Secret           string
+	WaitForDrain     bool
+	SDS              bool
+	Intermediate     string
+	CA               string
+	KeyType          string
+	KeySize          string
+	Format           string
+	RenewalSignal    string
+	RenewalProcess   string
+	RenewalExec      string
+	RenewalContainer string
+	IdentityEnv      bool
+	RolloutIdentity  string
+}
+
+// annotationRule validates the value of an annotation.
+type annotationRule struct {
+	// check returns why the value is not valid, or "" if it is.
+	check  func(v string) string
+	format string
+}
+
+const boolFormat = `"true" or "false"`
+
+var (
+	octalRegexp = regexp.MustCompile(`^0?[0-7]{3}$`)
+	ownerRegexp = regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`)
+	labelRegexp = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?$`)
+)
+
+// annotationRules are the rules of the annotations with a value to validate.
+var annotationRules = map[string]annotationRule{
+	admissionWebhookAnnotationKey:     {checkName, "a DNS name, like hello.default.svc.$(CLUSTER_DOMAIN)"},
+	sansAnnotationKey:                 {checkSANList, "a comma-separated list of DNS names, IP addresses, email addresses or URIs"},
+	durationWebhookStatusKey:          {checkDuration, `a positive duration with a unit, like "1h" or "2h45m"`},
+	ownerAnnotationKey:                {checkOwner, `numeric user and group IDs, like "999:999"`},
+	modeAnnotationKey:                 {checkOctal, `octal permissions, like "0600"`},
+	umaskAnnotationKey:                {checkOctal, `an octal umask, like "027"`},
+	firstAnnotationKey:                {checkBool, boolFormat},
+	bootstrapperOnlyAnnotationKey:     {checkBool, boolFormat},
+	readOnlyAnnotationKey:             {checkBool, boolFormat},
+	startupProbeAnnotationKey:         {checkBool, boolFormat},
+	dualStackAnnotationKey:            {checkBool, boolFormat},
+	externalSecretAnnotationKey:       {checkSecretName, "the name of a Secret in the namespace of the pod"},
+	secretAnnotationKey:               {checkSecretName, "the name of a Secret in the namespace of the pod"},
+	drainAnnotationKey:                {checkBool, boolFormat},
+	sdsAnnotationKey:                  {checkBool, boolFormat},
+	intermediateAnnotationKey:         {checkIntermediateName, "the name of a constrained intermediate in the configuration"},
+	certificateAuthorityAnnotationKey: {checkCertificateAuthorityName, "the name of a certificate authority in the configuration"},
+	spiffeIDAnnotationKey:             {checkSPIFFEID, "a SPIFFE ID, like spiffe://example.com/ns/default/sa/hello"},
+	keyTypeAnnotationKey:              {checkKeyType, `"EC", "RSA" or "Ed25519"`},
+	keySizeAnnotationKey:              {checkKeySize, `a size in bits, 256, 384 or 521 for EC keys, 2048, 3072 or 4096 for RSA keys`},
+	formatAnnotationKey:               {checkFormat, `"pkcs12", "jks" or "pem"`},
+	renewalSignalAnnotationKey:        {checkSignal, "SIGHUP, SIGINT, SIGQUIT, SIGTERM, SIGUSR1, SIGUSR2 or SIGWINCH"},
+	renewalProcessAnnotationKey:       {checkProcessName, `the name of a process, like "nginx"`},
+	renewalExecAnnotationKey:          {checkCommand, `a command and its arguments, like "nginx -s reload"`},
+	renewalContainerAnnotationKey:     {checkContainerName, "the name of a container of the pod"},
+	identityEnvAnnotationKey:          {checkBool, boolFormat},
+	rolloutIdentityAnnotationKey:      {checkRolloutIdentity, `"shared" or "isolated"`},
+}
+
+// parseAnnotations returns the autocert annotations of a pod, or the
+// annotationErrors of the invalid ones. Placeholders in the names must be
+// expanded first.
+func parseAnnotations(annotations map[string]string) (podAnnotations, error) {
+	var errs annotationErrors
+	for _, key := range slices.Sorted(maps.Keys(annotationRules)) {
+		v, ok := annotations[key]
+		if !ok {
+			continue
+		}
+		rule := annotationRules[key]
+		if reason := rule.check(v); reason != "" {
+			errs = append(errs, &annotationError{Key: key, Value: v, Reason: reason, Format: rule.format})
+		}
+	}
+	if len(errs) > 0 {
+		return podAnnotations{}, errs
+	}
+	return podAnnotations{
+		CommonName:       annotations[admissionWebhookAnnotationKey],
+		SANs:             annotations[sansAnnotationKey],
+		Duration:         annotations[durationWebhookStatusKey],
+		Owner:            annotations[ownerAnnotationKey],
+		Mode:             annotations[modeAnnotationKey],
+		Umask:            annotations[umaskAnnotationKey],
+		First:            strings.EqualFold(annotations[firstAnnotationKey], "true"),
+		BootstrapperOnly: strings.EqualFold(annotations[bootstrapperOnlyAnnotationKey], "true"),
+		ReadOnly:         strings.EqualFold(annotations[readOnlyAnnotationKey], "true"),
+		ExternalSecret:   annotations[externalSecretAnnotationKey],
+		Secret:           annotations[secretAnnotationKey],
+		WaitForDrain:     strings.EqualFold(annotations[drainAnnotationKey], "true"),
+		SDS:              strings.EqualFold(annotations[sdsAnnotationKey], "true"),
+		Intermediate:     annotations[intermediateAnnotationKey],
+		CA:               annotations[certificateAuthorityAnnotationKey],
+		KeyType:          annotations[keyTypeAnnotationKey],
+		KeySize:          annotations[keySizeAnnotationKey],
+		Format:           annotations[formatAnnotationKey],
+		RenewalSignal:    normalizeSignal(annotations[renewalSignalAnnotationKey]),
+		RenewalProcess:   annotations[renewalProcessAnnotationKey],
+		RenewalExec:      annotations[renewalExecAnnotationKey],
+		RenewalContainer: annotations[renewalContainerAnnotationKey],
+		IdentityEnv:      strings.EqualFold(annotations[identityEnvAnnotationKey], "true"),
+		RolloutIdentity:  annotations[rolloutIdentityAnnotationKey],
+	}, nil
+}
+
+func checkName(v string) string {
+	if v == "" {
+		return "is empty"
+	}
+	return checkSAN(v)
+}
+
+func checkSANList(v string) string {
+	for _, san := range strings.Split(v, ",") {
+		if reason := checkSAN(san); reason != "" {
+			if san == "" {
+				return "has an empty name"
+			}
+			return fmt.Sprintf("%q %s", san, reason)
+		}
+	}
+	return ""
+}
+
+// checkSAN returns why a name is not a valid DNS name, IP address, email
+// address or URI. Wildcards are checked by the SAN policy, with a more
+// specific message.
+func checkSAN(v string) string {
+	switch {
+	case v == "":
+		return "is empty"
+	case strings.ContainsAny(v, " \t\r\n"):
+		return "contains whitespace"
+	case strings.Contains(v, "$("):
+		return fmt.Sprintf("contains an unknown placeholder, the placeholders are %s and %s", clusterDomainPlaceholder, namespacePlaceholder)
+	case strings.Contains(v, "*"):
+		return ""
+	case net.ParseIP(v) != nil:
+		return ""
+	case strings.Contains(v, "://"):
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "") {
+			return "is not a valid URI"
+		}
+		return ""
+	case strings.Contains(v, "@"):
+		local, domain, _ := strings.Cut(v, "@")
+		if local == "" || !isDNSName(domain) {
+			return "is not a valid email address"
+		}
+		return ""
+	case !isDNSName(v):
+		return "is not a valid DNS name"
+	default:
+		return ""
+	}
+}
+
+// isDNSName returns whether v is a DNS name, without a trailing dot.
+func isDNSName(v string) bool {
+	if v == "" || len(v) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(v, ".") {
+		if !labelRegexp.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkSecretName(v string) string {
+	if !isDNSName(v) || strings.ToLower(v) != v || strings.Contains(v, "_") {
+		return "is not a valid Secret name"
+	}
+	return ""
+}
+
+func checkDuration(v string) string {
+	d, err := time.ParseDuration(v)
+	switch {
+	case err != nil:
+		return "is not a duration"
+	case d <= 0:
+		return "is not positive"
+	default:
+		return ""
+	}
+}
+
+func checkOwner(v string) string {
+	if !ownerRegexp.MatchString(v) {
+		return "is not a user ID and a group ID"
+	}
+	return ""
+}
+
+func checkOctal(v string) string {
+	if !octalRegexp.MatchString(v) {
+		return "is not an octal value"
+	}
+	return ""
+}
+
+func checkBool(v string) string {
+	if !strings.EqualFold(v, "true") && !strings.EqualFold(v, "false") {
+		return "is not a boolean"
+	}
+	return ""
+}
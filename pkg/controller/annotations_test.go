@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantKeys    []string
+	}{
+		{"valid", map[string]string{
+			admissionWebhookAnnotationKey: "api.default.svc.cluster.local",
+			sansAnnotationKey:             "api,10.0.0.1,::1,api@example.com,spiffe://cluster.local/ns/default/sa/api,*.api.example.com",
+			durationWebhookStatusKey:      "2h45m",
+			ownerAnnotationKey:            "999:999",
+			modeAnnotationKey:             "0600",
+			umaskAnnotationKey:            "027",
+			firstAnnotationKey:            "True",
+			readOnlyAnnotationKey:         "false",
+		}, nil},
+		{"owner user only", map[string]string{ownerAnnotationKey: "999"}, nil},
+		{"unknown annotations", map[string]string{"example.com/duration": "forever"}, nil},
+		{"bad duration", map[string]string{durationWebhookStatusKey: "1d"}, []string{durationWebhookStatusKey}},
+		{"negative duration", map[string]string{durationWebhookStatusKey: "-1h"}, []string{durationWebhookStatusKey}},
+		{"bad sans", map[string]string{sansAnnotationKey: "api, api.default.svc"}, []string{sansAnnotationKey}},
+		{"empty san", map[string]string{sansAnnotationKey: "api,,web"}, []string{sansAnnotationKey}},
+		{"placeholder", map[string]string{admissionWebhookAnnotationKey: "api.$(DOMAIN)"}, []string{admissionWebhookAnnotationKey}},
+		{"bad name", map[string]string{admissionWebhookAnnotationKey: "api_.-default"}, []string{admissionWebhookAnnotationKey}},
+		{"bad email", map[string]string{sansAnnotationKey: "@example.com"}, []string{sansAnnotationKey}},
+		{"owner names", map[string]string{ownerAnnotationKey: "step:step"}, []string{ownerAnnotationKey}},
+		{"bad mode", map[string]string{modeAnnotationKey: "0800"}, []string{modeAnnotationKey}},
+		{"bad bool", map[string]string{bootstrapperOnlyAnnotationKey: "yes"}, []string{bootstrapperOnlyAnnotationKey}},
+		{"renewal hook", map[string]string{renewalSignalAnnotationKey: "usr1", renewalProcessAnnotationKey: "envoy", renewalContainerAnnotationKey: "proxy"}, nil},
+		{"bad signal", map[string]string{renewalSignalAnnotationKey: "SIGKILL"}, []string{renewalSignalAnnotationKey}},
+		{"bad process", map[string]string{renewalProcessAnnotationKey: "/usr/sbin/nginx"}, []string{renewalProcessAnnotationKey}},
+		{"empty exec", map[string]string{renewalExecAnnotationKey: " "}, []string{renewalExecAnnotationKey}},
+		{"several", map[string]string{umaskAnnotationKey: "rwx", durationWebhookStatusKey: "1 hour"}, []string{durationWebhookStatusKey, umaskAnnotationKey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseAnnotations(tt.annotations)
+			if tt.wantKeys == nil {
+				if err != nil {
+					t.Errorf("parseAnnotations() error = %v", err)
+				}
+				return
+			}
+			var errs annotationErrors
+			if !errors.As(err, &errs) || len(errs) != len(tt.wantKeys) {
+				t.Fatalf("parseAnnotations() error = %v, want errors for %v", err, tt.wantKeys)
+			}
+			for i, key := range tt.wantKeys {
+				if errs[i].Key != key || !strings.Contains(errs[i].Error(), ", use ") {
+					t.Errorf("parseAnnotations() error[%d] = %v, want an error for %s with the format", i, errs[i], key)
+				}
+			}
+		})
+	}
+
+	got, err := parseAnnotations(tests[0].annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CommonName != "api.default.svc.cluster.local" || got.Duration != "2h45m" || !got.First || got.ReadOnly || got.BootstrapperOnly {
+		t.Errorf("parseAnnotations() = %+v", got)
+	}
+}
+
+func TestAnnotationErrorsStatus(t *testing.T) {
+	_, err := parseAnnotations(map[string]string{durationWebhookStatusKey: "1d", modeAnnotationKey: "rw"})
+	status := err.(annotationErrors).status()
+	if status.Code != http.StatusUnprocessableEntity || status.Reason != "Invalid" || len(status.Details.Causes) != 2 {
+		t.Fatalf("status() = %+v", status)
+	}
+	if f := status.Details.Causes[1].Field; f != "metadata.annotations[autocert.step.sm/mode]" {
+		t.Errorf("status() cause field = %s", f)
+	}
+	if want := `annotation autocert.step.sm/duration="1d": is not a duration, use a positive duration with a unit, like "1h" or "2h45m"; annotation autocert.step.sm/mode="rw"`; !strings.HasPrefix(status.Message, want) {
+		t.Errorf("status() message = %s, want prefix %s", status.Message, want)
+	}
+}
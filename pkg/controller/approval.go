@@ -0,0 +1,196 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/approval"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// approvalGateAnnotationKey records on a CertificateSigningRequest the
+	// approval gate holding it.
+	approvalGateAnnotationKey = "autocert.step.sm/approval-gate"
+	// approvalReviewTimeout bounds the time spent in an approver.
+	approvalReviewTimeout = 5 * time.Second
+)
+
+// ApprovalGate holds the issuance of high-value identities pending approval.
+// Pods requesting a matching name get their certificate through a
+// CertificateSigningRequest, approved by hand, by a registered approver or by
+// a webhook.
+type ApprovalGate struct {
+	// Name identifies the gate in logs and approval requests.
+	Name string `yaml:"name"`
+	// Names are the patterns of the names held by the gate, like
+	// *.payments.svc.
+	Names []string `yaml:"names"`
+	// Namespaces restricts the gate to the given namespaces, all of them if
+	// empty.
+	Namespaces []string `yaml:"namespaces"`
+	// Approver is the name of a registered approver. Without an approver or
+	// a webhook, requests are approved by hand.
+	Approver string `yaml:"approver"`
+	// Webhook is the URL of a service making the approval decisions.
+	Webhook string `yaml:"webhook"`
+}
+
+// matches returns whether the gate holds a certificate with the given names
+// requested in the given namespace.
+func (g *ApprovalGate) matches(names []string, namespace string) bool {
+	if len(g.Namespaces) > 0 && !namespaceAllowed(g.Namespaces, namespace) {
+		return false
+	}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, pattern := range g.Names {
+			if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// approver returns the approver of the gate, or nil if requests are approved
+// by hand.
+func (g *ApprovalGate) approver() (approval.Approver, error) {
+	switch {
+	case g.Webhook != "":
+		return &approval.Webhook{URL: g.Webhook}, nil
+	case g.Approver != "":
+		return approval.Lookup(g.Approver)
+	default:
+		return nil, nil
+	}
+}
+
+// validateApprovalGates returns an error if an approval gate is invalid.
+func validateApprovalGates(c *Config) error {
+	if len(c.ApprovalGates) > 0 && c.GetProtocolVersion() < csrProtocolVersion {
+		return fmt.Errorf("approvalGates requires protocolVersion %d or later", csrProtocolVersion)
+	}
+
+	var seen []string
+	for _, g := range c.ApprovalGates {
+		if g.Name == "" {
+			return errors.New("invalid approvalGates: every gate must have a name")
+		}
+		if slices.Contains(seen, g.Name) {
+			return fmt.Errorf("invalid approvalGates: duplicate gate %q", g.Name)
+		}
+		seen = append(seen, g.Name)
+
+		if len(g.Names) == 0 {
+			return fmt.Errorf("invalid approvalGates: gate %q has no names", g.Name)
+		}
+		for _, pattern := range g.Names {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid approvalGates: gate %q has an invalid pattern %q", g.Name, pattern)
+			}
+		}
+		if g.Approver != "" && g.Webhook != "" {
+			return fmt.Errorf("invalid approvalGates: gate %q can't have both an approver and a webhook", g.Name)
+		}
+		if g.Approver != "" {
+			if _, err := approval.Lookup(g.Approver); err != nil {
+				return errors.Wrapf(err, "invalid approvalGates, registered approvers are %v", approval.Names())
+			}
+		}
+		if g.Webhook != "" {
+			if u, err := url.Parse(g.Webhook); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+				return fmt.Errorf("invalid approvalGates: gate %q has an invalid webhook %q", g.Name, g.Webhook)
+			}
+		}
+	}
+	return nil
+}
+
+// approvalGate returns the first approval gate holding a certificate with the
+// given names requested in the given namespace, or nil.
+func approvalGate(config *Config, names []string, namespace string) *ApprovalGate {
+	for i := range config.ApprovalGates {
+		if config.ApprovalGates[i].matches(names, namespace) {
+			return &config.ApprovalGates[i]
+		}
+	}
+	return nil
+}
+
+// reviewCSR asks the approver of the gate holding a pending
+// CertificateSigningRequest for a decision, and records it in the request
+// conditions. It returns whether the request was approved, or an error if it
+// was denied. Errors from the approver are logged and leave the request
+// pending.
+func reviewCSR(ctx context.Context, config *Config, obj *certificatesv1.CertificateSigningRequest) (bool, error) {
+	name := obj.Annotations[approvalGateAnnotationKey]
+	i := slices.IndexFunc(config.ApprovalGates, func(g ApprovalGate) bool { return g.Name == name })
+	if name == "" || i < 0 {
+		return false, nil
+	}
+	gate := &config.ApprovalGates[i]
+
+	ctxLog := log.WithFields(log.Fields{
+		"name": obj.Name,
+		"gate": gate.Name,
+	})
+
+	a, err := gate.approver()
+	if err != nil || a == nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, approvalReviewTimeout)
+	defer cancel()
+	d, err := a.Review(ctx, approval.Request{
+		Name:       obj.Name,
+		Gate:       gate.Name,
+		Namespace:  obj.Annotations[csrNamespaceAnnotationKey],
+		CommonName: obj.Annotations[admissionWebhookAnnotationKey],
+		SANs:       strings.Split(obj.Annotations[sansAnnotationKey], ","),
+	})
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error reviewing certificate signing request")
+		return false, nil
+	}
+
+	condition := certificatesv1.CertificateSigningRequestCondition{
+		Status:             corev1.ConditionTrue,
+		Message:            d.Reason,
+		LastUpdateTime:     metav1.Now(),
+		LastTransitionTime: metav1.Now(),
+	}
+	switch d.Status {
+	case approval.Approved:
+		condition.Type = certificatesv1.CertificateApproved
+		condition.Reason = "AutocertApprovalGate"
+	case approval.Denied:
+		condition.Type = certificatesv1.CertificateDenied
+		condition.Reason = "AutocertApprovalGate"
+	default:
+		return false, nil
+	}
+
+	obj.Status.Conditions = append(obj.Status.Conditions, condition)
+	if err := updateCSR(obj, "approval"); err != nil {
+		ctxLog.WithField("error", err).Error("Error recording certificate signing request decision")
+		return false, nil
+	}
+	ctxLog.WithFields(log.Fields{
+		"audit":    true,
+		"decision": d.Status,
+		"reason":   d.Reason,
+	}).Info("Reviewed certificate signing request")
+
+	return csrStatus(obj)
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/smallstep/autocert/pkg/approval"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUsesCSR(t *testing.T) {
+	config := &Config{
+		CSRNamespaces: []string{"legacy"},
+		ApprovalGates: []ApprovalGate{
+			{Name: "payments", Names: []string{"*.payments.svc", "*.payments.svc.cluster.local"}},
+			{Name: "admin", Names: []string{"admin"}, Namespaces: []string{"ops"}},
+		},
+	}
+	tests := []struct {
+		name      string
+		names     []string
+		namespace string
+		wantCSR   bool
+		wantGate  string
+	}{
+		{"token", []string{"api.default.svc"}, "default", false, ""},
+		{"csr namespace", []string{"api.legacy.svc"}, "legacy", true, ""},
+		{"gate", []string{"api", "api.payments.svc"}, "payments", true, "payments"},
+		{"gate any namespace", []string{"API.payments.svc.cluster.local."}, "default", true, "payments"},
+		{"gate namespace", []string{"admin"}, "ops", true, "admin"},
+		{"other gate namespace", []string{"admin"}, "default", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csr, gate := usesCSR(config, tt.names, tt.namespace)
+			if csr != tt.wantCSR || gate != tt.wantGate {
+				t.Errorf("usesCSR() = %v, %q, want %v, %q", csr, gate, tt.wantCSR, tt.wantGate)
+			}
+		})
+	}
+}
+
+func TestValidateApprovalGates(t *testing.T) {
+	approval.Register("test-controller", approval.Func(func(context.Context, approval.Request) (approval.Decision, error) {
+		return approval.Decision{Status: approval.Pending}, nil
+	}))
+
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"none", Config{}, false},
+		{"manual", Config{ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"*.payments.svc"}}}}, false},
+		{"approver", Config{ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}, Approver: "test-controller"}}}, false},
+		{"webhook", Config{ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}, Webhook: "https://approvals.example.com/autocert"}}}, false},
+		{"old protocol", Config{ProtocolVersion: 24, ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}}}}, true},
+		{"no name", Config{ApprovalGates: []ApprovalGate{{Names: []string{"a"}}}}, true},
+		{"duplicate", Config{ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}}, {Name: "a", Names: []string{"b"}}}}, true},
+		{"no names", Config{ApprovalGates: []ApprovalGate{{Name: "a"}}}, true},
+		{"bad pattern", Config{ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"[a"}}}}, true},
+		{"unknown approver", Config{ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}, Approver: "test-missing"}}}, true},
+		{"both", Config{ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}, Approver: "test-controller", Webhook: "https://example.com"}}}, true},
+		{"bad webhook", Config{ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}, Webhook: "approvals.example.com"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateApprovalGates(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateApprovalGates() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReviewCSRManual(t *testing.T) {
+	config := &Config{ApprovalGates: []ApprovalGate{{Name: "payments", Names: []string{"*.payments.svc"}}}}
+	for _, gate := range []string{"", "payments", "removed"} {
+		obj := &certificatesv1.CertificateSigningRequest{ObjectMeta: metav1.ObjectMeta{
+			Name:        "autocert-abcde",
+			Annotations: map[string]string{approvalGateAnnotationKey: gate},
+		}}
+		// Without an approver the request stays pending until approved by
+		// hand.
+		if approved, err := reviewCSR(context.Background(), config, obj); approved || err != nil {
+			t.Errorf("reviewCSR() with gate %q = %v, %v, want pending", gate, approved, err)
+		}
+	}
+}
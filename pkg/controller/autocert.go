@@ -0,0 +1,1521 @@
+package controller
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/resolver"
+	"github.com/smallstep/certificates/pki"
+	"github.com/smallstep/cli-utils/errs"
+	"go.step.sm/crypto/pemutil"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	runtimeScheme = runtime.NewScheme()
+	codecs        = serializer.NewCodecFactory(runtimeScheme)
+	deserializer  = codecs.UniversalDeserializer()
+)
+
+const (
+	admissionWebhookAnnotationKey = "autocert.step.sm/name"
+	admissionWebhookStatusKey     = "autocert.step.sm/status"
+	durationWebhookStatusKey      = "autocert.step.sm/duration"
+	firstAnnotationKey            = "autocert.step.sm/init-first"
+	bootstrapperOnlyAnnotationKey = "autocert.step.sm/bootstrapper-only"
+	sansAnnotationKey             = "autocert.step.sm/sans"
+	ownerAnnotationKey            = "autocert.step.sm/owner"
+	modeAnnotationKey             = "autocert.step.sm/mode"
+	umaskAnnotationKey            = "autocert.step.sm/umask"
+	readOnlyAnnotationKey         = "autocert.step.sm/read-only"
+	volumeMountPath               = "/var/run/autocert.step.sm"
+	tokenSecretKey                = "token"
+	//nolint:gosec // not a secret
+	tokenSecretLabel = "autocert.step.sm/token"
+	tokenLifetime    = 5 * time.Minute
+	// sanResolverTimeout bounds the time spent in custom SAN resolvers.
+	sanResolverTimeout = 5 * time.Second
+)
+
+// Config options for the autocert admission controller.
+type Config struct {
+	Address                         string                    `yaml:"address"`
+	Service                         string                    `yaml:"service"`
+	LogFormat                       string                    `yaml:"logFormat"`
+	CaURL                           string                    `yaml:"caUrl"`
+	CAService                       CAService                 `yaml:"caService"`
+	CAFailoverURLs                  []string                  `yaml:"caFailoverURLs"`
+	CertLifetime                    string                    `yaml:"certLifetime"`
+	Bootstrapper                    corev1.Container          `yaml:"bootstrapper"`
+	Renewer                         corev1.Container          `yaml:"renewer"`
+	CertsVolume                     corev1.Volume             `yaml:"certsVolume"`
+	RestrictCertificatesToNamespace bool                      `yaml:"restrictCertificatesToNamespace"`
+	ClusterDomain                   string                    `yaml:"clusterDomain"`
+	RootCAPath                      string                    `yaml:"rootCAPath"`
+	ProvisionerPasswordPath         string                    `yaml:"provisionerPasswordPath"`
+	HostNetworkNamespaces           []string                  `yaml:"hostNetworkNamespaces"`
+	HostPIDNamespaces               []string                  `yaml:"hostPIDNamespaces"`
+	ClusterName                     string                    `yaml:"clusterName"`
+	TrustDomain                     string                    `yaml:"trustDomain"`
+	ProvisionerName                 string                    `yaml:"provisionerName"`
+	TokenSecretPrefix               string                    `yaml:"tokenSecretPrefix"`
+	RolloutIdentity                 string                    `yaml:"rolloutIdentity"`
+	AdmissionBudget                 string                    `yaml:"admissionBudget"`
+	ProtocolVersion                 int                       `yaml:"protocolVersion"`
+	ShadowMode                      bool                      `yaml:"shadowMode"`
+	SANCheck                        string                    `yaml:"sanCheck"`
+	SANCheckExcludedDomains         []string                  `yaml:"sanCheckExcludedDomains"`
+	SANResolvers                    []string                  `yaml:"sanResolvers"`
+	SANPolicy                       SANPolicy                 `yaml:"sanPolicy"`
+	NamespaceSANPolicies            map[string]SANPolicy      `yaml:"namespaceSANPolicies"`
+	SANPolicies                     map[string]SANPolicy      `yaml:"sanPolicies"`
+	RequireEnrollment               bool                      `yaml:"requireEnrollment"`
+	CSRNamespaces                   []string                  `yaml:"csrNamespaces"`
+	CSRSignerName                   string                    `yaml:"csrSignerName"`
+	ApprovalGates                   []ApprovalGate            `yaml:"approvalGates"`
+	ExpiringSoon                    string                    `yaml:"expiringSoon"`
+	PodExpiryMetrics                string                    `yaml:"podExpiryMetrics"`
+	RenewerResources                RenewerResources          `yaml:"renewerResources"`
+	NonRootContainers               bool                      `yaml:"nonRootContainers"`
+	NonRootUser                     int64                     `yaml:"nonRootUser"`
+	OpenShift                       bool                      `yaml:"openShift"`
+	PodLabels                       map[string]string         `yaml:"podLabels"`
+	PodAnnotations                  map[string]string         `yaml:"podAnnotations"`
+	SecretLabels                    map[string]string         `yaml:"secretLabels"`
+	SecretAnnotations               map[string]string         `yaml:"secretAnnotations"`
+	EndpointAuth                    EndpointAuth              `yaml:"endpointAuth"`
+	AirGapped                       AirGapped                 `yaml:"airGapped"`
+	BuildVerification               BuildVerification         `yaml:"buildVerification"`
+	TokenBinding                    bool                      `yaml:"tokenBinding"`
+	TokenRemint                     TokenRemint               `yaml:"tokenRemint"`
+	PersistentQueue                 PersistentQueue           `yaml:"persistentQueue"`
+	IssuanceLog                     IssuanceLog               `yaml:"issuanceLog"`
+	LeakGuard                       LeakGuard                 `yaml:"leakGuard"`
+	LoadShedding                    LoadShedding              `yaml:"loadShedding"`
+	MinimizePatches                 bool                      `yaml:"minimizePatches"`
+	RenewerAuth                     RenewerAuth               `yaml:"renewerAuth"`
+	WebhookReconciler               WebhookReconciler         `yaml:"webhookReconciler"`
+	DevCA                           DevCA                     `yaml:"devCA"`
+	SecretIssuance                  SecretIssuance            `yaml:"secretIssuance"`
+	KnativeSecrets                  bool                      `yaml:"knativeSecrets"`
+	ConstrainedIntermediates        []ConstrainedIntermediate `yaml:"constrainedIntermediates"`
+	CertificateAuthorities          []CertificateAuthority    `yaml:"certificateAuthorities"`
+	TrustBundle                     TrustBundle               `yaml:"trustBundle"`
+	RenewerMetrics                  RenewerMetrics            `yaml:"renewerMetrics"`
+	ServiceAccountAuth              ServiceAccountAuth        `yaml:"serviceAccountAuth"`
+	NextProvisioner                 NextProvisioner           `yaml:"nextProvisioner"`
+	OTLP                            OTLP                      `yaml:"otlp"`
+	RestartNever                    RestartNever              `yaml:"restartNever"`
+	LeaderElection                  LeaderElection            `yaml:"leaderElection"`
+	Reload                          Reload                    `yaml:"reload"`
+	Features                        map[string]string         `yaml:"features"`
+}
+
+// GetAddress returns the address set in the configuration, defaults to ":4443"
+// if it's not specified.
+func (c Config) GetAddress() string {
+	if c.Address != "" {
+		return c.Address
+	}
+
+	return ":4443"
+}
+
+// GetServiceName returns the service name set in the configuration, defaults to
+// "autocert" if it's not specified.
+func (c Config) GetServiceName() string {
+	if c.Service != "" {
+		return c.Service
+	}
+
+	return "autocert"
+}
+
+// GetClusterDomain returns the Kubernetes cluster domain, defaults to
+// "cluster.local" if not specified in the configuration.
+func (c Config) GetClusterDomain() string {
+	if c.ClusterDomain != "" {
+		return c.ClusterDomain
+	}
+
+	return "cluster.local"
+}
+
+// GetCertLifetime returns the lifetime of the certificates, defaults to 24h,
+// the default maximum of the provisioners, if it's not a duration.
+func (c Config) GetCertLifetime() time.Duration {
+	d, err := time.ParseDuration(c.CertLifetime)
+	if err != nil || d <= 0 {
+		return defaultCertLifetime
+	}
+	return d
+}
+
+// GetRootCAPath returns the root CA path in the configuration, defaults to
+// "STEPPATH/certs/root_ca.crt" if it's not specified.
+func (c Config) GetRootCAPath() string {
+	if c.RootCAPath != "" {
+		return c.RootCAPath
+	}
+
+	return pki.GetRootCAPath()
+}
+
+// GetProvisionerPasswordPath returns the path to the provisioner password,
+// defaults to "/home/step/password/password" if not specified in the
+// configuration.
+func (c Config) GetProvisionerPasswordPath() string {
+	if c.ProvisionerPasswordPath != "" {
+		return c.ProvisionerPasswordPath
+	}
+
+	return "/home/step/password/password"
+}
+
+// GetTokenSecretPrefix returns the prefix used to name the Secrets holding the
+// bootstrap tokens, defaults to the common name followed by a dash if not
+// specified in the configuration.
+func (c Config) GetTokenSecretPrefix(commonName string) string {
+	if c.TokenSecretPrefix != "" {
+		return c.TokenSecretPrefix
+	}
+
+	return commonName + "-"
+}
+
+// GetAdmissionBudget returns the maximum time spent generating the bootstrap
+// token during admission, defaults to 0 (no limit) if not specified in the
+// configuration.
+func (c Config) GetAdmissionBudget() time.Duration {
+	d, err := time.ParseDuration(c.AdmissionBudget)
+	if err != nil {
+		return 0
+	}
+
+	return d
+}
+
+// GetTokenURL returns the URL used by bootstrappers to exchange a claim for a
+// bootstrap token with the controller.
+func (c Config) GetTokenURL() string {
+	return fmt.Sprintf("https://%s.%s.svc/token", c.GetServiceName(), os.Getenv("NAMESPACE"))
+}
+
+// GetFreezeURL returns the URL used by renewers to check whether renewals are
+// frozen.
+func (c Config) GetFreezeURL() string {
+	return fmt.Sprintf("https://%s.%s.svc/freeze", c.GetServiceName(), os.Getenv("NAMESPACE"))
+}
+
+// GetProvisionerName returns the name of the provisioner used to generate
+// bootstrap tokens, defaults to the PROVISIONER_NAME environment variable if
+// not specified in the configuration.
+func (c Config) GetProvisionerName() string {
+	if c.ProvisionerName != "" {
+		return c.ProvisionerName
+	}
+
+	return os.Getenv("PROVISIONER_NAME")
+}
+
+// PatchOperation represents a RFC6902 JSONPatch Operation
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// RFC6901 JSONPath Escaping -- https://tools.ietf.org/html/rfc6901
+func escapeJSONPath(path string) string {
+	// Replace`~` with `~0` then `/` with `~1`. Note that the order
+	// matters otherwise we'll turn a `/` into a `~/`.
+	path = strings.ReplaceAll(path, "~", "~0")
+	path = strings.ReplaceAll(path, "/", "~1")
+	return path
+}
+
+func loadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file) //nolint:gosec // file path comes from trusted configuration
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateProtocolVersion(cfg.ProtocolVersion); err != nil {
+		return nil, err
+	}
+
+	if err := validateClusterDomain(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.AdmissionBudget != "" {
+		if _, err := time.ParseDuration(cfg.AdmissionBudget); err != nil {
+			return nil, errors.Wrap(err, "invalid admissionBudget")
+		}
+	}
+
+	if cfg.ExpiringSoon != "" {
+		if d, err := time.ParseDuration(cfg.ExpiringSoon); err != nil || d <= 0 {
+			return nil, errors.Errorf("invalid expiringSoon %q, it must be a positive duration", cfg.ExpiringSoon)
+		}
+	}
+
+	if err := validateSANCheck(cfg.SANCheck); err != nil {
+		return nil, err
+	}
+
+	if err := validateSANPolicies(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateMetadata(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateCSRConfig(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateApprovalGates(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateRenewerResources(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateFeatures(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateAirGapped(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateBuildVerification(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateTokenBinding(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateTokenRemint(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validatePersistentQueue(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateIssuanceLog(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateLeakGuard(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateLoadShedding(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateRenewerAuth(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateCAService(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateCAFailover(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validatePodExpiryMetrics(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateWebhookReconciler(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateDevCA(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateSecretIssuance(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateKnativeSecrets(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateRolloutIdentity(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateConstrainedIntermediates(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateCertificateAuthorities(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateTrustBundle(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateRenewerMetrics(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateServiceAccountAuth(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateNextProvisioner(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateOTLP(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateRestartNever(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateLeaderElection(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateReload(&cfg); err != nil {
+		return nil, err
+	}
+
+	for _, name := range cfg.SANResolvers {
+		if _, err := resolver.Lookup(name); err != nil {
+			return nil, errors.Wrapf(err, "invalid sanResolvers, registered resolvers are %v", resolver.Names())
+		}
+	}
+
+	return &cfg, nil
+}
+
+// createTokenSecret generates a kubernetes Secret object containing a bootstrap token
+// in the specified namespace. The secret name is randomly generated with a given prefix.
+// The secret is scheduled for deletion after the token expires. The secret
+// is also labeled for easy identification and manual cleanup, and carries the
+// secretLabels and secretAnnotations set in the configuration.
+func createTokenSecret(config *Config, prefix, namespace, token string) (string, error) {
+	labels := maps.Clone(config.SecretLabels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[tokenSecretLabel] = "true"
+
+	secret := corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: prefix,
+			Namespace:    namespace,
+			Labels:       labels,
+			Annotations:  config.SecretAnnotations,
+		},
+		StringData: map[string]string{
+			tokenSecretKey: token,
+		},
+		Type: corev1.SecretTypeOpaque,
+	}
+
+	name, err := tokenSecrets.CreateSecret(&secret)
+	if err != nil {
+		return "", err
+	}
+
+	// Clean up after ourselves by deleting the Secret after the bootstrap
+	// token expires. This is best effort -- obviously we'll miss some stuff
+	// if this process goes away without a persistent queue -- but the
+	// secrets are also labeled so it's also easy to clean them up in bulk
+	// using kubectl if we miss any.
+	tokenSecretDeletions.schedule(secretDeletion{
+		Namespace: namespace,
+		Name:      name,
+		Due:       time.Now().Add(tokenLifetime),
+	})
+
+	return name, nil
+}
+
+// mkBootstrapper generates a bootstrap container based on the template defined in Config. It
+// generates a new bootstrap token and mounts it, along with other required configuration, as
+// environment variables in the returned bootstrap container. If a claim is given, no token is
+// generated: the bootstrapper exchanges the claim for a token with the controller instead.
+func mkBootstrapper(ctx context.Context, config *Config, podName, commonName, duration, owner, mode, umask, namespace, secretPrefix, claim string, readOnly bool, sans []string, provisioner TokenManager) (corev1.Container, error) {
+	b := *config.Bootstrapper.DeepCopy()
+
+	// Generate CA fingerprint
+	crt, err := pemutil.ReadCertificate(config.GetRootCAPath())
+	if err != nil {
+		return b, errors.Wrap(err, "CA fingerprint")
+	}
+	sum := sha256.Sum256(crt.Raw)
+	fingerprint := strings.ToLower(hex.EncodeToString(sum[:]))
+
+	var tokenEnv []corev1.EnvVar
+	switch {
+	case config.ServiceAccountAuth.Enabled:
+		tokenEnv = serviceAccountAuthEnv(sans)
+		addServiceAccountAuth(&b)
+	case claim != "":
+		tokenEnv = []corev1.EnvVar{
+			{
+				Name:  "AUTOCERT_TOKEN_URL",
+				Value: config.GetTokenURL(),
+			},
+			{
+				Name:  "AUTOCERT_CLAIM",
+				Value: claim,
+			},
+		}
+	default:
+		token, err := mintToken(ctx, provisioner, commonName, sans...)
+		if err != nil {
+			return b, errors.Wrap(err, "token generation")
+		}
+
+		// Don't leave a secret behind for a request the API server gave up
+		// on.
+		if err := ctx.Err(); err != nil {
+			return b, errors.Wrap(err, "create token secret")
+		}
+		secretName, err := createTokenSecret(config, secretPrefix, namespace, token)
+		if err != nil {
+			return b, errors.Wrap(err, "create token secret")
+		}
+		log.Infof("Secret name is: %s", secretName)
+
+		tokenEnv = []corev1.EnvVar{
+			{
+				Name: "STEP_TOKEN",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: secretName,
+						},
+						Key:      tokenSecretKey,
+						Optional: ptr.To[bool](true),
+					},
+				},
+			},
+		}
+	}
+
+	b.Env = setEnv(b.Env,
+		corev1.EnvVar{
+			Name:  "COMMON_NAME",
+			Value: commonName,
+		},
+		corev1.EnvVar{
+			Name:  "DURATION",
+			Value: duration,
+		},
+		corev1.EnvVar{
+			Name:  "OWNER",
+			Value: owner,
+		},
+		corev1.EnvVar{
+			Name:  "MODE",
+			Value: mode,
+		},
+		corev1.EnvVar{
+			Name:  "UMASK",
+			Value: umask,
+		},
+		corev1.EnvVar{
+			Name:  "READ_ONLY",
+			Value: strconv.FormatBool(readOnly),
+		},
+		corev1.EnvVar{
+			Name:  "STEP_CA_URL",
+			Value: config.GetCaURL(),
+		},
+		corev1.EnvVar{
+			Name:  "STEP_FINGERPRINT",
+			Value: fingerprint,
+		},
+		corev1.EnvVar{
+			Name:  "STEP_ROOT_PEM",
+			Value: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})),
+		},
+		corev1.EnvVar{
+			Name:  "STEP_NOT_AFTER",
+			Value: config.CertLifetime,
+		},
+		corev1.EnvVar{
+			Name:  "POD_NAME",
+			Value: podName,
+		},
+		corev1.EnvVar{
+			Name:  "NAMESPACE",
+			Value: namespace,
+		},
+		corev1.EnvVar{
+			Name:  "CLUSTER_DOMAIN",
+			Value: config.GetClusterDomain(),
+		})
+	b.Env = setEnv(b.Env, tokenEnv...)
+	if config.AirGapped.Enabled {
+		env, err := airGappedEnv(config)
+		if err != nil {
+			return b, err
+		}
+		b.Env = setEnv(b.Env, env...)
+	}
+	b.Env = setEnv(b.Env, protocolEnv(config.GetProtocolVersion()))
+	b.Env = filterEnv(b.Env, config.GetProtocolVersion())
+
+	return b, nil
+}
+
+// mkRenewer generates a new renewer based on the template provided in Config.
+func mkRenewer(config *Config, podName, commonName, namespace string) corev1.Container {
+	r := *config.Renewer.DeepCopy()
+	r.Env = setEnv(r.Env,
+		corev1.EnvVar{
+			Name:  "STEP_CA_URL",
+			Value: config.GetCaURL(),
+		},
+		corev1.EnvVar{
+			Name:  "COMMON_NAME",
+			Value: commonName,
+		},
+		corev1.EnvVar{
+			Name:  "POD_NAME",
+			Value: podName,
+		},
+		corev1.EnvVar{
+			Name:  "NAMESPACE",
+			Value: namespace,
+		},
+		corev1.EnvVar{
+			Name:  "CLUSTER_DOMAIN",
+			Value: config.GetClusterDomain(),
+		},
+		corev1.EnvVar{
+			Name:  "AUTOCERT_FREEZE_URL",
+			Value: config.GetFreezeURL(),
+		},
+		corev1.EnvVar{
+			Name:  "AUTOCERT_STATUS_URL",
+			Value: config.GetStatusURL(),
+		},
+		corev1.EnvVar{
+			Name:  readyFileEnvVar,
+			Value: readyFileName,
+		},
+	)
+	// Certificates are re-issued with tokens of the provisioner.
+	if featureEnabled(config, featureReissue, namespace) && !config.ServiceAccountAuth.Enabled {
+		r.Env = setEnv(r.Env, corev1.EnvVar{
+			Name:  "AUTOCERT_REISSUE_URL",
+			Value: config.GetReissueURL(),
+		})
+	}
+	r.Env = setEnv(r.Env, protocolEnv(config.GetProtocolVersion()))
+	r.Env = filterEnv(r.Env, config.GetProtocolVersion())
+	applyRecommendation(config, &r, namespace)
+	return r
+}
+
+// setEnv sets the given environment variables on a copy of env. Variables
+// already defined in env are replaced in place and new ones are appended in
+// the given order, so the resulting list is stable across requests and
+// controller versions.
+func setEnv(env []corev1.EnvVar, vars ...corev1.EnvVar) []corev1.EnvVar {
+	result := slices.Clone(env)
+	for _, v := range vars {
+		if i := slices.IndexFunc(result, func(e corev1.EnvVar) bool { return e.Name == v.Name }); i >= 0 {
+			result[i] = v
+		} else {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func removeInitContainers() (ops PatchOperation) {
+	return PatchOperation{
+		Op:   "remove",
+		Path: "/spec/initContainers",
+	}
+}
+
+func addContainers(existing, nu []corev1.Container, path string) (ops []PatchOperation) {
+	if len(existing) == 0 {
+		return []PatchOperation{
+			{
+				Op:    "add",
+				Path:  path,
+				Value: nu,
+			},
+		}
+	}
+
+	for _, add := range nu {
+		ops = append(ops, PatchOperation{
+			Op:    "add",
+			Path:  path + "/-",
+			Value: add,
+		})
+	}
+
+	return ops
+}
+
+func addVolumes(existing, nu []corev1.Volume, path string) (ops []PatchOperation) {
+	if len(existing) == 0 {
+		return []PatchOperation{
+			{
+				Op:    "add",
+				Path:  path,
+				Value: nu,
+			},
+		}
+	}
+
+	for _, add := range nu {
+		ops = append(ops, PatchOperation{
+			Op:    "add",
+			Path:  path + "/-",
+			Value: add,
+		})
+	}
+	return ops
+}
+
+// addCertsVolumeMount mounts the certificates volume in the given containers.
+// Containers already mounting the whole volume at volumeMountPath are left
+// as is. It returns an error if a container mounts another volume, or a
+// subPath, at volumeMountPath.
+func addCertsVolumeMount(volumeName string, containers []corev1.Container, containerType string, first bool) (ops []PatchOperation, err error) {
+	volumeMount := corev1.VolumeMount{
+		Name:      volumeName,
+		MountPath: volumeMountPath,
+		ReadOnly:  true,
+	}
+
+	add := 0
+	if first {
+		add = 1
+	}
+
+	for i, container := range containers {
+		mounted, err := mountsCertsVolume(container, volumeName)
+		if err != nil {
+			return nil, err
+		}
+		if mounted {
+			continue
+		}
+		if len(container.VolumeMounts) == 0 {
+			ops = append(ops, PatchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/%s/%v/volumeMounts", containerType, i+add),
+				Value: []corev1.VolumeMount{volumeMount},
+			})
+		} else {
+			ops = append(ops, PatchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/%s/%v/volumeMounts/-", containerType, i+add),
+				Value: volumeMount,
+			})
+		}
+	}
+	return ops, nil
+}
+
+// mountsCertsVolume returns whether the container mounts the certificates
+// volume at volumeMountPath, or an error if something else is mounted there.
+func mountsCertsVolume(container corev1.Container, volumeName string) (bool, error) {
+	for _, m := range container.VolumeMounts {
+		if path.Clean(m.MountPath) != volumeMountPath {
+			continue
+		}
+		if m.Name != volumeName || m.SubPath != "" || m.SubPathExpr != "" {
+			return false, fmt.Errorf("container %s mounts volume %s at %s, where the certificates are mounted", container.Name, m.Name, volumeMountPath)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func addAnnotations(existing, nu map[string]string) (ops []PatchOperation) {
+	return addMetadata(existing, nu, "annotations")
+}
+
+// addLabels adds the given labels to the pod, replacing existing values.
+func addLabels(existing, nu map[string]string) (ops []PatchOperation) {
+	if len(nu) == 0 {
+		return nil
+	}
+	return addMetadata(existing, nu, "labels")
+}
+
+// addMetadata adds the given entries to the labels or annotations of the pod,
+// replacing existing values.
+func addMetadata(existing, nu map[string]string, field string) (ops []PatchOperation) {
+	if len(existing) == 0 {
+		return []PatchOperation{
+			{
+				Op:    "add",
+				Path:  "/metadata/" + field,
+				Value: nu,
+			},
+		}
+	}
+	// Iterate in key order so the generated patch is deterministic.
+	for _, k := range slices.Sorted(maps.Keys(nu)) {
+		v := nu[k]
+		if existing[k] == "" {
+			ops = append(ops, PatchOperation{
+				Op:    "add",
+				Path:  "/metadata/" + field + "/" + escapeJSONPath(k),
+				Value: v,
+			})
+		} else {
+			ops = append(ops, PatchOperation{
+				Op:    "replace",
+				Path:  "/metadata/" + field + "/" + escapeJSONPath(k),
+				Value: v,
+			})
+		}
+	}
+	return ops
+}
+
+// desiredSANs returns the SANs of the certificate of a pod: the names in the
+// sans annotation, or its common name, the SPIFFE ID or workload identity,
+// and the names added by the SAN resolvers. The identity of a rollout
+// revision with isolated identities gets the revision.
+func desiredSANs(ctx context.Context, pod *corev1.Pod, namespace, revision string, config *Config) ([]string, error) {
+	annotations := pod.GetAnnotations()
+	commonName := annotations[admissionWebhookAnnotationKey]
+	sans := strings.Split(annotations[sansAnnotationKey], ",")
+	if annotations[sansAnnotationKey] == "" {
+		sans = []string{commonName}
+	}
+	uri, err := podIdentity(config, namespace, pod.Spec.ServiceAccountName, annotations)
+	if err != nil {
+		return nil, err
+	}
+	uri = rolloutIdentityURI(uri, revision)
+	if uri != "" && !slices.Contains(sans, uri) {
+		sans = append(sans, uri)
+	}
+	if len(config.SANResolvers) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, sanResolverTimeout)
+		defer cancel()
+		resolved, err := resolver.Resolve(ctx, config.SANResolvers, resolver.Request{
+			Pod:        pod,
+			Namespace:  namespace,
+			CommonName: commonName,
+			SANs:       sans,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sans = resolved
+	}
+	return sans, nil
+}
+
+// patch produces a list of patches to apply to a pod to inject a certificate. In particular,
+// we patch the pod in order to:
+// - Mount the `certs` volume in existing containers and initContainers defined in the pod
+// - Add the autocert-renewer as a container, or a native sidecar (a sidecar)
+// - Add the autocert-bootstrapper as an initContainer
+// - Add the `certs` volume definition
+// - Annotate the pod to indicate that it's been processed by this controller
+// The result is a list of serialized JSONPatch objects (or an error).
+func patch(ctx context.Context, pod *corev1.Pod, namespace string, config *Config, provisioner TokenManager) ([]byte, error) {
+	var ops []PatchOperation
+
+	name := pod.GetName()
+	if name == "" {
+		name = pod.GetGenerateName()
+	}
+
+	annotations, err := parseAnnotations(pod.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	intermediate, err := constrainedIntermediate(annotations, namespace, config)
+	if err != nil {
+		return nil, err
+	}
+	authority, err := podCertificateAuthority(annotations, namespace, config, intermediate)
+	if err != nil {
+		return nil, err
+	}
+	format, err := keystoreFormat(annotations, config)
+	if err != nil {
+		return nil, err
+	}
+	hook, err := podRenewalHook(pod, annotations, config)
+	if err != nil {
+		return nil, err
+	}
+	managed, err := managedSecret(annotations, config)
+	if err != nil {
+		return nil, err
+	}
+	revision := rolloutRevision(pod, namespace, annotations, config)
+	// The identity environment variables are added by managedSecretPatch
+	// for pods with a managed Secret, and below for the others.
+	if _, err := identityEnv(annotations); err != nil {
+		return nil, err
+	}
+	if managed != "" && intermediate != nil {
+		return nil, annotationErrors{{
+			Key:    secretAnnotationKey,
+			Value:  managed,
+			Reason: fmt.Sprintf("certificates in Secrets are not signed by constrained intermediates, the pod uses intermediate %s", intermediate.Name),
+		}}
+	}
+	if managed != "" && authority != nil {
+		return nil, annotationErrors{{
+			Key:    secretAnnotationKey,
+			Value:  managed,
+			Reason: fmt.Sprintf("certificates in Secrets are signed by the CA in the configuration, the pod uses certificate authority %s", authority.Name),
+		}}
+	}
+	// The revisions of a rollout with isolated identities get their own
+	// Secret, or the preview and stable replicas would replace each other's
+	// certificate.
+	if managed != "" && revision != "" {
+		name := managed + "-" + revision
+		if reason := checkSecretName(name); reason != "" {
+			return nil, annotationErrors{{
+				Key:    secretAnnotationKey,
+				Value:  managed,
+				Reason: fmt.Sprintf("%s with revision %s appended", reason, revision),
+			}}
+		}
+		managed = name
+	}
+	// Pods of Knative Revisions share a Secret per Revision, so scaling from
+	// zero doesn't wait for the CA.
+	var (
+		managedSANs   []string
+		revisionOwner *metav1.OwnerReference
+	)
+	if managed == "" && intermediate == nil && authority == nil {
+		if managed, revisionOwner, managedSANs, err = knativeSecret(ctx, pod, namespace, annotations, revision, config); err != nil {
+			return nil, err
+		}
+	}
+	if managed != "" {
+		if managedSANs == nil {
+			if managedSANs, err = desiredSANs(ctx, pod, namespace, revision, config); err != nil {
+				return nil, err
+			}
+		}
+		if ops, err = managedSecretPatch(ctx, pod, namespace, config, annotations, managed, revision, managedSANs, revisionOwner); err != nil {
+			return nil, err
+		}
+		if config.MinimizePatches {
+			if ops, err = minimizePatch(pod, ops); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(ops)
+	}
+	secretName, err := externalSecret(annotations, config)
+	if err != nil {
+		return nil, err
+	}
+	if secretName != "" {
+		if ops, err = externalSecretPatch(pod, namespace, config, annotations, secretName); err != nil {
+			return nil, err
+		}
+		if config.MinimizePatches {
+			if ops, err = minimizePatch(pod, ops); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(ops)
+	}
+
+	commonName := annotations.CommonName
+	first := annotations.First
+	sans, err := desiredSANs(ctx, pod, namespace, revision, config)
+	if err != nil {
+		return nil, err
+	}
+	var intermediateName string
+	if intermediate != nil {
+		if err := intermediate.checkNames(commonName, sans); err != nil {
+			return nil, err
+		}
+		intermediateName = intermediate.Name
+		provisioner = intermediate.tokens
+	}
+	var authorityName string
+	if authority != nil {
+		authorityName = authority.Name
+		provisioner = authority.tokens
+	}
+	bootstrapperOnly := annotations.BootstrapperOnly
+	duration := annotations.Duration
+	if duration == "" && featureEnabled(config, featureJobDuration, namespace) {
+		duration = jobDuration(pod, namespace, config.GetCertLifetime(), getJob)
+	}
+	owner := annotations.Owner
+	mode := annotations.Mode
+	umask := annotations.Umask
+	readOnly := annotations.ReadOnly
+	dual, err := dualStack(pod, config)
+	if err != nil {
+		return nil, err
+	}
+	key, err := podKeySpec(annotations, config, dual)
+	if err != nil {
+		return nil, err
+	}
+	probe, err := startupProbe(pod, config, bootstrapperOnly)
+	if err != nil {
+		return nil, err
+	}
+	certsVolume, err := hasCertsVolume(pod, config)
+	if err != nil {
+		return nil, err
+	}
+	drain, err := waitForDrain(annotations, config)
+	if err != nil {
+		return nil, err
+	}
+	sds, err := useSDS(annotations, config)
+	if err != nil {
+		return nil, err
+	}
+	secretPrefix := config.GetTokenSecretPrefix(commonName)
+	if revision != "" {
+		secretPrefix += revision + "-"
+	}
+	renewer := mkRenewer(config, name, commonName, namespace)
+
+	// Generate the bootstrapper within the admission budget. If it takes
+	// longer, admit the pod with a claim that the bootstrapper exchanges for a
+	// token with the controller once it runs.
+	// The pod redeems the claim with its service account token, which
+	// bootstrappers older than the protocol version of claimTokenEnvVar
+	// don't send: they always get their token during admission.
+	// Pods in csrNamespaces, or requesting names held by an approval gate,
+	// get their certificate through a CertificateSigningRequest approved out
+	// of band instead.
+	var pending bool
+	budget := config.GetAdmissionBudget()
+	if config.GetProtocolVersion() < envProtocolVersions[claimTokenEnvVar] {
+		budget = 0
+	}
+	var bootstrapper corev1.Container
+	csr, gate := usesCSR(config, append([]string{commonName}, sans...), namespace)
+	if csr && intermediate != nil {
+		return nil, errors.Errorf("names held by approval gate %s are not signed by constrained intermediate %s", gate, intermediate.Name)
+	}
+	if csr && authority != nil {
+		return nil, errors.Errorf("names held by approval gate %s are not signed by certificate authority %s", gate, authority.Name)
+	}
+	if csr {
+		if err := checkCSRDuration(annotations, duration); err != nil {
+			return nil, err
+		}
+	}
+	bound := config.TokenBinding && !csr
+	switch {
+	case csr:
+		bootstrapper, err = mkCSRBootstrapper(ctx, config, pod, commonName, duration, owner, mode, umask, namespace, gate, readOnly, sans, provisioner)
+	case bound:
+		bootstrapper, err = mkBoundBootstrapper(ctx, config, pod, commonName, duration, owner, mode, umask, namespace, readOnly, sans, provisioner)
+	case config.ServiceAccountAuth.Enabled:
+		bootstrapper, err = mkBootstrapper(ctx, config, name, commonName, duration, owner, mode, umask, namespace, "", "", readOnly, sans, nil)
+	default:
+		bootstrapper, err = withBudget(ctx, budget, func(ctx context.Context) (corev1.Container, error) {
+			return mkBootstrapper(ctx, config, name, commonName, duration, owner, mode, umask, namespace, secretPrefix, "", readOnly, sans, provisioner)
+		})
+	}
+	if errors.Is(err, errBudgetExceeded) {
+		log.WithField("commonName", commonName).Warn("Admission budget exceeded, deferring token issuance")
+		claim, cerr := pendingIssuances.add(pendingIssuance{
+			CommonName:     commonName,
+			SANs:           sans,
+			Namespace:      namespace,
+			Intermediate:   intermediateName,
+			CA:             authorityName,
+			ServiceAccount: podServiceAccount(pod),
+			PodName:        pod.GetName(),
+			GenerateName:   pod.GetGenerateName(),
+		})
+		if cerr != nil {
+			return nil, cerr
+		}
+		pending = true
+		bootstrapper, err = mkBootstrapper(ctx, config, name, commonName, duration, owner, mode, umask, namespace, secretPrefix, claim, readOnly, sans, provisioner)
+		if err == nil {
+			addClaimToken(&bootstrapper)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Pods whose token expires before their bootstrapper runs can get a new
+	// one. Bound tokens and CertificateSigningRequests are requested by the
+	// bootstrapper itself.
+	remint := config.TokenRemint.Enabled && !csr && !bound
+	if remint {
+		if err := addRemint(config, &bootstrapper, pod, commonName, namespace, intermediateName, authorityName, sans); err != nil {
+			return nil, err
+		}
+	}
+
+	// Surface the logs of the injected containers in the pod status when they
+	// fail without a termination message.
+	for _, c := range []*corev1.Container{&bootstrapper, &renewer} {
+		if c.TerminationMessagePolicy == "" {
+			c.TerminationMessagePolicy = corev1.TerminationMessageFallbackToLogsOnError
+		}
+	}
+
+	if dual {
+		setDualStack(&bootstrapper, &renewer)
+	}
+	if key != (keySpec{}) {
+		setKeySpec(&bootstrapper, key)
+	}
+	if format != "" {
+		setKeystore(format, &bootstrapper, &renewer)
+	}
+	setBootstrapRetries(config, pod, &bootstrapper)
+	if config.RenewerAuth.BindToken {
+		addRenewerAuth(&renewer)
+	}
+	// The passive CAs don't sign with the intermediates, and only back the
+	// CA in the configuration.
+	switch {
+	case intermediate != nil:
+		setIntermediate(intermediate, &bootstrapper, &renewer)
+	case authority != nil:
+		setCertificateAuthority(authority, &bootstrapper, &renewer)
+	case len(config.CAFailoverURLs) > 0:
+		setCAFailover(config, &bootstrapper, &renewer)
+	}
+	if drain {
+		setDrain(&renewer, pod)
+	}
+	if hook != nil {
+		setRenewalHook(hook, &renewer)
+	}
+	// The bundle holds the roots of the CA in the configuration.
+	if config.TrustBundle.Enabled && authority == nil {
+		setTrustBundle(config, &renewer)
+	}
+	if sds {
+		setSDS(&renewer)
+	}
+	setRenewerMetrics(config, &renewer, pod, namespace)
+	setRenewerOTLP(config, &renewer)
+
+	// Pods with a read-only root filesystem get injected containers with one
+	// too, writing their state to a scratch volume.
+	readOnlyRoot := readOnlyRootFilesystem(pod)
+	if readOnlyRoot {
+		setReadOnlyRootFilesystem(&bootstrapper, &renewer)
+	}
+
+	// Run the injected containers as non-root in pods with an fsGroup. On
+	// OpenShift, the user and fsGroup are the ones the SCC assigns to the pod.
+	scPod := pod
+	if config.OpenShift {
+		if scPod, err = openShiftPod(pod, namespace, namespaceAnnotations.get); err != nil {
+			return nil, err
+		}
+	}
+	if sc := nonRootSecurityContext(config, scPod, owner); sc != nil {
+		setSecurityContext(&bootstrapper, sc)
+		setSecurityContext(&renewer, sc.DeepCopy())
+	}
+
+	// Native sidecar renewers run after every init container, see
+	// addRenewer.
+	native := !bootstrapperOnly && useNativeSidecar(config, namespace)
+	var sidecars []corev1.Container
+	if native {
+		setNativeSidecar(&renewer)
+		sidecars = append(sidecars, renewer)
+	}
+
+	if first {
+		if len(pod.Spec.InitContainers) > 0 {
+			ops = append(ops, removeInitContainers())
+		}
+
+		initContainers := append([]corev1.Container{bootstrapper}, pod.Spec.InitContainers...)
+		initContainers = append(initContainers, sidecars...)
+		ops = append(ops, addContainers([]corev1.Container{}, initContainers, "/spec/initContainers")...)
+	} else {
+		ops = append(ops, addContainers(pod.Spec.InitContainers, append([]corev1.Container{bootstrapper}, sidecars...), "/spec/initContainers")...)
+	}
+
+	mountOps, err := addCertsVolumeMount(config.CertsVolume.Name, pod.Spec.Containers, "containers", false)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, mountOps...)
+	mountOps, err = addCertsVolumeMount(config.CertsVolume.Name, pod.Spec.InitContainers, "initContainers", first)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, mountOps...)
+	if probe {
+		ops = append(ops, addStartupProbes(pod.Spec.Containers)...)
+	}
+	if annotations.IdentityEnv {
+		ops = append(ops, addIdentityEnv(pod.Spec.Containers, identityEnvVars(commonName, sans))...)
+	}
+	if drain {
+		mountOps, err = addDrainVolumeMounts(pod.Spec.Containers)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, mountOps...)
+	}
+	if !bootstrapperOnly && !native {
+		ops = append(ops, addRenewer(pod, renewer)...)
+	}
+	if hook != nil && hook.Signal != "" {
+		ops = append(ops, shareProcessNamespace(pod)...)
+	}
+	var volumes []corev1.Volume
+	if !certsVolume {
+		volumes = append(volumes, config.CertsVolume)
+	}
+	if readOnlyRoot {
+		volumes = append(volumes, scratchVolume())
+	}
+	if bound || csr || pending || remint || (config.RenewerAuth.BindToken && !bootstrapperOnly) {
+		volumes = append(volumes, tokenBindingVolumeSource())
+	}
+	if drain {
+		volumes = append(volumes, drainVolume())
+	}
+	if config.ServiceAccountAuth.Enabled {
+		volumes = append(volumes, caTokenVolumeSource(config))
+	}
+	ops = append(ops, addVolumes(pod.Spec.Volumes, volumes, "/spec/volumes")...)
+	podAnnotations := map[string]string{admissionWebhookStatusKey: "injected"}
+	if revision != "" {
+		podAnnotations[revisionAnnotationKey] = revision
+	}
+	if pending {
+		podAnnotations[issuanceAnnotationKey] = "pending"
+	}
+	if requests := sidecarRequests(renewer); native && requests != "" {
+		podAnnotations[sidecarRequestsAnnotationKey] = requests
+	}
+	// Labels and annotations from the configuration never replace the ones
+	// set on the pod.
+	for k, v := range withoutExisting(pod.Annotations, config.PodAnnotations) {
+		podAnnotations[k] = v
+	}
+	ops = append(ops, addAnnotations(pod.Annotations, podAnnotations)...)
+	ops = append(ops, addLabels(pod.Labels, withoutExisting(pod.Labels, config.PodLabels))...)
+
+	recordIssuance(IssuanceRecord{
+		Namespace:  namespace,
+		Event:      issuanceEventAdmitted,
+		Pod:        cmp.Or(pod.Name, pod.GenerateName),
+		CommonName: commonName,
+		SANs:       sans,
+	})
+	if config.MinimizePatches {
+		if ops, err = minimizePatch(pod, ops); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(ops)
+}
+
+// shouldMutate checks whether a pod is subject to mutation by this admission controller. A pod
+// is subject to mutation if it's annotated with the `admissionWebhookAnnotationKey` and if it
+// has not already been processed (indicated by `admissionWebhookStatusKey` set to `injected`).
+// If the pod requests a certificate with a subject matching a namespace other than its own
+// and restrictToNamespace is true, then shouldMutate will return a validation error
+// that should be returned to the client.
+func shouldMutate(metadata *metav1.ObjectMeta, namespace, clusterDomain string, restrictToNamespace bool) (bool, error) {
+	annotations := metadata.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	// Only mutate if the object is annotated appropriately (annotation key set) and we haven't
+	// mutated already (status key isn't set).
+	if annotations[admissionWebhookAnnotationKey] == "" || annotations[admissionWebhookStatusKey] == "injected" {
+		return false, nil
+	}
+
+	if !restrictToNamespace {
+		return true, nil
+	}
+
+	subject := strings.Trim(annotations[admissionWebhookAnnotationKey], ".")
+
+	err := fmt.Errorf("subject \"%s\" matches a namespace other than \"%s\" and is not permitted. This check can be disabled by setting restrictCertificatesToNamespace to false in the autocert-config ConfigMap", subject, namespace)
+
+	if strings.HasSuffix(subject, ".svc") && !strings.HasSuffix(subject, fmt.Sprintf(".%s.svc", namespace)) {
+		return false, err
+	}
+
+	if strings.HasSuffix(subject, fmt.Sprintf(".svc.%s", clusterDomain)) && !strings.HasSuffix(subject, fmt.Sprintf(".%s.svc.%s", namespace, clusterDomain)) {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// shadowResponse logs and counts the decision that would have been made for a
+// request and returns a response allowing the pod without changes. It is used
+// in shadow mode to evaluate configuration changes on production traffic.
+func shadowResponse(ctxLog *log.Entry, request *v1beta1.AdmissionRequest, decision, reason string) *v1beta1.AdmissionResponse {
+	ctxLog.WithFields(log.Fields{
+		"decision": decision,
+		"reason":   reason,
+	}).Info("Shadow mode: admitting pod without changes")
+	recordDecision(decisionShadowed, reason, request.Namespace)
+	return &v1beta1.AdmissionResponse{
+		Allowed: true,
+		UID:     request.UID,
+	}
+}
+
+// mutate takes an `AdmissionReview`, determines whether it is subject to mutation, and returns
+// an appropriate `AdmissionResponse` including patches or any errors that occurred.
+func mutate(ctx context.Context, review *v1beta1.AdmissionReview, config *Config, provisioner TokenManager) (response *v1beta1.AdmissionResponse) {
+	ctxLog := log.WithField("uid", review.Request.UID)
+
+	request := review.Request
+	var pod corev1.Pod
+	if err := json.Unmarshal(request.Object.Raw, &pod); err != nil {
+		ctxLog.WithField("error", err).Error("Error unmarshaling pod")
+		recordDecision(decisionErrored, reasonInvalidPod, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: false,
+			UID:     request.UID,
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+	defer func() {
+		recordAdmissionEvent(&pod, request.Namespace, config, response)
+	}()
+
+	expandNames(&pod, request.Namespace, config)
+
+	ctxLog = ctxLog.WithFields(log.Fields{
+		"kind":         request.Kind,
+		"operation":    request.Operation,
+		"name":         pod.Name,
+		"generateName": pod.GenerateName,
+		"namespace":    request.Namespace,
+		"user":         request.UserInfo,
+	})
+
+	mutationAllowed, validationErr := shouldMutate(&pod.ObjectMeta, request.Namespace, config.GetClusterDomain(), config.RestrictCertificatesToNamespace)
+
+	if validationErr != nil {
+		if config.ShadowMode {
+			return shadowResponse(ctxLog.WithField("error", validationErr), request, "deny", reasonNamespaceRestriction)
+		}
+		ctxLog.WithField("error", validationErr).Info("Validation error")
+		recordDecision(decisionDenied, reasonNamespaceRestriction, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: false,
+			UID:     request.UID,
+			Result: &metav1.Status{
+				Message: validationErr.Error(),
+			},
+		}
+	}
+
+	if !mutationAllowed {
+		ctxLog.WithField("annotations", pod.Annotations).Info("Skipping mutation")
+		reason := reasonNoAnnotation
+		if pod.Annotations[admissionWebhookStatusKey] == "injected" {
+			reason = reasonAlreadyInjected
+		}
+		recordDecision(decisionSkipped, reason, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+			UID:     request.UID,
+		}
+	}
+
+	if _, err := parseAnnotations(pod.GetAnnotations()); err != nil {
+		if config.ShadowMode {
+			return shadowResponse(ctxLog.WithField("error", err), request, "deny", reasonInvalidAnnotation)
+		}
+		ctxLog.WithField("error", err).Info("Invalid annotation")
+		recordDecision(decisionDenied, reasonInvalidAnnotation, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: false,
+			UID:     request.UID,
+			Result:  err.(annotationErrors).status(),
+		}
+	}
+
+	if err := checkHostNamespaces(&pod.Spec, request.Namespace, config); err != nil {
+		if config.ShadowMode {
+			return shadowResponse(ctxLog.WithField("error", err), request, "deny", reasonHostNamespaces)
+		}
+		ctxLog.WithField("error", err).Info("Policy error")
+		recordDecision(decisionDenied, reasonHostNamespaces, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: false,
+			UID:     request.UID,
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	policy, err := checkEnrollment(request.Namespace, config, getEnrollment, countCertificates)
+	if err != nil {
+		if config.ShadowMode {
+			return shadowResponse(ctxLog.WithField("error", err), request, "deny", reasonEnrollment)
+		}
+		ctxLog.WithField("error", err).Info("Enrollment error")
+		recordDecision(decisionDenied, reasonEnrollment, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: false,
+			UID:     request.UID,
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	warnings, err := checkSANPolicy(requestedNames(&pod), request.Namespace, policy)
+	if err == nil {
+		var sanWarnings []string
+		sanWarnings, err = checkSANs(&pod, request.Namespace, config, listServices)
+		warnings = append(warnings, sanWarnings...)
+	}
+	if err != nil {
+		if config.ShadowMode {
+			return shadowResponse(ctxLog.WithField("error", err), request, "deny", reasonSANPolicy)
+		}
+		ctxLog.WithField("error", err).Info("SAN check error")
+		recordDecision(decisionDenied, reasonSANPolicy, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: false,
+			UID:     request.UID,
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+	if len(warnings) > 0 {
+		ctxLog.WithField("warnings", warnings).Warn("SAN check warning")
+	}
+	warnings = append(warnings, subPathWarnings(&pod, config)...)
+	warnings = append(warnings, restartNeverWarnings(&pod, config)...)
+
+	if freeze := issuanceFreeze.get(os.Getenv("NAMESPACE")); freeze.Issuance {
+		err := freeze.issuanceError()
+		if config.ShadowMode {
+			return shadowResponse(ctxLog.WithField("error", err), request, "deny", reasonIssuanceFrozen)
+		}
+		ctxLog.WithFields(log.Fields{
+			"audit": true,
+			"error": err,
+		}).Warn("Issuance frozen")
+		recordDecision(decisionDenied, reasonIssuanceFrozen, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: false,
+			UID:     request.UID,
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	if config.ShadowMode {
+		return shadowResponse(ctxLog.WithField("annotations", pod.Annotations), request, "inject", reasonInjected)
+	}
+
+	patchBytes, err := patch(ctx, &pod, request.Namespace, config, provisioner)
+	var aerrs annotationErrors
+	if errors.As(err, &aerrs) {
+		ctxLog.WithField("error", err).Info("Invalid annotation")
+		recordDecision(decisionDenied, reasonInvalidAnnotation, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: false,
+			UID:     request.UID,
+			Result:  aerrs.status(),
+		}
+	}
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error generating patch")
+		recordDecision(decisionErrored, reasonIssuance, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed: false,
+			UID:     request.UID,
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	admissionPatchBytes.Observe(float64(len(patchBytes)))
+	if len(patchBytes) > largePatchBytes {
+		ctxLog.WithFields(log.Fields{
+			"size":      len(patchBytes),
+			"minimized": config.MinimizePatches,
+		}).Warn("Generated a large patch")
+	}
+	ctxLog.WithField("patch", string(patchBytes)).Info("Generated patch")
+	recordDecision(decisionPatched, reasonInjected, request.Namespace)
+	return &v1beta1.AdmissionResponse{
+		Allowed:  true,
+		Patch:    patchBytes,
+		UID:      request.UID,
+		Warnings: warnings,
+		PatchType: func() *v1beta1.PatchType {
+			pt := v1beta1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+}
+
+// readPasswordFromFile reads and returns the password from the given filename.
+// The contents of the file will be trimmed at the right.
+func readPasswordFromFile(filename string) ([]byte, error) {
+	password, err := os.ReadFile(filename) //nolint:gosec // file path comes from trusted configuration
+	if err != nil {
+		return nil, errs.FileError(err, filename)
+	}
+	password = bytes.TrimRightFunc(password, unicode.IsSpace)
+	return password, nil
+}
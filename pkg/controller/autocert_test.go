@@ -0,0 +1,313 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestGetClusterDomain(t *testing.T) {
+	c := Config{}
+	if c.GetClusterDomain() != "cluster.local" {
+		t.Errorf("cluster domain should default to cluster.local, not: %s", c.GetClusterDomain())
+	}
+
+	c.ClusterDomain = "mydomain.com"
+	if c.GetClusterDomain() != "mydomain.com" {
+		t.Errorf("cluster domain should default to cluster.local, not: %s", c.GetClusterDomain())
+	}
+}
+
+func TestShouldMutate(t *testing.T) {
+	testCases := []struct {
+		description string
+		subject     string
+		namespace   string
+		expected    bool
+	}{
+		{"full cluster domain", "test.default.svc.cluster.local", "default", true},
+		{"full cluster domain wrong ns", "test.default.svc.cluster.local", "kube-system", false},
+		{"left dots get stripped", ".test.default.svc.cluster.local", "default", true},
+		{"left dots get stripped wrong ns", ".test.default.svc.cluster.local", "kube-system", false},
+		{"right dots get stripped", "test.default.svc.cluster.local.", "default", true},
+		{"right dots get stripped wrong ns", "test.default.svc.cluster.local.", "kube-system", false},
+		{"dots get stripped", ".test.default.svc.cluster.local.", "default", true},
+		{"dots get stripped wrong ns", ".test.default.svc.cluster.local.", "kube-system", false},
+		{"partial cluster domain", "test.default.svc.cluster", "default", true},
+		{"partial cluster domain wrong ns is still allowed because not valid hostname", "test.default.svc.cluster", "kube-system", true},
+		{"service domain", "test.default.svc", "default", true},
+		{"service domain wrong ns", "test.default.svc", "kube-system", false},
+		{"two part domain", "test.default", "default", true},
+		{"two part domain different ns", "test.default", "kube-system", true},
+		{"one hostname", "test", "default", true},
+		{"no subject specified", "", "default", false},
+		{"three part not cluster", "test.default.com", "kube-system", true},
+		{"four part not cluster", "test.default.svc.com", "kube-system", true},
+		{"five part not cluster", "test.default.svc.cluster.com", "kube-system", true},
+		{"six part not cluster", "test.default.svc.cluster.local.com", "kube-system", true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			mutationAllowed, validationErr := shouldMutate(&metav1.ObjectMeta{
+				Annotations: map[string]string{
+					admissionWebhookAnnotationKey: testCase.subject,
+				},
+			}, testCase.namespace, "cluster.local", true)
+			if mutationAllowed != testCase.expected {
+				t.Errorf("shouldMutate did not return %t for %s", testCase.expected, testCase.description)
+			}
+			if testCase.subject != "" && mutationAllowed == false && validationErr == nil {
+				t.Errorf("shouldMutate should return validation error for invalid hostname")
+			}
+		})
+	}
+}
+
+func TestShouldMutateNotRestrictToNamespace(t *testing.T) {
+	mutationAllowed, _ := shouldMutate(&metav1.ObjectMeta{
+		Annotations: map[string]string{
+			admissionWebhookAnnotationKey: "test.default.svc.cluster.local",
+		},
+	}, "kube-system", "cluster.local", false)
+	if mutationAllowed == false {
+		t.Errorf("shouldMutate should return true even with a wrong namespace if restrictToNamespace is false.")
+	}
+}
+
+func Test_mkRenewer(t *testing.T) {
+	type args struct {
+		config     *Config
+		podName    string
+		commonName string
+		namespace  string
+	}
+	tests := []struct {
+		name string
+		args args
+		want corev1.Container
+	}{
+		{"ok", args{&Config{CaURL: "caURL", ClusterDomain: "clusterDomain"}, "podName", "commonName", "namespace"}, corev1.Container{
+			Env: []corev1.EnvVar{
+				{Name: "STEP_CA_URL", Value: "caURL"},
+				{Name: "COMMON_NAME", Value: "commonName"},
+				{Name: "POD_NAME", Value: "podName"},
+				{Name: "NAMESPACE", Value: "namespace"},
+				{Name: "CLUSTER_DOMAIN", Value: "clusterDomain"},
+				{Name: "AUTOCERT_FREEZE_URL", Value: Config{}.GetFreezeURL()},
+				{Name: "AUTOCERT_STATUS_URL", Value: Config{}.GetStatusURL()},
+				{Name: "READY_FILE", Value: "ready"},
+				{Name: "AUTOCERT_REISSUE_URL", Value: Config{}.GetReissueURL()},
+				{Name: "AUTOCERT_PROTOCOL", Value: "25"},
+			},
+		}},
+		{"protocol version 1", args{&Config{CaURL: "caURL", ClusterDomain: "clusterDomain", ProtocolVersion: 1}, "podName", "commonName", "namespace"}, corev1.Container{
+			Env: []corev1.EnvVar{
+				{Name: "STEP_CA_URL", Value: "caURL"},
+				{Name: "COMMON_NAME", Value: "commonName"},
+				{Name: "POD_NAME", Value: "podName"},
+				{Name: "NAMESPACE", Value: "namespace"},
+				{Name: "CLUSTER_DOMAIN", Value: "clusterDomain"},
+			},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mkRenewer(tt.args.config, tt.args.podName, tt.args.commonName, tt.args.namespace); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mkRenewer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkloadIdentity(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         *Config
+		namespace      string
+		serviceAccount string
+		want           string
+	}{
+		{"no trust domain", &Config{ClusterName: "us-east-1"}, "default", "app", ""},
+		{"trust domain", &Config{TrustDomain: "example.com"}, "default", "app", "spiffe://example.com/ns/default/sa/app"},
+		{"default service account", &Config{TrustDomain: "example.com"}, "default", "", "spiffe://example.com/ns/default/sa/default"},
+		{"cluster name", &Config{TrustDomain: "example.com", ClusterName: "us-east-1"}, "payments", "api", "spiffe://example.com/cluster/us-east-1/ns/payments/sa/api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := workloadIdentity(tt.config, tt.namespace, tt.serviceAccount); got != tt.want {
+				t.Errorf("workloadIdentity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodIdentity(t *testing.T) {
+	spiffeID := func(id string) map[string]string {
+		return map[string]string{spiffeIDAnnotationKey: id}
+	}
+	tests := []struct {
+		name        string
+		config      *Config
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{"workload identity", &Config{TrustDomain: "example.com"}, nil, "spiffe://example.com/ns/default/sa/app", false},
+		{"none", &Config{}, nil, "", false},
+		{"annotation", &Config{TrustDomain: "example.com"}, spiffeID("spiffe://example.com/ns/default/workload/api"), "spiffe://example.com/ns/default/workload/api", false},
+		{"annotation without trust domain", &Config{}, spiffeID("spiffe://other.org/ns/default/sa/app"), "spiffe://other.org/ns/default/sa/app", false},
+		{"annotation with cluster name", &Config{TrustDomain: "example.com", ClusterName: "us-east-1"}, spiffeID("spiffe://example.com/cluster/us-east-1/ns/default/sa/api"), "spiffe://example.com/cluster/us-east-1/ns/default/sa/api", false},
+		{"other trust domain", &Config{TrustDomain: "example.com"}, spiffeID("spiffe://other.org/ns/default/sa/app"), "", true},
+		{"other namespace", &Config{TrustDomain: "example.com"}, spiffeID("spiffe://example.com/ns/kube-system/sa/app"), "", true},
+		{"other cluster", &Config{TrustDomain: "example.com", ClusterName: "us-east-1"}, spiffeID("spiffe://example.com/cluster/eu-west-1/ns/default/sa/app"), "", true},
+		{"namespace prefix", &Config{}, spiffeID("spiffe://example.com/ns/defaults/sa/app"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := podIdentity(tt.config, "default", "app", tt.annotations)
+			var aerrs annotationErrors
+			if (err != nil) != tt.wantErr || (err != nil && !errors.As(err, &aerrs)) {
+				t.Fatalf("podIdentity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("podIdentity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSPIFFEID(t *testing.T) {
+	tests := []struct {
+		id string
+		ok bool
+	}{
+		{"spiffe://example.com/ns/default/sa/app", true},
+		{"spiffe://example.com/workload", true},
+		{"https://example.com/ns/default/sa/app", false},
+		{"spiffe:example.com/ns/default", false},
+		{"spiffe:///ns/default", false},
+		{"spiffe://Example.com/ns/default", false},
+		{"spiffe://example.com:8443/ns/default", false},
+		{"spiffe://user@example.com/ns/default", false},
+		{"spiffe://example.com", false},
+		{"spiffe://example.com/", false},
+		{"spiffe://example.com/ns/default/", false},
+		{"spiffe://example.com/ns//default", false},
+		{"spiffe://example.com/ns/../kube-system", false},
+		{"spiffe://example.com/ns/default?x=1", false},
+		{"spiffe://example.com/ns/default#x", false},
+	}
+	for _, tt := range tests {
+		if reason := checkSPIFFEID(tt.id); (reason == "") != tt.ok {
+			t.Errorf("checkSPIFFEID(%q) = %q, want ok %v", tt.id, reason, tt.ok)
+		}
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	env := []corev1.EnvVar{
+		{Name: "LOG_FORMAT", Value: "json"},
+		{Name: "STEP_CA_URL", Value: "template"},
+	}
+	got := setEnv(env,
+		corev1.EnvVar{Name: "STEP_CA_URL", Value: "caURL"},
+		corev1.EnvVar{Name: "COMMON_NAME", Value: "commonName"},
+	)
+	want := []corev1.EnvVar{
+		{Name: "LOG_FORMAT", Value: "json"},
+		{Name: "STEP_CA_URL", Value: "caURL"},
+		{Name: "COMMON_NAME", Value: "commonName"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("setEnv() = %v, want %v", got, want)
+	}
+	if env[1].Value != "template" {
+		t.Errorf("setEnv() modified the original slice")
+	}
+}
+
+func TestAddAnnotationsOrder(t *testing.T) {
+	existing := map[string]string{"b": "1"}
+	nu := map[string]string{"d": "4", "a": "1", "c": "3", "b": "2"}
+	for i := 0; i < 10; i++ {
+		ops := addAnnotations(existing, nu)
+		var paths []string
+		for _, op := range ops {
+			paths = append(paths, op.Op+" "+op.Path)
+		}
+		want := []string{
+			"add /metadata/annotations/a",
+			"replace /metadata/annotations/b",
+			"add /metadata/annotations/c",
+			"add /metadata/annotations/d",
+		}
+		if !reflect.DeepEqual(paths, want) {
+			t.Fatalf("addAnnotations() = %v, want %v", paths, want)
+		}
+	}
+}
+
+func TestValidateProtocolVersion(t *testing.T) {
+	for _, v := range []int{0, minProtocolVersion, protocolVersion} {
+		if err := validateProtocolVersion(v); err != nil {
+			t.Errorf("validateProtocolVersion(%d) error = %v", v, err)
+		}
+	}
+	for _, v := range []int{-1, protocolVersion + 1} {
+		if err := validateProtocolVersion(v); err == nil {
+			t.Errorf("validateProtocolVersion(%d) should fail", v)
+		}
+	}
+}
+
+func TestMutateShadowMode(t *testing.T) {
+	review := func(pod *corev1.Pod) *v1beta1.AdmissionReview {
+		raw, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &v1beta1.AdmissionReview{
+			Request: &v1beta1.AdmissionRequest{
+				UID:       "uid",
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		}
+	}
+
+	config := &Config{ShadowMode: true, RestrictCertificatesToNamespace: true}
+	testCases := []struct {
+		description string
+		pod         *corev1.Pod
+	}{
+		{"would inject", &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{admissionWebhookAnnotationKey: "test.default.svc"},
+		}}},
+		{"would deny namespace", &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{admissionWebhookAnnotationKey: "test.kube-system.svc"},
+		}}},
+		{"would deny host network", &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{admissionWebhookAnnotationKey: "test.default.svc"},
+			},
+			Spec: corev1.PodSpec{HostNetwork: true},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			resp := mutate(context.Background(), review(tc.pod), config, nil)
+			if !resp.Allowed || resp.Patch != nil || resp.UID != "uid" {
+				t.Errorf("mutate() in shadow mode = %+v, want allowed without patch", resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/cli-utils/token"
+	"github.com/smallstep/cli-utils/token/provision"
+	"go.step.sm/crypto/jose"
+	"go.step.sm/crypto/randutil"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// tokenBindingAudience is the audience of the service account tokens
+	// bootstrappers present to get a bound token.
+	tokenBindingAudience = "autocert.step.sm"
+	// tokenBindingEnvVar is the path of the service account token of the
+	// bootstrapper, set when tokens are bound to pods.
+	tokenBindingEnvVar = "AUTOCERT_BIND_TOKEN"
+	// podUIDEnvVar is the UID of the pod, checked by the bootstrapper
+	// against the UID in its bound token.
+	podUIDEnvVar          = "POD_UID"
+	tokenBindingVolume    = "autocert-token"
+	tokenBindingMountPath = "/var/run/secrets/autocert.step.sm"
+	tokenBindingLifetime  = 10 * time.Minute
+	// Extra fields of the users of bound service account tokens.
+	podNameExtraKey  = "authentication.kubernetes.io/pod-name"
+	podUIDExtraKey   = "authentication.kubernetes.io/pod-uid"
+	nodeNameExtraKey = "authentication.kubernetes.io/node-name"
+)
+
+// boundPod identifies the pod a bootstrap token is bound to. It's added to
+// the token in the autocert claim.
+type boundPod struct {
+	UID      string `json:"podUID"`
+	Name     string `json:"podName"`
+	NodeName string `json:"nodeName,omitempty"`
+}
+
+// bindingError is returned when a pod may not redeem a claim.
+type bindingError struct {
+	reason string
+}
+
+func (e *bindingError) Error() string {
+	return e.reason
+}
+
+// tokenBinder binds bootstrap tokens to the pods redeeming them. Pods prove
+// who they are with a service account token, reviewed by the API server, and
+// send their certificate request, whose fingerprint is added to the token in
+// the cnf claim: the CA rejects the token with any other request, so a
+// leaked token can't be redeemed by another pod.
+type tokenBinder struct {
+	review func(token string) (*authenticationv1.UserInfo, error)
+	sign   func(p pendingIssuance, csr *x509.CertificateRequest, pod boundPod) (string, error)
+}
+
+// tokenBinding binds the tokens of the pending issuances created with
+// tokenBinding enabled. Its signer is set on startup.
+var tokenBinding = &tokenBinder{review: reviewPodToken}
+
+// token returns a token for a pending issuance bound to the pod making the
+// request.
+func (b *tokenBinder) token(r *http.Request, req tokenRequest, p pendingIssuance) (string, boundPod, error) {
+	pod, err := b.identify(r, p)
+	if err != nil {
+		return "", pod, err
+	}
+
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", pod, &bindingError{"missing certificate request"}
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", pod, &bindingError{"invalid certificate request"}
+	}
+	if err := checkCSR(csr, p); err != nil {
+		return "", pod, &bindingError{err.Error()}
+	}
+	if b.sign == nil {
+		return "", pod, errors.New("token binding is not configured")
+	}
+	tok, err := b.sign(p, csr, pod)
+	return tok, pod, err
+}
+
+// identify returns the pod making the request, authenticated by its service
+// account token, if it's the pod of the pending issuance.
+func (b *tokenBinder) identify(r *http.Request, p pendingIssuance) (boundPod, error) {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || bearer == "" {
+		return boundPod{}, &bindingError{"missing service account token"}
+	}
+	user, err := b.review(bearer)
+	if err != nil {
+		return boundPod{}, errors.Wrap(err, "review service account token")
+	}
+	return p.bind(user)
+}
+
+// bind returns the pod of an authenticated service account user, if it's the
+// pod of the pending issuance.
+func (p pendingIssuance) bind(user *authenticationv1.UserInfo) (boundPod, error) {
+	if user == nil {
+		return boundPod{}, &bindingError{"invalid service account token"}
+	}
+	if want := "system:serviceaccount:" + p.Namespace + ":" + p.ServiceAccount; user.Username != want {
+		return boundPod{}, &bindingError{fmt.Sprintf("service account %s does not match %s", user.Username, want)}
+	}
+	pod := boundPod{
+		Name:     extraValue(user.Extra[podNameExtraKey]),
+		UID:      extraValue(user.Extra[podUIDExtraKey]),
+		NodeName: extraValue(user.Extra[nodeNameExtraKey]),
+	}
+	if pod.Name == "" || pod.UID == "" {
+		return boundPod{}, &bindingError{"service account token is not bound to a pod"}
+	}
+	if (p.PodName != "" && pod.Name != p.PodName) || (p.PodName == "" && !strings.HasPrefix(pod.Name, p.GenerateName)) {
+		return boundPod{}, &bindingError{fmt.Sprintf("pod %s did not request this certificate", pod.Name)}
+	}
+	return pod, nil
+}
+
+func extraValue(values authenticationv1.ExtraValue) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// reviewPodToken authenticates a service account token with a TokenReview
+// for the token binding audience. It returns nil if the token is not valid.
+func reviewPodToken(bearer string) (*authenticationv1.UserInfo, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	var tr authenticationv1.TokenReview
+	if err := createReview(client, tokenReviewAPIPath, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     bearer,
+			Audiences: []string{tokenBindingAudience},
+		},
+	}, &tr); err != nil {
+		return nil, errors.Wrap(err, "create token review")
+	}
+	if !tr.Status.Authenticated || !slices.Contains(tr.Status.Audiences, tokenBindingAudience) {
+		return nil, nil
+	}
+	return &tr.Status.User, nil
+}
+
+// tokenSigner signs bootstrap tokens with claims the provisioner can't set.
+type tokenSigner struct {
+	provisioner *ca.Provisioner
+	key         *jose.JSONWebKey
+}
+
+// newTokenSigner decrypts the key of the provisioner to sign bound tokens.
+func newTokenSigner(client *ca.Client, provisioner *ca.Provisioner, password []byte) (*tokenSigner, error) {
+	resp, err := client.ProvisionerKey(provisioner.Kid())
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting the provisioner key")
+	}
+	enc, err := jose.ParseEncrypted(resp.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing the provisioner key")
+	}
+	data, err := enc.Decrypt(password)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decrypting the provisioner key")
+	}
+	key := new(jose.JSONWebKey)
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, errors.Wrap(err, "error parsing the provisioner key")
+	}
+	return &tokenSigner{provisioner: provisioner, key: key}, nil
+}
+
+// sign returns a bootstrap token for a pending issuance that the CA only
+// accepts with the given certificate request.
+func (s *tokenSigner) sign(p pendingIssuance, csr *x509.CertificateRequest, pod boundPod) (string, error) {
+	jwtID, err := randutil.Hex(64)
+	if err != nil {
+		return "", err
+	}
+	sans := p.SANs
+	if len(sans) == 0 {
+		sans = []string{p.CommonName}
+	}
+	sum := sha256.Sum256(csr.Raw)
+	now := time.Now()
+	tok, err := provision.New(p.CommonName,
+		token.WithJWTID(jwtID),
+		token.WithKid(s.provisioner.Kid()),
+		token.WithIssuer(s.provisioner.Name()),
+		token.WithAudience(s.provisioner.Audience()),
+		token.WithValidity(now, now.Add(tokenLifetime)),
+		token.WithSANS(sans),
+		token.WithSHA(s.provisioner.Fingerprint()),
+		token.WithClaim("cnf", map[string]string{"x5rt#S256": base64.RawURLEncoding.EncodeToString(sum[:])}),
+		token.WithClaim("autocert", pod),
+	)
+	if err != nil {
+		return "", err
+	}
+	return tok.SignedString(s.key.Algorithm, s.key.Key)
+}
+
+// validateTokenBinding returns an error if token binding is enabled with a
+// protocol version that doesn't support it.
+func validateTokenBinding(c *Config) error {
+	if v := envProtocolVersions[tokenBindingEnvVar]; c.TokenBinding && c.GetProtocolVersion() < v {
+		return fmt.Errorf("tokenBinding requires protocolVersion %d or later", v)
+	}
+	return nil
+}
+
+// mkBoundBootstrapper generates a bootstrap container that exchanges a claim
+// for a token bound to its pod. The claim records the pod that may redeem
+// it.
+func mkBoundBootstrapper(ctx context.Context, config *Config, pod *corev1.Pod, commonName, duration, owner, mode, umask, namespace string, readOnly bool, sans []string, provisioner TokenManager) (corev1.Container, error) {
+	claim, err := pendingIssuances.add(pendingIssuance{
+		CommonName:     commonName,
+		SANs:           sans,
+		Namespace:      namespace,
+		Duration:       duration,
+		Bound:          true,
+		ServiceAccount: podServiceAccount(pod),
+		PodName:        pod.GetName(),
+		GenerateName:   pod.GetGenerateName(),
+	})
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	name := pod.GetName()
+	if name == "" {
+		name = pod.GetGenerateName()
+	}
+	b, err := mkBootstrapper(ctx, config, name, commonName, duration, owner, mode, umask, namespace, "", claim, readOnly, sans, provisioner)
+	if err != nil {
+		return b, err
+	}
+	b.Env = setEnv(b.Env,
+		corev1.EnvVar{
+			Name:  tokenBindingEnvVar,
+			Value: tokenBindingMountPath + "/token",
+		},
+		corev1.EnvVar{
+			Name: podUIDEnvVar,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.uid"},
+			},
+		},
+		corev1.EnvVar{
+			Name:  "AUTOCERT_SANS",
+			Value: strings.Join(sans, ","),
+		})
+	mountTokenBinding(&b)
+	return b, nil
+}
+
+// podServiceAccount returns the name of the service account of a pod.
+func podServiceAccount(pod *corev1.Pod) string {
+	if pod.Spec.ServiceAccountName == "" {
+		return "default"
+	}
+	return pod.Spec.ServiceAccountName
+}
+
+// mountTokenBinding mounts the projected service account token of the pod in
+// a container, unless it's already mounted.
+func mountTokenBinding(c *corev1.Container) {
+	if slices.ContainsFunc(c.VolumeMounts, func(m corev1.VolumeMount) bool { return m.Name == tokenBindingVolume }) {
+		return
+	}
+	c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+		Name:      tokenBindingVolume,
+		MountPath: tokenBindingMountPath,
+		ReadOnly:  true,
+	})
+}
+
+// tokenBindingVolumeSource returns the volume projecting the service account
+// token bootstrappers present to get a bound token.
+func tokenBindingVolumeSource() corev1.Volume {
+	return corev1.Volume{
+		Name: tokenBindingVolume,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{{
+					ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+						Audience:          tokenBindingAudience,
+						ExpirationSeconds: ptr.To(int64(tokenBindingLifetime.Seconds())),
+						Path:              "token",
+					},
+				}},
+			},
+		},
+	}
+}
+
+// logBindingDenied logs a denied claim redemption as an audit event.
+func logBindingDenied(p pendingIssuance, err error) {
+	log.WithFields(log.Fields{
+		"audit":      true,
+		"commonName": p.CommonName,
+		"namespace":  p.Namespace,
+		"error":      err,
+	}).Warn("Denied claim request")
+}
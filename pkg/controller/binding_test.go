@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+func boundUser(serviceAccount, podName, podUID string) *authenticationv1.UserInfo {
+	return &authenticationv1.UserInfo{
+		Username: "system:serviceaccount:default:" + serviceAccount,
+		Extra: map[string]authenticationv1.ExtraValue{
+			podNameExtraKey:  {podName},
+			podUIDExtraKey:   {podUID},
+			nodeNameExtraKey: {"node-1"},
+		},
+	}
+}
+
+func TestPendingIssuanceBind(t *testing.T) {
+	named := pendingIssuance{Namespace: "default", ServiceAccount: "api", PodName: "api-0"}
+	generated := pendingIssuance{Namespace: "default", ServiceAccount: "api", GenerateName: "api-7d9f-"}
+	tests := []struct {
+		name    string
+		p       pendingIssuance
+		user    *authenticationv1.UserInfo
+		want    boundPod
+		wantErr bool
+	}{
+		{"named pod", named, boundUser("api", "api-0", "uid-1"), boundPod{UID: "uid-1", Name: "api-0", NodeName: "node-1"}, false},
+		{"generated name", generated, boundUser("api", "api-7d9f-x2k4q", "uid-2"), boundPod{UID: "uid-2", Name: "api-7d9f-x2k4q", NodeName: "node-1"}, false},
+		{"other pod", named, boundUser("api", "api-1", "uid-1"), boundPod{}, true},
+		{"other generated name", generated, boundUser("api", "web-7d9f-x2k4q", "uid-2"), boundPod{}, true},
+		{"other service account", named, boundUser("web", "api-0", "uid-1"), boundPod{}, true},
+		{"unbound token", named, boundUser("api", "api-0", ""), boundPod{}, true},
+		{"invalid token", named, nil, boundPod{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.p.bind(tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bind() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("bind() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenBinderToken(t *testing.T) {
+	p := pendingIssuance{
+		CommonName:     "api.default.svc",
+		SANs:           []string{"api.default.svc"},
+		Namespace:      "default",
+		Bound:          true,
+		ServiceAccount: "api",
+		PodName:        "api-0",
+	}
+	csrPEM := func(csr *x509.CertificateRequest) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+	}
+	ok := csrPEM(newTestCSR(t, "api.default.svc", []string{"api.default.svc"}, nil))
+	other := csrPEM(newTestCSR(t, "web.default.svc", []string{"web.default.svc"}, nil))
+
+	b := &tokenBinder{
+		review: func(token string) (*authenticationv1.UserInfo, error) {
+			switch token {
+			case "api-0":
+				return boundUser("api", "api-0", "uid-1"), nil
+			case "api-1":
+				return boundUser("api", "api-1", "uid-2"), nil
+			case "error":
+				return nil, errors.New("connection refused")
+			}
+			return nil, nil
+		},
+		sign: func(p pendingIssuance, csr *x509.CertificateRequest, pod boundPod) (string, error) {
+			return csr.Subject.CommonName + "/" + pod.UID, nil
+		},
+	}
+	tests := []struct {
+		name        string
+		bearer      string
+		csr         string
+		want        string
+		wantBinding bool
+		wantErr     bool
+	}{
+		{"ok", "api-0", ok, "api.default.svc/uid-1", false, false},
+		{"missing token", "", ok, "", true, true},
+		{"invalid token", "forged", ok, "", true, true},
+		{"other pod", "api-1", ok, "", true, true},
+		{"missing request", "api-0", "", "", true, true},
+		{"other request", "api-0", other, "", true, true},
+		{"review error", "error", ok, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/token", nil)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			got, _, err := b.token(r, tokenRequest{Claim: "claim", CSR: tt.csr}, p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("token() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var berr *bindingError
+			if errors.As(err, &berr) != tt.wantBinding {
+				t.Errorf("token() error = %v, want a binding error %v", err, tt.wantBinding)
+			}
+			if got != tt.want {
+				t.Errorf("token() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenHandlerBound(t *testing.T) {
+	defer func(s *issuanceStore, b *tokenBinder) {
+		pendingIssuances, tokenBinding = s, b
+	}(pendingIssuances, tokenBinding)
+	pendingIssuances = newIssuanceStore()
+	tokenBinding = &tokenBinder{
+		review: func(token string) (*authenticationv1.UserInfo, error) {
+			return boundUser("api", token, "uid-1"), nil
+		},
+		sign: func(pendingIssuance, *x509.CertificateRequest, boundPod) (string, error) {
+			return "bound-token", nil
+		},
+	}
+	claim, err := pendingIssuances.add(pendingIssuance{
+		CommonName:     "api.default.svc",
+		Namespace:      "default",
+		Bound:          true,
+		ServiceAccount: "api",
+		PodName:        "api-0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: newTestCSR(t, "api.default.svc", nil, nil).Raw,
+	}))
+
+	request := func(pod string) *httptest.ResponseRecorder {
+		body := `{"claim":"` + claim + `","csr":` + strconv.Quote(csr) + `}`
+		r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+pod)
+		w := httptest.NewRecorder()
+		tokenHandler(w, r, &Config{}, nil)
+		return w
+	}
+
+	// Another pod presenting the claim is denied without burning it.
+	if w := request("api-1"); w.Code != http.StatusForbidden {
+		t.Errorf("tokenHandler() from another pod = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := request("api-0"); w.Code != http.StatusOK || w.Body.String() != "bound-token" {
+		t.Errorf("tokenHandler() = %d %q, want the bound token", w.Code, w.Body.String())
+	}
+	if w := request("api-0"); w.Code != http.StatusForbidden {
+		t.Errorf("tokenHandler() with a redeemed claim = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
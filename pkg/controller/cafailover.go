@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// caFailoverEnvVar is the comma-separated list of the URLs of the passive
+// CAs, used by the bootstrapper and the renewer while the CA at STEP_CA_URL
+// is not healthy.
+const caFailoverEnvVar = "STEP_CA_FAILOVER_URLS"
+
+// validateCAFailover returns an error if the failover URLs are not valid, or
+// not supported by the protocol version in use.
+func validateCAFailover(c *Config) error {
+	if len(c.CAFailoverURLs) == 0 {
+		return nil
+	}
+	if c.CAService.Name != "" {
+		return fmt.Errorf("caFailoverURLs can't be set with caService, use caService.fallbackURLs")
+	}
+	if v := envProtocolVersions[caFailoverEnvVar]; c.GetProtocolVersion() < v {
+		return fmt.Errorf("caFailoverURLs requires protocolVersion %d or later", v)
+	}
+	for _, u := range c.CAFailoverURLs {
+		if p, err := url.Parse(u); err != nil || p.Scheme != "https" || p.Host == "" || strings.Contains(u, ",") {
+			return fmt.Errorf("caFailoverURLs %q must be an https URL", u)
+		}
+	}
+	return nil
+}
+
+// setCAFailover configures the injected containers to fail over to the
+// passive CAs.
+func setCAFailover(config *Config, containers ...*corev1.Container) {
+	for _, c := range containers {
+		c.Env = setEnv(c.Env, corev1.EnvVar{
+			Name:  caFailoverEnvVar,
+			Value: strings.Join(config.CAFailoverURLs, ","),
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidateCAFailover(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"not set", Config{}, false},
+		{"ok", Config{CAFailoverURLs: []string{"https://ca-b.step.svc"}}, false},
+		{"http", Config{CAFailoverURLs: []string{"http://ca-b.step.svc"}}, true},
+		{"comma", Config{CAFailoverURLs: []string{"https://ca-b.step.svc,https://ca-c.step.svc"}}, true},
+		{"with caService", Config{CAFailoverURLs: []string{"https://ca-b.step.svc"}, CAService: CAService{Name: "ca", Namespace: "step"}}, true},
+		{"pinned protocol", Config{CAFailoverURLs: []string{"https://ca-b.step.svc"}, ProtocolVersion: 12}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateCAFailover(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateCAFailover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetCAFailover(t *testing.T) {
+	var b, r corev1.Container
+	setCAFailover(&Config{CAFailoverURLs: []string{"https://ca-b.step.svc", "https://ca-c.step.svc"}}, &b, &r)
+	want := corev1.EnvVar{Name: caFailoverEnvVar, Value: "https://ca-b.step.svc,https://ca-c.step.svc"}
+	for _, c := range []corev1.Container{b, r} {
+		if len(c.Env) != 1 || c.Env[0] != want {
+			t.Errorf("setCAFailover() env = %v, want %v", c.Env, want)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+const (
+	// caServiceInterval is how often the endpoints of the CA service are
+	// health-checked.
+	caServiceInterval = 30 * time.Second
+	// caHealthTimeout bounds each health check.
+	caHealthTimeout = 5 * time.Second
+	defaultCAPort   = 443
+)
+
+// CAService references the Service of the CA, used instead of a static
+// caUrl. The controller health-checks the endpoints of the service, and
+// injects the first fallback URL that is healthy while none of them is, for
+// instance the CA of another region.
+type CAService struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+	// Port is the port of the service, defaults to 443.
+	Port         int      `yaml:"port"`
+	FallbackURLs []string `yaml:"fallbackURLs"`
+}
+
+// GetPort returns the port of the CA service, defaults to 443.
+func (s CAService) GetPort() int {
+	if s.Port == 0 {
+		return defaultCAPort
+	}
+	return s.Port
+}
+
+// host returns the DNS name of the CA service.
+func (s CAService) host(clusterDomain string) string {
+	return fmt.Sprintf("%s.%s.svc.%s", s.Name, s.Namespace, clusterDomain)
+}
+
+// url returns the URL of the CA through its service.
+func (s CAService) url(clusterDomain string) string {
+	if s.GetPort() == defaultCAPort {
+		return "https://" + s.host(clusterDomain)
+	}
+	return "https://" + net.JoinHostPort(s.host(clusterDomain), strconv.Itoa(s.GetPort()))
+}
+
+// GetCaURL returns the URL of the CA injected in the pods and used by the
+// controller: caUrl, or the URL currently selected for caService.
+func (c Config) GetCaURL() string {
+	if c.CAService.Name == "" {
+		return c.CaURL
+	}
+	return caEndpoint.get(c.CAService.url(c.GetClusterDomain()))
+}
+
+// validateCAService returns an error if the CA service is not valid, or set
+// along with caUrl.
+func validateCAService(c *Config) error {
+	s := c.CAService
+	if s.Name == "" {
+		return nil
+	}
+	switch {
+	case c.CaURL != "":
+		return fmt.Errorf("caUrl and caService can't be set at the same time")
+	case s.Namespace == "":
+		return fmt.Errorf("caService.namespace is required")
+	case s.Port < 0 || s.Port > 65535:
+		return fmt.Errorf("caService.port %d is not valid", s.Port)
+	}
+	for _, u := range s.FallbackURLs {
+		if p, err := url.Parse(u); err != nil || p.Scheme != "https" || p.Host == "" {
+			return fmt.Errorf("caService.fallbackURLs %q must be an https URL", u)
+		}
+	}
+	return nil
+}
+
+// caEndpointsHealthy is the number of healthy endpoints of the CA service.
+var caEndpointsHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "autocert_ca_endpoints_healthy",
+	Help: "Number of endpoints of the CA service passing health checks.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(caEndpointsHealthy)
+}
+
+// caEndpoint selects the URL of the CA when caService is set.
+var caEndpoint = &caResolver{
+	endpoints: listCAEndpoints,
+}
+
+// caResolver health-checks the endpoints of the CA service, and the fallback
+// URLs when none of them is healthy.
+type caResolver struct {
+	sync.Mutex
+	selected string
+	// endpoints returns the addresses, host:port, of the ready endpoints of
+	// the service.
+	endpoints func(s CAService) ([]string, error)
+	// check returns an error if the CA at baseURL is not healthy. The TLS
+	// server name is the host of baseURL unless serverName is set.
+	check func(ctx context.Context, baseURL, serverName string) error
+}
+
+// get returns the selected URL, or the URL of the service before the first
+// resolution.
+func (r *caResolver) get(serviceURL string) string {
+	r.Lock()
+	defer r.Unlock()
+	if r.selected == "" {
+		return serviceURL
+	}
+	return r.selected
+}
+
+// start sets the health check with the roots of the CA, selects the URL of
+// the CA, and keeps it up to date until the context is canceled.
+func (r *caResolver) start(ctx context.Context, config *Config) error {
+	roots, err := loadRoots(config.GetRootCAPath())
+	if err != nil {
+		return err
+	}
+	r.check = newCAHealthCheck(roots)
+	r.resolve(ctx, config)
+
+	go func() {
+		ticker := time.NewTicker(caServiceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.resolve(ctx, config)
+			}
+		}
+	}()
+	return nil
+}
+
+// resolve selects the URL of the service if any of its endpoints is healthy,
+// or else the first healthy fallback URL. The service URL is kept if nothing
+// is healthy, so pods are injected with the address the CA is expected at.
+func (r *caResolver) resolve(ctx context.Context, config *Config) string {
+	s := config.CAService
+	clusterDomain := config.GetClusterDomain()
+	selected := s.url(clusterDomain)
+
+	addrs, err := r.endpoints(s)
+	if err != nil {
+		log.WithField("error", err).Warn("Error listing the endpoints of the CA service")
+	}
+	healthy := 0
+	for _, addr := range addrs {
+		if err := r.check(ctx, "https://"+addr, s.host(clusterDomain)); err != nil {
+			log.WithFields(log.Fields{
+				"endpoint": addr,
+				"error":    err,
+			}).Warn("CA endpoint is not healthy")
+			continue
+		}
+		healthy++
+	}
+	caEndpointsHealthy.Set(float64(healthy))
+
+	if healthy == 0 {
+		for _, u := range s.FallbackURLs {
+			if err := r.check(ctx, u, ""); err != nil {
+				log.WithFields(log.Fields{
+					"url":   u,
+					"error": err,
+				}).Warn("CA fallback is not healthy")
+				continue
+			}
+			selected = u
+			break
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if selected != r.selected {
+		log.WithFields(log.Fields{
+			"previous": r.selected,
+			"url":      selected,
+			"healthy":  healthy,
+		}).Info("Selected CA URL")
+		r.selected = selected
+	}
+	return selected
+}
+
+// loadRoots returns a pool with the root certificates in the given file.
+func loadRoots(filename string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(filename) //nolint:gosec // file path comes from trusted configuration
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading root certificate")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("%s does not contain a PEM certificate", filename)
+	}
+	return roots, nil
+}
+
+// newCAHealthCheck returns a check of the /health endpoint of the CA,
+// trusting the given roots.
+func newCAHealthCheck(roots *x509.CertPool) func(ctx context.Context, baseURL, serverName string) error {
+	return func(ctx context.Context, baseURL, serverName string) error {
+		ctx, cancel := context.WithTimeout(ctx, caHealthTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/health", http.NoBody)
+		if err != nil {
+			return err
+		}
+		tr := &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				RootCAs:    roots,
+				ServerName: serverName,
+			},
+		}
+		defer tr.CloseIdleConnections()
+
+		resp, err := (&http.Client{Transport: tr}).Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("health check: %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// listCAEndpoints returns the addresses of the ready endpoints of the CA
+// service, on the target port of the service port.
+func listCAEndpoints(s CAService) ([]string, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var svc corev1.Service
+	if err := getJSON(client, fmt.Sprintf("api/v1/namespaces/%s/services/%s", s.Namespace, s.Name), &svc); err != nil {
+		return nil, errors.Wrap(err, "get CA service")
+	}
+	portName, found := "", false
+	for _, p := range svc.Spec.Ports {
+		if int(p.Port) == s.GetPort() {
+			portName, found = p.Name, true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.Errorf("service %s/%s has no port %d", s.Namespace, s.Name, s.GetPort())
+	}
+
+	var list discoveryv1.EndpointSliceList
+	if err := getJSON(client, fmt.Sprintf("apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?labelSelector=%s", s.Namespace, url.QueryEscape(discoveryv1.LabelServiceName+"="+s.Name)), &list); err != nil {
+		return nil, errors.Wrap(err, "list CA endpoint slices")
+	}
+	return readyAddresses(list.Items, portName), nil
+}
+
+// readyAddresses returns the host:port addresses of the ready endpoints in the
+// given slices, on the port with the given name.
+func readyAddresses(items []discoveryv1.EndpointSlice, portName string) []string {
+	var addrs []string
+	for _, slice := range items {
+		port := 0
+		for _, p := range slice.Ports {
+			name := ""
+			if p.Name != nil {
+				name = *p.Name
+			}
+			if p.Port != nil && name == portName {
+				port = int(*p.Port)
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, e := range slice.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			for _, a := range e.Addresses {
+				addrs = append(addrs, net.JoinHostPort(a, strconv.Itoa(port)))
+			}
+		}
+	}
+	return addrs
+}
+
+// getJSON gets an object from the Kubernetes API and decodes it in out.
+func getJSON(client Client, path string, out any) error {
+	req, err := client.GetRequest(path)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestValidateCAService(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"not set", Config{CaURL: "https://ca.step.svc"}, false},
+		{"ok", Config{CAService: CAService{Name: "ca", Namespace: "step", FallbackURLs: []string{"https://ca.eu-west-1.example.com"}}}, false},
+		{"with caUrl", Config{CaURL: "https://ca.step.svc", CAService: CAService{Name: "ca", Namespace: "step"}}, true},
+		{"no namespace", Config{CAService: CAService{Name: "ca"}}, true},
+		{"bad port", Config{CAService: CAService{Name: "ca", Namespace: "step", Port: 70000}}, true},
+		{"http fallback", Config{CAService: CAService{Name: "ca", Namespace: "step", FallbackURLs: []string{"http://ca.example.com"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateCAService(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateCAService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadyAddresses(t *testing.T) {
+	items := []discoveryv1.EndpointSlice{{
+		Ports: []discoveryv1.EndpointPort{
+			{Name: ptr.To("metrics"), Port: ptr.To(int32(9000))},
+			{Name: ptr.To("https"), Port: ptr.To(int32(9443))},
+		},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(true)}},
+			{Addresses: []string{"10.0.0.2"}, Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(false)}},
+			{Addresses: []string{"fd00::3"}},
+		},
+	}}
+	want := []string{"10.0.0.1:9443", "[fd00::3]:9443"}
+	if got := readyAddresses(items, "https"); !slices.Equal(got, want) {
+		t.Errorf("readyAddresses() = %v, want %v", got, want)
+	}
+	if got := readyAddresses(items, "other"); len(got) != 0 {
+		t.Errorf("readyAddresses() with an unknown port = %v, want none", got)
+	}
+}
+
+func TestCAResolver(t *testing.T) {
+	config := &Config{CAService: CAService{
+		Name:         "step-certificates",
+		Namespace:    "step",
+		Port:         9000,
+		FallbackURLs: []string{"https://ca.us-east-1.example.com", "https://ca.eu-west-1.example.com"},
+	}}
+	const serviceURL = "https://step-certificates.step.svc.cluster.local:9000"
+
+	healthy := map[string]bool{}
+	r := &caResolver{
+		endpoints: func(CAService) ([]string, error) {
+			return []string{"10.0.0.1:9000", "10.0.0.2:9000"}, nil
+		},
+		check: func(_ context.Context, baseURL, serverName string) error {
+			if strings.HasPrefix(baseURL, "https://10.") && serverName != "step-certificates.step.svc.cluster.local" {
+				t.Errorf("check(%s) server name = %q", baseURL, serverName)
+			}
+			if !healthy[baseURL] {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+	}
+
+	if got := r.get(serviceURL); got != serviceURL {
+		t.Errorf("get() before resolving = %s, want %s", got, serviceURL)
+	}
+
+	healthy["https://10.0.0.2:9000"] = true
+	healthy["https://ca.eu-west-1.example.com"] = true
+	if got := r.resolve(context.Background(), config); got != serviceURL {
+		t.Errorf("resolve() with a healthy endpoint = %s, want %s", got, serviceURL)
+	}
+
+	// The first healthy fallback is used while no endpoint is healthy.
+	healthy["https://10.0.0.2:9000"] = false
+	if got := r.resolve(context.Background(), config); got != "https://ca.eu-west-1.example.com" {
+		t.Errorf("resolve() without a healthy endpoint = %s, want the healthy fallback", got)
+	}
+	if got := r.get(serviceURL); got != "https://ca.eu-west-1.example.com" {
+		t.Errorf("get() = %s, want the healthy fallback", got)
+	}
+
+	// The service is kept when nothing is healthy.
+	healthy["https://ca.eu-west-1.example.com"] = false
+	if got := r.resolve(context.Background(), config); got != serviceURL {
+		t.Errorf("resolve() with nothing healthy = %s, want %s", got, serviceURL)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package controller
 
 import (
 	"crypto/tls"
@@ -22,6 +22,7 @@ type Client interface {
 	Do(req *http.Request) (*http.Response, error)
 	GetRequest(url string) (*http.Request, error)
 	PostRequest(url, body, contentType string) (*http.Request, error)
+	PutRequest(url, body, contentType string) (*http.Request, error)
 	DeleteRequest(url string) (*http.Request, error)
 	Host() string
 }
@@ -63,6 +64,23 @@ func (kc *k8sClient) PostRequest(url, body, contentType string) (*http.Request,
 	return req, nil
 }
 
+func (kc *k8sClient) PutRequest(url, body, contentType string) (*http.Request, error) {
+	if !strings.HasPrefix(url, kc.host) {
+		url = fmt.Sprintf("%s/%s", kc.host, url)
+	}
+	req, err := http.NewRequest("PUT", url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if kc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+kc.token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
 func (kc *k8sClient) DeleteRequest(url string) (*http.Request, error) {
 	if !strings.HasPrefix(url, kc.host) {
 		url = fmt.Sprintf("%s/%s", kc.host, url)
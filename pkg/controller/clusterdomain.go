@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Placeholders expanded in the name and sans annotations, so manifests work
+// in clusters with any domain.
+const (
+	clusterDomainPlaceholder = "$(CLUSTER_DOMAIN)"
+	namespacePlaceholder     = "$(NAMESPACE)"
+)
+
+// validateClusterDomain returns an error if the clusterDomain in the
+// configuration is not a valid domain.
+func validateClusterDomain(c *Config) error {
+	if c.ClusterDomain == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Subdomain(c.ClusterDomain); len(errs) > 0 {
+		return fmt.Errorf("clusterDomain %q is not valid: %s", c.ClusterDomain, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// expandNames replaces the placeholders in the name and sans annotations of
+// a pod with the cluster domain and the namespace of the pod. The pod is
+// only changed in memory, the placeholders are kept in the stored pod.
+func expandNames(pod *corev1.Pod, namespace string, config *Config) {
+	r := strings.NewReplacer(
+		clusterDomainPlaceholder, config.GetClusterDomain(),
+		namespacePlaceholder, namespace,
+	)
+	annotations := pod.GetAnnotations()
+	for _, key := range []string{admissionWebhookAnnotationKey, sansAnnotationKey} {
+		if v, ok := annotations[key]; ok && strings.Contains(v, "$(") {
+			annotations = maps.Clone(annotations)
+			annotations[key] = r.Replace(v)
+		}
+	}
+	pod.SetAnnotations(annotations)
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateClusterDomain(t *testing.T) {
+	tests := []struct {
+		domain  string
+		wantErr bool
+	}{
+		{"", false},
+		{"cluster.local", false},
+		{"prod.example.internal", false},
+		{".cluster.local", true},
+		{"cluster.local.", true},
+		{"Cluster.Local", true},
+		{"cluster local", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			if err := validateClusterDomain(&Config{ClusterDomain: tt.domain}); (err != nil) != tt.wantErr {
+				t.Errorf("validateClusterDomain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpandNames(t *testing.T) {
+	annotations := map[string]string{
+		admissionWebhookAnnotationKey: "api.$(NAMESPACE).svc.$(CLUSTER_DOMAIN)",
+		sansAnnotationKey:             "api,api.$(NAMESPACE).svc,api.$(NAMESPACE).svc.$(CLUSTER_DOMAIN)",
+		ownerAnnotationKey:            "$(NAMESPACE)",
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+
+	expandNames(pod, "payments", &Config{ClusterDomain: "prod.internal"})
+	got := pod.GetAnnotations()
+	if want := "api.payments.svc.prod.internal"; got[admissionWebhookAnnotationKey] != want {
+		t.Errorf("expandNames() name = %q, want %q", got[admissionWebhookAnnotationKey], want)
+	}
+	if want := "api,api.payments.svc,api.payments.svc.prod.internal"; got[sansAnnotationKey] != want {
+		t.Errorf("expandNames() sans = %q, want %q", got[sansAnnotationKey], want)
+	}
+	if got[ownerAnnotationKey] != "$(NAMESPACE)" {
+		t.Errorf("expandNames() expanded the owner annotation: %q", got[ownerAnnotationKey])
+	}
+	if annotations[admissionWebhookAnnotationKey] != "api.$(NAMESPACE).svc.$(CLUSTER_DOMAIN)" {
+		t.Error("expandNames() changed the annotations of the original pod")
+	}
+
+	// The cluster domain defaults to cluster.local.
+	pod = &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		admissionWebhookAnnotationKey: "api.default.svc.$(CLUSTER_DOMAIN)",
+	}}}
+	expandNames(pod, "default", &Config{})
+	if got := pod.GetAnnotations()[admissionWebhookAnnotationKey]; got != "api.default.svc.cluster.local" {
+		t.Errorf("expandNames() name = %q, want the default cluster domain", got)
+	}
+}
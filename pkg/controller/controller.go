@@ -0,0 +1,612 @@
+// Package controller implements the autocert admission controller. It's run
+// by the autocert binary, and can be embedded in other operators:
+//
+//	config, err := controller.LoadConfig("/home/step/autocert/config.yaml")
+//	if err != nil {
+//		return err
+//	}
+//	return controller.New(config).Start(ctx)
+//
+// The controller keeps its pending issuances, stats and metrics in package
+// state, so only one controller can run per process.
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/caclient"
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/cli-utils/step"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// shutdownTimeout bounds the time spent draining requests when the context
+// given to Start is canceled.
+const shutdownTimeout = 10 * time.Second
+
+// TokenManager generates the bootstrap tokens of the pods. The controller
+// uses the JWK provisioner in its configuration by default, a
+// *ca.Provisioner.
+type TokenManager interface {
+	Token(subject string, sans ...string) (string, error)
+}
+
+// ContextTokenManager is a TokenManager able to stop generating a token when
+// its context is done, like a manager calling a remote service. The controller
+// gives it the context of the request the token is generated for, canceled
+// when the API server stops waiting for an admission review.
+type ContextTokenManager interface {
+	TokenManager
+	TokenWithContext(ctx context.Context, subject string, sans ...string) (string, error)
+}
+
+// mintToken generates a token with the given manager, unless ctx is done.
+func mintToken(ctx context.Context, m TokenManager, subject string, sans ...string) (string, error) {
+	if cm, ok := m.(ContextTokenManager); ok {
+		return cm.TokenWithContext(ctx, subject, sans...)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return m.Token(subject, sans...)
+}
+
+// SecretManager stores the bootstrap tokens of the pods in Secrets. The
+// controller uses the Kubernetes API by default.
+type SecretManager interface {
+	// CreateSecret creates the given secret and returns its name.
+	CreateSecret(secret *corev1.Secret) (string, error)
+	// DeleteSecret deletes a secret once its token expired.
+	DeleteSecret(namespace, name string) error
+}
+
+// tokenSecrets stores the bootstrap tokens, replaced by WithSecretManager.
+var tokenSecrets SecretManager = apiSecretManager{}
+
+// Controller is the autocert admission controller.
+type Controller struct {
+	config   *Config
+	tokens   TokenManager
+	secrets  SecretManager
+	caClient *ca.Client
+	caPool   *caclient.Pool
+	queue    QueueMetrics
+	devCA    *devCA
+
+	// provisioner mints the tokens when no token manager is given, signer
+	// signs the bound tokens, and reloaded is the last configuration
+	// reloaded from configFile.
+	provisioner *reloadableTokens
+	signer      atomic.Pointer[tokenSigner]
+	configFile  string
+	reloaded    atomic.Pointer[Config]
+}
+
+// Option configures a Controller.
+type Option func(*Controller)
+
+// WithTokenManager sets the manager generating the bootstrap tokens, instead
+// of the provisioner in the configuration. Bound tokens are still signed with
+// the provisioner in the configuration.
+func WithTokenManager(m TokenManager) Option {
+	return func(c *Controller) {
+		c.tokens = m
+	}
+}
+
+// WithSecretManager sets the manager storing the bootstrap tokens in
+// Secrets, instead of the Kubernetes API.
+func WithSecretManager(m SecretManager) Option {
+	return func(c *Controller) {
+		c.secrets = m
+	}
+}
+
+// WithCAClient sets the client used to sign the CertificateSigningRequests,
+// instead of a client of the CA in the configuration.
+func WithCAClient(client *ca.Client) Option {
+	return func(c *Controller) {
+		c.caClient = client
+	}
+}
+
+// WithQueueMetrics sets the metrics of the admission queue, instead of the
+// Prometheus metrics exported on /metrics.
+func WithQueueMetrics(m QueueMetrics) Option {
+	return func(c *Controller) {
+		c.queue = m
+	}
+}
+
+// New returns a controller with the given configuration, loaded with
+// LoadConfig.
+func New(config *Config, opts ...Option) *Controller {
+	c := &Controller{config: config}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// LoadConfig reads and validates the configuration of a controller.
+func LoadConfig(file string) (*Config, error) {
+	return loadConfig(file)
+}
+
+// Start loads the provisioner and runs the webhook server until the context
+// is canceled. The server gets its certificate from the CA, like the pods it
+// admits.
+func (c *Controller) Start(ctx context.Context) error {
+	config := c.config
+
+	// Initialize step environment
+	if err := step.Init(); err != nil {
+		return err
+	}
+
+	log.WithFields(buildFields()).Info("Starting autocert")
+
+	if config.BuildVerification.Enabled {
+		binary, err := os.Executable()
+		if err == nil {
+			err = verifyBuild(config.BuildVerification, binary)
+		}
+		if err != nil {
+			return errors.Wrap(err, "error verifying the controller build")
+		}
+		log.WithField("binary", binary).Info("Verified the controller build")
+	}
+
+	log.WithFields(log.Fields{
+		"config": config,
+	}).Info("Loaded config")
+
+	guardEgress(config)
+
+	namespace := os.Getenv("NAMESPACE")
+	if namespace == "" {
+		return errors.New("$NAMESPACE not set")
+	}
+
+	checkNativeSidecars()
+
+	if config.OTLP.Enabled {
+		stop, err := startOTLP(config, namespace)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	if config.DevCA.Enabled {
+		var err error
+		if c.devCA, err = newDevCA(config, namespace); err != nil {
+			return err
+		}
+		go c.devCA.run(ctx)
+		if err := c.devCA.waitReady(ctx); err != nil {
+			return err
+		}
+	}
+
+	provisioner, password, err := c.loadCredentials()
+	if err != nil {
+		return err
+	}
+	if c.tokens == nil && provisioner != nil {
+		c.provisioner = &reloadableTokens{}
+		c.provisioner.provisioner.Store(provisioner)
+		c.tokens = c.provisioner
+	}
+	if err := loadIntermediateProvisioners(config); err != nil {
+		return err
+	}
+	if err := loadCertificateAuthorities(config); err != nil {
+		return err
+	}
+	if c.secrets != nil {
+		tokenSecrets = c.secrets
+	}
+
+	if path := config.PersistentQueue.Path; path != "" {
+		if err := openQueue(path); err != nil {
+			return err
+		}
+	}
+
+	if config.IssuanceLog.Enabled {
+		if issuanceLog, err = openIssuanceLog(ctx, config.IssuanceLog); err != nil {
+			return err
+		}
+	}
+
+	if config.CAService.Name != "" {
+		if err := caEndpoint.start(ctx, config); err != nil {
+			return errors.Wrap(err, "error resolving CA service")
+		}
+	}
+
+	if c.caClient == nil {
+		c.caPool, err = caclient.New(append([]string{c.caURL()}, config.CAFailoverURLs...), ca.WithRootFile(config.GetRootCAPath()))
+		if err != nil {
+			return errors.Wrap(err, "error loading CA client")
+		}
+		c.caClient = c.caPool.Client()
+	}
+
+	if config.TokenBinding {
+		signer, err := newTokenSigner(c.caClient, provisioner, password)
+		if err != nil {
+			return errors.Wrap(err, "error loading token signer")
+		}
+		c.signer.Store(signer)
+		tokenBinding.sign = func(p pendingIssuance, csr *x509.CertificateRequest, pod boundPod) (string, error) {
+			return c.signer.Load().sign(p, csr, pod)
+		}
+	}
+
+	// With serviceAccountAuth the controller gets its certificate with its
+	// service account token, once the server is configured.
+	name := fmt.Sprintf("%s.%s.svc", config.GetServiceName(), namespace)
+	var token string
+	if !config.ServiceAccountAuth.Enabled {
+		token, err = c.tokens.Token(name, name, name+"."+config.GetClusterDomain())
+		if err != nil {
+			return errors.Wrap(err, "error generating bootstrap token during controller startup")
+		}
+		log.WithField("name", name).Infof("Generated bootstrap token for controller")
+	}
+
+	namespaceStats.expiringSoon = config.GetExpiringSoon()
+	podExpiry.mode = config.PodExpiryMetrics
+	if c.queue == nil {
+		c.queue = promQueueMetrics{}
+	}
+	admissionQueue = newAdmissionLimiter(config.LoadShedding, c.queue)
+
+	// make sure to cancel the renew goroutine
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if config.LeakGuard.enabled() {
+		go selfGuard.run(ctx, config.LeakGuard)
+	}
+	if c.caPool != nil {
+		go c.caPool.Run(ctx, caclient.DefaultInterval)
+	}
+	if config.WebhookReconciler.CARoots {
+		selfWebhook.roots = c.caRoots
+	}
+	if config.SecretIssuance.Enabled {
+		managedSecrets.sign = newSecretSigner(c.tokens, c.currentCA)
+	}
+	if config.TrustBundle.Enabled {
+		trustBundles.roots, trustBundles.intermediates = c.caRoots, c.caIntermediates
+		go trustBundles.run(ctx, config)
+	}
+	// The tasks repairing or renewing cluster objects run on the leader
+	// only, every replica admits pods.
+	lead := func(ctx context.Context) {
+		if config.WebhookReconciler.Enabled {
+			go selfWebhook.run(ctx, config)
+		}
+		if config.SecretIssuance.Enabled {
+			go managedSecrets.run(ctx, config, namespace)
+		}
+		if config.TrustBundle.Enabled {
+			trustBundles.lead(ctx)
+		}
+	}
+	if config.LeaderElection.Enabled {
+		go newLeaderElector(config.LeaderElection, namespace).run(ctx, lead)
+	} else {
+		lead(ctx)
+	}
+	if config.Reload.Enabled && c.configFile != "" {
+		go c.watchReload(ctx)
+	}
+
+	var srv *http.Server
+	base := newWebhookServer(config.GetAddress(), c.handler(namespace))
+	if config.ServiceAccountAuth.Enabled {
+		srv, err = serviceAccountServer(ctx, c.caClient, config, base, name, name, name+"."+config.GetClusterDomain())
+	} else {
+		srv, err = ca.BootstrapServer(ctx, token, base, ca.VerifyClientCertIfGiven())
+	}
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx) //nolint:errcheck // the server is going away
+	}()
+
+	log.Info("Listening on", config.GetAddress(), "...")
+	if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// loadCredentials loads the provisioners in the configuration, and returns
+// the one minting the tokens and its password. During a rotation both
+// credentials must load, and the next ones mint the tokens once active.
+func (c *Controller) loadCredentials() (*ca.Provisioner, []byte, error) {
+	provisioner, password, err := c.loadProvisioner()
+	if err != nil {
+		return nil, nil, err
+	}
+	next, nextPassword, err := c.loadNextProvisioner()
+	if err != nil {
+		return nil, nil, err
+	}
+	active := c.liveConfig().NextProvisioner.Active
+	provisionerRotation.set(provisioner, next, active, listProvisioners(c.currentCA))
+	if next != nil && active {
+		return next, nextPassword, nil
+	}
+	return provisioner, password, nil
+}
+
+// loadProvisioner loads the provisioner in the configuration and its
+// password, unless another token manager was given.
+func (c *Controller) loadProvisioner() (*ca.Provisioner, []byte, error) {
+	config := c.liveConfig()
+	if c.tokens != nil && c.provisioner == nil && !config.TokenBinding {
+		return nil, nil, nil
+	}
+	// Bootstrappers and the controller authenticate with their service
+	// account tokens, there's no provisioner password.
+	if config.ServiceAccountAuth.Enabled {
+		return nil, nil, nil
+	}
+
+	provisionerName := config.GetProvisionerName()
+	provisionerKid := os.Getenv("PROVISIONER_KID")
+	if c.devCA != nil {
+		provisionerKid = c.devCA.kid
+	}
+	log.WithFields(log.Fields{
+		"provisionerName": provisionerName,
+		"provisionerKid":  provisionerKid,
+	}).Info("Loaded provisioner configuration")
+
+	var password []byte
+	if c.devCA != nil {
+		password = c.devCA.password
+	} else {
+		var err error
+		if password, err = readPasswordFromFile(config.GetProvisionerPasswordPath()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	provisioner, err := ca.NewProvisioner(
+		provisionerName, provisionerKid, c.caURL(), password,
+		ca.WithRootFile(config.GetRootCAPath()))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error loading provisioner")
+	}
+	log.WithFields(log.Fields{
+		"name": provisioner.Name(),
+		"kid":  provisioner.Kid(),
+	}).Info("Loaded provisioner")
+	return provisioner, password, nil
+}
+
+// caURL returns the URL of the CA used by the controller itself: the URL in
+// the configuration, or the local URL of the development CA.
+func (c *Controller) caURL() string {
+	if c.devCA != nil {
+		return c.devCA.localURL
+	}
+	return c.config.GetCaURL()
+}
+
+// currentCA returns the client used to sign the CertificateSigningRequests:
+// the one set with WithCAClient, or the client of the first healthy CA.
+func (c *Controller) currentCA() *ca.Client {
+	if c.caPool != nil {
+		return c.caPool.Client()
+	}
+	return c.caClient
+}
+
+// handler returns the handler of the webhook and the controller endpoints.
+func (c *Controller) handler(namespace string) http.Handler {
+	tokens := c.tokens
+	metricsHandler := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := c.liveConfig()
+		if r.URL.Path == "/healthz" {
+			log.Info("/healthz")
+			if err := selfGuard.healthy(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintln(w, "ok") //nolint:errcheck // write errors on health endpoint are unactionable
+			return
+		}
+
+		if !endpointAuth.authorize(w, r, config) {
+			return
+		}
+
+		// Without a provisioner there are no tokens to give or re-issue
+		// certificates with.
+		if config.ServiceAccountAuth.Enabled && (r.URL.Path == "/token" || r.URL.Path == "/remint" || r.URL.Path == "/reissue") {
+			http.Error(w, "Not Found (tokens are not issued with serviceAccountAuth)", http.StatusNotFound)
+			return
+		}
+
+		if r.URL.Path == "/token" {
+			tokenHandler(w, r, config, tokens)
+			return
+		}
+
+		if r.URL.Path == "/remint" {
+			remintHandler(w, r, config, tokens)
+			return
+		}
+
+		if r.URL.Path == "/csr" {
+			csrHandler(w, r, config, tokens, c.currentCA())
+			return
+		}
+
+		if r.URL.Path == "/status" {
+			reportHandler(w, r, config)
+			return
+		}
+
+		if r.URL.Path == "/reissue" {
+			reissueHandler(w, r, config, tokens)
+			return
+		}
+
+		if r.URL.Path == "/provisioner" {
+			provisionerHandler(w, r)
+			return
+		}
+
+		if r.URL.Path == "/stats" {
+			statsHandler(w, r, config)
+			return
+		}
+
+		if r.URL.Path == "/recommendations" {
+			recommendationsHandler(w, r)
+			return
+		}
+
+		if r.URL.Path == "/issuances" {
+			issuancesHandler(w, r)
+			return
+		}
+
+		// The metrics are pushed instead.
+		if r.URL.Path == "/metrics" && config.OTLP.Enabled {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.URL.Path == "/metrics" {
+			metricsHandler.ServeHTTP(w, r)
+			return
+		}
+
+		if r.URL.Path == "/webhook" {
+			webhookHandler(w, config)
+			return
+		}
+
+		if r.URL.Path == "/freeze" {
+			freezeHandler(w, namespace)
+			return
+		}
+
+		if r.URL.Path == "/trust-bundle" {
+			trustBundleHandler(w)
+			return
+		}
+
+		if r.URL.Path != "/mutate" {
+			log.WithField("path", r.URL.Path).Error("Bad Request: 404 Not Found")
+			http.NotFound(w, r)
+			return
+		}
+
+		mutateHandler(w, r, config, tokens)
+	})
+}
+
+// apiSecretManager stores the bootstrap tokens with the Kubernetes API.
+type apiSecretManager struct{}
+
+func (apiSecretManager) CreateSecret(secret *corev1.Secret) (string, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(secret)
+	if err != nil {
+		return "", err
+	}
+	log.WithField("secret", string(body)).Debug("Creating secret")
+
+	req, err := client.PostRequest(fmt.Sprintf("api/v1/namespaces/%s/secrets", secret.Namespace), string(body), "application/json")
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Errorf("Secret creation error. Response: %v", resp)
+		return "", errors.Wrap(err, "secret creation")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Errorf("Secret creation error (!2XX). Response: %v", resp)
+		var rbody []byte
+		if resp.Body != nil {
+			if data, err := io.ReadAll(resp.Body); err == nil {
+				rbody = data
+			}
+		}
+		log.Error("Error body: ", string(rbody))
+		return "", errors.New("Not 200")
+	}
+
+	var rbody []byte
+	if resp.Body != nil {
+		if data, err := io.ReadAll(resp.Body); err == nil {
+			rbody = data
+		}
+	}
+	if len(rbody) == 0 {
+		return "", errors.New("Empty response body")
+	}
+
+	var created *corev1.Secret
+	if err := json.Unmarshal(rbody, &created); err != nil {
+		return "", errors.Wrap(err, "Error unmarshalling secret response")
+	}
+	return created.Name, nil
+}
+
+func (apiSecretManager) DeleteSecret(namespace, name string) error {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return err
+	}
+	req, err := client.DeleteRequest(fmt.Sprintf("api/v1/namespaces/%s/secrets/%s", namespace, name))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
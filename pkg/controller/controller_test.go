@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type fakeTokens struct{}
+
+func (fakeTokens) Token(subject string, sans ...string) (string, error) {
+	return "token-" + subject, nil
+}
+
+type fakeSecrets struct {
+	sync.Mutex
+	created []*corev1.Secret
+	deleted chan string
+}
+
+func (s *fakeSecrets) CreateSecret(secret *corev1.Secret) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.created = append(s.created, secret)
+	return secret.GenerateName + "abcde", nil
+}
+
+func (s *fakeSecrets) DeleteSecret(namespace, name string) error {
+	if s.deleted != nil {
+		s.deleted <- namespace + "/" + name
+	}
+	return nil
+}
+
+func TestCreateTokenSecret(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	secrets := &fakeSecrets{}
+	tokenSecrets = secrets
+
+	config := &Config{SecretLabels: map[string]string{"team": "payments"}}
+	name, err := createTokenSecret(config, "api-", "default", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "api-abcde" {
+		t.Errorf("createTokenSecret() = %q, want the name given by the secret manager", name)
+	}
+	if len(secrets.created) != 1 {
+		t.Fatalf("createTokenSecret() created %d secrets", len(secrets.created))
+	}
+	s := secrets.created[0]
+	if s.Namespace != "default" || s.StringData[tokenSecretKey] != "token" || s.Labels[tokenSecretLabel] != "true" || s.Labels["team"] != "payments" {
+		t.Errorf("createTokenSecret() secret = %+v", s)
+	}
+}
+
+func TestControllerHandler(t *testing.T) {
+	defer func(s *issuanceStore, b *tokenBinder) {
+		pendingIssuances, tokenBinding = s, b
+	}(pendingIssuances, tokenBinding)
+	pendingIssuances = newIssuanceStore()
+	tokenBinding = &tokenBinder{
+		review: func(token string) (*authenticationv1.UserInfo, error) {
+			return boundUser("api", token, "uid-1"), nil
+		},
+	}
+	claim, err := pendingIssuances.add(pendingIssuance{CommonName: "api.default.svc", Namespace: "default", ServiceAccount: "api", PodName: "api-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(&Config{}, WithTokenManager(fakeTokens{})).handler("step")
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		bearer   string
+		wantCode int
+		wantBody string
+	}{
+		{"healthz", http.MethodGet, "/healthz", "", "", http.StatusOK, "ok\n"},
+		{"token without service account token", http.MethodPost, "/token", `{"claim":"` + claim + `"}`, "", http.StatusForbidden, ""},
+		{"token for another pod", http.MethodPost, "/token", `{"claim":"` + claim + `"}`, "api-1", http.StatusForbidden, ""},
+		{"token", http.MethodPost, "/token", `{"claim":"` + claim + `"}`, "api-0", http.StatusOK, "token-api.default.svc"},
+		{"redeemed claim", http.MethodPost, "/token", `{"claim":"` + claim + `"}`, "api-0", http.StatusForbidden, ""},
+		{"not found", http.MethodGet, "/unknown", "", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("handler() = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("handler() body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+type contextTokens struct{}
+
+func (contextTokens) Token(subject string, sans ...string) (string, error) {
+	return "", errors.New("unexpected call to Token")
+}
+
+func (contextTokens) TokenWithContext(ctx context.Context, subject string, sans ...string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return "ctx-token-" + subject, nil
+}
+
+func TestMintToken(t *testing.T) {
+	ctx := context.Background()
+	if got, err := mintToken(ctx, fakeTokens{}, "api"); err != nil || got != "token-api" {
+		t.Errorf("mintToken() = %q, %v", got, err)
+	}
+	if got, err := mintToken(ctx, contextTokens{}, "api"); err != nil || got != "ctx-token-api" {
+		t.Errorf("mintToken() = %q, %v, want a token from TokenWithContext", got, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	for _, m := range []TokenManager{fakeTokens{}, contextTokens{}} {
+		if _, err := mintToken(ctx, m, "api"); !errors.Is(err, context.Canceled) {
+			t.Errorf("mintToken(%T) with a canceled context error = %v", m, err)
+		}
+	}
+}
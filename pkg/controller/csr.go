@@ -0,0 +1,638 @@
+package controller
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+	"go.step.sm/crypto/jose"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// defaultCSRSignerName is the signerName of the CertificateSigningRequests
+	// created by the controller, unless csrSignerName is set.
+	defaultCSRSignerName = "autocert.step.sm/step-ca"
+	csrAPIPath           = "apis/certificates.k8s.io/v1/certificatesigningrequests"
+	// csrLabel identifies the CertificateSigningRequests created by the
+	// controller.
+	csrLabel                  = "autocert.step.sm/csr"
+	csrNamespaceAnnotationKey = "autocert.step.sm/namespace"
+	// csrClaimHeader carries the claim of a CSR issuance.
+	csrClaimHeader = "Autocert-Claim"
+	// maxCSRRequestSize limits the size of a PEM encoded CSR.
+	maxCSRRequestSize = 16384
+	// csrProtocolVersion is the oldest protocol version whose bootstrappers
+	// authenticate their certificate requests with the service account
+	// token of their pod. The CSR issuance path was introduced in version 4.
+	csrProtocolVersion = 25
+	// csrLifetime is how long the claim of a submitted certificate request
+	// is kept, the time the API server keeps pending
+	// CertificateSigningRequests.
+	csrLifetime = 24 * time.Hour
+	// minCSRDuration is the minimum expirationSeconds accepted by the API
+	// server.
+	minCSRDuration = 10 * time.Minute
+)
+
+// errInvalidCSRDuration is returned by newCSR for durations the API server
+// doesn't accept.
+var errInvalidCSRDuration = errors.New("invalid certificate signing request duration")
+
+// csrIssuances holds the issuances of pods getting their certificate through
+// a CertificateSigningRequest. They are kept apart from pendingIssuances so
+// their claims can't be exchanged for a token, bypassing the approval.
+var csrIssuances = newIssuanceStore()
+
+// controllerUsername returns the username of the service account of the
+// controller, the subject of its token. The API server records it as the
+// username of the CertificateSigningRequests created by the controller.
+var controllerUsername = func() (string, error) {
+	b, err := os.ReadFile(serviceAccountToken)
+	if err != nil {
+		return "", err
+	}
+	tok, err := jose.ParseSigned(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return "", errors.Wrap(err, "error parsing service account token")
+	}
+	var claims jose.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", errors.Wrap(err, "error parsing service account token")
+	}
+	if claims.Subject == "" {
+		return "", errors.New("service account token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// GetCSRSignerName returns the signerName of the CertificateSigningRequests
+// created by the controller, defaults to "autocert.step.sm/step-ca".
+func (c Config) GetCSRSignerName() string {
+	if c.CSRSignerName != "" {
+		return c.CSRSignerName
+	}
+	return defaultCSRSignerName
+}
+
+// GetCSRURL returns the URL where bootstrappers submit their certificate
+// signing requests.
+func (c Config) GetCSRURL() string {
+	return fmt.Sprintf("https://%s.%s.svc/csr", c.GetServiceName(), os.Getenv("NAMESPACE"))
+}
+
+// usesCSR returns whether pods in the given namespace get their certificate
+// through a CertificateSigningRequest, and the approval gate holding the
+// given names, if any.
+func usesCSR(config *Config, names []string, namespace string) (bool, string) {
+	if gate := approvalGate(config, names, namespace); gate != nil {
+		return true, gate.Name
+	}
+	return namespaceAllowed(config.CSRNamespaces, namespace), ""
+}
+
+// validateCSRConfig returns an error if the CSR issuance path is enabled with
+// a protocol version that doesn't support it.
+func validateCSRConfig(c *Config) error {
+	if len(c.CSRNamespaces) > 0 && c.GetProtocolVersion() < csrProtocolVersion {
+		return fmt.Errorf("csrNamespaces requires protocolVersion %d or later", csrProtocolVersion)
+	}
+	return nil
+}
+
+// checkCSRDuration returns an error if the duration of the certificate of a
+// pod getting it through a CertificateSigningRequest is not accepted by the
+// API server. It's checked during admission, the bootstrapper would only
+// find out when submitting its request, and fail for good. The duration is
+// either the one annotated or the one of the deadline of its Job.
+func checkCSRDuration(annotations podAnnotations, duration string) error {
+	if _, err := csrExpirationSeconds(duration); err == nil {
+		return nil
+	}
+	if annotations.Duration != "" {
+		return annotationErrors{{
+			Key:    durationWebhookStatusKey,
+			Value:  duration,
+			Reason: fmt.Sprintf("is not a valid duration of a CertificateSigningRequest, it must be between %s and %ds", minCSRDuration, math.MaxInt32),
+		}}
+	}
+	return errors.Errorf("the deadline of the pod gives a certificate duration of %s, shorter than the minimum %s of a CertificateSigningRequest, annotate the pod with a longer %s", duration, minCSRDuration, durationWebhookStatusKey)
+}
+
+// mkCSRBootstrapper generates a bootstrap container that submits a
+// certificate signing request to the controller, instead of getting a
+// certificate with a bootstrap token. The request is held by the given
+// approval gate, if any. The claim records the pod that may submit it.
+func mkCSRBootstrapper(ctx context.Context, config *Config, pod *corev1.Pod, commonName, duration, owner, mode, umask, namespace, gate string, readOnly bool, sans []string, provisioner TokenManager) (corev1.Container, error) {
+	claim, err := csrIssuances.add(pendingIssuance{
+		CommonName:     commonName,
+		SANs:           sans,
+		Namespace:      namespace,
+		Duration:       duration,
+		Gate:           gate,
+		ServiceAccount: podServiceAccount(pod),
+		PodName:        pod.GetName(),
+		GenerateName:   pod.GetGenerateName(),
+	})
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	name := pod.GetName()
+	if name == "" {
+		name = pod.GetGenerateName()
+	}
+	b, err := mkBootstrapper(ctx, config, name, commonName, duration, owner, mode, umask, namespace, "", claim, readOnly, sans, provisioner)
+	if err != nil {
+		return b, err
+	}
+	addClaimToken(&b)
+	b.Env = slices.DeleteFunc(b.Env, func(e corev1.EnvVar) bool { return e.Name == "AUTOCERT_TOKEN_URL" })
+	b.Env = setEnv(b.Env,
+		corev1.EnvVar{
+			Name:  "AUTOCERT_CSR_URL",
+			Value: config.GetCSRURL(),
+		},
+		corev1.EnvVar{
+			Name:  "AUTOCERT_SANS",
+			Value: strings.Join(sans, ","),
+		})
+	return b, nil
+}
+
+// csrSANs returns the subject alternative names in a certificate request.
+func csrSANs(csr *x509.CertificateRequest) []string {
+	sans := slices.Clone(csr.DNSNames)
+	for _, ip := range csr.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, csr.EmailAddresses...)
+	for _, u := range csr.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
+
+// checkCSR returns an error if a certificate request doesn't match the
+// issuance it was submitted for.
+func checkCSR(csr *x509.CertificateRequest, p pendingIssuance) error {
+	if err := csr.CheckSignature(); err != nil {
+		return errors.Wrap(err, "invalid certificate request signature")
+	}
+	if csr.Subject.CommonName != p.CommonName {
+		return errors.Errorf("certificate request common name %q does not match %q", csr.Subject.CommonName, p.CommonName)
+	}
+	for _, san := range csrSANs(csr) {
+		if !slices.Contains(p.SANs, san) {
+			return errors.Errorf("certificate request name %q is not allowed", san)
+		}
+	}
+	return nil
+}
+
+// newCSR returns the CertificateSigningRequest for a certificate request.
+// The requested names are recorded as annotations so approvers don't need to
+// decode the request.
+func newCSR(config *Config, p pendingIssuance, csrPEM []byte) (*certificatesv1.CertificateSigningRequest, error) {
+	obj := &certificatesv1.CertificateSigningRequest{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "CertificateSigningRequest",
+			APIVersion: "certificates.k8s.io/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "autocert-",
+			Labels: map[string]string{
+				csrLabel: "true",
+			},
+			Annotations: map[string]string{
+				admissionWebhookAnnotationKey: p.CommonName,
+				sansAnnotationKey:             strings.Join(p.SANs, ","),
+				csrNamespaceAnnotationKey:     p.Namespace,
+			},
+		},
+		Spec: certificatesv1.CertificateSigningRequestSpec{
+			Request:    csrPEM,
+			SignerName: config.GetCSRSignerName(),
+			Usages: []certificatesv1.KeyUsage{
+				certificatesv1.UsageDigitalSignature,
+				certificatesv1.UsageKeyEncipherment,
+				certificatesv1.UsageServerAuth,
+				certificatesv1.UsageClientAuth,
+			},
+		},
+	}
+	if p.Gate != "" {
+		obj.Annotations[approvalGateAnnotationKey] = p.Gate
+	}
+	seconds, err := csrExpirationSeconds(p.Duration)
+	if err != nil {
+		return nil, err
+	}
+	obj.Spec.ExpirationSeconds = seconds
+	return obj, nil
+}
+
+// csrExpirationSeconds returns the expirationSeconds of a
+// CertificateSigningRequest for the given certificate duration, or nil if
+// the duration is empty. It returns errInvalidCSRDuration for durations the
+// API server doesn't accept.
+func csrExpirationSeconds(duration string) (*int32, error) {
+	if duration == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return nil, errors.Wrapf(errInvalidCSRDuration, "%q", duration)
+	}
+	if d < minCSRDuration || d > math.MaxInt32*time.Second {
+		return nil, errors.Wrapf(errInvalidCSRDuration, "%s is not between %s and %ds", duration, minCSRDuration, math.MaxInt32)
+	}
+	seconds := int32(d / time.Second)
+	return &seconds, nil
+}
+
+// csrStatus returns whether a CertificateSigningRequest was approved, and
+// the reason it can't be signed if it was denied or failed.
+func csrStatus(obj *certificatesv1.CertificateSigningRequest) (approved bool, err error) {
+	for _, c := range obj.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case certificatesv1.CertificateDenied, certificatesv1.CertificateFailed:
+			return false, errors.Errorf("certificate signing request %s %s: %s", obj.Name, strings.ToLower(string(c.Type)), c.Message)
+		case certificatesv1.CertificateApproved:
+			approved = true
+		}
+	}
+	return approved, nil
+}
+
+// parseCSR returns the certificate request of a CertificateSigningRequest.
+func parseCSR(obj *certificatesv1.CertificateSigningRequest) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(obj.Spec.Request)
+	if block == nil {
+		return nil, errors.New("invalid certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid certificate request")
+	}
+	return csr, nil
+}
+
+// signCSR gets the certificate for the certificate request of an approved
+// CertificateSigningRequest from the CA, and returns the PEM encoded
+// certificate chain.
+func signCSR(ctx context.Context, obj *certificatesv1.CertificateSigningRequest, csr *x509.CertificateRequest, provisioner TokenManager, client *ca.Client) ([]byte, error) {
+	token, err := mintToken(ctx, provisioner, csr.Subject.CommonName, csrSANs(csr)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "token generation")
+	}
+	req := &api.SignRequest{
+		CsrPEM: api.NewCertificateRequest(csr),
+		OTT:    token,
+	}
+	if s := obj.Spec.ExpirationSeconds; s != nil {
+		if req.NotAfter, err = api.ParseTimeDuration(fmt.Sprintf("%ds", *s)); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := client.SignWithContext(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign certificate")
+	}
+	return chainPEM(resp), nil
+}
+
+// chainPEM returns the PEM encoded certificate chain of a sign response.
+func chainPEM(resp *api.SignResponse) []byte {
+	chain := resp.CertChainPEM
+	if len(chain) == 0 {
+		chain = []api.Certificate{resp.ServerPEM, resp.CaPEM}
+	}
+	var b []byte
+	for _, crt := range chain {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})...)
+	}
+	return b
+}
+
+// createCSR creates a CertificateSigningRequest and returns its name.
+func createCSR(obj *certificatesv1.CertificateSigningRequest) (string, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return "", errors.Wrap(err, "Error marshaling certificate signing request")
+	}
+	req, err := client.PostRequest(csrAPIPath, string(body), "application/json")
+	if err != nil {
+		return "", err
+	}
+	var created certificatesv1.CertificateSigningRequest
+	if err := doCSRRequest(client, req, &created); err != nil {
+		return "", errors.Wrap(err, "create certificate signing request")
+	}
+	return created.Name, nil
+}
+
+// getCSR returns a CertificateSigningRequest created by the controller. The
+// label can be set by anyone creating CertificateSigningRequests, the
+// username is set by the API server.
+func getCSR(name string) (*certificatesv1.CertificateSigningRequest, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := client.GetRequest(fmt.Sprintf("%s/%s", csrAPIPath, name))
+	if err != nil {
+		return nil, err
+	}
+	var obj certificatesv1.CertificateSigningRequest
+	if err := doCSRRequest(client, req, &obj); err != nil {
+		return nil, errors.Wrap(err, "get certificate signing request")
+	}
+	username, err := controllerUsername()
+	if err != nil {
+		return nil, err
+	}
+	if obj.Labels[csrLabel] != "true" || obj.Spec.Username != username {
+		return nil, errors.Errorf("certificate signing request %s was not created by autocert", name)
+	}
+	return &obj, nil
+}
+
+// updateCSR writes the status or approval subresource of a
+// CertificateSigningRequest.
+func updateCSR(obj *certificatesv1.CertificateSigningRequest, subresource string) error {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrap(err, "Error marshaling certificate signing request")
+	}
+	req, err := client.PutRequest(fmt.Sprintf("%s/%s/%s", csrAPIPath, obj.Name, subresource), string(body), "application/json")
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(doCSRRequest(client, req, nil), "update certificate signing request %s", subresource)
+}
+
+// doCSRRequest sends a request to the certificates API and decodes the
+// response into v, if not nil.
+func doCSRRequest(client Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "Error unmarshalling certificate signing request")
+}
+
+// csrHandler implements the CSR issuance path. Bootstrappers POST their
+// certificate request with the claim set during admission, and get the name
+// of the CertificateSigningRequest created for it. They then GET
+// /csr?name=<name> with the same claim until it's approved, at which point
+// the controller checks the request against the names of the claim again,
+// signs it with the CA and returns the certificate chain. Both requests are
+// authenticated with the service account token of the pod the claim was
+// created for: the claim is readable by anyone allowed to get the pod.
+func csrHandler(w http.ResponseWriter, r *http.Request, config *Config, provisioner TokenManager, client *ca.Client) {
+	switch r.Method {
+	case http.MethodPost:
+		submitCSR(w, r, config)
+	case http.MethodGet:
+		fetchCSR(w, r, config, provisioner, client)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// submitCSR creates a CertificateSigningRequest for a certificate request
+// matching a claim.
+func submitCSR(w http.ResponseWriter, r *http.Request, config *Config) {
+	csrPEM, err := io.ReadAll(io.LimitReader(r.Body, maxCSRRequestSize))
+	if err != nil {
+		http.Error(w, "Bad Request (Invalid CSR)", http.StatusBadRequest)
+		return
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		log.Error("Bad Request: 400 (Invalid CSR)")
+		http.Error(w, "Bad Request (Invalid CSR)", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		log.Error("Bad Request: 400 (Invalid CSR)")
+		http.Error(w, "Bad Request (Invalid CSR)", http.StatusBadRequest)
+		return
+	}
+
+	// The claim is only removed once the pod is identified, so a pod
+	// presenting a stolen claim can't burn it.
+	claim := r.Header.Get(csrClaimHeader)
+	p, ok := csrIssuances.peek(claim)
+	if !ok || p.CSR != "" {
+		log.Error("Forbidden: 403 (Unknown or Expired Claim)")
+		http.Error(w, "Forbidden (Unknown or Expired Claim)", http.StatusForbidden)
+		return
+	}
+	if !identifyCSRPod(w, r, p) {
+		return
+	}
+	if p, ok = csrIssuances.take(claim); !ok || p.CSR != "" {
+		log.Error("Forbidden: 403 (Unknown or Expired Claim)")
+		http.Error(w, "Forbidden (Unknown or Expired Claim)", http.StatusForbidden)
+		return
+	}
+
+	ctxLog := log.WithFields(log.Fields{
+		"commonName": p.CommonName,
+		"namespace":  p.Namespace,
+	})
+
+	if err := checkCSR(csr, p); err != nil {
+		ctxLog.WithField("error", err).Error("Forbidden: 403 (Invalid CSR)")
+		http.Error(w, fmt.Sprintf("Forbidden (%v)", err), http.StatusForbidden)
+		return
+	}
+
+	obj, err := newCSR(config, p, csrPEM)
+	if errors.Is(err, errInvalidCSRDuration) {
+		ctxLog.WithField("error", err).Error("Bad Request: 400 (Invalid Duration)")
+		http.Error(w, fmt.Sprintf("Bad Request (%v)", err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error generating certificate signing request")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	name, err := createCSR(obj)
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error creating certificate signing request")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// The claim is kept to fetch the certificate, for as long as the
+	// request can be approved.
+	p.CSR = name
+	p.Expires = time.Now().Add(csrLifetime)
+	csrIssuances.put(claim, p)
+
+	ctxLog.WithFields(log.Fields{
+		"audit": true,
+		"name":  name,
+	}).Info("Created certificate signing request")
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, name) //nolint:errcheck // write errors are unactionable
+}
+
+// identifyCSRPod returns whether the request is made by the pod a CSR
+// issuance was created for, authenticated by its service account token. If
+// it's not, it writes the error response.
+func identifyCSRPod(w http.ResponseWriter, r *http.Request, p pendingIssuance) bool {
+	_, err := tokenBinding.identify(r, p)
+	var berr *bindingError
+	switch {
+	case errors.As(err, &berr):
+		logBindingDenied(p, err)
+		http.Error(w, "Forbidden ("+berr.reason+")", http.StatusForbidden)
+		return false
+	case err != nil:
+		log.WithFields(log.Fields{
+			"commonName": p.CommonName,
+			"namespace":  p.Namespace,
+			"error":      err,
+		}).Error("Error authenticating certificate signing request")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	default:
+		return true
+	}
+}
+
+// fetchCSR returns the certificate chain of an approved
+// CertificateSigningRequest submitted with the claim of the request,
+// signing it if needed. It responds with 202 Accepted while the request is
+// pending approval.
+func fetchCSR(w http.ResponseWriter, r *http.Request, config *Config, provisioner TokenManager, client *ca.Client) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Bad Request (Missing Name)", http.StatusBadRequest)
+		return
+	}
+	p, ok := csrIssuances.peek(r.Header.Get(csrClaimHeader))
+	if !ok || p.CSR != name {
+		log.WithField("name", name).Error("Forbidden: 403 (Unknown or Expired Claim)")
+		http.Error(w, "Forbidden (Unknown or Expired Claim)", http.StatusForbidden)
+		return
+	}
+	if !identifyCSRPod(w, r, p) {
+		return
+	}
+	ctxLog := log.WithFields(log.Fields{
+		"name":       name,
+		"commonName": p.CommonName,
+		"namespace":  p.Namespace,
+	})
+
+	obj, err := getCSR(name)
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error reading certificate signing request")
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if obj.Spec.SignerName != config.GetCSRSignerName() {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	// The request is checked again against the names of the claim, it's
+	// the one signed.
+	csr, err := parseCSR(obj)
+	if err == nil {
+		err = checkCSR(csr, p)
+	}
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Forbidden: 403 (Invalid CSR)")
+		http.Error(w, fmt.Sprintf("Forbidden (%v)", err), http.StatusForbidden)
+		return
+	}
+
+	approved, err := csrStatus(obj)
+	if err == nil && !approved {
+		approved, err = reviewCSR(r.Context(), config, obj)
+	}
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case !approved:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if len(obj.Status.Certificate) == 0 {
+		chain, err := signCSR(r.Context(), obj, csr, provisioner, client)
+		if err != nil {
+			// Errors from the CA are usually transient, the bootstrapper
+			// retries.
+			ctxLog.WithField("error", err).Error("Error signing certificate signing request")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		obj.Status.Certificate = chain
+		if err := updateCSR(obj, "status"); err != nil {
+			// Most likely a concurrent update, the bootstrapper retries.
+			ctxLog.WithField("error", err).Error("Error updating certificate signing request status")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		ctxLog.WithField("audit", true).Info("Signed certificate signing request")
+		recordIssuance(IssuanceRecord{
+			Namespace:  p.Namespace,
+			Event:      issuanceEventCSR,
+			Pod:        cmp.Or(p.PodName, p.GenerateName),
+			CSR:        name,
+			CommonName: p.CommonName,
+			SANs:       p.SANs,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(obj.Status.Certificate) //nolint:errcheck,gosec // write errors are unactionable
+}
@@ -0,0 +1,304 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestCSR(t *testing.T, commonName string, dnsNames []string, ips []net.IP) *x509.CertificateRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestCheckCSR(t *testing.T) {
+	p := pendingIssuance{
+		CommonName: "api.default.svc",
+		SANs:       []string{"api.default.svc", "api", "10.0.0.1"},
+	}
+	tests := []struct {
+		name    string
+		csr     *x509.CertificateRequest
+		wantErr bool
+	}{
+		{"ok", newTestCSR(t, "api.default.svc", []string{"api.default.svc", "api"}, []net.IP{net.ParseIP("10.0.0.1")}), false},
+		{"subset", newTestCSR(t, "api.default.svc", []string{"api.default.svc"}, nil), false},
+		{"other common name", newTestCSR(t, "web.default.svc", []string{"api.default.svc"}, nil), true},
+		{"other name", newTestCSR(t, "api.default.svc", []string{"api.default.svc", "web.default.svc"}, nil), true},
+		{"other ip", newTestCSR(t, "api.default.svc", nil, []net.IP{net.ParseIP("10.0.0.2")}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkCSR(tt.csr, p); (err != nil) != tt.wantErr {
+				t.Errorf("checkCSR() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewCSR(t *testing.T) {
+	csr := newTestCSR(t, "api.default.svc", []string{"api.default.svc"}, nil)
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	p := pendingIssuance{
+		CommonName: "api.default.svc",
+		SANs:       []string{"api.default.svc"},
+		Namespace:  "default",
+		Duration:   "1h",
+	}
+
+	obj, err := newCSR(&Config{}, p, csrPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Spec.SignerName != defaultCSRSignerName {
+		t.Errorf("SignerName = %s, want %s", obj.Spec.SignerName, defaultCSRSignerName)
+	}
+	if obj.Spec.ExpirationSeconds == nil || *obj.Spec.ExpirationSeconds != 3600 {
+		t.Errorf("ExpirationSeconds = %v, want 3600", obj.Spec.ExpirationSeconds)
+	}
+	if obj.Labels[csrLabel] != "true" || obj.Annotations[csrNamespaceAnnotationKey] != "default" {
+		t.Errorf("metadata = %+v, want csr label and namespace annotation", obj.ObjectMeta)
+	}
+
+	obj, err = newCSR(&Config{CSRSignerName: "example.com/signer"}, pendingIssuance{CommonName: "api.default.svc"}, csrPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Spec.SignerName != "example.com/signer" || obj.Spec.ExpirationSeconds != nil {
+		t.Errorf("newCSR() = %+v, want custom signer without expiration", obj.Spec)
+	}
+
+	for _, d := range []string{"1 day", "5m", "600000h"} {
+		if _, err := newCSR(&Config{}, pendingIssuance{Duration: d}, csrPEM); !errors.Is(err, errInvalidCSRDuration) {
+			t.Errorf("newCSR() with duration %s error = %v, want errInvalidCSRDuration", d, err)
+		}
+	}
+}
+
+func TestCheckCSRDuration(t *testing.T) {
+	tests := []struct {
+		name          string
+		annotations   podAnnotations
+		duration      string
+		wantErr       bool
+		wantAnnotated bool
+	}{
+		{"none", podAnnotations{}, "", false, false},
+		{"annotation", podAnnotations{Duration: "1h"}, "1h", false, false},
+		{"short annotation", podAnnotations{Duration: "5m"}, "5m", true, true},
+		{"long annotation", podAnnotations{Duration: "600000h"}, "600000h", true, true},
+		{"job", podAnnotations{}, "15m0s", false, false},
+		{"short job", podAnnotations{}, "6m0s", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCSRDuration(tt.annotations, tt.duration)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkCSRDuration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var aerrs annotationErrors
+			if errors.As(err, &aerrs) != tt.wantAnnotated {
+				t.Errorf("checkCSRDuration() error = %v, want an annotation error %v", err, tt.wantAnnotated)
+			}
+		})
+	}
+}
+
+// reviewCSRPods makes the service account token of the pods of CSR
+// issuances their name, for the service account api.
+func reviewCSRPods(t *testing.T) {
+	t.Helper()
+	b := tokenBinding
+	t.Cleanup(func() { tokenBinding = b })
+	tokenBinding = &tokenBinder{
+		review: func(token string) (*authenticationv1.UserInfo, error) {
+			return boundUser("api", token, "uid-1"), nil
+		},
+	}
+}
+
+func TestSubmitCSRPod(t *testing.T) {
+	defer func(s *issuanceStore) { csrIssuances = s }(csrIssuances)
+	csrIssuances = newIssuanceStore()
+	reviewCSRPods(t)
+
+	// The duration is rejected once the pod is identified, before creating
+	// the CertificateSigningRequest.
+	csr := newTestCSR(t, "api.default.svc", []string{"api.default.svc"}, nil)
+	claim, err := csrIssuances.add(pendingIssuance{
+		CommonName:     "api.default.svc",
+		SANs:           []string{"api.default.svc"},
+		Namespace:      "default",
+		Duration:       "1m",
+		ServiceAccount: "api",
+		PodName:        "api-0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		bearer   string
+		wantCode int
+	}{
+		{"no service account token", "", http.StatusForbidden},
+		{"other pod", "api-1", http.StatusForbidden},
+		{"pod", "api-0", http.StatusBadRequest},
+		{"submitted claim", "api-0", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/csr", bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})))
+			r.Header.Set(csrClaimHeader, claim)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			submitCSR(w, r, &Config{})
+			if w.Code != tt.wantCode {
+				t.Errorf("submitCSR() = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestFetchCSRClaim(t *testing.T) {
+	defer func(s *issuanceStore) { csrIssuances = s }(csrIssuances)
+	csrIssuances = newIssuanceStore()
+	reviewCSRPods(t)
+
+	issuance := pendingIssuance{CommonName: "api.default.svc", Namespace: "default", ServiceAccount: "api", PodName: "api-0", CSR: "autocert-7x2kq"}
+	claim, err := csrIssuances.add(issuance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuance.CSR = ""
+	submitted, err := csrIssuances.add(issuance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		claim  string
+		bearer string
+		csr    string
+	}{
+		{"no claim", "", "api-0", "autocert-7x2kq"},
+		{"unknown claim", "claim", "api-0", "autocert-7x2kq"},
+		{"other request", claim, "api-0", "autocert-p4ltz"},
+		{"not submitted", submitted, "api-0", "autocert-7x2kq"},
+		{"no service account token", claim, "", "autocert-7x2kq"},
+		{"other pod", claim, "api-1", "autocert-7x2kq"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/csr?name="+tt.csr, http.NoBody)
+			if tt.claim != "" {
+				r.Header.Set(csrClaimHeader, tt.claim)
+			}
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			fetchCSR(w, r, &Config{}, nil, nil)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("fetchCSR() = %d, want 403", w.Code)
+			}
+		})
+	}
+}
+
+func TestPatchCSRPod(t *testing.T) {
+	defer func(s *issuanceStore) { csrIssuances = s }(csrIssuances)
+	csrIssuances = newIssuanceStore()
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+
+	rootFile, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	config := &Config{
+		CaURL:         "https://ca",
+		RootCAPath:    rootFile,
+		CSRNamespaces: []string{"payments"},
+		CertsVolume:   corev1.Volume{Name: "certs"},
+		Bootstrapper:  corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper"},
+		Renewer:       corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "api-7d9f-", Annotations: map[string]string{
+			admissionWebhookAnnotationKey: "api.payments.svc",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "api"}}},
+	}
+	if patched := patchPod(t, pod, "payments", config, fakeTokens{}); !presentsClaimToken(patched) {
+		t.Errorf("bootstrapper doesn't present its service account token with its claim")
+	}
+	issuances := csrIssuances.snapshot()
+	if len(issuances) != 1 {
+		t.Fatalf("CSR issuances = %v, want one", issuances)
+	}
+	for _, p := range issuances {
+		if p.ServiceAccount != "default" || p.GenerateName != "api-7d9f-" {
+			t.Errorf("CSR issuance = %+v, want the service account and generated name of the pod", p)
+		}
+	}
+}
+
+func TestCSRStatus(t *testing.T) {
+	condition := func(typ certificatesv1.RequestConditionType, status corev1.ConditionStatus) certificatesv1.CertificateSigningRequestCondition {
+		return certificatesv1.CertificateSigningRequestCondition{Type: typ, Status: status, Message: "by policy"}
+	}
+	tests := []struct {
+		name         string
+		conditions   []certificatesv1.CertificateSigningRequestCondition
+		wantApproved bool
+		wantErr      bool
+	}{
+		{"pending", nil, false, false},
+		{"approved", []certificatesv1.CertificateSigningRequestCondition{condition(certificatesv1.CertificateApproved, corev1.ConditionTrue)}, true, false},
+		{"not approved", []certificatesv1.CertificateSigningRequestCondition{condition(certificatesv1.CertificateApproved, corev1.ConditionFalse)}, false, false},
+		{"denied", []certificatesv1.CertificateSigningRequestCondition{condition(certificatesv1.CertificateDenied, corev1.ConditionTrue)}, false, true},
+		{"failed", []certificatesv1.CertificateSigningRequestCondition{
+			condition(certificatesv1.CertificateApproved, corev1.ConditionTrue),
+			condition(certificatesv1.CertificateFailed, corev1.ConditionTrue),
+		}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &certificatesv1.CertificateSigningRequest{Status: certificatesv1.CertificateSigningRequestStatus{Conditions: tt.conditions}}
+			approved, err := csrStatus(obj)
+			if approved != tt.wantApproved || (err != nil) != tt.wantErr {
+				t.Errorf("csrStatus() = %v, %v, want %v, wantErr %v", approved, err, tt.wantApproved, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Admission decisions, the decision label of
+// autocert_admission_decisions_total.
+const (
+	decisionSkipped  = "skipped"
+	decisionDenied   = "denied"
+	decisionErrored  = "errored"
+	decisionPatched  = "patched"
+	decisionShadowed = "shadowed"
+)
+
+// Admission decision reasons, the reason label of
+// autocert_admission_decisions_total. Shadowed decisions have the reason of
+// the decision that would have been made.
+const (
+	reasonNoAnnotation         = "no_annotation"
+	reasonAlreadyInjected      = "already_injected"
+	reasonNamespaceRestriction = "namespace_restriction"
+	reasonHostNamespaces       = "host_namespaces"
+	reasonInvalidAnnotation    = "invalid_annotation"
+	reasonEnrollment           = "enrollment"
+	reasonSANPolicy            = "san_policy"
+	reasonIssuanceFrozen       = "issuance_frozen"
+	reasonInvalidPod           = "invalid_pod"
+	reasonIssuance             = "issuance"
+	reasonInjected             = "injected"
+)
+
+// admissionDecisions counts the decisions of the admission webhook, so the
+// health of a rollout can be judged from the ratio of patched to denied or
+// errored pods.
+var admissionDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "autocert_admission_decisions_total",
+	Help: "Number of admission decisions by decision, reason and namespace.",
+}, []string{"decision", "reason", "namespace"})
+
+// admissionDuration is the time the webhook takes to answer the admission
+// reviews, including the time they wait in the admission queue. The API
+// server fails or ignores the reviews exceeding the timeout of the webhook.
+var admissionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "autocert_admission_duration_seconds",
+	Help:    "Time in seconds to answer the admission reviews.",
+	Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+})
+
+func init() {
+	metricsRegistry.MustRegister(admissionDecisions, admissionDuration)
+}
+
+// recordDecision counts an admission decision.
+func recordDecision(decision, reason, namespace string) {
+	admissionDecisions.WithLabelValues(decision, reason, namespace).Inc()
+}
+
+// observeAdmission records the time taken to answer an admission review
+// started at start.
+func observeAdmission(start time.Time) {
+	admissionDuration.Observe(time.Since(start).Seconds())
+}
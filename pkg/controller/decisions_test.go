@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// decisionCount returns the value of autocert_admission_decisions_total with
+// the given labels.
+func decisionCount(t *testing.T, decision, reason, namespace string) float64 {
+	t.Helper()
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "autocert_admission_decisions_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["decision"] == decision && labels["reason"] == reason && labels["namespace"] == namespace {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestMutateDecisions(t *testing.T) {
+	const namespace = "decisions"
+	review := func(pod *corev1.Pod) *v1beta1.AdmissionReview {
+		raw, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &v1beta1.AdmissionReview{
+			Request: &v1beta1.AdmissionRequest{
+				UID:       "uid",
+				Namespace: namespace,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		}
+	}
+	annotated := func(annotations map[string]string, spec corev1.PodSpec) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}, Spec: spec}
+	}
+
+	testCases := []struct {
+		description string
+		config      *Config
+		pod         *corev1.Pod
+		decision    string
+		reason      string
+	}{
+		{"no annotation", &Config{}, annotated(nil, corev1.PodSpec{}), decisionSkipped, reasonNoAnnotation},
+		{"already injected", &Config{}, annotated(map[string]string{
+			admissionWebhookAnnotationKey: "test.decisions.svc",
+			admissionWebhookStatusKey:     "injected",
+		}, corev1.PodSpec{}), decisionSkipped, reasonAlreadyInjected},
+		{"other namespace", &Config{RestrictCertificatesToNamespace: true}, annotated(map[string]string{
+			admissionWebhookAnnotationKey: "test.kube-system.svc",
+		}, corev1.PodSpec{}), decisionDenied, reasonNamespaceRestriction},
+		{"host network", &Config{}, annotated(map[string]string{
+			admissionWebhookAnnotationKey: "test.decisions.svc",
+		}, corev1.PodSpec{HostNetwork: true}), decisionDenied, reasonHostNamespaces},
+		{"shadow host network", &Config{ShadowMode: true}, annotated(map[string]string{
+			admissionWebhookAnnotationKey: "test.decisions.svc",
+		}, corev1.PodSpec{HostNetwork: true}), decisionShadowed, reasonHostNamespaces},
+		{"shadow inject", &Config{ShadowMode: true}, annotated(map[string]string{
+			admissionWebhookAnnotationKey: "test.decisions.svc",
+		}, corev1.PodSpec{}), decisionShadowed, reasonInjected},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			before := decisionCount(t, tc.decision, tc.reason, namespace)
+			mutate(context.Background(), review(tc.pod), tc.config, nil)
+			if got := decisionCount(t, tc.decision, tc.reason, namespace) - before; got != 1 {
+				t.Errorf("autocert_admission_decisions_total{decision=%q, reason=%q} increased by %v, want 1", tc.decision, tc.reason, got)
+			}
+		})
+	}
+}
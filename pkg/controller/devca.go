@@ -0,0 +1,254 @@
+package controller
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	caconfig "github.com/smallstep/certificates/authority/config"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/ca"
+	"go.step.sm/crypto/jose"
+)
+
+const (
+	defaultDevCAPort = 9000
+	// devCARootName and devCAIntermediateName are the common names of the
+	// development CA, so its certificates are never mistaken for the ones of
+	// a real CA.
+	devCARootName         = "Autocert INSECURE Development Root CA"
+	devCAIntermediateName = "Autocert INSECURE Development Intermediate CA"
+	devCALifetime         = 365 * 24 * time.Hour
+	// devCAStartTimeout bounds the wait for the development CA to listen.
+	devCAStartTimeout = 10 * time.Second
+)
+
+// DevCA runs a CA embedded in the controller, for development clusters
+// without step-ca. Its root and keys are generated in memory at startup and
+// lost on restart, so the pods must be restarted along with the controller.
+// It's insecure: never enable it outside of development clusters.
+type DevCA struct {
+	Enabled bool `yaml:"enabled"`
+	// Port is the port of the CA in the controller and its Service, defaults
+	// to 9000.
+	Port int `yaml:"port"`
+}
+
+// GetPort returns the port of the development CA, defaults to 9000.
+func (d DevCA) GetPort() int {
+	if d.Port == 0 {
+		return defaultDevCAPort
+	}
+	return d.Port
+}
+
+// validateDevCA returns an error if the development CA is enabled along with
+// another CA.
+func validateDevCA(c *Config) error {
+	d := c.DevCA
+	switch {
+	case !d.Enabled:
+		return nil
+	case d.Port < 0 || d.Port > 65535:
+		return fmt.Errorf("devCA.port %d is not valid", d.Port)
+	case c.CaURL != "" || c.CAService.Name != "" || len(c.CAFailoverURLs) > 0:
+		return fmt.Errorf("devCA can't be enabled along with caUrl, caService or caFailoverURLs")
+	case c.AirGapped.Enabled:
+		return fmt.Errorf("devCA can't be enabled in air-gapped mode")
+	}
+	return nil
+}
+
+// devCA is a running development CA.
+type devCA struct {
+	srv *ca.CA
+	dir string
+	// localURL is the URL of the CA for the controller itself, which can't
+	// reach its own Service before it's ready.
+	localURL string
+	// kid and password are the key ID and password of the provisioner.
+	kid      string
+	password []byte
+}
+
+// newDevCA generates the PKI of the development CA in a temporary directory,
+// with a JWK provisioner named after the configuration, and sets the CA URL
+// and root of the configuration to its own. The CA is reachable through the
+// Service of the controller.
+func newDevCA(config *Config, namespace string) (*devCA, error) {
+	dir, err := os.MkdirTemp("", "autocert-dev-ca")
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating development CA directory")
+	}
+	d, err := writeDevCA(config, namespace, dir)
+	if err != nil {
+		os.RemoveAll(dir) //nolint:errcheck // best effort cleanup
+		return nil, err
+	}
+	return d, nil
+}
+
+func writeDevCA(config *Config, namespace, dir string) (*devCA, error) {
+	now := time.Now()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	root, err := devCACertificate(devCARootName, now, rootKey, nil, rootKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating development root")
+	}
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	intermediate, err := devCACertificate(devCAIntermediateName, now, intermediateKey, root, rootKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating development intermediate")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(intermediateKey)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]*pem.Block{
+		"root_ca.crt":         {Type: "CERTIFICATE", Bytes: root.Raw},
+		"intermediate_ca.crt": {Type: "CERTIFICATE", Bytes: intermediate.Raw},
+		"intermediate_ca_key": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	}
+	for name, block := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0o600); err != nil {
+			return nil, errors.Wrap(err, "error writing development CA")
+		}
+	}
+
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating provisioner key")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	password := []byte(hex.EncodeToString(secret))
+	jwe, err := jose.EncryptJWK(jwk, password)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encrypting provisioner key")
+	}
+	encryptedKey, err := jwe.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	pub := jwk.Public()
+
+	port := config.DevCA.GetPort()
+	service := fmt.Sprintf("%s.%s.svc", config.GetServiceName(), namespace)
+	srv, err := ca.New(&caconfig.Config{
+		Root:             []string{filepath.Join(dir, "root_ca.crt")},
+		IntermediateCert: filepath.Join(dir, "intermediate_ca.crt"),
+		IntermediateKey:  filepath.Join(dir, "intermediate_ca_key"),
+		Address:          fmt.Sprintf(":%d", port),
+		DNSNames:         []string{service, service + "." + config.GetClusterDomain(), "localhost"},
+		AuthorityConfig: &caconfig.AuthConfig{
+			Provisioners: provisioner.List{&provisioner.JWK{
+				Type:         "JWK",
+				Name:         config.GetProvisionerName(),
+				Key:          &pub,
+				EncryptedKey: encryptedKey,
+			}},
+		},
+	}, ca.WithQuiet(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "error initializing development CA")
+	}
+
+	config.CaURL = fmt.Sprintf("https://%s:%d", service, port)
+	config.RootCAPath = filepath.Join(dir, "root_ca.crt")
+	return &devCA{
+		srv:      srv,
+		dir:      dir,
+		localURL: fmt.Sprintf("https://localhost:%d", port),
+		kid:      jwk.KeyID,
+		password: password,
+	}, nil
+}
+
+// devCACertificate returns a CA certificate for key, signed by parent, or
+// self-signed if parent is nil.
+func devCACertificate(commonName string, now time.Time, key *ecdsa.PrivateKey, parent *x509.Certificate, signer crypto.Signer) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"INSECURE autocert development CA"}},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(devCALifetime),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	if parent == nil {
+		parent = tmpl
+	} else {
+		tmpl.MaxPathLenZero = true
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// waitReady waits until the CA answers its health checks.
+func (d *devCA) waitReady(ctx context.Context) error {
+	roots, err := loadRoots(filepath.Join(d.dir, "root_ca.crt"))
+	if err != nil {
+		return err
+	}
+	check := newCAHealthCheck(roots)
+	ctx, cancel := context.WithTimeout(ctx, devCAStartTimeout)
+	defer cancel()
+	for {
+		err := check(ctx, d.localURL, "")
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(err, "error starting development CA")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// run serves the CA until the context is canceled, then removes its keys.
+func (d *devCA) run(ctx context.Context) {
+	log.WithFields(log.Fields{
+		"url":  d.localURL,
+		"root": devCARootName,
+	}).Warn("Running the INSECURE development CA, its keys are lost on restart, never use it in production")
+	go func() {
+		<-ctx.Done()
+		if err := d.srv.Stop(); err != nil {
+			log.WithField("error", err).Warn("Error stopping the development CA")
+		}
+	}()
+	if err := d.srv.Run(); err != nil && ctx.Err() == nil {
+		log.WithField("error", err).Error("Development CA stopped")
+	}
+	os.RemoveAll(d.dir) //nolint:errcheck // best effort cleanup
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateDevCA(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"disabled", Config{CaURL: "https://ca"}, false},
+		{"ok", Config{DevCA: DevCA{Enabled: true}}, false},
+		{"port", Config{DevCA: DevCA{Enabled: true, Port: 70000}}, true},
+		{"caUrl", Config{DevCA: DevCA{Enabled: true}, CaURL: "https://ca"}, true},
+		{"caService", Config{DevCA: DevCA{Enabled: true}, CAService: CAService{Name: "step-ca"}}, true},
+		{"airGapped", Config{DevCA: DevCA{Enabled: true}, AirGapped: AirGapped{Enabled: true}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateDevCA(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateDevCA() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewDevCA(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	config := &Config{DevCA: DevCA{Enabled: true, Port: port}}
+	d, err := newDevCA(config, "autocert")
+	if err != nil {
+		t.Fatalf("newDevCA() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		if _, err := os.Stat(d.dir); !os.IsNotExist(err) {
+			t.Errorf("development CA directory not removed: %v", err)
+		}
+	})
+
+	if !strings.HasPrefix(config.CaURL, "https://autocert.autocert.svc:") {
+		t.Errorf("CaURL = %s", config.CaURL)
+	}
+	if root := readCertificate(t, config.GetRootCAPath()); !strings.Contains(root.Subject.CommonName, "INSECURE") {
+		t.Errorf("development root common name = %s, want INSECURE", root.Subject.CommonName)
+	}
+	if err := d.waitReady(ctx); err != nil {
+		t.Errorf("waitReady() error = %v", err)
+	}
+}
+
+func TestDevCACertificate(t *testing.T) {
+	d, err := newDevCA(&Config{DevCA: DevCA{Enabled: true}}, "autocert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d.dir)
+	pool := x509.NewCertPool()
+	pool.AddCert(readCertificate(t, filepath.Join(d.dir, "root_ca.crt")))
+	intermediate := readCertificate(t, filepath.Join(d.dir, "intermediate_ca.crt"))
+	if _, err := intermediate.Verify(x509.VerifyOptions{Roots: pool, CurrentTime: time.Now()}); err != nil {
+		t.Errorf("intermediate doesn't chain to the development root: %v", err)
+	}
+	if cn := intermediate.Subject.CommonName; cn != devCAIntermediateName {
+		t.Errorf("intermediate common name = %s, want %s", cn, devCAIntermediateName)
+	}
+}
+
+func readCertificate(t *testing.T, filename string) *x509.Certificate {
+	t.Helper()
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		t.Fatalf("%s is not PEM encoded", filename)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// drainAnnotationKey keeps the renewer running after the pod is deleted
+	// until the application has drained.
+	drainAnnotationKey = "autocert.step.sm/wait-for-drain"
+	// drainFileEnvVar is the file the application writes once it has
+	// drained, the renewer stops after it's written.
+	drainFileEnvVar = "DRAIN_FILE"
+	// drainTimeoutEnvVar bounds how long the renewer waits for the drain
+	// file.
+	drainTimeoutEnvVar = "DRAIN_TIMEOUT"
+	// drainVolumeName is the volume shared by the application and the
+	// renewer for the drain file. The certificates volume is read-only in
+	// the application containers.
+	drainVolumeName = "autocert-drain"
+	drainMountPath  = "/var/run/autocert-drain"
+	drainFileName   = "drained"
+	// drainStopMargin is the time left to the renewer to stop after the
+	// drain timeout, within the grace period of the pod.
+	drainStopMargin = 10 * time.Second
+	// defaultGracePeriod is the grace period of pods not setting
+	// terminationGracePeriodSeconds.
+	defaultGracePeriod = 30 * time.Second
+)
+
+// drainSizeLimit bounds the drain volume, backed by memory.
+var drainSizeLimit = resource.MustParse("1Mi")
+
+// waitForDrain returns whether the renewer of a pod waits for the
+// application to drain before stopping. It returns an error if the pod has
+// no renewer, or if the protocol version in use doesn't support it.
+func waitForDrain(annotations podAnnotations, config *Config) (bool, error) {
+	if !annotations.WaitForDrain {
+		return false, nil
+	}
+	if annotations.BootstrapperOnly {
+		return false, annotationErrors{{
+			Key:    drainAnnotationKey,
+			Value:  "true",
+			Reason: "the pod has no renewer, it's annotated with " + bootstrapperOnlyAnnotationKey,
+		}}
+	}
+	if v := envProtocolVersions[drainFileEnvVar]; config.GetProtocolVersion() < v {
+		return false, annotationErrors{{
+			Key:    drainAnnotationKey,
+			Value:  "true",
+			Reason: fmt.Sprintf("requires protocol version %d, but version %d is pinned in the configuration", v, config.GetProtocolVersion()),
+		}}
+	}
+	return true, nil
+}
+
+// drainTimeout returns how long the renewer of a pod waits for the
+// application to drain: the grace period of the pod, less the time the
+// renewer needs to stop.
+func drainTimeout(pod *corev1.Pod) time.Duration {
+	grace := defaultGracePeriod
+	if s := pod.Spec.TerminationGracePeriodSeconds; s != nil {
+		grace = time.Duration(*s) * time.Second
+	}
+	return max(grace-drainStopMargin, time.Second)
+}
+
+// setDrain configures the renewer to wait for the drain file.
+func setDrain(renewer *corev1.Container, pod *corev1.Pod) {
+	renewer.Env = setEnv(renewer.Env,
+		corev1.EnvVar{Name: drainFileEnvVar, Value: path.Join(drainMountPath, drainFileName)},
+		corev1.EnvVar{Name: drainTimeoutEnvVar, Value: drainTimeout(pod).String()},
+	)
+	renewer.VolumeMounts = append(renewer.VolumeMounts, corev1.VolumeMount{
+		Name:      drainVolumeName,
+		MountPath: drainMountPath,
+		ReadOnly:  true,
+	})
+}
+
+// addDrainVolumeMounts mounts the drain volume in the application
+// containers. They must already have volume mounts, like the certificates
+// volume.
+func addDrainVolumeMounts(containers []corev1.Container) (ops []PatchOperation, err error) {
+	for i, c := range containers {
+		for _, m := range c.VolumeMounts {
+			if m.MountPath == drainMountPath {
+				return nil, fmt.Errorf("container %s mounts %s at %s, reserved for the drain file", c.Name, m.Name, drainMountPath)
+			}
+		}
+		ops = append(ops, PatchOperation{
+			Op:   "add",
+			Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", i),
+			Value: corev1.VolumeMount{
+				Name:      drainVolumeName,
+				MountPath: drainMountPath,
+			},
+		})
+	}
+	return ops, nil
+}
+
+// drainVolume returns the volume holding the drain file.
+func drainVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: drainVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{
+				Medium:    corev1.StorageMediumMemory,
+				SizeLimit: &drainSizeLimit,
+			},
+		},
+	}
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestWaitForDrain(t *testing.T) {
+	if drain, err := waitForDrain(podAnnotations{WaitForDrain: true}, &Config{}); !drain || err != nil {
+		t.Errorf("waitForDrain() = %v, %v, want true", drain, err)
+	}
+	if drain, err := waitForDrain(podAnnotations{}, &Config{ProtocolVersion: 14}); drain || err != nil {
+		t.Errorf("waitForDrain() without annotation = %v, %v", drain, err)
+	}
+	var aerrs annotationErrors
+	if _, err := waitForDrain(podAnnotations{WaitForDrain: true}, &Config{ProtocolVersion: 14}); !errors.As(err, &aerrs) {
+		t.Errorf("waitForDrain() with protocol 14 = %v, want an annotation error", err)
+	}
+	if _, err := waitForDrain(podAnnotations{WaitForDrain: true, BootstrapperOnly: true}, &Config{}); !errors.As(err, &aerrs) {
+		t.Errorf("waitForDrain() without renewer = %v, want an annotation error", err)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	tests := []struct {
+		name  string
+		grace *int64
+		want  time.Duration
+	}{
+		{"default", nil, 20 * time.Second},
+		{"long", ptr.To(int64(120)), 110 * time.Second},
+		{"short", ptr.To(int64(5)), time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{TerminationGracePeriodSeconds: tt.grace}}
+			if got := drainTimeout(pod); got != tt.want {
+				t.Errorf("drainTimeout() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDrainPatch(t *testing.T) {
+	config := &Config{
+		CertsVolume: corev1.Volume{Name: "certs"},
+		Renewer:     corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: map[string]string{
+			admissionWebhookAnnotationKey: "app.default.svc",
+			externalSecretAnnotationKey:   "legacy-tls",
+			drainAnnotationKey:            "true",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	annotations, err := parseAnnotations(pod.Annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := externalSecretPatch(pod, "default", config, annotations, "legacy-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var renewer *corev1.Container
+	var appMount, volume bool
+	for _, op := range ops {
+		switch op.Path {
+		case "/spec/containers/-":
+			c := op.Value.(corev1.Container)
+			renewer = &c
+		case "/spec/containers/0/volumeMounts/-":
+			m := op.Value.(corev1.VolumeMount)
+			appMount = m.Name == drainVolumeName && m.MountPath == drainMountPath && !m.ReadOnly
+		case "/spec/volumes":
+			for _, v := range op.Value.([]corev1.Volume) {
+				volume = volume || v.Name == drainVolumeName
+			}
+		}
+	}
+	if !appMount || !volume {
+		t.Errorf("externalSecretPatch() = %v, want the drain volume mounted in the application", ops)
+	}
+	if renewer == nil {
+		t.Fatal("externalSecretPatch() didn't add the renewer")
+	}
+	env := make(map[string]string)
+	for _, e := range renewer.Env {
+		env[e.Name] = e.Value
+	}
+	if env[drainFileEnvVar] != "/var/run/autocert-drain/drained" || env[drainTimeoutEnvVar] != "20s" {
+		t.Errorf("renewer env = %v, want the drain file and timeout", env)
+	}
+
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "run", MountPath: drainMountPath}}
+	if _, err := externalSecretPatch(pod, "default", config, annotations, "legacy-tls"); err == nil {
+		t.Error("externalSecretPatch() with a mount at the drain path should fail")
+	}
+}
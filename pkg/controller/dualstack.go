@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// dualStackAnnotationKey requests an RSA certificate for the same
+	// identity next to the ECDSA one, for pods serving clients that only
+	// support RSA.
+	dualStackAnnotationKey = "autocert.step.sm/dual-stack"
+	// dualStackEnvVar tells the bootstrapper and the renewer to maintain the
+	// RSA certificate.
+	dualStackEnvVar = "DUAL_STACK"
+)
+
+// dualStack returns whether a pod requests an RSA certificate next to the
+// ECDSA one. It returns an error if the protocol version in use doesn't
+// support it: the application would fail to load the missing files.
+func dualStack(pod *corev1.Pod, config *Config) (bool, error) {
+	value := pod.GetAnnotations()[dualStackAnnotationKey]
+	if !strings.EqualFold(value, "true") {
+		return false, nil
+	}
+	if v := envProtocolVersions[dualStackEnvVar]; config.GetProtocolVersion() < v {
+		return false, annotationErrors{{
+			Key:    dualStackAnnotationKey,
+			Value:  value,
+			Reason: fmt.Sprintf("requires protocol version %d, but version %d is pinned in the configuration", v, config.GetProtocolVersion()),
+		}}
+	}
+	return true, nil
+}
+
+// setDualStack configures the injected containers to maintain the RSA
+// certificate.
+func setDualStack(containers ...*corev1.Container) {
+	for _, c := range containers {
+		c.Env = setEnv(c.Env, corev1.EnvVar{
+			Name:  dualStackEnvVar,
+			Value: "true",
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDualStack(t *testing.T) {
+	pod := func(v string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{dualStackAnnotationKey: v}}}
+	}
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		config  *Config
+		want    bool
+		wantErr bool
+	}{
+		{"no annotation", &corev1.Pod{}, &Config{}, false, false},
+		{"false", pod("false"), &Config{}, false, false},
+		{"true", pod("true"), &Config{}, true, false},
+		{"True", pod("True"), &Config{}, true, false},
+		{"pinned protocol", pod("true"), &Config{ProtocolVersion: 6}, false, true},
+		{"pinned protocol without annotation", pod("false"), &Config{ProtocolVersion: 6}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dualStack(tt.pod, tt.config)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("dualStack() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetDualStack(t *testing.T) {
+	b := corev1.Container{Env: []corev1.EnvVar{{Name: "CRT", Value: "/var/run/autocert.step.sm/site.crt"}}}
+	var r corev1.Container
+	setDualStack(&b, &r)
+	for _, c := range []corev1.Container{b, r} {
+		if c.Env[len(c.Env)-1] != (corev1.EnvVar{Name: dualStackEnvVar, Value: "true"}) {
+			t.Errorf("setDualStack() env = %v", c.Env)
+		}
+	}
+	if len(b.Env) != 2 {
+		t.Errorf("setDualStack() env = %v, want the template variables kept", b.Env)
+	}
+}
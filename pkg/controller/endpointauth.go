@@ -0,0 +1,250 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+const (
+	tokenReviewAPIPath          = "apis/authentication.k8s.io/v1/tokenreviews"
+	subjectAccessReviewAPIPath  = "apis/authorization.k8s.io/v1/subjectaccessreviews"
+	endpointAuthCacheTTL        = time.Minute
+	endpointAuthCacheMaxEntries = 1024
+)
+
+// EndpointAuth configures the authorization of the endpoints serving
+// issuance data and the state of the controller: /stats, /recommendations,
+// /webhook and /provisioner, and optionally /metrics.
+// Callers send a Kubernetes bearer token, authenticated with a TokenReview,
+// and must be allowed to get the path of the endpoint, checked with a
+// SubjectAccessReview. Access is granted with a ClusterRole on the
+// non-resource URLs:
+//
+//	rules:
+//	- nonResourceURLs: ["/stats", "/recommendations", "/webhook", "/provisioner", "/metrics"]
+//	  verbs: ["get"]
+type EndpointAuth struct {
+	// Enabled requires authorization on /stats, /recommendations, /webhook
+	// and /provisioner.
+	Enabled bool `yaml:"enabled"`
+	// Metrics also requires authorization on /metrics. Prometheus must then
+	// scrape the controller with a service account token.
+	Metrics bool `yaml:"metrics"`
+}
+
+// protects returns whether a request to the given path requires
+// authorization.
+func (a EndpointAuth) protects(path string) bool {
+	switch path {
+	case "/stats", "/recommendations", "/webhook", "/provisioner":
+		return a.Enabled
+	case "/metrics":
+		return a.Enabled && a.Metrics
+	default:
+		return false
+	}
+}
+
+// accessReview is the result of the review of a request.
+type accessReview struct {
+	// User is the name of the authenticated user, empty if the token is
+	// not valid.
+	User string
+	// Allowed is whether the user may get the path or resource.
+	Allowed bool
+}
+
+// accessResource is what a request accesses: the path of a non-resource URL,
+// or a resource of the autocert.step.sm group in a namespace.
+type accessResource struct {
+	Path      string
+	Namespace string
+	Resource  string
+}
+
+func (r accessResource) String() string {
+	if r.Resource == "" {
+		return r.Path
+	}
+	return r.Namespace + "/" + r.Resource
+}
+
+// endpointAuthorizer authorizes requests to the protected endpoints, caching
+// the reviews so scrapers don't create a TokenReview on every request.
+type endpointAuthorizer struct {
+	sync.Mutex
+	review  func(token string, resource accessResource) (accessReview, error)
+	reviews map[[sha256.Size]byte]cachedReview
+}
+
+type cachedReview struct {
+	accessReview
+	expires time.Time
+}
+
+// endpointAuth authorizes the requests to the protected endpoints.
+var endpointAuth = &endpointAuthorizer{review: reviewAccess}
+
+// authorize returns whether the request may proceed. If it may not, it
+// writes the error response.
+func (a *endpointAuthorizer) authorize(w http.ResponseWriter, r *http.Request, config *Config) bool {
+	if !config.EndpointAuth.protects(r.URL.Path) {
+		return true
+	}
+	return a.check(w, r, accessResource{Path: r.URL.Path})
+}
+
+// authorizeResource returns whether the request may get the given resource
+// of the autocert.step.sm group in a namespace. A token is always required.
+// If the request may not proceed, it writes the error response.
+func (a *endpointAuthorizer) authorizeResource(w http.ResponseWriter, r *http.Request, namespace, resource string) bool {
+	return a.check(w, r, accessResource{Namespace: namespace, Resource: resource})
+}
+
+// check reviews the bearer token of the request for the given path or
+// resource, and writes the error response if it's not allowed.
+func (a *endpointAuthorizer) check(w http.ResponseWriter, r *http.Request, resource accessResource) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="autocert"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	review, err := a.get(token, resource)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":     r.URL.Path,
+			"resource": resource.String(),
+			"error":    err,
+		}).Error("Error reviewing access")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	switch {
+	case review.User == "":
+		w.Header().Set("WWW-Authenticate", `Bearer realm="autocert", error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	case !review.Allowed:
+		log.WithFields(log.Fields{
+			"audit":    true,
+			"path":     r.URL.Path,
+			"resource": resource.String(),
+			"user":     review.User,
+		}).Warn("Forbidden access to endpoint")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	default:
+		return true
+	}
+}
+
+// get returns the review of a token and path or resource, from the cache if
+// possible. Errors are not cached.
+func (a *endpointAuthorizer) get(token string, resource accessResource) (accessReview, error) {
+	key := sha256.Sum256([]byte(resource.Path + "\x00" + resource.Namespace + "\x00" + resource.Resource + "\x00" + token))
+	now := time.Now()
+
+	a.Lock()
+	if c, ok := a.reviews[key]; ok && now.Before(c.expires) {
+		a.Unlock()
+		return c.accessReview, nil
+	}
+	a.Unlock()
+
+	review, err := a.review(token, resource)
+	if err != nil {
+		return accessReview{}, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if a.reviews == nil || len(a.reviews) >= endpointAuthCacheMaxEntries {
+		a.reviews = make(map[[sha256.Size]byte]cachedReview)
+	}
+	a.reviews[key] = cachedReview{review, now.Add(endpointAuthCacheTTL)}
+	return review, nil
+}
+
+// reviewAccess authenticates a token with a TokenReview and, if it's valid,
+// checks with a SubjectAccessReview whether its user may get the given path
+// or resource.
+func reviewAccess(token string, resource accessResource) (accessReview, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return accessReview{}, err
+	}
+
+	var tr authenticationv1.TokenReview
+	if err := createReview(client, tokenReviewAPIPath, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, &tr); err != nil {
+		return accessReview{}, errors.Wrap(err, "create token review")
+	}
+	if !tr.Status.Authenticated || tr.Status.User.Username == "" {
+		return accessReview{}, nil
+	}
+
+	user := tr.Status.User
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	spec := authorizationv1.SubjectAccessReviewSpec{
+		User:   user.Username,
+		Groups: user.Groups,
+		UID:    user.UID,
+		Extra:  extra,
+	}
+	if resource.Resource == "" {
+		spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{
+			Path: resource.Path,
+			Verb: "get",
+		}
+	} else {
+		spec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+			Namespace: resource.Namespace,
+			Verb:      "get",
+			Group:     "autocert.step.sm",
+			Resource:  resource.Resource,
+		}
+	}
+	var sar authorizationv1.SubjectAccessReview
+	if err := createReview(client, subjectAccessReviewAPIPath, &authorizationv1.SubjectAccessReview{Spec: spec}, &sar); err != nil {
+		return accessReview{}, errors.Wrap(err, "create subject access review")
+	}
+	return accessReview{User: user.Username, Allowed: sar.Status.Allowed}, nil
+}
+
+// createReview creates a TokenReview or SubjectAccessReview and decodes the
+// result in out.
+func createReview(client Client, path string, review, out any) error {
+	body, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+	req, err := client.PostRequest(path, string(body), "application/json")
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(out), "Error unmarshalling review")
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEndpointAuthorizer(t *testing.T) {
+	var calls int
+	a := &endpointAuthorizer{review: func(token string, _ accessResource) (accessReview, error) {
+		calls++
+		switch token {
+		case "reader":
+			return accessReview{User: "system:serviceaccount:monitoring:prometheus", Allowed: true}, nil
+		case "other":
+			return accessReview{User: "system:serviceaccount:default:default"}, nil
+		case "error":
+			return accessReview{}, errors.New("connection refused")
+		default:
+			return accessReview{}, nil
+		}
+	}}
+
+	tests := []struct {
+		name   string
+		auth   EndpointAuth
+		path   string
+		header string
+		want   int
+	}{
+		{"disabled", EndpointAuth{}, "/stats", "", http.StatusOK},
+		{"unprotected", EndpointAuth{Enabled: true}, "/healthz", "", http.StatusOK},
+		{"metrics not protected", EndpointAuth{Enabled: true}, "/metrics", "", http.StatusOK},
+		{"metrics protected", EndpointAuth{Enabled: true, Metrics: true}, "/metrics", "", http.StatusUnauthorized},
+		{"missing token", EndpointAuth{Enabled: true}, "/stats", "", http.StatusUnauthorized},
+		{"not bearer", EndpointAuth{Enabled: true}, "/stats", "Basic cmVhZGVyOg==", http.StatusUnauthorized},
+		{"invalid token", EndpointAuth{Enabled: true}, "/stats", "Bearer invalid", http.StatusUnauthorized},
+		{"webhook missing token", EndpointAuth{Enabled: true}, "/webhook", "", http.StatusUnauthorized},
+		{"webhook allowed", EndpointAuth{Enabled: true}, "/webhook", "Bearer reader", http.StatusOK},
+		{"provisioner missing token", EndpointAuth{Enabled: true}, "/provisioner", "", http.StatusUnauthorized},
+		{"provisioner allowed", EndpointAuth{Enabled: true}, "/provisioner", "Bearer reader", http.StatusOK},
+		{"forbidden", EndpointAuth{Enabled: true}, "/recommendations", "Bearer other", http.StatusForbidden},
+		{"allowed", EndpointAuth{Enabled: true}, "/recommendations", "Bearer reader", http.StatusOK},
+		{"review error", EndpointAuth{Enabled: true}, "/stats", "Bearer error", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, http.NoBody)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			if a.authorize(w, r, &Config{EndpointAuth: tt.auth}) {
+				w.WriteHeader(http.StatusOK)
+			}
+			if w.Code != tt.want {
+				t.Errorf("authorize() = %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("authorize() did not set WWW-Authenticate")
+			}
+		})
+	}
+
+	// Reviews are cached by token and path, errors are not.
+	calls, a.reviews = 0, nil
+	config := &Config{EndpointAuth: EndpointAuth{Enabled: true}}
+	for _, req := range []struct{ token, path string }{
+		{"reader", "/stats"}, {"reader", "/stats"}, {"reader", "/recommendations"},
+		{"error", "/stats"}, {"error", "/stats"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, req.path, http.NoBody)
+		r.Header.Set("Authorization", "Bearer "+req.token)
+		a.authorize(httptest.NewRecorder(), r, config)
+	}
+	if calls != 4 {
+		t.Errorf("reviews = %d, want 4", calls)
+	}
+}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// enrollmentAPIPath is the path of the cluster-scoped AutocertEnrollment
+// resources.
+const enrollmentAPIPath = "apis/autocert.step.sm/v1alpha1/autocertenrollments"
+
+// Enrollment is an AutocertEnrollment: the onboarding of a namespace, named
+// after it, required for injection when requireEnrollment is set. Tenants
+// describe what they need in the spec, and platform admins approve it by
+// setting status.approvedGeneration through the status subresource, so
+// approval can be granted to a different set of users than creation.
+type Enrollment struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              EnrollmentSpec   `json:"spec,omitempty"`
+	Status            EnrollmentStatus `json:"status,omitempty"`
+}
+
+// EnrollmentSpec references the provisioner, SAN policy and quota of an
+// enrolled namespace.
+type EnrollmentSpec struct {
+	// Provisioner is the provisioner the namespace gets certificates from.
+	// It must match the one used by the controller.
+	Provisioner string `json:"provisioner,omitempty"`
+	// SANPolicy is the name of an entry in sanPolicies applied to the
+	// namespace, instead of its default SAN policy.
+	SANPolicy string `json:"sanPolicy,omitempty"`
+	// MaxCertificates is the maximum number of running pods with a
+	// certificate in the namespace, 0 means no limit.
+	MaxCertificates int `json:"maxCertificates,omitempty"`
+}
+
+// EnrollmentStatus records the approval of an enrollment.
+type EnrollmentStatus struct {
+	// ApprovedGeneration is the generation of the spec that was approved.
+	// Changes to the spec require a new approval.
+	ApprovedGeneration int64 `json:"approvedGeneration,omitempty"`
+	// ApprovedBy is who approved the enrollment, for auditing.
+	ApprovedBy string `json:"approvedBy,omitempty"`
+}
+
+// approved returns whether the current spec of the enrollment was approved.
+func (e *Enrollment) approved() bool {
+	return e.Status.ApprovedGeneration > 0 && e.Status.ApprovedGeneration == e.Generation
+}
+
+// checkEnrollment enforces the enrollment of a namespace when requireEnrollment
+// is set. It returns the SAN policy of the namespace, or an error if the pod
+// must be denied.
+func checkEnrollment(namespace string, config *Config, enrollments func(string) (*Enrollment, error), certificates func(string) (int, error)) (SANPolicy, error) {
+	policy := config.GetSANPolicy(namespace)
+	if !config.RequireEnrollment {
+		return policy, nil
+	}
+
+	e, err := enrollments(namespace)
+	if err != nil {
+		return policy, errors.Wrapf(err, "unable to check the enrollment of namespace %q", namespace)
+	}
+	if e == nil {
+		return policy, fmt.Errorf("namespace %q is not enrolled: ask your platform admins for an AutocertEnrollment named %q", namespace, namespace)
+	}
+	if !e.approved() {
+		return policy, fmt.Errorf("the AutocertEnrollment of namespace %q is pending approval by your platform admins", namespace)
+	}
+
+	if e.Spec.Provisioner != "" && e.Spec.Provisioner != config.GetProvisionerName() {
+		return policy, fmt.Errorf("the AutocertEnrollment of namespace %q references provisioner %q, but this controller uses %q", namespace, e.Spec.Provisioner, config.GetProvisionerName())
+	}
+	if e.Spec.SANPolicy != "" {
+		p, ok := config.SANPolicies[e.Spec.SANPolicy]
+		if !ok {
+			return policy, fmt.Errorf("the AutocertEnrollment of namespace %q references unknown SAN policy %q", namespace, e.Spec.SANPolicy)
+		}
+		policy = p
+	}
+	if e.Spec.MaxCertificates > 0 {
+		n, err := certificates(namespace)
+		if err != nil {
+			return policy, errors.Wrapf(err, "unable to check the certificate quota of namespace %q", namespace)
+		}
+		if n >= e.Spec.MaxCertificates {
+			return policy, fmt.Errorf("namespace %q reached its quota of %d certificates", namespace, e.Spec.MaxCertificates)
+		}
+	}
+
+	return policy, nil
+}
+
+// getEnrollment returns the AutocertEnrollment of a namespace, or nil if
+// there is none.
+func getEnrollment(namespace string) (*Enrollment, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := client.GetRequest(fmt.Sprintf("%s/%s", enrollmentAPIPath, namespace))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "get enrollment")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, errors.Errorf("get enrollment: %s", resp.Status)
+	}
+
+	var e Enrollment
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshalling enrollment")
+	}
+	return &e, nil
+}
+
+// countCertificates returns the number of running pods with a certificate in
+// the given namespace.
+func countCertificates(namespace string) (int, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := client.GetRequest(fmt.Sprintf("api/v1/namespaces/%s/pods", namespace))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "list pods")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, errors.Errorf("list pods: %s", resp.Status)
+	}
+
+	var list corev1.PodList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return 0, errors.Wrap(err, "Error unmarshalling pods")
+	}
+
+	var n int
+	for i := range list.Items {
+		pod := &list.Items[i]
+		if pod.Annotations[admissionWebhookStatusKey] != "injected" {
+			continue
+		}
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckEnrollment(t *testing.T) {
+	strict := SANPolicy{Wildcards: policyDeny}
+	config := &Config{
+		RequireEnrollment: true,
+		ProvisionerName:   "autocert",
+		SANPolicy:         SANPolicy{Wildcards: policyWarn},
+		SANPolicies:       map[string]SANPolicy{"strict": strict},
+	}
+	enrollment := func(spec EnrollmentSpec, approved int64) func(string) (*Enrollment, error) {
+		return func(string) (*Enrollment, error) {
+			return &Enrollment{
+				ObjectMeta: metav1.ObjectMeta{Name: "default", Generation: 2},
+				Spec:       spec,
+				Status:     EnrollmentStatus{ApprovedGeneration: approved},
+			}, nil
+		}
+	}
+	notEnrolled := func(string) (*Enrollment, error) { return nil, nil }
+	failing := func(string) (*Enrollment, error) { return nil, errors.New("forbidden") }
+	certificates := func(string) (int, error) { return 3, nil }
+
+	tests := []struct {
+		name        string
+		config      *Config
+		enrollments func(string) (*Enrollment, error)
+		want        SANPolicy
+		wantErr     bool
+	}{
+		{"not required", &Config{SANPolicy: strict}, notEnrolled, strict, false},
+		{"not enrolled", config, notEnrolled, SANPolicy{}, true},
+		{"error", config, failing, SANPolicy{}, true},
+		{"pending", config, enrollment(EnrollmentSpec{}, 0), SANPolicy{}, true},
+		{"spec changed", config, enrollment(EnrollmentSpec{}, 1), SANPolicy{}, true},
+		{"approved", config, enrollment(EnrollmentSpec{Provisioner: "autocert"}, 2), config.SANPolicy, false},
+		{"other provisioner", config, enrollment(EnrollmentSpec{Provisioner: "admin"}, 2), SANPolicy{}, true},
+		{"policy", config, enrollment(EnrollmentSpec{SANPolicy: "strict"}, 2), strict, false},
+		{"unknown policy", config, enrollment(EnrollmentSpec{SANPolicy: "lax"}, 2), SANPolicy{}, true},
+		{"under quota", config, enrollment(EnrollmentSpec{MaxCertificates: 4}, 2), config.SANPolicy, false},
+		{"quota reached", config, enrollment(EnrollmentSpec{MaxCertificates: 3}, 2), SANPolicy{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkEnrollment("default", tt.config, tt.enrollments, certificates)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkEnrollment() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("checkEnrollment() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// injectionFailedReason is the reason of the Events recorded when the
+	// webhook denies a pod or fails to inject it.
+	injectionFailedReason = "AutocertInjectionFailed"
+	// injectionSkippedReason is the reason of the Events recorded when an
+	// annotated pod is admitted without a certificate in shadow mode.
+	injectionSkippedReason = "AutocertInjectionSkipped"
+
+	// eventInterval is the minimum interval between two Events with the same
+	// reason on the same object, so a crash-looping ReplicaSet doesn't flood
+	// the API server with Events.
+	eventInterval = time.Minute
+	// maxRecentEvents bounds the Events remembered for eventInterval.
+	maxRecentEvents = 1024
+)
+
+// eventRecorder records the Events of the admission webhook in the
+// background, dropping the repeated ones.
+type eventRecorder struct {
+	mu     sync.Mutex
+	recent map[string]time.Time
+	now    func() time.Time
+	create func(namespace string, ref corev1.ObjectReference, eventType, reason, message string) error
+}
+
+// injectionEvents records the Events of the admission decisions.
+var injectionEvents = &eventRecorder{
+	recent: map[string]time.Time{},
+	now:    time.Now,
+	create: createEvent,
+}
+
+// record records an Event on ref unless an Event with the same reason was
+// recorded on it in the last eventInterval. It doesn't wait for the Event to
+// be created.
+func (e *eventRecorder) record(ref corev1.ObjectReference, eventType, reason, message string) {
+	key := ref.Namespace + "/" + ref.Kind + "/" + ref.Name + "/" + reason
+	now := e.now()
+
+	e.mu.Lock()
+	if last, ok := e.recent[key]; ok && now.Sub(last) < eventInterval {
+		e.mu.Unlock()
+		return
+	}
+	if len(e.recent) >= maxRecentEvents {
+		for k, last := range e.recent {
+			if now.Sub(last) >= eventInterval {
+				delete(e.recent, k)
+			}
+		}
+	}
+	if len(e.recent) < maxRecentEvents {
+		e.recent[key] = now
+	}
+	e.mu.Unlock()
+
+	go func() {
+		if err := e.create(ref.Namespace, ref, eventType, reason, message); err != nil {
+			log.WithFields(log.Fields{
+				"namespace": ref.Namespace,
+				"kind":      ref.Kind,
+				"name":      ref.Name,
+				"reason":    reason,
+				"error":     err,
+			}).Warn("Error recording event")
+		}
+	}()
+}
+
+// admissionEventObject returns the object to record the Events of the
+// admission of a pod on: the pod itself if it's named, or the controller
+// creating it, as pods created by controllers have no name until they're
+// admitted. It returns false if the pod has neither.
+func admissionEventObject(pod *corev1.Pod, namespace string) (corev1.ObjectReference, bool) {
+	if pod.Name != "" {
+		return corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  namespace,
+			Name:       pod.Name,
+		}, true
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		return corev1.ObjectReference{
+			APIVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+			Namespace:  namespace,
+			Name:       owner.Name,
+			UID:        owner.UID,
+		}, true
+	}
+	return corev1.ObjectReference{}, false
+}
+
+// recordAdmissionEvent records an Event for the admission of an annotated
+// pod that didn't get a certificate: a warning if the pod was denied, and a
+// normal Event if it was admitted as is in shadow mode.
+func recordAdmissionEvent(pod *corev1.Pod, namespace string, config *Config, response *v1beta1.AdmissionResponse) {
+	annotations := pod.GetAnnotations()
+	if annotations[admissionWebhookAnnotationKey] == "" || annotations[admissionWebhookStatusKey] == "injected" {
+		return
+	}
+	var eventType, reason, message string
+	switch {
+	case !response.Allowed:
+		eventType, reason = corev1.EventTypeWarning, injectionFailedReason
+		message = "The autocert webhook denied the pod"
+		if response.Result != nil && response.Result.Message != "" {
+			message = fmt.Sprintf("The autocert webhook denied the pod: %s", response.Result.Message)
+		}
+	case config.ShadowMode && response.Patch == nil:
+		eventType, reason = corev1.EventTypeNormal, injectionSkippedReason
+		message = "The autocert webhook is in shadow mode and admitted the pod without a certificate"
+	default:
+		return
+	}
+	if ref, ok := admissionEventObject(pod, namespace); ok {
+		injectionEvents.record(ref, eventType, reason, message)
+	}
+}
+
+// createEvent records an Event on an object.
+func createEvent(namespace string, ref corev1.ObjectReference, eventType, reason, message string) error {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	body, err := json.Marshal(corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: ref.Name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: ref,
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: "autocert"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Error marshaling event")
+	}
+
+	req, err := client.PostRequest(fmt.Sprintf("api/v1/namespaces/%s/events", namespace), string(body), "application/json")
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "create event")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("create event: %s", resp.Status)
+	}
+	return nil
+}
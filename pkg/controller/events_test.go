@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeEvent is an Event recorded by a fake eventRecorder.
+type fakeEvent struct {
+	ref                        corev1.ObjectReference
+	eventType, reason, message string
+}
+
+// fakeEventRecorder returns an eventRecorder sending the Events it records
+// to the returned channel.
+func fakeEventRecorder(now func() time.Time) (*eventRecorder, chan fakeEvent) {
+	events := make(chan fakeEvent, 16)
+	return &eventRecorder{
+		recent: map[string]time.Time{},
+		now:    now,
+		create: func(_ string, ref corev1.ObjectReference, eventType, reason, message string) error {
+			events <- fakeEvent{ref, eventType, reason, message}
+			return nil
+		},
+	}, events
+}
+
+// receive returns the next recorded Event, or false if none is recorded.
+func receive(events chan fakeEvent) (fakeEvent, bool) {
+	select {
+	case e := <-events:
+		return e, true
+	case <-time.After(100 * time.Millisecond):
+		return fakeEvent{}, false
+	}
+}
+
+func TestEventRecorder(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Now()
+	e, events := fakeEventRecorder(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	})
+	pod := corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "api"}
+
+	e.record(pod, corev1.EventTypeWarning, injectionFailedReason, "denied")
+	if _, ok := receive(events); !ok {
+		t.Fatal("event not recorded")
+	}
+	e.record(pod, corev1.EventTypeWarning, injectionFailedReason, "denied")
+	if got, ok := receive(events); ok {
+		t.Fatalf("repeated event recorded: %+v", got)
+	}
+	e.record(pod, corev1.EventTypeNormal, injectionSkippedReason, "skipped")
+	if _, ok := receive(events); !ok {
+		t.Fatal("event with another reason not recorded")
+	}
+
+	mu.Lock()
+	now = now.Add(eventInterval)
+	mu.Unlock()
+	e.record(pod, corev1.EventTypeWarning, injectionFailedReason, "denied")
+	if _, ok := receive(events); !ok {
+		t.Fatal("event not recorded after the interval")
+	}
+}
+
+func TestAdmissionEventObject(t *testing.T) {
+	isController := true
+	tests := []struct {
+		name   string
+		pod    corev1.Pod
+		want   corev1.ObjectReference
+		wantOK bool
+	}{
+		{"named", corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "api"}},
+			corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: "api"}, true},
+		{"owned", corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "api-7d9c5b7d4-", OwnerReferences: []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "api-7d9c5b7d4", UID: "uid", Controller: &isController},
+		}}}, corev1.ObjectReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Namespace: "default", Name: "api-7d9c5b7d4", UID: "uid"}, true},
+		{"anonymous", corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "api-"}}, corev1.ObjectReference{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := admissionEventObject(&tt.pod, "default")
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("admissionEventObject() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRecordAdmissionEvent(t *testing.T) {
+	defer func(e *eventRecorder) { injectionEvents = e }(injectionEvents)
+
+	annotated := func(name string, annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations}}
+	}
+	denied := &v1beta1.AdmissionResponse{Result: &metav1.Status{Message: "invalid annotation"}}
+	allowed := &v1beta1.AdmissionResponse{Allowed: true}
+	patched := &v1beta1.AdmissionResponse{Allowed: true, Patch: []byte("[]")}
+	name := map[string]string{admissionWebhookAnnotationKey: "api.default.svc"}
+
+	tests := []struct {
+		name       string
+		pod        *corev1.Pod
+		shadow     bool
+		response   *v1beta1.AdmissionResponse
+		wantReason string
+	}{
+		{"denied", annotated("denied", name), false, denied, injectionFailedReason},
+		{"patched", annotated("patched", name), false, patched, ""},
+		{"shadowed", annotated("shadowed", name), true, allowed, injectionSkippedReason},
+		{"not annotated", annotated("plain", nil), true, allowed, ""},
+		{"already injected", annotated("injected", map[string]string{
+			admissionWebhookAnnotationKey: "api.default.svc",
+			admissionWebhookStatusKey:     "injected",
+		}), false, denied, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events chan fakeEvent
+			injectionEvents, events = fakeEventRecorder(time.Now)
+			recordAdmissionEvent(tt.pod, "default", &Config{ShadowMode: tt.shadow}, tt.response)
+			got, ok := receive(events)
+			if got.reason != tt.wantReason {
+				t.Fatalf("event = %+v, want reason %q", got, tt.wantReason)
+			}
+			if ok && (got.ref.Name != tt.pod.Name || got.ref.Kind != "Pod") {
+				t.Errorf("event object = %+v, want the pod", got.ref)
+			}
+			if tt.wantReason == injectionFailedReason && !strings.Contains(got.message, "invalid annotation") {
+				t.Errorf("message = %q, want the reason of the denial", got.message)
+			}
+		})
+	}
+}
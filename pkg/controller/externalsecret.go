@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// externalSecretAnnotationKey mounts the certificate of an existing
+	// Secret, issued outside of autocert, instead of bootstrapping one.
+	externalSecretAnnotationKey = "autocert.step.sm/external-secret"
+	// verifyOnlyEnvVar tells the renewer to watch the expiry of the
+	// certificate without renewing it.
+	verifyOnlyEnvVar = "VERIFY_ONLY"
+	// externalStatusFile is the status file of verify-only renewers. The
+	// Secret volume is read-only.
+	externalStatusFile = "/tmp/renewal-status.json"
+)
+
+// externalSecretItems maps the keys of a kubernetes.io/tls Secret, with the
+// ca.crt key set by most issuers, to the files autocert writes.
+var externalSecretItems = []corev1.KeyToPath{
+	{Key: corev1.TLSCertKey, Path: "site.crt"},
+	{Key: corev1.TLSPrivateKeyKey, Path: "site.key"},
+	{Key: "ca.crt", Path: "root.crt"},
+}
+
+// externalSecret returns the name of the Secret with the certificate of a
+// pod issued outside of autocert, or "" if autocert issues it. It returns an
+// error if the protocol version in use doesn't support verify-only renewers:
+// they would try to renew the certificate with the CA.
+func externalSecret(annotations podAnnotations, config *Config) (string, error) {
+	name := annotations.ExternalSecret
+	if name == "" {
+		return "", nil
+	}
+	if v := envProtocolVersions[verifyOnlyEnvVar]; config.GetProtocolVersion() < v {
+		return "", annotationErrors{{
+			Key:    externalSecretAnnotationKey,
+			Value:  name,
+			Reason: fmt.Sprintf("requires protocol version %d, but version %d is pinned in the configuration", v, config.GetProtocolVersion()),
+		}}
+	}
+	return name, nil
+}
+
+// externalSecretVolume returns the certificates volume of a pod using the
+// certificate of the given Secret.
+func externalSecretVolume(config *Config, secretName string) corev1.Volume {
+	return corev1.Volume{
+		Name: config.CertsVolume.Name,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secretName,
+				Items:      slices.Clone(externalSecretItems),
+			},
+		},
+	}
+}
+
+// setVerifyOnly configures the renewer to watch the certificate of the
+// Secret without renewing it. It doesn't talk to the controller, which
+// doesn't trust the certificate, and it writes its status outside of the
+// read-only volume.
+func setVerifyOnly(renewer *corev1.Container) {
+	renewer.Env = slices.DeleteFunc(renewer.Env, func(e corev1.EnvVar) bool {
+		switch e.Name {
+		case "AUTOCERT_FREEZE_URL", "AUTOCERT_STATUS_URL", "AUTOCERT_REISSUE_URL", readyFileEnvVar:
+			return true
+		default:
+			return false
+		}
+	})
+	renewer.Env = setEnv(renewer.Env,
+		corev1.EnvVar{Name: verifyOnlyEnvVar, Value: "true"},
+		corev1.EnvVar{Name: "STATUS_FILE", Value: externalStatusFile},
+		corev1.EnvVar{Name: "CRT", Value: path.Join(volumeMountPath, "site.crt")},
+		corev1.EnvVar{Name: "KEY", Value: path.Join(volumeMountPath, "site.key")},
+		corev1.EnvVar{Name: "STEP_ROOT", Value: path.Join(volumeMountPath, "root.crt")},
+	)
+}
+
+// externalSecretPatch returns the patch of a pod using the certificate of
+// an existing Secret: the Secret is mounted at the usual path in place of
+// the certificates volume, with a verify-only renewer and no bootstrapper.
+func externalSecretPatch(pod *corev1.Pod, namespace string, config *Config, annotations podAnnotations, secretName string) ([]PatchOperation, error) {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == config.CertsVolume.Name {
+			return nil, fmt.Errorf("volume %s is reserved for the certificates of secret %s, rename the volume of the pod", v.Name, secretName)
+		}
+	}
+
+	name := pod.GetName()
+	if name == "" {
+		name = pod.GetGenerateName()
+	}
+	drain, err := waitForDrain(annotations, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []PatchOperation
+	mountOps, err := addCertsVolumeMount(config.CertsVolume.Name, pod.Spec.Containers, "containers", false)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, mountOps...)
+	mountOps, err = addCertsVolumeMount(config.CertsVolume.Name, pod.Spec.InitContainers, "initContainers", false)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, mountOps...)
+	if drain {
+		mountOps, err = addDrainVolumeMounts(pod.Spec.Containers)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, mountOps...)
+	}
+
+	volumes := []corev1.Volume{externalSecretVolume(config, secretName)}
+	podAnnotations := map[string]string{admissionWebhookStatusKey: "injected"}
+	if !annotations.BootstrapperOnly {
+		renewer := mkRenewer(config, name, annotations.CommonName, namespace)
+		setVerifyOnly(&renewer)
+		setRenewerMetrics(config, &renewer, pod, namespace)
+		setRenewerOTLP(config, &renewer)
+		if drain {
+			setDrain(&renewer, pod)
+			volumes = append(volumes, drainVolume())
+		}
+		if renewer.TerminationMessagePolicy == "" {
+			renewer.TerminationMessagePolicy = corev1.TerminationMessageFallbackToLogsOnError
+		}
+		if readOnlyRootFilesystem(pod) {
+			setReadOnlyRootFilesystem(&renewer)
+			volumes = append(volumes, scratchVolume())
+		}
+		scPod := pod
+		if config.OpenShift {
+			if scPod, err = openShiftPod(pod, namespace, namespaceAnnotations.get); err != nil {
+				return nil, err
+			}
+		}
+		if sc := nonRootSecurityContext(config, scPod, annotations.Owner); sc != nil {
+			setSecurityContext(&renewer, sc)
+		}
+		if useNativeSidecar(config, namespace) {
+			setNativeSidecar(&renewer)
+			if requests := sidecarRequests(renewer); requests != "" {
+				podAnnotations[sidecarRequestsAnnotationKey] = requests
+			}
+		}
+		ops = append(ops, addRenewer(pod, renewer)...)
+	}
+	ops = append(ops, addVolumes(pod.Spec.Volumes, volumes, "/spec/volumes")...)
+
+	for k, v := range withoutExisting(pod.Annotations, config.PodAnnotations) {
+		podAnnotations[k] = v
+	}
+	ops = append(ops, addAnnotations(pod.Annotations, podAnnotations)...)
+	ops = append(ops, addLabels(pod.Labels, withoutExisting(pod.Labels, config.PodLabels))...)
+	return ops, nil
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExternalSecret(t *testing.T) {
+	if name, err := externalSecret(podAnnotations{ExternalSecret: "legacy-tls"}, &Config{}); name != "legacy-tls" || err != nil {
+		t.Errorf("externalSecret() = %q, %v, want legacy-tls", name, err)
+	}
+	if name, err := externalSecret(podAnnotations{}, &Config{ProtocolVersion: 13}); name != "" || err != nil {
+		t.Errorf("externalSecret() without annotation = %q, %v", name, err)
+	}
+	var aerrs annotationErrors
+	if _, err := externalSecret(podAnnotations{ExternalSecret: "legacy-tls"}, &Config{ProtocolVersion: 13}); !errors.As(err, &aerrs) {
+		t.Errorf("externalSecret() with protocol 13 = %v, want an annotation error", err)
+	}
+
+	for _, v := range []string{"Legacy", "legacy_tls", "-legacy", ""} {
+		if _, err := parseAnnotations(map[string]string{externalSecretAnnotationKey: v}); err == nil {
+			t.Errorf("parseAnnotations(%q) should fail", v)
+		}
+	}
+}
+
+func TestExternalSecretPatch(t *testing.T) {
+	config := &Config{
+		CertsVolume: corev1.Volume{Name: "certs"},
+		Renewer:     corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: map[string]string{
+			admissionWebhookAnnotationKey: "app.default.svc",
+			externalSecretAnnotationKey:   "legacy-tls",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	annotations, err := parseAnnotations(pod.Annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := externalSecretPatch(pod, "default", config, annotations, "legacy-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var renewer *corev1.Container
+	var volume *corev1.Volume
+	for _, op := range ops {
+		switch op.Path {
+		case "/spec/initContainers", "/spec/initContainers/-":
+			t.Errorf("externalSecretPatch() adds an init container: %v", op.Value)
+		case "/spec/containers/-":
+			c := op.Value.(corev1.Container)
+			renewer = &c
+		case "/spec/volumes":
+			v := op.Value.([]corev1.Volume)[0]
+			volume = &v
+		}
+	}
+	if volume == nil || volume.Secret == nil || volume.Secret.SecretName != "legacy-tls" || len(volume.Secret.Items) != 3 {
+		t.Fatalf("externalSecretPatch() volume = %+v, want secret legacy-tls", volume)
+	}
+	if renewer == nil {
+		t.Fatal("externalSecretPatch() didn't add the renewer")
+	}
+	env := make(map[string]string)
+	for _, e := range renewer.Env {
+		env[e.Name] = e.Value
+	}
+	if env[verifyOnlyEnvVar] != "true" || env["STATUS_FILE"] != externalStatusFile || env["CRT"] != "/var/run/autocert.step.sm/site.crt" {
+		t.Errorf("renewer env = %v, want verify-only", env)
+	}
+	for _, name := range []string{"AUTOCERT_STATUS_URL", "AUTOCERT_FREEZE_URL", readyFileEnvVar} {
+		if _, ok := env[name]; ok {
+			t.Errorf("renewer env has %s", name)
+		}
+	}
+
+	pod.Spec.Volumes = []corev1.Volume{{Name: "certs"}}
+	if _, err := externalSecretPatch(pod, "default", config, annotations, "legacy-tls"); err == nil {
+		t.Error("externalSecretPatch() with a certs volume should fail")
+	}
+}
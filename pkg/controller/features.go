@@ -0,0 +1,209 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// featuresConfigMapName is the name of the ConfigMap, in the controller
+	// namespace, used to enable or disable features at runtime.
+	featuresConfigMapName = "autocert-features"
+	// featuresCacheTTL is how long the features ConfigMap is cached.
+	featuresCacheTTL = 10 * time.Second
+
+	// featureReissue gates the in-place re-issuance of certificates when the
+	// SANs of a pod change.
+	featureReissue = "reissue"
+	// featureNativeSidecar runs the renewer as a native sidecar, a
+	// restartable init container, on clusters supporting them.
+	featureNativeSidecar = "nativeSidecar"
+	// featureJobDuration derives the duration of the certificates of Job pods
+	// from their deadline.
+	featureJobDuration = "jobDuration"
+)
+
+// defaultFeatures lists the features gated by flags, with whether they are
+// enabled when no flag is set.
+var defaultFeatures = map[string]bool{
+	featureReissue:       true,
+	featureNativeSidecar: false,
+	featureJobDuration:   true,
+}
+
+// featureFlags holds the flags read from the features ConfigMap.
+var featureFlags = &featureState{fetch: fetchFeatureFlags}
+
+// featureFlag is a parsed flag. Flags are comma-separated lists of the
+// namespaces where a feature is enabled, with "*" for every namespace, and of
+// namespaces prefixed with "-" where it's disabled, which take precedence. For
+// instance, this flag enables re-issuance everywhere but in payments:
+//
+//	reissue: "*,-payments"
+//
+// "true" and "false" enable or disable a feature everywhere.
+type featureFlag struct {
+	all      bool
+	enabled  []string
+	disabled []string
+}
+
+// parseFeatureFlag parses the value of a flag.
+func parseFeatureFlag(v string) (featureFlag, error) {
+	var f featureFlag
+	for _, term := range strings.Split(v, ",") {
+		term = strings.TrimSpace(term)
+		switch {
+		case strings.EqualFold(term, "true"), term == "*":
+			f.all = true
+		case strings.EqualFold(term, "false"), term == "":
+		case strings.HasPrefix(term, "-") && len(term) > 1:
+			f.disabled = append(f.disabled, term[1:])
+		case strings.HasPrefix(term, "-"):
+			return featureFlag{}, fmt.Errorf("invalid term %q", term)
+		default:
+			f.enabled = append(f.enabled, term)
+		}
+	}
+	return f, nil
+}
+
+// enabledIn returns whether the flag enables its feature in the given
+// namespace.
+func (f featureFlag) enabledIn(namespace string) bool {
+	switch {
+	case slices.Contains(f.disabled, namespace):
+		return false
+	case slices.Contains(f.enabled, namespace):
+		return true
+	default:
+		return f.all
+	}
+}
+
+// validateFeatures returns an error if a flag in the configuration is
+// invalid or gates an unknown feature.
+func validateFeatures(c *Config) error {
+	for _, name := range slices.Sorted(maps.Keys(c.Features)) {
+		if _, ok := defaultFeatures[name]; !ok {
+			return fmt.Errorf("invalid features: unknown feature %q, known features are %v", name, slices.Sorted(maps.Keys(defaultFeatures)))
+		}
+		if _, err := parseFeatureFlag(c.Features[name]); err != nil {
+			return errors.Wrapf(err, "invalid features: feature %q", name)
+		}
+	}
+	return nil
+}
+
+// featureEnabled returns whether a feature is enabled in a namespace. Flags
+// in the features ConfigMap take precedence over the ones in the
+// configuration, so a feature can be rolled back without restarting the
+// controller.
+func featureEnabled(config *Config, feature, namespace string) bool {
+	v, ok := featureFlags.get(os.Getenv("NAMESPACE"))[feature]
+	if !ok {
+		v, ok = config.Features[feature]
+	}
+	if !ok {
+		return defaultFeatures[feature]
+	}
+	f, err := parseFeatureFlag(v)
+	if err != nil {
+		return defaultFeatures[feature]
+	}
+	return f.enabledIn(namespace)
+}
+
+// featureState caches the features ConfigMap.
+type featureState struct {
+	sync.Mutex
+	fetch   func(namespace string) (map[string]string, error)
+	flags   map[string]string
+	fetched time.Time
+}
+
+// get returns the flags currently set, reading the ConfigMap if the cached
+// value is stale. Errors reading the ConfigMap are logged and the last known
+// flags are kept. Invalid flags and unknown features are logged and ignored.
+func (s *featureState) get(namespace string) map[string]string {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.fetched) <= featuresCacheTTL {
+		return s.flags
+	}
+	s.fetched = now
+
+	data, err := s.fetch(namespace)
+	if err != nil {
+		log.WithField("error", err).Error("Error reading features ConfigMap")
+		return s.flags
+	}
+	flags := make(map[string]string, len(data))
+	for name, v := range data {
+		if _, ok := defaultFeatures[name]; !ok {
+			log.WithField("feature", name).Warn("Ignoring unknown feature in features ConfigMap")
+			continue
+		}
+		if _, err := parseFeatureFlag(v); err != nil {
+			log.WithFields(log.Fields{
+				"feature": name,
+				"error":   err,
+			}).Warn("Ignoring invalid flag in features ConfigMap")
+			continue
+		}
+		flags[name] = v
+	}
+	if !maps.Equal(flags, s.flags) {
+		log.WithFields(log.Fields{
+			"audit": true,
+			"flags": flags,
+		}).Warn("Feature flags changed")
+		s.flags = flags
+	}
+	return s.flags
+}
+
+// fetchFeatureFlags reads the features ConfigMap in the given namespace. A
+// missing ConfigMap means no flags.
+func fetchFeatureFlags(namespace string) (map[string]string, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := client.GetRequest(fmt.Sprintf("api/v1/namespaces/%s/configmaps/%s", namespace, featuresConfigMapName))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "get features ConfigMap")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, errors.Errorf("get features ConfigMap: %s", resp.Status)
+	}
+
+	var cm corev1.ConfigMap
+	if err := json.NewDecoder(resp.Body).Decode(&cm); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshalling features ConfigMap")
+	}
+	return cm.Data, nil
+}
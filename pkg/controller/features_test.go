@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFeatureFlag(t *testing.T) {
+	tests := []struct {
+		flag      string
+		namespace string
+		want      bool
+		wantErr   bool
+	}{
+		{"true", "default", true, false},
+		{"TRUE", "default", true, false},
+		{"false", "default", false, false},
+		{"", "default", false, false},
+		{"*", "default", true, false},
+		{"team-a, team-b", "team-b", true, false},
+		{"team-a,team-b", "default", false, false},
+		{"*,-payments", "payments", false, false},
+		{"*,-payments", "default", true, false},
+		{"payments,-payments", "payments", false, false},
+		{"*,-", "default", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag+"/"+tt.namespace, func(t *testing.T) {
+			f, err := parseFeatureFlag(tt.flag)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFeatureFlag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := f.enabledIn(tt.namespace); got != tt.want {
+				t.Errorf("enabledIn() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFeatures(t *testing.T) {
+	tests := []struct {
+		name     string
+		features map[string]string
+		wantErr  bool
+	}{
+		{"empty", nil, false},
+		{"ok", map[string]string{featureReissue: "*,-payments"}, false},
+		{"unknown feature", map[string]string{"teleport": "true"}, true},
+		{"invalid flag", map[string]string{featureReissue: "-"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateFeatures(&Config{Features: tt.features}); (err != nil) != tt.wantErr {
+				t.Errorf("validateFeatures() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFeatureEnabled(t *testing.T) {
+	var data map[string]string
+	var fetchErr error
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+
+	// refresh replaces the features ConfigMap, bypassing the cache.
+	refresh := func(d map[string]string, err error) {
+		data, fetchErr = d, err
+		featureFlags.fetched = time.Time{}
+	}
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) {
+		return data, fetchErr
+	}}
+	config := &Config{Features: map[string]string{featureReissue: "team-a"}}
+
+	// Features default to their default without flags.
+	if !featureEnabled(&Config{}, featureReissue, "default") {
+		t.Error("featureEnabled() = false without flags, want the default")
+	}
+
+	// The configuration sets the flag.
+	refresh(nil, nil)
+	if featureEnabled(config, featureReissue, "default") || !featureEnabled(config, featureReissue, "team-a") {
+		t.Error("featureEnabled() does not follow the configuration")
+	}
+
+	// The ConfigMap takes precedence, ignoring unknown features and invalid
+	// flags.
+	refresh(map[string]string{featureReissue: "false", "teleport": "true"}, nil)
+	if featureEnabled(config, featureReissue, "team-a") {
+		t.Error("featureEnabled() does not follow the ConfigMap")
+	}
+	if flags := featureFlags.get(""); len(flags) != 1 {
+		t.Errorf("flags = %v, want unknown features ignored", flags)
+	}
+	refresh(map[string]string{featureReissue: "-"}, nil)
+	if !featureEnabled(config, featureReissue, "team-a") {
+		t.Error("featureEnabled() does not ignore invalid flags")
+	}
+
+	// Errors reading the ConfigMap keep the last known flags.
+	refresh(map[string]string{featureReissue: "false"}, nil)
+	featureEnabled(config, featureReissue, "team-a")
+	refresh(nil, errors.New("connection refused"))
+	if featureEnabled(config, featureReissue, "team-a") {
+		t.Error("featureEnabled() does not keep the last known flags on errors")
+	}
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// freezeConfigMapName is the name of the ConfigMap, in the controller
+	// namespace, used to freeze issuance or renewals during an incident.
+	freezeConfigMapName = "autocert-freeze"
+	// freezeCacheTTL is how long the freeze ConfigMap is cached.
+	freezeCacheTTL = 10 * time.Second
+	// maxFreezeDuration is the lifetime of a freeze without an explicit
+	// expiration, counted from the creation of the ConfigMap.
+	maxFreezeDuration = 24 * time.Hour
+)
+
+// issuanceFreeze holds the current freeze state of the cluster.
+var issuanceFreeze = &freezeState{}
+
+// Freeze describes a time-bound, cluster-wide halt of new issuance, renewals
+// or both. It is read from the autocert-freeze ConfigMap:
+//
+//	data:
+//	  issuance: "true"
+//	  renewal: "false"
+//	  expires: "2024-01-02T15:04:05Z"
+//	  reason: "INC-1234 CA key compromise investigation"
+type Freeze struct {
+	Issuance bool      `json:"issuance"`
+	Renewal  bool      `json:"renewal"`
+	Expires  time.Time `json:"expires,omitzero"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// active returns the freeze in effect at the given time, which is empty once
+// the freeze has expired.
+func (f Freeze) active(now time.Time) Freeze {
+	if f.Expires.IsZero() || now.After(f.Expires) {
+		return Freeze{}
+	}
+	return f
+}
+
+// issuanceError returns the error returned to pods requesting a certificate
+// while issuance is frozen.
+func (f Freeze) issuanceError() error {
+	return fmt.Errorf("new certificate issuance is frozen until %s: %s. Delete the %s ConfigMap to lift the freeze", f.Expires.Format(time.RFC3339), f.Reason, freezeConfigMapName)
+}
+
+// parseFreeze reads a Freeze from a ConfigMap.
+func parseFreeze(cm *corev1.ConfigMap) (Freeze, error) {
+	f := Freeze{
+		Issuance: strings.EqualFold(cm.Data["issuance"], "true"),
+		Renewal:  strings.EqualFold(cm.Data["renewal"], "true"),
+		Reason:   cm.Data["reason"],
+	}
+	if f.Reason == "" {
+		f.Reason = "no reason given"
+	}
+
+	maxExpires := cm.CreationTimestamp.Add(maxFreezeDuration)
+	if v := cm.Data["expires"]; v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return Freeze{}, errors.Wrapf(err, "invalid expires %q in %s ConfigMap", v, freezeConfigMapName)
+		}
+		f.Expires = t
+	} else {
+		f.Expires = maxExpires
+	}
+
+	return f, nil
+}
+
+// freezeState caches the freeze ConfigMap.
+type freezeState struct {
+	sync.Mutex
+	freeze  Freeze
+	fetched time.Time
+}
+
+// get returns the freeze currently in effect, reading the ConfigMap if the
+// cached value is stale. Errors reading the ConfigMap are logged and the last
+// known state is kept.
+func (s *freezeState) get(namespace string) Freeze {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.fetched) > freezeCacheTTL {
+		s.fetched = now
+		f, err := fetchFreeze(namespace)
+		if err != nil {
+			log.WithField("error", err).Error("Error reading freeze ConfigMap")
+		} else if f != s.freeze {
+			log.WithFields(log.Fields{
+				"audit":    true,
+				"issuance": f.Issuance,
+				"renewal":  f.Renewal,
+				"expires":  f.Expires,
+				"reason":   f.Reason,
+			}).Warn("Freeze changed")
+			s.freeze = f
+		}
+	}
+
+	return s.freeze.active(now)
+}
+
+// fetchFreeze reads the freeze ConfigMap in the given namespace. A missing
+// ConfigMap means no freeze.
+func fetchFreeze(namespace string) (Freeze, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return Freeze{}, err
+	}
+
+	req, err := client.GetRequest(fmt.Sprintf("api/v1/namespaces/%s/configmaps/%s", namespace, freezeConfigMapName))
+	if err != nil {
+		return Freeze{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Freeze{}, errors.Wrap(err, "get freeze ConfigMap")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return Freeze{}, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return Freeze{}, errors.Errorf("get freeze ConfigMap: %s", resp.Status)
+	}
+
+	var cm corev1.ConfigMap
+	if err := json.NewDecoder(resp.Body).Decode(&cm); err != nil {
+		return Freeze{}, errors.Wrap(err, "Error unmarshalling freeze ConfigMap")
+	}
+	return parseFreeze(&cm)
+}
+
+// freezeHandler returns the freeze currently in effect. Renewers call it
+// before each renewal.
+func freezeHandler(w http.ResponseWriter, namespace string) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(issuanceFreeze.get(namespace)); err != nil {
+		log.WithField("error", err).Info("Write error")
+	}
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestParseFreeze(t *testing.T) {
+	created := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	configMap := func(data map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(created)},
+			Data:       data,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    Freeze
+		wantErr bool
+	}{
+		{"issuance", map[string]string{"issuance": "true", "expires": "2024-01-02T12:00:00Z", "reason": "incident"},
+			Freeze{Issuance: true, Expires: created.Add(12 * time.Hour), Reason: "incident"}, false},
+		{"renewal", map[string]string{"renewal": "True", "expires": "2024-01-02T12:00:00Z"},
+			Freeze{Renewal: true, Expires: created.Add(12 * time.Hour), Reason: "no reason given"}, false},
+		{"default expiration", map[string]string{"issuance": "true", "reason": "incident"},
+			Freeze{Issuance: true, Expires: created.Add(maxFreezeDuration), Reason: "incident"}, false},
+		{"invalid expiration", map[string]string{"issuance": "true", "expires": "tomorrow"}, Freeze{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFreeze(configMap(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFreeze() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Expires.Equal(tt.want.Expires) || got.Issuance != tt.want.Issuance || got.Renewal != tt.want.Renewal || got.Reason != tt.want.Reason {
+				t.Errorf("parseFreeze() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFreezeActive(t *testing.T) {
+	now := time.Now()
+	f := Freeze{Issuance: true, Expires: now.Add(time.Hour)}
+	if got := f.active(now); !got.Issuance {
+		t.Errorf("active() = %+v, want issuance frozen", got)
+	}
+	if got := f.active(now.Add(2 * time.Hour)); got.Issuance {
+		t.Errorf("active() after expiration = %+v, want no freeze", got)
+	}
+}
+
+func TestMutateIssuanceFrozen(t *testing.T) {
+	issuanceFreeze.Lock()
+	issuanceFreeze.freeze = Freeze{Issuance: true, Expires: time.Now().Add(time.Hour), Reason: "incident"}
+	issuanceFreeze.fetched = time.Now()
+	issuanceFreeze.Unlock()
+	t.Cleanup(func() {
+		issuanceFreeze.Lock()
+		issuanceFreeze.freeze = Freeze{}
+		issuanceFreeze.fetched = time.Time{}
+		issuanceFreeze.Unlock()
+	})
+
+	raw, err := json.Marshal(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{admissionWebhookAnnotationKey: "test.default.svc"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			UID:       "uid",
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+
+	resp := mutate(context.Background(), review, &Config{}, nil)
+	if resp.Allowed || resp.Result == nil || resp.Result.Message == "" {
+		t.Errorf("mutate() while frozen = %+v, want denied", resp)
+	}
+}
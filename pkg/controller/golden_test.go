@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	autocerttest "github.com/smallstep/autocert/pkg/testing"
+	"k8s.io/api/admission/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+// goldenMutator runs mutate with the configuration of a golden case.
+func goldenMutator(t testing.TB, c autocerttest.Case) *v1beta1.AdmissionResponse {
+	var config Config
+	if err := yaml.Unmarshal(c.Config, &config); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateSANPolicies(&config); err != nil {
+		t.Fatal(err)
+	}
+	return mutate(context.Background(), c.Review, &config, nil)
+}
+
+// TestGolden runs the published golden cases, and the cases in
+// $AUTOCERT_GOLDEN_DIR if set, so custom settings can be regression-tested
+// with:
+//
+//	AUTOCERT_GOLDEN_DIR=/path/to/cases go test ./controller -run TestGolden
+func TestGolden(t *testing.T) {
+	autocerttest.Run(t, autocerttest.Golden(), goldenMutator)
+
+	if dir := os.Getenv("AUTOCERT_GOLDEN_DIR"); dir != "" {
+		t.Run("custom", func(t *testing.T) {
+			autocerttest.RunDir(t, dir, goldenMutator)
+		})
+	}
+}
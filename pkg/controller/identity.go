@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// spiffeIDAnnotationKey sets the SPIFFE ID of a pod, replacing the workload
+// identity derived from its service account.
+const spiffeIDAnnotationKey = "autocert.step.sm/spiffe-id"
+
+// workloadIdentity returns the URI SAN identifying a workload when a trust
+// domain is configured, or an empty string otherwise. The URI follows the
+// SPIFFE conventions for Kubernetes and, if a cluster name is configured,
+// encodes the origin cluster so a CA shared by many clusters issues identities
+// that can be told apart:
+//
+//	spiffe://<trustDomain>/cluster/<clusterName>/ns/<namespace>/sa/<serviceAccount>
+func workloadIdentity(config *Config, namespace, serviceAccount string) string {
+	if config.TrustDomain == "" {
+		return ""
+	}
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+
+	u := url.URL{
+		Scheme: "spiffe",
+		Host:   config.TrustDomain,
+		Path:   identityPathPrefix(config, namespace) + "sa/" + serviceAccount,
+	}
+	return u.String()
+}
+
+// identityPathPrefix returns the prefix of the paths of the SPIFFE IDs of a
+// namespace.
+func identityPathPrefix(config *Config, namespace string) string {
+	path := fmt.Sprintf("/ns/%s/", namespace)
+	if config.ClusterName != "" {
+		path = fmt.Sprintf("/cluster/%s%s", config.ClusterName, path)
+	}
+	return path
+}
+
+// podIdentity returns the URI SAN identifying a pod: the SPIFFE ID in its
+// spiffe-id annotation, or its workload identity. An X.509 SVID has a single
+// URI SAN, so the annotation replaces the workload identity. The annotated ID
+// must be in the trust domain, if one is configured, and under the path of
+// the namespace of the pod, so pods can't take the identity of workloads in
+// other namespaces.
+func podIdentity(config *Config, namespace, serviceAccount string, annotations map[string]string) (string, error) {
+	id, ok := annotations[spiffeIDAnnotationKey]
+	if !ok {
+		return workloadIdentity(config, namespace, serviceAccount), nil
+	}
+	u, err := url.Parse(id)
+	if err != nil {
+		return "", annotationErrors{{Key: spiffeIDAnnotationKey, Value: id, Reason: "is not a valid SPIFFE ID"}}
+	}
+	if config.TrustDomain != "" && u.Host != config.TrustDomain {
+		return "", annotationErrors{{
+			Key:    spiffeIDAnnotationKey,
+			Value:  id,
+			Reason: fmt.Sprintf("is not in the trust domain %s", config.TrustDomain),
+		}}
+	}
+	if prefix := identityPathPrefix(config, namespace); !strings.HasPrefix(u.Path, prefix) {
+		return "", annotationErrors{{
+			Key:    spiffeIDAnnotationKey,
+			Value:  id,
+			Reason: fmt.Sprintf("is not in namespace %s", namespace),
+			Format: fmt.Sprintf("a path starting with %s", prefix),
+		}}
+	}
+	return id, nil
+}
+
+// checkSPIFFEID returns why a value is not a SPIFFE ID: a spiffe URI with a
+// trust domain and a path, without port, user, query or fragment.
+func checkSPIFFEID(v string) string {
+	u, err := url.Parse(v)
+	switch {
+	case err != nil || u.Scheme != "spiffe" || u.Opaque != "":
+		return "is not a spiffe URI"
+	case u.Host == "" || u.Port() != "" || u.User != nil || strings.ToLower(u.Host) != u.Host || !isDNSName(u.Host):
+		return "doesn't have a valid trust domain"
+	case u.Path == "" || u.Path == "/" || strings.HasSuffix(u.Path, "/") || strings.Contains(u.Path, "//"):
+		return "doesn't have a valid path"
+	case strings.Contains(u.Path, "/./") || strings.Contains(u.Path, "/../") || strings.HasSuffix(u.Path, "/.") || strings.HasSuffix(u.Path, "/.."):
+		return "has a relative path segment"
+	case u.RawQuery != "" || u.ForceQuery || u.Fragment != "" || strings.Contains(v, "#"):
+		return "has a query or a fragment"
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// identityEnvAnnotationKey sets environment variables with the names and
+	// the file locations of the certificate in the application containers.
+	identityEnvAnnotationKey = "autocert.step.sm/identity-env"
+
+	// The environment variables of the application containers.
+	identityNameEnvVar     = "AUTOCERT_NAME"
+	identitySANsEnvVar     = "AUTOCERT_SANS"
+	identityCertPathEnvVar = "AUTOCERT_CERT_PATH"
+	identityKeyPathEnvVar  = "AUTOCERT_KEY_PATH"
+	identityRootPathEnvVar = "AUTOCERT_ROOT_PATH"
+)
+
+// identityEnv returns whether the application containers of a pod get the
+// identity environment variables. It returns an error for pods mounting a
+// Secret they don't manage: the names of its certificate are not known.
+func identityEnv(annotations podAnnotations) (bool, error) {
+	if !annotations.IdentityEnv {
+		return false, nil
+	}
+	if annotations.ExternalSecret != "" {
+		return false, annotationErrors{{
+			Key:    identityEnvAnnotationKey,
+			Value:  "true",
+			Reason: "the names of the certificate in the Secret are not known, the pod is annotated with " + externalSecretAnnotationKey,
+		}}
+	}
+	return true, nil
+}
+
+// identityEnvVars returns the identity environment variables of a
+// certificate. The files are the ones in the certificates volume, also
+// written with keystores.
+func identityEnvVars(commonName string, sans []string) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: identityNameEnvVar, Value: commonName},
+		{Name: identitySANsEnvVar, Value: strings.Join(sans, ",")},
+		{Name: identityCertPathEnvVar, Value: path.Join(volumeMountPath, "site.crt")},
+		{Name: identityKeyPathEnvVar, Value: path.Join(volumeMountPath, "site.key")},
+		{Name: identityRootPathEnvVar, Value: path.Join(volumeMountPath, "root.crt")},
+	}
+}
+
+// addIdentityEnv adds the identity environment variables to the containers.
+// Variables the containers already define are kept.
+func addIdentityEnv(containers []corev1.Container, env []corev1.EnvVar) (ops []PatchOperation) {
+	for i, c := range containers {
+		defined := make(map[string]bool, len(c.Env))
+		for _, e := range c.Env {
+			defined[e.Name] = true
+		}
+		var missing []corev1.EnvVar
+		for _, e := range env {
+			if !defined[e.Name] {
+				missing = append(missing, e)
+			}
+		}
+		switch {
+		case len(missing) == 0:
+		case len(c.Env) == 0:
+			ops = append(ops, PatchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/containers/%d/env", i),
+				Value: missing,
+			})
+		default:
+			for _, e := range missing {
+				ops = append(ops, PatchOperation{
+					Op:    "add",
+					Path:  fmt.Sprintf("/spec/containers/%d/env/-", i),
+					Value: e,
+				})
+			}
+		}
+	}
+	return ops
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIdentityEnv(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	tokenSecrets = &fakeSecrets{}
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+
+	rootFile, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	config := &Config{
+		CaURL:        "https://ca",
+		RootCAPath:   rootFile,
+		CertsVolume:  corev1.Volume{Name: "certs"},
+		Bootstrapper: corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper"},
+		Renewer:      corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Annotations: map[string]string{
+			admissionWebhookAnnotationKey: "api.default.svc",
+			sansAnnotationKey:             "api.default.svc,api",
+			identityEnvAnnotationKey:      "true",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "api"},
+			{Name: "proxy", Env: []corev1.EnvVar{{Name: "LISTEN", Value: ":8443"}, {Name: identityRootPathEnvVar, Value: "/etc/ca.crt"}}},
+		}},
+	}
+
+	b, err := patch(context.Background(), pod, "default", config, fakeTokens{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []PatchOperation
+	if err := json.Unmarshal(b, &ops); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := toJSONValue(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = json.Marshal(applyPatch(t, doc, ops)); err != nil {
+		t.Fatal(err)
+	}
+	var patched corev1.Pod
+	if err := json.Unmarshal(b, &patched); err != nil {
+		t.Fatal(err)
+	}
+	env := make(map[string]map[string]string)
+	for _, c := range patched.Spec.Containers {
+		env[c.Name] = make(map[string]string)
+		for _, e := range c.Env {
+			env[c.Name][e.Name] = e.Value
+		}
+	}
+	want := map[string]string{
+		identityNameEnvVar:     "api.default.svc",
+		identitySANsEnvVar:     "api.default.svc,api",
+		identityCertPathEnvVar: "/var/run/autocert.step.sm/site.crt",
+		identityKeyPathEnvVar:  "/var/run/autocert.step.sm/site.key",
+		identityRootPathEnvVar: "/var/run/autocert.step.sm/root.crt",
+	}
+	for k, v := range want {
+		if env["api"][k] != v {
+			t.Errorf("api %s = %q, want %q", k, env["api"][k], v)
+		}
+	}
+	// Variables set by the pod are kept.
+	if got := env["proxy"]; got[identityNameEnvVar] != "api.default.svc" || got[identityRootPathEnvVar] != "/etc/ca.crt" || got["LISTEN"] != ":8443" {
+		t.Errorf("proxy env = %v, want the identity and its own variables", got)
+	}
+	if _, ok := env["autocert-renewer"][identityNameEnvVar]; ok {
+		t.Errorf("the renewer got %s", identityNameEnvVar)
+	}
+
+	pod.Annotations[externalSecretAnnotationKey] = "api-tls"
+	_, err = patch(context.Background(), pod, "default", config, fakeTokens{})
+	var aerrs annotationErrors
+	if !errors.As(err, &aerrs) || aerrs[0].Key != identityEnvAnnotationKey {
+		t.Errorf("patch() with an external secret = %v, want an annotation error", err)
+	}
+}
+
+func TestIdentityEnvManagedSecret(t *testing.T) {
+	now := time.Now()
+	issuer, _, _ := fakeSecretIssuer(t, &now)
+	defer func(s *secretIssuer) { managedSecrets = s }(managedSecrets)
+	managedSecrets = issuer
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "ingress", Annotations: map[string]string{
+			admissionWebhookAnnotationKey: "ingress.edge.svc",
+			secretAnnotationKey:           "ingress-tls",
+			identityEnvAnnotationKey:      "true",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "ingress"}}},
+	}
+	b, err := patch(context.Background(), pod, "edge", secretIssuanceConfig(t), fakeTokens{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []PatchOperation
+	if err := json.Unmarshal(b, &ops); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := toJSONValue(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = json.Marshal(applyPatch(t, doc, ops)); err != nil {
+		t.Fatal(err)
+	}
+	var patched corev1.Pod
+	if err := json.Unmarshal(b, &patched); err != nil {
+		t.Fatal(err)
+	}
+	env := make(map[string]string)
+	for _, e := range patched.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	want := map[string]string{
+		identityNameEnvVar:     "ingress.edge.svc",
+		identitySANsEnvVar:     "ingress.edge.svc",
+		identityCertPathEnvVar: "/var/run/autocert.step.sm/site.crt",
+		identityKeyPathEnvVar:  "/var/run/autocert.step.sm/site.key",
+		identityRootPathEnvVar: "/var/run/autocert.step.sm/root.crt",
+	}
+	for k, v := range want {
+		if env[k] != v {
+			t.Errorf("ingress %s = %q, want %q", k, env[k], v)
+		}
+	}
+}
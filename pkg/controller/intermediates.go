@@ -0,0 +1,314 @@
+package controller
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/ca"
+	"go.step.sm/crypto/pemutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// intermediateAnnotationKey selects the constrained intermediate issuing the
+// certificate of a pod, instead of the default one of its namespace.
+const intermediateAnnotationKey = "autocert.step.sm/intermediate"
+
+// ConstrainedIntermediate issues the certificates of some namespaces under
+// an intermediate with name constraints, signing with its own CA. Clients
+// verifying the chains enforce the constraints, so a tenant can't get a
+// certificate for the names of another, even if policies are bypassed.
+type ConstrainedIntermediate struct {
+	// Name is the value of the autocert.step.sm/intermediate annotation
+	// selecting the intermediate.
+	Name string `yaml:"name"`
+	// Namespaces are the namespaces whose pods can use the intermediate. It
+	// issues the certificates of the namespaces it's the first to list.
+	Namespaces []string `yaml:"namespaces"`
+	// CaURL is the URL of the CA signing with the intermediate, used by the
+	// bootstrapper and the renewer.
+	CaURL string `yaml:"caUrl"`
+	// Certificate is the path of the certificate of the intermediate. The
+	// names of the pods are checked against its constraints at admission.
+	Certificate             string `yaml:"certificate"`
+	ProvisionerName         string `yaml:"provisionerName"`
+	ProvisionerKid          string `yaml:"provisionerKid"`
+	ProvisionerPasswordPath string `yaml:"provisionerPasswordPath"`
+
+	// constraints checks the names of the pods, loaded by loadConfig.
+	constraints *nameConstraints
+	// tokens generates the bootstrap tokens, loaded by Start.
+	tokens TokenManager
+}
+
+// validateConstrainedIntermediates returns an error if a constrained
+// intermediate is not valid, and loads the constraints of the valid ones.
+func validateConstrainedIntermediates(c *Config) error {
+	if len(c.ConstrainedIntermediates) == 0 {
+		return nil
+	}
+	if c.TokenBinding {
+		return errors.New("constrainedIntermediates can't be used with tokenBinding")
+	}
+	roots, err := pemutil.ReadCertificateBundle(c.GetRootCAPath())
+	if err != nil {
+		return errors.Wrap(err, "constrainedIntermediates")
+	}
+	pool := x509.NewCertPool()
+	for _, root := range roots {
+		pool.AddCert(root)
+	}
+
+	names := make(map[string]bool)
+	for i := range c.ConstrainedIntermediates {
+		ci := &c.ConstrainedIntermediates[i]
+		if checkIntermediateName(ci.Name) != "" {
+			return errors.Errorf("constrainedIntermediates name %q must be a lowercase DNS label", ci.Name)
+		}
+		if names[ci.Name] {
+			return errors.Errorf("constrainedIntermediates %s is listed twice", ci.Name)
+		}
+		names[ci.Name] = true
+
+		switch u, err := url.Parse(ci.CaURL); {
+		case len(ci.Namespaces) == 0:
+			return errors.Errorf("constrainedIntermediates %s has no namespaces", ci.Name)
+		case err != nil || u.Scheme != "https" || u.Host == "":
+			return errors.Errorf("constrainedIntermediates %s caUrl %q must be an https URL", ci.Name, ci.CaURL)
+		case ci.ProvisionerName == "" || ci.ProvisionerKid == "" || ci.ProvisionerPasswordPath == "":
+			return errors.Errorf("constrainedIntermediates %s requires provisionerName, provisionerKid and provisionerPasswordPath", ci.Name)
+		}
+		for _, ns := range ci.Namespaces {
+			if slices.Contains(c.CSRNamespaces, ns) {
+				return errors.Errorf("constrainedIntermediates %s: namespace %s is in csrNamespaces, its certificates are not signed by the intermediate", ci.Name, ns)
+			}
+		}
+
+		crt, err := pemutil.ReadCertificate(ci.Certificate)
+		if err != nil {
+			return errors.Wrapf(err, "constrainedIntermediates %s", ci.Name)
+		}
+		if _, err := crt.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+			return errors.Wrapf(err, "constrainedIntermediates %s is not issued by the root", ci.Name)
+		}
+		if ci.constraints, err = newNameConstraints(crt); err != nil {
+			return errors.Wrapf(err, "constrainedIntermediates %s", ci.Name)
+		}
+	}
+	return nil
+}
+
+func checkIntermediateName(v string) string {
+	if !labelRegexp.MatchString(v) || strings.ToLower(v) != v || strings.Contains(v, "_") {
+		return "is not a valid intermediate name"
+	}
+	return ""
+}
+
+// loadIntermediateProvisioners loads the provisioners of the constrained
+// intermediates.
+func loadIntermediateProvisioners(config *Config) error {
+	for i := range config.ConstrainedIntermediates {
+		ci := &config.ConstrainedIntermediates[i]
+		if ci.tokens != nil {
+			continue
+		}
+		password, err := readPasswordFromFile(ci.ProvisionerPasswordPath)
+		if err != nil {
+			return err
+		}
+		p, err := ca.NewProvisioner(ci.ProvisionerName, ci.ProvisionerKid, ci.CaURL, password,
+			ca.WithRootFile(config.GetRootCAPath()))
+		if err != nil {
+			return errors.Wrapf(err, "error loading the provisioner of intermediate %s", ci.Name)
+		}
+		ci.tokens = p
+		log.WithFields(log.Fields{
+			"intermediate": ci.Name,
+			"caURL":        ci.CaURL,
+			"name":         p.Name(),
+			"kid":          p.Kid(),
+		}).Info("Loaded provisioner of constrained intermediate")
+	}
+	return nil
+}
+
+// constrainedIntermediate returns the intermediate issuing the certificate
+// of a pod: the one set in its annotations, or the default one of its
+// namespace. It returns nil if the pod uses the CA in the configuration.
+func constrainedIntermediate(annotations podAnnotations, namespace string, config *Config) (*ConstrainedIntermediate, error) {
+	for i := range config.ConstrainedIntermediates {
+		ci := &config.ConstrainedIntermediates[i]
+		if annotations.Intermediate != "" && ci.Name != annotations.Intermediate {
+			continue
+		}
+		if slices.Contains(ci.Namespaces, namespace) {
+			return ci, nil
+		}
+		if annotations.Intermediate != "" {
+			return nil, annotationErrors{{
+				Key:    intermediateAnnotationKey,
+				Value:  annotations.Intermediate,
+				Reason: "the intermediate can't be used in namespace " + namespace,
+			}}
+		}
+	}
+	if annotations.Intermediate != "" {
+		return nil, annotationErrors{{
+			Key:    intermediateAnnotationKey,
+			Value:  annotations.Intermediate,
+			Reason: "no constrained intermediate with this name is configured",
+		}}
+	}
+	return nil, nil
+}
+
+// intermediateTokens returns the manager generating the tokens of an
+// intermediate, or fallback if name is empty.
+func intermediateTokens(config *Config, name string, fallback TokenManager) (TokenManager, error) {
+	if name == "" {
+		return fallback, nil
+	}
+	for _, ci := range config.ConstrainedIntermediates {
+		if ci.Name == name {
+			return ci.tokens, nil
+		}
+	}
+	return nil, errors.Errorf("constrained intermediate %s is no longer configured", name)
+}
+
+// checkNames returns an annotation error if the intermediate is not
+// permitted to sign the names of a pod.
+func (ci *ConstrainedIntermediate) checkNames(commonName string, sans []string) error {
+	if err := ci.constraints.check(append([]string{commonName}, sans...)); err != nil {
+		return annotationErrors{{
+			Key:    admissionWebhookAnnotationKey,
+			Value:  commonName,
+			Reason: fmt.Sprintf("intermediate %s can't sign the names of the pod: %v", ci.Name, err),
+		}}
+	}
+	return nil
+}
+
+// setIntermediate configures the injected containers to get their
+// certificate from the CA of the intermediate.
+func setIntermediate(ci *ConstrainedIntermediate, containers ...*corev1.Container) {
+	for _, c := range containers {
+		c.Env = setEnv(c.Env, corev1.EnvVar{Name: "STEP_CA_URL", Value: ci.CaURL})
+	}
+}
+
+// nameConstraints checks names against the constraints of an intermediate
+// the way crypto/x509 does: a throwaway CA with the same constraints signs a
+// certificate for the names, which is then verified.
+type nameConstraints struct {
+	ca    *x509.Certificate
+	key   crypto.Signer
+	roots *x509.CertPool
+}
+
+// newNameConstraints returns the constraints of an intermediate, or an error
+// if it has none.
+func newNameConstraints(intermediate *x509.Certificate) (*nameConstraints, error) {
+	if !intermediate.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	}
+	if len(intermediate.PermittedDNSDomains)+len(intermediate.ExcludedDNSDomains)+
+		len(intermediate.PermittedIPRanges)+len(intermediate.ExcludedIPRanges)+
+		len(intermediate.PermittedEmailAddresses)+len(intermediate.ExcludedEmailAddresses)+
+		len(intermediate.PermittedURIDomains)+len(intermediate.ExcludedURIDomains) == 0 {
+		return nil, errors.New("certificate has no name constraints")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:                big.NewInt(1),
+		Subject:                     pkix.Name{CommonName: "autocert name constraints"},
+		NotBefore:                   now.Add(-time.Hour),
+		NotAfter:                    now.Add(100 * 365 * 24 * time.Hour),
+		IsCA:                        true,
+		BasicConstraintsValid:       true,
+		KeyUsage:                    x509.KeyUsageCertSign,
+		PermittedDNSDomainsCritical: intermediate.PermittedDNSDomainsCritical,
+		PermittedDNSDomains:         intermediate.PermittedDNSDomains,
+		ExcludedDNSDomains:          intermediate.ExcludedDNSDomains,
+		PermittedIPRanges:           intermediate.PermittedIPRanges,
+		ExcludedIPRanges:            intermediate.ExcludedIPRanges,
+		PermittedEmailAddresses:     intermediate.PermittedEmailAddresses,
+		ExcludedEmailAddresses:      intermediate.ExcludedEmailAddresses,
+		PermittedURIDomains:         intermediate.PermittedURIDomains,
+		ExcludedURIDomains:          intermediate.ExcludedURIDomains,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(crt)
+	return &nameConstraints{ca: crt, key: key, roots: roots}, nil
+}
+
+// check returns an error if the constraints don't permit one of the names.
+func (n *nameConstraints) check(names []string) error {
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(time.Hour),
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		switch {
+		case name == "":
+		case net.ParseIP(name) != nil:
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(name))
+		case strings.Contains(name, "://"):
+			u, err := url.Parse(name)
+			if err != nil {
+				return err
+			}
+			tmpl.URIs = append(tmpl.URIs, u)
+		case strings.Contains(name, "@"):
+			tmpl.EmailAddresses = append(tmpl.EmailAddresses, name)
+		default:
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, n.ca, n.key.Public(), n.key)
+	if err != nil {
+		return err
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	_, err = crt.Verify(x509.VerifyOptions{
+		Roots:       n.roots,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		CurrentTime: now,
+	})
+	var cerr x509.CertificateInvalidError
+	if errors.As(err, &cerr) && cerr.Detail != "" {
+		return errors.New(cerr.Detail)
+	}
+	return err
+}
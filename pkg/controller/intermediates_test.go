@@ -0,0 +1,276 @@
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// namedTokens generates the tokens of a constrained intermediate.
+type namedTokens string
+
+func (n namedTokens) Token(subject string, sans ...string) (string, error) {
+	return string(n) + "-" + subject, nil
+}
+
+// constrainedCA writes a root and an intermediate constrained by tmpl in
+// dir, and returns their paths.
+func constrainedCA(t *testing.T, dir string, tmpl *x509.Certificate) (rootFile, intermediateFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := devCACertificate("Test Root", time.Now(), key, nil, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(2)
+	tmpl.Subject = pkix.Name{CommonName: "Tenant Intermediate"}
+	tmpl.NotBefore = time.Now().Add(-time.Minute)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, root, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootFile = filepath.Join(dir, "root.crt")
+	intermediateFile = filepath.Join(dir, "intermediate.crt")
+	for file, b := range map[string][]byte{rootFile: root.Raw, intermediateFile: der} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootFile, intermediateFile
+}
+
+func TestNameConstraints(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	n, err := newNameConstraints(&x509.Certificate{
+		IsCA:                true,
+		PermittedDNSDomains: []string{"team-a.svc.cluster.local"},
+		ExcludedIPRanges:    []*net.IPNet{ipNet},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		names   []string
+		wantErr bool
+	}{
+		{[]string{"api.team-a.svc.cluster.local"}, false},
+		{[]string{"api.team-a.svc.cluster.local", "*.api.team-a.svc.cluster.local", "192.168.1.1"}, false},
+		{[]string{"api.team-a.svc.cluster.local", "api.team-b.svc.cluster.local"}, true},
+		{[]string{"api.team-a.svc.cluster.local", "10.1.2.3"}, true},
+		{[]string{"api.team-a.svc.cluster.local."}, false},
+	}
+	for _, tt := range tests {
+		if err := n.check(tt.names); (err != nil) != tt.wantErr {
+			t.Errorf("check(%v) = %v, want error %v", tt.names, err, tt.wantErr)
+		}
+	}
+
+	if _, err := newNameConstraints(&x509.Certificate{IsCA: true}); err == nil {
+		t.Error("newNameConstraints() without constraints succeeded")
+	}
+	if _, err := newNameConstraints(&x509.Certificate{PermittedDNSDomains: []string{"example.com"}}); err == nil {
+		t.Error("newNameConstraints() of a leaf succeeded")
+	}
+}
+
+func TestValidateConstrainedIntermediates(t *testing.T) {
+	dir := t.TempDir()
+	rootFile, intermediateFile := constrainedCA(t, dir, &x509.Certificate{
+		IsCA:                true,
+		PermittedDNSDomains: []string{"team-a.svc.cluster.local"},
+	})
+	_, unconstrainedFile := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	otherRoot, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+
+	valid := func() *Config {
+		return &Config{
+			RootCAPath: rootFile,
+			ConstrainedIntermediates: []ConstrainedIntermediate{{
+				Name:                    "team-a",
+				Namespaces:              []string{"team-a"},
+				CaURL:                   "https://team-a-ca.step.svc",
+				Certificate:             intermediateFile,
+				ProvisionerName:         "autocert",
+				ProvisionerKid:          "kid",
+				ProvisionerPasswordPath: "/home/step/team-a/password",
+			}},
+		}
+	}
+	c := valid()
+	if err := validateConstrainedIntermediates(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.ConstrainedIntermediates[0].constraints == nil {
+		t.Error("constraints not loaded")
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"name", func(c *Config) { c.ConstrainedIntermediates[0].Name = "Team A" }},
+		{"duplicate", func(c *Config) {
+			c.ConstrainedIntermediates = append(c.ConstrainedIntermediates, c.ConstrainedIntermediates[0])
+		}},
+		{"namespaces", func(c *Config) { c.ConstrainedIntermediates[0].Namespaces = nil }},
+		{"caUrl", func(c *Config) { c.ConstrainedIntermediates[0].CaURL = "http://team-a-ca" }},
+		{"provisioner", func(c *Config) { c.ConstrainedIntermediates[0].ProvisionerKid = "" }},
+		{"csrNamespaces", func(c *Config) { c.CSRNamespaces = []string{"team-a"} }},
+		{"tokenBinding", func(c *Config) { c.TokenBinding = true }},
+		{"missing certificate", func(c *Config) { c.ConstrainedIntermediates[0].Certificate = filepath.Join(dir, "missing.crt") }},
+		{"unconstrained", func(c *Config) { c.ConstrainedIntermediates[0].Certificate = unconstrainedFile }},
+		{"other root", func(c *Config) { c.RootCAPath = otherRoot }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			if err := validateConstrainedIntermediates(c); err == nil {
+				t.Error("validateConstrainedIntermediates() succeeded")
+			}
+		})
+	}
+}
+
+func TestConstrainedIntermediate(t *testing.T) {
+	config := &Config{ConstrainedIntermediates: []ConstrainedIntermediate{
+		{Name: "team-a", Namespaces: []string{"team-a", "shared"}},
+		{Name: "shared", Namespaces: []string{"shared"}},
+	}}
+	tests := []struct {
+		name         string
+		namespace    string
+		intermediate string
+		want         string
+		wantErr      bool
+	}{
+		{"default", "team-a", "", "team-a", false},
+		{"first default", "shared", "", "team-a", false},
+		{"annotation", "shared", "shared", "shared", false},
+		{"none", "default", "", "", false},
+		{"other namespace", "default", "team-a", "", true},
+		{"unknown", "team-a", "team-b", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ci, err := constrainedIntermediate(podAnnotations{Intermediate: tt.intermediate}, tt.namespace, config)
+			var aerrs annotationErrors
+			if tt.wantErr != errors.As(err, &aerrs) {
+				t.Fatalf("constrainedIntermediate() error = %v, want annotation error %v", err, tt.wantErr)
+			}
+			var got string
+			if ci != nil {
+				got = ci.Name
+			}
+			if got != tt.want {
+				t.Errorf("constrainedIntermediate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConstrainedIntermediatePatch(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	secrets := &fakeSecrets{}
+	tokenSecrets = secrets
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+
+	rootFile, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	constraints, err := newNameConstraints(&x509.Certificate{IsCA: true, PermittedDNSDomains: []string{"team-a.svc.cluster.local"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		CaURL:          "https://ca",
+		CAFailoverURLs: []string{"https://ca-passive"},
+		RootCAPath:     rootFile,
+		CertsVolume:    corev1.Volume{Name: "certs"},
+		Bootstrapper:   corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper"},
+		Renewer:        corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+		ConstrainedIntermediates: []ConstrainedIntermediate{{
+			Name:        "team-a",
+			Namespaces:  []string{"team-a"},
+			CaURL:       "https://team-a-ca",
+			constraints: constraints,
+			tokens:      namedTokens("team-a"),
+		}},
+	}
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Annotations: map[string]string{admissionWebhookAnnotationKey: name}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "api"}}},
+		}
+	}
+
+	b, err := patch(context.Background(), pod("api.team-a.svc.cluster.local"), "team-a", config, fakeTokens{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []struct {
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(b, &ops); err != nil {
+		t.Fatal(err)
+	}
+	var containers []corev1.Container
+	for _, op := range ops {
+		var c corev1.Container
+		var cs []corev1.Container
+		switch {
+		case op.Path == "/spec/initContainers" && json.Unmarshal(op.Value, &cs) == nil:
+			containers = append(containers, cs...)
+		case op.Path == "/spec/containers/-" && json.Unmarshal(op.Value, &c) == nil:
+			containers = append(containers, c)
+		}
+	}
+	if len(containers) != 2 {
+		t.Fatalf("patch() added %d containers, want the bootstrapper and the renewer", len(containers))
+	}
+	for _, c := range containers {
+		var url string
+		for _, e := range c.Env {
+			switch e.Name {
+			case "STEP_CA_URL":
+				url = e.Value
+			case caFailoverEnvVar:
+				t.Errorf("%s: %s = %s, the passive CAs don't sign with the intermediate", c.Name, e.Name, e.Value)
+			}
+		}
+		if url != "https://team-a-ca" {
+			t.Errorf("%s: STEP_CA_URL = %q, want the CA of the intermediate", c.Name, url)
+		}
+	}
+	if len(secrets.created) != 1 || secrets.created[0].StringData[tokenSecretKey] != "team-a-api.team-a.svc.cluster.local" {
+		t.Errorf("token secrets = %v, want a token of the intermediate", secrets.created)
+	}
+
+	_, err = patch(context.Background(), pod("api.team-b.svc.cluster.local"), "team-a", config, fakeTokens{})
+	var aerrs annotationErrors
+	if !errors.As(err, &aerrs) || !strings.Contains(err.Error(), "team-a") {
+		t.Errorf("patch() with names outside the constraints = %v, want an annotation error", err)
+	}
+}
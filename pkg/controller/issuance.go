@@ -0,0 +1,326 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	issuanceAnnotationKey = "autocert.step.sm/issuance"
+	// claimLifetime is how long a pending issuance can be claimed. It is
+	// longer than the token lifetime so that pods sitting in the scheduling
+	// queue a little while can still get a certificate, pods pending longer
+	// need tokenRemint.
+	claimLifetime = 10 * time.Minute
+	// maxClaimRequestSize limits the size of the body of a token request.
+	maxClaimRequestSize = 4096
+	// claimTokenEnvVar is the path of the service account token
+	// bootstrappers present with their claim. Claims are set in the pod spec,
+	// readable by anyone allowed to get the pod, so they are only redeemed
+	// by the pod they were created for.
+	claimTokenEnvVar = "AUTOCERT_CLAIM_TOKEN"
+)
+
+var (
+	errBudgetExceeded = errors.New("admission budget exceeded")
+
+	// pendingIssuances holds the issuances deferred because generating the
+	// token took longer than the admission budget.
+	pendingIssuances = newIssuanceStore()
+)
+
+// pendingIssuance is the information needed to generate a bootstrap token
+// for a pod admitted before its token was generated.
+type pendingIssuance struct {
+	CommonName string    `json:"commonName"`
+	SANs       []string  `json:"sans,omitempty"`
+	Namespace  string    `json:"namespace"`
+	Duration   string    `json:"duration,omitempty"`
+	Gate       string    `json:"gate,omitempty"`
+	Expires    time.Time `json:"expires"`
+	// Intermediate is the constrained intermediate signing the certificate,
+	// empty for the CA in the configuration.
+	Intermediate string `json:"intermediate,omitempty"`
+	// CA is the certificate authority issuing the certificate, empty for
+	// the CA in the configuration.
+	CA string `json:"ca,omitempty"`
+	// Bound is set when the token must be bound to the pod that requested
+	// the certificate, identified by its service account and its name or
+	// the prefix of its generated name.
+	Bound          bool   `json:"bound,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	PodName        string `json:"podName,omitempty"`
+	GenerateName   string `json:"generateName,omitempty"`
+	// CSR is the name of the CertificateSigningRequest created for the
+	// issuance, set once the pod submitted its certificate request.
+	CSR string `json:"csr,omitempty"`
+}
+
+// issuanceStore is an in-memory store of pending issuances indexed by a
+// random, single use claim. Claims are stored hashed, so a persisted store
+// doesn't hold them.
+type issuanceStore struct {
+	sync.Mutex
+	pending map[string]pendingIssuance
+	// persist is called after every change when the queue is persistent.
+	persist func()
+}
+
+func newIssuanceStore() *issuanceStore {
+	return &issuanceStore{
+		pending: make(map[string]pendingIssuance),
+	}
+}
+
+// claimKey returns the key of a claim in the store.
+func claimKey(claim string) string {
+	sum := sha256.Sum256([]byte(claim))
+	return hex.EncodeToString(sum[:])
+}
+
+// changed persists the store, it must be called without the lock held.
+func (s *issuanceStore) changed() {
+	if s.persist != nil {
+		s.persist()
+	}
+}
+
+// add stores a pending issuance and returns the claim to redeem it.
+func (s *issuanceStore) add(p pendingIssuance) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "claim generation")
+	}
+	claim := hex.EncodeToString(b)
+
+	s.Lock()
+	now := time.Now()
+	for k, v := range s.pending {
+		if now.After(v.Expires) {
+			delete(s.pending, k)
+		}
+	}
+
+	if p.Expires.IsZero() {
+		p.Expires = now.Add(claimLifetime)
+	}
+	s.pending[claimKey(claim)] = p
+	s.Unlock()
+
+	s.changed()
+	return claim, nil
+}
+
+// put stores a pending issuance with an existing claim.
+func (s *issuanceStore) put(claim string, p pendingIssuance) {
+	s.Lock()
+	s.pending[claimKey(claim)] = p
+	s.Unlock()
+
+	s.changed()
+}
+
+// peek returns the pending issuance for the given claim without removing it.
+func (s *issuanceStore) peek(claim string) (pendingIssuance, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	p, ok := s.pending[claimKey(claim)]
+	if !ok || time.Now().After(p.Expires) {
+		return p, false
+	}
+	return p, true
+}
+
+// take removes and returns the pending issuance for the given claim.
+func (s *issuanceStore) take(claim string) (pendingIssuance, bool) {
+	key := claimKey(claim)
+	s.Lock()
+	p, ok := s.pending[key]
+	if !ok {
+		s.Unlock()
+		return p, false
+	}
+	delete(s.pending, key)
+	s.Unlock()
+
+	s.changed()
+	if time.Now().After(p.Expires) {
+		return p, false
+	}
+	return p, true
+}
+
+// snapshot returns a copy of the unexpired pending issuances, indexed by the
+// hash of their claim.
+func (s *issuanceStore) snapshot() map[string]pendingIssuance {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	pending := make(map[string]pendingIssuance, len(s.pending))
+	for k, v := range s.pending {
+		if !now.After(v.Expires) {
+			pending[k] = v
+		}
+	}
+	return pending
+}
+
+// restore adds the unexpired issuances of a snapshot to the store.
+func (s *issuanceStore) restore(pending map[string]pendingIssuance) int {
+	s.Lock()
+	defer s.Unlock()
+
+	var n int
+	now := time.Now()
+	for k, v := range pending {
+		if !now.After(v.Expires) {
+			s.pending[k] = v
+			n++
+		}
+	}
+	return n
+}
+
+// addClaimToken configures a bootstrapper to present the service account
+// token of its pod with its claim.
+func addClaimToken(b *corev1.Container) {
+	b.Env = setEnv(b.Env, corev1.EnvVar{
+		Name:  claimTokenEnvVar,
+		Value: tokenBindingMountPath + "/token",
+	})
+	mountTokenBinding(b)
+}
+
+// withBudget runs fn and waits for its result for up to budget. If budget is
+// 0 it waits until fn returns. If the budget is exceeded it returns
+// errBudgetExceeded, and if ctx is done first it returns its error. In both
+// cases the context given to fn is canceled and its result is discarded.
+func withBudget[T any](ctx context.Context, budget time.Duration, fn func(context.Context) (T, error)) (T, error) {
+	if budget <= 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		value T
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		v, err := fn(ctx)
+		ch <- result{v, err}
+	}()
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	var zero T
+	select {
+	case r := <-ch:
+		return r.value, r.err
+	case <-timer.C:
+		return zero, errBudgetExceeded
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// tokenRequest is the body of a request to the /token endpoint.
+type tokenRequest struct {
+	Claim string `json:"claim"`
+	// CSR is the PEM encoded certificate request of the pod, required to get
+	// a bound token.
+	CSR string `json:"csr,omitempty"`
+}
+
+// tokenHandler exchanges the claim of a pending issuance for a bootstrap
+// token, for the pod the claim was created for, authenticated by its service
+// account token. The token is written in the response body as plain text.
+func tokenHandler(w http.ResponseWriter, r *http.Request, config *Config, provisioner TokenManager) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req tokenRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxClaimRequestSize)).Decode(&req); err != nil || req.Claim == "" {
+		log.Error("Bad Request: 400 (Invalid Claim)")
+		http.Error(w, "Bad Request (Invalid Claim)", http.StatusBadRequest)
+		return
+	}
+
+	// Claims are only removed once the pod is identified, so a pod
+	// presenting a stolen claim can't burn it.
+	p, ok := pendingIssuances.peek(req.Claim)
+	if !ok {
+		log.Error("Forbidden: 403 (Unknown or Expired Claim)")
+		http.Error(w, "Forbidden (Unknown or Expired Claim)", http.StatusForbidden)
+		return
+	}
+
+	ctxLog := log.WithFields(log.Fields{
+		"commonName": p.CommonName,
+		"namespace":  p.Namespace,
+	})
+
+	// The pod must present its service account token: bound tokens are
+	// also tied to its certificate request.
+	var token string
+	var pod boundPod
+	var err error
+	if p.Bound {
+		token, pod, err = tokenBinding.token(r, req, p)
+	} else {
+		pod, err = tokenBinding.identify(r, p)
+	}
+	var berr *bindingError
+	if errors.As(err, &berr) {
+		logBindingDenied(p, err)
+		http.Error(w, "Forbidden ("+berr.reason+")", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error generating token for pending issuance")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	ctxLog = ctxLog.WithFields(log.Fields{
+		"pod":    pod.Name,
+		"podUID": pod.UID,
+	})
+	if _, ok := pendingIssuances.take(req.Claim); !ok {
+		log.Error("Forbidden: 403 (Unknown or Expired Claim)")
+		http.Error(w, "Forbidden (Unknown or Expired Claim)", http.StatusForbidden)
+		return
+	}
+	if !p.Bound {
+		var tokens TokenManager
+		if tokens, err = issuerTokens(config, p, provisioner); err == nil {
+			token, err = mintToken(r.Context(), tokens, p.CommonName, p.SANs...)
+		}
+	}
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error generating token for pending issuance")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	ctxLog.Info("Issued token for pending issuance")
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, token) //nolint:errcheck // write errors are unactionable
+}
@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIssuanceStore(t *testing.T) {
+	s := newIssuanceStore()
+	claim, err := s.add(pendingIssuance{CommonName: "test.default.svc", Namespace: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claim) != 64 {
+		t.Errorf("unexpected claim length %d", len(claim))
+	}
+
+	if p, ok := s.peek(claim); !ok || p.CommonName != "test.default.svc" {
+		t.Errorf("peek() = %v, %v", p, ok)
+	}
+	p, ok := s.take(claim)
+	if !ok || p.CommonName != "test.default.svc" {
+		t.Errorf("take() = %v, %v", p, ok)
+	}
+	if _, ok := s.take(claim); ok {
+		t.Error("claims must be single use")
+	}
+
+	expired, err := s.add(pendingIssuance{CommonName: "expired", Expires: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.take(expired); ok {
+		t.Error("expired claims must not be redeemed")
+	}
+}
+
+func TestWithBudget(t *testing.T) {
+	ctx := context.Background()
+	got, err := withBudget(ctx, 0, func(context.Context) (string, error) { return "ok", nil })
+	if err != nil || got != "ok" {
+		t.Errorf("withBudget() = %v, %v", got, err)
+	}
+
+	got, err = withBudget(ctx, time.Second, func(context.Context) (string, error) { return "ok", nil })
+	if err != nil || got != "ok" {
+		t.Errorf("withBudget() = %v, %v", got, err)
+	}
+
+	// The work is canceled once the budget is exceeded.
+	canceled := make(chan struct{})
+	_, err = withBudget(ctx, 10*time.Millisecond, func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		close(canceled)
+		return "late", ctx.Err()
+	})
+	if !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("withBudget() error = %v, want %v", err, errBudgetExceeded)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("withBudget() didn't cancel the work past the budget")
+	}
+
+	// And when the request is done first.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = withBudget(ctx, time.Minute, func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "late", ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("withBudget() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// patchPod returns a pod patched by the controller.
+func patchPod(t *testing.T, pod *corev1.Pod, namespace string, config *Config, provisioner TokenManager) corev1.Pod {
+	t.Helper()
+	b, err := patch(context.Background(), pod, namespace, config, provisioner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []PatchOperation
+	if err := json.Unmarshal(b, &ops); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := toJSONValue(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = json.Marshal(applyPatch(t, doc, ops)); err != nil {
+		t.Fatal(err)
+	}
+	var patched corev1.Pod
+	if err := json.Unmarshal(b, &patched); err != nil {
+		t.Fatal(err)
+	}
+	return patched
+}
+
+// presentsClaimToken returns whether the bootstrapper of a patched pod
+// presents the service account token of the pod with its claim.
+func presentsClaimToken(pod corev1.Pod) bool {
+	var env, mount, volume bool
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name != "autocert-bootstrapper" {
+			continue
+		}
+		for _, e := range c.Env {
+			env = env || (e.Name == claimTokenEnvVar && e.Value == tokenBindingMountPath+"/token")
+		}
+		for _, m := range c.VolumeMounts {
+			mount = mount || m.Name == tokenBindingVolume
+		}
+	}
+	for _, v := range pod.Spec.Volumes {
+		volume = volume || v.Name == tokenBindingVolume
+	}
+	return env && mount && volume
+}
+
+// slowTokens generates tokens after a delay.
+type slowTokens struct{}
+
+func (slowTokens) Token(subject string, sans ...string) (string, error) {
+	time.Sleep(50 * time.Millisecond)
+	return "token-" + subject, nil
+}
+
+func TestPatchDeferredIssuance(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	tokenSecrets = &fakeSecrets{}
+	defer func(s *issuanceStore) { pendingIssuances = s }(pendingIssuances)
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+
+	rootFile, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "api-0", Annotations: map[string]string{
+				admissionWebhookAnnotationKey: "api.default.svc",
+			}},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: "api",
+				Containers:         []corev1.Container{{Name: "api"}},
+			},
+		}
+	}
+	tests := []struct {
+		name         string
+		version      int
+		wantDeferred bool
+	}{
+		{"deferred", 0, true},
+		{"protocol without claim token", 24, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pendingIssuances = newIssuanceStore()
+			config := &Config{
+				CaURL:           "https://ca",
+				RootCAPath:      rootFile,
+				AdmissionBudget: "10ms",
+				ProtocolVersion: tt.version,
+				CertsVolume:     corev1.Volume{Name: "certs"},
+				Bootstrapper:    corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper"},
+				Renewer:         corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+			}
+			patched := patchPod(t, newPod(), "default", config, slowTokens{})
+
+			pending := pendingIssuances.snapshot()
+			if (len(pending) == 1) != tt.wantDeferred {
+				t.Fatalf("pending issuances = %v, want deferred %v", pending, tt.wantDeferred)
+			}
+			if got := presentsClaimToken(patched); got != tt.wantDeferred {
+				t.Errorf("bootstrapper presents its service account token = %v, want %v", got, tt.wantDeferred)
+			}
+			for _, p := range pending {
+				if p.ServiceAccount != "api" || p.PodName != "api-0" {
+					t.Errorf("pending issuance = %+v, want the service account and name of the pod", p)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.step.sm/crypto/kms"
+	"go.step.sm/crypto/kms/apiv1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	// The data keys are wrapped with a key in a PEM file, or with AWS KMS.
+	_ "go.step.sm/crypto/kms/awskms"
+	_ "go.step.sm/crypto/kms/softkms"
+)
+
+const (
+	issuanceLogKeyFile     = "data-key"
+	issuanceLogRecordsFile = "records.jsonl"
+	// issuanceLogResource is the resource a reader must be allowed to get in
+	// a namespace to read its records.
+	issuanceLogResource = "issuances"
+	// defaultIssuanceLogLimit is the number of records returned by default,
+	// the most recent ones.
+	defaultIssuanceLogLimit = 100
+	// maxIssuanceLogRecordSize bounds the lines read from the records file.
+	maxIssuanceLogRecordSize = 64 << 10
+)
+
+// IssuanceLog configures the log of the certificates issued for the pods of
+// each namespace. Records are sealed with a data key per namespace, wrapped
+// with a KMS key, so a reader of the log store can't read them without the
+// KMS, and are only served to the callers allowed to get the issuances of
+// their namespace.
+type IssuanceLog struct {
+	Enabled bool `yaml:"enabled"`
+	// Path is the directory of the log, with a subdirectory per namespace.
+	Path string `yaml:"path"`
+	// KMS is the URI of the KMS holding the key wrapping the data keys, like
+	// "awskms:region=us-east-1". It defaults to softkms, with the key in a
+	// PEM file.
+	KMS string `yaml:"kms"`
+	// Key is the RSA key wrapping the data keys, like
+	// "awskms:key-id=..." or the path of a PEM file with softkms.
+	Key string `yaml:"key"`
+}
+
+// validateIssuanceLog returns an error if the issuance log is enabled
+// without an absolute path or a key.
+func validateIssuanceLog(c *Config) error {
+	l := c.IssuanceLog
+	if !l.Enabled {
+		return nil
+	}
+	if !filepath.IsAbs(l.Path) {
+		return fmt.Errorf("issuanceLog.path %q must be an absolute path", l.Path)
+	}
+	if l.Key == "" {
+		return errors.New("issuanceLog.key is required")
+	}
+	return nil
+}
+
+// IssuanceRecord is an entry of the issuance log.
+type IssuanceRecord struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Namespace  string    `json:"namespace"`
+	Event      string    `json:"event"`
+	Pod        string    `json:"pod,omitempty"`
+	Secret     string    `json:"secret,omitempty"`
+	CSR        string    `json:"csr,omitempty"`
+	CommonName string    `json:"commonName"`
+	SANs       []string  `json:"sans,omitempty"`
+}
+
+// The events of the issuance log.
+const (
+	issuanceEventAdmitted = "admitted"
+	issuanceEventSecret   = "secret"
+	issuanceEventCSR      = "csr"
+	issuanceEventReissue  = "reissue"
+)
+
+// sealedRecord is a line of the records file of a namespace.
+type sealedRecord struct {
+	ID     string `json:"id"`
+	Nonce  []byte `json:"nonce"`
+	Sealed []byte `json:"sealed"`
+}
+
+// issuanceLogStore appends the records of each namespace to a file, sealed
+// with AES-GCM under the data key of the namespace. The namespace and the ID
+// of a record are its additional data, so records can't be moved between
+// namespaces. Data keys are wrapped with RSA-OAEP and only kept unwrapped in
+// memory. Deleting the data key of a namespace erases its history.
+type issuanceLogStore struct {
+	mu   sync.Mutex
+	dir  string
+	wrap func(key []byte) ([]byte, error)
+	// unwrap decrypts a data key with the KMS.
+	unwrap func(wrapped []byte) ([]byte, error)
+	keys   map[string][]byte
+}
+
+// issuanceLog is the issuance log, nil when it's disabled.
+var issuanceLog *issuanceLogStore
+
+// openIssuanceLog opens the issuance log of the configuration, checking the
+// KMS key can wrap and unwrap a data key.
+func openIssuanceLog(ctx context.Context, l IssuanceLog) (*issuanceLogStore, error) {
+	km, err := kms.New(ctx, apiv1.Options{URI: l.KMS})
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading issuance log kms")
+	}
+	d, ok := km.(apiv1.Decrypter)
+	if !ok {
+		return nil, fmt.Errorf("issuance log kms %q can't decrypt", l.KMS)
+	}
+	decrypter, err := d.CreateDecrypter(&apiv1.CreateDecrypterRequest{DecryptionKey: l.Key})
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading issuance log key")
+	}
+	s, err := newIssuanceLogStore(l.Path, decrypter)
+	if err != nil {
+		return nil, err
+	}
+	// Fail at startup rather than on the first issuance.
+	key := make([]byte, 32)
+	wrapped, err := s.wrap(key)
+	if err == nil {
+		_, err = s.unwrap(wrapped)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error checking issuance log key")
+	}
+	return s, nil
+}
+
+// newIssuanceLogStore returns a store in dir, wrapping the data keys with
+// the RSA public key of the decrypter.
+func newIssuanceLogStore(dir string, decrypter crypto.Decrypter) (*issuanceLogStore, error) {
+	pub, ok := decrypter.Public().(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("issuance log key must be an RSA key, not %T", decrypter.Public())
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "error creating issuance log directory")
+	}
+	opts := &rsa.OAEPOptions{Hash: crypto.SHA256}
+	return &issuanceLogStore{
+		dir: dir,
+		wrap: func(key []byte) ([]byte, error) {
+			return rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+		},
+		unwrap: func(wrapped []byte) ([]byte, error) {
+			return decrypter.Decrypt(rand.Reader, wrapped, opts)
+		},
+		keys: make(map[string][]byte),
+	}, nil
+}
+
+// recordIssuance adds a record to the issuance log, if it's enabled. Errors
+// are logged, the issuance isn't failed because of the log.
+func recordIssuance(r IssuanceRecord) {
+	if issuanceLog == nil {
+		return
+	}
+	if err := issuanceLog.add(r); err != nil {
+		log.WithFields(log.Fields{
+			"namespace": r.Namespace,
+			"event":     r.Event,
+			"error":     err,
+		}).Error("Error recording issuance")
+	}
+}
+
+// add seals a record with the data key of its namespace and appends it to
+// the records of the namespace.
+func (s *issuanceLogStore) add(r IssuanceRecord) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	r.ID = hex.EncodeToString(id)
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	plaintext, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	aead, err := s.aead(r.Namespace, true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	line, err := json.Marshal(sealedRecord{
+		ID:     r.ID,
+		Nonce:  nonce,
+		Sealed: aead.Seal(nil, nonce, plaintext, recordAdditionalData(r.Namespace, r.ID)),
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, r.Namespace, issuanceLogRecordsFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close() //nolint:errcheck,gosec // the write error is returned
+		return err
+	}
+	return f.Close()
+}
+
+// records returns the last records of a namespace, oldest first. A record
+// that can't be opened with the key of the namespace, because it was
+// modified or copied from another namespace, is an error.
+func (s *issuanceLogStore) records(namespace string, limit int) ([]IssuanceRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	aead, err := s.aead(namespace, false)
+	if err != nil || aead == nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(s.dir, namespace, issuanceLogRecordsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck // read-only
+
+	var records []IssuanceRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxIssuanceLogRecordSize)
+	for scanner.Scan() {
+		var line sealedRecord
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, errors.Wrap(err, "error reading issuance record")
+		}
+		plaintext, err := aead.Open(nil, line.Nonce, line.Sealed, recordAdditionalData(namespace, line.ID))
+		if err != nil {
+			return nil, fmt.Errorf("issuance record %s can't be opened with the key of namespace %s", line.ID, namespace)
+		}
+		var r IssuanceRecord
+		if err := json.Unmarshal(plaintext, &r); err != nil {
+			return nil, errors.Wrap(err, "error reading issuance record")
+		}
+		records = append(records, r)
+		if len(records) > limit {
+			records = records[1:]
+		}
+	}
+	return records, scanner.Err()
+}
+
+// aead returns the cipher of the data key of a namespace, creating the key
+// if create is set, or nil if the namespace has no key. It must be called
+// with the lock held.
+func (s *issuanceLogStore) aead(namespace string, create bool) (cipher.AEAD, error) {
+	// The namespace is a directory name.
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid namespace %q", namespace)
+	}
+	key, ok := s.keys[namespace]
+	if !ok {
+		var err error
+		if key, err = s.loadKey(namespace, create); err != nil || key == nil {
+			return nil, err
+		}
+		s.keys[namespace] = key
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadKey unwraps the data key of a namespace, or creates it.
+func (s *issuanceLogStore) loadKey(namespace string, create bool) ([]byte, error) {
+	path := filepath.Join(s.dir, namespace, issuanceLogKeyFile)
+	wrapped, err := os.ReadFile(path) //nolint:gosec // the namespace is validated
+	switch {
+	case err == nil:
+		key, err := s.unwrap(wrapped)
+		return key, errors.Wrapf(err, "error unwrapping the data key of namespace %s", namespace)
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	case !create:
+		return nil, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if wrapped, err = s.wrap(key); err != nil {
+		return nil, errors.Wrapf(err, "error wrapping the data key of namespace %s", namespace)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	// The key is written before any record sealed with it.
+	if err := os.WriteFile(path, wrapped, 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func recordAdditionalData(namespace, id string) []byte {
+	return []byte(namespace + "\x00" + id)
+}
+
+// issuancesHandler serves the last records of the issuance log of a
+// namespace, given by the namespace query parameter, to the callers allowed
+// to get the issuances resource of the autocert.step.sm group in the
+// namespace. The number of records defaults to defaultIssuanceLogLimit and
+// can be set with the limit query parameter.
+func issuancesHandler(w http.ResponseWriter, r *http.Request) {
+	if issuanceLog == nil {
+		http.Error(w, "Not Found (issuanceLog is not enabled)", http.StatusNotFound)
+		return
+	}
+	namespace := r.URL.Query().Get("namespace")
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		http.Error(w, "Bad Request (Invalid Namespace)", http.StatusBadRequest)
+		return
+	}
+	limit := defaultIssuanceLogLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Bad Request (Invalid Limit)", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if !endpointAuth.authorizeResource(w, r, namespace, issuanceLogResource) {
+		return
+	}
+
+	records, err := issuanceLog.records(namespace, limit)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"namespace": namespace,
+			"error":     err,
+		}).Error("Error reading issuance log")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []IssuanceRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		log.WithField("error", err).Info("Write error")
+	}
+}
@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateIssuanceLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		log     IssuanceLog
+		wantErr bool
+	}{
+		{"disabled", IssuanceLog{Path: "issuances"}, false},
+		{"enabled", IssuanceLog{Enabled: true, Path: "/var/lib/autocert/issuances", Key: "/etc/autocert/issuances.key"}, false},
+		{"relative path", IssuanceLog{Enabled: true, Path: "issuances", Key: "/etc/autocert/issuances.key"}, true},
+		{"no key", IssuanceLog{Enabled: true, Path: "/var/lib/autocert/issuances"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateIssuanceLog(&Config{IssuanceLog: tt.log}); (err != nil) != tt.wantErr {
+				t.Errorf("validateIssuanceLog() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// issuanceLogConfig returns the configuration of an issuance log in a
+// temporary directory, with its key in a PEM file read by softkms.
+func issuanceLogConfig(t *testing.T) IssuanceLog {
+	t.Helper()
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "issuances.key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return IssuanceLog{Enabled: true, Path: filepath.Join(dir, "log"), Key: keyFile}
+}
+
+func TestIssuanceLog(t *testing.T) {
+	config := issuanceLogConfig(t)
+	s, err := openIssuanceLog(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []IssuanceRecord{
+		{Namespace: "team-a", Event: issuanceEventAdmitted, Pod: "api-", CommonName: "api.team-a.svc"},
+		{Namespace: "team-b", Event: issuanceEventSecret, Secret: "web-tls", CommonName: "web.team-b.svc"},
+		{Namespace: "team-a", Event: issuanceEventCSR, Pod: "api-", CSR: "autocert-api", CommonName: "api.team-a.svc", SANs: []string{"api.team-a.svc"}},
+	} {
+		if err := s.add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.add(IssuanceRecord{Namespace: "../team-a"}); err == nil {
+		t.Error("add() with an invalid namespace should fail")
+	}
+
+	// The records are sealed and the data key is wrapped.
+	raw, err := os.ReadFile(filepath.Join(config.Path, "team-a", issuanceLogRecordsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json.Valid(raw) || len(raw) == 0 {
+		t.Fatalf("records file = %q", raw)
+	}
+	if strings.Contains(string(raw), "api.team-a.svc") {
+		t.Error("records file contains the common name in clear text")
+	}
+	wrapped, err := os.ReadFile(filepath.Join(config.Path, "team-a", issuanceLogKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wrapped) != 256 {
+		t.Errorf("data key is %d bytes, want a 2048-bit RSA ciphertext", len(wrapped))
+	}
+
+	// A new store unwraps the data keys with the KMS.
+	s, err = openIssuanceLog(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := s.records("team-a", defaultIssuanceLogLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Event != issuanceEventAdmitted || records[1].CSR != "autocert-api" {
+		t.Errorf("records() = %+v", records)
+	}
+	if records, err = s.records("team-a", 1); err != nil || len(records) != 1 || records[0].Event != issuanceEventCSR {
+		t.Errorf("records() with limit = %+v, %v", records, err)
+	}
+	if records, err = s.records("team-c", defaultIssuanceLogLimit); err != nil || len(records) != 0 {
+		t.Errorf("records() of a namespace without records = %+v, %v", records, err)
+	}
+
+	// A record copied from another namespace can't be opened.
+	other, err := os.ReadFile(filepath.Join(config.Path, "team-b", issuanceLogRecordsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(config.Path, "team-a", issuanceLogRecordsFile), append(raw, other...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.records("team-a", defaultIssuanceLogLimit); err == nil {
+		t.Error("records() with a record of another namespace should fail")
+	}
+}
+
+func TestIssuancesHandler(t *testing.T) {
+	defer func(s *issuanceLogStore, a *endpointAuthorizer) { issuanceLog, endpointAuth = s, a }(issuanceLog, endpointAuth)
+	endpointAuth = &endpointAuthorizer{review: func(token string, resource accessResource) (accessReview, error) {
+		if token != "team-a" {
+			return accessReview{}, nil
+		}
+		return accessReview{
+			User:    "system:serviceaccount:team-a:auditor",
+			Allowed: resource.Namespace == "team-a" && resource.Resource == issuanceLogResource,
+		}, nil
+	}}
+
+	get := func(query, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/issuances?"+query, http.NoBody)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		issuancesHandler(w, r)
+		return w
+	}
+
+	issuanceLog = nil
+	if w := get("namespace=team-a", "team-a"); w.Code != http.StatusNotFound {
+		t.Errorf("issuancesHandler() without a log = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	var err error
+	if issuanceLog, err = openIssuanceLog(context.Background(), issuanceLogConfig(t)); err != nil {
+		t.Fatal(err)
+	}
+	recordIssuance(IssuanceRecord{Namespace: "team-a", Event: issuanceEventAdmitted, CommonName: "api.team-a.svc"})
+	recordIssuance(IssuanceRecord{Namespace: "team-b", Event: issuanceEventAdmitted, CommonName: "web.team-b.svc"})
+
+	tests := []struct {
+		name  string
+		query string
+		token string
+		want  int
+	}{
+		{"missing token", "namespace=team-a", "", http.StatusUnauthorized},
+		{"invalid token", "namespace=team-a", "invalid", http.StatusUnauthorized},
+		{"other namespace", "namespace=team-b", "team-a", http.StatusForbidden},
+		{"invalid namespace", "namespace=../team-b", "team-a", http.StatusBadRequest},
+		{"invalid limit", "namespace=team-a&limit=0", "team-a", http.StatusBadRequest},
+		{"allowed", "namespace=team-a", "team-a", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.query, tt.token)
+			if w.Code != tt.want {
+				t.Fatalf("issuancesHandler() = %d, want %d", w.Code, tt.want)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var records []IssuanceRecord
+			if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 || records[0].CommonName != "api.team-a.svc" || records[0].ID == "" {
+				t.Errorf("issuancesHandler() records = %+v", records)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// jobDurationMargin is added to the deadline of a Job, so its
+	// certificate outlives the bootstrap and the last retries of the
+	// application.
+	jobDurationMargin = 5 * time.Minute
+	// defaultCertLifetime is the default maximum duration of the
+	// certificates of a provisioner.
+	defaultCertLifetime = 24 * time.Hour
+)
+
+// jobDuration returns the duration of the certificate of a pod with a
+// deadline, usually run by a Job: the shortest of the activeDeadlineSeconds
+// of the pod and of its Job, plus jobDurationMargin. The deadline of a Job
+// counts from its start, and the one of a pod from the start of the pod, so
+// the certificate, issued later, expires shortly after either must have
+// finished. The duration is at most maxDuration, the lifetime of the other
+// certificates. It returns "" if the pod has no deadline. The Job is read
+// with getJob; errors are logged and its deadline is ignored.
+func jobDuration(pod *corev1.Pod, namespace string, maxDuration time.Duration, getJob func(namespace, name string) (*batchv1.Job, error)) string {
+	var deadline int64
+	shorten := func(seconds *int64) {
+		if seconds != nil && *seconds > 0 && (deadline == 0 || *seconds < deadline) {
+			deadline = *seconds
+		}
+	}
+	shorten(pod.Spec.ActiveDeadlineSeconds)
+	if name := jobName(pod); name != "" {
+		job, err := getJob(namespace, name)
+		switch {
+		case err != nil:
+			log.WithFields(log.Fields{
+				"namespace": namespace,
+				"job":       name,
+				"error":     err,
+			}).Warn("Error getting job, its deadline is ignored")
+		case job != nil:
+			shorten(job.Spec.ActiveDeadlineSeconds)
+		}
+	}
+	if deadline == 0 {
+		return ""
+	}
+	// Deadlines are clamped in seconds, converting them to a Duration
+	// overflows above 292 years.
+	if deadline >= int64((maxDuration-jobDurationMargin)/time.Second) {
+		return maxDuration.String()
+	}
+	return (time.Duration(deadline)*time.Second + jobDurationMargin).String()
+}
+
+// jobName returns the name of the Job controlling a pod, or "" if it's not
+// run by a Job.
+func jobName(pod *corev1.Pod) string {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "Job" && ref.APIVersion == batchv1.SchemeGroupVersion.String() && ref.Controller != nil && *ref.Controller {
+			return ref.Name
+		}
+	}
+	return ""
+}
+
+// getJob returns a Job, or nil if it doesn't exist.
+func getJob(namespace, name string) (*batchv1.Job, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := client.GetRequest(fmt.Sprintf("apis/batch/v1/namespaces/%s/jobs/%s", namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, errors.New(resp.Status)
+	}
+	var job batchv1.Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
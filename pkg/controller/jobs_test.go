@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestJobDuration(t *testing.T) {
+	seconds := func(s int64) *int64 { return &s }
+	controller := true
+	jobPod := func(podDeadline *int64) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "batch/v1",
+				Kind:       "Job",
+				Name:       "migrate",
+				Controller: &controller,
+			}}},
+			Spec: corev1.PodSpec{ActiveDeadlineSeconds: podDeadline},
+		}
+	}
+	jobs := func(deadline *int64) func(string, string) (*batchv1.Job, error) {
+		return func(namespace, name string) (*batchv1.Job, error) {
+			if namespace != "default" || name != "migrate" {
+				t.Errorf("getJob(%q, %q), want default/migrate", namespace, name)
+			}
+			return &batchv1.Job{Spec: batchv1.JobSpec{ActiveDeadlineSeconds: deadline}}, nil
+		}
+	}
+	noJob := func(string, string) (*batchv1.Job, error) {
+		t.Error("getJob() called for a pod without a job")
+		return nil, nil
+	}
+	failing := func(string, string) (*batchv1.Job, error) {
+		return nil, errors.New("forbidden")
+	}
+
+	tests := []struct {
+		name   string
+		pod    *corev1.Pod
+		getJob func(string, string) (*batchv1.Job, error)
+		want   string
+	}{
+		{"job deadline", jobPod(nil), jobs(seconds(600)), "15m0s"},
+		{"pod deadline", jobPod(seconds(300)), jobs(nil), "10m0s"},
+		{"shortest deadline", jobPod(seconds(3600)), jobs(seconds(600)), "15m0s"},
+		{"no deadline", jobPod(nil), jobs(nil), ""},
+		{"deleted job", jobPod(seconds(60)), func(string, string) (*batchv1.Job, error) { return nil, nil }, "6m0s"},
+		{"job error", jobPod(seconds(60)), failing, "6m0s"},
+		{"bare pod", &corev1.Pod{Spec: corev1.PodSpec{ActiveDeadlineSeconds: seconds(60)}}, noJob, "6m0s"},
+		{"no deadline bare pod", &corev1.Pod{}, noJob, ""},
+		{"long deadline", jobPod(seconds(7 * 24 * 3600)), jobs(nil), "24h0m0s"},
+		{"huge deadline", jobPod(seconds(10_000_000_000)), jobs(nil), "24h0m0s"},
+		{"deadline of the lifetime", jobPod(seconds(24*3600 - 300)), jobs(nil), "24h0m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jobDuration(tt.pod, "default", 24*time.Hour, tt.getJob); got != tt.want {
+				t.Errorf("jobDuration() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobName(t *testing.T) {
+	controller := true
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web", Controller: &controller},
+	}}}
+	if got := jobName(pod); got != "" {
+		t.Errorf("jobName() = %q, want none", got)
+	}
+	pod.OwnerReferences = append(pod.OwnerReferences, metav1.OwnerReference{APIVersion: "batch/v1", Kind: "Job", Name: "migrate"})
+	if got := jobName(pod); got != "" {
+		t.Errorf("jobName() without controller = %q, want none", got)
+	}
+	pod.OwnerReferences[1].Controller = &controller
+	if got := jobName(pod); got != "migrate" {
+		t.Errorf("jobName() = %q, want migrate", got)
+	}
+}
+
+func TestJobDurationPatch(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	tokenSecrets = &fakeSecrets{}
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := devCACertificate("Test Root", time.Now(), key, nil, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootFile := filepath.Join(t.TempDir(), "root.crt")
+	if err := os.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		CaURL:        "https://ca",
+		RootCAPath:   rootFile,
+		CertsVolume:  corev1.Volume{Name: "certs"},
+		Bootstrapper: corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper"},
+		Renewer:      corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+	}
+
+	duration := func(annotations map[string]string) string {
+		t.Helper()
+		annotations[admissionWebhookAnnotationKey] = "batch.default.svc"
+		deadline := int64(600)
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "batch", Annotations: annotations},
+			Spec: corev1.PodSpec{
+				ActiveDeadlineSeconds: &deadline,
+				Containers:            []corev1.Container{{Name: "batch"}},
+			},
+		}
+		b, err := patch(context.Background(), pod, "default", config, fakeTokens{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ops []struct {
+			Path  string          `json:"path"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(b, &ops); err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range ops {
+			var containers []corev1.Container
+			if op.Path != "/spec/initContainers" || json.Unmarshal(op.Value, &containers) != nil {
+				continue
+			}
+			for _, e := range containers[0].Env {
+				if e.Name == "DURATION" {
+					return e.Value
+				}
+			}
+		}
+		t.Fatal("patch() didn't add the bootstrapper")
+		return ""
+	}
+
+	if got := duration(map[string]string{}); got != "15m0s" {
+		t.Errorf("DURATION = %q, want 15m0s", got)
+	}
+	if got := duration(map[string]string{durationWebhookStatusKey: "1h"}); got != "1h" {
+		t.Errorf("DURATION with annotation = %q, want 1h", got)
+	}
+	config.Features = map[string]string{featureJobDuration: "false"}
+	if got := duration(map[string]string{}); got != "" {
+		t.Errorf("DURATION with jobDuration disabled = %q, want none", got)
+	}
+}
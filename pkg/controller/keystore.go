@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/smallstep/autocert/pkg/keystore"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// formatAnnotationKey makes the bootstrapper and the renewer write the
+// certificate as a PKCS#12 or Java keystore and truststore too, for JVM and
+// .NET workloads that can't load PEM files.
+const formatAnnotationKey = "autocert.step.sm/format"
+
+// keystoreFormat returns the format of the keystores of a pod, or "" if the
+// pod only gets PEM files. It returns an error if the certificate isn't
+// written by the injected containers, or if the protocol version in use
+// doesn't support keystores: the application would fail to load them.
+func keystoreFormat(annotations podAnnotations, config *Config) (string, error) {
+	format := annotations.Format
+	if format == "" || format == keystore.FormatPEM {
+		return "", nil
+	}
+	var reason string
+	switch {
+	case annotations.ExternalSecret != "":
+		reason = "the certificate is mounted from a Secret, the pod is annotated with " + externalSecretAnnotationKey
+	case annotations.Secret != "":
+		reason = "the certificate is mounted from a Secret, the pod is annotated with " + secretAnnotationKey
+	case config.GetProtocolVersion() < envProtocolVersions[keystore.FormatEnvVar]:
+		reason = fmt.Sprintf("requires protocol version %d, but version %d is pinned in the configuration", envProtocolVersions[keystore.FormatEnvVar], config.GetProtocolVersion())
+	default:
+		return format, nil
+	}
+	return "", annotationErrors{{
+		Key:    formatAnnotationKey,
+		Value:  format,
+		Reason: reason,
+	}}
+}
+
+// setKeystore configures the injected containers to write the keystores.
+func setKeystore(format string, containers ...*corev1.Container) {
+	for _, c := range containers {
+		c.Env = setEnv(c.Env, corev1.EnvVar{
+			Name:  keystore.FormatEnvVar,
+			Value: format,
+		})
+	}
+}
+
+func checkFormat(v string) string {
+	if !keystore.IsFormat(v) {
+		return "is not a format"
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/smallstep/autocert/pkg/keystore"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestKeystoreFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations podAnnotations
+		config      *Config
+		want        string
+		wantErr     bool
+	}{
+		{"none", podAnnotations{}, &Config{}, "", false},
+		{"pem", podAnnotations{Format: "pem"}, &Config{}, "", false},
+		{"pkcs12", podAnnotations{Format: "pkcs12"}, &Config{}, "pkcs12", false},
+		{"jks", podAnnotations{Format: "jks"}, &Config{}, "jks", false},
+		{"external secret", podAnnotations{Format: "pkcs12", ExternalSecret: "legacy-tls"}, &Config{}, "", true},
+		{"managed secret", podAnnotations{Format: "jks", Secret: "legacy-tls"}, &Config{}, "", true},
+		{"pinned protocol", podAnnotations{Format: "pkcs12"}, &Config{ProtocolVersion: 20}, "", true},
+		{"pinned protocol with pem", podAnnotations{Format: "pem"}, &Config{ProtocolVersion: 20}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keystoreFormat(tt.annotations, tt.config)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("keystoreFormat() = %q, %v, want %q, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetKeystore(t *testing.T) {
+	var b, r corev1.Container
+	r.Env = []corev1.EnvVar{{Name: keystore.FormatEnvVar, Value: "pem"}}
+	setKeystore("jks", &b, &r)
+	for _, c := range []corev1.Container{b, r} {
+		if len(c.Env) != 1 || c.Env[0] != (corev1.EnvVar{Name: keystore.FormatEnvVar, Value: "jks"}) {
+			t.Errorf("Env = %v", c.Env)
+		}
+	}
+}
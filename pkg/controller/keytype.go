@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"crypto"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/smallstep/certificates/api"
+	"go.step.sm/crypto/keyutil"
+	"go.step.sm/crypto/x509util"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// keyTypeAnnotationKey selects the type of the key of a pod, EC, RSA or
+	// Ed25519, for workloads that can't use the default P-256 key.
+	keyTypeAnnotationKey = "autocert.step.sm/key-type"
+	// keySizeAnnotationKey selects the size of the key in bits: the curve of
+	// EC keys, or the modulus of RSA keys.
+	keySizeAnnotationKey = "autocert.step.sm/key-size"
+	// keyTypeEnvVar, keyCurveEnvVar and keySizeEnvVar tell the bootstrapper
+	// the --kty, --curve and --size of the key it generates.
+	keyTypeEnvVar  = "KEY_TYPE"
+	keyCurveEnvVar = "KEY_CURVE"
+	keySizeEnvVar  = "KEY_SIZE"
+)
+
+// ecKeyCurves maps the sizes of EC keys to their curve, rsaKeySizes are the
+// sizes of RSA keys.
+var (
+	ecKeyCurves = map[int]string{256: "P-256", 384: "P-384", 521: "P-521"}
+	rsaKeySizes = []int{2048, 3072, 4096}
+)
+
+// keySpec is the key of a certificate, with the values of the --kty, --curve
+// and --size flags of step. The zero value is the default P-256 key.
+type keySpec struct {
+	Type  string
+	Curve string
+	Size  int
+}
+
+// parseKeySpec returns the key requested by the values of the key-type and
+// key-size annotations. The size defaults to 256 for EC keys and 2048 for
+// RSA keys, the type to EC.
+func parseKeySpec(keyType, keySize string) (keySpec, error) {
+	if keyType == "" && keySize == "" {
+		return keySpec{}, nil
+	}
+	var size int
+	if keySize != "" {
+		size, _ = strconv.Atoi(keySize)
+	}
+	sizeError := func(reason string) error {
+		return annotationErrors{{Key: keySizeAnnotationKey, Value: keySize, Reason: reason}}
+	}
+	switch {
+	case keyType == "" || strings.EqualFold(keyType, "EC"):
+		if size == 0 {
+			size = 256
+		}
+		curve, ok := ecKeyCurves[size]
+		if !ok {
+			return keySpec{}, sizeError("is not a size of EC keys, use 256, 384 or 521")
+		}
+		return keySpec{Type: "EC", Curve: curve}, nil
+	case strings.EqualFold(keyType, "RSA"):
+		if size == 0 {
+			size = rsaKeySizes[0]
+		}
+		if !slices.Contains(rsaKeySizes, size) {
+			return keySpec{}, sizeError("is not a size of RSA keys, use 2048, 3072 or 4096")
+		}
+		return keySpec{Type: "RSA", Size: size}, nil
+	case strings.EqualFold(keyType, "Ed25519"):
+		if keySize != "" {
+			return keySpec{}, sizeError("Ed25519 keys have a fixed size, remove the annotation")
+		}
+		return keySpec{Type: "OKP", Curve: "Ed25519"}, nil
+	default:
+		return keySpec{}, annotationErrors{{Key: keyTypeAnnotationKey, Value: keyType, Reason: "is not a key type"}}
+	}
+}
+
+// podKeySpec returns the key requested by the annotations of a pod. It
+// returns an error if the protocol version in use doesn't support it, the
+// bootstrapper would generate the default key, or if the pod requests a
+// dual-stack RSA certificate next to a key that is not EC.
+func podKeySpec(annotations podAnnotations, config *Config, dual bool) (keySpec, error) {
+	key, err := parseKeySpec(annotations.KeyType, annotations.KeySize)
+	if err != nil || key == (keySpec{}) {
+		return key, err
+	}
+	if v := envProtocolVersions[keyTypeEnvVar]; config.GetProtocolVersion() < v {
+		k, value := keyTypeAnnotationKey, annotations.KeyType
+		if value == "" {
+			k, value = keySizeAnnotationKey, annotations.KeySize
+		}
+		return keySpec{}, annotationErrors{{
+			Key:    k,
+			Value:  value,
+			Reason: fmt.Sprintf("requires protocol version %d, but version %d is pinned in the configuration", v, config.GetProtocolVersion()),
+		}}
+	}
+	if dual && key.Type != "EC" {
+		return keySpec{}, annotationErrors{{
+			Key:    dualStackAnnotationKey,
+			Value:  "true",
+			Reason: fmt.Sprintf("the RSA certificate is added next to an EC one, but the pod requests a %s key", annotations.KeyType),
+		}}
+	}
+	return key, nil
+}
+
+// setKeySpec configures the bootstrapper to generate the key of the pod.
+func setKeySpec(bootstrapper *corev1.Container, key keySpec) {
+	env := []corev1.EnvVar{{Name: keyTypeEnvVar, Value: key.Type}}
+	if key.Curve != "" {
+		env = append(env, corev1.EnvVar{Name: keyCurveEnvVar, Value: key.Curve})
+	}
+	if key.Size != 0 {
+		env = append(env, corev1.EnvVar{Name: keySizeEnvVar, Value: strconv.Itoa(key.Size)})
+	}
+	bootstrapper.Env = setEnv(bootstrapper.Env, env...)
+}
+
+// certificateRequest generates a key and returns a certificate request for
+// the names signed with it.
+func (k keySpec) certificateRequest(commonName string, sans []string) (*api.CertificateRequest, crypto.PrivateKey, error) {
+	if k == (keySpec{}) {
+		k = keySpec{Type: "EC", Curve: "P-256"}
+	}
+	signer, err := keyutil.GenerateSigner(k.Type, k.Curve, k.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509util.CreateCertificateRequest(commonName, sans, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &api.CertificateRequest{CertificateRequest: csr}, signer, nil
+}
+
+func checkKeyType(v string) string {
+	for _, t := range []string{"EC", "RSA", "Ed25519"} {
+		if strings.EqualFold(v, t) {
+			return ""
+		}
+	}
+	return "is not a key type"
+}
+
+func checkKeySize(v string) string {
+	size, err := strconv.Atoi(v)
+	if err != nil || (ecKeyCurves[size] == "" && !slices.Contains(rsaKeySizes, size)) {
+		return "is not a key size"
+	}
+	return ""
+}
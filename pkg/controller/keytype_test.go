@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseKeySpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		keyType  string
+		keySize  string
+		want     keySpec
+		wantKey  string
+		wantFail bool
+	}{
+		{"default", "", "", keySpec{}, "", false},
+		{"EC", "EC", "", keySpec{Type: "EC", Curve: "P-256"}, "", false},
+		{"EC size", "ec", "384", keySpec{Type: "EC", Curve: "P-384"}, "", false},
+		{"size only", "", "521", keySpec{Type: "EC", Curve: "P-521"}, "", false},
+		{"RSA", "RSA", "", keySpec{Type: "RSA", Size: 2048}, "", false},
+		{"RSA size", "rsa", "4096", keySpec{Type: "RSA", Size: 4096}, "", false},
+		{"Ed25519", "Ed25519", "", keySpec{Type: "OKP", Curve: "Ed25519"}, "", false},
+		{"EC with RSA size", "EC", "2048", keySpec{}, keySizeAnnotationKey, true},
+		{"size only with RSA size", "", "3072", keySpec{}, keySizeAnnotationKey, true},
+		{"RSA with EC size", "RSA", "256", keySpec{}, keySizeAnnotationKey, true},
+		{"Ed25519 with size", "Ed25519", "256", keySpec{}, keySizeAnnotationKey, true},
+		{"unknown type", "DSA", "", keySpec{}, keyTypeAnnotationKey, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKeySpec(tt.keyType, tt.keySize)
+			if (err != nil) != tt.wantFail || got != tt.want {
+				t.Fatalf("parseKeySpec() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantFail)
+			}
+			var errs annotationErrors
+			if err != nil && (!errors.As(err, &errs) || errs[0].Key != tt.wantKey) {
+				t.Errorf("parseKeySpec() error = %v, want an error on %s", err, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestPodKeySpec(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations podAnnotations
+		config      *Config
+		dual        bool
+		want        keySpec
+		wantErr     bool
+	}{
+		{"default", podAnnotations{}, &Config{}, false, keySpec{}, false},
+		{"RSA", podAnnotations{KeyType: "RSA", KeySize: "3072"}, &Config{}, false, keySpec{Type: "RSA", Size: 3072}, false},
+		{"pinned protocol", podAnnotations{KeyType: "RSA"}, &Config{ProtocolVersion: 19}, false, keySpec{}, true},
+		{"pinned protocol without annotation", podAnnotations{}, &Config{ProtocolVersion: 19}, false, keySpec{}, false},
+		{"dual-stack EC", podAnnotations{KeySize: "384"}, &Config{}, true, keySpec{Type: "EC", Curve: "P-384"}, false},
+		{"dual-stack RSA", podAnnotations{KeyType: "RSA"}, &Config{}, true, keySpec{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := podKeySpec(tt.annotations, tt.config, tt.dual)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("podKeySpec() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetKeySpec(t *testing.T) {
+	var b corev1.Container
+	setKeySpec(&b, keySpec{Type: "RSA", Size: 4096})
+	want := []corev1.EnvVar{{Name: keyTypeEnvVar, Value: "RSA"}, {Name: keySizeEnvVar, Value: "4096"}}
+	if len(b.Env) != len(want) || b.Env[0] != want[0] || b.Env[1] != want[1] {
+		t.Errorf("setKeySpec() env = %v, want %v", b.Env, want)
+	}
+}
+
+func TestKeySpecCertificateRequest(t *testing.T) {
+	sans := []string{"legacy.default.svc", "10.0.0.1"}
+	for _, spec := range []keySpec{{}, {Type: "EC", Curve: "P-384"}, {Type: "RSA", Size: 2048}, {Type: "OKP", Curve: "Ed25519"}} {
+		csr, key, err := spec.certificateRequest("legacy.default.svc", sans)
+		if err != nil {
+			t.Fatalf("certificateRequest(%v) error = %v", spec, err)
+		}
+		if err := csr.CheckSignature(); err != nil || csr.Subject.CommonName != "legacy.default.svc" || len(csr.DNSNames) != 1 || len(csr.IPAddresses) != 1 {
+			t.Errorf("certificateRequest(%v) = %v, %v", spec, csr.CertificateRequest, err)
+		}
+		var ok bool
+		switch spec.Type {
+		case "", "EC":
+			var k *ecdsa.PrivateKey
+			k, ok = key.(*ecdsa.PrivateKey)
+			ok = ok && (spec.Curve != "" || k.Curve == elliptic.P256())
+		case "RSA":
+			var k *rsa.PrivateKey
+			k, ok = key.(*rsa.PrivateKey)
+			ok = ok && k.N.BitLen() == spec.Size
+		case "OKP":
+			_, ok = key.(ed25519.PrivateKey)
+		}
+		if !ok {
+			t.Errorf("certificateRequest(%v) key = %T", spec, key)
+		}
+	}
+}
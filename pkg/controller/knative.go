@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// knativeRevisionLabel and knativeRevisionUIDLabel are set by Knative
+	// Serving on the pods of a Revision.
+	knativeRevisionLabel    = "serving.knative.dev/revision"
+	knativeRevisionUIDLabel = "serving.knative.dev/revisionUID"
+	// knativeRevisionAPIVersion is the API version of Knative Revisions.
+	knativeRevisionAPIVersion = "serving.knative.dev/v1"
+	// knativeSecretSuffix is appended to the name of a Revision to name the
+	// Secret with the certificate of its pods.
+	knativeSecretSuffix = "-autocert-tls"
+)
+
+// validateKnativeSecrets returns an error if knativeSecrets is enabled
+// without secretIssuance, which renews the Secrets.
+func validateKnativeSecrets(c *Config) error {
+	if c.KnativeSecrets && !c.SecretIssuance.Enabled {
+		return errors.New("knativeSecrets requires secretIssuance to be enabled")
+	}
+	return nil
+}
+
+// knativeSecret returns the name of the managed Secret shared by the pods of
+// a Knative Revision, the reference to the Revision owning it, and the SANs
+// of its certificate. The first pod of a Revision gets the certificate
+// issued, the next ones, like the ones started when scaling from zero, mount
+// it without waiting for the CA.
+//
+// The revision of a rollout with isolated identities gets its own Secret.
+//
+// It returns "" for pods getting their certificate from the injected
+// containers: knativeSecrets is disabled, the pod is not part of a Revision,
+// it mounts an external Secret, uses annotations only implemented by the
+// injected containers, or its names are held by an approval gate or in
+// csrNamespaces.
+func knativeSecret(ctx context.Context, pod *corev1.Pod, namespace string, annotations podAnnotations, rollout string, config *Config) (string, *metav1.OwnerReference, []string, error) {
+	revision := pod.Labels[knativeRevisionLabel]
+	if !config.KnativeSecrets || revision == "" || annotations.ExternalSecret != "" || usesInjectedContainers(pod, annotations) {
+		return "", nil, nil, nil
+	}
+	sans, err := desiredSANs(ctx, pod, namespace, rollout, config)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if csr, _ := usesCSR(config, append([]string{annotations.CommonName}, sans...), namespace); csr {
+		return "", nil, nil, nil
+	}
+	var owner *metav1.OwnerReference
+	if uid := pod.Labels[knativeRevisionUIDLabel]; uid != "" {
+		owner = &metav1.OwnerReference{
+			APIVersion: knativeRevisionAPIVersion,
+			Kind:       "Revision",
+			Name:       revision,
+			UID:        types.UID(uid),
+		}
+	}
+	if rollout != "" {
+		revision += "-" + rollout
+	}
+	return revision + knativeSecretSuffix, owner, sans, nil
+}
+
+// usesInjectedContainers returns whether a pod uses annotations implemented
+// by the bootstrapper or the renewer, which are not injected for pods with a
+// managed Secret.
+func usesInjectedContainers(pod *corev1.Pod, annotations podAnnotations) bool {
+	return annotations.Owner != "" || annotations.Mode != "" || annotations.Umask != "" ||
+		annotations.First || annotations.BootstrapperOnly || annotations.ReadOnly ||
+		annotations.WaitForDrain || annotations.SDS || annotations.Format != "" ||
+		annotations.RenewalSignal != "" || annotations.RenewalProcess != "" ||
+		annotations.RenewalExec != "" || annotations.RenewalContainer != "" ||
+		strings.EqualFold(pod.Annotations[dualStackAnnotationKey], "true")
+}
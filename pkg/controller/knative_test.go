@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// revisionPod returns a pod of the Knative Revision hello-00001.
+func revisionPod(annotations map[string]string) *corev1.Pod {
+	annotations[admissionWebhookAnnotationKey] = "hello.serving.svc"
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "hello-00001-deployment-",
+			Labels: map[string]string{
+				knativeRevisionLabel:    "hello-00001",
+				knativeRevisionUIDLabel: "4d2b5c1e-8a7f-4f8e-9b3a-2c6d1e0f7a90",
+			},
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "user-container"}}},
+	}
+}
+
+func TestValidateKnativeSecrets(t *testing.T) {
+	if err := validateKnativeSecrets(&Config{KnativeSecrets: true, SecretIssuance: SecretIssuance{Enabled: true}}); err != nil {
+		t.Errorf("validateKnativeSecrets() = %v", err)
+	}
+	if err := validateKnativeSecrets(&Config{KnativeSecrets: true}); err == nil {
+		t.Error("validateKnativeSecrets() without secretIssuance should fail")
+	}
+}
+
+func TestKnativeSecret(t *testing.T) {
+	enabled := &Config{KnativeSecrets: true, SecretIssuance: SecretIssuance{Enabled: true}}
+	tests := []struct {
+		name    string
+		config  *Config
+		pod     *corev1.Pod
+		rollout string
+		want    string
+	}{
+		{"revision", enabled, revisionPod(map[string]string{}), "", "hello-00001-autocert-tls"},
+		{"disabled", &Config{}, revisionPod(map[string]string{}), "", ""},
+		{"not a revision", enabled, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{admissionWebhookAnnotationKey: "hello.serving.svc"}}}, "", ""},
+		{"external secret", enabled, revisionPod(map[string]string{externalSecretAnnotationKey: "hello-tls"}), "", ""},
+		{"keystore", enabled, revisionPod(map[string]string{formatAnnotationKey: "pkcs12"}), "", ""},
+		{"renewal hook", enabled, revisionPod(map[string]string{renewalSignalAnnotationKey: "SIGHUP"}), "", ""},
+		{"dual stack", enabled, revisionPod(map[string]string{dualStackAnnotationKey: "true"}), "", ""},
+		{"approval gate", &Config{
+			KnativeSecrets: true,
+			SecretIssuance: SecretIssuance{Enabled: true},
+			ApprovalGates:  []ApprovalGate{{Name: "serving", Names: []string{"*.serving.svc"}}},
+		}, revisionPod(map[string]string{}), "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations, err := parseAnnotations(tt.pod.Annotations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name, owner, sans, err := knativeSecret(context.Background(), tt.pod, "serving", annotations, tt.rollout, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.want {
+				t.Fatalf("knativeSecret() = %q, want %q", name, tt.want)
+			}
+			if name == "" {
+				return
+			}
+			if owner == nil || owner.Kind != "Revision" || owner.Name != "hello-00001" || owner.UID != "4d2b5c1e-8a7f-4f8e-9b3a-2c6d1e0f7a90" {
+				t.Errorf("knativeSecret() owner = %+v, want revision hello-00001", owner)
+			}
+			if len(sans) != 1 || sans[0] != "hello.serving.svc" {
+				t.Errorf("knativeSecret() sans = %v", sans)
+			}
+		})
+	}
+}
+
+func TestKnativeScaleFromZero(t *testing.T) {
+	now := time.Now()
+	issuer, secrets, issued := fakeSecretIssuer(t, &now)
+	defer func(s *secretIssuer) { managedSecrets = s }(managedSecrets)
+	managedSecrets = issuer
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+	config := secretIssuanceConfig(t)
+	config.KnativeSecrets = true
+
+	// The first pod of the revision gets the certificate issued, the next
+	// ones mount it.
+	for i := range 3 {
+		b, err := patch(context.Background(), revisionPod(map[string]string{}), "serving", config, fakeTokens{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ops []PatchOperation
+		if err := json.Unmarshal(b, &ops); err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range ops {
+			switch op.Path {
+			case "/spec/initContainers", "/spec/initContainers/-", "/spec/containers/-":
+				t.Errorf("pod %d: patch() adds a container", i)
+			}
+		}
+		if *issued != 1 {
+			t.Errorf("pod %d: issued %d certificates, want 1", i, *issued)
+		}
+	}
+	secret := secrets["serving/hello-00001-autocert-tls"]
+	if secret == nil {
+		t.Fatal("patch() didn't issue the certificate of the revision")
+	}
+	if refs := secret.OwnerReferences; len(refs) != 1 || refs[0].APIVersion != "serving.knative.dev/v1" || refs[0].Name != "hello-00001" {
+		t.Errorf("secret owner references = %+v, want revision hello-00001", refs)
+	}
+
+	// Renewals keep the owner.
+	issuer.renew(context.Background(), config, "step", now.Add(50*time.Minute))
+	if *issued != 2 || len(secrets["serving/hello-00001-autocert-tls"].OwnerReferences) != 1 {
+		t.Errorf("renew() issued %d certificates, owners %+v", *issued, secrets["serving/hello-00001-autocert-tls"].OwnerReferences)
+	}
+}
+
+// BenchmarkKnativeScaleFromZero measures the admission of a pod of a
+// Revision scaling from zero, whose certificate is already in the Secret of
+// the Revision. It's the only time autocert adds to the cold start: the pod
+// gets no init container, and its certificate is in the volume when the
+// application starts.
+func BenchmarkKnativeScaleFromZero(b *testing.B) {
+	now := time.Now()
+	issuer, _, _ := fakeSecretIssuer(b, &now)
+	defer func(s *secretIssuer) { managedSecrets = s }(managedSecrets)
+	managedSecrets = issuer
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+	config := secretIssuanceConfig(b)
+	config.KnativeSecrets = true
+
+	if _, err := patch(context.Background(), revisionPod(map[string]string{}), "serving", config, fakeTokens{}); err != nil {
+		b.Fatal(err)
+	}
+	for b.Loop() {
+		if _, err := patch(context.Background(), revisionPod(map[string]string{}), "serving", config, fakeTokens{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	defaultLeaseName     = "autocert-controller"
+	defaultLeaseDuration = 15 * time.Second
+	minLeaseDuration     = 3 * time.Second
+)
+
+// LeaderElection elects one replica of the controller to run the background
+// tasks that must not run twice: the webhook reconciler and the renewal of
+// the Secrets of secretIssuance. Every replica admits pods and serves the
+// endpoints, so features keeping claims or a CA in the memory or the disk of
+// the replica admitting the pod can't be enabled with it. The leader holds a
+// Lease in the namespace of the controller.
+type LeaderElection struct {
+	Enabled bool `yaml:"enabled"`
+	// LeaseName defaults to autocert-controller.
+	LeaseName string `yaml:"leaseName"`
+	// LeaseDuration is how long the other replicas wait for a leader that
+	// stopped renewing the lease before taking over, defaults to 15s.
+	LeaseDuration string `yaml:"leaseDuration"`
+}
+
+// GetLeaseName returns the name of the Lease, defaults to
+// autocert-controller.
+func (l LeaderElection) GetLeaseName() string {
+	return cmp.Or(l.LeaseName, defaultLeaseName)
+}
+
+// GetLeaseDuration returns the duration of the lease, defaults to 15s.
+func (l LeaderElection) GetLeaseDuration() time.Duration {
+	d, err := time.ParseDuration(l.LeaseDuration)
+	if err != nil || d <= 0 {
+		return defaultLeaseDuration
+	}
+	return d
+}
+
+// validateLeaderElection returns an error if the leader election is not
+// valid.
+func validateLeaderElection(c *Config) error {
+	l := c.LeaderElection
+	if l.LeaseDuration != "" {
+		if d, err := time.ParseDuration(l.LeaseDuration); err != nil || d < minLeaseDuration {
+			return fmt.Errorf("leaderElection.leaseDuration %q must be a duration of at least %s", l.LeaseDuration, minLeaseDuration)
+		}
+	}
+	if l.LeaseName != "" {
+		if errs := validation.IsDNS1123Subdomain(l.LeaseName); len(errs) > 0 {
+			return fmt.Errorf("invalid leaderElection.leaseName %q: %s", l.LeaseName, strings.Join(errs, ", "))
+		}
+	}
+	if !l.Enabled {
+		return nil
+	}
+	// Bootstrappers reach any replica through the Service, they must not
+	// depend on the state of the one that admitted their pod.
+	var conflicts []string
+	if c.DevCA.Enabled {
+		conflicts = append(conflicts, "devCA")
+	}
+	if c.TokenBinding {
+		conflicts = append(conflicts, "tokenBinding")
+	}
+	if c.TokenRemint.Enabled {
+		conflicts = append(conflicts, "tokenRemint")
+	}
+	if len(c.CSRNamespaces) > 0 || len(c.ApprovalGates) > 0 {
+		conflicts = append(conflicts, "csrNamespaces and approvalGates")
+	}
+	if c.GetAdmissionBudget() > 0 {
+		conflicts = append(conflicts, "admissionBudget")
+	}
+	if c.PersistentQueue.Path != "" {
+		conflicts = append(conflicts, "persistentQueue")
+	}
+	if c.IssuanceLog.Enabled {
+		conflicts = append(conflicts, "issuanceLog")
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("leaderElection can't be enabled with %s, their claims, CA or records are only known to the replica admitting the pod", strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+var leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "autocert_leader",
+	Help: "Whether this replica of the controller is the leader running the background tasks.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(leaderGauge)
+}
+
+// leaderElector acquires and renews the Lease of the leader. A lease is
+// expired when its holder didn't renew it for its duration, measured with
+// the local clock since the lease was last seen changing, so clock skew
+// between replicas doesn't matter.
+type leaderElector struct {
+	identity string
+	name     string
+	duration time.Duration
+	// get returns the Lease with the given name, or nil if it doesn't
+	// exist.
+	get    func(name string) (*coordinationv1.Lease, error)
+	create func(lease *coordinationv1.Lease) error
+	update func(lease *coordinationv1.Lease) error
+
+	// observed is the holder and renew time of the lease when last read,
+	// and observedAt when they last changed.
+	observed   string
+	observedAt time.Time
+}
+
+// newLeaderElector returns an elector of the Lease in the namespace of the
+// controller. The replica is identified by its pod name.
+func newLeaderElector(l LeaderElection, namespace string) *leaderElector {
+	hostname, _ := os.Hostname()
+	return &leaderElector{
+		identity: cmp.Or(os.Getenv("POD_NAME"), hostname),
+		name:     l.GetLeaseName(),
+		duration: l.GetLeaseDuration(),
+		get: func(name string) (*coordinationv1.Lease, error) {
+			return getLease(namespace, name)
+		},
+		create: func(lease *coordinationv1.Lease) error {
+			return sendLease(http.MethodPost, leaseAPI(namespace), lease)
+		},
+		update: func(lease *coordinationv1.Lease) error {
+			return sendLease(http.MethodPut, leaseAPI(namespace)+"/"+lease.Name, lease)
+		},
+	}
+}
+
+// run tries to acquire the lease until the context is canceled, and calls
+// lead, which must start the tasks of the leader and return, with a context
+// canceled when the replica stops being the leader. The leader steps down if
+// it can't renew the lease in 2/3 of its duration, so it stops before another
+// replica can take over, and releases the lease on shutdown so another one
+// takes over at once.
+func (e *leaderElector) run(ctx context.Context, lead func(ctx context.Context)) {
+	retry, deadline := e.duration/3, e.duration*2/3
+	ctxLog := log.WithFields(log.Fields{
+		"lease":    e.name,
+		"identity": e.identity,
+	})
+	ctxLog.WithField("duration", e.duration).Info("Electing the leader")
+
+	var stop context.CancelFunc
+	var renewed time.Time
+	ticker := time.NewTicker(retry)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		acquired, err := e.tryAcquire(now)
+		if err != nil {
+			ctxLog.WithField("error", err).Warn("Error acquiring the leader lease")
+		}
+		switch {
+		case acquired:
+			renewed = now
+			if stop == nil {
+				var leadCtx context.Context
+				leadCtx, stop = context.WithCancel(ctx)
+				leaderGauge.Set(1)
+				ctxLog.Info("Became the leader")
+				lead(leadCtx)
+			}
+		case stop != nil && (err == nil || now.Sub(renewed) > deadline):
+			stop()
+			stop = nil
+			leaderGauge.Set(0)
+			ctxLog.Warn("Stopped being the leader")
+		}
+
+		select {
+		case <-ctx.Done():
+			if stop != nil {
+				stop()
+				leaderGauge.Set(0)
+				if err := e.release(); err != nil {
+					ctxLog.WithField("error", err).Warn("Error releasing the leader lease")
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryAcquire creates, renews or takes over the lease, and returns whether
+// this replica holds it.
+func (e *leaderElector) tryAcquire(now time.Time) (bool, error) {
+	lease, err := e.get(e.name)
+	if err != nil {
+		return false, err
+	}
+	if lease == nil {
+		lease = &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: e.name}}
+		e.hold(lease, now, 0)
+		if err := e.create(lease); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	holder := ptrValue(lease.Spec.HolderIdentity)
+	if observed := holder + "@" + microTime(lease.Spec.RenewTime); observed != e.observed {
+		e.observed, e.observedAt = observed, now
+	}
+	duration := e.duration
+	if s := ptrValue(lease.Spec.LeaseDurationSeconds); s > 0 {
+		duration = time.Duration(s) * time.Second
+	}
+
+	switch {
+	case holder == e.identity:
+		lease.Spec.RenewTime = &metav1.MicroTime{Time: now}
+	case holder == "" || now.Sub(e.observedAt) > duration:
+		e.hold(lease, now, ptrValue(lease.Spec.LeaseTransitions)+1)
+	default:
+		return false, nil
+	}
+	if err := e.update(lease); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hold sets this replica as the holder of the lease.
+func (e *leaderElector) hold(lease *coordinationv1.Lease, now time.Time, transitions int32) {
+	seconds := int32(e.duration / time.Second) //nolint:gosec // a few seconds
+	lease.Spec = coordinationv1.LeaseSpec{
+		HolderIdentity:       &e.identity,
+		LeaseDurationSeconds: &seconds,
+		AcquireTime:          &metav1.MicroTime{Time: now},
+		RenewTime:            &metav1.MicroTime{Time: now},
+		LeaseTransitions:     &transitions,
+	}
+}
+
+// release clears the holder of the lease, if it's still this replica.
+func (e *leaderElector) release() error {
+	lease, err := e.get(e.name)
+	if err != nil || lease == nil || ptrValue(lease.Spec.HolderIdentity) != e.identity {
+		return err
+	}
+	lease.Spec.HolderIdentity = nil
+	return e.update(lease)
+}
+
+func ptrValue[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
+	}
+	return *p
+}
+
+func microTime(t *metav1.MicroTime) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func leaseAPI(namespace string) string {
+	return fmt.Sprintf("apis/coordination.k8s.io/v1/namespaces/%s/leases", namespace)
+}
+
+// getLease returns the Lease with the given name, or nil if it doesn't
+// exist.
+func getLease(namespace, name string) (*coordinationv1.Lease, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := client.GetRequest(leaseAPI(namespace) + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, errors.New(resp.Status)
+	}
+	var lease coordinationv1.Lease
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// sendLease creates or replaces a Lease. The resource version of the lease
+// makes an update fail if another replica modified it since it was read.
+func sendLease(method, path string, lease *coordinationv1.Lease) error {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	var req *http.Request
+	if method == http.MethodPost {
+		req, err = client.PostRequest(path, string(body), "application/json")
+	} else {
+		req, err = client.PutRequest(path, string(body), "application/json")
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
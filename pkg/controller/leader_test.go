@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateLeaderElection(t *testing.T) {
+	enabled := LeaderElection{Enabled: true}
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"not set", Config{}, false},
+		{"ok", Config{LeaderElection: LeaderElection{Enabled: true, LeaseName: "autocert-east", LeaseDuration: "30s"}}, false},
+		{"short duration", Config{LeaderElection: LeaderElection{LeaseDuration: "1s"}}, true},
+		{"bad duration", Config{LeaderElection: LeaderElection{LeaseDuration: "soon"}}, true},
+		{"bad name", Config{LeaderElection: LeaderElection{LeaseName: "Autocert_Leader"}}, true},
+		{"disabled with devCA", Config{DevCA: DevCA{Enabled: true}}, false},
+		{"devCA", Config{LeaderElection: enabled, DevCA: DevCA{Enabled: true}}, true},
+		{"tokenBinding", Config{LeaderElection: enabled, TokenBinding: true}, true},
+		{"tokenRemint", Config{LeaderElection: enabled, TokenRemint: TokenRemint{Enabled: true}}, true},
+		{"csrNamespaces", Config{LeaderElection: enabled, CSRNamespaces: []string{"legacy"}}, true},
+		{"approvalGates", Config{LeaderElection: enabled, ApprovalGates: []ApprovalGate{{Name: "a", Names: []string{"a"}}}}, true},
+		{"admissionBudget", Config{LeaderElection: enabled, AdmissionBudget: "2s"}, true},
+		{"persistentQueue", Config{LeaderElection: enabled, PersistentQueue: PersistentQueue{Path: "/var/lib/autocert/queue"}}, true},
+		{"issuanceLog", Config{LeaderElection: enabled, IssuanceLog: IssuanceLog{Enabled: true, Path: "/var/lib/autocert/issuances", Key: "/etc/autocert/issuances.key"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateLeaderElection(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateLeaderElection() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// fakeLeases stores a single lease, and fails updates with a stale resource
+// version like the API server.
+type fakeLeases struct {
+	lease   *coordinationv1.Lease
+	version int
+	err     error
+}
+
+func (f *fakeLeases) elector(identity string) *leaderElector {
+	return &leaderElector{
+		identity: identity,
+		name:     defaultLeaseName,
+		duration: 15 * time.Second,
+		get: func(string) (*coordinationv1.Lease, error) {
+			if f.err != nil || f.lease == nil {
+				return nil, f.err
+			}
+			return f.lease.DeepCopy(), nil
+		},
+		create: func(lease *coordinationv1.Lease) error {
+			if f.lease != nil {
+				return errors.New("409 Conflict")
+			}
+			f.store(lease)
+			return nil
+		},
+		update: func(lease *coordinationv1.Lease) error {
+			if f.err != nil {
+				return f.err
+			}
+			if lease.ResourceVersion != f.lease.ResourceVersion {
+				return errors.New("409 Conflict")
+			}
+			f.store(lease)
+			return nil
+		},
+	}
+}
+
+func (f *fakeLeases) store(lease *coordinationv1.Lease) {
+	f.version++
+	f.lease = lease.DeepCopy()
+	f.lease.ResourceVersion = strconv.Itoa(f.version)
+}
+
+func (f *fakeLeases) holder() string {
+	return ptrValue(f.lease.Spec.HolderIdentity)
+}
+
+func TestLeaderElector_tryAcquire(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	leases := &fakeLeases{}
+	a, b := leases.elector("autocert-a"), leases.elector("autocert-b")
+
+	if ok, err := a.tryAcquire(now); !ok || err != nil {
+		t.Fatalf("tryAcquire() = %v, %v, want the new lease", ok, err)
+	}
+	if leases.holder() != "autocert-a" || ptrValue(leases.lease.Spec.LeaseDurationSeconds) != 15 {
+		t.Errorf("lease = %+v, want held by autocert-a for 15s", leases.lease.Spec)
+	}
+
+	// The leader renews, the other replica waits for the lease to expire.
+	for i := range 3 {
+		at := now.Add(time.Duration(i+1) * 5 * time.Second)
+		if ok, err := a.tryAcquire(at); !ok || err != nil {
+			t.Fatalf("tryAcquire() = %v, %v, want the lease renewed", ok, err)
+		}
+		if ok, err := b.tryAcquire(at); ok || err != nil {
+			t.Fatalf("tryAcquire() = %v, %v, want the lease held by the leader", ok, err)
+		}
+	}
+	if !leases.lease.Spec.RenewTime.Equal(&metav1.MicroTime{Time: now.Add(15 * time.Second)}) {
+		t.Errorf("renewTime = %v, want the last renewal", leases.lease.Spec.RenewTime)
+	}
+
+	// The leader stops renewing, and is replaced once the lease wasn't
+	// renewed for its duration.
+	if ok, _ := b.tryAcquire(now.Add(25 * time.Second)); ok {
+		t.Fatal("tryAcquire() took over a lease renewed 10s ago")
+	}
+	if ok, err := b.tryAcquire(now.Add(31 * time.Second)); !ok || err != nil {
+		t.Fatalf("tryAcquire() = %v, %v, want the expired lease", ok, err)
+	}
+	if leases.holder() != "autocert-b" || ptrValue(leases.lease.Spec.LeaseTransitions) != 1 {
+		t.Errorf("lease = %+v, want held by autocert-b after 1 transition", leases.lease.Spec)
+	}
+	if ok, _ := a.tryAcquire(now.Add(32 * time.Second)); ok {
+		t.Error("tryAcquire() kept the lease of the replaced leader")
+	}
+
+	// A released lease is taken over at once.
+	if err := b.release(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := a.tryAcquire(now.Add(33 * time.Second)); !ok || err != nil {
+		t.Fatalf("tryAcquire() = %v, %v, want the released lease", ok, err)
+	}
+
+	leases.err = errors.New("connection refused")
+	if ok, err := a.tryAcquire(now.Add(35 * time.Second)); ok || err == nil {
+		t.Errorf("tryAcquire() = %v, %v, want an error", ok, err)
+	}
+}
+
+func TestLeaderElector_run(t *testing.T) {
+	leases := &fakeLeases{}
+	e := leases.elector("autocert-a")
+	e.duration = 30 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	led := make(chan context.Context, 1)
+	done := make(chan struct{})
+	go func() {
+		e.run(ctx, func(ctx context.Context) { led <- ctx })
+		close(done)
+	}()
+
+	var leadCtx context.Context
+	select {
+	case leadCtx = <-led:
+	case <-time.After(time.Second):
+		t.Fatal("run() didn't lead")
+	}
+	cancel()
+	<-done
+	if leadCtx.Err() == nil {
+		t.Error("the context of the leader is not canceled on shutdown")
+	}
+	if leases.holder() != "" {
+		t.Errorf("holder = %q, want the lease released", leases.holder())
+	}
+}
@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// leakGuardInterval is how often the usage of the controller is checked
+	// against the leak guard limits.
+	leakGuardInterval = time.Minute
+	// leakGuardChecks is the number of consecutive checks over a limit after
+	// which the controller reports itself unhealthy, so spikes under load
+	// don't restart it.
+	leakGuardChecks = 3
+)
+
+// Resources checked by the leak guard, used as the resource label of
+// autocert_leak_guard_exceeded.
+const (
+	resourceGoroutines = "goroutines"
+	resourceOpenFDs    = "open_fds"
+	resourceHeap       = "heap"
+)
+
+// LeakGuard sets limits on the usage of the controller. Once a limit is
+// exceeded for 3 consecutive minutes, /healthz fails so the liveness probe
+// restarts the controller before a slow leak, like connections to the CA
+// never closed, takes it down. Limits left at zero are not checked.
+type LeakGuard struct {
+	MaxGoroutines int `yaml:"maxGoroutines"`
+	MaxOpenFDs    int `yaml:"maxOpenFDs"`
+	// MaxHeap is a quantity, like 512Mi.
+	MaxHeap string `yaml:"maxHeap"`
+}
+
+// enabled returns whether any limit is set.
+func (g LeakGuard) enabled() bool {
+	return g.MaxGoroutines > 0 || g.MaxOpenFDs > 0 || g.MaxHeap != ""
+}
+
+// GetMaxHeap returns the heap limit in bytes, 0 if not set.
+func (g LeakGuard) GetMaxHeap() uint64 {
+	q, err := resource.ParseQuantity(g.MaxHeap)
+	if err != nil || q.Sign() <= 0 {
+		return 0
+	}
+	return uint64(q.Value()) //nolint:gosec // the quantity is positive
+}
+
+// validateLeakGuard returns an error if the leak guard limits are invalid.
+func validateLeakGuard(c *Config) error {
+	g := c.LeakGuard
+	if g.MaxGoroutines < 0 || g.MaxOpenFDs < 0 {
+		return fmt.Errorf("leakGuard limits must not be negative")
+	}
+	if g.MaxHeap != "" {
+		if q, err := resource.ParseQuantity(g.MaxHeap); err != nil || q.Sign() <= 0 {
+			return fmt.Errorf("leakGuard.maxHeap %q must be a positive quantity, like 512Mi", g.MaxHeap)
+		}
+	}
+	return nil
+}
+
+var (
+	// leakGuardExceeded tells which limits are currently exceeded.
+	leakGuardExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "autocert_leak_guard_exceeded",
+		Help: "Whether the usage of the controller is over the leak guard limit, by resource.",
+	}, []string{"resource"})
+
+	// selfGuard is the leak guard of the controller.
+	selfGuard = &leakGuard{}
+)
+
+func init() {
+	// The goroutines, heap and open file descriptors of the controller are
+	// exported as go_goroutines, go_memstats_heap_alloc_bytes and
+	// process_open_fds.
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		leakGuardExceeded,
+	)
+}
+
+// selfUsage is the usage of the controller checked by the leak guard.
+type selfUsage struct {
+	Goroutines int
+	OpenFDs    int
+	Heap       uint64
+}
+
+// currentUsage returns the current usage of the controller. The open file
+// descriptors are only counted on Linux, and are 0 elsewhere.
+func currentUsage() selfUsage {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	u := selfUsage{
+		Goroutines: runtime.NumGoroutine(),
+		Heap:       ms.HeapAlloc,
+	}
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		u.OpenFDs = len(fds)
+	}
+	return u
+}
+
+// leakGuard tracks how long the usage of the controller has been over the
+// limits.
+type leakGuard struct {
+	sync.Mutex
+	over map[string]int
+	err  error
+}
+
+// run checks the usage of the controller every leakGuardInterval until the
+// context is canceled.
+func (g *leakGuard) run(ctx context.Context, limits LeakGuard) {
+	ticker := time.NewTicker(leakGuardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.observe(limits, currentUsage())
+		}
+	}
+}
+
+// observe records a usage sample. The guard becomes unhealthy once a limit is
+// exceeded for leakGuardChecks consecutive samples, and stays so until the
+// controller restarts.
+func (g *leakGuard) observe(limits LeakGuard, u selfUsage) {
+	g.Lock()
+	defer g.Unlock()
+	if g.over == nil {
+		g.over = make(map[string]int)
+	}
+
+	check := func(name string, exceeded bool, usage string) {
+		if !exceeded {
+			g.over[name] = 0
+			leakGuardExceeded.WithLabelValues(name).Set(0)
+			return
+		}
+		g.over[name]++
+		leakGuardExceeded.WithLabelValues(name).Set(1)
+		log.WithFields(log.Fields{
+			"resource": name,
+			"usage":    usage,
+			"checks":   g.over[name],
+		}).Warn("Controller usage over the leak guard limit")
+		if g.over[name] >= leakGuardChecks && g.err == nil {
+			g.err = fmt.Errorf("%s over the leak guard limit for %d checks: %s", name, g.over[name], usage)
+			log.WithField("error", g.err).Error("Leak guard tripped, failing health checks to restart the controller")
+		}
+	}
+
+	if limits.MaxGoroutines > 0 {
+		check(resourceGoroutines, u.Goroutines > limits.MaxGoroutines, fmt.Sprintf("%d > %d", u.Goroutines, limits.MaxGoroutines))
+	}
+	if limits.MaxOpenFDs > 0 && u.OpenFDs > 0 {
+		check(resourceOpenFDs, u.OpenFDs > limits.MaxOpenFDs, fmt.Sprintf("%d > %d", u.OpenFDs, limits.MaxOpenFDs))
+	}
+	if maxHeap := limits.GetMaxHeap(); maxHeap > 0 {
+		check(resourceHeap, u.Heap > maxHeap, fmt.Sprintf("%d > %d bytes", u.Heap, maxHeap))
+	}
+}
+
+// healthy returns an error once the leak guard has tripped.
+func (g *leakGuard) healthy() error {
+	g.Lock()
+	defer g.Unlock()
+	return g.err
+}
@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestValidateLeakGuard(t *testing.T) {
+	tests := []struct {
+		name    string
+		guard   LeakGuard
+		wantErr bool
+	}{
+		{"off", LeakGuard{}, false},
+		{"limits", LeakGuard{MaxGoroutines: 5000, MaxOpenFDs: 1000, MaxHeap: "512Mi"}, false},
+		{"negative", LeakGuard{MaxGoroutines: -1}, true},
+		{"invalid heap", LeakGuard{MaxHeap: "lots"}, true},
+		{"zero heap", LeakGuard{MaxHeap: "0"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateLeakGuard(&Config{LeakGuard: tt.guard}); (err != nil) != tt.wantErr {
+				t.Errorf("validateLeakGuard() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLeakGuard(t *testing.T) {
+	limits := LeakGuard{MaxGoroutines: 100, MaxOpenFDs: 50, MaxHeap: "1Mi"}
+	g := &leakGuard{}
+
+	// Spikes don't trip the guard.
+	g.observe(limits, selfUsage{Goroutines: 200, OpenFDs: 10, Heap: 1024})
+	g.observe(limits, selfUsage{Goroutines: 200, OpenFDs: 10, Heap: 1024})
+	g.observe(limits, selfUsage{Goroutines: 10, OpenFDs: 10, Heap: 1024})
+	g.observe(limits, selfUsage{Goroutines: 200, OpenFDs: 10, Heap: 1024})
+	if err := g.healthy(); err != nil {
+		t.Fatalf("healthy() = %v after a spike", err)
+	}
+
+	// A sustained leak does.
+	for range leakGuardChecks {
+		g.observe(limits, selfUsage{Goroutines: 10, OpenFDs: 60, Heap: 1024})
+	}
+	if err := g.healthy(); err == nil {
+		t.Fatal("healthy() = nil after a sustained leak")
+	}
+
+	// Until the controller restarts.
+	g.observe(limits, selfUsage{Goroutines: 10, OpenFDs: 10, Heap: 1024})
+	if err := g.healthy(); err == nil {
+		t.Error("healthy() = nil after the usage went down")
+	}
+}
+
+func TestCurrentUsage(t *testing.T) {
+	u := currentUsage()
+	if u.Goroutines == 0 || u.Heap == 0 {
+		t.Errorf("currentUsage() = %+v", u)
+	}
+}
@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Load shedding policies.
+const (
+	// shedReject denies the pods with a retryable error. Workload controllers
+	// retry creating them with a backoff.
+	shedReject = "reject"
+	// shedAllow admits the pods without a certificate.
+	shedAllow = "allow"
+)
+
+// reasonOverloaded is the reason of the admission decisions made when the
+// controller sheds load.
+const reasonOverloaded = "overloaded"
+
+// LoadShedding bounds the number of admission reviews processed at the same
+// time. Reviews over MaxInFlight wait in a queue of up to MaxQueued reviews,
+// until a slot is free or the API server stops waiting. Reviews that don't
+// fit in the queue, or time out waiting, are shed following Policy.
+type LoadShedding struct {
+	// MaxInFlight is the number of reviews processed at the same time, 0 for
+	// no limit.
+	MaxInFlight int `yaml:"maxInFlight"`
+	// MaxQueued is the number of reviews waiting for a slot.
+	MaxQueued int `yaml:"maxQueued"`
+	// Policy is reject or allow, defaults to reject.
+	Policy string `yaml:"policy"`
+}
+
+// GetPolicy returns the load shedding policy, defaults to reject.
+func (l LoadShedding) GetPolicy() string {
+	if l.Policy == "" {
+		return shedReject
+	}
+	return l.Policy
+}
+
+// validateLoadShedding returns an error if the load shedding configuration is
+// invalid.
+func validateLoadShedding(c *Config) error {
+	l := c.LoadShedding
+	if l.MaxInFlight < 0 || l.MaxQueued < 0 {
+		return fmt.Errorf("loadShedding limits must not be negative")
+	}
+	switch l.GetPolicy() {
+	case shedReject, shedAllow:
+		return nil
+	default:
+		return fmt.Errorf("loadShedding.policy %q is not valid, it must be %s or %s", l.Policy, shedReject, shedAllow)
+	}
+}
+
+// QueueMetrics observes the admission queue of the controller. The controller
+// exports Prometheus metrics by default, replaced by WithQueueMetrics.
+type QueueMetrics interface {
+	// SetInFlight sets the number of reviews being processed.
+	SetInFlight(n int)
+	// SetQueued sets the number of reviews waiting for a slot.
+	SetQueued(n int)
+	// Shed counts a review shed with the given policy.
+	Shed(policy string)
+}
+
+var (
+	admissionInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "autocert_admission_in_flight",
+		Help: "Number of admission reviews being processed.",
+	})
+	admissionQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "autocert_admission_queued",
+		Help: "Number of admission reviews waiting for a slot.",
+	})
+	admissionShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autocert_admission_shed_total",
+		Help: "Number of admission reviews shed because the controller is saturated, by policy.",
+	}, []string{"policy"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(admissionInFlight, admissionQueued, admissionShed)
+}
+
+// promQueueMetrics exports the admission queue metrics on /metrics.
+type promQueueMetrics struct{}
+
+func (promQueueMetrics) SetInFlight(n int) {
+	admissionInFlight.Set(float64(n))
+}
+
+func (promQueueMetrics) SetQueued(n int) {
+	admissionQueued.Set(float64(n))
+}
+
+func (promQueueMetrics) Shed(policy string) {
+	admissionShed.WithLabelValues(policy).Inc()
+}
+
+// admissionQueue is the admission limiter, replaced in Start with the limits
+// in the configuration.
+var admissionQueue = newAdmissionLimiter(LoadShedding{}, promQueueMetrics{})
+
+// admissionLimiter limits the number of admission reviews processed at the
+// same time.
+type admissionLimiter struct {
+	sync.Mutex
+	policy    string
+	slots     chan struct{}
+	maxQueued int
+	inFlight  int
+	queued    int
+	metrics   QueueMetrics
+}
+
+func newAdmissionLimiter(l LoadShedding, metrics QueueMetrics) *admissionLimiter {
+	a := &admissionLimiter{
+		policy:    l.GetPolicy(),
+		maxQueued: l.MaxQueued,
+		metrics:   metrics,
+	}
+	if l.MaxInFlight > 0 {
+		a.slots = make(chan struct{}, l.MaxInFlight)
+	}
+	return a
+}
+
+// acquire waits for a slot to process a review, and returns false if the
+// review must be shed: the queue is full, or ctx is done before a slot is
+// free. release must be called after a successful acquire.
+func (a *admissionLimiter) acquire(ctx context.Context) bool {
+	if a.slots == nil {
+		a.add(1, 0)
+		return true
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		a.add(1, 0)
+		return true
+	default:
+	}
+
+	a.Lock()
+	if a.queued >= a.maxQueued {
+		a.Unlock()
+		a.metrics.Shed(a.policy)
+		return false
+	}
+	a.queued++
+	a.metrics.SetQueued(a.queued)
+	a.Unlock()
+
+	select {
+	case a.slots <- struct{}{}:
+		a.add(1, -1)
+		return true
+	case <-ctx.Done():
+		a.add(0, -1)
+		a.metrics.Shed(a.policy)
+		return false
+	}
+}
+
+// release frees the slot of a processed review.
+func (a *admissionLimiter) release() {
+	if a.slots != nil {
+		<-a.slots
+	}
+	a.add(-1, 0)
+}
+
+// add updates the number of reviews in flight and queued.
+func (a *admissionLimiter) add(inFlight, queued int) {
+	a.Lock()
+	defer a.Unlock()
+	a.inFlight += inFlight
+	a.queued += queued
+	a.metrics.SetInFlight(a.inFlight)
+	a.metrics.SetQueued(a.queued)
+}
+
+// shedResponse returns the response to a review shed because the controller
+// is saturated.
+func (a *admissionLimiter) shedResponse(request *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	if a.policy == shedAllow {
+		recordDecision(decisionSkipped, reasonOverloaded, request.Namespace)
+		return &v1beta1.AdmissionResponse{
+			Allowed:  true,
+			UID:      request.UID,
+			Warnings: []string{"autocert is overloaded, the pod was admitted without a certificate"},
+		}
+	}
+	recordDecision(decisionDenied, reasonOverloaded, request.Namespace)
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		UID:     request.UID,
+		Result: &metav1.Status{
+			Code:    http.StatusTooManyRequests,
+			Reason:  metav1.StatusReasonTooManyRequests,
+			Message: "autocert is overloaded, retry later",
+		},
+	}
+}
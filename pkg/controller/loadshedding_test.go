@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+type fakeQueueMetrics struct {
+	sync.Mutex
+	inFlight, queued, shed int
+}
+
+func (m *fakeQueueMetrics) SetInFlight(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.inFlight = n
+}
+
+func (m *fakeQueueMetrics) SetQueued(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.queued = n
+}
+
+func (m *fakeQueueMetrics) Shed(string) {
+	m.Lock()
+	defer m.Unlock()
+	m.shed++
+}
+
+func (m *fakeQueueMetrics) get() (int, int, int) {
+	m.Lock()
+	defer m.Unlock()
+	return m.inFlight, m.queued, m.shed
+}
+
+func TestValidateLoadShedding(t *testing.T) {
+	tests := []struct {
+		name    string
+		l       LoadShedding
+		wantErr bool
+	}{
+		{"off", LoadShedding{}, false},
+		{"reject", LoadShedding{MaxInFlight: 10, MaxQueued: 20, Policy: shedReject}, false},
+		{"allow", LoadShedding{MaxInFlight: 10, Policy: shedAllow}, false},
+		{"negative", LoadShedding{MaxInFlight: -1}, true},
+		{"invalid policy", LoadShedding{MaxInFlight: 10, Policy: "drop"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateLoadShedding(&Config{LoadShedding: tt.l}); (err != nil) != tt.wantErr {
+				t.Errorf("validateLoadShedding() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdmissionLimiter(t *testing.T) {
+	metrics := &fakeQueueMetrics{}
+	a := newAdmissionLimiter(LoadShedding{MaxInFlight: 1, MaxQueued: 1}, metrics)
+	ctx := context.Background()
+
+	if !a.acquire(ctx) {
+		t.Fatal("acquire() = false with a free slot")
+	}
+
+	// The second review waits in the queue, the third one is shed.
+	acquired := make(chan bool)
+	go func() { acquired <- a.acquire(ctx) }()
+	for {
+		if _, queued, _ := metrics.get(); queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if a.acquire(ctx) {
+		t.Error("acquire() = true with a full queue")
+	}
+
+	// The queued review gets the slot once it's released.
+	a.release()
+	if !<-acquired {
+		t.Error("acquire() = false for a queued review")
+	}
+	if inFlight, queued, shed := metrics.get(); inFlight != 1 || queued != 0 || shed != 1 {
+		t.Errorf("metrics = %d in flight, %d queued, %d shed, want 1, 0, 1", inFlight, queued, shed)
+	}
+
+	// Queued reviews are shed when the API server stops waiting.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if a.acquire(ctx) {
+		t.Error("acquire() = true past the deadline")
+	}
+	a.release()
+	if inFlight, queued, shed := metrics.get(); inFlight != 0 || queued != 0 || shed != 2 {
+		t.Errorf("metrics = %d in flight, %d queued, %d shed, want 0, 0, 2", inFlight, queued, shed)
+	}
+}
+
+func TestShedResponse(t *testing.T) {
+	request := &v1beta1.AdmissionRequest{UID: "uid", Namespace: "default"}
+
+	resp := newAdmissionLimiter(LoadShedding{}, &fakeQueueMetrics{}).shedResponse(request)
+	if resp.Allowed || resp.UID != "uid" || resp.Result == nil || resp.Result.Code != http.StatusTooManyRequests {
+		t.Errorf("shedResponse() with the reject policy = %+v", resp)
+	}
+
+	resp = newAdmissionLimiter(LoadShedding{Policy: shedAllow}, &fakeQueueMetrics{}).shedResponse(request)
+	if !resp.Allowed || resp.Patch != nil || len(resp.Warnings) != 1 {
+		t.Errorf("shedResponse() with the allow policy = %+v", resp)
+	}
+}
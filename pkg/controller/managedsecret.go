@@ -0,0 +1,550 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+	"go.step.sm/crypto/pemutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// secretAnnotationKey makes the controller issue and renew the
+	// certificate of a pod in a Secret, instead of injecting a bootstrapper
+	// and a renewer.
+	secretAnnotationKey = "autocert.step.sm/secret"
+	// managedSecretLabel identifies the Secrets issued and renewed by the
+	// controller.
+	managedSecretLabel      = "autocert.step.sm/managed"
+	defaultSecretInterval   = time.Minute
+	managedSecretsSelector  = managedSecretLabel + "=true"
+	managedSecretsListLimit = 500
+)
+
+// SecretIssuance lets the controller issue certificates in kubernetes.io/tls
+// Secrets for pods annotated with autocert.step.sm/secret, and renew them
+// once two thirds of their lifetime have elapsed. It's meant for workloads
+// that can't run the injected containers, like ingress controllers reading
+// their certificates from the API. The controller needs permission to get,
+// list and update Secrets.
+type SecretIssuance struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often the Secrets are checked for renewal, defaults
+	// to 1m.
+	Interval string `yaml:"interval"`
+}
+
+// GetInterval returns how often the Secrets are checked for renewal,
+// defaults to 1m.
+func (s SecretIssuance) GetInterval() time.Duration {
+	d, err := time.ParseDuration(s.Interval)
+	if err != nil || d <= 0 {
+		return defaultSecretInterval
+	}
+	return d
+}
+
+// validateSecretIssuance returns an error if the secret issuance
+// configuration is not valid.
+func validateSecretIssuance(c *Config) error {
+	if s := c.SecretIssuance.Interval; s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			return fmt.Errorf("invalid secretIssuance.interval %q, it must be a positive duration", s)
+		}
+	}
+	return nil
+}
+
+var (
+	managedSecretIssuances = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autocert_secret_issuances_total",
+		Help: "Number of certificates issued in Secrets, by reason and result.",
+	}, []string{"reason", "result"})
+	managedSecretsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "autocert_secrets_managed",
+		Help: "Number of Secrets with certificates renewed by the controller on the last check.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(managedSecretIssuances, managedSecretsGauge)
+}
+
+// Reasons to issue the certificate of a Secret.
+const (
+	secretReasonCreated = "created"
+	secretReasonChanged = "changed"
+	secretReasonRenewal = "renewal"
+)
+
+// managedSecret returns the name of the Secret the controller issues the
+// certificate of a pod in, or "" if the pod gets its certificate from the
+// injected containers.
+func managedSecret(annotations podAnnotations, config *Config) (string, error) {
+	name := annotations.Secret
+	switch {
+	case name == "":
+		return "", nil
+	case !config.SecretIssuance.Enabled:
+		return "", annotationErrors{{
+			Key:    secretAnnotationKey,
+			Value:  name,
+			Reason: "secretIssuance is not enabled in the configuration",
+		}}
+	case annotations.ExternalSecret != "":
+		return "", annotationErrors{{
+			Key:    secretAnnotationKey,
+			Value:  name,
+			Reason: fmt.Sprintf("can't be used along with %s", externalSecretAnnotationKey),
+		}}
+	}
+	return name, nil
+}
+
+// secretRequest is a certificate to issue in a Secret. Its names, duration
+// and key are kept in the annotations of the Secret, to renew it.
+type secretRequest struct {
+	Namespace  string
+	Name       string
+	CommonName string
+	SANs       []string
+	Duration   string
+	KeyType    string
+	KeySize    string
+	// Owner is the owner of the Secret, set when it's created.
+	Owner *metav1.OwnerReference
+}
+
+// secretRequestOf returns the request of a managed Secret.
+func secretRequestOf(s *corev1.Secret) secretRequest {
+	req := secretRequest{
+		Namespace:  s.Namespace,
+		Name:       s.Name,
+		CommonName: s.Annotations[admissionWebhookAnnotationKey],
+		Duration:   s.Annotations[durationWebhookStatusKey],
+		KeyType:    s.Annotations[keyTypeAnnotationKey],
+		KeySize:    s.Annotations[keySizeAnnotationKey],
+	}
+	if sans := s.Annotations[sansAnnotationKey]; sans != "" {
+		req.SANs = strings.Split(sans, ",")
+	}
+	return req
+}
+
+// managedSecrets issues and renews the Secrets of the controller.
+var managedSecrets = &secretIssuer{
+	get:    getSecret,
+	list:   listManagedSecrets,
+	create: createManagedSecret,
+	update: updateManagedSecret,
+}
+
+// secretIssuer issues certificates in Secrets.
+type secretIssuer struct {
+	// get returns the Secret with the given name, or nil if it doesn't
+	// exist.
+	get    func(namespace, name string) (*corev1.Secret, error)
+	list   func() ([]corev1.Secret, error)
+	create func(s *corev1.Secret) error
+	update func(s *corev1.Secret) error
+	// sign returns the PEM encoded certificate chain and key of a new
+	// certificate. It's set when the controller starts.
+	sign func(ctx context.Context, req secretRequest, lifetime string) (chain, key []byte, err error)
+
+	// mu serializes issuance, so the replicas of a workload admitted at the
+	// same time share a single certificate.
+	mu sync.Mutex
+}
+
+// newSecretSigner returns the sign function of a secretIssuer, which gets
+// the certificates from the current CA with a token of the provisioner.
+func newSecretSigner(provisioner TokenManager, client func() *ca.Client) func(context.Context, secretRequest, string) ([]byte, []byte, error) {
+	return func(ctx context.Context, req secretRequest, lifetime string) ([]byte, []byte, error) {
+		spec, err := parseKeySpec(req.KeyType, req.KeySize)
+		if err != nil {
+			return nil, nil, err
+		}
+		csr, key, err := spec.certificateRequest(req.CommonName, req.SANs)
+		if err != nil {
+			return nil, nil, err
+		}
+		token, err := mintToken(ctx, provisioner, req.CommonName, req.SANs...)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "token generation")
+		}
+		sign := &api.SignRequest{CsrPEM: *csr, OTT: token}
+		if lifetime != "" {
+			if sign.NotAfter, err = api.ParseTimeDuration(lifetime); err != nil {
+				return nil, nil, err
+			}
+		}
+		resp, err := client().SignWithContext(ctx, sign)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "sign certificate")
+		}
+		block, err := pemutil.Serialize(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return chainPEM(resp), pem.EncodeToMemory(block), nil
+	}
+}
+
+// ensure issues the certificate of a Secret unless it already holds a
+// certificate for the same names that isn't due for renewal. Secrets not
+// created by the controller are never replaced.
+func (s *secretIssuer) ensure(ctx context.Context, config *Config, req secretRequest, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.get(req.Namespace, req.Name)
+	if err != nil {
+		return errors.Wrapf(err, "error getting secret %s", req.Name)
+	}
+	reason := secretReasonCreated
+	if existing != nil {
+		if existing.Labels[managedSecretLabel] != "true" {
+			return fmt.Errorf("secret %s already exists and was not created by autocert, use %s to mount it", req.Name, externalSecretAnnotationKey)
+		}
+		switch {
+		case !sameSecretRequest(secretRequestOf(existing), req):
+			reason = secretReasonChanged
+		case !secretDue(existing, now):
+			return nil
+		default:
+			reason = secretReasonRenewal
+		}
+	}
+	return s.issue(ctx, config, req, existing, reason)
+}
+
+// renew renews the managed Secrets due for renewal, unless renewals are
+// frozen.
+func (s *secretIssuer) renew(ctx context.Context, config *Config, namespace string, now time.Time) {
+	secrets, err := s.list()
+	if err != nil {
+		log.WithField("error", err).Error("Error listing secrets to renew")
+		return
+	}
+	managedSecretsGauge.Set(float64(len(secrets)))
+	if freeze := issuanceFreeze.get(namespace); freeze.Renewal {
+		log.WithField("reason", freeze.Reason).Warn("Renewals are frozen, secrets are not renewed")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range secrets {
+		secret := &secrets[i]
+		if !secretDue(secret, now) {
+			continue
+		}
+		if err := s.issue(ctx, config, secretRequestOf(secret), secret, secretReasonRenewal); err != nil {
+			log.WithFields(log.Fields{
+				"namespace": secret.Namespace,
+				"secret":    secret.Name,
+				"error":     err,
+			}).Error("Error renewing secret")
+		}
+	}
+}
+
+// run renews the managed Secrets every interval until the context is
+// canceled.
+func (s *secretIssuer) run(ctx context.Context, config *Config, namespace string) {
+	interval := config.SecretIssuance.GetInterval()
+	log.WithField("interval", interval).Info("Renewing certificates in secrets")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.renew(ctx, config, namespace, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// issue signs a new certificate and writes it to the Secret, creating it if
+// existing is nil. It must be called with the lock held.
+func (s *secretIssuer) issue(ctx context.Context, config *Config, req secretRequest, existing *corev1.Secret, reason string) (err error) {
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		managedSecretIssuances.WithLabelValues(reason, result).Inc()
+	}()
+
+	root, err := os.ReadFile(config.GetRootCAPath())
+	if err != nil {
+		return errors.Wrap(err, "error reading root certificate")
+	}
+	chain, key, err := s.sign(ctx, req, cmp.Or(req.Duration, config.CertLifetime))
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        req.Name,
+			Namespace:   req.Namespace,
+			Labels:      map[string]string{},
+			Annotations: map[string]string{},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       chain,
+			corev1.TLSPrivateKeyKey: key,
+			"ca.crt":                root,
+		},
+	}
+	if existing != nil {
+		secret.ObjectMeta = *existing.ObjectMeta.DeepCopy()
+		if secret.Labels == nil {
+			secret.Labels = map[string]string{}
+		}
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+	}
+	if req.Owner != nil && !slices.ContainsFunc(secret.OwnerReferences, func(r metav1.OwnerReference) bool { return r.UID == req.Owner.UID }) {
+		secret.OwnerReferences = append(secret.OwnerReferences, *req.Owner)
+	}
+	for k, v := range withoutExisting(secret.Labels, config.SecretLabels) {
+		secret.Labels[k] = v
+	}
+	for k, v := range withoutExisting(secret.Annotations, config.SecretAnnotations) {
+		secret.Annotations[k] = v
+	}
+	secret.Labels[managedSecretLabel] = "true"
+	setOrDelete(secret.Annotations, admissionWebhookAnnotationKey, req.CommonName)
+	setOrDelete(secret.Annotations, sansAnnotationKey, strings.Join(req.SANs, ","))
+	setOrDelete(secret.Annotations, durationWebhookStatusKey, req.Duration)
+	setOrDelete(secret.Annotations, keyTypeAnnotationKey, req.KeyType)
+	setOrDelete(secret.Annotations, keySizeAnnotationKey, req.KeySize)
+
+	if existing == nil {
+		err = s.create(secret)
+	} else {
+		err = s.update(secret)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error writing secret %s", req.Name)
+	}
+	log.WithFields(log.Fields{
+		"namespace":  req.Namespace,
+		"secret":     req.Name,
+		"commonName": req.CommonName,
+		"reason":     reason,
+	}).Info("Issued certificate in secret")
+	recordIssuance(IssuanceRecord{
+		Namespace:  req.Namespace,
+		Event:      issuanceEventSecret,
+		Secret:     req.Name,
+		CommonName: req.CommonName,
+		SANs:       req.SANs,
+	})
+	return nil
+}
+
+// setOrDelete sets a key of m, or deletes it if the value is empty.
+func setOrDelete(m map[string]string, key, value string) {
+	if value == "" {
+		delete(m, key)
+	} else {
+		m[key] = value
+	}
+}
+
+// sameSecretRequest returns whether two requests get the same certificate.
+func sameSecretRequest(a, b secretRequest) bool {
+	return a.CommonName == b.CommonName && a.Duration == b.Duration &&
+		strings.Join(a.SANs, ",") == strings.Join(b.SANs, ",") &&
+		a.KeyType == b.KeyType && a.KeySize == b.KeySize
+}
+
+// secretDue returns whether the certificate of a Secret must be renewed: two
+// thirds of its lifetime have elapsed, or it can't be read.
+func secretDue(s *corev1.Secret, now time.Time) bool {
+	block, _ := pem.Decode(s.Data[corev1.TLSCertKey])
+	if block == nil {
+		return true
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	lifetime := crt.NotAfter.Sub(crt.NotBefore)
+	return !now.Before(crt.NotBefore.Add(lifetime * 2 / 3))
+}
+
+// managedSecretPatch returns the patch of a pod whose certificate is issued
+// in a Secret: the Secret is mounted at the usual path in place of the
+// certificates volume, and no container is injected. The certificate is
+// issued before the pod is admitted, so the volume can be mounted. The
+// Secret gets the given owner, if any, when it's written. The rollout
+// revision, if any, is recorded in the annotations of the pod.
+func managedSecretPatch(ctx context.Context, pod *corev1.Pod, namespace string, config *Config, annotations podAnnotations, secretName, revision string, sans []string, owner *metav1.OwnerReference) ([]PatchOperation, error) {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == config.CertsVolume.Name {
+			return nil, fmt.Errorf("volume %s is reserved for the certificates of secret %s, rename the volume of the pod", v.Name, secretName)
+		}
+	}
+	if _, err := parseKeySpec(annotations.KeyType, annotations.KeySize); err != nil {
+		return nil, err
+	}
+	req := secretRequest{
+		Namespace:  namespace,
+		Name:       secretName,
+		CommonName: annotations.CommonName,
+		SANs:       sans,
+		Duration:   annotations.Duration,
+		KeyType:    annotations.KeyType,
+		KeySize:    annotations.KeySize,
+		Owner:      owner,
+	}
+	if err := managedSecrets.ensure(ctx, config, req, time.Now()); err != nil {
+		return nil, err
+	}
+
+	var ops []PatchOperation
+	mountOps, err := addCertsVolumeMount(config.CertsVolume.Name, pod.Spec.Containers, "containers", false)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, mountOps...)
+	mountOps, err = addCertsVolumeMount(config.CertsVolume.Name, pod.Spec.InitContainers, "initContainers", false)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, mountOps...)
+	if annotations.IdentityEnv {
+		ops = append(ops, addIdentityEnv(pod.Spec.Containers, identityEnvVars(annotations.CommonName, sans))...)
+	}
+	ops = append(ops, addVolumes(pod.Spec.Volumes, []corev1.Volume{externalSecretVolume(config, secretName)}, "/spec/volumes")...)
+
+	podAnnotations := map[string]string{admissionWebhookStatusKey: "injected"}
+	if revision != "" {
+		podAnnotations[revisionAnnotationKey] = revision
+	}
+	for k, v := range withoutExisting(pod.Annotations, config.PodAnnotations) {
+		podAnnotations[k] = v
+	}
+	ops = append(ops, addAnnotations(pod.Annotations, podAnnotations)...)
+	ops = append(ops, addLabels(pod.Labels, withoutExisting(pod.Labels, config.PodLabels))...)
+	return ops, nil
+}
+
+// getSecret returns a Secret, or nil if it doesn't exist.
+func getSecret(namespace, name string) (*corev1.Secret, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := client.GetRequest(fmt.Sprintf("api/v1/namespaces/%s/secrets/%s", namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, errors.New(resp.Status)
+	}
+	var secret corev1.Secret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// listManagedSecrets returns the Secrets of every namespace issued by the
+// controller.
+func listManagedSecrets() ([]corev1.Secret, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	var secrets []corev1.Secret
+	query := url.Values{"labelSelector": {managedSecretsSelector}, "limit": {fmt.Sprint(managedSecretsListLimit)}}
+	for {
+		var list corev1.SecretList
+		if err := getJSON(client, "api/v1/secrets?"+query.Encode(), &list); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, list.Items...)
+		if list.Continue == "" {
+			return secrets, nil
+		}
+		query.Set("continue", list.Continue)
+	}
+}
+
+func createManagedSecret(s *corev1.Secret) error {
+	return sendSecret(http.MethodPost, fmt.Sprintf("api/v1/namespaces/%s/secrets", s.Namespace), s)
+}
+
+// updateManagedSecret replaces a Secret. The resource version of s makes the
+// update fail if it was modified since it was read.
+func updateManagedSecret(s *corev1.Secret) error {
+	return sendSecret(http.MethodPut, fmt.Sprintf("api/v1/namespaces/%s/secrets/%s", s.Namespace, s.Name), s)
+}
+
+// sendSecret creates or replaces a Secret. Unlike the token Secrets, its body
+// is never logged: it holds a private key.
+func sendSecret(method, path string, s *corev1.Secret) error {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	var req *http.Request
+	if method == http.MethodPost {
+		req, err = client.PostRequest(path, string(body), "application/json")
+	} else {
+		req, err = client.PutRequest(path, string(body), "application/json")
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
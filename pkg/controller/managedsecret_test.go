@@ -0,0 +1,353 @@
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeSecretIssuer returns a secretIssuer storing the Secrets in memory, and
+// issuing certificates valid for an hour from the current time of now.
+func fakeSecretIssuer(t testing.TB, now *time.Time) (*secretIssuer, map[string]*corev1.Secret, *int) {
+	t.Helper()
+	secrets := make(map[string]*corev1.Secret)
+	issued := new(int)
+	return &secretIssuer{
+		get: func(namespace, name string) (*corev1.Secret, error) {
+			return secrets[namespace+"/"+name].DeepCopy(), nil
+		},
+		list: func() ([]corev1.Secret, error) {
+			var list []corev1.Secret
+			for _, s := range secrets {
+				if s.Labels[managedSecretLabel] == "true" {
+					list = append(list, *s.DeepCopy())
+				}
+			}
+			return list, nil
+		},
+		create: func(s *corev1.Secret) error {
+			if secrets[s.Namespace+"/"+s.Name] != nil {
+				return errors.New("already exists")
+			}
+			secrets[s.Namespace+"/"+s.Name] = s
+			return nil
+		},
+		update: func(s *corev1.Secret) error {
+			secrets[s.Namespace+"/"+s.Name] = s
+			return nil
+		},
+		sign: func(_ context.Context, req secretRequest, _ string) ([]byte, []byte, error) {
+			*issued++
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				return nil, nil, err
+			}
+			der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+				SerialNumber: big.NewInt(int64(*issued)),
+				DNSNames:     req.SANs,
+				NotBefore:    *now,
+				NotAfter:     now.Add(time.Hour),
+			}, &x509.Certificate{}, key.Public(), key)
+			if err != nil {
+				return nil, nil, err
+			}
+			keyDER, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+				pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+		},
+	}, secrets, issued
+}
+
+// secretIssuanceConfig returns a configuration with secret issuance enabled
+// and a root certificate.
+func secretIssuanceConfig(t testing.TB) *Config {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "root.crt")
+	if err := os.WriteFile(root, []byte("root"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &Config{
+		RootCAPath:     root,
+		CertsVolume:    corev1.Volume{Name: "certs"},
+		SecretIssuance: SecretIssuance{Enabled: true},
+		SecretLabels:   map[string]string{"team": "edge"},
+	}
+}
+
+func TestManagedSecret(t *testing.T) {
+	config := &Config{SecretIssuance: SecretIssuance{Enabled: true}}
+	if name, err := managedSecret(podAnnotations{Secret: "ingress-tls"}, config); name != "ingress-tls" || err != nil {
+		t.Errorf("managedSecret() = %q, %v, want ingress-tls", name, err)
+	}
+	if name, err := managedSecret(podAnnotations{}, config); name != "" || err != nil {
+		t.Errorf("managedSecret() without annotation = %q, %v", name, err)
+	}
+	var aerrs annotationErrors
+	if _, err := managedSecret(podAnnotations{Secret: "ingress-tls"}, &Config{}); !errors.As(err, &aerrs) {
+		t.Errorf("managedSecret() not enabled = %v, want an annotation error", err)
+	}
+	if _, err := managedSecret(podAnnotations{Secret: "ingress-tls", ExternalSecret: "legacy-tls"}, config); !errors.As(err, &aerrs) {
+		t.Errorf("managedSecret() with an external secret = %v, want an annotation error", err)
+	}
+	if _, err := parseAnnotations(map[string]string{secretAnnotationKey: "Ingress_TLS"}); err == nil {
+		t.Error("parseAnnotations() with an invalid secret name should fail")
+	}
+}
+
+func TestSecretIssuerEnsure(t *testing.T) {
+	now := time.Now()
+	issuer, secrets, issued := fakeSecretIssuer(t, &now)
+	config := secretIssuanceConfig(t)
+	ctx := context.Background()
+	req := secretRequest{
+		Namespace:  "edge",
+		Name:       "ingress-tls",
+		CommonName: "ingress.edge.svc",
+		SANs:       []string{"ingress.edge.svc", "example.com"},
+	}
+
+	if err := issuer.ensure(ctx, config, req, now); err != nil {
+		t.Fatal(err)
+	}
+	s := secrets["edge/ingress-tls"]
+	switch {
+	case s == nil:
+		t.Fatal("ensure() didn't create the secret")
+	case s.Type != corev1.SecretTypeTLS:
+		t.Errorf("secret type = %s, want %s", s.Type, corev1.SecretTypeTLS)
+	case s.Labels[managedSecretLabel] != "true" || s.Labels["team"] != "edge":
+		t.Errorf("secret labels = %v", s.Labels)
+	case s.Annotations[sansAnnotationKey] != "ingress.edge.svc,example.com":
+		t.Errorf("secret annotations = %v", s.Annotations)
+	case string(s.Data["ca.crt"]) != "root" || len(s.Data[corev1.TLSCertKey]) == 0 || len(s.Data[corev1.TLSPrivateKeyKey]) == 0:
+		t.Errorf("secret data = %v", s.Data)
+	}
+
+	// Other replicas share the certificate.
+	if err := issuer.ensure(ctx, config, req, now.Add(time.Minute)); err != nil || *issued != 1 {
+		t.Errorf("ensure() again = %v, issued %d certificates, want 1", err, *issued)
+	}
+	// New names are issued right away.
+	req.SANs = append(req.SANs, "www.example.com")
+	if err := issuer.ensure(ctx, config, req, now.Add(time.Minute)); err != nil || *issued != 2 {
+		t.Errorf("ensure() with new names = %v, issued %d certificates, want 2", err, *issued)
+	}
+	// And certificates due for renewal.
+	now = now.Add(time.Hour)
+	if err := issuer.ensure(ctx, config, req, now.Add(-30*time.Minute)); err != nil || *issued != 2 {
+		t.Errorf("ensure() before renewal = %v, issued %d certificates, want 2", err, *issued)
+	}
+	if err := issuer.ensure(ctx, config, req, now.Add(time.Hour)); err != nil || *issued != 3 {
+		t.Errorf("ensure() after renewal time = %v, issued %d certificates, want 3", err, *issued)
+	}
+
+	// And a new key.
+	req.KeyType, req.KeySize = "RSA", "3072"
+	if err := issuer.ensure(ctx, config, req, now.Add(time.Hour)); err != nil || *issued != 4 {
+		t.Errorf("ensure() with a new key = %v, issued %d certificates, want 4", err, *issued)
+	}
+	if got := secretRequestOf(secrets["edge/ingress-tls"]); got.KeyType != "RSA" || got.KeySize != "3072" {
+		t.Errorf("secret request = %+v, want the key kept in the annotations", got)
+	}
+
+	secrets["edge/other-tls"] = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other-tls", Namespace: "edge"}}
+	req.Name = "other-tls"
+	if err := issuer.ensure(ctx, config, req, now); err == nil {
+		t.Error("ensure() replaced a secret not created by autocert")
+	}
+}
+
+func TestSecretIssuerRenew(t *testing.T) {
+	now := time.Now()
+	issuer, secrets, issued := fakeSecretIssuer(t, &now)
+	config := secretIssuanceConfig(t)
+	ctx := context.Background()
+	for _, name := range []string{"a-tls", "b-tls"} {
+		req := secretRequest{Namespace: "edge", Name: name, CommonName: name + ".edge.svc", SANs: []string{name + ".edge.svc"}}
+		if err := issuer.ensure(ctx, config, req, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b-tls gets new names from a newer rollout.
+	now = now.Add(30 * time.Minute)
+	b := secretRequestOf(secrets["edge/b-tls"])
+	b.SANs = append(b.SANs, "b.example.com")
+	if err := issuer.ensure(ctx, config, b, now); err != nil {
+		t.Fatal(err)
+	}
+
+	issuanceFreeze.Lock()
+	issuanceFreeze.freeze = Freeze{Renewal: true, Expires: time.Now().Add(time.Hour), Reason: "incident"}
+	issuanceFreeze.fetched = time.Now()
+	issuanceFreeze.Unlock()
+	t.Cleanup(func() {
+		issuanceFreeze.Lock()
+		issuanceFreeze.freeze = Freeze{}
+		issuanceFreeze.Unlock()
+	})
+	issuer.renew(ctx, config, "step", now.Add(15*time.Minute))
+	if *issued != 3 {
+		t.Errorf("renew() while frozen issued %d certificates, want 3", *issued)
+	}
+
+	issuanceFreeze.Lock()
+	issuanceFreeze.freeze = Freeze{}
+	issuanceFreeze.Unlock()
+	before := secrets["edge/b-tls"].Data[corev1.TLSCertKey]
+	issuer.renew(ctx, config, "step", now.Add(15*time.Minute))
+	if *issued != 4 {
+		t.Errorf("renew() issued %d certificates, want 4", *issued)
+	}
+	if string(secrets["edge/b-tls"].Data[corev1.TLSCertKey]) != string(before) {
+		t.Error("renew() renewed a certificate not due for renewal")
+	}
+	if got := secretRequestOf(secrets["edge/a-tls"]); got.CommonName != "a-tls.edge.svc" || len(got.SANs) != 1 {
+		t.Errorf("renewed secret request = %+v", got)
+	}
+}
+
+func TestSecretDue(t *testing.T) {
+	now := time.Now()
+	issuer, secrets, _ := fakeSecretIssuer(t, &now)
+	if err := issuer.ensure(context.Background(), secretIssuanceConfig(t), secretRequest{Namespace: "edge", Name: "tls", CommonName: "a"}, now); err != nil {
+		t.Fatal(err)
+	}
+	s := secrets["edge/tls"]
+	tests := []struct {
+		name   string
+		secret *corev1.Secret
+		now    time.Time
+		want   bool
+	}{
+		{"fresh", s, now.Add(39 * time.Minute), false},
+		{"two thirds", s, now.Add(40 * time.Minute), true},
+		{"expired", s, now.Add(2 * time.Hour), true},
+		{"no certificate", &corev1.Secret{}, now, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := secretDue(tt.secret, tt.now); got != tt.want {
+				t.Errorf("secretDue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManagedSecretPatch(t *testing.T) {
+	now := time.Now()
+	issuer, secrets, _ := fakeSecretIssuer(t, &now)
+	defer func(s *secretIssuer) { managedSecrets = s }(managedSecrets)
+	managedSecrets = issuer
+	config := secretIssuanceConfig(t)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "ingress", Annotations: map[string]string{
+			admissionWebhookAnnotationKey: "ingress.edge.svc",
+			secretAnnotationKey:           "ingress-tls",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "ingress"}}},
+	}
+	annotations, err := parseAnnotations(pod.Annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := managedSecretPatch(context.Background(), pod, "edge", config, annotations, "ingress-tls", "", []string{"ingress.edge.svc"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secrets["edge/ingress-tls"] == nil {
+		t.Fatal("managedSecretPatch() didn't issue the certificate")
+	}
+	var volume *corev1.Volume
+	for _, op := range ops {
+		switch op.Path {
+		case "/spec/initContainers", "/spec/initContainers/-", "/spec/containers/-":
+			t.Errorf("managedSecretPatch() adds a container: %v", op.Value)
+		case "/spec/volumes":
+			v := op.Value.([]corev1.Volume)[0]
+			volume = &v
+		}
+	}
+	if volume == nil || volume.Secret == nil || volume.Secret.SecretName != "ingress-tls" {
+		t.Errorf("managedSecretPatch() volume = %+v, want secret ingress-tls", volume)
+	}
+
+	pod.Spec.Volumes = []corev1.Volume{{Name: "certs"}}
+	if _, err := managedSecretPatch(context.Background(), pod, "edge", config, annotations, "ingress-tls", "", []string{"ingress.edge.svc"}, nil); err == nil {
+		t.Error("managedSecretPatch() with a certs volume should fail")
+	}
+}
+
+func TestValidateSecretIssuance(t *testing.T) {
+	for _, interval := range []string{"", "5m"} {
+		if err := validateSecretIssuance(&Config{SecretIssuance: SecretIssuance{Interval: interval}}); err != nil {
+			t.Errorf("validateSecretIssuance(%q) = %v", interval, err)
+		}
+	}
+	for _, interval := range []string{"0s", "-1m", "often"} {
+		if err := validateSecretIssuance(&Config{SecretIssuance: SecretIssuance{Interval: interval}}); err == nil {
+			t.Errorf("validateSecretIssuance(%q) should fail", interval)
+		}
+	}
+	if got := (SecretIssuance{}).GetInterval(); got != time.Minute {
+		t.Errorf("GetInterval() = %v, want 1m", got)
+	}
+}
+
+func TestPatchManagedSecretRollout(t *testing.T) {
+	now := time.Now()
+	issuer, secrets, _ := fakeSecretIssuer(t, &now)
+	defer func(s *secretIssuer) { managedSecrets = s }(managedSecrets)
+	managedSecrets = issuer
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+	config := secretIssuanceConfig(t)
+	config.RolloutIdentity = rolloutIdentityIsolated
+
+	// The stable and preview replicas of a blue-green rollout get their own
+	// Secret.
+	for _, hash := range []string{"6d4f8c7b9", "58b9d7f4c"} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: "ingress-" + hash + "-",
+				Labels:       map[string]string{rolloutsPodTemplateHashLabel: hash},
+				Annotations: map[string]string{
+					admissionWebhookAnnotationKey: "ingress.edge.svc",
+					secretAnnotationKey:           "ingress-tls",
+				},
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "ingress"}}},
+		}
+		patched := patchPod(t, pod, "edge", config, fakeTokens{})
+		want := "ingress-tls-" + hash
+		if secrets["edge/"+want] == nil {
+			t.Errorf("patch() didn't issue the certificate in secret %s", want)
+		}
+		if got := patched.Annotations[revisionAnnotationKey]; got != hash {
+			t.Errorf("revision annotation = %q, want %q", got, hash)
+		}
+		for _, v := range patched.Spec.Volumes {
+			if v.Name == config.CertsVolume.Name && (v.Secret == nil || v.Secret.SecretName != want) {
+				t.Errorf("patch() volume = %+v, want secret %s", v, want)
+			}
+		}
+	}
+	if len(secrets) != 2 {
+		t.Errorf("patch() issued %d secrets, want 2", len(secrets))
+	}
+}
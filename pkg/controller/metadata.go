@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+)
+
+// reservedPrefix is the prefix of the labels and annotations managed by
+// autocert, which can't be set from the configuration.
+const reservedPrefix = "autocert.step.sm/"
+
+// validateMetadata returns an error if the labels or annotations set in the
+// configuration use keys reserved by autocert.
+func validateMetadata(c *Config) error {
+	for field, m := range map[string]map[string]string{
+		"podLabels":         c.PodLabels,
+		"podAnnotations":    c.PodAnnotations,
+		"secretLabels":      c.SecretLabels,
+		"secretAnnotations": c.SecretAnnotations,
+	} {
+		for k := range m {
+			if strings.HasPrefix(k, reservedPrefix) {
+				return fmt.Errorf("%s: key %q is reserved, keys starting with %s are managed by autocert", field, k, reservedPrefix)
+			}
+		}
+	}
+	return nil
+}
+
+// withoutExisting returns the entries of nu whose keys are not in existing.
+func withoutExisting(existing, nu map[string]string) map[string]string {
+	m := make(map[string]string, len(nu))
+	for k, v := range nu {
+		if _, ok := existing[k]; !ok {
+			m[k] = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	if err := validateMetadata(&Config{
+		PodLabels:         map[string]string{"cost-center": "1234"},
+		PodAnnotations:    map[string]string{"sidecar.istio.io/inject": "false"},
+		SecretLabels:      map[string]string{"team": "payments"},
+		SecretAnnotations: map[string]string{"example.com/owner": "payments"},
+	}); err != nil {
+		t.Errorf("validateMetadata() error = %v", err)
+	}
+	if err := validateMetadata(&Config{SecretLabels: map[string]string{tokenSecretLabel: "false"}}); err == nil {
+		t.Error("validateMetadata() should fail with a reserved key")
+	}
+}
+
+func TestAddLabels(t *testing.T) {
+	config := map[string]string{"cost-center": "1234", "app": "other"}
+
+	// Labels already set on the pod are kept.
+	ops := addLabels(map[string]string{"app": "api"}, withoutExisting(map[string]string{"app": "api"}, config))
+	want := []PatchOperation{{Op: "add", Path: "/metadata/labels/cost-center", Value: "1234"}}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("addLabels() = %v, want %v", ops, want)
+	}
+
+	// Pods without labels get the whole map.
+	ops = addLabels(nil, withoutExisting(nil, config))
+	if len(ops) != 1 || ops[0].Path != "/metadata/labels" || !reflect.DeepEqual(ops[0].Value, config) {
+		t.Errorf("addLabels() = %v, want a single add of %v", ops, config)
+	}
+
+	if ops := addLabels(nil, nil); ops != nil {
+		t.Errorf("addLabels() without labels = %v, want nil", ops)
+	}
+}
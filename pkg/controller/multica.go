@@ -0,0 +1,272 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/ca"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// certificateAuthorityAnnotationKey selects the CA issuing the certificate
+// of a pod, instead of the one selecting its namespace.
+const certificateAuthorityAnnotationKey = "autocert.step.sm/ca"
+
+var fingerprintRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// namespaceLabels caches the labels of the namespaces of the pods, matched
+// against the namespace selectors of the CAs.
+var namespaceLabels = &namespaceCache{fetch: fetchNamespaceLabels}
+
+// CertificateAuthority is a CA issuing the certificates of some namespaces
+// instead of the one in the configuration, so a single controller serves
+// clusters with a CA per environment or per tenant.
+type CertificateAuthority struct {
+	// Name is the value of the autocert.step.sm/ca annotation selecting the
+	// CA.
+	Name  string `yaml:"name"`
+	CaURL string `yaml:"caUrl"`
+	// Fingerprint is the SHA-256 fingerprint of the root of the CA, which
+	// the controller downloads on startup.
+	Fingerprint string `yaml:"fingerprint"`
+	// NamespaceSelector selects the namespaces whose pods get their
+	// certificates from the CA, unless they select another one with the
+	// annotation. Pods can only select a CA with a selector if it matches
+	// their namespace. Without a selector, the CA is only used by the pods
+	// selecting it.
+	NamespaceSelector *metav1.LabelSelector `yaml:"namespaceSelector"`
+	ProvisionerName   string                `yaml:"provisionerName"`
+	ProvisionerKid    string                `yaml:"provisionerKid"`
+	// ProvisionerPasswordPath is the path of the password of the
+	// provisioner, usually mounted from a Secret.
+	ProvisionerPasswordPath string `yaml:"provisionerPasswordPath"`
+
+	// selector matches the labels of the namespaces, loaded by loadConfig.
+	selector labels.Selector
+	// root is the root of the CA and tokens generates the bootstrap tokens,
+	// loaded by Start.
+	root   *x509.Certificate
+	tokens TokenManager
+}
+
+// validateCertificateAuthorities returns an error if a CA is not valid, and
+// loads the selectors of the valid ones.
+func validateCertificateAuthorities(c *Config) error {
+	if len(c.CertificateAuthorities) == 0 {
+		return nil
+	}
+	if c.TokenBinding {
+		return errors.New("certificateAuthorities can't be used with tokenBinding")
+	}
+	names := make(map[string]bool)
+	for i := range c.CertificateAuthorities {
+		authority := &c.CertificateAuthorities[i]
+		if checkCertificateAuthorityName(authority.Name) != "" {
+			return errors.Errorf("certificateAuthorities name %q must be a lowercase DNS label", authority.Name)
+		}
+		if names[authority.Name] {
+			return errors.Errorf("certificateAuthorities %s is listed twice", authority.Name)
+		}
+		names[authority.Name] = true
+
+		switch u, err := url.Parse(authority.CaURL); {
+		case err != nil || u.Scheme != "https" || u.Host == "":
+			return errors.Errorf("certificateAuthorities %s caUrl %q must be an https URL", authority.Name, authority.CaURL)
+		case !fingerprintRegexp.MatchString(strings.ToLower(authority.Fingerprint)):
+			return errors.Errorf("certificateAuthorities %s fingerprint %q must be a hex-encoded SHA-256 sum", authority.Name, authority.Fingerprint)
+		case authority.ProvisionerName == "" || authority.ProvisionerKid == "" || authority.ProvisionerPasswordPath == "":
+			return errors.Errorf("certificateAuthorities %s requires provisionerName, provisionerKid and provisionerPasswordPath", authority.Name)
+		}
+		authority.Fingerprint = strings.ToLower(authority.Fingerprint)
+		if authority.NamespaceSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(authority.NamespaceSelector)
+			if err != nil {
+				return errors.Wrapf(err, "certificateAuthorities %s namespaceSelector", authority.Name)
+			}
+			authority.selector = selector
+		}
+	}
+	return nil
+}
+
+func checkCertificateAuthorityName(v string) string {
+	if !labelRegexp.MatchString(v) || strings.ToLower(v) != v || strings.Contains(v, "_") {
+		return "is not a valid CA name"
+	}
+	return ""
+}
+
+// loadCertificateAuthorities downloads the roots of the CAs, verified with
+// their fingerprints, and loads their provisioners.
+func loadCertificateAuthorities(config *Config) error {
+	for i := range config.CertificateAuthorities {
+		authority := &config.CertificateAuthorities[i]
+		if authority.tokens != nil {
+			continue
+		}
+		client, err := ca.NewClient(authority.CaURL, ca.WithRootSHA256(authority.Fingerprint))
+		if err != nil {
+			return errors.Wrapf(err, "error loading the client of CA %s", authority.Name)
+		}
+		resp, err := client.Root(authority.Fingerprint)
+		if err != nil {
+			return errors.Wrapf(err, "error downloading the root of CA %s", authority.Name)
+		}
+		authority.root = resp.RootPEM.Certificate
+
+		password, err := readPasswordFromFile(authority.ProvisionerPasswordPath)
+		if err != nil {
+			return err
+		}
+		p, err := ca.NewProvisioner(authority.ProvisionerName, authority.ProvisionerKid, authority.CaURL, password,
+			ca.WithCABundle(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: authority.root.Raw})))
+		if err != nil {
+			return errors.Wrapf(err, "error loading the provisioner of CA %s", authority.Name)
+		}
+		authority.tokens = p
+		log.WithFields(log.Fields{
+			"ca":    authority.Name,
+			"caURL": authority.CaURL,
+			"name":  p.Name(),
+			"kid":   p.Kid(),
+		}).Info("Loaded provisioner of certificate authority")
+	}
+	return nil
+}
+
+// certificateAuthority returns the CA issuing the certificate of a pod: the
+// one set in its annotations, or the first one selecting its namespace. It
+// returns nil if the pod uses the CA in the configuration.
+func certificateAuthority(annotations podAnnotations, namespace string, config *Config, namespaceLabels func(namespace string) (map[string]string, error)) (*CertificateAuthority, error) {
+	if len(config.CertificateAuthorities) == 0 {
+		if annotations.CA != "" {
+			return nil, annotationErrors{{
+				Key:    certificateAuthorityAnnotationKey,
+				Value:  annotations.CA,
+				Reason: "no certificate authority with this name is configured",
+			}}
+		}
+		return nil, nil
+	}
+	// The labels of the namespace are only read for the first selector.
+	var nsLabels labels.Set
+	var fetched bool
+	matches := func(authority *CertificateAuthority) (bool, error) {
+		if authority.selector == nil {
+			return false, nil
+		}
+		if !fetched {
+			l, err := namespaceLabels(namespace)
+			if err != nil {
+				return false, errors.Wrapf(err, "error reading the labels of namespace %s", namespace)
+			}
+			nsLabels, fetched = labels.Set(l), true
+		}
+		return authority.selector.Matches(nsLabels), nil
+	}
+
+	for i := range config.CertificateAuthorities {
+		authority := &config.CertificateAuthorities[i]
+		if annotations.CA != "" && authority.Name != annotations.CA {
+			continue
+		}
+		ok, err := matches(authority)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case ok:
+			return authority, nil
+		case annotations.CA == "":
+		case authority.selector == nil:
+			return authority, nil
+		default:
+			return nil, annotationErrors{{
+				Key:    certificateAuthorityAnnotationKey,
+				Value:  annotations.CA,
+				Reason: "the certificate authority can't be used in namespace " + namespace,
+			}}
+		}
+	}
+	if annotations.CA != "" {
+		return nil, annotationErrors{{
+			Key:    certificateAuthorityAnnotationKey,
+			Value:  annotations.CA,
+			Reason: "no certificate authority with this name is configured",
+		}}
+	}
+	return nil, nil
+}
+
+// podCertificateAuthority returns the CA issuing the certificate of a pod,
+// nil if it uses the CA in the configuration. Constrained intermediates are
+// issued by the CA in the configuration, a pod can't use both.
+func podCertificateAuthority(annotations podAnnotations, namespace string, config *Config, intermediate *ConstrainedIntermediate) (*CertificateAuthority, error) {
+	authority, err := certificateAuthority(annotations, namespace, config, namespaceLabels.get)
+	if err != nil || authority == nil || intermediate == nil {
+		return authority, err
+	}
+	return nil, annotationErrors{{
+		Key:    certificateAuthorityAnnotationKey,
+		Value:  authority.Name,
+		Reason: fmt.Sprintf("the pod uses constrained intermediate %s, issued by the CA in the configuration", intermediate.Name),
+	}}
+}
+
+// certificateAuthorityTokens returns the manager generating the tokens of a
+// CA, or fallback if name is empty.
+func certificateAuthorityTokens(config *Config, name string, fallback TokenManager) (TokenManager, error) {
+	if name == "" {
+		return fallback, nil
+	}
+	for _, authority := range config.CertificateAuthorities {
+		if authority.Name == name {
+			return authority.tokens, nil
+		}
+	}
+	return nil, errors.Errorf("certificate authority %s is no longer configured", name)
+}
+
+// issuerTokens returns the manager generating the tokens of a pending
+// issuance: the one of its constrained intermediate or CA, or fallback.
+func issuerTokens(config *Config, p pendingIssuance, fallback TokenManager) (TokenManager, error) {
+	if p.CA != "" {
+		return certificateAuthorityTokens(config, p.CA, fallback)
+	}
+	return intermediateTokens(config, p.Intermediate, fallback)
+}
+
+// setCertificateAuthority configures the injected containers to get their
+// certificate from a CA. The renewer trusts the root the bootstrapper
+// writes.
+func setCertificateAuthority(authority *CertificateAuthority, bootstrapper, renewer *corev1.Container) {
+	sum := sha256.Sum256(authority.root.Raw)
+	bootstrapper.Env = setEnv(bootstrapper.Env,
+		corev1.EnvVar{Name: "STEP_CA_URL", Value: authority.CaURL},
+		corev1.EnvVar{Name: "STEP_FINGERPRINT", Value: hex.EncodeToString(sum[:])},
+		corev1.EnvVar{Name: "STEP_ROOT_PEM", Value: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: authority.root.Raw}))})
+	renewer.Env = setEnv(renewer.Env, corev1.EnvVar{Name: "STEP_CA_URL", Value: authority.CaURL})
+}
+
+// fetchNamespaceLabels reads the labels of a namespace.
+func fetchNamespaceLabels(namespace string) (map[string]string, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	var ns corev1.Namespace
+	if err := getJSON(client, "api/v1/namespaces/"+namespace, &ns); err != nil {
+		return nil, err
+	}
+	return ns.Labels, nil
+}
@@ -0,0 +1,255 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"go.step.sm/crypto/pemutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateCertificateAuthorities(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			CertificateAuthorities: []CertificateAuthority{{
+				Name:                    "staging",
+				CaURL:                   "https://staging-ca.step.svc",
+				Fingerprint:             "D9D0B8F0A7E5A4C3B2A19F8E7D6C5B4A39281706F5E4D3C2B1A09F8E7D6C5B4A",
+				NamespaceSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"environment": "staging"}},
+				ProvisionerName:         "autocert",
+				ProvisionerKid:          "kid",
+				ProvisionerPasswordPath: "/home/step/staging/password",
+			}},
+		}
+	}
+	c := valid()
+	if err := validateCertificateAuthorities(c); err != nil {
+		t.Fatal(err)
+	}
+	if ca := c.CertificateAuthorities[0]; ca.selector == nil || ca.Fingerprint != "d9d0b8f0a7e5a4c3b2a19f8e7d6c5b4a39281706f5e4d3c2b1a09f8e7d6c5b4a" {
+		t.Errorf("validateCertificateAuthorities() = %+v, want a selector and a lowercase fingerprint", ca)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"name", func(c *Config) { c.CertificateAuthorities[0].Name = "Staging" }},
+		{"duplicate", func(c *Config) {
+			c.CertificateAuthorities = append(c.CertificateAuthorities, c.CertificateAuthorities[0])
+		}},
+		{"caUrl", func(c *Config) { c.CertificateAuthorities[0].CaURL = "http://staging-ca" }},
+		{"fingerprint", func(c *Config) { c.CertificateAuthorities[0].Fingerprint = "d9d0b8f0" }},
+		{"provisioner", func(c *Config) { c.CertificateAuthorities[0].ProvisionerPasswordPath = "" }},
+		{"selector", func(c *Config) {
+			c.CertificateAuthorities[0].NamespaceSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "environment", Operator: "Near"},
+			}}
+		}},
+		{"tokenBinding", func(c *Config) { c.TokenBinding = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			if err := validateCertificateAuthorities(c); err == nil {
+				t.Error("validateCertificateAuthorities() succeeded")
+			}
+		})
+	}
+}
+
+func TestCertificateAuthority(t *testing.T) {
+	config := &Config{CertificateAuthorities: []CertificateAuthority{
+		{Name: "staging", NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"environment": "staging"}}},
+		{Name: "qa", NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "environment", Operator: metav1.LabelSelectorOpIn, Values: []string{"staging", "qa"}},
+		}}},
+		{Name: "partners"},
+	}}
+	for i := range config.CertificateAuthorities {
+		ca := &config.CertificateAuthorities[i]
+		if ca.NamespaceSelector != nil {
+			ca.selector, _ = metav1.LabelSelectorAsSelector(ca.NamespaceSelector)
+		}
+	}
+	namespaces := map[string]map[string]string{
+		"payments-staging": {"environment": "staging"},
+		"payments-qa":      {"environment": "qa"},
+		"payments":         {"environment": "production"},
+		"tools":            nil,
+	}
+	var fetched int
+	labels := func(namespace string) (map[string]string, error) {
+		fetched++
+		l, ok := namespaces[namespace]
+		if !ok {
+			return nil, errors.New("namespace not found")
+		}
+		return l, nil
+	}
+
+	tests := []struct {
+		name       string
+		namespace  string
+		annotation string
+		want       string
+		wantErr    bool
+	}{
+		{"selector", "payments-staging", "", "staging", false},
+		{"second selector", "payments-qa", "", "qa", false},
+		{"annotation", "payments-staging", "qa", "qa", false},
+		{"annotation without selector", "tools", "partners", "partners", false},
+		{"none", "payments", "", "", false},
+		{"no labels", "tools", "", "", false},
+		{"other namespace", "payments", "staging", "", true},
+		{"unknown", "payments-staging", "production", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca, err := certificateAuthority(podAnnotations{CA: tt.annotation}, tt.namespace, config, labels)
+			var aerrs annotationErrors
+			if tt.wantErr != errors.As(err, &aerrs) {
+				t.Fatalf("certificateAuthority() error = %v, want annotation error %v", err, tt.wantErr)
+			}
+			var got string
+			if ca != nil {
+				got = ca.Name
+			}
+			if got != tt.want {
+				t.Errorf("certificateAuthority() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	fetched = 0
+	if _, err := certificateAuthority(podAnnotations{}, "payments", config, labels); err != nil || fetched != 1 {
+		t.Errorf("certificateAuthority() read the labels %d times, want once", fetched)
+	}
+	if _, err := certificateAuthority(podAnnotations{}, "missing", config, labels); err == nil {
+		t.Error("certificateAuthority() ignored an error reading the namespace")
+	}
+	if _, err := certificateAuthority(podAnnotations{CA: "staging"}, "payments", &Config{}, labels); err == nil {
+		t.Error("certificateAuthority() accepted an annotation without certificate authorities")
+	}
+}
+
+func TestCertificateAuthorityPatch(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	secrets := &fakeSecrets{}
+	tokenSecrets = secrets
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+	defer func(c *namespaceCache) { namespaceLabels = c }(namespaceLabels)
+	namespaceLabels = &namespaceCache{fetch: func(namespace string) (map[string]string, error) {
+		return map[string]string{"environment": namespace}, nil
+	}}
+
+	rootFile, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	stagingFile, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	stagingRoot, err := pemutil.ReadCertificate(stagingFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"environment": "staging"}}
+	config := &Config{
+		CaURL:          "https://ca",
+		CAFailoverURLs: []string{"https://ca-passive"},
+		RootCAPath:     rootFile,
+		CertsVolume:    corev1.Volume{Name: "certs"},
+		Bootstrapper:   corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper"},
+		Renewer:        corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+		CertificateAuthorities: []CertificateAuthority{{
+			Name:              "staging",
+			CaURL:             "https://staging-ca",
+			NamespaceSelector: selector,
+			root:              stagingRoot,
+			tokens:            namedTokens("staging"),
+		}},
+	}
+	config.CertificateAuthorities[0].selector, _ = metav1.LabelSelectorAsSelector(selector)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Annotations: map[string]string{admissionWebhookAnnotationKey: "api.staging.svc"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "api"}}},
+	}
+
+	b, err := patch(context.Background(), pod, "staging", config, fakeTokens{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []struct {
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(b, &ops); err != nil {
+		t.Fatal(err)
+	}
+	env := make(map[string]map[string]string)
+	for _, op := range ops {
+		var c corev1.Container
+		var cs []corev1.Container
+		switch {
+		case op.Path == "/spec/initContainers" && json.Unmarshal(op.Value, &cs) == nil:
+		case op.Path == "/spec/containers/-" && json.Unmarshal(op.Value, &c) == nil:
+			cs = []corev1.Container{c}
+		}
+		for _, c := range cs {
+			env[c.Name] = make(map[string]string)
+			for _, e := range c.Env {
+				env[c.Name][e.Name] = e.Value
+			}
+		}
+	}
+	sum := sha256.Sum256(stagingRoot.Raw)
+	bootstrapper, renewer := env["autocert-bootstrapper"], env["autocert-renewer"]
+	switch {
+	case bootstrapper["STEP_CA_URL"] != "https://staging-ca" || renewer["STEP_CA_URL"] != "https://staging-ca":
+		t.Errorf("STEP_CA_URL = %q and %q, want the URL of the staging CA", bootstrapper["STEP_CA_URL"], renewer["STEP_CA_URL"])
+	case bootstrapper["STEP_FINGERPRINT"] != hex.EncodeToString(sum[:]):
+		t.Errorf("STEP_FINGERPRINT = %q, want the fingerprint of the staging root", bootstrapper["STEP_FINGERPRINT"])
+	case bootstrapper["STEP_ROOT_PEM"] != string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: stagingRoot.Raw})):
+		t.Error("STEP_ROOT_PEM is not the staging root")
+	case bootstrapper[caFailoverEnvVar] != "" || renewer[caFailoverEnvVar] != "":
+		t.Errorf("%s is set, the passive CAs back the CA in the configuration", caFailoverEnvVar)
+	}
+	if len(secrets.created) != 1 || secrets.created[0].StringData[tokenSecretKey] != "staging-api.staging.svc" {
+		t.Errorf("token secrets = %v, want a token of the staging CA", secrets.created)
+	}
+
+	config.ConstrainedIntermediates = []ConstrainedIntermediate{{Name: "team-a", Namespaces: []string{"staging"}}}
+	_, err = patch(context.Background(), pod, "staging", config, fakeTokens{})
+	var aerrs annotationErrors
+	if !errors.As(err, &aerrs) || aerrs[0].Key != certificateAuthorityAnnotationKey {
+		t.Errorf("patch() with a constrained intermediate = %v, want an annotation error", err)
+	}
+}
+
+func TestIssuerTokens(t *testing.T) {
+	config := &Config{
+		ConstrainedIntermediates: []ConstrainedIntermediate{{Name: "team-a", tokens: namedTokens("team-a")}},
+		CertificateAuthorities:   []CertificateAuthority{{Name: "staging", tokens: namedTokens("staging")}},
+	}
+	tests := []struct {
+		p       pendingIssuance
+		want    TokenManager
+		wantErr bool
+	}{
+		{pendingIssuance{}, fakeTokens{}, false},
+		{pendingIssuance{Intermediate: "team-a"}, namedTokens("team-a"), false},
+		{pendingIssuance{CA: "staging"}, namedTokens("staging"), false},
+		{pendingIssuance{CA: "production"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := issuerTokens(config, tt.p, fakeTokens{})
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("issuerTokens(%+v) = %v, %v, want %v", tt.p, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+// defaultNonRootUser is the user of the step image, used to run the injected
+// containers as non-root when the pod doesn't set one.
+const defaultNonRootUser = 1000
+
+// GetNonRootUser returns the user running the injected containers of pods
+// with an fsGroup, defaults to 1000.
+func (c Config) GetNonRootUser() int64 {
+	if c.NonRootUser > 0 {
+		return c.NonRootUser
+	}
+	return defaultNonRootUser
+}
+
+// nonRootSecurityContext returns the security context running the injected
+// containers of a pod as non-root, or nil if they must keep running as root.
+//
+// The certificates volume of a pod with an fsGroup is writable by the group,
+// so the bootstrapper and the renewer can write the files as a non-root member
+// of the group, complying with the restricted Pod Security Standard. Pods
+// without an fsGroup, or setting the owner of the files, which requires root
+// to chown, keep running the containers as root. The openShift option
+// implies nonRootContainers.
+func nonRootSecurityContext(config *Config, pod *corev1.Pod, owner string) *corev1.SecurityContext {
+	psc := pod.Spec.SecurityContext
+	if (!config.NonRootContainers && !config.OpenShift) || owner != "" || psc == nil || psc.FSGroup == nil {
+		return nil
+	}
+
+	uid := config.GetNonRootUser()
+	if psc.RunAsUser != nil && *psc.RunAsUser != 0 {
+		uid = *psc.RunAsUser
+	}
+	return &corev1.SecurityContext{
+		RunAsUser:                ptr.To(uid),
+		RunAsGroup:               ptr.To(*psc.FSGroup),
+		RunAsNonRoot:             ptr.To(true),
+		AllowPrivilegeEscalation: ptr.To(false),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// setSecurityContext sets the fields of sc on the security context of the
+// given container, keeping the other fields of the template, like
+// readOnlyRootFilesystem.
+func setSecurityContext(c *corev1.Container, sc *corev1.SecurityContext) {
+	if c.SecurityContext == nil {
+		c.SecurityContext = sc
+		return
+	}
+	c.SecurityContext.RunAsUser = sc.RunAsUser
+	c.SecurityContext.RunAsGroup = sc.RunAsGroup
+	c.SecurityContext.RunAsNonRoot = sc.RunAsNonRoot
+	c.SecurityContext.AllowPrivilegeEscalation = sc.AllowPrivilegeEscalation
+	c.SecurityContext.Privileged = nil
+	c.SecurityContext.Capabilities = sc.Capabilities
+	c.SecurityContext.SeccompProfile = sc.SeccompProfile
+}
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestNonRootSecurityContext(t *testing.T) {
+	pod := func(sc *corev1.PodSecurityContext) *corev1.Pod {
+		return &corev1.Pod{Spec: corev1.PodSpec{SecurityContext: sc}}
+	}
+	enabled := &Config{NonRootContainers: true}
+
+	tests := []struct {
+		name      string
+		config    *Config
+		pod       *corev1.Pod
+		owner     string
+		wantUser  int64
+		wantGroup int64
+	}{
+		{"disabled", &Config{}, pod(&corev1.PodSecurityContext{FSGroup: ptr.To[int64](2000)}), "", 0, 0},
+		{"no security context", enabled, pod(nil), "", 0, 0},
+		{"no fsGroup", enabled, pod(&corev1.PodSecurityContext{RunAsUser: ptr.To[int64](1001)}), "", 0, 0},
+		{"owner", enabled, pod(&corev1.PodSecurityContext{FSGroup: ptr.To[int64](2000)}), "999:999", 0, 0},
+		{"fsGroup", enabled, pod(&corev1.PodSecurityContext{FSGroup: ptr.To[int64](2000)}), "", defaultNonRootUser, 2000},
+		{"pod user", enabled, pod(&corev1.PodSecurityContext{FSGroup: ptr.To[int64](2000), RunAsUser: ptr.To[int64](1001)}), "", 1001, 2000},
+		{"root pod user", enabled, pod(&corev1.PodSecurityContext{FSGroup: ptr.To[int64](2000), RunAsUser: ptr.To[int64](0)}), "", defaultNonRootUser, 2000},
+		{"configured user", &Config{NonRootContainers: true, NonRootUser: 4000}, pod(&corev1.PodSecurityContext{FSGroup: ptr.To[int64](2000)}), "", 4000, 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := nonRootSecurityContext(tt.config, tt.pod, tt.owner)
+			if tt.wantUser == 0 {
+				if sc != nil {
+					t.Errorf("nonRootSecurityContext() = %+v, want nil", sc)
+				}
+				return
+			}
+			if sc == nil {
+				t.Fatal("nonRootSecurityContext() = nil")
+			}
+			if *sc.RunAsUser != tt.wantUser || *sc.RunAsGroup != tt.wantGroup || !*sc.RunAsNonRoot || *sc.AllowPrivilegeEscalation {
+				t.Errorf("nonRootSecurityContext() = %+v, want user %d and group %d", sc, tt.wantUser, tt.wantGroup)
+			}
+		})
+	}
+}
+
+func TestSetSecurityContext(t *testing.T) {
+	sc := nonRootSecurityContext(&Config{NonRootContainers: true},
+		&corev1.Pod{Spec: corev1.PodSpec{SecurityContext: &corev1.PodSecurityContext{FSGroup: ptr.To[int64](2000)}}}, "")
+
+	c := corev1.Container{SecurityContext: &corev1.SecurityContext{
+		RunAsUser:              ptr.To[int64](0),
+		Privileged:             ptr.To(true),
+		ReadOnlyRootFilesystem: ptr.To(true),
+	}}
+	setSecurityContext(&c, sc)
+	if *c.SecurityContext.RunAsUser != defaultNonRootUser || c.SecurityContext.Privileged != nil {
+		t.Errorf("setSecurityContext() = %+v, want the non-root user and no privileges", c.SecurityContext)
+	}
+	if !*c.SecurityContext.ReadOnlyRootFilesystem {
+		t.Error("setSecurityContext() should keep the other fields of the template")
+	}
+}
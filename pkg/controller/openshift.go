@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// uidRangeAnnotationKey is set by OpenShift on every namespace with the
+	// range of user IDs its pods may run as under the restricted SCCs.
+	uidRangeAnnotationKey = "openshift.io/sa.scc.uid-range"
+	// supplementalGroupsAnnotationKey is set by OpenShift on every namespace
+	// with the range of group IDs its pods may use as fsGroup.
+	supplementalGroupsAnnotationKey = "openshift.io/sa.scc.supplemental-groups"
+	// namespaceCacheTTL is how long the annotations of a namespace are cached.
+	// OpenShift allocates the ranges once, when the namespace is created.
+	namespaceCacheTTL = 5 * time.Minute
+)
+
+// namespaceAnnotations caches the annotations of the namespaces of the pods.
+var namespaceAnnotations = &namespaceCache{fetch: fetchNamespaceAnnotations}
+
+// openShiftPod returns the pod with the user and fsGroup the restricted SCCs
+// assign to it. The SCC admission usually sets them before the webhook is
+// called, otherwise they are the first IDs of the ranges allocated to the
+// namespace, which is what the SCC assigns to the pod afterwards. The
+// injected containers then run as non-root with IDs the SCC accepts, without
+// granting the service account of the pod another SCC.
+func openShiftPod(pod *corev1.Pod, namespace string, annotations func(namespace string) (map[string]string, error)) (*corev1.Pod, error) {
+	psc := pod.Spec.SecurityContext
+	if psc != nil && psc.RunAsUser != nil && psc.FSGroup != nil {
+		return pod, nil
+	}
+
+	a, err := annotations(namespace)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get namespace %s", namespace)
+	}
+	uid, err := parseRangeStart(a[uidRangeAnnotationKey])
+	if err != nil {
+		return nil, errors.Wrapf(err, "namespace %s: annotation %s", namespace, uidRangeAnnotationKey)
+	}
+	gid := uid
+	if v := a[supplementalGroupsAnnotationKey]; v != "" {
+		if gid, err = parseRangeStart(v); err != nil {
+			return nil, errors.Wrapf(err, "namespace %s: annotation %s", namespace, supplementalGroupsAnnotationKey)
+		}
+	}
+
+	p := *pod
+	p.Spec.SecurityContext = psc.DeepCopy()
+	if p.Spec.SecurityContext == nil {
+		p.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	if p.Spec.SecurityContext.RunAsUser == nil {
+		p.Spec.SecurityContext.RunAsUser = &uid
+	}
+	if p.Spec.SecurityContext.FSGroup == nil {
+		p.Spec.SecurityContext.FSGroup = &gid
+	}
+	return &p, nil
+}
+
+// parseRangeStart returns the first ID of an OpenShift range annotation,
+// "start/size" or "start-end", using the first range of comma-separated
+// lists.
+func parseRangeStart(v string) (int64, error) {
+	if v == "" {
+		return 0, errors.New("missing range")
+	}
+	first, _, _ := strings.Cut(v, ",")
+	start, _, ok := strings.Cut(first, "/")
+	if !ok {
+		start, _, _ = strings.Cut(first, "-")
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(start), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid range %q", v)
+	}
+	return id, nil
+}
+
+// namespaceCache caches the annotations of namespaces.
+type namespaceCache struct {
+	sync.Mutex
+	fetch   func(namespace string) (map[string]string, error)
+	entries map[string]namespaceEntry
+}
+
+type namespaceEntry struct {
+	annotations map[string]string
+	fetched     time.Time
+}
+
+// get returns the annotations of a namespace, reading the namespace if the
+// cached value is stale.
+func (c *namespaceCache) get(namespace string) (map[string]string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if e, ok := c.entries[namespace]; ok && now.Sub(e.fetched) <= namespaceCacheTTL {
+		return e.annotations, nil
+	}
+	a, err := c.fetch(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]namespaceEntry)
+	}
+	c.entries[namespace] = namespaceEntry{annotations: a, fetched: now}
+	return a, nil
+}
+
+// fetchNamespaceAnnotations reads the annotations of a namespace.
+func fetchNamespaceAnnotations(namespace string) (map[string]string, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	var ns corev1.Namespace
+	if err := getJSON(client, "api/v1/namespaces/"+namespace, &ns); err != nil {
+		return nil, err
+	}
+	return ns.Annotations, nil
+}
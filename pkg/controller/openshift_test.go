@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestParseRangeStart(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    int64
+		wantErr bool
+	}{
+		{"1000620000/10000", 1000620000, false},
+		{"1000620000-1000629999", 1000620000, false},
+		{"1000620000/10000,1000700000/10000", 1000620000, false},
+		{"", 0, true},
+		{"abc/10000", 0, true},
+		{"0/10000", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.v, func(t *testing.T) {
+			got, err := parseRangeStart(tt.v)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseRangeStart() = %d, %v, want %d, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenShiftPod(t *testing.T) {
+	annotations := func(a map[string]string) func(string) (map[string]string, error) {
+		return func(string) (map[string]string, error) { return a, nil }
+	}
+	ranges := annotations(map[string]string{
+		uidRangeAnnotationKey:           "1000620000/10000",
+		supplementalGroupsAnnotationKey: "1000630000/10000",
+	})
+
+	t.Run("assigned by the SCC", func(t *testing.T) {
+		pod := &corev1.Pod{Spec: corev1.PodSpec{SecurityContext: &corev1.PodSecurityContext{
+			RunAsUser: ptr.To[int64](1000650000),
+			FSGroup:   ptr.To[int64](1000650000),
+		}}}
+		got, err := openShiftPod(pod, "default", annotations(nil))
+		if err != nil || got != pod {
+			t.Errorf("openShiftPod() = %v, %v, want the pod", got, err)
+		}
+	})
+
+	t.Run("namespace ranges", func(t *testing.T) {
+		pod := &corev1.Pod{}
+		got, err := openShiftPod(pod, "default", ranges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if psc := got.Spec.SecurityContext; *psc.RunAsUser != 1000620000 || *psc.FSGroup != 1000630000 {
+			t.Errorf("openShiftPod() = %+v, want the first IDs of the ranges", psc)
+		}
+		if pod.Spec.SecurityContext != nil {
+			t.Error("openShiftPod() modified the pod")
+		}
+		sc := nonRootSecurityContext(&Config{OpenShift: true}, got, "")
+		if sc == nil || *sc.RunAsUser != 1000620000 || *sc.RunAsGroup != 1000630000 {
+			t.Errorf("nonRootSecurityContext() = %+v, want the namespace ranges", sc)
+		}
+	})
+
+	t.Run("pod user", func(t *testing.T) {
+		pod := &corev1.Pod{Spec: corev1.PodSpec{SecurityContext: &corev1.PodSecurityContext{RunAsUser: ptr.To[int64](1000620005)}}}
+		got, err := openShiftPod(pod, "default", ranges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if psc := got.Spec.SecurityContext; *psc.RunAsUser != 1000620005 || *psc.FSGroup != 1000630000 {
+			t.Errorf("openShiftPod() = %+v, want the user of the pod", psc)
+		}
+	})
+
+	t.Run("no supplemental groups", func(t *testing.T) {
+		got, err := openShiftPod(&corev1.Pod{}, "default", annotations(map[string]string{uidRangeAnnotationKey: "1000620000/10000"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if psc := got.Spec.SecurityContext; *psc.FSGroup != 1000620000 {
+			t.Errorf("openShiftPod() = %+v, want the first user ID as fsGroup", psc)
+		}
+	})
+
+	for name, a := range map[string]func(string) (map[string]string, error){
+		"no annotation": annotations(map[string]string{}),
+		"fetch error":   func(string) (map[string]string, error) { return nil, errors.New("forbidden") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := openShiftPod(&corev1.Pod{}, "default", a); err == nil {
+				t.Error("openShiftPod() should fail")
+			}
+		})
+	}
+}
+
+func TestNamespaceCache(t *testing.T) {
+	calls := 0
+	c := &namespaceCache{fetch: func(namespace string) (map[string]string, error) {
+		calls++
+		return map[string]string{"namespace": namespace}, nil
+	}}
+	for _, ns := range []string{"a", "a", "b"} {
+		a, err := c.get(ns)
+		if err != nil || a["namespace"] != ns {
+			t.Errorf("get(%s) = %v, %v", ns, a, err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("fetched %d times, want 2", calls)
+	}
+}
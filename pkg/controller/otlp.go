@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/otlp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// otlpIntervalEnvVar is how often the renewer exports its metrics, in
+	// milliseconds, the variable of the OpenTelemetry SDKs.
+	otlpIntervalEnvVar = "OTEL_METRIC_EXPORT_INTERVAL"
+	// otlpLogsEnvVar is "otlp" when the renewer exports its logs, "none"
+	// otherwise.
+	otlpLogsEnvVar = "OTEL_LOGS_EXPORTER"
+)
+
+// OTLP configures the export of the metrics and the logs with OTLP/HTTP,
+// for clusters where nothing scrapes Prometheus metrics. When enabled, the
+// controller pushes its metrics instead of serving them on /metrics.
+type OTLP struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is the base URL of the collector, like
+	// http://otel-collector.observability:4318.
+	Endpoint string `yaml:"endpoint"`
+	// Headers are sent with the requests of the controller, not with the
+	// ones of the renewers.
+	Headers map[string]string `yaml:"headers"`
+	// Interval is how often the metrics are exported, defaults to 30s.
+	Interval string `yaml:"interval"`
+	// Logs also exports the logs.
+	Logs bool `yaml:"logs"`
+	// ResourceAttributes are added to the attributes identifying the
+	// controller and the renewers, like deployment.environment.
+	ResourceAttributes map[string]string `yaml:"resourceAttributes"`
+	// Renewers configures the renewers to export their metrics, and logs, to
+	// their own endpoint.
+	Renewers OTLPRenewers `yaml:"renewers"`
+}
+
+// OTLPRenewers configures the export of the renewers.
+type OTLPRenewers struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint of the renewers, like a node-local collector, defaults to the
+	// endpoint of the controller.
+	Endpoint string `yaml:"endpoint"`
+}
+
+// GetInterval returns how often the metrics are exported, defaults to 30s.
+func (o OTLP) GetInterval() time.Duration {
+	d, err := time.ParseDuration(o.Interval)
+	if err != nil || d <= 0 {
+		return otlp.DefaultInterval
+	}
+	return d
+}
+
+// validateOTLP returns an error if the OTLP endpoints are not valid, or the
+// renewers are configured for both OTLP and Prometheus metrics.
+func validateOTLP(c *Config) error {
+	o := c.OTLP
+	if !o.Enabled {
+		return nil
+	}
+	if _, err := otlp.New(o.Endpoint); err != nil {
+		return fmt.Errorf("otlp.endpoint: %w", err)
+	}
+	if o.Interval != "" {
+		if d, err := time.ParseDuration(o.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("otlp.interval %q is not a valid duration", o.Interval)
+		}
+	}
+	if !o.Renewers.Enabled {
+		return nil
+	}
+	if v := envProtocolVersions[otlp.EndpointEnvVar]; c.GetProtocolVersion() < v {
+		return fmt.Errorf("otlp.renewers requires protocolVersion %d or later", v)
+	}
+	if o.Renewers.Endpoint != "" {
+		if _, err := otlp.New(o.Renewers.Endpoint); err != nil {
+			return fmt.Errorf("otlp.renewers.endpoint: %w", err)
+		}
+	}
+	if c.RenewerMetrics.Enabled {
+		return fmt.Errorf("otlp.renewers can't be enabled with renewerMetrics, the renewers either serve or push their metrics")
+	}
+	return nil
+}
+
+// otlpResource returns the resource attributes of the controller, or of the
+// renewers without service.name, k8s.namespace.name and k8s.pod.name, set by
+// each renewer.
+func otlpResource(config *Config) map[string]string {
+	attrs := make(map[string]string)
+	if config.ClusterName != "" {
+		attrs["k8s.cluster.name"] = config.ClusterName
+	}
+	for k, v := range config.OTLP.ResourceAttributes {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// startOTLP starts exporting the metrics, and the logs, of the controller.
+// The returned function stops the export after a last one.
+func startOTLP(config *Config, namespace string) (stop func(), err error) {
+	attrs := map[string]string{
+		"service.name":       "autocert-controller",
+		"k8s.namespace.name": namespace,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		attrs["k8s.pod.name"] = hostname
+	}
+	for k, v := range otlpResource(config) {
+		attrs[k] = v
+	}
+	e, err := otlp.New(config.OTLP.Endpoint,
+		otlp.WithHeaders(config.OTLP.Headers),
+		otlp.WithResource(attrs),
+		otlp.WithGatherer(metricsRegistry))
+	if err != nil {
+		return nil, err
+	}
+	if config.OTLP.Logs {
+		log.AddHook(e)
+	}
+	log.WithFields(log.Fields{
+		"endpoint": config.OTLP.Endpoint,
+		"interval": config.OTLP.GetInterval(),
+		"logs":     config.OTLP.Logs,
+	}).Info("Exporting metrics with OTLP")
+	return e.Start(config.OTLP.GetInterval()), nil
+}
+
+// setRenewerOTLP configures the renewer to export its metrics, and logs, if
+// enabled for the renewers.
+func setRenewerOTLP(config *Config, renewer *corev1.Container) {
+	o := config.OTLP
+	if !o.Enabled || !o.Renewers.Enabled {
+		return
+	}
+	logs := "none"
+	if o.Logs {
+		logs = "otlp"
+	}
+	renewer.Env = setEnv(renewer.Env,
+		corev1.EnvVar{Name: otlp.EndpointEnvVar, Value: cmp.Or(o.Renewers.Endpoint, o.Endpoint)},
+		corev1.EnvVar{Name: otlp.ResourceEnvVar, Value: otlp.FormatAttributes(otlpResource(config))},
+		corev1.EnvVar{Name: otlpIntervalEnvVar, Value: strconv.FormatInt(o.GetInterval().Milliseconds(), 10)},
+		corev1.EnvVar{Name: otlpLogsEnvVar, Value: logs},
+	)
+}
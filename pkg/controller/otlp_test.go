@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smallstep/autocert/pkg/otlp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidateOTLP(t *testing.T) {
+	enabled := OTLP{Enabled: true, Endpoint: "http://otel-collector.observability:4318"}
+	renewers := enabled
+	renewers.Renewers = OTLPRenewers{Enabled: true}
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"disabled", Config{OTLP: OTLP{Endpoint: "collector"}}, false},
+		{"enabled", Config{OTLP: enabled}, false},
+		{"renewers", Config{OTLP: renewers}, false},
+		{"no endpoint", Config{OTLP: OTLP{Enabled: true}}, true},
+		{"invalid endpoint", Config{OTLP: OTLP{Enabled: true, Endpoint: "otel-collector:4318"}}, true},
+		{"invalid interval", Config{OTLP: OTLP{Enabled: true, Endpoint: enabled.Endpoint, Interval: "-1s"}}, true},
+		{"old protocol", Config{ProtocolVersion: 18, OTLP: renewers}, true},
+		{"old protocol without renewers", Config{ProtocolVersion: 18, OTLP: enabled}, false},
+		{"renewer metrics", Config{OTLP: renewers, RenewerMetrics: RenewerMetrics{Enabled: true}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateOTLP(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateOTLP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetRenewerOTLP(t *testing.T) {
+	config := &Config{
+		ClusterName: "prod",
+		OTLP: OTLP{
+			Enabled:            true,
+			Endpoint:           "https://otel.example.com",
+			Headers:            map[string]string{"Authorization": "Bearer token"},
+			Interval:           "1m",
+			ResourceAttributes: map[string]string{"deployment.environment": "production"},
+			Renewers:           OTLPRenewers{Enabled: true, Endpoint: "http://otel-agent.observability:4318"},
+		},
+	}
+	var renewer corev1.Container
+	setRenewerOTLP(config, &renewer)
+	env := map[string]string{}
+	for _, e := range renewer.Env {
+		env[e.Name] = e.Value
+	}
+	want := map[string]string{
+		otlp.EndpointEnvVar: "http://otel-agent.observability:4318",
+		otlp.ResourceEnvVar: "deployment.environment=production,k8s.cluster.name=prod",
+		otlpIntervalEnvVar:  "60000",
+		otlpLogsEnvVar:      "none",
+	}
+	for k, v := range want {
+		if env[k] != v {
+			t.Errorf("%s = %q, want %q", k, env[k], v)
+		}
+	}
+	if _, ok := env[otlp.HeadersEnvVar]; ok || len(env) != len(want) {
+		t.Errorf("env = %v, the headers of the controller must not be set in pods", env)
+	}
+
+	config.OTLP.Renewers.Enabled = false
+	renewer = corev1.Container{}
+	setRenewerOTLP(config, &renewer)
+	if len(renewer.Env) != 0 {
+		t.Errorf("env = %v, want none when disabled for the renewers", renewer.Env)
+	}
+}
+
+func TestOTLPMetricsEndpoint(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		config := &Config{OTLP: OTLP{Enabled: enabled, Endpoint: "http://otel-collector:4318"}}
+		rec := httptest.NewRecorder()
+		New(config, WithTokenManager(fakeTokens{})).handler("step").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+		if want := map[bool]int{false: http.StatusOK, true: http.StatusNotFound}[enabled]; rec.Code != want {
+			t.Errorf("otlp.enabled = %v: GET /metrics = %d, want %d", enabled, rec.Code, want)
+		}
+	}
+}
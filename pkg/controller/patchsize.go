@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// largePatchBytes is the size above which patches are logged. The API server
+// accepts much larger responses, but a patch this size means the pod is
+// already close to the limits of its own object.
+const largePatchBytes = 256 << 10
+
+// admissionPatchBytes is the size of the patches of the admission responses.
+var admissionPatchBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "autocert_admission_patch_bytes",
+	Help:    "Size in bytes of the JSON patches of the admission responses.",
+	Buckets: prometheus.ExponentialBuckets(1024, 2, 10),
+})
+
+func init() {
+	metricsRegistry.MustRegister(admissionPatchBytes)
+}
+
+// defaultValues are the fields the API server defaults, omitted from
+// minimized patches when they are set to their default.
+var defaultValues = map[string]any{
+	"terminationMessagePath":   corev1.TerminationMessagePathDefault,
+	"terminationMessagePolicy": string(corev1.TerminationMessageReadFile),
+}
+
+// minimizePatch returns a smaller equivalent of the patch of the given pod.
+// Null fields, empty resources and fields set to the value the API server
+// defaults them to are omitted, and runs of operations adding to the same
+// array or map are consolidated into a single operation replacing it, when
+// that is smaller.
+func minimizePatch(pod *corev1.Pod, ops []PatchOperation) ([]PatchOperation, error) {
+	var doc any
+	b, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	pruned := make([]PatchOperation, len(ops))
+	for i, op := range ops {
+		if op.Value != nil {
+			v, err := toJSONValue(op.Value)
+			if err != nil {
+				return nil, err
+			}
+			op.Value = omitDefaults(v)
+		}
+		pruned[i] = op
+	}
+
+	var result []PatchOperation
+	var touched []string
+	for i := 0; i < len(pruned); {
+		parent, _, ok := consolidationTarget(pruned[i])
+		j := i + 1
+		for ok && j < len(pruned) {
+			if p, _, ok := consolidationTarget(pruned[j]); !ok || p != parent {
+				break
+			}
+			j++
+		}
+		if ok && j-i > 1 && !overlaps(touched, parent) {
+			if op, ok := consolidate(doc, parent, pruned[i:j]); ok && patchSize(op) < patchSize(pruned[i:j]...) {
+				result = append(result, op)
+				touched = append(touched, parent)
+				i = j
+				continue
+			}
+		}
+		result = append(result, pruned[i])
+		touched = append(touched, pruned[i].Path)
+		i++
+	}
+	return result, nil
+}
+
+// consolidationTarget returns the array or map an operation adds to, with
+// the key it sets in maps. Only appends to arrays, and additions to the
+// labels and annotations of the pod, are consolidated.
+func consolidationTarget(op PatchOperation) (parent, key string, ok bool) {
+	if op.Op == "add" {
+		if p, found := strings.CutSuffix(op.Path, "/-"); found {
+			return p, "", true
+		}
+	}
+	if op.Op != "add" && op.Op != "replace" {
+		return "", "", false
+	}
+	i := strings.LastIndex(op.Path, "/")
+	if i < 0 {
+		return "", "", false
+	}
+	switch parent := op.Path[:i]; parent {
+	case "/metadata/annotations", "/metadata/labels":
+		return parent, unescapeJSONPath(op.Path[i+1:]), true
+	default:
+		return "", "", false
+	}
+}
+
+// consolidate returns an operation replacing the given array or map of the
+// document with its value after the given operations.
+func consolidate(doc any, parent string, ops []PatchOperation) (PatchOperation, bool) {
+	switch existing := lookupJSONPath(doc, parent).(type) {
+	case []any:
+		value := slices.Clone(existing)
+		for _, op := range ops {
+			value = append(value, op.Value)
+		}
+		return PatchOperation{Op: "replace", Path: parent, Value: value}, true
+	case map[string]any:
+		value := maps.Clone(existing)
+		for _, op := range ops {
+			_, key, _ := consolidationTarget(op)
+			value[key] = op.Value
+		}
+		return PatchOperation{Op: "replace", Path: parent, Value: value}, true
+	default:
+		return PatchOperation{}, false
+	}
+}
+
+// overlaps returns whether any of the paths is the given path, or a parent
+// or a child of it. The value of the path in the original document is then
+// out of date.
+func overlaps(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path || strings.HasPrefix(path, p+"/") || strings.HasPrefix(p, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// omitDefaults removes the null fields, the empty resources and the fields
+// set to their default from a JSON value.
+func omitDefaults(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			val = omitDefaults(val)
+			switch {
+			case val == nil:
+				delete(v, k)
+			case k == "resources" && isEmptyObject(val):
+				delete(v, k)
+			case defaultValues[k] != nil && defaultValues[k] == val:
+				delete(v, k)
+			default:
+				v[k] = val
+			}
+		}
+		return v
+	case []any:
+		for i := range v {
+			v[i] = omitDefaults(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func isEmptyObject(v any) bool {
+	m, ok := v.(map[string]any)
+	return ok && len(m) == 0
+}
+
+// toJSONValue returns the generic JSON representation of v.
+func toJSONValue(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	if err := json.Unmarshal(b, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// lookupJSONPath returns the value at the given RFC 6901 path of a document,
+// or nil if it doesn't exist.
+func lookupJSONPath(doc any, path string) any {
+	v := doc
+	for _, token := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[unescapeJSONPath(token)]
+		case []any:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// unescapeJSONPath reverses escapeJSONPath.
+func unescapeJSONPath(token string) string {
+	token = strings.ReplaceAll(token, "~1", "/")
+	return strings.ReplaceAll(token, "~0", "~")
+}
+
+// patchSize returns the size of the given operations, marshaled.
+func patchSize(ops ...PatchOperation) int {
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// applyPatch applies the add, replace and remove operations of a patch to a
+// JSON document.
+func applyPatch(t *testing.T, doc any, ops []PatchOperation) any {
+	t.Helper()
+	for _, op := range ops {
+		value, err := toJSONValue(op.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := strings.LastIndex(op.Path, "/")
+		parentPath, key := op.Path[:i], unescapeJSONPath(op.Path[i+1:])
+		var parent any = doc
+		if parentPath != "" {
+			parent = lookupJSONPath(doc, parentPath)
+		}
+		switch p := parent.(type) {
+		case map[string]any:
+			if op.Op == "remove" {
+				delete(p, key)
+			} else {
+				p[key] = value
+			}
+		case []any:
+			var next []any
+			switch n, _ := strconv.Atoi(key); {
+			case key == "-":
+				next = append(p, value)
+			case op.Op == "add":
+				next = append(p[:n:n], append([]any{value}, p[n:]...)...)
+			default:
+				p[n] = value
+				next = p
+			}
+			grand := lookupJSONPath(doc, parentPath[:strings.LastIndex(parentPath, "/")])
+			grand.(map[string]any)[parentPath[strings.LastIndex(parentPath, "/")+1:]] = next
+		default:
+			t.Fatalf("can't apply %s %s", op.Op, op.Path)
+		}
+	}
+	return doc
+}
+
+func TestMinimizePatch(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Annotations: map[string]string{"a": "1", admissionWebhookAnnotationKey: "app.default.svc.cluster.local"},
+			Labels:      map[string]string{"app": "app"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "app"}},
+			Volumes:    []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+		},
+	}
+	renewer := corev1.Container{
+		Name:                     "autocert-renewer",
+		Image:                    "renewer",
+		TerminationMessagePath:   corev1.TerminationMessagePathDefault,
+		TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+	}
+	ops := []PatchOperation{
+		{Op: "add", Path: "/spec/containers/0/volumeMounts", Value: []corev1.VolumeMount{{Name: "certs", MountPath: volumeMountPath, ReadOnly: true}}},
+		{Op: "add", Path: "/spec/containers/-", Value: renewer},
+		{Op: "add", Path: "/spec/volumes/-", Value: corev1.Volume{Name: "certs", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+		{Op: "add", Path: "/spec/volumes/-", Value: tokenBindingVolumeSource()},
+		{Op: "add", Path: "/metadata/annotations/" + escapeJSONPath(admissionWebhookStatusKey), Value: "injected"},
+		{Op: "add", Path: "/metadata/annotations/" + escapeJSONPath(revisionAnnotationKey), Value: "1"},
+		{Op: "replace", Path: "/metadata/annotations/a", Value: "2"},
+		{Op: "add", Path: "/metadata/labels/team", Value: "payments"},
+	}
+
+	got, err := minimizePatch(pod, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patchSize(got...) >= patchSize(ops...) {
+		t.Errorf("minimizePatch() = %d bytes, want less than %d", patchSize(got...), patchSize(ops...))
+	}
+	paths := make([]string, len(got))
+	for i, op := range got {
+		paths[i] = op.Op + " " + op.Path
+	}
+	want := []string{
+		"add /spec/containers/0/volumeMounts",
+		"add /spec/containers/-",
+		"replace /spec/volumes",
+		"replace /metadata/annotations",
+		"add /metadata/labels/team",
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("minimizePatch() = %v, want %v", paths, want)
+	}
+	if c := got[1].Value.(map[string]any); c["terminationMessagePath"] != nil || c["resources"] != nil || c["terminationMessagePolicy"] == nil {
+		t.Errorf("minimizePatch() renewer = %v, want the defaults omitted", c)
+	}
+
+	// Both patches give the same pod, once defaults are omitted.
+	doc := func() any {
+		v, err := toJSONValue(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	full := omitDefaults(applyPatch(t, doc(), ops))
+	minimized := omitDefaults(applyPatch(t, doc(), got))
+	if !reflect.DeepEqual(full, minimized) {
+		a, _ := json.Marshal(full)
+		b, _ := json.Marshal(minimized)
+		t.Errorf("minimized patch gives\n%s\nwant\n%s", b, a)
+	}
+}
+
+func TestMinimizePatchOverlap(t *testing.T) {
+	// The init containers are replaced before the mounts are added, the
+	// mounts can't be consolidated with the containers of the original pod.
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "init", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}}},
+	}}
+	ops := []PatchOperation{
+		removeInitContainers(),
+		{Op: "add", Path: "/spec/initContainers", Value: []corev1.Container{{Name: "bootstrapper"}, pod.Spec.InitContainers[0]}},
+		{Op: "add", Path: "/spec/initContainers/1/volumeMounts/-", Value: corev1.VolumeMount{Name: "certs", MountPath: volumeMountPath}},
+		{Op: "add", Path: "/spec/initContainers/1/volumeMounts/-", Value: corev1.VolumeMount{Name: "scratch", MountPath: "/tmp"}},
+	}
+	got, err := minimizePatch(pod, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(ops) {
+		t.Errorf("minimizePatch() = %v, want the operations kept", got)
+	}
+}
+
+func TestOmitDefaults(t *testing.T) {
+	var v any
+	if err := json.Unmarshal([]byte(`{"name":"c","resources":{},"limits":null,"emptyDir":{},"terminationMessagePath":"/dev/termination-log","env":[{"name":"A","value":null}]}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(omitDefaults(v))
+	if want := `{"emptyDir":{},"env":[{"name":"A"}],"name":"c"}`; string(got) != want {
+		t.Errorf("omitDefaults() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values of podExpiryMetrics.
+const (
+	// podExpiryMetricsFailing exposes the pods whose last renewal attempt
+	// failed, the ones automation may have to cycle.
+	podExpiryMetricsFailing = "failing"
+	// podExpiryMetricsAll exposes every pod with a certificate.
+	podExpiryMetricsAll = "all"
+)
+
+var (
+	podExpiryDesc = prometheus.NewDesc("autocert_pod_certificate_expiry_seconds",
+		"Seconds until the certificate of the pod expires.", []string{"namespace", "pod"}, nil)
+	podRenewalFailuresDesc = prometheus.NewDesc("autocert_pod_renewal_failures",
+		"Number of consecutive failed renewal attempts of the certificate of the pod.", []string{"namespace", "pod"}, nil)
+
+	// podExpiry exposes the expiry of the certificates of the pods. mode is
+	// set from the configuration before the server starts.
+	podExpiry = &podExpiryCollector{store: renewerReports}
+)
+
+func init() {
+	metricsRegistry.MustRegister(podExpiry)
+}
+
+// validatePodExpiryMetrics returns an error if podExpiryMetrics is not valid.
+func validatePodExpiryMetrics(c *Config) error {
+	switch c.PodExpiryMetrics {
+	case "", podExpiryMetricsFailing, podExpiryMetricsAll:
+		return nil
+	default:
+		return fmt.Errorf("podExpiryMetrics %q is not valid, it must be %s or %s", c.PodExpiryMetrics, podExpiryMetricsFailing, podExpiryMetricsAll)
+	}
+}
+
+// active returns the last report of every renewer with an unexpired
+// certificate, sorted by namespace and pod.
+func (s *reportStore) active(now time.Time) []renewerReport {
+	s.Lock()
+	defer s.Unlock()
+
+	reports := make([]renewerReport, 0, len(s.reports))
+	for _, r := range s.reports {
+		if now.Before(r.Status.NotAfter) {
+			reports = append(reports, r)
+		}
+	}
+	slices.SortFunc(reports, func(a, b renewerReport) int {
+		if c := strings.Compare(a.Namespace, b.Namespace); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Pod, b.Pod)
+	})
+	return reports
+}
+
+// podExpiryCollector exposes the time left before the certificate of each
+// pod expires, and its failed renewal attempts, computed at scrape time. The
+// metrics have a series per pod, so they are only exposed when enabled, for
+// the pods with failing renewals or for all of them.
+type podExpiryCollector struct {
+	store *reportStore
+	mode  string
+}
+
+// Describe implements prometheus.Collector.
+func (c *podExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- podExpiryDesc
+	ch <- podRenewalFailuresDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *podExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.mode == "" {
+		return
+	}
+	now := time.Now()
+	for _, r := range c.store.active(now) {
+		if c.mode == podExpiryMetricsFailing && r.Status.ConsecutiveFailures == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(podExpiryDesc, prometheus.GaugeValue, r.Status.NotAfter.Sub(now).Seconds(), r.Namespace, r.Pod)
+		ch <- prometheus.MustNewConstMetric(podRenewalFailuresDesc, prometheus.GaugeValue, float64(r.Status.ConsecutiveFailures), r.Namespace, r.Pod)
+	}
+}
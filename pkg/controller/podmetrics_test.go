@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPodExpiryCollector(t *testing.T) {
+	s := newReportStore()
+	s.add(renewerReport{Namespace: "payments", Pod: "api-1", Status: renewerStatus{NotAfter: time.Now().Add(time.Hour), ConsecutiveFailures: 3}})
+	s.add(renewerReport{Namespace: "payments", Pod: "api-2", Status: renewerStatus{NotAfter: time.Now().Add(8 * time.Hour)}})
+	s.add(renewerReport{Namespace: "payments", Pod: "api-3", Status: renewerStatus{NotAfter: time.Now().Add(-time.Minute), ConsecutiveFailures: 9}})
+
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{"", nil},
+		{podExpiryMetricsFailing, []string{"api-1"}},
+		{podExpiryMetricsAll, []string{"api-1", "api-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(&podExpiryCollector{store: s, mode: tt.mode})
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var pods []string
+			for _, f := range families {
+				if f.GetName() != "autocert_pod_certificate_expiry_seconds" {
+					continue
+				}
+				for _, m := range f.GetMetric() {
+					pod := m.GetLabel()[1].GetValue()
+					pods = append(pods, pod)
+					if v := m.GetGauge().GetValue(); pod == "api-1" && (v <= 3500 || v > 3600) {
+						t.Errorf("expiry of %s = %v, want about an hour", pod, v)
+					}
+				}
+			}
+			if len(pods) != len(tt.want) || (len(pods) > 0 && pods[0] != tt.want[0]) || (len(pods) > 1 && pods[1] != tt.want[1]) {
+				t.Errorf("pods = %v, want %v", pods, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePodExpiryMetrics(t *testing.T) {
+	for _, v := range []string{"", "failing", "all"} {
+		if err := validatePodExpiryMetrics(&Config{PodExpiryMetrics: v}); err != nil {
+			t.Errorf("validatePodExpiryMetrics(%q) error = %v", v, err)
+		}
+	}
+	if err := validatePodExpiryMetrics(&Config{PodExpiryMetrics: "true"}); err == nil {
+		t.Error("validatePodExpiryMetrics(true) should fail")
+	}
+}
@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Policy actions.
+const (
+	policyAllow = "allow"
+	policyWarn  = "warn"
+	policyDeny  = "deny"
+)
+
+// SANPolicy controls the shape of the DNS names pods can request.
+type SANPolicy struct {
+	// Wildcards is the action taken on wildcard names like *.example.com:
+	// allow (the default), warn or deny.
+	Wildcards string `yaml:"wildcards"`
+	// MaxLabels is the maximum number of labels of a requested name, 0 means
+	// no limit.
+	MaxLabels int `yaml:"maxLabels"`
+	// MaxLabelsAction is the action taken on names with more than MaxLabels
+	// labels: warn or deny (the default).
+	MaxLabelsAction string `yaml:"maxLabelsAction"`
+}
+
+// validate returns an error if the policy uses an unsupported action.
+func (p SANPolicy) validate() error {
+	switch p.Wildcards {
+	case "", policyAllow, policyWarn, policyDeny:
+	default:
+		return fmt.Errorf("wildcards %q is not supported, use %q, %q or %q", p.Wildcards, policyAllow, policyWarn, policyDeny)
+	}
+	switch p.MaxLabelsAction {
+	case "", policyWarn, policyDeny:
+	default:
+		return fmt.Errorf("maxLabelsAction %q is not supported, use %q or %q", p.MaxLabelsAction, policyWarn, policyDeny)
+	}
+	if p.MaxLabels < 0 {
+		return fmt.Errorf("maxLabels %d must not be negative", p.MaxLabels)
+	}
+	return nil
+}
+
+// GetSANPolicy returns the SAN policy of a namespace: the entry in
+// namespaceSANPolicies if there is one, sanPolicy otherwise.
+func (c Config) GetSANPolicy(namespace string) SANPolicy {
+	if p, ok := c.NamespaceSANPolicies[namespace]; ok {
+		return p
+	}
+	return c.SANPolicy
+}
+
+// validateSANPolicies returns an error if any SAN policy is invalid.
+func validateSANPolicies(c *Config) error {
+	if err := c.SANPolicy.validate(); err != nil {
+		return errors.Wrap(err, "invalid sanPolicy")
+	}
+	for namespace, p := range c.NamespaceSANPolicies {
+		if err := p.validate(); err != nil {
+			return errors.Wrapf(err, "invalid namespaceSANPolicies for namespace %q", namespace)
+		}
+	}
+	for name, p := range c.SANPolicies {
+		if err := p.validate(); err != nil {
+			return errors.Wrapf(err, "invalid sanPolicies entry %q", name)
+		}
+	}
+	return nil
+}
+
+// checkSANPolicy checks the names requested by a pod against the SAN policy
+// of its namespace, returned by GetSANPolicy or checkEnrollment. It returns the warnings to attach to the admission
+// response, or an error if the pod must be denied. Malformed wildcards, which
+// the CA would reject with an unhelpful error, are always denied.
+func checkSANPolicy(names []string, namespace string, policy SANPolicy) ([]string, error) {
+	var warnings []string
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if name == "" || net.ParseIP(name) != nil || strings.Contains(name, "@") || strings.Contains(name, "://") {
+			continue
+		}
+
+		if strings.Contains(name, "*") {
+			if !strings.HasPrefix(name, "*.") || strings.Count(name, "*") > 1 || strings.Count(name, ".") < 2 {
+				return nil, fmt.Errorf("wildcard name \"%s\" is not valid, a wildcard must be the whole leftmost label of a name with at least three labels, like *.example.com", name)
+			}
+			switch policy.Wildcards {
+			case policyDeny:
+				return nil, fmt.Errorf("wildcard name \"%s\" is not permitted in namespace \"%s\". Allow wildcards with sanPolicy or namespaceSANPolicies in the autocert-config ConfigMap", name, namespace)
+			case policyWarn:
+				warnings = append(warnings, fmt.Sprintf("autocert: wildcard name %s is valid for every subdomain, prefer explicit names", name))
+			}
+		}
+
+		if labels := strings.Count(name, ".") + 1; policy.MaxLabels > 0 && labels > policy.MaxLabels {
+			if policy.MaxLabelsAction == policyWarn {
+				warnings = append(warnings, fmt.Sprintf("autocert: name %s has %d labels, more than the %d allowed", name, labels, policy.MaxLabels))
+				continue
+			}
+			return nil, fmt.Errorf("name \"%s\" has %d labels, more than the %d permitted in namespace \"%s\". Change maxLabels with sanPolicy or namespaceSANPolicies in the autocert-config ConfigMap", name, labels, policy.MaxLabels, namespace)
+		}
+	}
+	return warnings, nil
+}
+
+// checkHostNamespaces returns an error if the pod shares the host network or
+// PID namespace and its namespace is not allowed to do so. Certificates issued
+// to these pods have a larger blast radius, so they are denied unless the
+// namespace is listed in hostNetworkNamespaces or hostPIDNamespaces. The
+// special value "*" allows every namespace.
+func checkHostNamespaces(spec *corev1.PodSpec, namespace string, config *Config) error {
+	if spec.HostNetwork && !namespaceAllowed(config.HostNetworkNamespaces, namespace) {
+		return fmt.Errorf("pods using the host network are not permitted to get certificates in namespace \"%s\". Add the namespace to hostNetworkNamespaces in the autocert-config ConfigMap to allow them", namespace)
+	}
+	if spec.HostPID && !namespaceAllowed(config.HostPIDNamespaces, namespace) {
+		return fmt.Errorf("pods using the host PID namespace are not permitted to get certificates in namespace \"%s\". Add the namespace to hostPIDNamespaces in the autocert-config ConfigMap to allow them", namespace)
+	}
+	return nil
+}
+
+// namespaceAllowed returns true if namespace or "*" is in the allow list.
+func namespaceAllowed(allowed []string, namespace string) bool {
+	return slices.Contains(allowed, namespace) || slices.Contains(allowed, "*")
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCheckHostNamespaces(t *testing.T) {
+	config := &Config{
+		HostNetworkNamespaces: []string{"ingress"},
+		HostPIDNamespaces:     []string{"*"},
+	}
+	testCases := []struct {
+		description string
+		spec        corev1.PodSpec
+		namespace   string
+		config      *Config
+		wantErr     bool
+	}{
+		{"regular pod", corev1.PodSpec{}, "default", &Config{}, false},
+		{"host network denied by default", corev1.PodSpec{HostNetwork: true}, "default", &Config{}, true},
+		{"host pid denied by default", corev1.PodSpec{HostPID: true}, "default", &Config{}, true},
+		{"host network allowed namespace", corev1.PodSpec{HostNetwork: true}, "ingress", config, false},
+		{"host network other namespace", corev1.PodSpec{HostNetwork: true}, "default", config, true},
+		{"host pid wildcard", corev1.PodSpec{HostPID: true}, "default", config, false},
+		{"host network and pid", corev1.PodSpec{HostNetwork: true, HostPID: true}, "ingress", config, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := checkHostNamespaces(&tc.spec, tc.namespace, tc.config)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("checkHostNamespaces() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckSANPolicy(t *testing.T) {
+	config := &Config{
+		SANPolicy: SANPolicy{Wildcards: policyDeny, MaxLabels: 6},
+		NamespaceSANPolicies: map[string]SANPolicy{
+			"gateway": {Wildcards: policyWarn, MaxLabels: 4, MaxLabelsAction: policyWarn},
+			"legacy":  {},
+		},
+	}
+	testCases := []struct {
+		description  string
+		names        []string
+		namespace    string
+		wantWarnings int
+		wantErr      bool
+	}{
+		{"regular names", []string{"api.default.svc.cluster.local", "10.0.0.1", "spiffe://example.com/ns/default/sa/api"}, "default", 0, false},
+		{"wildcard denied", []string{"*.example.com"}, "default", 0, true},
+		{"wildcard warning", []string{"*.example.com"}, "gateway", 1, false},
+		{"wildcard allowed", []string{"*.example.com"}, "legacy", 0, false},
+		{"malformed wildcard", []string{"api.*.example.com"}, "legacy", 0, true},
+		{"partial wildcard", []string{"api*.example.com"}, "legacy", 0, true},
+		{"top level wildcard", []string{"*.com"}, "legacy", 0, true},
+		{"too deep", []string{"a.b.c.d.e.example.com"}, "default", 0, true},
+		{"too deep warning", []string{"a.b.c.example.com", "c.d.e.example.com"}, "gateway", 2, false},
+		{"no limit", []string{"a.b.c.d.e.f.example.com"}, "legacy", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			warnings, err := checkSANPolicy(tc.names, tc.namespace, config.GetSANPolicy(tc.namespace))
+			if (err != nil) != tc.wantErr || len(warnings) != tc.wantWarnings {
+				t.Errorf("checkSANPolicy() = %v, %v, want %d warnings, wantErr %v", warnings, err, tc.wantWarnings, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSANPolicies(t *testing.T) {
+	if err := validateSANPolicies(&Config{SANPolicy: SANPolicy{Wildcards: policyWarn, MaxLabels: 5, MaxLabelsAction: policyDeny}}); err != nil {
+		t.Errorf("validateSANPolicies() error = %v", err)
+	}
+	if err := validateSANPolicies(&Config{SANPolicy: SANPolicy{Wildcards: "sometimes"}}); err == nil {
+		t.Error("validateSANPolicies() should fail with an unknown wildcards action")
+	}
+	if err := validateSANPolicies(&Config{NamespaceSANPolicies: map[string]SANPolicy{"default": {MaxLabelsAction: policyAllow}}}); err == nil {
+		t.Error("validateSANPolicies() should fail with an unknown maxLabelsAction")
+	}
+}
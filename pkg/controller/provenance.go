@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Version and BuildTime are set at build time, see the Makefile.
+var (
+	Version   = "dev"
+	BuildTime = ""
+)
+
+// provenancePredicateType is the type of the SLSA provenance in the in-toto
+// statements generated by tools/provenance.
+const provenancePredicateType = "https://slsa.dev/provenance/v1"
+
+// BuildVerification configures the startup check of the controller binary
+// against its cosign signature and SLSA provenance. The controller refuses to
+// start if the check fails.
+type BuildVerification struct {
+	Enabled bool `yaml:"enabled"`
+	// PublicKey is the path to the cosign public key.
+	PublicKey string `yaml:"publicKey"`
+	// Signature is the path to the signature of the binary, created with
+	// cosign sign-blob.
+	Signature string `yaml:"signature"`
+	// Provenance is the path to the in-toto statement of the binary,
+	// optional. Its signature is read from the same path with a .sig
+	// extension.
+	Provenance string `yaml:"provenance"`
+}
+
+// validateBuildVerification returns an error if the build verification is
+// enabled without a public key or a signature.
+func validateBuildVerification(c *Config) error {
+	v := c.BuildVerification
+	if v.Enabled && (v.PublicKey == "" || v.Signature == "") {
+		return errors.New("buildVerification requires a publicKey and a signature")
+	}
+	return nil
+}
+
+// buildFields returns the build information logged on startup: the version,
+// the build time and the revision and toolchain embedded by the Go linker.
+func buildFields() log.Fields {
+	fields := log.Fields{
+		"version":   Version,
+		"buildTime": BuildTime,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		fields["goVersion"] = info.GoVersion
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision", "vcs.modified", "-trimpath", "CGO_ENABLED":
+				fields[s.Key] = s.Value
+			}
+		}
+	}
+	return fields
+}
+
+// verifyBuild checks the given binary against the signature and the
+// provenance set in the configuration.
+func verifyBuild(v BuildVerification, binary string) error {
+	key, err := readCosignKey(v.PublicKey)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(binary) //nolint:gosec // path of the running binary
+	if err != nil {
+		return errors.Wrap(err, "error reading binary")
+	}
+	digest := sha256.Sum256(data)
+	if err := verifyBlob(key, digest[:], v.Signature); err != nil {
+		return errors.Wrapf(err, "binary %s", binary)
+	}
+	if v.Provenance == "" {
+		return nil
+	}
+
+	statement, err := os.ReadFile(v.Provenance)
+	if err != nil {
+		return errors.Wrap(err, "error reading provenance")
+	}
+	sum := sha256.Sum256(statement)
+	if err := verifyBlob(key, sum[:], v.Provenance+".sig"); err != nil {
+		return errors.Wrapf(err, "provenance %s", v.Provenance)
+	}
+	var s struct {
+		PredicateType string `json:"predicateType"`
+		Subject       []struct {
+			Name   string            `json:"name"`
+			Digest map[string]string `json:"digest"`
+		} `json:"subject"`
+	}
+	if err := json.Unmarshal(statement, &s); err != nil {
+		return errors.Wrap(err, "error parsing provenance")
+	}
+	if s.PredicateType != provenancePredicateType {
+		return errors.Errorf("provenance has predicate type %q, want %q", s.PredicateType, provenancePredicateType)
+	}
+	want := hex.EncodeToString(digest[:])
+	for _, subject := range s.Subject {
+		if strings.EqualFold(subject.Digest["sha256"], want) {
+			return nil
+		}
+	}
+	return errors.Errorf("provenance %s has no subject with the digest of the binary, sha256:%s", v.Provenance, want)
+}
+
+// readCosignKey reads a cosign ECDSA public key.
+func readCosignKey(path string) (*ecdsa.PublicKey, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // file path comes from trusted configuration
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading public key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("error reading public key %s: no PEM data found", path)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing public key %s", path)
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("public key %s is a %T, only ECDSA keys are supported", path, pub)
+	}
+	return key, nil
+}
+
+// verifyBlob verifies a base64 signature created by cosign sign-blob over a
+// blob with the given SHA-256 digest.
+func verifyBlob(key *ecdsa.PublicKey, digest []byte, sigPath string) error {
+	data, err := os.ReadFile(sigPath) //nolint:gosec // file path comes from trusted configuration
+	if err != nil {
+		return errors.Wrap(err, "error reading signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return errors.Wrapf(err, "error decoding signature %s", sigPath)
+	}
+	if !ecdsa.VerifyASN1(key, digest, sig) {
+		return errors.Errorf("signature %s is not valid", sigPath)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyBuild(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	newKey := func(name string) (*ecdsa.PrivateKey, string) {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, write(name, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	// sign writes a signature in the format of cosign sign-blob.
+	sign := func(key *ecdsa.PrivateKey, name string, data []byte) string {
+		t.Helper()
+		sum := sha256.Sum256(data)
+		sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return write(name, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"))
+	}
+	statement := func(data []byte) []byte {
+		sum := sha256.Sum256(data)
+		return []byte(fmt.Sprintf(`{"_type":"https://in-toto.io/Statement/v1","subject":[{"name":"autocert","digest":{"sha256":%q}}],"predicateType":%q,"predicate":{}}`,
+			hex.EncodeToString(sum[:]), provenancePredicateType))
+	}
+
+	key, pub := newKey("cosign.pub")
+	_, otherPub := newKey("other.pub")
+	binary := []byte("autocert controller")
+	binaryPath := write("autocert", binary)
+	sigPath := sign(key, "autocert.sig", binary)
+	provenancePath := write("autocert.intoto.json", statement(binary))
+	sign(key, "autocert.intoto.json.sig", statement(binary))
+	otherPath := write("other.intoto.json", statement([]byte("another binary")))
+	sign(key, "other.intoto.json.sig", statement([]byte("another binary")))
+	unsignedPath := write("unsigned.intoto.json", statement(binary))
+	tamperedPath := write("tampered", []byte("autocert controller!"))
+
+	tests := []struct {
+		name    string
+		v       BuildVerification
+		binary  string
+		wantErr bool
+	}{
+		{"signature", BuildVerification{PublicKey: pub, Signature: sigPath}, binaryPath, false},
+		{"provenance", BuildVerification{PublicKey: pub, Signature: sigPath, Provenance: provenancePath}, binaryPath, false},
+		{"tampered binary", BuildVerification{PublicKey: pub, Signature: sigPath}, tamperedPath, true},
+		{"other key", BuildVerification{PublicKey: otherPub, Signature: sigPath}, binaryPath, true},
+		{"missing signature", BuildVerification{PublicKey: pub, Signature: filepath.Join(dir, "missing.sig")}, binaryPath, true},
+		{"provenance of another binary", BuildVerification{PublicKey: pub, Signature: sigPath, Provenance: otherPath}, binaryPath, true},
+		{"unsigned provenance", BuildVerification{PublicKey: pub, Signature: sigPath, Provenance: unsignedPath}, binaryPath, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyBuild(tt.v, tt.binary); (err != nil) != tt.wantErr {
+				t.Errorf("verifyBuild() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
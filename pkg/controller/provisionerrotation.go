@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/ca"
+)
+
+// Credentials of the provisioners, the values of ProvisionerStatus.Active.
+const (
+	credentialsCurrent = "current"
+	credentialsNext    = "next"
+)
+
+// NextProvisioner configures the provisioner replacing the one of the
+// controller. While it's set the controller loads both, so the start of the
+// controller fails if the new credentials don't work, and mints the tokens
+// with the new ones once Active is set. Tokens already minted with the
+// current provisioner stay valid until it's removed from the CA.
+type NextProvisioner struct {
+	Name         string `yaml:"name"`
+	Kid          string `yaml:"kid"`
+	PasswordPath string `yaml:"passwordPath"`
+	Active       bool   `yaml:"active"`
+}
+
+// enabled returns whether a provisioner rotation is in progress.
+func (n NextProvisioner) enabled() bool {
+	return n.Name != "" || n.Kid != "" || n.PasswordPath != ""
+}
+
+// validateNextProvisioner returns an error if the next provisioner is
+// incomplete, or used with a controller that has no provisioner.
+func validateNextProvisioner(c *Config) error {
+	n := c.NextProvisioner
+	if !n.enabled() {
+		if n.Active {
+			return errors.New("nextProvisioner.active requires a nextProvisioner")
+		}
+		return nil
+	}
+	if n.Name == "" || n.Kid == "" || n.PasswordPath == "" {
+		return errors.New("nextProvisioner requires a name, a kid and a passwordPath")
+	}
+	if n.Name == c.GetProvisionerName() {
+		return fmt.Errorf("nextProvisioner.name %q must differ from the name of the current provisioner, the CA requires unique names", n.Name)
+	}
+	if c.ServiceAccountAuth.Enabled || c.DevCA.Enabled {
+		return errors.New("nextProvisioner can't be set with serviceAccountAuth or devCA, the controller has no provisioner password")
+	}
+	return nil
+}
+
+// loadNextProvisioner loads the next provisioner in the configuration and
+// its password, or returns nil if there's none.
+func (c *Controller) loadNextProvisioner() (*ca.Provisioner, []byte, error) {
+	config := c.liveConfig()
+	n := config.NextProvisioner
+	if !n.enabled() {
+		return nil, nil, nil
+	}
+	password, err := readPasswordFromFile(n.PasswordPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := ca.NewProvisioner(n.Name, n.Kid, c.caURL(), password, ca.WithRootFile(config.GetRootCAPath()))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error loading next provisioner %s", n.Name)
+	}
+	log.WithFields(log.Fields{
+		"name":   p.Name(),
+		"kid":    p.Kid(),
+		"active": n.Active,
+	}).Info("Loaded next provisioner")
+	return p, password, nil
+}
+
+// CredentialStatus is the status of the credentials of a provisioner.
+type CredentialStatus struct {
+	Name string `json:"name"`
+	Kid  string `json:"kid"`
+	// OnCA is whether the CA still lists the provisioner with this key.
+	OnCA  bool   `json:"onCA"`
+	Error string `json:"error,omitempty"`
+}
+
+// ProvisionerStatus is the status of the provisioners of the controller,
+// served on /provisioner to follow a rotation.
+type ProvisionerStatus struct {
+	// Active is the credentials minting the tokens, current or next.
+	Active  string            `json:"active"`
+	Current *CredentialStatus `json:"current,omitempty"`
+	Next    *CredentialStatus `json:"next,omitempty"`
+}
+
+// credential identifies the key of a provisioner.
+type credential struct {
+	name, kid string
+}
+
+// provisionerCredentials are the provisioners loaded by the controller.
+type provisionerCredentials struct {
+	mu            sync.Mutex
+	current, next *credential
+	active        string
+	// list returns the provisioners of the CA.
+	list func(ctx context.Context) (provisioner.List, error)
+}
+
+// provisionerRotation holds the provisioners loaded by the controller.
+var provisionerRotation = &provisionerCredentials{active: credentialsCurrent}
+
+// set records the provisioners loaded by the controller, either may be nil.
+func (p *provisionerCredentials) set(current, next *ca.Provisioner, active bool, list func(ctx context.Context) (provisioner.List, error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current, p.next, p.list = nil, nil, list
+	if current != nil {
+		p.current = &credential{current.Name(), current.Kid()}
+	}
+	if next != nil {
+		p.next = &credential{next.Name(), next.Kid()}
+	}
+	p.active = credentialsCurrent
+	if active && next != nil {
+		p.active = credentialsNext
+	}
+}
+
+// status returns the status of the provisioners, checking they're still on
+// the CA.
+func (p *provisionerCredentials) status(ctx context.Context) ProvisionerStatus {
+	p.mu.Lock()
+	current, next, active, list := p.current, p.next, p.active, p.list
+	p.mu.Unlock()
+
+	var provisioners provisioner.List
+	var listErr error
+	if list != nil && (current != nil || next != nil) {
+		provisioners, listErr = list(ctx)
+	}
+	check := func(c *credential) *CredentialStatus {
+		if c == nil {
+			return nil
+		}
+		s := &CredentialStatus{Name: c.name, Kid: c.kid}
+		switch {
+		case listErr != nil:
+			s.Error = listErr.Error()
+		case list == nil:
+			s.Error = "the provisioners of the CA are not available"
+		default:
+			for _, p := range provisioners {
+				if kid, _, ok := p.GetEncryptedKey(); ok && p.GetName() == c.name && kid == c.kid {
+					s.OnCA = true
+				}
+			}
+		}
+		return s
+	}
+	return ProvisionerStatus{
+		Active:  active,
+		Current: check(current),
+		Next:    check(next),
+	}
+}
+
+// listProvisioners returns a function listing all the provisioners of the
+// CA of a client.
+func listProvisioners(client func() *ca.Client) func(ctx context.Context) (provisioner.List, error) {
+	return func(ctx context.Context) (provisioner.List, error) {
+		var list provisioner.List
+		var cursor string
+		for {
+			resp, err := client().ProvisionersWithContext(ctx, ca.WithProvisionerCursor(cursor), ca.WithProvisionerLimit(100))
+			if err != nil {
+				return nil, errors.Wrap(err, "error listing provisioners")
+			}
+			list = append(list, resp.Provisioners...)
+			if resp.NextCursor == "" || len(resp.Provisioners) == 0 {
+				return list, nil
+			}
+			cursor = resp.NextCursor
+		}
+	}
+}
+
+// provisionerHandler serves the status of the provisioners of the
+// controller. The names and key IDs are public, the CA lists them too, but
+// the status tells which credentials mint the tokens, so the endpoint is
+// protected by endpointAuth like the other ones.
+func provisionerHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(provisionerRotation.status(ctx)); err != nil {
+		log.WithField("error", err).Info("Write error")
+	}
+}
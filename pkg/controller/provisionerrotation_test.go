@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smallstep/certificates/authority/provisioner"
+	"go.step.sm/crypto/jose"
+)
+
+func TestValidateNextProvisioner(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			ProvisionerName: "autocert",
+			NextProvisioner: NextProvisioner{Name: "autocert-2", Kid: "kid", PasswordPath: "/home/step/password/next-password"},
+		}
+	}
+	if err := validateNextProvisioner(valid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateNextProvisioner(&Config{}); err != nil {
+		t.Errorf("validateNextProvisioner() without a rotation = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"kid", func(c *Config) { c.NextProvisioner.Kid = "" }},
+		{"passwordPath", func(c *Config) { c.NextProvisioner.PasswordPath = "" }},
+		{"same name", func(c *Config) { c.NextProvisioner.Name = "autocert" }},
+		{"active", func(c *Config) { c.NextProvisioner = NextProvisioner{Active: true} }},
+		{"serviceAccountAuth", func(c *Config) { c.ServiceAccountAuth.Enabled = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			if err := validateNextProvisioner(c); err == nil {
+				t.Error("validateNextProvisioner() succeeded")
+			}
+		})
+	}
+}
+
+func TestProvisionerStatus(t *testing.T) {
+	list := func(context.Context) (provisioner.List, error) {
+		return provisioner.List{
+			&provisioner.JWK{Name: "autocert", Key: &jose.JSONWebKey{KeyID: "old"}, EncryptedKey: "old-key"},
+			&provisioner.JWK{Name: "autocert-2", Key: &jose.JSONWebKey{KeyID: "new"}, EncryptedKey: "new-key"},
+		}, nil
+	}
+	p := &provisionerCredentials{
+		current: &credential{"autocert", "old"},
+		next:    &credential{"autocert-2", "other"},
+		active:  credentialsNext,
+		list:    list,
+	}
+	want := ProvisionerStatus{
+		Active:  credentialsNext,
+		Current: &CredentialStatus{Name: "autocert", Kid: "old", OnCA: true},
+		Next:    &CredentialStatus{Name: "autocert-2", Kid: "other"},
+	}
+	got := p.status(context.Background())
+	if b, w := mustJSON(t, got), mustJSON(t, want); b != w {
+		t.Errorf("status() = %s, want %s", b, w)
+	}
+
+	p.list = func(context.Context) (provisioner.List, error) { return nil, errors.New("connection refused") }
+	if got := p.status(context.Background()); got.Current.OnCA || got.Current.Error != "connection refused" {
+		t.Errorf("status() with the CA down = %+v", got.Current)
+	}
+
+	defer func(p *provisionerCredentials) { provisionerRotation = p }(provisionerRotation)
+	provisionerRotation = &provisionerCredentials{current: &credential{"autocert", "old"}, active: credentialsCurrent, list: list}
+	rec := httptest.NewRecorder()
+	New(&Config{}).handler("step").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/provisioner", http.NoBody))
+	var s ProvisionerStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || s.Active != credentialsCurrent || s.Current == nil || !s.Current.OnCA || s.Next != nil {
+		t.Errorf("GET /provisioner = %d %s", rec.Code, rec.Body)
+	}
+
+	// With endpointAuth, the status requires a token.
+	rec = httptest.NewRecorder()
+	New(&Config{EndpointAuth: EndpointAuth{Enabled: true}}).handler("step").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/provisioner", http.NoBody))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /provisioner without a token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
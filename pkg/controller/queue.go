@@ -0,0 +1,209 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// PersistentQueue configures where the controller saves its pending work, so
+// it survives restarts: the claims of pods admitted before their token was
+// generated, waiting on a CertificateSigningRequest approval, or allowed to
+// re-mint their token, and the token secrets to delete once expired. The
+// path should be on a persistent volume only mounted by the controller.
+type PersistentQueue struct {
+	Path string `yaml:"path"`
+}
+
+// validatePersistentQueue returns an error if the path of the persistent
+// queue is not absolute.
+func validatePersistentQueue(c *Config) error {
+	if p := c.PersistentQueue.Path; p != "" && !filepath.IsAbs(p) {
+		return fmt.Errorf("persistentQueue.path %q must be an absolute path", p)
+	}
+	return nil
+}
+
+// queueState is the content of the persistent queue file. Claims are only
+// saved hashed.
+type queueState struct {
+	Issuances       map[string]pendingIssuance `json:"issuances,omitempty"`
+	CSRIssuances    map[string]pendingIssuance `json:"csrIssuances,omitempty"`
+	Remints         map[string]pendingIssuance `json:"remints,omitempty"`
+	SecretDeletions []secretDeletion           `json:"secretDeletions,omitempty"`
+}
+
+// persistentQueue saves the pending work of the controller to a file after
+// every change.
+type persistentQueue struct {
+	sync.Mutex
+	path         string
+	issuances    *issuanceStore
+	csrIssuances *issuanceStore
+	remints      *issuanceStore
+	deletions    *deletionStore
+}
+
+// openQueue restores the pending work saved in the given file, if any, and
+// saves every change from now on.
+func openQueue(path string) error {
+	var state queueState
+	b, err := os.ReadFile(path) //nolint:gosec // path comes from trusted configuration
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return errors.Wrap(err, "error reading persistent queue")
+	default:
+		if err := json.Unmarshal(b, &state); err != nil {
+			return errors.Wrapf(err, "error parsing persistent queue %s", path)
+		}
+	}
+
+	q := &persistentQueue{
+		path:         path,
+		issuances:    pendingIssuances,
+		csrIssuances: csrIssuances,
+		remints:      remintClaims,
+		deletions:    tokenSecretDeletions,
+	}
+	ctxLog := log.WithFields(log.Fields{
+		"path":            path,
+		"issuances":       q.issuances.restore(state.Issuances),
+		"csrIssuances":    q.csrIssuances.restore(state.CSRIssuances),
+		"remints":         q.remints.restore(state.Remints),
+		"secretDeletions": len(state.SecretDeletions),
+	})
+	for _, s := range []*issuanceStore{q.issuances, q.csrIssuances, q.remints} {
+		s.persist = q.save
+	}
+	q.deletions.persist = q.save
+	for _, d := range state.SecretDeletions {
+		q.deletions.schedule(d)
+	}
+	ctxLog.Info("Restored persistent queue")
+	return nil
+}
+
+// save writes the current pending work to the queue file. Errors are only
+// logged: the work is still done by this controller, it's only lost if the
+// controller restarts before the next successful save.
+func (q *persistentQueue) save() {
+	q.Lock()
+	defer q.Unlock()
+
+	b, err := json.Marshal(queueState{
+		Issuances:       q.issuances.snapshot(),
+		CSRIssuances:    q.csrIssuances.snapshot(),
+		Remints:         q.remints.snapshot(),
+		SecretDeletions: q.deletions.snapshot(),
+	})
+	if err == nil {
+		err = writeQueueFile(q.path, b)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  q.path,
+			"error": err,
+		}).Error("Error saving persistent queue")
+	}
+}
+
+// writeQueueFile atomically replaces the queue file, readable only by the
+// controller.
+func writeQueueFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) //nolint:errcheck // the file is gone after a successful rename
+
+	if _, err := f.Write(data); err != nil {
+		f.Close() //nolint:errcheck // the write error is more relevant
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close() //nolint:errcheck // the sync error is more relevant
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// secretDeletion is a token secret to delete once its token expired.
+type secretDeletion struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Due       time.Time `json:"due"`
+}
+
+// tokenSecretDeletions holds the token secrets waiting to be deleted.
+var tokenSecretDeletions = newDeletionStore()
+
+// deletionStore schedules the deletion of token secrets.
+type deletionStore struct {
+	sync.Mutex
+	pending map[string]secretDeletion
+	// persist is called after every change when the queue is persistent.
+	persist func()
+}
+
+func newDeletionStore() *deletionStore {
+	return &deletionStore{
+		pending: make(map[string]secretDeletion),
+	}
+}
+
+func (s *deletionStore) changed() {
+	if s.persist != nil {
+		s.persist()
+	}
+}
+
+// schedule deletes a token secret when it's due. This is best effort: a
+// secret is deleted once even if its deletion fails.
+func (s *deletionStore) schedule(d secretDeletion) {
+	key := d.Namespace + "/" + d.Name
+	s.Lock()
+	s.pending[key] = d
+	s.Unlock()
+	s.changed()
+
+	go func() {
+		time.Sleep(time.Until(d.Due))
+		ctxLog := log.WithFields(log.Fields{
+			"name":      d.Name,
+			"namespace": d.Namespace,
+		})
+		if err := tokenSecrets.DeleteSecret(d.Namespace, d.Name); err != nil {
+			ctxLog.WithField("error", err).Error("Error deleting expired bootstrap token secret")
+		} else {
+			ctxLog.Info("Deleted expired bootstrap token secret")
+		}
+
+		s.Lock()
+		delete(s.pending, key)
+		s.Unlock()
+		s.changed()
+	}()
+}
+
+// snapshot returns the pending deletions.
+func (s *deletionStore) snapshot() []secretDeletion {
+	s.Lock()
+	defer s.Unlock()
+
+	deletions := make([]secretDeletion, 0, len(s.pending))
+	for _, d := range s.pending {
+		deletions = append(deletions, d)
+	}
+	return deletions
+}
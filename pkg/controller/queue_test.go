@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePersistentQueue(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"", false},
+		{"/var/lib/autocert/queue.json", false},
+		{"queue.json", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if err := validatePersistentQueue(&Config{PersistentQueue: PersistentQueue{Path: tt.path}}); (err != nil) != tt.wantErr {
+				t.Errorf("validatePersistentQueue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPersistentQueue(t *testing.T) {
+	defer func(p, c, r *issuanceStore, d *deletionStore, m SecretManager) {
+		pendingIssuances, csrIssuances, remintClaims, tokenSecretDeletions, tokenSecrets = p, c, r, d, m
+	}(pendingIssuances, csrIssuances, remintClaims, tokenSecretDeletions, tokenSecrets)
+	secrets := &fakeSecrets{deleted: make(chan string, 1)}
+	tokenSecrets = secrets
+	restart := func() {
+		pendingIssuances, csrIssuances, remintClaims = newIssuanceStore(), newIssuanceStore(), newIssuanceStore()
+		tokenSecretDeletions = newDeletionStore()
+	}
+
+	path := filepath.Join(t.TempDir(), "queue.json")
+	restart()
+	if err := openQueue(path); err != nil {
+		t.Fatal(err)
+	}
+	claim, err := pendingIssuances.add(pendingIssuance{CommonName: "api.default.svc", Namespace: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenSecretDeletions.schedule(secretDeletion{Namespace: "default", Name: "api-abcde", Due: time.Now().Add(time.Hour)})
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), claim) {
+		t.Error("persistent queue holds the claim")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("persistent queue mode = %v, %v", fi.Mode(), err)
+	}
+
+	// Claims and secret deletions survive a restart.
+	var state queueState
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	state.SecretDeletions[0].Due = time.Now()
+	if b, err = json.Marshal(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	restart()
+	if err := openQueue(path); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := pendingIssuances.take(claim); !ok || p.CommonName != "api.default.svc" {
+		t.Errorf("take() = %+v, %v, want the issuance added before the restart", p, ok)
+	}
+	select {
+	case got := <-secrets.deleted:
+		if got != "default/api-abcde" {
+			t.Errorf("deleted secret %s, want default/api-abcde", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("secret scheduled before the restart was not deleted")
+	}
+
+	// Redeemed claims are removed from the file.
+	restart()
+	if err := openQueue(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pendingIssuances.peek(claim); ok {
+		t.Error("redeemed claim restored after a restart")
+	}
+}
+
+func TestOpenQueueInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := openQueue(path); err == nil {
+		t.Error("openQueue() with an invalid file succeeded")
+	}
+}
@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// GetReissueURL returns the URL where renewers check whether their
+// certificate must be re-issued with new SANs.
+func (c Config) GetReissueURL() string {
+	return fmt.Sprintf("https://%s.%s.svc/reissue", c.GetServiceName(), os.Getenv("NAMESPACE"))
+}
+
+// reissueRequest is the body of a request to the /reissue endpoint, sent
+// periodically by renewers.
+type reissueRequest struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+}
+
+// reissueResponse is the response of the /reissue endpoint when the
+// certificate must be re-issued: a token for the new SANs.
+type reissueResponse struct {
+	Token string   `json:"token"`
+	SANs  []string `json:"sans"`
+}
+
+// normalizeSANs returns the given names in the form they take in a
+// certificate, sorted and without duplicates, so the SANs of a pod can be
+// compared to the ones of its certificate.
+func normalizeSANs(names []string) []string {
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			name = ip.String()
+		} else if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+			name = u.String()
+		}
+		result = append(result, strings.ToLower(name))
+	}
+	slices.Sort(result)
+	return slices.Compact(result)
+}
+
+// certificateSANs returns the SANs of a certificate, normalized like
+// normalizeSANs.
+func certificateSANs(crt *x509.Certificate) []string {
+	var names []string
+	names = append(names, crt.DNSNames...)
+	names = append(names, crt.EmailAddresses...)
+	for _, ip := range crt.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, u := range crt.URIs {
+		names = append(names, u.String())
+	}
+	return normalizeSANs(names)
+}
+
+// reissueAllowed returns whether the given client certificate may ask for the
+// re-issuance of the certificate of a pod: the pod must have been injected
+// with a certificate for the same common name.
+func reissueAllowed(crt *x509.Certificate, pod *corev1.Pod) bool {
+	annotations := pod.GetAnnotations()
+	return annotations[admissionWebhookStatusKey] == "injected" &&
+		annotations[admissionWebhookAnnotationKey] != "" &&
+		annotations[admissionWebhookAnnotationKey] == crt.Subject.CommonName
+}
+
+// getPod returns a pod, or nil if it doesn't exist.
+func getPod(namespace, name string) (*corev1.Pod, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := client.GetRequest(fmt.Sprintf("api/v1/namespaces/%s/pods/%s", namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "get pod")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, errors.Errorf("get pod: %s", resp.Status)
+	}
+
+	var pod corev1.Pod
+	if err := json.NewDecoder(resp.Body).Decode(&pod); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshalling pod")
+	}
+	return &pod, nil
+}
+
+// reissueHandler tells a renewer whether the certificate of its pod must be
+// re-issued because the SANs requested by the pod changed, for instance after
+// its sans annotation or a SAN resolver input was updated. If so, the new
+// SANs go through the same checks as at admission, and the response is a
+// token for them. It responds with 204 No Content if the certificate is up to
+// date. Renewers authenticate with their certificate and, with
+// renewerAuth.bindToken, with a service account token bound to the pod.
+func reissueHandler(w http.ResponseWriter, r *http.Request, config *Config, provisioner TokenManager) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "Unauthorized (Missing Client Certificate)", http.StatusUnauthorized)
+		return
+	}
+	crt := r.TLS.PeerCertificates[0]
+
+	var req reissueRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxClaimRequestSize)).Decode(&req); err != nil || req.Namespace == "" || req.Pod == "" {
+		log.Error("Bad Request: 400 (Invalid Reissue Request)")
+		http.Error(w, "Bad Request (Invalid Reissue Request)", http.StatusBadRequest)
+		return
+	}
+
+	bound, err := authorizeRenewer(r, config, req.Namespace, req.Pod)
+	if err != nil {
+		renewerAuthError(w, r, req.Namespace, req.Pod, err)
+		return
+	}
+
+	ctxLog := log.WithFields(log.Fields{
+		"commonName": crt.Subject.CommonName,
+		"namespace":  req.Namespace,
+		"pod":        req.Pod,
+	})
+
+	pod, err := getPod(req.Namespace, req.Pod)
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error getting pod")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if pod != nil {
+		expandNames(pod, req.Namespace, config)
+	}
+	// A pod recreated with the same name, like a StatefulSet replica, is not
+	// the pod the token is bound to.
+	if pod == nil || !reissueAllowed(crt, pod) || (bound.UID != "" && string(pod.UID) != bound.UID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Renewers injected before the feature was disabled keep asking, their
+	// certificate is reported as up to date.
+	if !featureEnabled(config, featureReissue, req.Namespace) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sans, err := desiredSANs(r.Context(), pod, req.Namespace, pod.Annotations[revisionAnnotationKey], config)
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error resolving SANs")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sans = slices.Compact(slices.Sorted(slices.Values(sans)))
+	if slices.Equal(normalizeSANs(sans), certificateSANs(crt)) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	ctxLog = ctxLog.WithFields(log.Fields{
+		"audit": true,
+		"sans":  sans,
+	})
+
+	// The new names must pass the checks done at admission.
+	policy, err := checkEnrollment(req.Namespace, config, getEnrollment, countCertificates)
+	if err == nil {
+		_, err = checkSANPolicy(requestedNames(pod), req.Namespace, policy)
+	}
+	if err == nil {
+		_, err = checkSANs(pod, req.Namespace, config, listServices)
+	}
+	if err == nil {
+		// Names held by an approval gate, or pods in csrNamespaces, get
+		// their certificate through a CertificateSigningRequest created by
+		// the bootstrapper.
+		if csr, _ := usesCSR(config, append([]string{crt.Subject.CommonName}, sans...), req.Namespace); csr {
+			err = errors.New("the new names require an approved certificate signing request, restart the pod to get one")
+		}
+	}
+	// Pods of a constrained intermediate get a token of its provisioner, for
+	// names it can sign, and pods of another CA a token of its provisioner.
+	tokens := provisioner
+	if err == nil {
+		var annotations podAnnotations
+		var intermediate *ConstrainedIntermediate
+		var authority *CertificateAuthority
+		if annotations, err = parseAnnotations(pod.Annotations); err == nil {
+			intermediate, err = constrainedIntermediate(annotations, req.Namespace, config)
+		}
+		if err == nil {
+			authority, err = podCertificateAuthority(annotations, req.Namespace, config, intermediate)
+		}
+		switch {
+		case err != nil:
+		case intermediate != nil:
+			err = intermediate.checkNames(crt.Subject.CommonName, sans)
+			tokens = intermediate.tokens
+		case authority != nil:
+			tokens = authority.tokens
+		}
+	}
+	if err != nil {
+		ctxLog.WithField("error", err).Warn("Certificate re-issuance denied")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if freeze := issuanceFreeze.get(os.Getenv("NAMESPACE")); freeze.Issuance {
+		err := freeze.issuanceError()
+		ctxLog.WithField("error", err).Warn("Issuance frozen")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	token, err := mintToken(r.Context(), tokens, crt.Subject.CommonName, sans...)
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error generating token for re-issuance")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	ctxLog.Info("Issued token to re-issue certificate with new SANs")
+	recordIssuance(IssuanceRecord{
+		Namespace:  req.Namespace,
+		Event:      issuanceEventReissue,
+		Pod:        req.Pod,
+		CommonName: crt.Subject.CommonName,
+		SANs:       sans,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reissueResponse{
+		Token: token,
+		SANs:  sans,
+	}); err != nil {
+		ctxLog.WithField("error", err).Info("Write error")
+	}
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_certificateSANs(t *testing.T) {
+	crt := &x509.Certificate{
+		DNSNames:    []string{"Web.default.svc", "web"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")},
+		URIs:        []*url.URL{{Scheme: "spiffe", Host: "cluster.local", Path: "/ns/default/sa/web"}},
+	}
+	tests := []struct {
+		name  string
+		names []string
+		want  bool
+	}{
+		{"same", []string{"web", "web.default.svc", "10.0.0.1", "2001:db8::1", "spiffe://cluster.local/ns/default/sa/web"}, true},
+		{"different order and case", []string{"spiffe://cluster.local/ns/default/sa/web", "WEB.default.svc", "web", "2001:0db8:0:0:0:0:0:1", "10.0.0.1"}, true},
+		{"duplicates", []string{"web", "web", "web.default.svc", "10.0.0.1", "2001:db8::1", "spiffe://cluster.local/ns/default/sa/web"}, true},
+		{"new name", []string{"web", "web.default.svc", "api.default.svc", "10.0.0.1", "2001:db8::1", "spiffe://cluster.local/ns/default/sa/web"}, false},
+		{"removed name", []string{"web", "10.0.0.1", "2001:db8::1", "spiffe://cluster.local/ns/default/sa/web"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := slices.Equal(normalizeSANs(tt.names), certificateSANs(crt)); got != tt.want {
+				t.Errorf("normalizeSANs() = %v, certificateSANs() = %v, want equal %v", normalizeSANs(tt.names), certificateSANs(crt), tt.want)
+			}
+		})
+	}
+}
+
+func Test_reissueAllowed(t *testing.T) {
+	crt := &x509.Certificate{Subject: pkix.Name{CommonName: "web.default.svc"}}
+	pod := func(annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+	}
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want bool
+	}{
+		{"ok", pod(map[string]string{admissionWebhookAnnotationKey: "web.default.svc", admissionWebhookStatusKey: "injected"}), true},
+		{"other name", pod(map[string]string{admissionWebhookAnnotationKey: "api.default.svc", admissionWebhookStatusKey: "injected"}), false},
+		{"not injected", pod(map[string]string{admissionWebhookAnnotationKey: "web.default.svc"}), false},
+		{"no annotations", pod(nil), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reissueAllowed(crt, tt.pod); got != tt.want {
+				t.Errorf("reissueAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/ca"
+)
+
+const defaultReloadInterval = 10 * time.Second
+
+// Reload makes the controller apply the changes of its configuration file
+// and of the password files of its provisioners without a restart. The
+// files are mounted from a ConfigMap and a Secret, updated by the kubelet
+// when they change. Settings only read on startup, restartFields, keep their
+// value until the controller restarts.
+type Reload struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often the files are checked, defaults to 10s.
+	Interval string `yaml:"interval"`
+}
+
+// GetInterval returns how often the files are checked, defaults to 10s.
+func (r Reload) GetInterval() time.Duration {
+	d, err := time.ParseDuration(r.Interval)
+	if err != nil || d <= 0 {
+		return defaultReloadInterval
+	}
+	return d
+}
+
+// validateReload returns an error if the reload interval is not valid.
+func validateReload(c *Config) error {
+	if r := c.Reload.Interval; r != "" {
+		if d, err := time.ParseDuration(r); err != nil || d < time.Second {
+			return fmt.Errorf("reload.interval %q must be a duration of at least 1s", r)
+		}
+	}
+	return nil
+}
+
+// restartFields are the settings, by yaml key, only read when the controller
+// starts: the server, the CA and its clients, and the background tasks. The
+// provisioner settings are reloaded with the provisioner passwords.
+var restartFields = map[string]bool{
+	"address":                  true,
+	"service":                  true,
+	"logFormat":                true,
+	"caUrl":                    true,
+	"caService":                true,
+	"caFailoverURLs":           true,
+	"rootCAPath":               true,
+	"expiringSoon":             true,
+	"podExpiryMetrics":         true,
+	"airGapped":                true,
+	"buildVerification":        true,
+	"tokenBinding":             true,
+	"persistentQueue":          true,
+	"issuanceLog":              true,
+	"leakGuard":                true,
+	"loadShedding":             true,
+	"webhookReconciler":        true,
+	"devCA":                    true,
+	"secretIssuance":           true,
+	"knativeSecrets":           true,
+	"constrainedIntermediates": true,
+	"certificateAuthorities":   true,
+	"trustBundle":              true,
+	"serviceAccountAuth":       true,
+	"otlp":                     true,
+	"leaderElection":           true,
+	"reload":                   true,
+}
+
+// provisionerFields are the settings, by yaml key, of the provisioners of the
+// controller.
+var provisionerFields = []string{"provisionerName", "provisionerPasswordPath", "nextProvisioner"}
+
+var configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "autocert_config_reloads_total",
+	Help: "Number of reloads of the configuration or the provisioner passwords, by what was reloaded and result.",
+}, []string{"kind", "result"})
+
+func init() {
+	metricsRegistry.MustRegister(configReloads)
+}
+
+// WithConfigFile sets the file the configuration was loaded from, reloaded
+// when it changes if reload is enabled.
+func WithConfigFile(file string) Option {
+	return func(c *Controller) {
+		c.configFile = file
+	}
+}
+
+// liveConfig returns the configuration applied to the requests: the one
+// given to New, or the last one reloaded.
+func (c *Controller) liveConfig() *Config {
+	if config := c.reloaded.Load(); config != nil {
+		return config
+	}
+	return c.config
+}
+
+// mergeReload returns the configuration to apply on a reload: next, with the
+// settings only read on startup kept from current. It also returns the keys
+// of the ones that changed, to warn that they need a restart.
+func mergeReload(current, next *Config) (*Config, []string) {
+	merged := *next
+	cv, mv := reflect.ValueOf(current).Elem(), reflect.ValueOf(&merged).Elem()
+	var ignored []string
+	for i := range mv.NumField() {
+		key := yamlKey(mv.Type().Field(i))
+		if !restartFields[key] {
+			continue
+		}
+		if !reflect.DeepEqual(cv.Field(i).Interface(), mv.Field(i).Interface()) {
+			ignored = append(ignored, key)
+			mv.Field(i).Set(cv.Field(i))
+		}
+	}
+	return &merged, ignored
+}
+
+// provisionerChanged returns whether the provisioner settings differ.
+func provisionerChanged(current, next *Config) bool {
+	cv, nv := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	for i := range cv.NumField() {
+		key := yamlKey(cv.Type().Field(i))
+		if slices.Contains(provisionerFields, key) && !reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+			return true
+		}
+	}
+	return false
+}
+
+func yamlKey(f reflect.StructField) string {
+	key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	return key
+}
+
+// reloadableTokens mints the bootstrap tokens with the provisioner loaded
+// last, swapped when its password changes.
+type reloadableTokens struct {
+	provisioner atomic.Pointer[ca.Provisioner]
+}
+
+func (t *reloadableTokens) Token(subject string, sans ...string) (string, error) {
+	return t.provisioner.Load().Token(subject, sans...)
+}
+
+// reloader polls the configuration and password files of a controller.
+type reloader struct {
+	c *Controller
+	// digests of the files when last read, by path.
+	digests map[string][32]byte
+}
+
+// watchReload reloads the configuration and the provisioners when their
+// files change, until the context is canceled.
+func (c *Controller) watchReload(ctx context.Context) {
+	interval := c.config.Reload.GetInterval()
+	log.WithFields(log.Fields{
+		"file":     c.configFile,
+		"interval": interval,
+	}).Info("Watching the configuration for changes")
+
+	r := &reloader{c: c, digests: map[string][32]byte{}}
+	r.changed(c.watchedFiles())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.check()
+	}
+}
+
+// check reloads what changed since the last check.
+func (r *reloader) check() {
+	c := r.c
+	var reloadProvisioner bool
+	if r.changed([]string{c.configFile}) {
+		current := c.liveConfig()
+		next, err := c.reloadConfig()
+		if err == nil {
+			reloadProvisioner = provisionerChanged(current, next)
+		}
+	}
+	if r.changed(c.passwordFiles()) {
+		reloadProvisioner = true
+	}
+	if reloadProvisioner {
+		c.reloadProvisioner()
+	}
+}
+
+// changed returns whether any of the files changed since the last call.
+// Files that can't be read are left to the reload to report.
+func (r *reloader) changed(files []string) bool {
+	var changed bool
+	for _, file := range files {
+		data, err := os.ReadFile(file) //nolint:gosec // file path comes from trusted configuration
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if last, ok := r.digests[file]; !ok || last != sum {
+			changed = changed || ok
+			r.digests[file] = sum
+		}
+	}
+	return changed
+}
+
+// watchedFiles returns the configuration and password files.
+func (c *Controller) watchedFiles() []string {
+	return append([]string{c.configFile}, c.passwordFiles()...)
+}
+
+// passwordFiles returns the password files of the provisioners of the live
+// configuration, none if the controller doesn't mint tokens with them.
+func (c *Controller) passwordFiles() []string {
+	config := c.liveConfig()
+	if c.provisioner == nil || c.devCA != nil {
+		return nil
+	}
+	files := []string{config.GetProvisionerPasswordPath()}
+	if config.NextProvisioner.enabled() {
+		files = append(files, config.NextProvisioner.PasswordPath)
+	}
+	return files
+}
+
+// reloadConfig loads and validates the configuration file, and applies it.
+// An invalid configuration is reported and the current one kept.
+func (c *Controller) reloadConfig() (*Config, error) {
+	next, err := loadConfig(c.configFile)
+	if err != nil {
+		configReloads.WithLabelValues("config", "error").Inc()
+		log.WithFields(log.Fields{
+			"file":  c.configFile,
+			"error": err,
+		}).Error("Error reloading the configuration, keeping the current one")
+		return nil, err
+	}
+	merged, ignored := mergeReload(c.liveConfig(), next)
+	c.reloaded.Store(merged)
+	configReloads.WithLabelValues("config", "success").Inc()
+	ctxLog := log.WithField("file", c.configFile)
+	if len(ignored) > 0 {
+		ctxLog.WithField("settings", ignored).Warn("Changed settings are only applied when the controller restarts")
+	}
+	ctxLog.Info("Reloaded the configuration")
+	return merged, nil
+}
+
+// reloadProvisioner loads the provisioners of the live configuration, and
+// mints the tokens with them. On errors the current ones are kept.
+func (c *Controller) reloadProvisioner() {
+	if c.provisioner == nil {
+		return
+	}
+	provisioner, password, err := c.loadCredentials()
+	if err == nil && c.liveConfig().TokenBinding {
+		var signer *tokenSigner
+		if signer, err = newTokenSigner(c.currentCA(), provisioner, password); err == nil {
+			c.signer.Store(signer)
+		}
+	}
+	if err != nil {
+		configReloads.WithLabelValues("provisioner", "error").Inc()
+		log.WithField("error", errors.Wrap(err, "error reloading provisioner")).Error("Error reloading the provisioner, keeping the current one")
+		return
+	}
+	c.provisioner.provisioner.Store(provisioner)
+	configReloads.WithLabelValues("provisioner", "success").Inc()
+	log.WithFields(log.Fields{
+		"name": provisioner.Name(),
+		"kid":  provisioner.Kid(),
+	}).Info("Reloaded the provisioner")
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestValidateReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		r       Reload
+		wantErr bool
+	}{
+		{"not set", Reload{}, false},
+		{"ok", Reload{Enabled: true, Interval: "30s"}, false},
+		{"short interval", Reload{Interval: "100ms"}, true},
+		{"bad interval", Reload{Interval: "often"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateReload(&Config{Reload: tt.r}); (err != nil) != tt.wantErr {
+				t.Errorf("validateReload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMergeReload(t *testing.T) {
+	current := &Config{
+		Address:      ":4443",
+		CertLifetime: "24h",
+		OTLP:         OTLP{Enabled: true, Endpoint: "http://otel-collector:4318"},
+	}
+	next := &Config{
+		Address:      ":8443",
+		CertLifetime: "12h",
+		OTLP:         OTLP{Enabled: true, Endpoint: "http://otel-collector:4318"},
+		Features:     map[string]string{"keyTypes": "on"},
+	}
+	merged, ignored := mergeReload(current, next)
+	if !slices.Equal(ignored, []string{"address"}) {
+		t.Errorf("mergeReload() ignored %v, want [address]", ignored)
+	}
+	if merged.Address != ":4443" || merged.CertLifetime != "12h" || merged.Features["keyTypes"] != "on" {
+		t.Errorf("mergeReload() = %+v, want the new settings but the address", merged)
+	}
+	if next.Address != ":8443" {
+		t.Error("mergeReload() modified the loaded configuration")
+	}
+}
+
+func TestProvisionerChanged(t *testing.T) {
+	current := &Config{ProvisionerName: "autocert", CertLifetime: "24h"}
+	if provisionerChanged(current, &Config{ProvisionerName: "autocert", CertLifetime: "12h"}) {
+		t.Error("provisionerChanged() = true for another setting")
+	}
+	if !provisionerChanged(current, &Config{ProvisionerName: "autocert", NextProvisioner: NextProvisioner{Name: "autocert-2", Active: true}}) {
+		t.Error("provisionerChanged() = false with a next provisioner")
+	}
+}
+
+func TestReloader(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("address: :4443\ncertLifetime: 24h\n")
+	config, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(config, WithConfigFile(file))
+	r := &reloader{c: c, digests: map[string][32]byte{}}
+	r.changed(c.watchedFiles())
+
+	r.check()
+	if c.reloaded.Load() != nil {
+		t.Fatal("check() reloaded an unchanged configuration")
+	}
+
+	write("address: :8443\ncertLifetime: 12h\n")
+	r.check()
+	if got := c.liveConfig(); got.CertLifetime != "12h" || got.Address != ":4443" {
+		t.Errorf("liveConfig() = %+v, want certLifetime reloaded and the address kept", got)
+	}
+	if c.config.CertLifetime != "24h" {
+		t.Error("check() modified the startup configuration")
+	}
+
+	write("certLifetime: 6h\nsanCheck: sometimes\n")
+	r.check()
+	if got := c.liveConfig(); got.CertLifetime != "12h" {
+		t.Errorf("liveConfig() = %+v, want the last valid configuration", got)
+	}
+}
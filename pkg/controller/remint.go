@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// remintURLEnvVar is the URL bootstrappers get a new token from when
+	// their token expired before they ran.
+	remintURLEnvVar = "AUTOCERT_REMINT_URL"
+	// remintClaimEnvVar is the claim of the pod on new tokens.
+	remintClaimEnvVar = "AUTOCERT_REMINT_CLAIM"
+	// serviceAccountTokenEnvVar is the path of the service account token
+	// bootstrappers authenticate re-mint requests with.
+	serviceAccountTokenEnvVar = "AUTOCERT_SA_TOKEN"
+	// defaultRemintWindow is how long after admission tokens can be
+	// re-minted if not specified in the configuration.
+	defaultRemintWindow = 24 * time.Hour
+)
+
+// remintClaims holds the claims on new tokens of the pods admitted with
+// tokenRemint enabled. Unlike pending issuances, they can be redeemed until
+// they expire: a bootstrapper restarted before getting its certificate may
+// need another token.
+var remintClaims = newIssuanceStore()
+
+// TokenRemint configures the re-minting of the bootstrap tokens of pods that
+// ran after their token expired, like pods pending in a long scheduling
+// queue.
+type TokenRemint struct {
+	Enabled bool `yaml:"enabled"`
+	// Window is how long after admission a pod can get a new token.
+	Window string `yaml:"window"`
+}
+
+// GetWindow returns how long after admission a pod can get a new token,
+// defaults to 24h.
+func (t TokenRemint) GetWindow() time.Duration {
+	d, err := time.ParseDuration(t.Window)
+	if err != nil || d <= 0 {
+		return defaultRemintWindow
+	}
+	return d
+}
+
+// GetRemintURL returns the URL used by bootstrappers to get a new token.
+func (c Config) GetRemintURL() string {
+	return fmt.Sprintf("https://%s.%s.svc/remint", c.GetServiceName(), os.Getenv("NAMESPACE"))
+}
+
+// validateTokenRemint returns an error if the tokenRemint configuration is not
+// valid.
+func validateTokenRemint(c *Config) error {
+	if !c.TokenRemint.Enabled {
+		return nil
+	}
+	if v := envProtocolVersions[remintURLEnvVar]; c.GetProtocolVersion() < v {
+		return fmt.Errorf("tokenRemint requires protocolVersion %d or later", v)
+	}
+	if c.TokenRemint.Window != "" {
+		if d, err := time.ParseDuration(c.TokenRemint.Window); err != nil || d <= 0 {
+			return fmt.Errorf("tokenRemint.window %q is not a valid duration", c.TokenRemint.Window)
+		}
+	}
+	return nil
+}
+
+// addRemint registers the claim of a pod on new tokens, and configures its
+// bootstrapper to use it if its token expired.
+func addRemint(config *Config, b *corev1.Container, pod *corev1.Pod, commonName, namespace, intermediate, authority string, sans []string) error {
+	claim, err := remintClaims.add(pendingIssuance{
+		CommonName:     commonName,
+		SANs:           sans,
+		Namespace:      namespace,
+		Intermediate:   intermediate,
+		CA:             authority,
+		Expires:        time.Now().Add(config.TokenRemint.GetWindow()),
+		ServiceAccount: podServiceAccount(pod),
+		PodName:        pod.GetName(),
+		GenerateName:   pod.GetGenerateName(),
+	})
+	if err != nil {
+		return err
+	}
+
+	b.Env = setEnv(b.Env,
+		corev1.EnvVar{
+			Name:  remintURLEnvVar,
+			Value: config.GetRemintURL(),
+		},
+		corev1.EnvVar{
+			Name:  remintClaimEnvVar,
+			Value: claim,
+		},
+		corev1.EnvVar{
+			Name:  serviceAccountTokenEnvVar,
+			Value: tokenBindingMountPath + "/token",
+		})
+	mountTokenBinding(b)
+	return nil
+}
+
+// remintHandler generates a new bootstrap token for a pod whose token
+// expired. The pod authenticates with its service account token, and must
+// be the pod the claim was created for. The token is written in the response
+// body as plain text.
+func remintHandler(w http.ResponseWriter, r *http.Request, config *Config, provisioner TokenManager) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req tokenRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxClaimRequestSize)).Decode(&req); err != nil || req.Claim == "" {
+		log.Error("Bad Request: 400 (Invalid Claim)")
+		http.Error(w, "Bad Request (Invalid Claim)", http.StatusBadRequest)
+		return
+	}
+
+	p, ok := remintClaims.peek(req.Claim)
+	if !ok {
+		log.Error("Forbidden: 403 (Unknown or Expired Claim)")
+		http.Error(w, "Forbidden (Unknown or Expired Claim)", http.StatusForbidden)
+		return
+	}
+
+	ctxLog := log.WithFields(log.Fields{
+		"commonName": p.CommonName,
+		"namespace":  p.Namespace,
+	})
+
+	pod, err := tokenBinding.identify(r, p)
+	var berr *bindingError
+	if errors.As(err, &berr) {
+		logBindingDenied(p, err)
+		http.Error(w, "Forbidden ("+berr.reason+")", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error authenticating re-mint request")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var token string
+	tokens, err := issuerTokens(config, p, provisioner)
+	if err == nil {
+		token, err = mintToken(r.Context(), tokens, p.CommonName, p.SANs...)
+	}
+	if err != nil {
+		ctxLog.WithField("error", err).Error("Error re-minting token")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	ctxLog.WithFields(log.Fields{
+		"pod":    pod.Name,
+		"podUID": pod.UID,
+	}).Info("Re-minted expired bootstrap token")
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, token) //nolint:errcheck // write errors are unactionable
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateTokenRemint(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"disabled", Config{ProtocolVersion: 9}, false},
+		{"enabled", Config{TokenRemint: TokenRemint{Enabled: true}}, false},
+		{"window", Config{TokenRemint: TokenRemint{Enabled: true, Window: "2h"}}, false},
+		{"old protocol", Config{ProtocolVersion: 9, TokenRemint: TokenRemint{Enabled: true}}, true},
+		{"invalid window", Config{TokenRemint: TokenRemint{Enabled: true, Window: "tomorrow"}}, true},
+		{"negative window", Config{TokenRemint: TokenRemint{Enabled: true, Window: "-1h"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateTokenRemint(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateTokenRemint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddRemint(t *testing.T) {
+	defer func(s *issuanceStore) { remintClaims = s }(remintClaims)
+	remintClaims = newIssuanceStore()
+
+	config := &Config{TokenRemint: TokenRemint{Enabled: true, Window: "2h"}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "api-7d9f-"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "api"},
+	}
+	var b corev1.Container
+	if err := addRemint(config, &b, pod, "api.default.svc", "default", "", "", []string{"api.default.svc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{}
+	for _, e := range b.Env {
+		env[e.Name] = e.Value
+	}
+	if env[remintURLEnvVar] == "" || env[serviceAccountTokenEnvVar] != tokenBindingMountPath+"/token" {
+		t.Errorf("addRemint() env = %v", b.Env)
+	}
+	if len(b.VolumeMounts) != 1 || b.VolumeMounts[0].Name != tokenBindingVolume {
+		t.Errorf("addRemint() volumeMounts = %v", b.VolumeMounts)
+	}
+	p, ok := remintClaims.peek(env[remintClaimEnvVar])
+	if !ok {
+		t.Fatal("addRemint() did not register the claim")
+	}
+	if p.ServiceAccount != "api" || p.GenerateName != "api-7d9f-" {
+		t.Errorf("addRemint() claim = %+v", p)
+	}
+	if d := time.Until(p.Expires); d < time.Hour || d > 2*time.Hour {
+		t.Errorf("addRemint() claim expires in %s, want 2h", d)
+	}
+}
+
+func TestRemintHandlerDenied(t *testing.T) {
+	defer func(s *issuanceStore, b *tokenBinder) {
+		remintClaims, tokenBinding = s, b
+	}(remintClaims, tokenBinding)
+	remintClaims = newIssuanceStore()
+	tokenBinding = &tokenBinder{
+		review: func(token string) (*authenticationv1.UserInfo, error) {
+			return boundUser("api", token, "uid-1"), nil
+		},
+	}
+	claim, err := remintClaims.add(pendingIssuance{
+		CommonName:     "api.default.svc",
+		Namespace:      "default",
+		ServiceAccount: "api",
+		PodName:        "api-0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		claim  string
+		bearer string
+		want   int
+	}{
+		{"get", http.MethodGet, claim, "api-0", http.StatusMethodNotAllowed},
+		{"missing claim", http.MethodPost, "", "api-0", http.StatusBadRequest},
+		{"unknown claim", http.MethodPost, "unknown", "api-0", http.StatusForbidden},
+		{"missing token", http.MethodPost, claim, "", http.StatusForbidden},
+		{"other pod", http.MethodPost, claim, "api-1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/remint", strings.NewReader(`{"claim":"`+tt.claim+`"}`))
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			remintHandler(w, r, &Config{}, nil)
+			if w.Code != tt.want {
+				t.Errorf("remintHandler() = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	// Denied requests don't use the claim.
+	if _, ok := remintClaims.peek(claim); !ok {
+		t.Error("remintHandler() removed the claim")
+	}
+}
@@ -0,0 +1,201 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// renewalSignalAnnotationKey makes the renewer signal the application
+	// after every renewal, through a process namespace shared by the
+	// containers of the pod.
+	renewalSignalAnnotationKey = "autocert.step.sm/renewal-signal"
+	// renewalProcessAnnotationKey is the name of the process signaled,
+	// defaults to the command of the application container.
+	renewalProcessAnnotationKey = "autocert.step.sm/renewal-process"
+	// renewalExecAnnotationKey makes the renewer run a command in the
+	// application container after every renewal, with the pod exec API.
+	renewalExecAnnotationKey = "autocert.step.sm/renewal-exec"
+	// renewalContainerAnnotationKey is the container signaled or running the
+	// command, defaults to the first one.
+	renewalContainerAnnotationKey = "autocert.step.sm/renewal-container"
+
+	renewalSignalEnvVar    = "RENEWAL_SIGNAL"
+	renewalProcessEnvVar   = "RENEWAL_PROCESS"
+	renewalExecEnvVar      = "RENEWAL_EXEC"
+	renewalContainerEnvVar = "RENEWAL_CONTAINER"
+	// renewalPodEnvVar is the name of the pod, from the downward API: the
+	// name in the admission request is the generateName of the pods of
+	// workloads.
+	renewalPodEnvVar = "RENEWAL_POD"
+
+	// serviceAccountMountPath is where the service account token of the pod
+	// is mounted, used by the renewer to call the exec API.
+	serviceAccountMountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// renewalSignals are the signals the renewer can send to the application.
+var renewalSignals = []string{"SIGHUP", "SIGINT", "SIGQUIT", "SIGTERM", "SIGUSR1", "SIGUSR2", "SIGWINCH"}
+
+// renewalHook is how the renewer notifies the application of a renewal:
+// with a signal to the processes named Process, or by running Exec in
+// Container.
+type renewalHook struct {
+	Signal    string
+	Process   string
+	Exec      string
+	Container string
+	// tokenMount is the mount of the service account token of Container,
+	// added to the renewer to call the exec API.
+	tokenMount *corev1.VolumeMount
+}
+
+// podRenewalHook returns the renewal hook of a pod, or nil if it has none.
+// It returns an error if the pod has no renewer writing its certificate, or
+// if the hook can't run: the application would keep serving the old
+// certificate.
+func podRenewalHook(pod *corev1.Pod, annotations podAnnotations, config *Config) (*renewalHook, error) {
+	if annotations.RenewalSignal == "" && annotations.RenewalExec == "" {
+		return nil, nil
+	}
+	key, value := renewalSignalAnnotationKey, annotations.RenewalSignal
+	if value == "" {
+		key, value = renewalExecAnnotationKey, annotations.RenewalExec
+	}
+	fail := func(reason string) (*renewalHook, error) {
+		return nil, annotationErrors{{Key: key, Value: value, Reason: reason}}
+	}
+	switch {
+	case annotations.RenewalSignal != "" && annotations.RenewalExec != "":
+		return fail("the pod is also annotated with " + renewalExecAnnotationKey + ", use one of them")
+	case annotations.BootstrapperOnly:
+		return fail("the pod has no renewer, it's annotated with " + bootstrapperOnlyAnnotationKey)
+	case annotations.ExternalSecret != "":
+		return fail("the certificate is not renewed by autocert, the pod is annotated with " + externalSecretAnnotationKey)
+	case annotations.Secret != "":
+		return fail("the certificate is mounted from a Secret, the pod is annotated with " + secretAnnotationKey)
+	case config.GetProtocolVersion() < envProtocolVersions[renewalSignalEnvVar]:
+		return fail(fmt.Sprintf("requires protocol version %d, but version %d is pinned in the configuration", envProtocolVersions[renewalSignalEnvVar], config.GetProtocolVersion()))
+	case len(pod.Spec.Containers) == 0:
+		return fail("the pod has no containers")
+	}
+
+	target := &pod.Spec.Containers[0]
+	if name := annotations.RenewalContainer; name != "" {
+		i := slices.IndexFunc(pod.Spec.Containers, func(c corev1.Container) bool { return c.Name == name })
+		if i < 0 {
+			return nil, annotationErrors{{
+				Key:    renewalContainerAnnotationKey,
+				Value:  name,
+				Reason: "the pod has no container with this name",
+			}}
+		}
+		target = &pod.Spec.Containers[i]
+	}
+
+	hook := &renewalHook{Container: target.Name}
+	if annotations.RenewalSignal != "" {
+		hook.Signal = annotations.RenewalSignal
+		hook.Process = annotations.RenewalProcess
+		if hook.Process == "" && len(target.Command) > 0 {
+			hook.Process = path.Base(target.Command[0])
+		}
+		if hook.Process == "" {
+			return fail(fmt.Sprintf("the command of container %s is set by its image, annotate the pod with %s", target.Name, renewalProcessAnnotationKey))
+		}
+		return hook, nil
+	}
+
+	// The service account token is mounted in the application containers
+	// before the webhook is called, unless automountServiceAccountToken is
+	// disabled.
+	hook.Exec = annotations.RenewalExec
+	for _, m := range target.VolumeMounts {
+		if m.MountPath == serviceAccountMountPath {
+			hook.tokenMount = m.DeepCopy()
+			break
+		}
+	}
+	if hook.tokenMount == nil {
+		return fail(fmt.Sprintf("container %s doesn't mount a service account token, the renewer needs one to exec into it", target.Name))
+	}
+	return hook, nil
+}
+
+// setRenewalHook configures the renewer to run the hook after every
+// renewal.
+func setRenewalHook(hook *renewalHook, renewer *corev1.Container) {
+	if hook.Signal != "" {
+		renewer.Env = setEnv(renewer.Env,
+			corev1.EnvVar{Name: renewalSignalEnvVar, Value: hook.Signal},
+			corev1.EnvVar{Name: renewalProcessEnvVar, Value: hook.Process},
+		)
+		return
+	}
+	renewer.Env = setEnv(renewer.Env,
+		corev1.EnvVar{Name: renewalExecEnvVar, Value: hook.Exec},
+		corev1.EnvVar{Name: renewalContainerEnvVar, Value: hook.Container},
+		corev1.EnvVar{Name: renewalPodEnvVar, ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+		}},
+	)
+	mount := *hook.tokenMount
+	mount.ReadOnly = true
+	renewer.VolumeMounts = append(renewer.VolumeMounts, mount)
+}
+
+// shareProcessNamespace returns the operation sharing the process namespace
+// of the pod, so the renewer sees the processes of the application.
+func shareProcessNamespace(pod *corev1.Pod) []PatchOperation {
+	if pod.Spec.ShareProcessNamespace != nil && *pod.Spec.ShareProcessNamespace {
+		return nil
+	}
+	return []PatchOperation{{
+		Op:    "add",
+		Path:  "/spec/shareProcessNamespace",
+		Value: true,
+	}}
+}
+
+// normalizeSignal returns the name of a signal with the SIG prefix, in upper
+// case, like SIGHUP for hup.
+func normalizeSignal(v string) string {
+	v = strings.ToUpper(v)
+	if v != "" && !strings.HasPrefix(v, "SIG") {
+		v = "SIG" + v
+	}
+	return v
+}
+
+func checkSignal(v string) string {
+	if !slices.Contains(renewalSignals, normalizeSignal(v)) {
+		return "is not a supported signal"
+	}
+	return ""
+}
+
+func checkProcessName(v string) string {
+	if v == "" || strings.ContainsAny(v, "/ \t\r\n") {
+		return "is not a process name"
+	}
+	return ""
+}
+
+func checkCommand(v string) string {
+	if len(strings.Fields(v)) == 0 {
+		return "is empty"
+	}
+	return ""
+}
+
+func checkContainerName(v string) string {
+	if len(validation.IsDNS1123Label(v)) > 0 {
+		return "is not a valid container name"
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodRenewalHook(t *testing.T) {
+	tokenMount := corev1.VolumeMount{Name: "kube-api-access-x7k2p", MountPath: serviceAccountMountPath, ReadOnly: true}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		{Name: "nginx", Command: []string{"/usr/sbin/nginx", "-g", "daemon off;"}, VolumeMounts: []corev1.VolumeMount{tokenMount}},
+		{Name: "exporter"},
+	}}}
+	tests := []struct {
+		name        string
+		annotations podAnnotations
+		config      *Config
+		want        *renewalHook
+		wantKey     string
+	}{
+		{"none", podAnnotations{}, &Config{}, nil, ""},
+		{"signal", podAnnotations{RenewalSignal: "SIGHUP"}, &Config{}, &renewalHook{Signal: "SIGHUP", Process: "nginx", Container: "nginx"}, ""},
+		{"signal process", podAnnotations{RenewalSignal: "SIGUSR1", RenewalProcess: "envoy"}, &Config{}, &renewalHook{Signal: "SIGUSR1", Process: "envoy", Container: "nginx"}, ""},
+		{"signal image command", podAnnotations{RenewalSignal: "SIGHUP", RenewalContainer: "exporter"}, &Config{}, nil, renewalSignalAnnotationKey},
+		{"exec", podAnnotations{RenewalExec: "nginx -s reload"}, &Config{}, &renewalHook{Exec: "nginx -s reload", Container: "nginx", tokenMount: &tokenMount}, ""},
+		{"exec without token", podAnnotations{RenewalExec: "reload", RenewalContainer: "exporter"}, &Config{}, nil, renewalExecAnnotationKey},
+		{"unknown container", podAnnotations{RenewalExec: "nginx -s reload", RenewalContainer: "app"}, &Config{}, nil, renewalContainerAnnotationKey},
+		{"signal and exec", podAnnotations{RenewalSignal: "SIGHUP", RenewalExec: "nginx -s reload"}, &Config{}, nil, renewalSignalAnnotationKey},
+		{"bootstrapper only", podAnnotations{RenewalSignal: "SIGHUP", BootstrapperOnly: true}, &Config{}, nil, renewalSignalAnnotationKey},
+		{"external secret", podAnnotations{RenewalExec: "nginx -s reload", ExternalSecret: "legacy-tls"}, &Config{}, nil, renewalExecAnnotationKey},
+		{"managed secret", podAnnotations{RenewalSignal: "SIGHUP", Secret: "nginx-tls"}, &Config{}, nil, renewalSignalAnnotationKey},
+		{"pinned protocol", podAnnotations{RenewalSignal: "SIGHUP"}, &Config{ProtocolVersion: 22}, nil, renewalSignalAnnotationKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := podRenewalHook(pod, tt.annotations, tt.config)
+			if tt.wantKey != "" {
+				var errs annotationErrors
+				if !errors.As(err, &errs) || errs[0].Key != tt.wantKey {
+					t.Fatalf("podRenewalHook() error = %v, want an error for %s", err, tt.wantKey)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("podRenewalHook() error = %v", err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) || (got != nil && (got.tokenMount == nil) != (tt.want.tokenMount == nil)) {
+				t.Errorf("podRenewalHook() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenewalHookPatch(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	tokenSecrets = &fakeSecrets{}
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := devCACertificate("Test Root", time.Now(), key, nil, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootFile := filepath.Join(t.TempDir(), "root.crt")
+	if err := os.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		CaURL:        "https://ca",
+		RootCAPath:   rootFile,
+		CertsVolume:  corev1.Volume{Name: "certs"},
+		Bootstrapper: corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper"},
+		Renewer:      corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+	}
+
+	patchPod := func(annotations map[string]string) (renewer corev1.Container, shared bool) {
+		t.Helper()
+		annotations[admissionWebhookAnnotationKey] = "web.default.svc"
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{GenerateName: "web-7d9c5b7d4-", Annotations: annotations},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:         "web",
+				Command:      []string{"nginx"},
+				VolumeMounts: []corev1.VolumeMount{{Name: "kube-api-access-x7k2p", MountPath: serviceAccountMountPath, ReadOnly: true}},
+			}}},
+		}
+		b, err := patch(context.Background(), pod, "default", config, fakeTokens{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ops []struct {
+			Path  string          `json:"path"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(b, &ops); err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range ops {
+			switch op.Path {
+			case "/spec/shareProcessNamespace":
+				shared = string(op.Value) == "true"
+			case "/spec/containers/-":
+				if err := json.Unmarshal(op.Value, &renewer); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return renewer, shared
+	}
+	env := func(c corev1.Container, name string) *corev1.EnvVar {
+		for i := range c.Env {
+			if c.Env[i].Name == name {
+				return &c.Env[i]
+			}
+		}
+		return nil
+	}
+
+	renewer, shared := patchPod(map[string]string{renewalSignalAnnotationKey: "hup"})
+	if !shared {
+		t.Error("patch() didn't share the process namespace")
+	}
+	if e := env(renewer, renewalSignalEnvVar); e == nil || e.Value != "SIGHUP" {
+		t.Errorf("%s = %v, want SIGHUP", renewalSignalEnvVar, e)
+	}
+	if e := env(renewer, renewalProcessEnvVar); e == nil || e.Value != "nginx" {
+		t.Errorf("%s = %v, want nginx", renewalProcessEnvVar, e)
+	}
+
+	renewer, shared = patchPod(map[string]string{renewalExecAnnotationKey: "nginx -s reload"})
+	if shared {
+		t.Error("patch() shared the process namespace of an exec hook")
+	}
+	if e := env(renewer, renewalPodEnvVar); e == nil || e.ValueFrom == nil || e.ValueFrom.FieldRef.FieldPath != "metadata.name" {
+		t.Errorf("%s = %v, want the pod name from the downward API", renewalPodEnvVar, e)
+	}
+	if e := env(renewer, renewalContainerEnvVar); e == nil || e.Value != "web" {
+		t.Errorf("%s = %v, want web", renewalContainerEnvVar, e)
+	}
+	var mounted bool
+	for _, m := range renewer.VolumeMounts {
+		mounted = mounted || (m.Name == "kube-api-access-x7k2p" && m.MountPath == serviceAccountMountPath && m.ReadOnly)
+	}
+	if !mounted {
+		t.Errorf("renewer mounts = %v, want the service account token", renewer.VolumeMounts)
+	}
+}
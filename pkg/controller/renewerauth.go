@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// renewerAuthProtocolVersion is the first protocol version whose renewers
+// send the service account token set in AUTOCERT_SA_TOKEN.
+const renewerAuthProtocolVersion = 12
+
+// RenewerAuth configures the authentication of the renewers on the
+// controller endpoints they call, /status and /reissue. Renewers always
+// present their certificate, but any pod with a certificate for the same name
+// could act on behalf of another one. With BindToken, renewers also present a
+// service account token bound to their pod, reviewed by the API server, and
+// may only report on or re-issue the certificate of their own pod.
+type RenewerAuth struct {
+	BindToken bool `yaml:"bindToken"`
+}
+
+// validateRenewerAuth returns an error if the renewers configured with the
+// protocol version in use don't send their service account token.
+func validateRenewerAuth(c *Config) error {
+	if c.RenewerAuth.BindToken && c.GetProtocolVersion() < renewerAuthProtocolVersion {
+		return fmt.Errorf("renewerAuth.bindToken requires protocolVersion %d or later", renewerAuthProtocolVersion)
+	}
+	return nil
+}
+
+// addRenewerAuth mounts the service account token of the pod in the renewer.
+// The token volume is the one projected for token binding.
+func addRenewerAuth(r *corev1.Container) {
+	r.Env = setEnv(r.Env, corev1.EnvVar{
+		Name:  serviceAccountTokenEnvVar,
+		Value: tokenBindingMountPath + "/token",
+	})
+	mountTokenBinding(r)
+}
+
+// authorizeRenewer returns the pod of the renewer making the request, when
+// renewers bind their requests with a service account token. It returns a
+// *bindingError if the token is missing or not bound to the given pod, and an
+// empty pod if tokens are not required.
+func authorizeRenewer(r *http.Request, config *Config, namespace, pod string) (boundPod, error) {
+	if !config.RenewerAuth.BindToken {
+		return boundPod{}, nil
+	}
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || bearer == "" {
+		return boundPod{}, &bindingError{"missing service account token"}
+	}
+	user, err := tokenBinding.review(bearer)
+	if err != nil {
+		return boundPod{}, errors.Wrap(err, "review service account token")
+	}
+	return bindRenewer(user, namespace, pod)
+}
+
+// bindRenewer returns the pod of an authenticated service account user, if
+// it's the given pod.
+func bindRenewer(user *authenticationv1.UserInfo, namespace, pod string) (boundPod, error) {
+	if user == nil {
+		return boundPod{}, &bindingError{"invalid service account token"}
+	}
+	if !strings.HasPrefix(user.Username, "system:serviceaccount:"+namespace+":") {
+		return boundPod{}, &bindingError{fmt.Sprintf("service account %s is not in namespace %s", user.Username, namespace)}
+	}
+	p := boundPod{
+		Name:     extraValue(user.Extra[podNameExtraKey]),
+		UID:      extraValue(user.Extra[podUIDExtraKey]),
+		NodeName: extraValue(user.Extra[nodeNameExtraKey]),
+	}
+	if p.Name == "" || p.UID == "" {
+		return boundPod{}, &bindingError{"service account token is not bound to a pod"}
+	}
+	if p.Name != pod {
+		return boundPod{}, &bindingError{fmt.Sprintf("service account token is bound to pod %s, not %s", p.Name, pod)}
+	}
+	return p, nil
+}
+
+// renewerAuthError writes the response to a renewer request that failed
+// authorization.
+func renewerAuthError(w http.ResponseWriter, r *http.Request, namespace, pod string, err error) {
+	var berr *bindingError
+	if errors.As(err, &berr) {
+		log.WithFields(log.Fields{
+			"audit":     true,
+			"path":      r.URL.Path,
+			"namespace": namespace,
+			"pod":       pod,
+			"error":     err,
+		}).Warn("Denied renewer request")
+		http.Error(w, "Forbidden ("+berr.reason+")", http.StatusForbidden)
+		return
+	}
+	log.WithFields(log.Fields{
+		"path":  r.URL.Path,
+		"error": err,
+	}).Error("Error authenticating renewer request")
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+func TestBindRenewer(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    *authenticationv1.UserInfo
+		want    boundPod
+		wantErr bool
+	}{
+		{"own pod", boundUser("api", "api-0", "uid-1"), boundPod{UID: "uid-1", Name: "api-0", NodeName: "node-1"}, false},
+		{"other pod", boundUser("api", "api-1", "uid-2"), boundPod{}, true},
+		{"other namespace", &authenticationv1.UserInfo{
+			Username: "system:serviceaccount:other:api",
+			Extra:    map[string]authenticationv1.ExtraValue{podNameExtraKey: {"api-0"}, podUIDExtraKey: {"uid-1"}},
+		}, boundPod{}, true},
+		{"unbound token", boundUser("api", "api-0", ""), boundPod{}, true},
+		{"invalid token", nil, boundPod{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bindRenewer(tt.user, "default", "api-0")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bindRenewer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("bindRenewer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportHandlerBindToken(t *testing.T) {
+	defer func(b *tokenBinder) { tokenBinding = b }(tokenBinding)
+	tokenBinding = &tokenBinder{
+		review: func(token string) (*authenticationv1.UserInfo, error) {
+			return boundUser("api", token, "uid-1"), nil
+		},
+	}
+	config := &Config{RenewerAuth: RenewerAuth{BindToken: true}}
+	crt := &x509.Certificate{SerialNumber: big.NewInt(42)}
+
+	send := func(bearer string) int {
+		t.Helper()
+		body := `{"namespace":"default","pod":"api-0","status":{"state":"waiting","serial":"42"}}`
+		r := httptest.NewRequest(http.MethodPost, "/status", strings.NewReader(body))
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{crt}}
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		reportHandler(w, r, config)
+		return w.Code
+	}
+
+	if code := send(""); code != http.StatusForbidden {
+		t.Errorf("reportHandler() without a token = %d, want %d", code, http.StatusForbidden)
+	}
+	// A certificate for the same name doesn't let another pod report.
+	if code := send("api-1"); code != http.StatusForbidden {
+		t.Errorf("reportHandler() from another pod = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := send("api-0"); code != http.StatusNoContent {
+		t.Errorf("reportHandler() = %d, want %d", code, http.StatusNoContent)
+	}
+}
+
+func TestValidateRenewerAuth(t *testing.T) {
+	if err := validateRenewerAuth(&Config{RenewerAuth: RenewerAuth{BindToken: true}}); err != nil {
+		t.Errorf("validateRenewerAuth() error = %v", err)
+	}
+	if err := validateRenewerAuth(&Config{RenewerAuth: RenewerAuth{BindToken: true}, ProtocolVersion: 11}); err == nil {
+		t.Error("validateRenewerAuth() with protocol version 11 succeeded")
+	}
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// metricsAddrEnvVar is the address the renewer serves its Prometheus
+	// metrics on.
+	metricsAddrEnvVar = "METRICS_ADDR"
+	// renewerMetricsPortName is the name of the port of the renewer metrics,
+	// to select it in a PodMonitor.
+	renewerMetricsPortName = "autocert-metrics"
+	// defaultRenewerMetricsPort is the default port of the renewer metrics.
+	defaultRenewerMetricsPort = 9798
+)
+
+// RenewerMetrics configures the Prometheus metrics served by the renewers.
+type RenewerMetrics struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"`
+}
+
+// GetPort returns the port of the renewer metrics, defaults to 9798.
+func (m RenewerMetrics) GetPort() int {
+	if m.Port != 0 {
+		return m.Port
+	}
+	return defaultRenewerMetricsPort
+}
+
+// validateRenewerMetrics returns an error if the renewer metrics port is not
+// valid, or the metrics are not supported by the protocol version in use.
+func validateRenewerMetrics(c *Config) error {
+	if !c.RenewerMetrics.Enabled {
+		return nil
+	}
+	if v := envProtocolVersions[metricsAddrEnvVar]; c.GetProtocolVersion() < v {
+		return fmt.Errorf("renewerMetrics requires protocolVersion %d or later", v)
+	}
+	if p := c.RenewerMetrics.Port; p < 0 || p > 65535 {
+		return fmt.Errorf("renewerMetrics.port %d is not a valid port", p)
+	}
+	return nil
+}
+
+// setRenewerMetrics configures the renewer to serve its metrics if they're
+// enabled, unless a container of the pod already uses the port.
+func setRenewerMetrics(config *Config, renewer *corev1.Container, pod *corev1.Pod, namespace string) {
+	if !config.RenewerMetrics.Enabled {
+		return
+	}
+	port := int32(config.RenewerMetrics.GetPort()) //nolint:gosec // validated port
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		for _, p := range c.Ports {
+			if p.ContainerPort == port || p.HostPort == port {
+				log.WithFields(log.Fields{
+					"namespace": namespace,
+					"container": c.Name,
+					"port":      port,
+				}).Warn("Renewer metrics port used by the pod, not serving renewer metrics")
+				return
+			}
+		}
+	}
+	renewer.Env = setEnv(renewer.Env, corev1.EnvVar{
+		Name:  metricsAddrEnvVar,
+		Value: ":" + strconv.Itoa(int(port)),
+	})
+	renewer.Ports = append(renewer.Ports, corev1.ContainerPort{
+		Name:          renewerMetricsPortName,
+		ContainerPort: port,
+		Protocol:      corev1.ProtocolTCP,
+	})
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidateRenewerMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"disabled", Config{ProtocolVersion: 16, RenewerMetrics: RenewerMetrics{Port: -1}}, false},
+		{"enabled", Config{RenewerMetrics: RenewerMetrics{Enabled: true}}, false},
+		{"port", Config{RenewerMetrics: RenewerMetrics{Enabled: true, Port: 9100}}, false},
+		{"invalid port", Config{RenewerMetrics: RenewerMetrics{Enabled: true, Port: 70000}}, true},
+		{"old protocol", Config{ProtocolVersion: 16, RenewerMetrics: RenewerMetrics{Enabled: true}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateRenewerMetrics(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateRenewerMetrics() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetRenewerMetrics(t *testing.T) {
+	config := &Config{RenewerMetrics: RenewerMetrics{Enabled: true}}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+		Name:  "api",
+		Ports: []corev1.ContainerPort{{ContainerPort: 8443}},
+	}}}}
+
+	var renewer corev1.Container
+	setRenewerMetrics(config, &renewer, pod, "default")
+	if len(renewer.Env) != 1 || renewer.Env[0].Name != metricsAddrEnvVar || renewer.Env[0].Value != ":9798" {
+		t.Errorf("env = %v, want %s=:9798", renewer.Env, metricsAddrEnvVar)
+	}
+	if len(renewer.Ports) != 1 || renewer.Ports[0].Name != renewerMetricsPortName || renewer.Ports[0].ContainerPort != 9798 {
+		t.Errorf("ports = %v, want the metrics port", renewer.Ports)
+	}
+
+	// The port of the application wins.
+	config.RenewerMetrics.Port = 8443
+	renewer = corev1.Container{}
+	setRenewerMetrics(config, &renewer, pod, "default")
+	if len(renewer.Env) != 0 || len(renewer.Ports) != 0 {
+		t.Errorf("renewer = %+v, want no metrics on a port used by the pod", renewer)
+	}
+
+	config.RenewerMetrics = RenewerMetrics{}
+	setRenewerMetrics(config, &renewer, pod, "default")
+	if len(renewer.Env) != 0 || len(renewer.Ports) != 0 {
+		t.Errorf("renewer = %+v, want no metrics when disabled", renewer)
+	}
+}
@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Renewer resources modes.
+const (
+	// renewerResourcesOff uses the requests of the renewer template.
+	renewerResourcesOff = "off"
+	// renewerResourcesRecommend computes recommendations without applying
+	// them.
+	renewerResourcesRecommend = "recommend"
+	// renewerResourcesAuto sets the requests of injected renewers to the
+	// recommendation for their namespace.
+	renewerResourcesAuto = "auto"
+)
+
+const (
+	// defaultMinSamples is the number of reporting renewers a namespace needs
+	// before its recommendation is applied.
+	defaultMinSamples = 3
+	// minUsageUptime is the uptime under which a renewer usage is ignored, as
+	// the start up dominates it.
+	minUsageUptime = 10 * time.Minute
+	// resourcesHeadroom is the margin added to the observed usage.
+	resourcesHeadroom = 1.3
+	// minRecommendedMilliCPU and minRecommendedMemory are the lowest
+	// recommended requests.
+	minRecommendedMilliCPU = 1
+	minRecommendedMemory   = 8 << 20
+)
+
+// RenewerResources configures the recommender sizing the requests of the
+// renewer sidecars from their observed usage, instead of the cluster-wide
+// requests of the renewer template.
+type RenewerResources struct {
+	// Mode is off, recommend or auto.
+	Mode string `yaml:"mode"`
+	// MinSamples is the number of reporting renewers a namespace needs
+	// before its recommendation is applied, defaults to 3.
+	MinSamples int `yaml:"minSamples"`
+}
+
+// GetMode returns the renewer resources mode, defaults to off.
+func (r RenewerResources) GetMode() string {
+	if r.Mode == "" {
+		return renewerResourcesOff
+	}
+	return r.Mode
+}
+
+// GetMinSamples returns the number of reporting renewers a namespace needs
+// before its recommendation is applied, defaults to 3.
+func (r RenewerResources) GetMinSamples() int {
+	if r.MinSamples <= 0 {
+		return defaultMinSamples
+	}
+	return r.MinSamples
+}
+
+// validateRenewerResources returns an error if the renewer resources
+// configuration is invalid.
+func validateRenewerResources(c *Config) error {
+	switch c.RenewerResources.GetMode() {
+	case renewerResourcesOff:
+		return nil
+	case renewerResourcesRecommend, renewerResourcesAuto:
+		// Usage is sent in the renewer reports.
+		if v := envProtocolVersions["AUTOCERT_STATUS_URL"]; c.GetProtocolVersion() < v {
+			return fmt.Errorf("renewerResources requires protocolVersion %d or later", v)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid renewerResources mode %q, it must be off, recommend or auto", c.RenewerResources.Mode)
+	}
+}
+
+// renewerUsage is the resource usage of a renewer process, sent in its
+// reports.
+type renewerUsage struct {
+	CPUSeconds    float64 `json:"cpuSeconds"`
+	MaxRSSBytes   int64   `json:"maxRSSBytes"`
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+}
+
+// ResourcesRecommendation are the recommended requests for the renewers of a
+// namespace.
+type ResourcesRecommendation struct {
+	Namespace string `json:"namespace"`
+	// Samples is the number of renewers the recommendation is based on.
+	Samples     int   `json:"samples"`
+	MilliCPU    int64 `json:"milliCPU"`
+	MemoryBytes int64 `json:"memoryBytes"`
+}
+
+// recommendations returns the recommended renewer requests of every
+// namespace with reported usage, sorted by namespace. Recommendations cover
+// the highest average CPU and peak memory of the renewers of the namespace,
+// with some headroom.
+func (s *reportStore) recommendations() []ResourcesRecommendation {
+	s.Lock()
+	defer s.Unlock()
+
+	byNamespace := make(map[string]*ResourcesRecommendation)
+	for _, r := range s.reports {
+		u := r.Usage
+		if u == nil || u.UptimeSeconds < minUsageUptime.Seconds() {
+			continue
+		}
+		rec, ok := byNamespace[r.Namespace]
+		if !ok {
+			rec = &ResourcesRecommendation{
+				Namespace:   r.Namespace,
+				MilliCPU:    minRecommendedMilliCPU,
+				MemoryBytes: minRecommendedMemory,
+			}
+			byNamespace[r.Namespace] = rec
+		}
+		rec.Samples++
+		rec.MilliCPU = max(rec.MilliCPU, int64(math.Ceil(1000*resourcesHeadroom*u.CPUSeconds/u.UptimeSeconds)))
+		rec.MemoryBytes = max(rec.MemoryBytes, roundUpMiB(int64(resourcesHeadroom*float64(u.MaxRSSBytes))))
+	}
+
+	recs := make([]ResourcesRecommendation, 0, len(byNamespace))
+	for _, rec := range byNamespace {
+		recs = append(recs, *rec)
+	}
+	slices.SortFunc(recs, func(a, b ResourcesRecommendation) int {
+		return strings.Compare(a.Namespace, b.Namespace)
+	})
+	return recs
+}
+
+// recommendation returns the recommendation for the given namespace, and
+// whether it's based on enough samples to be applied.
+func (s *reportStore) recommendation(namespace string, minSamples int) (ResourcesRecommendation, bool) {
+	for _, rec := range s.recommendations() {
+		if rec.Namespace == namespace {
+			return rec, rec.Samples >= minSamples
+		}
+	}
+	return ResourcesRecommendation{}, false
+}
+
+func roundUpMiB(n int64) int64 {
+	const mib = 1 << 20
+	return (n + mib - 1) / mib * mib
+}
+
+// applyRecommendation sets the requests of a renewer to the recommendation
+// for its namespace, in auto mode. Requests are capped by the limits of the
+// template, so the pod stays valid.
+func applyRecommendation(config *Config, r *corev1.Container, namespace string) {
+	if config.RenewerResources.GetMode() != renewerResourcesAuto {
+		return
+	}
+	rec, ok := renewerReports.recommendation(namespace, config.RenewerResources.GetMinSamples())
+	if !ok {
+		return
+	}
+
+	cpu := resource.NewMilliQuantity(rec.MilliCPU, resource.DecimalSI)
+	if limit, ok := r.Resources.Limits[corev1.ResourceCPU]; ok && cpu.Cmp(limit) > 0 {
+		cpu = &limit
+	}
+	memory := resource.NewQuantity(rec.MemoryBytes, resource.BinarySI)
+	if limit, ok := r.Resources.Limits[corev1.ResourceMemory]; ok && memory.Cmp(limit) > 0 {
+		memory = &limit
+	}
+
+	requests := make(corev1.ResourceList, len(r.Resources.Requests)+2)
+	for name, q := range r.Resources.Requests {
+		requests[name] = q
+	}
+	requests[corev1.ResourceCPU] = *cpu
+	requests[corev1.ResourceMemory] = *memory
+	r.Resources.Requests = requests
+}
+
+// recommendationsHandler returns the renewer resources recommendations of
+// every namespace, or of the one given in the namespace query parameter, as
+// JSON.
+func recommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	recs := renewerReports.recommendations()
+	if namespace := r.URL.Query().Get("namespace"); namespace != "" {
+		recs = slices.DeleteFunc(recs, func(rec ResourcesRecommendation) bool { return rec.Namespace != namespace })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(recs); err != nil {
+		log.WithField("error", err).Info("Write error")
+	}
+}
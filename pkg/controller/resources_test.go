@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestRecommendations(t *testing.T) {
+	usage := func(namespace, pod string, cpu float64, rss int64, uptime time.Duration) renewerReport {
+		return renewerReport{
+			Namespace: namespace,
+			Pod:       pod,
+			Status:    renewerStatus{State: "waiting", NotAfter: time.Now().Add(time.Hour)},
+			Usage:     &renewerUsage{CPUSeconds: cpu, MaxRSSBytes: rss, UptimeSeconds: uptime.Seconds()},
+		}
+	}
+
+	s := newReportStore()
+	// 1ms/s of CPU and 10MiB, the highest of the namespace.
+	s.add(usage("payments", "api-1", 3.6, 10<<20, time.Hour))
+	s.add(usage("payments", "api-2", 0.36, 6<<20, time.Hour))
+	// Ignored, too young.
+	s.add(usage("payments", "api-3", 60, 64<<20, time.Minute))
+	// Below the minimums.
+	s.add(usage("default", "web-1", 0, 1<<20, time.Hour))
+	// Ignored, no usage reported.
+	s.add(renewerReport{Namespace: "legacy", Pod: "app-1", Status: renewerStatus{NotAfter: time.Now().Add(time.Hour)}})
+
+	want := []ResourcesRecommendation{
+		{Namespace: "default", Samples: 1, MilliCPU: minRecommendedMilliCPU, MemoryBytes: minRecommendedMemory},
+		{Namespace: "payments", Samples: 2, MilliCPU: 2, MemoryBytes: 13 << 20},
+	}
+	if got := s.recommendations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("recommendations() = %+v, want %+v", got, want)
+	}
+
+	if _, ok := s.recommendation("payments", 2); !ok {
+		t.Error("recommendation() with enough samples should be applied")
+	}
+	if _, ok := s.recommendation("payments", 3); ok {
+		t.Error("recommendation() without enough samples should not be applied")
+	}
+	if _, ok := s.recommendation("legacy", 1); ok {
+		t.Error("recommendation() without usage should not be applied")
+	}
+}
+
+func TestApplyRecommendation(t *testing.T) {
+	defer func(s *reportStore) { renewerReports = s }(renewerReports)
+	renewerReports = newReportStore()
+	for _, pod := range []string{"api-1", "api-2", "api-3"} {
+		renewerReports.add(renewerReport{
+			Namespace: "payments",
+			Pod:       pod,
+			Status:    renewerStatus{NotAfter: time.Now().Add(time.Hour)},
+			Usage:     &renewerUsage{CPUSeconds: 3.6, MaxRSSBytes: 10 << 20, UptimeSeconds: 3600},
+		})
+	}
+
+	template := corev1.Container{
+		Name: "autocert-renewer",
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:              resource.MustParse("10m"),
+				corev1.ResourceMemory:           resource.MustParse("20Mi"),
+				corev1.ResourceEphemeralStorage: resource.MustParse("1Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("12Mi"),
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		mode       string
+		namespace  string
+		wantCPU    string
+		wantMemory string
+	}{
+		{"off", renewerResourcesOff, "payments", "10m", "20Mi"},
+		{"recommend", renewerResourcesRecommend, "payments", "10m", "20Mi"},
+		// Memory is capped by the limit.
+		{"auto", renewerResourcesAuto, "payments", "2m", "12Mi"},
+		{"auto without samples", renewerResourcesAuto, "default", "10m", "20Mi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{RenewerResources: RenewerResources{Mode: tt.mode}}
+			r := *template.DeepCopy()
+			applyRecommendation(config, &r, tt.namespace)
+
+			requests := r.Resources.Requests
+			if cpu := requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse(tt.wantCPU)) != 0 {
+				t.Errorf("cpu = %s, want %s", cpu.String(), tt.wantCPU)
+			}
+			if memory := requests[corev1.ResourceMemory]; memory.Cmp(resource.MustParse(tt.wantMemory)) != 0 {
+				t.Errorf("memory = %s, want %s", memory.String(), tt.wantMemory)
+			}
+			if _, ok := requests[corev1.ResourceEphemeralStorage]; !ok {
+				t.Error("other requests should be kept")
+			}
+			if template.Resources.Requests.Cpu().String() != "10m" {
+				t.Error("the template should not be modified")
+			}
+		})
+	}
+}
+
+func TestValidateRenewerResources(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"default", Config{}, false},
+		{"auto", Config{RenewerResources: RenewerResources{Mode: "auto"}}, false},
+		{"recommend", Config{RenewerResources: RenewerResources{Mode: "recommend"}}, false},
+		{"invalid", Config{RenewerResources: RenewerResources{Mode: "always"}}, true},
+		{"old protocol", Config{ProtocolVersion: 4, RenewerResources: RenewerResources{Mode: "auto"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateRenewerResources(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateRenewerResources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// bootstrapRetriesEnvVar and bootstrapBackoffEnvVar tell the
+	// bootstrapper of a pod with restartPolicy Never how many times to retry
+	// a failed bootstrap, and how many seconds to wait before the first
+	// retry.
+	bootstrapRetriesEnvVar = "AUTOCERT_BOOTSTRAP_RETRIES"
+	bootstrapBackoffEnvVar = "AUTOCERT_BOOTSTRAP_BACKOFF"
+	// defaultBootstrapBackoff is the delay before the first retry, doubled
+	// by the bootstrapper after each one up to 5 minutes.
+	defaultBootstrapBackoff = 10 * time.Second
+)
+
+// RestartNever configures the bootstrap of pods with restartPolicy Never.
+// The kubelet doesn't restart their failed init containers, so without
+// retries a single CA outage fails the pod for good.
+type RestartNever struct {
+	// Retries is the number of times the bootstrapper retries a failed
+	// bootstrap before exiting, 0 to fail on the first error.
+	Retries int `yaml:"retries"`
+	// Backoff is the delay before the first retry.
+	Backoff string `yaml:"backoff"`
+}
+
+// GetBackoff returns the delay before the first retry, defaults to 10s.
+func (r RestartNever) GetBackoff() time.Duration {
+	d, err := time.ParseDuration(r.Backoff)
+	if err != nil || d <= 0 {
+		return defaultBootstrapBackoff
+	}
+	return d
+}
+
+// validateRestartNever returns an error if the retries of the bootstrap are
+// not valid, or not supported by the protocol version in use.
+func validateRestartNever(c *Config) error {
+	r := c.RestartNever
+	if r.Retries < 0 {
+		return fmt.Errorf("restartNever.retries %d must not be negative", r.Retries)
+	}
+	if r.Backoff != "" {
+		if d, err := time.ParseDuration(r.Backoff); err != nil || d < time.Second {
+			return fmt.Errorf("restartNever.backoff %q must be a duration of at least 1s", r.Backoff)
+		}
+	}
+	if v := envProtocolVersions[bootstrapRetriesEnvVar]; r.Retries > 0 && c.GetProtocolVersion() < v {
+		return fmt.Errorf("restartNever requires protocolVersion %d or later", v)
+	}
+	return nil
+}
+
+// setBootstrapRetries configures the bootstrapper of a pod with restartPolicy
+// Never to retry failed bootstraps.
+func setBootstrapRetries(config *Config, pod *corev1.Pod, bootstrapper *corev1.Container) {
+	if pod.Spec.RestartPolicy != corev1.RestartPolicyNever || config.RestartNever.Retries == 0 {
+		return
+	}
+	bootstrapper.Env = setEnv(bootstrapper.Env,
+		corev1.EnvVar{Name: bootstrapRetriesEnvVar, Value: strconv.Itoa(config.RestartNever.Retries)},
+		corev1.EnvVar{Name: bootstrapBackoffEnvVar, Value: strconv.Itoa(int(config.RestartNever.GetBackoff().Seconds()))},
+	)
+}
+
+// restartNeverWarnings warns about pods with restartPolicy Never getting a
+// bootstrapper that doesn't retry: the pod fails for good if the CA can't be
+// reached when it starts. Certificates in Secrets are not bootstrapped in
+// the pod.
+func restartNeverWarnings(pod *corev1.Pod, config *Config) []string {
+	annotations := pod.GetAnnotations()
+	if pod.Spec.RestartPolicy != corev1.RestartPolicyNever || config.RestartNever.Retries > 0 ||
+		annotations[secretAnnotationKey] != "" || annotations[externalSecretAnnotationKey] != "" {
+		return nil
+	}
+	return []string{"the pod has restartPolicy Never and its bootstrapper doesn't retry, the pod fails if the CA is unavailable when it starts; set restartNever.retries in the autocert configuration"}
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateRestartNever(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"disabled", Config{}, false},
+		{"retries", Config{RestartNever: RestartNever{Retries: 3, Backoff: "30s"}}, false},
+		{"negative retries", Config{RestartNever: RestartNever{Retries: -1}}, true},
+		{"invalid backoff", Config{RestartNever: RestartNever{Retries: 3, Backoff: "soon"}}, true},
+		{"short backoff", Config{RestartNever: RestartNever{Retries: 3, Backoff: "500ms"}}, true},
+		{"old protocol", Config{ProtocolVersion: 21, RestartNever: RestartNever{Retries: 3}}, true},
+		{"old protocol without retries", Config{ProtocolVersion: 21}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateRestartNever(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateRestartNever() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetBootstrapRetries(t *testing.T) {
+	config := &Config{RestartNever: RestartNever{Retries: 4, Backoff: "1m"}}
+	tests := []struct {
+		name    string
+		config  *Config
+		policy  corev1.RestartPolicy
+		wantEnv []corev1.EnvVar
+	}{
+		{"never", config, corev1.RestartPolicyNever, []corev1.EnvVar{
+			{Name: bootstrapRetriesEnvVar, Value: "4"},
+			{Name: bootstrapBackoffEnvVar, Value: "60"},
+		}},
+		{"default backoff", &Config{RestartNever: RestartNever{Retries: 2}}, corev1.RestartPolicyNever, []corev1.EnvVar{
+			{Name: bootstrapRetriesEnvVar, Value: "2"},
+			{Name: bootstrapBackoffEnvVar, Value: "10"},
+		}},
+		{"on failure", config, corev1.RestartPolicyOnFailure, nil},
+		{"always", config, "", nil},
+		{"disabled", &Config{}, corev1.RestartPolicyNever, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b corev1.Container
+			pod := &corev1.Pod{Spec: corev1.PodSpec{RestartPolicy: tt.policy}}
+			setBootstrapRetries(tt.config, pod, &b)
+			if !slices.Equal(b.Env, tt.wantEnv) {
+				t.Errorf("Env = %v, want %v", b.Env, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestRestartNeverWarnings(t *testing.T) {
+	never := corev1.PodSpec{RestartPolicy: corev1.RestartPolicyNever}
+	tests := []struct {
+		name   string
+		pod    *corev1.Pod
+		config *Config
+		want   bool
+	}{
+		{"never", &corev1.Pod{Spec: never}, &Config{}, true},
+		{"never with retries", &corev1.Pod{Spec: never}, &Config{RestartNever: RestartNever{Retries: 3}}, false},
+		{"on failure", &corev1.Pod{Spec: corev1.PodSpec{RestartPolicy: corev1.RestartPolicyOnFailure}}, &Config{}, false},
+		{"secret", &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{secretAnnotationKey: "batch-tls"}},
+			Spec:       never,
+		}, &Config{}, false},
+		{"external secret", &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{externalSecretAnnotationKey: "batch-tls"}},
+			Spec:       never,
+		}, &Config{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := restartNeverWarnings(tt.pod, tt.config); (len(got) > 0) != tt.want {
+				t.Errorf("restartNeverWarnings() = %q, want a warning %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	rolloutIdentityAnnotationKey = "autocert.step.sm/rollout-identity"
+	revisionAnnotationKey        = "autocert.step.sm/revision"
+	// rolloutsPodTemplateHashLabel is set by Argo Rollouts on every pod it
+	// manages, and on the AnalysisRuns of a revision. Stable, canary and
+	// preview replicas get different values.
+	rolloutsPodTemplateHashLabel = "rollouts-pod-template-hash"
+	// argoRolloutsAPIVersion is the API version of the AnalysisRuns owning
+	// the Jobs of analysis pods.
+	argoRolloutsAPIVersion = "argoproj.io/v1alpha1"
+
+	rolloutIdentityShared   = "shared"
+	rolloutIdentityIsolated = "isolated"
+)
+
+// validateRolloutIdentity returns an error if rolloutIdentity is not one of
+// the supported values.
+func validateRolloutIdentity(c *Config) error {
+	if c.RolloutIdentity == "" {
+		return nil
+	}
+	if reason := checkRolloutIdentity(c.RolloutIdentity); reason != "" {
+		return fmt.Errorf("rolloutIdentity %q %s, it must be %q or %q", c.RolloutIdentity, reason, rolloutIdentityShared, rolloutIdentityIsolated)
+	}
+	return nil
+}
+
+func checkRolloutIdentity(v string) string {
+	if !strings.EqualFold(v, rolloutIdentityShared) && !strings.EqualFold(v, rolloutIdentityIsolated) {
+		return "is not a rollout identity"
+	}
+	return ""
+}
+
+// rolloutRevision returns the Argo Rollouts revision of a pod if the
+// identities of the revisions must be isolated from each other, or an empty
+// string if the pod is not managed by Argo Rollouts or identities are shared.
+// The rollout identity is taken from the `autocert.step.sm/rollout-identity`
+// annotation and defaults to rolloutIdentity in the configuration.
+//
+// Analysis pods, run by the Jobs of an AnalysisRun, get the revision the
+// AnalysisRun analyzes. Errors getting the Job or the AnalysisRun are logged
+// and the pod shares the identity of the rollout.
+//
+// When isolated, the revision is appended to the names of the Secrets of the
+// pod and to its URI SAN, so the stable and preview replicas of a blue-green
+// deployment don't fight over the same Secrets and can be told apart.
+func rolloutRevision(pod *corev1.Pod, namespace string, annotations podAnnotations, config *Config) string {
+	identity := annotations.RolloutIdentity
+	if identity == "" {
+		identity = config.RolloutIdentity
+	}
+	if !strings.EqualFold(identity, rolloutIdentityIsolated) {
+		return ""
+	}
+
+	if revision := pod.GetLabels()[rolloutsPodTemplateHashLabel]; revision != "" {
+		return revision
+	}
+	revision, err := analysisRevision(pod, namespace, getJob, getAnalysisRun)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"namespace": namespace,
+			"pod":       pod.GetGenerateName(),
+			"error":     err,
+		}).Warn("Error getting the analysis run of the pod, its identity is shared")
+		return ""
+	}
+	return revision
+}
+
+// analysisRevision returns the revision analyzed by the pod of an Argo
+// Rollouts analysis Job, or "" if the pod is not run by one. Argo Rollouts
+// doesn't label the pods of analysis Jobs, only the AnalysisRun owning the
+// Job.
+func analysisRevision(pod *corev1.Pod, namespace string, getJob func(namespace, name string) (*batchv1.Job, error), getAnalysisRun func(namespace, name string) (*metav1.PartialObjectMetadata, error)) (string, error) {
+	name := jobName(pod)
+	if name == "" {
+		return "", nil
+	}
+	job, err := getJob(namespace, name)
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting job %s", name)
+	}
+	if job == nil {
+		return "", nil
+	}
+	for _, ref := range job.OwnerReferences {
+		if ref.Kind != "AnalysisRun" || ref.APIVersion != argoRolloutsAPIVersion {
+			continue
+		}
+		run, err := getAnalysisRun(namespace, ref.Name)
+		if err != nil {
+			return "", errors.Wrapf(err, "error getting analysis run %s", ref.Name)
+		}
+		if run == nil {
+			return "", nil
+		}
+		return run.Labels[rolloutsPodTemplateHashLabel], nil
+	}
+	return "", nil
+}
+
+// rolloutIdentityURI returns the URI SAN of a revision of a rollout with
+// isolated identities.
+func rolloutIdentityURI(uri, revision string) string {
+	if uri == "" || revision == "" {
+		return uri
+	}
+	return uri + "/revision/" + revision
+}
+
+// getAnalysisRun returns the metadata of an AnalysisRun, or nil if it doesn't
+// exist.
+func getAnalysisRun(namespace, name string) (*metav1.PartialObjectMetadata, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := client.GetRequest(fmt.Sprintf("apis/%s/namespaces/%s/analysisruns/%s", argoRolloutsAPIVersion, namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, errors.New(resp.Status)
+	}
+	var run metav1.PartialObjectMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
@@ -0,0 +1,199 @@
+package controller
+
+import (
+	"crypto/x509"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRolloutRevision(t *testing.T) {
+	pod := func(labels, annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: labels, Annotations: annotations}}
+	}
+	rollout := map[string]string{rolloutsPodTemplateHashLabel: "6d4f8c7b9"}
+	isolated := map[string]string{rolloutIdentityAnnotationKey: rolloutIdentityIsolated}
+	shared := map[string]string{rolloutIdentityAnnotationKey: rolloutIdentityShared}
+
+	testCases := []struct {
+		description string
+		pod         *corev1.Pod
+		config      *Config
+		want        string
+	}{
+		{"not a rollout", pod(nil, isolated), &Config{RolloutIdentity: rolloutIdentityIsolated}, ""},
+		{"shared by default", pod(rollout, nil), &Config{}, ""},
+		{"isolated by config", pod(rollout, nil), &Config{RolloutIdentity: rolloutIdentityIsolated}, "6d4f8c7b9"},
+		{"isolated by annotation", pod(rollout, isolated), &Config{}, "6d4f8c7b9"},
+		{"annotation overrides config", pod(rollout, shared), &Config{RolloutIdentity: rolloutIdentityIsolated}, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			annotations, err := parseAnnotations(tc.pod.Annotations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rolloutRevision(tc.pod, "default", annotations, tc.config); got != tc.want {
+				t.Errorf("rolloutRevision() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRolloutIdentityValidation(t *testing.T) {
+	for _, v := range []string{"", rolloutIdentityShared, rolloutIdentityIsolated, "Isolated"} {
+		if err := validateRolloutIdentity(&Config{RolloutIdentity: v}); err != nil {
+			t.Errorf("validateRolloutIdentity(%q) = %v", v, err)
+		}
+	}
+	if err := validateRolloutIdentity(&Config{RolloutIdentity: "isolate"}); err == nil {
+		t.Error("validateRolloutIdentity(\"isolate\") should fail")
+	}
+
+	_, err := parseAnnotations(map[string]string{rolloutIdentityAnnotationKey: "separate"})
+	var errs annotationErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Key != rolloutIdentityAnnotationKey {
+		t.Errorf("parseAnnotations() error = %v, want an error on %s", err, rolloutIdentityAnnotationKey)
+	}
+}
+
+func TestAnalysisRevision(t *testing.T) {
+	controller := true
+	analysisPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "batch/v1", Kind: "Job", Name: "analysis", Controller: &controller}},
+	}}
+	job := func(kind string) func(string, string) (*batchv1.Job, error) {
+		return func(_, name string) (*batchv1.Job, error) {
+			return &batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: argoRolloutsAPIVersion, Kind: kind, Name: "hello-6d4f8c7b9-2-pre"}},
+			}}, nil
+		}
+	}
+	run := func(_, name string) (*metav1.PartialObjectMetadata, error) {
+		if name != "hello-6d4f8c7b9-2-pre" {
+			return nil, nil
+		}
+		return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{rolloutsPodTemplateHashLabel: "6d4f8c7b9"},
+		}}, nil
+	}
+	failing := func(string, string) (*batchv1.Job, error) { return nil, errors.New("forbidden") }
+
+	testCases := []struct {
+		description string
+		pod         *corev1.Pod
+		getJob      func(string, string) (*batchv1.Job, error)
+		want        string
+		wantErr     bool
+	}{
+		{"not a job", &corev1.Pod{}, failing, "", false},
+		{"analysis run", analysisPod, job("AnalysisRun"), "6d4f8c7b9", false},
+		{"other job", analysisPod, job("CronJob"), "", false},
+		{"error", analysisPod, failing, "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			got, err := analysisRevision(tc.pod, "default", tc.getJob, run)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("analysisRevision() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("analysisRevision() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRolloutIdentityURI(t *testing.T) {
+	const uri = "spiffe://cluster.local/ns/default/sa/hello"
+	if got := rolloutIdentityURI(uri, ""); got != uri {
+		t.Errorf("rolloutIdentityURI() = %v, want %v", got, uri)
+	}
+	if got := rolloutIdentityURI("", "6d4f8c7b9"); got != "" {
+		t.Errorf("rolloutIdentityURI() = %v, want none", got)
+	}
+	if got, want := rolloutIdentityURI(uri, "6d4f8c7b9"), uri+"/revision/6d4f8c7b9"; got != want {
+		t.Errorf("rolloutIdentityURI() = %v, want %v", got, want)
+	}
+}
+
+// sanTokens records the SANs of the tokens it generates.
+type sanTokens struct {
+	mu   sync.Mutex
+	sans [][]string
+}
+
+func (t *sanTokens) Token(subject string, sans ...string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sans = append(t.sans, sans)
+	return "token-" + subject, nil
+}
+
+func TestPatchRolloutIdentity(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+
+	rootFile, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	newPod := func(hash string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: "api-" + hash + "-",
+				Labels:       map[string]string{rolloutsPodTemplateHashLabel: hash},
+				Annotations:  map[string]string{admissionWebhookAnnotationKey: "api.default.svc"},
+			},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: "api",
+				Containers:         []corev1.Container{{Name: "api"}},
+			},
+		}
+	}
+	tests := []struct {
+		identity string
+		wantURI  string
+	}{
+		{rolloutIdentityShared, "spiffe://cluster.local/ns/default/sa/api"},
+		{rolloutIdentityIsolated, "spiffe://cluster.local/ns/default/sa/api/revision/6d4f8c7b9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.identity, func(t *testing.T) {
+			secrets := &fakeSecrets{}
+			tokenSecrets = secrets
+			tokens := &sanTokens{}
+			config := &Config{
+				CaURL:           "https://ca",
+				RootCAPath:      rootFile,
+				TrustDomain:     "cluster.local",
+				RolloutIdentity: tt.identity,
+				CertsVolume:     corev1.Volume{Name: "certs"},
+				Bootstrapper:    corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper"},
+				Renewer:         corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+			}
+			patched := patchPod(t, newPod("6d4f8c7b9"), "default", config, tokens)
+
+			if len(tokens.sans) != 1 || !slices.Contains(tokens.sans[0], tt.wantURI) {
+				t.Errorf("token SANs = %v, want %s", tokens.sans, tt.wantURI)
+			}
+			isolated := tt.identity == rolloutIdentityIsolated
+			if got := patched.Annotations[revisionAnnotationKey]; (got == "6d4f8c7b9") != isolated {
+				t.Errorf("revision annotation = %q", got)
+			}
+			if len(secrets.created) != 1 {
+				t.Fatalf("created secrets = %d, want 1", len(secrets.created))
+			}
+			if got := secrets.created[0].GenerateName; strings.Contains(got, "6d4f8c7b9") != isolated {
+				t.Errorf("token secret prefix = %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// scratchVolumeName is the writable volume of the injected containers in
+	// pods with a read-only root filesystem.
+	scratchVolumeName = "autocert-scratch"
+	// scratchMountPath is where the scratch volume is mounted. The step CLI
+	// keeps its state in $STEPPATH, under it.
+	scratchMountPath = "/tmp"
+)
+
+// scratchSizeLimit bounds the scratch volume, backed by memory.
+var scratchSizeLimit = resource.MustParse("16Mi")
+
+// readOnlyRootFilesystem returns whether every application container of the
+// pod has a read-only root filesystem. The injected containers then get one
+// too, so the pod still complies with the policies requiring it.
+func readOnlyRootFilesystem(pod *corev1.Pod) bool {
+	if len(pod.Spec.Containers) == 0 {
+		return false
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.SecurityContext == nil || c.SecurityContext.ReadOnlyRootFilesystem == nil || !*c.SecurityContext.ReadOnlyRootFilesystem {
+			return false
+		}
+	}
+	return true
+}
+
+// setReadOnlyRootFilesystem makes the root filesystem of the given containers
+// read-only. Besides the certificates volume, they can only write to the
+// scratch volume, where $HOME and $STEPPATH point.
+func setReadOnlyRootFilesystem(containers ...*corev1.Container) {
+	for _, c := range containers {
+		if c.SecurityContext == nil {
+			c.SecurityContext = &corev1.SecurityContext{}
+		}
+		c.SecurityContext.ReadOnlyRootFilesystem = ptr.To(true)
+		c.Env = setEnv(c.Env,
+			corev1.EnvVar{Name: "HOME", Value: scratchMountPath},
+			corev1.EnvVar{Name: "STEPPATH", Value: path.Join(scratchMountPath, ".step")},
+		)
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      scratchVolumeName,
+			MountPath: scratchMountPath,
+		})
+	}
+}
+
+// scratchVolume returns the writable volume of the injected containers.
+func scratchVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: scratchVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{
+				Medium:    corev1.StorageMediumMemory,
+				SizeLimit: &scratchSizeLimit,
+			},
+		},
+	}
+}
+
+// hasCertsVolume returns whether the pod already declares the certificates
+// volume, for instance because its manifest mounts it with a subPath. An
+// emptyDir is kept as is, the certificates are written to it the same way.
+// It returns an error if a volume with the same name has another source:
+// adding the certificates volume would make the pod invalid, and the
+// certificates would be written to a volume the pod didn't expect.
+func hasCertsVolume(pod *corev1.Pod, config *Config) (bool, error) {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name != config.CertsVolume.Name {
+			continue
+		}
+		if v.EmptyDir == nil {
+			return false, fmt.Errorf("volume %s is reserved for the certificates and must be an emptyDir, rename the volume of the pod", v.Name)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// subPathWarnings returns the warnings for the containers mounting the
+// certificates volume with a subPath. Renewed certificates replace the files
+// with a rename, and a subPath mount keeps the file that was there when the
+// container started, so those containers never see a renewed certificate.
+func subPathWarnings(pod *corev1.Pod, config *Config) []string {
+	if strings.EqualFold(pod.GetAnnotations()[bootstrapperOnlyAnnotationKey], "true") {
+		return nil
+	}
+	var warnings []string
+	for _, c := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+		for _, m := range c.VolumeMounts {
+			if m.Name != config.CertsVolume.Name || (m.SubPath == "" && m.SubPathExpr == "") {
+				continue
+			}
+			warnings = append(warnings, fmt.Sprintf("container %s mounts volume %s with a subPath and won't see renewed certificates, mount the whole volume instead", c.Name, m.Name))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestReadOnlyRootFilesystem(t *testing.T) {
+	readOnly := corev1.Container{SecurityContext: &corev1.SecurityContext{ReadOnlyRootFilesystem: ptr.To(true)}}
+	writable := corev1.Container{SecurityContext: &corev1.SecurityContext{ReadOnlyRootFilesystem: ptr.To(false)}}
+
+	tests := []struct {
+		name       string
+		containers []corev1.Container
+		want       bool
+	}{
+		{"no containers", nil, false},
+		{"no security context", []corev1.Container{{}}, false},
+		{"read-only", []corev1.Container{readOnly, readOnly}, true},
+		{"writable", []corev1.Container{writable}, false},
+		{"mixed", []corev1.Container{readOnly, {}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: tt.containers}}
+			if got := readOnlyRootFilesystem(pod); got != tt.want {
+				t.Errorf("readOnlyRootFilesystem() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetReadOnlyRootFilesystem(t *testing.T) {
+	c := corev1.Container{
+		Env:             []corev1.EnvVar{{Name: "HOME", Value: "/root"}},
+		SecurityContext: &corev1.SecurityContext{RunAsUser: ptr.To[int64](1000)},
+	}
+	setReadOnlyRootFilesystem(&c)
+	if !*c.SecurityContext.ReadOnlyRootFilesystem || *c.SecurityContext.RunAsUser != 1000 {
+		t.Errorf("SecurityContext = %+v, want a read-only root filesystem", c.SecurityContext)
+	}
+	want := []corev1.EnvVar{{Name: "HOME", Value: "/tmp"}, {Name: "STEPPATH", Value: "/tmp/.step"}}
+	if len(c.Env) != len(want) || c.Env[0] != want[0] || c.Env[1] != want[1] {
+		t.Errorf("Env = %v, want %v", c.Env, want)
+	}
+	if len(c.VolumeMounts) != 1 || c.VolumeMounts[0].Name != scratchVolumeName || c.VolumeMounts[0].ReadOnly {
+		t.Errorf("VolumeMounts = %v, want a writable scratch volume", c.VolumeMounts)
+	}
+
+	// Non-root containers keep the read-only root filesystem.
+	b := corev1.Container{}
+	setReadOnlyRootFilesystem(&b)
+	setSecurityContext(&b, &corev1.SecurityContext{RunAsUser: ptr.To[int64](1000)})
+	if !*b.SecurityContext.ReadOnlyRootFilesystem {
+		t.Error("setSecurityContext() should keep the read-only root filesystem")
+	}
+}
+
+func TestHasCertsVolume(t *testing.T) {
+	config := &Config{CertsVolume: corev1.Volume{Name: "certs"}}
+	pod := func(volumes ...corev1.Volume) *corev1.Pod {
+		return &corev1.Pod{Spec: corev1.PodSpec{Volumes: volumes}}
+	}
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		want    bool
+		wantErr bool
+	}{
+		{"no volumes", pod(), false, false},
+		{"other volume", pod(corev1.Volume{Name: "data"}), false, false},
+		{"emptyDir", pod(corev1.Volume{Name: "certs", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}), true, false},
+		{"secret", pod(corev1.Volume{Name: "certs", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "tls"}}}), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hasCertsVolume(tt.pod, config)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("hasCertsVolume() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddCertsVolumeMount(t *testing.T) {
+	containers := []corev1.Container{
+		{Name: "app"},
+		{Name: "mounted", VolumeMounts: []corev1.VolumeMount{{Name: "certs", MountPath: "/var/run/autocert.step.sm/"}}},
+		{Name: "subpath", VolumeMounts: []corev1.VolumeMount{{Name: "certs", MountPath: "/etc/tls/tls.crt", SubPath: "site.crt"}}},
+	}
+	ops, err := addCertsVolumeMount("certs", containers, "containers", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 || ops[0].Path != "/spec/containers/0/volumeMounts" || ops[1].Path != "/spec/containers/2/volumeMounts/-" {
+		t.Errorf("addCertsVolumeMount() = %v, want mounts in the app and subpath containers", ops)
+	}
+
+	for _, m := range []corev1.VolumeMount{
+		{Name: "data", MountPath: "/var/run/autocert.step.sm"},
+		{Name: "certs", MountPath: "/var/run/autocert.step.sm", SubPath: "site.crt"},
+	} {
+		conflict := []corev1.Container{{Name: "app", VolumeMounts: []corev1.VolumeMount{m}}}
+		if _, err := addCertsVolumeMount("certs", conflict, "containers", false); err == nil {
+			t.Errorf("addCertsVolumeMount() with %+v should fail", m)
+		}
+	}
+}
+
+func TestSubPathWarnings(t *testing.T) {
+	config := &Config{CertsVolume: corev1.Volume{Name: "certs"}}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{
+			{Name: "init", VolumeMounts: []corev1.VolumeMount{{Name: "certs", MountPath: "/etc/tls", SubPathExpr: "$(POD_NAME)"}}},
+		},
+		Containers: []corev1.Container{
+			{Name: "app", VolumeMounts: []corev1.VolumeMount{
+				{Name: "certs", MountPath: "/etc/tls/tls.crt", SubPath: "site.crt"},
+				{Name: "config", MountPath: "/etc/app/app.yaml", SubPath: "app.yaml"},
+			}},
+			{Name: "whole", VolumeMounts: []corev1.VolumeMount{{Name: "certs", MountPath: "/etc/tls"}}},
+		},
+	}}
+	if got := subPathWarnings(pod, config); len(got) != 2 {
+		t.Errorf("subPathWarnings() = %v, want warnings for the init and app containers", got)
+	}
+
+	pod.ObjectMeta = metav1.ObjectMeta{Annotations: map[string]string{bootstrapperOnlyAnnotationKey: "true"}}
+	if got := subPathWarnings(pod, config); got != nil {
+		t.Errorf("subPathWarnings() = %v, want no warnings without a renewer", got)
+	}
+}
@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// externalDNSHostnameAnnotationKey and
+	// externalDNSInternalHostnameAnnotationKey are the Service annotations
+	// used by external-dns to publish DNS records.
+	externalDNSHostnameAnnotationKey         = "external-dns.alpha.kubernetes.io/hostname"
+	externalDNSInternalHostnameAnnotationKey = "external-dns.alpha.kubernetes.io/internal-hostname"
+)
+
+// validateSANCheck returns an error if the sanCheck mode is not supported.
+func validateSANCheck(mode string) error {
+	switch mode {
+	case "", policyWarn, policyDeny:
+		return nil
+	default:
+		return fmt.Errorf("sanCheck %q is not supported, use %q or %q", mode, policyWarn, policyDeny)
+	}
+}
+
+// serviceHostnames returns the DNS names resolving to a Service: its cluster
+// DNS names and the hostnames published by external-dns.
+func serviceHostnames(svc *corev1.Service, clusterDomain string) []string {
+	names := []string{
+		svc.Name,
+		svc.Name + "." + svc.Namespace,
+		svc.Name + "." + svc.Namespace + ".svc",
+		svc.Name + "." + svc.Namespace + ".svc." + clusterDomain,
+	}
+	for _, key := range []string{externalDNSHostnameAnnotationKey, externalDNSInternalHostnameAnnotationKey} {
+		for _, name := range strings.Split(svc.Annotations[key], ",") {
+			if name = strings.TrimSuffix(strings.TrimSpace(name), "."); name != "" {
+				names = append(names, strings.ToLower(name))
+			}
+		}
+	}
+	return names
+}
+
+// selectsPod returns whether a Service routes traffic to a pod with the given
+// labels.
+func selectsPod(svc *corev1.Service, labels map[string]string) bool {
+	if len(svc.Spec.Selector) == 0 {
+		return false
+	}
+	for k, v := range svc.Spec.Selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// unresolvedSANs returns the DNS names requested by a pod that don't resolve
+// to a Service selecting it. IP addresses, URIs, emails, wildcards and names
+// under an excluded domain are not checked.
+func unresolvedSANs(names []string, labels map[string]string, services []corev1.Service, clusterDomain string, excluded []string) []string {
+	var resolved []string
+	for i := range services {
+		if selectsPod(&services[i], labels) {
+			resolved = append(resolved, serviceHostnames(&services[i], clusterDomain)...)
+		}
+	}
+
+	var unresolved []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		switch {
+		case name == "", net.ParseIP(name) != nil, strings.Contains(name, "@"), strings.HasPrefix(name, "*."):
+			continue
+		case strings.Contains(name, "://"):
+			if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+				continue
+			}
+		case slices.ContainsFunc(excluded, func(domain string) bool {
+			domain = strings.ToLower(strings.Trim(domain, "."))
+			return name == domain || strings.HasSuffix(name, "."+domain)
+		}):
+			continue
+		}
+		if !slices.Contains(resolved, name) {
+			unresolved = append(unresolved, name)
+		}
+	}
+	return unresolved
+}
+
+// requestedNames returns the names requested by a pod: its common name and
+// the names in the sans annotation.
+func requestedNames(pod *corev1.Pod) []string {
+	annotations := pod.GetAnnotations()
+	names := []string{annotations[admissionWebhookAnnotationKey]}
+	if v := annotations[sansAnnotationKey]; v != "" {
+		names = append(names, strings.Split(v, ",")...)
+	}
+	return names
+}
+
+// listServices returns the Services in the given namespace.
+func listServices(namespace string) ([]corev1.Service, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := client.GetRequest(fmt.Sprintf("api/v1/namespaces/%s/services", namespace))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "list services")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, errors.Errorf("list services: %s", resp.Status)
+	}
+
+	var list corev1.ServiceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshalling services")
+	}
+	return list.Items, nil
+}
+
+// checkSANs cross-checks the DNS names requested by a pod against the
+// Services selecting it, catching typos before they surface as handshake
+// errors. It returns the warnings to attach to the admission response, or an
+// error if the pod must be denied.
+func checkSANs(pod *corev1.Pod, namespace string, config *Config, services func(string) ([]corev1.Service, error)) ([]string, error) {
+	if config.SANCheck == "" {
+		return nil, nil
+	}
+
+	names := requestedNames(pod)
+	svcs, err := services(namespace)
+	if err != nil {
+		// Don't block admission on a failure of the check itself.
+		return []string{fmt.Sprintf("autocert: unable to check the requested names: %v", err)}, nil
+	}
+
+	unresolved := unresolvedSANs(names, pod.GetLabels(), svcs, config.GetClusterDomain(), config.SANCheckExcludedDomains)
+	if len(unresolved) == 0 {
+		return nil, nil
+	}
+
+	msg := fmt.Sprintf("names %s don't resolve to a Service selecting this pod, check the %s and %s annotations for typos", strings.Join(unresolved, ", "), admissionWebhookAnnotationKey, sansAnnotationKey)
+	if config.SANCheck == policyDeny {
+		return nil, errors.New(msg)
+	}
+	return []string{"autocert: " + msg}, nil
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUnresolvedSANs(t *testing.T) {
+	services := []corev1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "api",
+				Namespace:   "default",
+				Annotations: map[string]string{externalDNSHostnameAnnotationKey: "api.example.com., www.example.com"},
+			},
+			Spec: corev1.ServiceSpec{Selector: map[string]string{"app": "api"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "web",
+				Namespace:   "default",
+				Annotations: map[string]string{externalDNSHostnameAnnotationKey: "web.example.com"},
+			},
+			Spec: corev1.ServiceSpec{Selector: map[string]string{"app": "web"}},
+		},
+	}
+	labels := map[string]string{"app": "api", "version": "v1"}
+
+	tests := []struct {
+		name     string
+		names    []string
+		excluded []string
+		want     []string
+	}{
+		{"cluster names", []string{"api", "api.default.svc", "api.default.svc.cluster.local"}, nil, nil},
+		{"external-dns names", []string{"API.example.com", "www.example.com."}, nil, nil},
+		{"typo", []string{"api.exmaple.com"}, nil, []string{"api.exmaple.com"}},
+		{"other service", []string{"web.example.com", "web.default.svc"}, nil, []string{"web.example.com", "web.default.svc"}},
+		{"not checked", []string{"10.0.0.1", "spiffe://example.com/ns/default/sa/api", "api@example.com", "*.example.com"}, nil, nil},
+		{"excluded domain", []string{"api.internal.example.org"}, []string{"example.org"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unresolvedSANs(tt.names, labels, services, "cluster.local", tt.excluded); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unresolvedSANs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSANs(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Labels: map[string]string{"app": "api"},
+		Annotations: map[string]string{
+			admissionWebhookAnnotationKey: "api.default.svc",
+			sansAnnotationKey:             "api.default.svc,api.exmaple.com",
+		},
+	}}
+	services := func(string) ([]corev1.Service, error) {
+		return []corev1.Service{{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "api"}},
+		}}, nil
+	}
+	failing := func(string) ([]corev1.Service, error) {
+		return nil, errors.New("forbidden")
+	}
+
+	tests := []struct {
+		name         string
+		mode         string
+		services     func(string) ([]corev1.Service, error)
+		wantWarnings bool
+		wantErr      bool
+	}{
+		{"disabled", "", services, false, false},
+		{"warn", policyWarn, services, true, false},
+		{"deny", policyDeny, services, false, true},
+		{"list error", policyDeny, failing, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings, err := checkSANs(pod, "default", &Config{SANCheck: tt.mode}, tt.services)
+			if (err != nil) != tt.wantErr || (len(warnings) > 0) != tt.wantWarnings {
+				t.Errorf("checkSANs() = %v, %v, wantWarnings %v, wantErr %v", warnings, err, tt.wantWarnings, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// sdsAnnotationKey makes the renewer serve the certificate with the
+	// Envoy Secret Discovery Service.
+	sdsAnnotationKey = "autocert.step.sm/sds"
+	// sdsSocketEnvVar is the Unix socket the renewer serves SDS on, in the
+	// certificates volume.
+	sdsSocketEnvVar = "SDS_SOCKET"
+	sdsSocketName   = "sds.sock"
+)
+
+// useSDS returns whether the renewer of a pod serves its certificate with
+// SDS. It returns an error if the pod has no renewer renewing the
+// certificate, or if the protocol version in use doesn't support it.
+func useSDS(annotations podAnnotations, config *Config) (bool, error) {
+	if !annotations.SDS {
+		return false, nil
+	}
+	var reason string
+	switch {
+	case annotations.BootstrapperOnly:
+		reason = "the pod has no renewer, it's annotated with " + bootstrapperOnlyAnnotationKey
+	case annotations.ExternalSecret != "":
+		reason = "the certificate is not renewed by autocert, the pod is annotated with " + externalSecretAnnotationKey
+	case config.GetProtocolVersion() < envProtocolVersions[sdsSocketEnvVar]:
+		reason = fmt.Sprintf("requires protocol version %d, but version %d is pinned in the configuration", envProtocolVersions[sdsSocketEnvVar], config.GetProtocolVersion())
+	default:
+		return true, nil
+	}
+	return false, annotationErrors{{
+		Key:    sdsAnnotationKey,
+		Value:  "true",
+		Reason: reason,
+	}}
+}
+
+// setSDS configures the renewer to serve SDS on a socket in the certificates
+// volume, next to the certificate.
+func setSDS(renewer *corev1.Container) {
+	renewer.Env = setEnv(renewer.Env, corev1.EnvVar{
+		Name:  sdsSocketEnvVar,
+		Value: path.Join(volumeMountPath, sdsSocketName),
+	})
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestUseSDS(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations podAnnotations
+		config      *Config
+		want        bool
+		wantErr     bool
+	}{
+		{"enabled", podAnnotations{SDS: true}, &Config{}, true, false},
+		{"disabled", podAnnotations{}, &Config{ProtocolVersion: 15}, false, false},
+		{"old protocol", podAnnotations{SDS: true}, &Config{ProtocolVersion: 15}, false, true},
+		{"bootstrapper only", podAnnotations{SDS: true, BootstrapperOnly: true}, &Config{}, false, true},
+		{"external secret", podAnnotations{SDS: true, ExternalSecret: "legacy-tls"}, &Config{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := useSDS(tt.annotations, tt.config)
+			var aerrs annotationErrors
+			if tt.wantErr != errors.As(err, &aerrs) {
+				t.Fatalf("useSDS() error = %v, want annotation error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("useSDS() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetSDS(t *testing.T) {
+	renewer := corev1.Container{Env: []corev1.EnvVar{{Name: "CRT", Value: "/var/run/autocert.step.sm/site.crt"}}}
+	setSDS(&renewer)
+	want := corev1.EnvVar{Name: sdsSocketEnvVar, Value: "/var/run/autocert.step.sm/sds.sock"}
+	if len(renewer.Env) != 2 || renewer.Env[1] != want {
+		t.Errorf("env = %v, want %v added", renewer.Env, want)
+	}
+	if filtered := filterEnv(renewer.Env, 15); len(filtered) != 1 {
+		t.Errorf("filterEnv() = %v, want %s removed for protocol 15", filtered, sdsSocketEnvVar)
+	}
+}
@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// caTokenEnvVar is the path of the projected service account token the
+	// bootstrapper presents to the CA, set with serviceAccountAuth.
+	caTokenEnvVar = "AUTOCERT_CA_TOKEN"
+	// caTokenVolume is the volume projecting the service account token of
+	// the pod for the CA.
+	caTokenVolume    = "autocert-ca-token"
+	caTokenMountPath = "/var/run/secrets/ca.autocert.step.sm"
+	// minCATokenExpiration is the shortest lifetime of a projected service
+	// account token accepted by the API server.
+	minCATokenExpiration = 600
+)
+
+// ServiceAccountAuth configures the bootstrappers to authenticate to the CA
+// with a projected service account token of their pod, validated by an OIDC
+// provisioner trusting the service account issuer of the cluster, instead of
+// a token minted by the controller with the provisioner password. The
+// controller gets its own certificate the same way, with the token at
+// TokenPath, and needs no provisioner password.
+type ServiceAccountAuth struct {
+	Enabled bool `yaml:"enabled"`
+	// Audience is the audience of the tokens, the client ID of the
+	// provisioner. Defaults to the CA URL.
+	Audience          string `yaml:"audience"`
+	ExpirationSeconds int64  `yaml:"expirationSeconds"`
+	// TokenPath is the projected service account token of the controller.
+	TokenPath string `yaml:"tokenPath"`
+}
+
+// GetServiceAccountAudience returns the audience of the service account
+// tokens presented to the CA, defaults to the CA URL.
+func (c Config) GetServiceAccountAudience() string {
+	if c.ServiceAccountAuth.Audience != "" {
+		return c.ServiceAccountAuth.Audience
+	}
+	return c.GetCaURL()
+}
+
+// GetExpirationSeconds returns the lifetime of the service account tokens
+// of the bootstrappers, defaults to 10 minutes.
+func (a ServiceAccountAuth) GetExpirationSeconds() int64 {
+	if a.ExpirationSeconds != 0 {
+		return a.ExpirationSeconds
+	}
+	return minCATokenExpiration
+}
+
+// GetTokenPath returns the path of the service account token of the
+// controller, defaults to the path the bootstrappers use.
+func (a ServiceAccountAuth) GetTokenPath() string {
+	if a.TokenPath != "" {
+		return a.TokenPath
+	}
+	return caTokenMountPath + "/token"
+}
+
+// validateServiceAccountAuth returns an error if service account
+// authentication is enabled with features needing the tokens of the
+// provisioner, or with a protocol version that doesn't support it.
+func validateServiceAccountAuth(c *Config) error {
+	if !c.ServiceAccountAuth.Enabled {
+		return nil
+	}
+	if v := envProtocolVersions[caTokenEnvVar]; c.GetProtocolVersion() < v {
+		return fmt.Errorf("serviceAccountAuth requires protocolVersion %d or later", v)
+	}
+	if e := c.ServiceAccountAuth.ExpirationSeconds; e != 0 && e < minCATokenExpiration {
+		return fmt.Errorf("serviceAccountAuth.expirationSeconds must be at least %d", minCATokenExpiration)
+	}
+	var conflicts []string
+	if c.TokenBinding {
+		conflicts = append(conflicts, "tokenBinding")
+	}
+	if c.TokenRemint.Enabled {
+		conflicts = append(conflicts, "tokenRemint")
+	}
+	if len(c.CSRNamespaces) > 0 || len(c.ApprovalGates) > 0 {
+		conflicts = append(conflicts, "csrNamespaces and approvalGates")
+	}
+	if c.SecretIssuance.Enabled {
+		conflicts = append(conflicts, "secretIssuance")
+	}
+	if len(c.ConstrainedIntermediates) > 0 {
+		conflicts = append(conflicts, "constrainedIntermediates")
+	}
+	if len(c.CertificateAuthorities) > 0 {
+		conflicts = append(conflicts, "certificateAuthorities")
+	}
+	if c.DevCA.Enabled {
+		conflicts = append(conflicts, "devCA")
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("serviceAccountAuth can't be enabled with %s, they sign with the provisioner of the controller", strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// serviceAccountAuthEnv returns the environment variables of the
+// bootstrappers authenticating with their service account token, in place of
+// a bootstrap token. The bootstrapper creates the certificate request with
+// the names of the certificate.
+func serviceAccountAuthEnv(sans []string) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{
+			Name:  caTokenEnvVar,
+			Value: caTokenMountPath + "/token",
+		},
+		{
+			Name:  "AUTOCERT_SANS",
+			Value: strings.Join(sans, ","),
+		},
+	}
+}
+
+// addServiceAccountAuth mounts the service account token of the pod in the
+// bootstrapper.
+func addServiceAccountAuth(b *corev1.Container) {
+	b.VolumeMounts = append(b.VolumeMounts, corev1.VolumeMount{
+		Name:      caTokenVolume,
+		MountPath: caTokenMountPath,
+		ReadOnly:  true,
+	})
+}
+
+// caTokenVolumeSource returns the volume projecting the service account
+// token the bootstrapper presents to the CA.
+func caTokenVolumeSource(config *Config) corev1.Volume {
+	return corev1.Volume{
+		Name: caTokenVolume,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{{
+					ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+						Audience:          config.GetServiceAccountAudience(),
+						ExpirationSeconds: ptr.To(config.ServiceAccountAuth.GetExpirationSeconds()),
+						Path:              "token",
+					},
+				}},
+			},
+		},
+	}
+}
+
+// serviceAccountServer configures the TLS of the controller server with a
+// certificate signed with the service account token of the controller. The
+// certificate is renewed with itself, like the one of ca.BootstrapServer.
+func serviceAccountServer(ctx context.Context, client *ca.Client, config *Config, base *http.Server, name string, sans ...string) (*http.Server, error) {
+	token, err := os.ReadFile(config.ServiceAccountAuth.GetTokenPath())
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading service account token")
+	}
+	csr, key, err := ca.CreateCertificateRequest(name, sans...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.SignWithContext(ctx, &api.SignRequest{
+		CsrPEM: *csr,
+		OTT:    strings.TrimSpace(string(token)),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error signing the controller certificate with the service account token")
+	}
+	tlsConfig, err := client.GetServerTLSConfig(ctx, resp, key, ca.VerifyClientCertIfGiven(), ca.AddRootsToCAs())
+	if err != nil {
+		return nil, err
+	}
+	base.TLSConfig = tlsConfig
+	return base, nil
+}
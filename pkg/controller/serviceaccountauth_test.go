@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateServiceAccountAuth(t *testing.T) {
+	enabled := ServiceAccountAuth{Enabled: true}
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"disabled", Config{TokenBinding: true}, false},
+		{"enabled", Config{ServiceAccountAuth: enabled}, false},
+		{"expiration", Config{ServiceAccountAuth: ServiceAccountAuth{Enabled: true, ExpirationSeconds: 3600}}, false},
+		{"short expiration", Config{ServiceAccountAuth: ServiceAccountAuth{Enabled: true, ExpirationSeconds: 60}}, true},
+		{"old protocol", Config{ProtocolVersion: 17, ServiceAccountAuth: enabled}, true},
+		{"tokenBinding", Config{TokenBinding: true, ServiceAccountAuth: enabled}, true},
+		{"tokenRemint", Config{TokenRemint: TokenRemint{Enabled: true}, ServiceAccountAuth: enabled}, true},
+		{"csrNamespaces", Config{CSRNamespaces: []string{"default"}, ServiceAccountAuth: enabled}, true},
+		{"secretIssuance", Config{SecretIssuance: SecretIssuance{Enabled: true}, ServiceAccountAuth: enabled}, true},
+		{"devCA", Config{DevCA: DevCA{Enabled: true}, ServiceAccountAuth: enabled}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateServiceAccountAuth(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateServiceAccountAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServiceAccountAuthPatch(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	secrets := &fakeSecrets{}
+	tokenSecrets = secrets
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+
+	rootFile, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	config := &Config{
+		CaURL:              "https://ca",
+		RootCAPath:         rootFile,
+		CertsVolume:        corev1.Volume{Name: "certs"},
+		Bootstrapper:       corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper"},
+		Renewer:            corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+		ServiceAccountAuth: ServiceAccountAuth{Enabled: true, Audience: "step-ca"},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Annotations: map[string]string{
+			admissionWebhookAnnotationKey: "api.default.svc.cluster.local",
+			sansAnnotationKey:             "api.default.svc.cluster.local,api",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "api"}}},
+	}
+
+	b, err := patch(context.Background(), pod, "default", config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []struct {
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(b, &ops); err != nil {
+		t.Fatal(err)
+	}
+	var containers []corev1.Container
+	var volumes []corev1.Volume
+	for _, op := range ops {
+		var c corev1.Container
+		var cs []corev1.Container
+		var v corev1.Volume
+		var vs []corev1.Volume
+		switch {
+		case op.Path == "/spec/initContainers" && json.Unmarshal(op.Value, &cs) == nil:
+			containers = append(containers, cs...)
+		case op.Path == "/spec/containers/-" && json.Unmarshal(op.Value, &c) == nil:
+			containers = append(containers, c)
+		case op.Path == "/spec/volumes" && json.Unmarshal(op.Value, &vs) == nil:
+			volumes = append(volumes, vs...)
+		case op.Path == "/spec/volumes/-" && json.Unmarshal(op.Value, &v) == nil:
+			volumes = append(volumes, v)
+		}
+	}
+	if len(containers) != 2 {
+		t.Fatalf("patch() added %d containers, want the bootstrapper and the renewer", len(containers))
+	}
+	env := func(c corev1.Container) map[string]corev1.EnvVar {
+		m := map[string]corev1.EnvVar{}
+		for _, e := range c.Env {
+			m[e.Name] = e
+		}
+		return m
+	}
+	bootstrapper, renewer := env(containers[0]), env(containers[1])
+	if got := bootstrapper[caTokenEnvVar].Value; got != caTokenMountPath+"/token" {
+		t.Errorf("%s = %q, want the projected token", caTokenEnvVar, got)
+	}
+	if got := bootstrapper["AUTOCERT_SANS"].Value; got != "api.default.svc.cluster.local,api" {
+		t.Errorf("AUTOCERT_SANS = %q", got)
+	}
+	for _, name := range []string{"STEP_TOKEN", "AUTOCERT_TOKEN_URL", "AUTOCERT_CLAIM"} {
+		if e, ok := bootstrapper[name]; ok {
+			t.Errorf("bootstrapper has %s = %+v, want no bootstrap token", name, e)
+		}
+	}
+	if !slices.ContainsFunc(containers[0].VolumeMounts, func(m corev1.VolumeMount) bool {
+		return m.Name == caTokenVolume && m.MountPath == caTokenMountPath
+	}) {
+		t.Errorf("bootstrapper mounts = %+v, want the service account token", containers[0].VolumeMounts)
+	}
+	if e, ok := renewer["AUTOCERT_REISSUE_URL"]; ok {
+		t.Errorf("renewer has %+v, want no re-issuance without a provisioner", e)
+	}
+	if len(secrets.created) != 0 {
+		t.Errorf("token secrets = %v, want none", secrets.created)
+	}
+
+	var projected *corev1.ServiceAccountTokenProjection
+	for _, v := range volumes {
+		if v.Name == caTokenVolume && v.Projected != nil && len(v.Projected.Sources) == 1 {
+			projected = v.Projected.Sources[0].ServiceAccountToken
+		}
+	}
+	if projected == nil || projected.Audience != "step-ca" || *projected.ExpirationSeconds != minCATokenExpiration {
+		t.Errorf("volumes = %+v, want the service account token for the CA", volumes)
+	}
+}
+
+func TestServiceAccountAuthHandler(t *testing.T) {
+	config := &Config{ServiceAccountAuth: ServiceAccountAuth{Enabled: true}}
+	h := New(config).handler("step")
+	for _, path := range []string{"/token", "/remint", "/reissue"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}")))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s = %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestServiceAccountServer(t *testing.T) {
+	config := &Config{ServiceAccountAuth: ServiceAccountAuth{Enabled: true, TokenPath: filepath.Join(t.TempDir(), "token")}}
+	if _, err := serviceAccountServer(context.Background(), nil, config, &http.Server{}, "autocert.step.svc"); err == nil {
+		t.Error("serviceAccountServer() without a token succeeded")
+	}
+}
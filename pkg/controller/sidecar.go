@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+const (
+	// sidecarRequestsAnnotationKey is set on pods with a native sidecar
+	// renewer to the requests of the renewer, so capacity tooling can tell
+	// them apart from the requests of the init containers.
+	sidecarRequestsAnnotationKey = "autocert.step.sm/sidecar-requests"
+	// nativeSidecarMinorVersion is the first minor version of Kubernetes 1
+	// with native sidecars enabled by default.
+	nativeSidecarMinorVersion = 29
+)
+
+// nativeSidecars is whether the API server supports native sidecars. It's
+// checked once at startup, the nativeSidecar feature has no effect until
+// then.
+var nativeSidecars atomic.Bool
+
+// checkNativeSidecars records whether the API server supports native
+// sidecars. Errors are logged, and native sidecars are not used.
+func checkNativeSidecars() {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		log.WithField("error", err).Warn("Error checking support for native sidecars, the nativeSidecar feature is disabled")
+		return
+	}
+	var info version.Info
+	if err := getJSON(client, "version", &info); err != nil {
+		log.WithField("error", err).Warn("Error checking support for native sidecars, the nativeSidecar feature is disabled")
+		return
+	}
+	ok := supportsNativeSidecars(info)
+	nativeSidecars.Store(ok)
+	if !ok {
+		log.WithField("version", info.GitVersion).Info("Native sidecars are not supported by the API server, the nativeSidecar feature is disabled")
+	}
+}
+
+// supportsNativeSidecars returns whether a version of Kubernetes enables
+// native sidecars by default. Minor versions of managed clusters can have a
+// suffix, like "29+".
+func supportsNativeSidecars(info version.Info) bool {
+	major, err := strconv.Atoi(info.Major)
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(strings.TrimRight(info.Minor, "+"))
+	if err != nil {
+		return false
+	}
+	return major > 1 || (major == 1 && minor >= nativeSidecarMinorVersion)
+}
+
+// useNativeSidecar returns whether the renewer of a pod runs as a native
+// sidecar.
+func useNativeSidecar(config *Config, namespace string) bool {
+	return nativeSidecars.Load() && featureEnabled(config, featureNativeSidecar, namespace)
+}
+
+// setNativeSidecar makes the renewer a restartable init container. Kubelet
+// starts it after the bootstrapper and the other init containers, keeps it
+// running along with the application containers, and stops it after them.
+func setNativeSidecar(renewer *corev1.Container) {
+	always := corev1.ContainerRestartPolicyAlways
+	renewer.RestartPolicy = &always
+}
+
+// addRenewer adds the renewer to the containers of a pod, or after its init
+// containers if it's a native sidecar. As the last init container, its
+// requests are only added to the ones of the application containers, and
+// not to the ones of the bootstrapper or of other init containers.
+func addRenewer(pod *corev1.Pod, renewer corev1.Container) []PatchOperation {
+	if renewer.RestartPolicy != nil {
+		return addContainers(pod.Spec.InitContainers, []corev1.Container{renewer}, "/spec/initContainers")
+	}
+	return addContainers(pod.Spec.Containers, []corev1.Container{renewer}, "/spec/containers")
+}
+
+// sidecarRequests returns the requests of a native sidecar renewer as a
+// comma-separated list, like "cpu=10m,memory=32Mi", or an empty string if it
+// has no requests.
+func sidecarRequests(renewer corev1.Container) string {
+	names := make([]string, 0, len(renewer.Resources.Requests))
+	for name := range renewer.Resources.Requests {
+		names = append(names, string(name))
+	}
+	slices.Sort(names)
+	requests := make([]string, len(names))
+	for i, name := range names {
+		q := renewer.Resources.Requests[corev1.ResourceName(name)]
+		requests[i] = fmt.Sprintf("%s=%s", name, q.String())
+	}
+	return strings.Join(requests, ",")
+}
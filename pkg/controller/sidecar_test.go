@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+func TestSupportsNativeSidecars(t *testing.T) {
+	tests := []struct {
+		major, minor string
+		want         bool
+	}{
+		{"1", "28", false},
+		{"1", "29", true},
+		{"1", "31+", true},
+		{"2", "0", true},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := supportsNativeSidecars(version.Info{Major: tt.major, Minor: tt.minor}); got != tt.want {
+			t.Errorf("supportsNativeSidecars(%s.%s) = %v, want %v", tt.major, tt.minor, got, tt.want)
+		}
+	}
+}
+
+func TestSidecarRequests(t *testing.T) {
+	renewer := corev1.Container{Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+		corev1.ResourceMemory: resource.MustParse("32Mi"),
+		corev1.ResourceCPU:    resource.MustParse("10m"),
+	}}}
+	if got := sidecarRequests(renewer); got != "cpu=10m,memory=32Mi" {
+		t.Errorf("sidecarRequests() = %q", got)
+	}
+	if got := sidecarRequests(corev1.Container{}); got != "" {
+		t.Errorf("sidecarRequests() without requests = %q", got)
+	}
+}
+
+// withNativeSidecars enables native sidecars for the duration of a test.
+func withNativeSidecars(t *testing.T) {
+	t.Helper()
+	saved := nativeSidecars.Load()
+	nativeSidecars.Store(true)
+	t.Cleanup(func() { nativeSidecars.Store(saved) })
+}
+
+func TestNativeSidecarPatch(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	tokenSecrets = &fakeSecrets{}
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+	withNativeSidecars(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := devCACertificate("Test Root", time.Now(), key, nil, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootFile := filepath.Join(t.TempDir(), "root.crt")
+	if err := os.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		CaURL:       "https://ca",
+		RootCAPath:  rootFile,
+		CertsVolume: corev1.Volume{Name: "certs"},
+		Bootstrapper: corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper", Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+		}},
+		Renewer: corev1.Container{Name: "autocert-renewer", Image: "renewer", Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m")},
+		}},
+		Features: map[string]string{featureNativeSidecar: "default"},
+	}
+	newPod := func(annotations map[string]string) *corev1.Pod {
+		annotations[admissionWebhookAnnotationKey] = "app.default.svc"
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: annotations},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "migrate"}},
+				Containers:     []corev1.Container{{Name: "app"}},
+			},
+		}
+	}
+	type op struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	patchOps := func(pod *corev1.Pod, namespace string) map[string][]json.RawMessage {
+		t.Helper()
+		b, err := patch(context.Background(), pod, namespace, config, fakeTokens{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ops []op
+		if err := json.Unmarshal(b, &ops); err != nil {
+			t.Fatal(err)
+		}
+		byPath := make(map[string][]json.RawMessage)
+		for _, o := range ops {
+			if o.Op == "add" {
+				byPath[o.Path] = append(byPath[o.Path], o.Value)
+			}
+		}
+		return byPath
+	}
+	containerNames := func(values []json.RawMessage) (names []string) {
+		for _, v := range values {
+			var cs []corev1.Container
+			if err := json.Unmarshal(v, &cs); err != nil {
+				var c corev1.Container
+				if err := json.Unmarshal(v, &c); err != nil {
+					t.Fatal(err)
+				}
+				cs = []corev1.Container{c}
+			}
+			for _, c := range cs {
+				name := c.Name
+				if c.RestartPolicy != nil {
+					name += "/" + string(*c.RestartPolicy)
+				}
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+
+	ops := patchOps(newPod(map[string]string{}), "default")
+	if got := containerNames(ops["/spec/initContainers/-"]); len(got) != 2 || got[0] != "autocert-bootstrapper" || got[1] != "autocert-renewer/Always" {
+		t.Errorf("init containers added = %v, want the bootstrapper and the renewer", got)
+	}
+	if len(ops["/spec/containers/-"]) != 0 {
+		t.Errorf("containers added = %s, want none", ops["/spec/containers/-"])
+	}
+	if got := string(ops["/metadata/annotations/"+escapeJSONPath(sidecarRequestsAnnotationKey)][0]); got != `"cpu=10m"` {
+		t.Errorf("sidecar requests annotation = %s", got)
+	}
+
+	// The renewer runs after the other init containers, even if the
+	// bootstrapper runs first.
+	ops = patchOps(newPod(map[string]string{firstAnnotationKey: "true"}), "default")
+	if got := containerNames(ops["/spec/initContainers"]); len(got) != 3 || got[0] != "autocert-bootstrapper" || got[1] != "migrate" || got[2] != "autocert-renewer/Always" {
+		t.Errorf("init containers = %v, want the bootstrapper first and the renewer last", got)
+	}
+
+	// Namespaces without the feature get a regular sidecar.
+	ops = patchOps(newPod(map[string]string{}), "other")
+	if got := containerNames(ops["/spec/containers/-"]); len(got) != 1 || got[0] != "autocert-renewer" {
+		t.Errorf("containers added = %v, want the renewer", got)
+	}
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// renewerStateCritical is reported by renewers whose watchdog found their
+	// certificate stale, right before they exit.
+	renewerStateCritical = "critical"
+	// staleCertificateReason is the reason of the Events recorded on pods
+	// with a stale certificate.
+	staleCertificateReason = "StaleCertificate"
+)
+
+// staleCertificates counts the certificates found stale by the renewer
+// watchdogs. Renewers restart after reporting a stale certificate, so alerts
+// should be based on the increase of the counter rather than on a state.
+var staleCertificates = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "autocert_stale_certificates_total",
+	Help: "Number of certificates found about to expire while their renewals keep failing, by namespace.",
+}, []string{"namespace"})
+
+func init() {
+	metricsRegistry.MustRegister(staleCertificates)
+}
+
+// recordStaleCertificate counts a stale certificate reported by a renewer,
+// and records a warning Event on its pod, shown by kubectl describe pod.
+func recordStaleCertificate(report renewerReport) {
+	staleCertificates.WithLabelValues(report.Namespace).Inc()
+
+	ctxLog := log.WithFields(log.Fields{
+		"namespace": report.Namespace,
+		"pod":       report.Pod,
+		"serial":    report.Status.Serial,
+		"notAfter":  report.Status.NotAfter,
+		"error":     report.Status.LastError,
+	})
+	ctxLog.Error("Certificate is stale")
+
+	go func() {
+		msg := fmt.Sprintf("The certificate expires at %s and the renewer is unable to renew it: %s", report.Status.NotAfter.Format(time.RFC3339), report.Status.LastError)
+		if err := createPodEvent(report.Namespace, report.Pod, corev1.EventTypeWarning, staleCertificateReason, msg); err != nil {
+			ctxLog.WithField("error", err).Warn("Error recording stale certificate event")
+		}
+	}()
+}
+
+// createPodEvent records an Event on a pod.
+func createPodEvent(namespace, pod, eventType, reason, message string) error {
+	return createEvent(namespace, corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  namespace,
+		Name:       pod,
+	}, eventType, reason, message)
+}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// staleCount returns the value of autocert_stale_certificates_total for the
+// given namespace.
+func staleCount(t *testing.T, namespace string) float64 {
+	t.Helper()
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "autocert_stale_certificates_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			if l := m.GetLabel(); len(l) == 1 && l[0].GetValue() == namespace {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestReportHandlerStale(t *testing.T) {
+	const namespace = "stale"
+	crt := &x509.Certificate{SerialNumber: big.NewInt(1234)}
+	send := func(state string) {
+		t.Helper()
+		body := `{"namespace":"` + namespace + `","pod":"api-1","status":{"state":"` + state + `","serial":"1234","consecutiveFailures":7,"lastError":"connection refused"}}`
+		r := httptest.NewRequest(http.MethodPost, "/status", strings.NewReader(body))
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{crt}}
+		w := httptest.NewRecorder()
+		reportHandler(w, r, &Config{})
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("reportHandler() = %d, want %d", w.Code, http.StatusNoContent)
+		}
+	}
+
+	send("backoff")
+	if got := staleCount(t, namespace); got != 0 {
+		t.Errorf("stale certificates = %v, want 0", got)
+	}
+	send(renewerStateCritical)
+	send(renewerStateCritical)
+	if got := staleCount(t, namespace); got != 2 {
+		t.Errorf("stale certificates = %v, want 2", got)
+	}
+}
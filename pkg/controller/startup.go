@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// startupProbeAnnotationKey adds a startup probe to the application
+	// containers, so they only start once the renewer confirmed the
+	// certificate.
+	startupProbeAnnotationKey = "autocert.step.sm/startup-probe"
+	// readyFileEnvVar is the readiness file written by the renewer, relative
+	// to the certificates directory.
+	readyFileEnvVar = "READY_FILE"
+	// readyFileName is the name of the readiness file.
+	readyFileName = "ready"
+	// startupProbePeriod and startupProbeFailures give the renewer 5 minutes
+	// to confirm the certificate.
+	startupProbePeriod   = 2
+	startupProbeFailures = 150
+)
+
+// startupProbe returns whether the application containers of a pod get a
+// startup probe. It returns an error if the pod has no renewer to write the
+// readiness file, or the protocol version in use doesn't support it: the
+// probe would never succeed.
+func startupProbe(pod *corev1.Pod, config *Config, bootstrapperOnly bool) (bool, error) {
+	value := pod.GetAnnotations()[startupProbeAnnotationKey]
+	if !strings.EqualFold(value, "true") {
+		return false, nil
+	}
+	if bootstrapperOnly {
+		return false, annotationErrors{{
+			Key:    startupProbeAnnotationKey,
+			Value:  value,
+			Reason: "requires a renewer, but " + bootstrapperOnlyAnnotationKey + " is set",
+		}}
+	}
+	if v := envProtocolVersions[readyFileEnvVar]; config.GetProtocolVersion() < v {
+		return false, annotationErrors{{
+			Key:    startupProbeAnnotationKey,
+			Value:  value,
+			Reason: fmt.Sprintf("requires protocol version %d, but version %d is pinned in the configuration", v, config.GetProtocolVersion()),
+		}}
+	}
+	return true, nil
+}
+
+// readyProbe returns a probe that succeeds once the readiness file exists in
+// the certificates volume.
+func readyProbe() *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			Exec: &corev1.ExecAction{
+				Command: []string{"test", "-f", path.Join(volumeMountPath, readyFileName)},
+			},
+		},
+		PeriodSeconds:    startupProbePeriod,
+		FailureThreshold: startupProbeFailures,
+	}
+}
+
+// addStartupProbes adds the readiness file probe to the containers without a
+// startup probe. Probes set on the pod are kept.
+func addStartupProbes(containers []corev1.Container) (ops []PatchOperation) {
+	for i, c := range containers {
+		if c.StartupProbe != nil {
+			continue
+		}
+		ops = append(ops, PatchOperation{
+			Op:    "add",
+			Path:  fmt.Sprintf("/spec/containers/%d/startupProbe", i),
+			Value: readyProbe(),
+		})
+	}
+	return ops
+}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStartupProbe(t *testing.T) {
+	pod := func(v string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{startupProbeAnnotationKey: v}}}
+	}
+
+	tests := []struct {
+		name             string
+		pod              *corev1.Pod
+		config           *Config
+		bootstrapperOnly bool
+		want             bool
+		wantErr          bool
+	}{
+		{"no annotation", &corev1.Pod{}, &Config{}, false, false, false},
+		{"false", pod("false"), &Config{}, false, false, false},
+		{"true", pod("true"), &Config{}, false, true, false},
+		{"bootstrapper only", pod("true"), &Config{}, true, false, true},
+		{"pinned protocol", pod("true"), &Config{ProtocolVersion: 10}, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := startupProbe(tt.pod, tt.config, tt.bootstrapperOnly)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("startupProbe() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddStartupProbes(t *testing.T) {
+	own := &corev1.Probe{PeriodSeconds: 10}
+	ops := addStartupProbes([]corev1.Container{
+		{Name: "app"},
+		{Name: "probed", StartupProbe: own},
+		{Name: "sidecar"},
+	})
+	if len(ops) != 2 {
+		t.Fatalf("addStartupProbes() = %v, want 2 operations", ops)
+	}
+	for i, want := range []string{"/spec/containers/0/startupProbe", "/spec/containers/2/startupProbe"} {
+		if ops[i].Op != "add" || ops[i].Path != want {
+			t.Errorf("addStartupProbes()[%d] = %s %s, want add %s", i, ops[i].Op, ops[i].Path, want)
+		}
+		probe := ops[i].Value.(*corev1.Probe)
+		if cmd := probe.Exec.Command; len(cmd) != 3 || cmd[2] != "/var/run/autocert.step.sm/ready" {
+			t.Errorf("addStartupProbes()[%d] command = %v", i, cmd)
+		}
+	}
+}
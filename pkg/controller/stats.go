@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultExpiringSoon is the remaining lifetime under which a
+	// certificate counts as expiring soon, unless expiringSoon is set.
+	defaultExpiringSoon = time.Hour
+	// maxReportSize limits the size of the body of a renewer report.
+	maxReportSize = 16384
+	// renewerStateStopped is reported by renewers shutting down.
+	renewerStateStopped = "stopped"
+)
+
+var (
+	// metricsRegistry holds the metrics exposed on /metrics.
+	metricsRegistry = prometheus.NewRegistry()
+
+	// renewerReports holds the last status reported by every renewer.
+	renewerReports = newReportStore()
+
+	// namespaceStats exposes the stats computed from renewerReports.
+	namespaceStats = &statsCollector{store: renewerReports}
+)
+
+func init() {
+	metricsRegistry.MustRegister(namespaceStats)
+}
+
+// GetExpiringSoon returns the remaining lifetime under which a certificate
+// counts as expiring soon, defaults to one hour.
+func (c Config) GetExpiringSoon() time.Duration {
+	d, err := time.ParseDuration(c.ExpiringSoon)
+	if err != nil || d <= 0 {
+		return defaultExpiringSoon
+	}
+	return d
+}
+
+// GetStatusURL returns the URL where renewers report their status.
+func (c Config) GetStatusURL() string {
+	return fmt.Sprintf("https://%s.%s.svc/status", c.GetServiceName(), os.Getenv("NAMESPACE"))
+}
+
+// renewerStatus is the part of the renewer status file used for the stats.
+type renewerStatus struct {
+	State               string    `json:"state"`
+	Serial              string    `json:"serial"`
+	NotAfter            time.Time `json:"notAfter"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+}
+
+// renewerReport is the body of a request to the /status endpoint, sent by
+// renewers every time their state changes.
+type renewerReport struct {
+	Namespace string        `json:"namespace"`
+	Pod       string        `json:"pod"`
+	Status    renewerStatus `json:"status"`
+	Usage     *renewerUsage `json:"usage,omitempty"`
+}
+
+// NamespaceStats are the aggregate certificate stats of a namespace.
+type NamespaceStats struct {
+	Namespace string `json:"namespace"`
+	// Active is the number of unexpired certificates.
+	Active int `json:"active"`
+	// ExpiringSoon is the number of certificates expiring within the
+	// expiringSoon threshold.
+	ExpiringSoon int `json:"expiringSoon"`
+	// FailingRenewals is the number of certificates whose last renewal
+	// attempt failed.
+	FailingRenewals int `json:"failingRenewals"`
+}
+
+// reportStore keeps the last report of every renewer, until its certificate
+// expires or the renewer stops.
+type reportStore struct {
+	sync.Mutex
+	reports map[string]renewerReport
+}
+
+func newReportStore() *reportStore {
+	return &reportStore{
+		reports: make(map[string]renewerReport),
+	}
+}
+
+// add records a report, replacing the previous one from the same renewer,
+// and returns the previous one.
+func (s *reportStore) add(r renewerReport) (renewerReport, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := r.Namespace + "/" + r.Pod
+	previous, ok := s.reports[key]
+	if r.Status.State == renewerStateStopped {
+		delete(s.reports, key)
+		return previous, ok
+	}
+	s.reports[key] = r
+	return previous, ok
+}
+
+// stats returns the stats of every namespace with an active certificate,
+// sorted by namespace, and forgets expired certificates.
+func (s *reportStore) stats(now time.Time, expiringSoon time.Duration) []NamespaceStats {
+	s.Lock()
+	defer s.Unlock()
+
+	byNamespace := make(map[string]*NamespaceStats)
+	for key, r := range s.reports {
+		if !now.Before(r.Status.NotAfter) {
+			delete(s.reports, key)
+			continue
+		}
+		ns, ok := byNamespace[r.Namespace]
+		if !ok {
+			ns = &NamespaceStats{Namespace: r.Namespace}
+			byNamespace[r.Namespace] = ns
+		}
+		ns.Active++
+		if r.Status.NotAfter.Sub(now) < expiringSoon {
+			ns.ExpiringSoon++
+		}
+		if r.Status.ConsecutiveFailures > 0 {
+			ns.FailingRenewals++
+		}
+	}
+
+	stats := make([]NamespaceStats, 0, len(byNamespace))
+	for _, ns := range byNamespace {
+		stats = append(stats, *ns)
+	}
+	slices.SortFunc(stats, func(a, b NamespaceStats) int {
+		return strings.Compare(a.Namespace, b.Namespace)
+	})
+	return stats
+}
+
+var (
+	certificatesDesc = prometheus.NewDesc("autocert_namespace_certificates",
+		"Number of active certificates in the namespace.", []string{"namespace"}, nil)
+	expiringSoonDesc = prometheus.NewDesc("autocert_namespace_certificates_expiring_soon",
+		"Number of certificates in the namespace expiring within the expiringSoon threshold.", []string{"namespace"}, nil)
+	failingRenewalsDesc = prometheus.NewDesc("autocert_namespace_renewals_failing",
+		"Number of certificates in the namespace whose last renewal attempt failed.", []string{"namespace"}, nil)
+)
+
+// statsCollector exposes the namespace stats as Prometheus metrics, computed
+// at scrape time. expiringSoon is set from the configuration before the
+// server starts.
+type statsCollector struct {
+	store        *reportStore
+	expiringSoon time.Duration
+}
+
+// Describe implements prometheus.Collector.
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certificatesDesc
+	ch <- expiringSoonDesc
+	ch <- failingRenewalsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	expiringSoon := c.expiringSoon
+	if expiringSoon == 0 {
+		expiringSoon = defaultExpiringSoon
+	}
+	for _, ns := range c.store.stats(time.Now(), expiringSoon) {
+		ch <- prometheus.MustNewConstMetric(certificatesDesc, prometheus.GaugeValue, float64(ns.Active), ns.Namespace)
+		ch <- prometheus.MustNewConstMetric(expiringSoonDesc, prometheus.GaugeValue, float64(ns.ExpiringSoon), ns.Namespace)
+		ch <- prometheus.MustNewConstMetric(failingRenewalsDesc, prometheus.GaugeValue, float64(ns.FailingRenewals), ns.Namespace)
+	}
+}
+
+// reportHandler records the status reported by a renewer. Renewers
+// authenticate with their certificate, and can only report on that
+// certificate. With renewerAuth.bindToken, they can only report on their own
+// pod.
+func reportHandler(w http.ResponseWriter, r *http.Request, config *Config) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "Unauthorized (Missing Client Certificate)", http.StatusUnauthorized)
+		return
+	}
+
+	var report renewerReport
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxReportSize)).Decode(&report); err != nil || report.Namespace == "" || report.Pod == "" {
+		log.Error("Bad Request: 400 (Invalid Report)")
+		http.Error(w, "Bad Request (Invalid Report)", http.StatusBadRequest)
+		return
+	}
+	if !reportAllowed(r.TLS.PeerCertificates[0], report) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if _, err := authorizeRenewer(r, config, report.Namespace, report.Pod); err != nil {
+		renewerAuthError(w, r, report.Namespace, report.Pod, err)
+		return
+	}
+
+	previous, _ := renewerReports.add(report)
+	switch report.Status.State {
+	case renewerStateCritical:
+		recordStaleCertificate(report)
+	case renewerStateUnwritable:
+		recordUnwritableCertificate(report, previous.Status.State != renewerStateUnwritable)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reportAllowed returns whether the given client certificate may send a
+// report. Reports on a certificate other than the client one are rejected.
+func reportAllowed(crt *x509.Certificate, report renewerReport) bool {
+	return crt.SerialNumber.String() == report.Status.Serial
+}
+
+// statsHandler returns the stats of every namespace, or of the one given in
+// the namespace query parameter, as JSON.
+func statsHandler(w http.ResponseWriter, r *http.Request, config *Config) {
+	stats := renewerReports.stats(time.Now(), config.GetExpiringSoon())
+	if namespace := r.URL.Query().Get("namespace"); namespace != "" {
+		stats = slices.DeleteFunc(stats, func(ns NamespaceStats) bool { return ns.Namespace != namespace })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.WithField("error", err).Info("Write error")
+	}
+}
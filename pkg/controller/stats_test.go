@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"crypto/x509"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestReportStore(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	report := func(namespace, pod string, remaining time.Duration, failures int) renewerReport {
+		return renewerReport{
+			Namespace: namespace,
+			Pod:       pod,
+			Status: renewerStatus{
+				State:               "waiting",
+				NotAfter:            now.Add(remaining),
+				ConsecutiveFailures: failures,
+			},
+		}
+	}
+
+	s := newReportStore()
+	s.add(report("payments", "api-1", 8*time.Hour, 0))
+	s.add(report("payments", "api-2", 30*time.Minute, 3))
+	s.add(report("default", "web-1", -time.Minute, 0))
+	s.add(report("default", "web-2", 8*time.Hour, 0))
+	s.add(report("default", "web-3", 8*time.Hour, 0))
+	s.add(renewerReport{Namespace: "default", Pod: "web-3", Status: renewerStatus{State: renewerStateStopped}})
+
+	want := []NamespaceStats{
+		{Namespace: "default", Active: 1},
+		{Namespace: "payments", Active: 2, ExpiringSoon: 1, FailingRenewals: 1},
+	}
+	if got := s.stats(now, time.Hour); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats() = %+v, want %+v", got, want)
+	}
+	if _, ok := s.reports["default/web-1"]; ok {
+		t.Error("stats() should forget expired certificates")
+	}
+
+	// A renewal replaces the previous report.
+	s.add(report("payments", "api-2", 8*time.Hour, 0))
+	want[1] = NamespaceStats{Namespace: "payments", Active: 2}
+	if got := s.stats(now, time.Hour); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestStatsCollector(t *testing.T) {
+	s := newReportStore()
+	s.add(renewerReport{Namespace: "payments", Pod: "api-1", Status: renewerStatus{NotAfter: time.Now().Add(time.Hour), ConsecutiveFailures: 1}})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&statsCollector{store: s, expiringSoon: 2 * time.Hour})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			if l := m.GetLabel(); len(l) != 1 || l[0].GetValue() != "payments" {
+				t.Errorf("%s labels = %v, want namespace payments", f.GetName(), l)
+			}
+			got[f.GetName()] = m.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{
+		"autocert_namespace_certificates":               1,
+		"autocert_namespace_certificates_expiring_soon": 1,
+		"autocert_namespace_renewals_failing":           1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("metrics = %v, want %v", got, want)
+	}
+}
+
+func TestReportAllowed(t *testing.T) {
+	crt := &x509.Certificate{SerialNumber: big.NewInt(1234)}
+	if !reportAllowed(crt, renewerReport{Status: renewerStatus{Serial: "1234"}}) {
+		t.Error("reportAllowed() should allow reports on the client certificate")
+	}
+	if reportAllowed(crt, renewerReport{Status: renewerStatus{Serial: "5678"}}) {
+		t.Error("reportAllowed() should reject reports on other certificates")
+	}
+}
@@ -0,0 +1,561 @@
+package controller
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/ca"
+	"go.step.sm/crypto/pemutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// trustBundleEnvVar is the URL renewers refresh the roots of the pod
+	// from.
+	trustBundleEnvVar = "AUTOCERT_TRUST_BUNDLE_URL"
+	// trustBundleLabel identifies the ConfigMaps holding the trust bundle.
+	trustBundleLabel           = "autocert.step.sm/trust-bundle"
+	trustBundleSelector        = trustBundleLabel + "=true"
+	defaultTrustBundleName     = "autocert-trust-bundle"
+	defaultTrustBundleInterval = time.Minute
+	trustBundleListLimit       = 500
+
+	// The keys of the ConfigMap: the roots, the intermediates, and both.
+	trustBundleRootsKey         = "roots.pem"
+	trustBundleIntermediatesKey = "intermediates.pem"
+	trustBundleKey              = "bundle.pem"
+)
+
+// TrustBundle distributes the roots of the CA, and its intermediates, in a
+// ConfigMap replicated to the selected namespaces, and to the roots of the
+// pods through their renewers. Adding a new root to the bundle before the
+// CA signs with it lets the root be rotated without restarting the pods.
+// The controller needs permission to list namespaces and to manage
+// ConfigMaps.
+type TrustBundle struct {
+	Enabled bool `yaml:"enabled"`
+	// Name is the name of the ConfigMaps, defaults to autocert-trust-bundle.
+	Name string `yaml:"name"`
+	// NamespaceSelector selects the namespaces the ConfigMap is replicated
+	// to, defaults to the namespaces with autocert enabled.
+	NamespaceSelector *metav1.LabelSelector `yaml:"namespaceSelector"`
+	// IncomingRootPath is the path of the roots being rotated in, added to
+	// the bundle before the CA signs with them. The file is read on every
+	// refresh and may not exist.
+	IncomingRootPath string `yaml:"incomingRootPath"`
+	// Interval is how often the bundle is refreshed and replicated,
+	// defaults to 1m.
+	Interval string `yaml:"interval"`
+}
+
+// GetName returns the name of the ConfigMaps, defaults to
+// autocert-trust-bundle.
+func (t TrustBundle) GetName() string {
+	return cmp.Or(t.Name, defaultTrustBundleName)
+}
+
+// GetInterval returns how often the bundle is refreshed, defaults to 1m.
+func (t TrustBundle) GetInterval() time.Duration {
+	d, err := time.ParseDuration(t.Interval)
+	if err != nil || d <= 0 {
+		return defaultTrustBundleInterval
+	}
+	return d
+}
+
+// GetNamespaceSelector returns the selector of the namespaces the ConfigMap
+// is replicated to, defaults to the namespaces with autocert enabled.
+func (t TrustBundle) GetNamespaceSelector() *metav1.LabelSelector {
+	if t.NamespaceSelector != nil {
+		return t.NamespaceSelector
+	}
+	return &metav1.LabelSelector{MatchLabels: map[string]string{webhookName: "enabled"}}
+}
+
+// validateTrustBundle returns an error if the trust bundle configuration is
+// not valid.
+func validateTrustBundle(c *Config) error {
+	t := c.TrustBundle
+	if !t.Enabled {
+		return nil
+	}
+	if v := envProtocolVersions[trustBundleEnvVar]; c.GetProtocolVersion() < v {
+		return fmt.Errorf("trustBundle requires protocolVersion %d or later", v)
+	}
+	if t.Interval != "" {
+		if d, err := time.ParseDuration(t.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid trustBundle.interval %q, it must be a positive duration", t.Interval)
+		}
+	}
+	if t.Name != "" {
+		if errs := validation.IsDNS1123Subdomain(t.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid trustBundle.name %q: %s", t.Name, strings.Join(errs, ", "))
+		}
+	}
+	if _, err := metav1.LabelSelectorAsSelector(t.NamespaceSelector); err != nil {
+		return errors.Wrap(err, "invalid trustBundle.namespaceSelector")
+	}
+	return nil
+}
+
+// GetTrustBundleURL returns the URL used by renewers to refresh the roots of
+// the pods.
+func (c Config) GetTrustBundleURL() string {
+	return fmt.Sprintf("https://%s.%s.svc/trust-bundle", c.GetServiceName(), os.Getenv("NAMESPACE"))
+}
+
+// setTrustBundle configures the renewer to refresh the roots of the pod.
+func setTrustBundle(config *Config, r *corev1.Container) {
+	r.Env = setEnv(r.Env, corev1.EnvVar{
+		Name:  trustBundleEnvVar,
+		Value: config.GetTrustBundleURL(),
+	})
+}
+
+var (
+	trustBundleCertificates = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "autocert_trust_bundle_certificates",
+		Help: "Number of certificates in the trust bundle, by kind.",
+	}, []string{"kind"})
+	trustBundleReplications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autocert_trust_bundle_replications_total",
+		Help: "Number of writes of the trust bundle ConfigMaps, by operation and result.",
+	}, []string{"operation", "result"})
+	trustBundleErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "autocert_trust_bundle_errors_total",
+		Help: "Number of errors building the trust bundle or listing the namespaces it's replicated to.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(trustBundleCertificates, trustBundleReplications, trustBundleErrors)
+}
+
+// trustBundle holds the PEM encoded certificates of the bundle.
+type trustBundle struct {
+	Roots         []byte
+	Intermediates []byte
+}
+
+// data returns the data of the ConfigMaps.
+func (b *trustBundle) data() map[string]string {
+	return map[string]string{
+		trustBundleRootsKey:         string(b.Roots),
+		trustBundleIntermediatesKey: string(b.Intermediates),
+		trustBundleKey:              string(b.Roots) + string(b.Intermediates),
+	}
+}
+
+// trustBundles builds and replicates the trust bundle of the controller.
+var trustBundles = &trustBundleDistributor{
+	listNamespaces: listNamespaces,
+	list:           listTrustBundles,
+	create:         createConfigMap,
+	update:         updateConfigMap,
+	delete:         deleteConfigMap,
+}
+
+// trustBundleDistributor builds the trust bundle on every replica, to serve
+// it to the renewers, and replicates it to the namespaces on the leader.
+type trustBundleDistributor struct {
+	// roots and intermediates return the certificates served by the CA,
+	// set when the controller starts.
+	roots         func() ([]*x509.Certificate, error)
+	intermediates func() ([]*x509.Certificate, error)
+
+	listNamespaces func(selector string) ([]corev1.Namespace, error)
+	// list returns the trust bundle ConfigMaps of every namespace.
+	list   func() ([]corev1.ConfigMap, error)
+	create func(cm *corev1.ConfigMap) error
+	update func(cm *corev1.ConfigMap) error
+	delete func(namespace, name string) error
+
+	// leading is set while the replica is the leader.
+	leading atomic.Bool
+
+	mu      sync.Mutex
+	current *trustBundle
+}
+
+// get returns the last bundle built, nil if none was.
+func (d *trustBundleDistributor) get() *trustBundle {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current
+}
+
+// lead replicates the bundle until the context is canceled, when the
+// replica stops being the leader.
+func (d *trustBundleDistributor) lead(ctx context.Context) {
+	d.leading.Store(true)
+	go func() {
+		<-ctx.Done()
+		d.leading.Store(false)
+	}()
+}
+
+// run refreshes the bundle every interval until the context is canceled,
+// and replicates it while the replica is the leader.
+func (d *trustBundleDistributor) run(ctx context.Context, config *Config) {
+	t := config.TrustBundle
+	interval := t.GetInterval()
+	log.WithFields(log.Fields{
+		"name":     t.GetName(),
+		"interval": interval,
+	}).Info("Distributing the trust bundle")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.refresh(config); err != nil {
+			trustBundleErrors.Inc()
+			log.WithField("error", err).Error("Error building the trust bundle")
+		} else if d.leading.Load() {
+			if err := d.replicate(config, d.get()); err != nil {
+				trustBundleErrors.Inc()
+				log.WithField("error", err).Error("Error replicating the trust bundle")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh builds the bundle: the roots in rootCAPath, the roots served by
+// the CA and the incoming roots, then the intermediates served by the CA.
+func (d *trustBundleDistributor) refresh(config *Config) error {
+	roots, err := pemutil.ReadCertificateBundle(config.GetRootCAPath())
+	if err != nil {
+		return errors.Wrap(err, "error reading root certificate")
+	}
+	if d.roots != nil {
+		served, err := d.roots()
+		if err != nil {
+			return errors.Wrap(err, "error getting the roots of the CA")
+		}
+		roots = append(roots, served...)
+	}
+	if path := config.TrustBundle.IncomingRootPath; path != "" {
+		incoming, err := pemutil.ReadCertificateBundle(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return errors.Wrap(err, "error reading the incoming roots")
+		default:
+			roots = append(roots, incoming...)
+		}
+	}
+	var intermediates []*x509.Certificate
+	if d.intermediates != nil {
+		if intermediates, err = d.intermediates(); err != nil {
+			return errors.Wrap(err, "error getting the intermediates of the CA")
+		}
+	}
+
+	roots, intermediates = uniqueCertificates(roots), uniqueCertificates(intermediates)
+	bundle := &trustBundle{Roots: encodeCertificates(roots), Intermediates: encodeCertificates(intermediates)}
+	trustBundleCertificates.WithLabelValues("root").Set(float64(len(roots)))
+	trustBundleCertificates.WithLabelValues("intermediate").Set(float64(len(intermediates)))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.current == nil || !bytes.Equal(d.current.Roots, bundle.Roots) || !bytes.Equal(d.current.Intermediates, bundle.Intermediates) {
+		log.WithFields(log.Fields{
+			"roots":         len(roots),
+			"intermediates": len(intermediates),
+		}).Info("Trust bundle changed")
+	}
+	d.current = bundle
+	return nil
+}
+
+// uniqueCertificates returns certs without duplicates, in order.
+func uniqueCertificates(certs []*x509.Certificate) []*x509.Certificate {
+	seen := make(map[string]bool, len(certs))
+	var out []*x509.Certificate
+	for _, crt := range certs {
+		if !seen[string(crt.Raw)] {
+			seen[string(crt.Raw)] = true
+			out = append(out, crt)
+		}
+	}
+	return out
+}
+
+// encodeCertificates returns the PEM encoding of certs.
+func encodeCertificates(certs []*x509.Certificate) []byte {
+	var out []byte
+	for _, crt := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})...)
+	}
+	return out
+}
+
+// replicate creates or updates the ConfigMap of every selected namespace,
+// and deletes the ones of the namespaces no longer selected. ConfigMaps with
+// the same name not created by the controller are left untouched.
+func (d *trustBundleDistributor) replicate(config *Config, bundle *trustBundle) error {
+	name := config.TrustBundle.GetName()
+	selector, err := metav1.LabelSelectorAsSelector(config.TrustBundle.GetNamespaceSelector())
+	if err != nil {
+		return err
+	}
+	namespaces, err := d.listNamespaces(selector.String())
+	if err != nil {
+		return errors.Wrap(err, "error listing namespaces")
+	}
+	configMaps, err := d.list()
+	if err != nil {
+		return errors.Wrap(err, "error listing trust bundles")
+	}
+	existing := make(map[string]*corev1.ConfigMap, len(configMaps))
+	for i := range configMaps {
+		if cm := &configMaps[i]; cm.Name == name {
+			existing[cm.Namespace] = cm
+		}
+	}
+
+	data := bundle.data()
+	selected := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		// The ConfigMaps of terminating namespaces go away with them.
+		selected[ns.Name] = true
+		if ns.DeletionTimestamp != nil {
+			continue
+		}
+		cm := existing[ns.Name]
+		switch {
+		case cm == nil:
+			d.write("create", ns.Name, d.create(&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: ns.Name,
+					Labels:    map[string]string{trustBundleLabel: "true"},
+				},
+				Data: data,
+			}))
+		case !equalData(cm.Data, data):
+			cm = cm.DeepCopy()
+			cm.Data = data
+			d.write("update", ns.Name, d.update(cm))
+		}
+	}
+	for _, ns := range slices.Sorted(maps.Keys(existing)) {
+		if !selected[ns] {
+			d.write("delete", ns, d.delete(ns, name))
+		}
+	}
+	return nil
+}
+
+// write records the result of a write of the ConfigMap of a namespace.
+func (d *trustBundleDistributor) write(operation, namespace string, err error) {
+	if err != nil {
+		trustBundleReplications.WithLabelValues(operation, "error").Inc()
+		log.WithFields(log.Fields{
+			"namespace": namespace,
+			"operation": operation,
+			"error":     err,
+		}).Error("Error replicating the trust bundle")
+		return
+	}
+	trustBundleReplications.WithLabelValues(operation, "success").Inc()
+	log.WithFields(log.Fields{
+		"namespace": namespace,
+		"operation": operation,
+	}).Info("Replicated the trust bundle")
+}
+
+func equalData(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// trustBundleHandler serves the roots of the bundle to the renewers.
+func trustBundleHandler(w http.ResponseWriter) {
+	bundle := trustBundles.get()
+	if bundle == nil {
+		http.Error(w, "trust bundle not available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(bundle.Roots) //nolint:errcheck // write errors are unactionable
+}
+
+// caIntermediates returns the intermediates served by the CA of the
+// controller, none if the CA doesn't serve them.
+func (c *Controller) caIntermediates() ([]*x509.Certificate, error) {
+	return fetchIntermediates(c.currentCA())
+}
+
+// fetchIntermediates gets the intermediates served by a CA at
+// /intermediates.pem. Older CAs don't serve them.
+func fetchIntermediates(client *ca.Client) ([]*x509.Certificate, error) {
+	u, err := url.JoinPath(client.GetCaURL(), "intermediates.pem")
+	if err != nil {
+		return nil, err
+	}
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    client.GetRootCAs(),
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: tr, Timeout: 10 * time.Second}).Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNotImplemented:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, errors.New(resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return pemutil.ParseCertificateBundle(b)
+}
+
+// listNamespaces returns the namespaces matching a label selector.
+func listNamespaces(selector string) ([]corev1.Namespace, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []corev1.Namespace
+	query := url.Values{"labelSelector": {selector}, "limit": {fmt.Sprint(trustBundleListLimit)}}
+	for {
+		var list corev1.NamespaceList
+		if err := getJSON(client, "api/v1/namespaces?"+query.Encode(), &list); err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, list.Items...)
+		if list.Continue == "" {
+			return namespaces, nil
+		}
+		query.Set("continue", list.Continue)
+	}
+}
+
+// listTrustBundles returns the ConfigMaps of every namespace created by the
+// controller for the trust bundle.
+func listTrustBundles() ([]corev1.ConfigMap, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	var configMaps []corev1.ConfigMap
+	query := url.Values{"labelSelector": {trustBundleSelector}, "limit": {fmt.Sprint(trustBundleListLimit)}}
+	for {
+		var list corev1.ConfigMapList
+		if err := getJSON(client, "api/v1/configmaps?"+query.Encode(), &list); err != nil {
+			return nil, err
+		}
+		configMaps = append(configMaps, list.Items...)
+		if list.Continue == "" {
+			return configMaps, nil
+		}
+		query.Set("continue", list.Continue)
+	}
+}
+
+func createConfigMap(cm *corev1.ConfigMap) error {
+	return sendConfigMap(http.MethodPost, fmt.Sprintf("api/v1/namespaces/%s/configmaps", cm.Namespace), cm)
+}
+
+// updateConfigMap replaces a ConfigMap. The resource version of cm makes the
+// update fail if it was modified since it was listed.
+func updateConfigMap(cm *corev1.ConfigMap) error {
+	return sendConfigMap(http.MethodPut, fmt.Sprintf("api/v1/namespaces/%s/configmaps/%s", cm.Namespace, cm.Name), cm)
+}
+
+func sendConfigMap(method, path string, cm *corev1.ConfigMap) error {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(cm)
+	if err != nil {
+		return err
+	}
+	var req *http.Request
+	if method == http.MethodPost {
+		req, err = client.PostRequest(path, string(body), "application/json")
+	} else {
+		req, err = client.PutRequest(path, string(body), "application/json")
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+func deleteConfigMap(namespace, name string) error {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return err
+	}
+	req, err := client.DeleteRequest(fmt.Sprintf("api/v1/namespaces/%s/configmaps/%s", namespace, name))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.step.sm/crypto/pemutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateTrustBundle(t *testing.T) {
+	tests := []struct {
+		name    string
+		t       TrustBundle
+		version int
+		wantErr bool
+	}{
+		{"disabled", TrustBundle{Interval: "soon"}, 1, false},
+		{"defaults", TrustBundle{Enabled: true}, 0, false},
+		{"all", TrustBundle{Enabled: true, Name: "cluster-roots", Interval: "30s", IncomingRootPath: "/home/step/incoming/root.crt"}, 0, false},
+		{"protocol", TrustBundle{Enabled: true}, 23, true},
+		{"interval", TrustBundle{Enabled: true, Interval: "-1m"}, 0, true},
+		{"name", TrustBundle{Enabled: true, Name: "Cluster_Roots"}, 0, true},
+		{"selector", TrustBundle{Enabled: true, NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "tier", Operator: "Near"},
+		}}}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTrustBundle(&Config{TrustBundle: tt.t, ProtocolVersion: tt.version})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateTrustBundle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrustBundleRefresh(t *testing.T) {
+	rootFile, intermediateFile := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	incomingFile, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	root, err := pemutil.ReadCertificate(rootFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := pemutil.ReadCertificate(intermediateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPEM, _ := os.ReadFile(rootFile)
+	incomingPEM, _ := os.ReadFile(incomingFile)
+	intermediatePEM, _ := os.ReadFile(intermediateFile)
+
+	d := &trustBundleDistributor{
+		// The CA serves the root in rootCAPath, it's only listed once.
+		roots:         func() ([]*x509.Certificate, error) { return []*x509.Certificate{root}, nil },
+		intermediates: func() ([]*x509.Certificate, error) { return []*x509.Certificate{intermediate, intermediate}, nil },
+	}
+	config := &Config{
+		RootCAPath:  rootFile,
+		TrustBundle: TrustBundle{Enabled: true, IncomingRootPath: filepath.Join(t.TempDir(), "incoming.crt")},
+	}
+	if err := d.refresh(config); err != nil {
+		t.Fatal(err)
+	}
+	if b := d.get(); string(b.Roots) != string(rootPEM) || string(b.Intermediates) != string(intermediatePEM) {
+		t.Errorf("refresh() without incoming roots = %+v, want the root and the intermediate", b)
+	}
+
+	config.TrustBundle.IncomingRootPath = incomingFile
+	if err := d.refresh(config); err != nil {
+		t.Fatal(err)
+	}
+	if b := d.get(); string(b.Roots) != string(rootPEM)+string(incomingPEM) {
+		t.Errorf("refresh() roots = %s, want the root and the incoming root", b.Roots)
+	}
+
+	d.intermediates = func() ([]*x509.Certificate, error) { return nil, os.ErrDeadlineExceeded }
+	if err := d.refresh(config); err == nil {
+		t.Error("refresh() ignored an error getting the intermediates")
+	}
+}
+
+func TestTrustBundleReplicate(t *testing.T) {
+	bundle := &trustBundle{Roots: []byte("roots"), Intermediates: []byte("intermediates")}
+	configMap := func(namespace string, data map[string]string) corev1.ConfigMap {
+		return corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: defaultTrustBundleName, Namespace: namespace, Labels: map[string]string{trustBundleLabel: "true"}},
+			Data:       data,
+		}
+	}
+	var selector string
+	var writes []string
+	d := &trustBundleDistributor{
+		listNamespaces: func(s string) ([]corev1.Namespace, error) {
+			selector = s
+			return []corev1.Namespace{
+				{ObjectMeta: metav1.ObjectMeta{Name: "new"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "stale"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "current"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "terminating", DeletionTimestamp: &metav1.Time{}}},
+			}, nil
+		},
+		list: func() ([]corev1.ConfigMap, error) {
+			other := configMap("new", nil)
+			other.Name = "other-bundle"
+			return []corev1.ConfigMap{
+				other,
+				configMap("stale", map[string]string{trustBundleRootsKey: "old roots"}),
+				configMap("current", bundle.data()),
+				configMap("terminating", bundle.data()),
+				configMap("disabled", bundle.data()),
+			}, nil
+		},
+		create: func(cm *corev1.ConfigMap) error {
+			if !equalData(cm.Data, bundle.data()) || cm.Labels[trustBundleLabel] != "true" {
+				t.Errorf("create() = %+v, want the labeled bundle", cm)
+			}
+			writes = append(writes, "create "+cm.Namespace)
+			return nil
+		},
+		update: func(cm *corev1.ConfigMap) error {
+			if cm.Data[trustBundleKey] != "rootsintermediates" {
+				t.Errorf("update() data = %v, want the bundle", cm.Data)
+			}
+			writes = append(writes, "update "+cm.Namespace)
+			return nil
+		},
+		delete: func(namespace, name string) error {
+			writes = append(writes, "delete "+namespace+"/"+name)
+			return nil
+		},
+	}
+	if err := d.replicate(&Config{}, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if selector != webhookName+"=enabled" {
+		t.Errorf("replicate() listed namespaces with %q, want the namespaces with autocert enabled", selector)
+	}
+	want := "create new,update stale,delete disabled/" + defaultTrustBundleName
+	if got := strings.Join(writes, ","); got != want {
+		t.Errorf("replicate() wrote %s, want %s", got, want)
+	}
+}
+
+func TestTrustBundleHandler(t *testing.T) {
+	defer func(d *trustBundleDistributor) { trustBundles = d }(trustBundles)
+	trustBundles = &trustBundleDistributor{}
+
+	w := httptest.NewRecorder()
+	trustBundleHandler(w)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("trustBundleHandler() without a bundle = %d, want 503", w.Code)
+	}
+
+	trustBundles.current = &trustBundle{Roots: []byte("roots"), Intermediates: []byte("intermediates")}
+	w = httptest.NewRecorder()
+	trustBundleHandler(w)
+	if w.Code != http.StatusOK || w.Body.String() != "roots" {
+		t.Errorf("trustBundleHandler() = %d %q, want the roots", w.Code, w.Body.String())
+	}
+}
+
+func TestTrustBundlePatch(t *testing.T) {
+	defer func(m SecretManager) { tokenSecrets = m }(tokenSecrets)
+	tokenSecrets = &fakeSecrets{}
+	defer func(s *featureState) { featureFlags = s }(featureFlags)
+	featureFlags = &featureState{fetch: func(string) (map[string]string, error) { return nil, nil }}
+	defer func(c *namespaceCache) { namespaceLabels = c }(namespaceLabels)
+	namespaceLabels = &namespaceCache{fetch: func(namespace string) (map[string]string, error) {
+		return map[string]string{"environment": namespace}, nil
+	}}
+	t.Setenv("NAMESPACE", "step")
+
+	rootFile, _ := constrainedCA(t, t.TempDir(), &x509.Certificate{IsCA: true})
+	stagingRoot, err := pemutil.ReadCertificate(rootFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"environment": "staging"}}
+	config := &Config{
+		CaURL:        "https://ca",
+		RootCAPath:   rootFile,
+		CertsVolume:  corev1.Volume{Name: "certs"},
+		Bootstrapper: corev1.Container{Name: "autocert-bootstrapper", Image: "bootstrapper"},
+		Renewer:      corev1.Container{Name: "autocert-renewer", Image: "renewer"},
+		TrustBundle:  TrustBundle{Enabled: true},
+		CertificateAuthorities: []CertificateAuthority{{
+			Name:              "staging",
+			CaURL:             "https://staging-ca",
+			NamespaceSelector: selector,
+			root:              stagingRoot,
+			tokens:            namedTokens("staging"),
+		}},
+	}
+	config.CertificateAuthorities[0].selector, _ = metav1.LabelSelectorAsSelector(selector)
+
+	renewerEnv := func(namespace string) map[string]string {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Annotations: map[string]string{admissionWebhookAnnotationKey: "api." + namespace + ".svc"}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "api"}}},
+		}
+		b, err := patch(context.Background(), pod, namespace, config, fakeTokens{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ops []PatchOperation
+		if err := json.Unmarshal(b, &ops); err != nil {
+			t.Fatal(err)
+		}
+		doc, err := toJSONValue(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err = json.Marshal(applyPatch(t, doc, ops))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var patched corev1.Pod
+		if err := json.Unmarshal(b, &patched); err != nil {
+			t.Fatal(err)
+		}
+		env := make(map[string]string)
+		for _, c := range append(patched.Spec.InitContainers, patched.Spec.Containers...) {
+			if c.Name == "autocert-renewer" {
+				for _, e := range c.Env {
+					env[e.Name] = e.Value
+				}
+			}
+		}
+		return env
+	}
+
+	if got := renewerEnv("payments")[trustBundleEnvVar]; got != "https://autocert.step.svc/trust-bundle" {
+		t.Errorf("%s = %q, want the trust bundle of the controller", trustBundleEnvVar, got)
+	}
+	// The bundle holds the roots of the CA in the configuration.
+	if got, ok := renewerEnv("staging")[trustBundleEnvVar]; ok {
+		t.Errorf("%s = %q for a pod of another CA, want it unset", trustBundleEnvVar, got)
+	}
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// renewerStateUnwritable is reported by renewers unable to write a
+	// renewed certificate because the volume is full or read-only. They keep
+	// the previous certificate and retry the write.
+	renewerStateUnwritable = "unwritable"
+	// unwritableCertificateReason is the reason of the Events recorded on
+	// pods whose renewed certificate can't be written.
+	unwritableCertificateReason = "CertificateWriteFailed"
+)
+
+// unwritableCertificates counts the failed writes of renewed certificates
+// reported by the renewers, usually caused by node disk pressure.
+var unwritableCertificates = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "autocert_certificate_write_failures_total",
+	Help: "Number of renewed certificates that couldn't be written because the volume is full or read-only, by namespace.",
+}, []string{"namespace"})
+
+func init() {
+	metricsRegistry.MustRegister(unwritableCertificates)
+}
+
+// recordUnwritableCertificate counts a failed write reported by a renewer.
+// A warning Event is recorded on its pod when the renewer wasn't failing to
+// write already, so retries don't flood the pod events.
+func recordUnwritableCertificate(report renewerReport, first bool) {
+	unwritableCertificates.WithLabelValues(report.Namespace).Inc()
+	if !first {
+		return
+	}
+
+	ctxLog := log.WithFields(log.Fields{
+		"namespace": report.Namespace,
+		"pod":       report.Pod,
+		"serial":    report.Status.Serial,
+		"error":     report.Status.LastError,
+	})
+	ctxLog.Warn("Renewed certificate can't be written")
+
+	go func() {
+		msg := fmt.Sprintf("The renewed certificate can't be written, the renewer keeps the certificate expiring at %s and retries: %s", report.Status.NotAfter.Format(time.RFC3339), report.Status.LastError)
+		if err := createPodEvent(report.Namespace, report.Pod, corev1.EventTypeWarning, unwritableCertificateReason, msg); err != nil {
+			ctxLog.WithField("error", err).Warn("Error recording certificate write failure event")
+		}
+	}()
+}
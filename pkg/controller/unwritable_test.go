@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReportHandlerUnwritable(t *testing.T) {
+	const namespace = "unwritable"
+	crt := &x509.Certificate{SerialNumber: big.NewInt(1234)}
+	send := func(state string) {
+		t.Helper()
+		body := `{"namespace":"` + namespace + `","pod":"api-1","status":{"state":"` + state + `","serial":"1234","consecutiveFailures":1,"lastError":"write certificate: no space left on device"}}`
+		r := httptest.NewRequest(http.MethodPost, "/status", strings.NewReader(body))
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{crt}}
+		w := httptest.NewRecorder()
+		reportHandler(w, r, &Config{})
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("reportHandler() = %d, want %d", w.Code, http.StatusNoContent)
+		}
+	}
+	count := func() float64 {
+		t.Helper()
+		families, err := metricsRegistry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range families {
+			if f.GetName() != "autocert_certificate_write_failures_total" {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				if l := m.GetLabel(); len(l) == 1 && l[0].GetValue() == namespace {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+		return 0
+	}
+
+	send("waiting")
+	if got := count(); got != 0 {
+		t.Errorf("write failures = %v, want 0", got)
+	}
+	send(renewerStateUnwritable)
+	send(renewerStateUnwritable)
+	if got := count(); got != 2 {
+		t.Errorf("write failures = %v, want 2", got)
+	}
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/smallstep/autocert/pkg/keystore"
+	"github.com/smallstep/autocert/pkg/otlp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// protocolVersion is the version of the environment variables injected
+	// by the controller in the bootstrapper and renewer containers. It must
+	// be increased every time a variable is added or its meaning changes.
+	protocolVersion = 25
+	// minProtocolVersion is the oldest protocol version the controller can
+	// still emit, so the controller can be upgraded before the images.
+	minProtocolVersion = 1
+	// protocolEnvVar tells the injected containers which protocol version
+	// was used to configure them.
+	protocolEnvVar = "AUTOCERT_PROTOCOL"
+)
+
+// envProtocolVersions maps the environment variables injected by the
+// controller to the protocol version that introduced them. Variables not
+// listed here are part of version 1.
+var envProtocolVersions = map[string]int{
+	protocolEnvVar:            2,
+	"UMASK":                   2,
+	"READ_ONLY":               2,
+	"STEP_ROOT_PEM":           2,
+	"AUTOCERT_TOKEN_URL":      2,
+	"AUTOCERT_CLAIM":          2,
+	"AUTOCERT_FREEZE_URL":     3,
+	"AUTOCERT_CSR_URL":        4,
+	"AUTOCERT_SANS":           4,
+	"AUTOCERT_STATUS_URL":     5,
+	"AUTOCERT_REISSUE_URL":    6,
+	dualStackEnvVar:           7,
+	airGappedEnvVar:           8,
+	tokenBindingEnvVar:        9,
+	podUIDEnvVar:              9,
+	remintURLEnvVar:           10,
+	remintClaimEnvVar:         10,
+	serviceAccountTokenEnvVar: 10,
+	readyFileEnvVar:           11,
+	caFailoverEnvVar:          13,
+	verifyOnlyEnvVar:          14,
+	drainFileEnvVar:           15,
+	drainTimeoutEnvVar:        15,
+	sdsSocketEnvVar:           16,
+	metricsAddrEnvVar:         17,
+	caTokenEnvVar:             18,
+	otlp.EndpointEnvVar:       19,
+	otlp.ResourceEnvVar:       19,
+	otlpIntervalEnvVar:        19,
+	otlpLogsEnvVar:            19,
+	keyTypeEnvVar:             20,
+	keyCurveEnvVar:            20,
+	keySizeEnvVar:             20,
+	keystore.FormatEnvVar:     21,
+	bootstrapRetriesEnvVar:    22,
+	bootstrapBackoffEnvVar:    22,
+	renewalSignalEnvVar:       23,
+	renewalProcessEnvVar:      23,
+	renewalExecEnvVar:         23,
+	renewalContainerEnvVar:    23,
+	renewalPodEnvVar:          23,
+	trustBundleEnvVar:         24,
+	claimTokenEnvVar:          25,
+}
+
+// GetProtocolVersion returns the protocol version used to configure the
+// injected containers, defaults to the latest version if not specified in the
+// configuration.
+func (c Config) GetProtocolVersion() int {
+	if c.ProtocolVersion != 0 {
+		return c.ProtocolVersion
+	}
+
+	return protocolVersion
+}
+
+// validateProtocolVersion returns an error if the configured protocol
+// version is not supported by this controller.
+func validateProtocolVersion(version int) error {
+	if version == 0 {
+		return nil
+	}
+	if version < minProtocolVersion || version > protocolVersion {
+		return fmt.Errorf("protocolVersion %d is not supported, this controller supports versions %d to %d", version, minProtocolVersion, protocolVersion)
+	}
+	return nil
+}
+
+// protocolEnv returns the environment variable announcing the protocol
+// version to the injected containers.
+func protocolEnv(version int) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name:  protocolEnvVar,
+		Value: strconv.Itoa(version),
+	}
+}
+
+// filterEnv removes the environment variables introduced after the given
+// protocol version, so older bootstrapper and renewer images are configured
+// the way they expect.
+func filterEnv(env []corev1.EnvVar, version int) []corev1.EnvVar {
+	result := make([]corev1.EnvVar, 0, len(env))
+	for _, e := range env {
+		if v, ok := envProtocolVersions[e.Name]; ok && v > version {
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// maxAdmissionReviewSize limits the size of an AdmissionReview. The API
+	// server doesn't accept objects larger than 3 MiB, and the review of a
+	// pod creation embeds the pod once.
+	maxAdmissionReviewSize = 3 << 20
+	// webhookReadHeaderTimeout bounds the time to read the headers of a
+	// request.
+	webhookReadHeaderTimeout = 15 * time.Second
+	// webhookReadTimeout bounds the time to read a request, including the
+	// TLS handshake and the body.
+	webhookReadTimeout = 30 * time.Second
+	// webhookWriteTimeout bounds the time to handle a request and write the
+	// response. The API server doesn't wait for webhooks longer than 30
+	// seconds.
+	webhookWriteTimeout = 30 * time.Second
+	// webhookIdleTimeout bounds the time a keep-alive connection waits for
+	// the next request.
+	webhookIdleTimeout = 2 * time.Minute
+	// webhookMaxHeaderBytes limits the size of the request headers.
+	webhookMaxHeaderBytes = 64 << 10
+	// admissionDeadlineMargin is subtracted from the timeout of an admission
+	// review, so the response is written before the API server gives up.
+	admissionDeadlineMargin = 500 * time.Millisecond
+)
+
+// newWebhookServer returns the HTTP server of the controller, with timeouts
+// and limits protecting it from slow and oversized requests. Request bodies
+// are limited by each handler.
+func newWebhookServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: webhookReadHeaderTimeout,
+		ReadTimeout:       webhookReadTimeout,
+		WriteTimeout:      webhookWriteTimeout,
+		IdleTimeout:       webhookIdleTimeout,
+		MaxHeaderBytes:    webhookMaxHeaderBytes,
+	}
+}
+
+// admissionContext returns the context of an admission review, done when the
+// API server stops waiting for the response. The API server sets the timeout
+// of the webhook in the timeout query parameter, and closes the connection
+// once it's exceeded.
+func admissionContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout, err := time.ParseDuration(r.URL.Query().Get("timeout"))
+	if err != nil || timeout <= admissionDeadlineMargin {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), timeout-admissionDeadlineMargin)
+}
+
+// mutateHandler handles the AdmissionReviews sent by the API server, and
+// returns the patch injecting autocert in the pod.
+func mutateHandler(w http.ResponseWriter, r *http.Request, config *Config, provisioner TokenManager) {
+	defer observeAdmission(time.Now())
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		log.WithField("Content-Type", contentType).Error("Bad Request: 415 (Unsupported Media Type)")
+		http.Error(w, fmt.Sprintf("Bad Request: 415 Unsupported Media Type (Expected Content-Type 'application/json' but got '%s')", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var body []byte
+	if r.Body != nil {
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdmissionReviewSize))
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			log.WithField("limit", maxErr.Limit).Error("Bad Request: 413 (Request Entity Too Large)")
+			http.Error(w, fmt.Sprintf("Request Entity Too Large (Limit %d bytes)", maxErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err == nil {
+			body = data
+		}
+	}
+	if len(body) == 0 {
+		log.Error("Bad Request: 400 (Empty Body)")
+		http.Error(w, "Bad Request (Empty Body)", http.StatusBadRequest)
+		return
+	}
+
+	var response *v1beta1.AdmissionResponse
+	review := v1beta1.AdmissionReview{}
+	if _, _, err := deserializer.Decode(body, nil, &review); err != nil {
+		log.WithFields(log.Fields{
+			"size":  len(body),
+			"error": err,
+		}).Error("Can't decode body")
+		response = &v1beta1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	} else {
+		ctx, cancel := admissionContext(r)
+		if admissionQueue.acquire(ctx) {
+			response = mutate(ctx, &review, config, provisioner)
+			admissionQueue.release()
+		} else {
+			log.WithFields(log.Fields{
+				"uid":    review.Request.UID,
+				"policy": admissionQueue.policy,
+			}).Warn("Controller saturated, shedding admission review")
+			response = admissionQueue.shedResponse(review.Request)
+		}
+		cancel()
+	}
+
+	// A review that can't be decoded has no request.
+	var uid types.UID
+	if review.Request != nil {
+		uid = review.Request.UID
+	}
+
+	resp, err := json.Marshal(v1beta1.AdmissionReview{
+		Response: response,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uid":   uid,
+			"error": err,
+		}).Info("Marshal error")
+		http.Error(w, fmt.Sprintf("Marshal Error: %v", err), http.StatusInternalServerError)
+	} else {
+		log.WithFields(log.Fields{
+			"uid":      uid,
+			"response": string(resp),
+		}).Info("Returning review")
+		if _, err := w.Write(resp); err != nil {
+			log.WithFields(log.Fields{
+				"uid":   uid,
+				"error": err,
+			}).Info("Write error")
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+func TestMutateHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"oversized", "application/json", strings.Repeat(" ", maxAdmissionReviewSize+1), http.StatusRequestEntityTooLarge},
+		{"unsupported media type", "text/plain", "{}", http.StatusUnsupportedMediaType},
+		{"empty", "application/json", "", http.StatusBadRequest},
+		{"malformed", "application/json", `{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1beta1","request":`, http.StatusOK},
+	}
+	before := admissionCount(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			mutateHandler(w, r, nil, nil)
+			if w.Code != tt.want {
+				t.Fatalf("mutateHandler() = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var review v1beta1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatal(err)
+			}
+			if review.Response == nil || review.Response.Allowed || review.Response.Result == nil {
+				t.Errorf("mutateHandler() response = %+v, want a rejection", review.Response)
+			}
+		})
+	}
+	if got := admissionCount(t) - before; got != uint64(len(tests)) {
+		t.Errorf("observed admissions = %d, want %d", got, len(tests))
+	}
+}
+
+// admissionCount returns the number of admission reviews observed by
+// autocert_admission_duration_seconds.
+func admissionCount(t *testing.T) uint64 {
+	t.Helper()
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == "autocert_admission_duration_seconds" {
+			return f.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func TestNewWebhookServer(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = newWebhookServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutateHandler(w, r, nil, nil)
+	}))
+	srv.Start()
+	defer srv.Close()
+
+	// Oversized headers are rejected before reaching the handler.
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/mutate", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Padding", strings.Repeat("a", 2*webhookMaxHeaderBytes))
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("oversized headers = %d, want %d", resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+
+	// Oversized bodies are rejected without reading them in full.
+	body := bytes.NewReader(make([]byte, 2*maxAdmissionReviewSize))
+	resp, err = srv.Client().Post(srv.URL+"/mutate", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestAdmissionContext(t *testing.T) {
+	tests := []struct {
+		target       string
+		wantDeadline bool
+		wantMax      time.Duration
+	}{
+		{"/mutate?timeout=10s", true, 10*time.Second - admissionDeadlineMargin},
+		{"/mutate?timeout=100ms", false, 0},
+		{"/mutate?timeout=invalid", false, 0},
+		{"/mutate", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			ctx, cancel := admissionContext(httptest.NewRequest(http.MethodPost, tt.target, nil))
+			defer cancel()
+			deadline, ok := ctx.Deadline()
+			if ok != tt.wantDeadline {
+				t.Fatalf("admissionContext() deadline = %v, want %v", ok, tt.wantDeadline)
+			}
+			if ok && time.Until(deadline) > tt.wantMax {
+				t.Errorf("admissionContext() deadline in %v, want at most %v", time.Until(deadline), tt.wantMax)
+			}
+		})
+	}
+}
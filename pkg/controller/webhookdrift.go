@@ -0,0 +1,441 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// defaultWebhookConfigurationName is the name of the
+	// MutatingWebhookConfiguration created by the install scripts.
+	defaultWebhookConfigurationName = "autocert-webhook-config"
+	// webhookName is the name of the autocert webhook in the configuration.
+	webhookName             = "autocert.step.sm"
+	defaultWebhookInterval  = time.Minute
+	webhookConfigurationAPI = "apis/admissionregistration.k8s.io/v1/mutatingwebhookconfigurations"
+)
+
+// Fields of the webhook checked for drift, used as the field label of the
+// webhook metrics.
+const (
+	driftMissing           = "missing"
+	driftCABundle          = "caBundle"
+	driftRules             = "rules"
+	driftNamespaceSelector = "namespaceSelector"
+)
+
+// WebhookReconciler keeps the MutatingWebhookConfiguration of autocert as
+// installed: the caBundle, rules and namespaceSelector of the webhook are
+// compared with the expected ones every interval, and repaired when they're
+// edited out of band. A deleted configuration is reported but not recreated,
+// as deleting it is how autocert is uninstalled.
+type WebhookReconciler struct {
+	Enabled bool `yaml:"enabled"`
+	// Name is the name of the MutatingWebhookConfiguration, defaults to
+	// autocert-webhook-config.
+	Name string `yaml:"name"`
+	// Interval defaults to 1m.
+	Interval string `yaml:"interval"`
+	// DryRun reports drift without repairing it.
+	DryRun bool `yaml:"dryRun"`
+	// CARoots adds the roots served by the CA to the caBundle, so the API
+	// server keeps trusting the webhook when the CA rotates its root and the
+	// controller renews its serving certificate with the new one.
+	CARoots bool `yaml:"caRoots"`
+	// Rules default to the creation of pods.
+	Rules []admissionregistrationv1.RuleWithOperations `yaml:"rules"`
+	// NamespaceSelector defaults to namespaces labeled
+	// autocert.step.sm=enabled.
+	NamespaceSelector *metav1.LabelSelector `yaml:"namespaceSelector"`
+}
+
+// GetName returns the name of the MutatingWebhookConfiguration, defaults to
+// autocert-webhook-config.
+func (r WebhookReconciler) GetName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return defaultWebhookConfigurationName
+}
+
+// GetInterval returns how often the webhook is reconciled, defaults to 1m.
+func (r WebhookReconciler) GetInterval() time.Duration {
+	d, err := time.ParseDuration(r.Interval)
+	if err != nil || d <= 0 {
+		return defaultWebhookInterval
+	}
+	return d
+}
+
+// validateWebhookReconciler returns an error if the webhook reconciler is not
+// valid.
+func validateWebhookReconciler(c *Config) error {
+	r := c.WebhookReconciler
+	if r.Interval != "" {
+		if d, err := time.ParseDuration(r.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid webhookReconciler.interval %q, it must be a positive duration", r.Interval)
+		}
+	}
+	if r.NamespaceSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(r.NamespaceSelector); err != nil {
+			return errors.Wrap(err, "invalid webhookReconciler.namespaceSelector")
+		}
+	}
+	for _, rule := range r.Rules {
+		if len(rule.Operations) == 0 || len(rule.Resources) == 0 {
+			return fmt.Errorf("webhookReconciler.rules must set operations and resources")
+		}
+	}
+	return nil
+}
+
+// desiredRules returns the rules the webhook must have.
+func (r WebhookReconciler) desiredRules() []admissionregistrationv1.RuleWithOperations {
+	if len(r.Rules) > 0 {
+		return normalizeRules(r.Rules)
+	}
+	return normalizeRules([]admissionregistrationv1.RuleWithOperations{{
+		Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{""},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"pods"},
+		},
+	}})
+}
+
+// desiredNamespaceSelector returns the namespaceSelector the webhook must
+// have.
+func (r WebhookReconciler) desiredNamespaceSelector() *metav1.LabelSelector {
+	if r.NamespaceSelector != nil {
+		return r.NamespaceSelector
+	}
+	return &metav1.LabelSelector{MatchLabels: map[string]string{webhookName: "enabled"}}
+}
+
+// normalizeRules returns a copy of the rules with the scope the API server
+// defaults to, so configured rules compare equal to the stored ones.
+func normalizeRules(rules []admissionregistrationv1.RuleWithOperations) []admissionregistrationv1.RuleWithOperations {
+	out := make([]admissionregistrationv1.RuleWithOperations, len(rules))
+	for i, rule := range rules {
+		if rule.Scope == nil {
+			scope := admissionregistrationv1.AllScopes
+			rule.Scope = &scope
+		}
+		out[i] = rule
+	}
+	return out
+}
+
+// appendRoots returns the PEM bundle with the roots it doesn't have yet
+// appended, or the bundle itself if it has them all.
+func appendRoots(bundle []byte, roots []*x509.Certificate) []byte {
+	have := map[string]bool{}
+	for rest := bundle; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		have[string(block.Bytes)] = true
+	}
+	out := bundle
+	for _, root := range roots {
+		if have[string(root.Raw)] {
+			continue
+		}
+		have[string(root.Raw)] = true
+		if len(out) > 0 && !bytes.HasSuffix(out, []byte("\n")) {
+			out = append(bytes.Clone(out), '\n')
+		}
+		out = append(bytes.Clone(out), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})...)
+	}
+	return out
+}
+
+// caRoots returns the roots served by the CA of the controller.
+func (c *Controller) caRoots() ([]*x509.Certificate, error) {
+	resp, err := c.currentCA().Roots()
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]*x509.Certificate, 0, len(resp.Certificates))
+	for _, crt := range resp.Certificates {
+		roots = append(roots, crt.Certificate)
+	}
+	return roots, nil
+}
+
+// webhookDrift compares the autocert webhook in obj with the expected one and
+// repairs it in place. It returns the fields that drifted.
+func webhookDrift(obj *admissionregistrationv1.MutatingWebhookConfiguration, r WebhookReconciler, caBundle []byte) []string {
+	var webhook *admissionregistrationv1.MutatingWebhook
+	for i := range obj.Webhooks {
+		if obj.Webhooks[i].Name == webhookName {
+			webhook = &obj.Webhooks[i]
+			break
+		}
+	}
+	if webhook == nil {
+		return []string{driftMissing}
+	}
+
+	var fields []string
+	if !bytes.Equal(bytes.TrimSpace(webhook.ClientConfig.CABundle), bytes.TrimSpace(caBundle)) {
+		fields = append(fields, driftCABundle)
+		webhook.ClientConfig.CABundle = caBundle
+	}
+	if rules := r.desiredRules(); !equality.Semantic.DeepEqual(normalizeRules(webhook.Rules), rules) {
+		fields = append(fields, driftRules)
+		webhook.Rules = rules
+	}
+	if selector := r.desiredNamespaceSelector(); !equality.Semantic.DeepEqual(webhook.NamespaceSelector, selector) {
+		fields = append(fields, driftNamespaceSelector)
+		webhook.NamespaceSelector = selector.DeepCopy()
+	}
+	return fields
+}
+
+var (
+	// webhookDrifted tells which fields of the webhook had drifted on the
+	// last check.
+	webhookDrifted = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "autocert_webhook_drift",
+		Help: "Whether the field of the autocert webhook had drifted on the last check, by field.",
+	}, []string{"field"})
+	webhookRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autocert_webhook_repairs_total",
+		Help: "Number of repairs of the autocert webhook, by field.",
+	}, []string{"field"})
+	webhookReconcileErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "autocert_webhook_reconcile_errors_total",
+		Help: "Number of errors reading or repairing the autocert webhook.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(webhookDrifted, webhookRepairs, webhookReconcileErrors)
+}
+
+// WebhookStatus is the result of the last check of the webhook, served at
+// /webhook.
+type WebhookStatus struct {
+	Name    string    `json:"name"`
+	Checked time.Time `json:"checked"`
+	// Drift holds the fields that drifted, or "missing" if the webhook or
+	// its configuration doesn't exist.
+	Drift    []string `json:"drift,omitempty"`
+	Repaired bool     `json:"repaired"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// selfWebhook reconciles the webhook of the controller.
+var selfWebhook = &webhookDriftReconciler{
+	get:    getWebhookConfiguration,
+	update: updateWebhookConfiguration,
+}
+
+// webhookDriftReconciler checks and repairs the autocert webhook.
+type webhookDriftReconciler struct {
+	// get returns the MutatingWebhookConfiguration with the given name, or
+	// nil if it doesn't exist.
+	get    func(name string) (*admissionregistrationv1.MutatingWebhookConfiguration, error)
+	update func(obj *admissionregistrationv1.MutatingWebhookConfiguration) error
+	// roots returns the roots served by the CA, added to the caBundle with
+	// caRoots.
+	roots func() ([]*x509.Certificate, error)
+
+	mu   sync.Mutex
+	last *WebhookStatus
+}
+
+// run reconciles the webhook every interval until the context is canceled.
+func (w *webhookDriftReconciler) run(ctx context.Context, config *Config) {
+	interval := config.WebhookReconciler.GetInterval()
+	log.WithFields(log.Fields{
+		"name":     config.WebhookReconciler.GetName(),
+		"interval": interval,
+		"dryRun":   config.WebhookReconciler.DryRun,
+	}).Info("Reconciling the webhook configuration")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.reconcile(config, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile checks the webhook once, repairs it unless in dry run, and
+// updates the metrics and the status.
+func (w *webhookDriftReconciler) reconcile(config *Config, now time.Time) *WebhookStatus {
+	r := config.WebhookReconciler
+	status := &WebhookStatus{Name: r.GetName(), Checked: now.UTC()}
+	defer func() {
+		w.mu.Lock()
+		w.last = status
+		w.mu.Unlock()
+	}()
+
+	caBundle, err := os.ReadFile(config.GetRootCAPath())
+	if err != nil {
+		return w.fail(status, errors.Wrap(err, "error reading root certificate"))
+	}
+	if r.CARoots && w.roots != nil {
+		roots, err := w.roots()
+		if err != nil {
+			return w.fail(status, errors.Wrap(err, "error getting the roots of the CA"))
+		}
+		caBundle = appendRoots(caBundle, roots)
+	}
+	obj, err := w.get(status.Name)
+	if err != nil {
+		return w.fail(status, errors.Wrap(err, "error getting webhook configuration"))
+	}
+	if obj == nil {
+		status.Drift = []string{driftMissing}
+	} else {
+		status.Drift = webhookDrift(obj, r, caBundle)
+	}
+	for _, field := range []string{driftMissing, driftCABundle, driftRules, driftNamespaceSelector} {
+		webhookDrifted.WithLabelValues(field).Set(0)
+	}
+	for _, field := range status.Drift {
+		webhookDrifted.WithLabelValues(field).Set(1)
+	}
+
+	ctxLog := log.WithFields(log.Fields{
+		"name":  status.Name,
+		"drift": status.Drift,
+	})
+	switch {
+	case len(status.Drift) == 0:
+		return status
+	case status.Drift[0] == driftMissing:
+		ctxLog.Error("Webhook configuration is missing, pods are not injected")
+		return status
+	case r.DryRun:
+		ctxLog.Warn("Webhook configuration has drifted")
+		return status
+	}
+
+	if err := w.update(obj); err != nil {
+		return w.fail(status, errors.Wrap(err, "error repairing webhook configuration"))
+	}
+	for _, field := range status.Drift {
+		webhookRepairs.WithLabelValues(field).Inc()
+	}
+	status.Repaired = true
+	ctxLog.Warn("Repaired webhook configuration")
+	return status
+}
+
+func (w *webhookDriftReconciler) fail(status *WebhookStatus, err error) *WebhookStatus {
+	webhookReconcileErrors.Inc()
+	status.Error = err.Error()
+	log.WithFields(log.Fields{
+		"name":  status.Name,
+		"error": err,
+	}).Error("Error reconciling webhook configuration")
+	return status
+}
+
+// status returns the result of the last check, nil before the first one.
+func (w *webhookDriftReconciler) status() *WebhookStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
+
+// webhookHandler serves the result of the last check of the webhook.
+func webhookHandler(w http.ResponseWriter, config *Config) {
+	if !config.WebhookReconciler.Enabled {
+		http.Error(w, "webhook reconciler is not enabled", http.StatusNotFound)
+		return
+	}
+	status := selfWebhook.status()
+	if status == nil {
+		http.Error(w, "webhook not checked yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.WithField("error", err).Info("Write error")
+	}
+}
+
+// getWebhookConfiguration returns the MutatingWebhookConfiguration with the
+// given name, or nil if it doesn't exist.
+func getWebhookConfiguration(name string) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := client.GetRequest(webhookConfigurationAPI + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, errors.New(resp.Status)
+	}
+	var obj admissionregistrationv1.MutatingWebhookConfiguration
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+// updateWebhookConfiguration replaces a MutatingWebhookConfiguration. The
+// resource version of obj makes the update fail if it was modified since it
+// was read.
+func updateWebhookConfiguration(obj *admissionregistrationv1.MutatingWebhookConfiguration) error {
+	client, err := NewInClusterK8sClient()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	req, err := client.PutRequest(webhookConfigurationAPI+"/"+obj.Name, string(body), "application/json")
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
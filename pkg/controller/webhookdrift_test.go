@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testCABundle = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+// installedWebhook returns the webhook configuration created by the install
+// scripts, as stored by the API server.
+func installedWebhook() *admissionregistrationv1.MutatingWebhookConfiguration {
+	scope := admissionregistrationv1.AllScopes
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: defaultWebhookConfigurationName, ResourceVersion: "42"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name:         webhookName,
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte(strings.TrimSpace(testCABundle))},
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"pods"},
+					Scope:       &scope,
+				},
+			}},
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{webhookName: "enabled"}},
+		}},
+	}
+}
+
+func TestValidateWebhookReconciler(t *testing.T) {
+	tests := []struct {
+		name    string
+		r       WebhookReconciler
+		wantErr bool
+	}{
+		{"not set", WebhookReconciler{}, false},
+		{"ok", WebhookReconciler{Enabled: true, Interval: "30s", NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}}}, false},
+		{"bad interval", WebhookReconciler{Interval: "-1m"}, true},
+		{"bad selector", WebhookReconciler{NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Like"}}}}, true},
+		{"rule without operations", WebhookReconciler{Rules: []admissionregistrationv1.RuleWithOperations{{Rule: admissionregistrationv1.Rule{Resources: []string{"pods"}}}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateWebhookReconciler(&Config{WebhookReconciler: tt.r}); (err != nil) != tt.wantErr {
+				t.Errorf("validateWebhookReconciler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookDrift(t *testing.T) {
+	tests := []struct {
+		name   string
+		r      WebhookReconciler
+		modify func(obj *admissionregistrationv1.MutatingWebhookConfiguration)
+		want   []string
+	}{
+		{"installed", WebhookReconciler{}, func(*admissionregistrationv1.MutatingWebhookConfiguration) {}, nil},
+		{"default scope", WebhookReconciler{}, func(obj *admissionregistrationv1.MutatingWebhookConfiguration) {
+			obj.Webhooks[0].Rules[0].Scope = nil
+		}, nil},
+		{"caBundle", WebhookReconciler{}, func(obj *admissionregistrationv1.MutatingWebhookConfiguration) {
+			obj.Webhooks[0].ClientConfig.CABundle = nil
+		}, []string{driftCABundle}},
+		{"rules", WebhookReconciler{}, func(obj *admissionregistrationv1.MutatingWebhookConfiguration) {
+			obj.Webhooks[0].Rules[0].Resources = []string{"deployments"}
+		}, []string{driftRules}},
+		{"namespaceSelector", WebhookReconciler{}, func(obj *admissionregistrationv1.MutatingWebhookConfiguration) {
+			obj.Webhooks[0].NamespaceSelector = &metav1.LabelSelector{}
+		}, []string{driftNamespaceSelector}},
+		{"configured namespaceSelector", WebhookReconciler{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+		}, func(*admissionregistrationv1.MutatingWebhookConfiguration) {}, []string{driftNamespaceSelector}},
+		{"missing webhook", WebhookReconciler{}, func(obj *admissionregistrationv1.MutatingWebhookConfiguration) {
+			obj.Webhooks[0].Name = "other.example.com"
+		}, []string{driftMissing}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := installedWebhook()
+			tt.modify(obj)
+			if got := webhookDrift(obj, tt.r, []byte(testCABundle)); !slices.Equal(got, tt.want) {
+				t.Errorf("webhookDrift() = %v, want %v", got, tt.want)
+			}
+			if slices.Contains(tt.want, driftMissing) {
+				return
+			}
+			// The webhook is repaired in place.
+			if got := webhookDrift(obj, tt.r, []byte(testCABundle)); len(got) != 0 {
+				t.Errorf("webhookDrift() after repair = %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestWebhookReconcile(t *testing.T) {
+	rootFile := filepath.Join(t.TempDir(), "root_ca.crt")
+	if err := os.WriteFile(rootFile, []byte(testCABundle), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("repair", func(t *testing.T) {
+		var updated *admissionregistrationv1.MutatingWebhookConfiguration
+		w := &webhookDriftReconciler{
+			get: func(string) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+				obj := installedWebhook()
+				obj.Webhooks[0].NamespaceSelector = nil
+				return obj, nil
+			},
+			update: func(obj *admissionregistrationv1.MutatingWebhookConfiguration) error {
+				updated = obj
+				return nil
+			},
+		}
+		config := &Config{RootCAPath: rootFile, WebhookReconciler: WebhookReconciler{Enabled: true}}
+		status := w.reconcile(config, now)
+		if !status.Repaired || !slices.Equal(status.Drift, []string{driftNamespaceSelector}) {
+			t.Errorf("reconcile() = %+v, want namespaceSelector repaired", status)
+		}
+		if updated == nil || updated.ResourceVersion != "42" || updated.Webhooks[0].NamespaceSelector == nil {
+			t.Errorf("update() = %+v, want the repaired webhook", updated)
+		}
+
+		rec := httptest.NewRecorder()
+		saved := selfWebhook
+		selfWebhook = w
+		defer func() { selfWebhook = saved }()
+		webhookHandler(rec, config)
+		if !strings.Contains(rec.Body.String(), `"drift":["namespaceSelector"]`) {
+			t.Errorf("webhookHandler() = %s", rec.Body.String())
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		w := &webhookDriftReconciler{
+			get: func(string) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+				obj := installedWebhook()
+				obj.Webhooks[0].ClientConfig.CABundle = nil
+				return obj, nil
+			},
+			update: func(*admissionregistrationv1.MutatingWebhookConfiguration) error {
+				t.Error("update() should not be called in dry run")
+				return nil
+			},
+		}
+		status := w.reconcile(&Config{RootCAPath: rootFile, WebhookReconciler: WebhookReconciler{DryRun: true}}, now)
+		if status.Repaired || !slices.Equal(status.Drift, []string{driftCABundle}) {
+			t.Errorf("reconcile() = %+v, want caBundle drift", status)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		w := &webhookDriftReconciler{
+			get: func(string) (*admissionregistrationv1.MutatingWebhookConfiguration, error) { return nil, nil },
+			update: func(*admissionregistrationv1.MutatingWebhookConfiguration) error {
+				t.Error("update() should not recreate the configuration")
+				return nil
+			},
+		}
+		status := w.reconcile(&Config{RootCAPath: rootFile}, now)
+		if status.Repaired || !slices.Equal(status.Drift, []string{driftMissing}) {
+			t.Errorf("reconcile() = %+v, want missing", status)
+		}
+	})
+
+	t.Run("caRoots", func(t *testing.T) {
+		installed := &x509.Certificate{Raw: []byte{0x30, 0x82, 0x01}} // MIIB
+		rotated := &x509.Certificate{Raw: []byte{0x30, 0x82, 0x02}}
+		var updated *admissionregistrationv1.MutatingWebhookConfiguration
+		w := &webhookDriftReconciler{
+			get: func(string) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+				return installedWebhook(), nil
+			},
+			update: func(obj *admissionregistrationv1.MutatingWebhookConfiguration) error {
+				updated = obj
+				return nil
+			},
+			roots: func() ([]*x509.Certificate, error) { return []*x509.Certificate{installed}, nil },
+		}
+		config := &Config{RootCAPath: rootFile, WebhookReconciler: WebhookReconciler{CARoots: true}}
+		if status := w.reconcile(config, now); len(status.Drift) != 0 {
+			t.Errorf("reconcile() = %+v, want no drift with the installed root", status)
+		}
+
+		w.roots = func() ([]*x509.Certificate, error) { return []*x509.Certificate{installed, rotated}, nil }
+		status := w.reconcile(config, now)
+		if !status.Repaired || !slices.Equal(status.Drift, []string{driftCABundle}) {
+			t.Fatalf("reconcile() = %+v, want caBundle repaired", status)
+		}
+		want := testCABundle + "-----BEGIN CERTIFICATE-----\nMIIC\n-----END CERTIFICATE-----\n"
+		if got := string(updated.Webhooks[0].ClientConfig.CABundle); got != want {
+			t.Errorf("caBundle = %q, want %q", got, want)
+		}
+
+		w.roots = func() ([]*x509.Certificate, error) { return nil, errors.New("connection refused") }
+		if status := w.reconcile(config, now); !strings.Contains(status.Error, "connection refused") {
+			t.Errorf("reconcile() = %+v, want the roots error", status)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		w := &webhookDriftReconciler{
+			get: func(string) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+				obj := installedWebhook()
+				obj.Webhooks[0].Rules = nil
+				return obj, nil
+			},
+			update: func(*admissionregistrationv1.MutatingWebhookConfiguration) error {
+				return errors.New("409 Conflict")
+			},
+		}
+		status := w.reconcile(&Config{RootCAPath: rootFile}, now)
+		if status.Repaired || !strings.Contains(status.Error, "409 Conflict") {
+			t.Errorf("reconcile() = %+v, want a conflict error", status)
+		}
+	})
+}
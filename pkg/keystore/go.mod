@@ -0,0 +1,16 @@
+module github.com/smallstep/autocert/pkg/keystore
+
+go 1.25.0
+
+require (
+	github.com/pkg/errors v0.9.1
+	go.step.sm/crypto v0.77.2
+)
+
+require (
+	filippo.io/edwards25519 v1.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
+	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
+	golang.org/x/crypto v0.49.0 // indirect
+	golang.org/x/sys v0.42.0 // indirect
+)
@@ -0,0 +1,144 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // the JKS format is defined with SHA-1
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Java keystores, in the JKS format of sun.security.provider.JavaKeyStore.
+// Keys are protected with the algorithm of sun.security.provider.KeyProtector
+// and the store with a SHA-1 digest. JKS is only meant for applications that
+// can't load PKCS#12 keystores.
+
+const (
+	jksMagic   = 0xfeedfeed
+	jksVersion = 2
+	// Tags of the entries.
+	jksPrivateKey  = 1
+	jksTrustedCert = 2
+	// jksWhitener is mixed into the digest of the store.
+	jksWhitener = "Mighty Aphrodite"
+)
+
+// oidKeyProtector identifies the key protection algorithm of the JDK.
+var oidKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// jksWriter writes the big endian values of a Java DataOutputStream.
+type jksWriter struct {
+	bytes.Buffer
+}
+
+func (w *jksWriter) uint32(v uint32) {
+	w.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (w *jksWriter) int64(v int64) {
+	w.Write(binary.BigEndian.AppendUint64(nil, uint64(v))) //nolint:gosec // two's complement, like Java
+}
+
+// utf writes a string with its length, like DataOutput.writeUTF for ASCII
+// strings.
+func (w *jksWriter) utf(s string) {
+	w.Write(binary.BigEndian.AppendUint16(nil, uint16(len(s)))) //nolint:gosec // aliases are short
+	w.WriteString(s)
+}
+
+func (w *jksWriter) certificate(crt *x509.Certificate) {
+	w.utf("X.509")
+	w.uint32(uint32(len(crt.Raw))) //nolint:gosec // certificates are small
+	w.Write(crt.Raw)
+}
+
+// jksHeader starts a store with the given number of entries.
+func jksHeader(entries int) *jksWriter {
+	w := &jksWriter{}
+	w.uint32(jksMagic)
+	w.uint32(jksVersion)
+	w.uint32(uint32(entries)) //nolint:gosec // a few entries
+	return w
+}
+
+// sign appends the digest of the store.
+func (w *jksWriter) sign(password string) []byte {
+	h := sha1.New() //nolint:gosec // the JKS format is defined with SHA-1
+	h.Write(bmpString(password))
+	h.Write([]byte(jksWhitener))
+	h.Write(w.Bytes())
+	w.Write(h.Sum(nil))
+	return w.Bytes()
+}
+
+// encodeJKS returns a Java keystore with the key and its certificate chain,
+// under Alias.
+func encodeJKS(key crypto.PrivateKey, chain []*x509.Certificate, password string, now time.Time) ([]byte, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal private key")
+	}
+	protected, err := protectJKSKey(pkcs8, password)
+	if err != nil {
+		return nil, err
+	}
+	w := jksHeader(1)
+	w.uint32(jksPrivateKey)
+	w.utf(Alias)
+	w.int64(now.UnixMilli())
+	w.uint32(uint32(len(protected))) //nolint:gosec // keys are small
+	w.Write(protected)
+	w.uint32(uint32(len(chain))) //nolint:gosec // chains are short
+	for _, crt := range chain {
+		w.certificate(crt)
+	}
+	return w.sign(password), nil
+}
+
+// encodeJKSTrustStore returns a Java truststore with the roots.
+func encodeJKSTrustStore(roots []*x509.Certificate, password string, now time.Time) ([]byte, error) {
+	w := jksHeader(len(roots))
+	for i, crt := range roots {
+		w.uint32(jksTrustedCert)
+		w.utf(trustAlias(i))
+		w.int64(now.UnixMilli())
+		w.certificate(crt)
+	}
+	return w.sign(password), nil
+}
+
+// protectJKSKey returns the EncryptedPrivateKeyInfo of a PKCS#8 key,
+// encrypted with a key stream of chained SHA-1 digests of the password and a
+// salt, followed by a digest of the password and the key.
+func protectJKSKey(pkcs8 []byte, password string) ([]byte, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	passwd := bmpString(password)
+	xorKey := make([]byte, 0, len(pkcs8)+sha1.Size)
+	digest := salt
+	for len(xorKey) < len(pkcs8) {
+		sum := sha1.Sum(append(bytes.Clone(passwd), digest...)) //nolint:gosec // the JKS format is defined with SHA-1
+		digest = sum[:]
+		xorKey = append(xorKey, digest...)
+	}
+	encrypted := make([]byte, 0, len(salt)+len(pkcs8)+sha1.Size)
+	encrypted = append(encrypted, salt...)
+	for i, b := range pkcs8 {
+		encrypted = append(encrypted, b^xorKey[i])
+	}
+	check := sha1.Sum(append(bytes.Clone(passwd), pkcs8...)) //nolint:gosec // the JKS format is defined with SHA-1
+	encrypted = append(encrypted, check[:]...)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData: encrypted,
+	})
+}
@@ -0,0 +1,115 @@
+// Package keystore writes the certificate, key and root of a pod as PKCS#12
+// or Java keystores, for JVM and .NET workloads that can't load PEM files.
+// The keystores are encoded with the standard library, following the
+// PKCS#12 profile of current OpenSSL and JDK releases, and the JKS format of
+// the JDK.
+package keystore
+
+import (
+	"crypto"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.step.sm/crypto/pemutil"
+)
+
+// The formats of the certificates volume. PEM files are always written,
+// keystores are written next to them.
+const (
+	FormatPEM    = "pem"
+	FormatPKCS12 = "pkcs12"
+	FormatJKS    = "jks"
+)
+
+const (
+	// FormatEnvVar tells the bootstrapper and the renewer which keystores
+	// to write, none if empty or pem.
+	FormatEnvVar = "KEYSTORE_FORMAT"
+	// PasswordEnvVar is the password of the keystores, DefaultPassword if
+	// not set, the default of the JDK truststores.
+	PasswordEnvVar  = "KEYSTORE_PASSWORD"
+	DefaultPassword = "changeit"
+	// Alias is the alias of the certificate and key in the keystore, and
+	// the prefix of the aliases of the roots in the truststore.
+	Alias = "autocert"
+)
+
+// IsFormat returns whether s is a known format.
+func IsFormat(s string) bool {
+	switch s {
+	case FormatPEM, FormatPKCS12, FormatJKS:
+		return true
+	default:
+		return false
+	}
+}
+
+// Files returns the names of the keystore and the truststore written next to
+// the certificate: site.p12 and truststore.p12 for site.crt in PKCS#12, and
+// site.jks and truststore.jks in JKS.
+func Files(format, certFile string) (keyStore, trustStore string) {
+	ext := ".p12"
+	if format == FormatJKS {
+		ext = ".jks"
+	}
+	dir, base := filepath.Split(certFile)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	return filepath.Join(dir, base+ext), filepath.Join(dir, "truststore"+ext)
+}
+
+// Password returns the password of the keystores, from $KEYSTORE_PASSWORD.
+func Password() string {
+	if v := os.Getenv(PasswordEnvVar); v != "" {
+		return v
+	}
+	return DefaultPassword
+}
+
+// Encode returns the keystore with the key and its certificate chain, and the
+// truststore with the roots, in the given format.
+func Encode(format string, key crypto.PrivateKey, chain, roots []*x509.Certificate, password string, now time.Time) (keyStore, trustStore []byte, err error) {
+	if len(chain) == 0 || len(roots) == 0 {
+		return nil, nil, errors.New("keystores need a certificate and a root")
+	}
+	switch format {
+	case FormatPKCS12:
+		if keyStore, err = encodePKCS12(key, chain, password); err != nil {
+			return nil, nil, err
+		}
+		trustStore, err = encodePKCS12TrustStore(roots, password)
+	case FormatJKS:
+		if keyStore, err = encodeJKS(key, chain, password, now); err != nil {
+			return nil, nil, err
+		}
+		trustStore, err = encodeJKSTrustStore(roots, password, now)
+	default:
+		return nil, nil, errors.Errorf("unsupported keystore format %q", format)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyStore, trustStore, nil
+}
+
+// Load reads the PEM certificate chain, key and roots to write in the
+// keystores.
+func Load(certFile, keyFile, rootFile string) (key crypto.PrivateKey, chain, roots []*x509.Certificate, err error) {
+	if chain, err = pemutil.ReadCertificateBundle(certFile); err != nil {
+		return nil, nil, nil, err
+	}
+	if roots, err = pemutil.ReadCertificateBundle(rootFile); err != nil {
+		return nil, nil, nil, err
+	}
+	b, err := os.ReadFile(keyFile) //nolint:gosec // file path comes from trusted configuration
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if key, err = pemutil.ParseKey(b); err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "parse %s", keyFile)
+	}
+	return key, chain, roots, nil
+}
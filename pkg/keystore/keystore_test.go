@@ -0,0 +1,317 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec // the JKS format is defined with SHA-1
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func mustCertificate(t *testing.T, cn string, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+// testChain returns a key with its certificate chain, and the root.
+func testChain(t *testing.T, key crypto.Signer) (chain []*x509.Certificate, root *x509.Certificate) {
+	t.Helper()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = mustCertificate(t, "Root CA", nil, rootKey.Public(), rootKey)
+	leaf := mustCertificate(t, "legacy.default.svc", root, key.Public(), rootKey)
+	return []*x509.Certificate{leaf, root}, root
+}
+
+// decodePKCS12 checks the MAC of a PFX and returns its safe bags.
+func decodePKCS12(t *testing.T, b []byte, password string) []safeBag {
+	t.Helper()
+	var p pfx
+	if rest, err := asn1.Unmarshal(b, &p); err != nil || len(rest) > 0 {
+		t.Fatalf("unmarshal PFX: %v", err)
+	}
+	var data []byte
+	if _, err := asn1.Unmarshal(p.AuthSafe.Content.Bytes, &data); err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, pkcs12MACKey(password, p.MacData.MacSalt, p.MacData.Iterations))
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), p.MacData.Mac.Digest) {
+		t.Fatal("MAC does not match")
+	}
+	var authSafe []contentInfo
+	if _, err := asn1.Unmarshal(data, &authSafe); err != nil {
+		t.Fatal(err)
+	}
+	var bags []safeBag
+	for _, ci := range authSafe {
+		var octets []byte
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &octets); err != nil {
+			t.Fatal(err)
+		}
+		var contents []safeBag
+		if _, err := asn1.Unmarshal(octets, &contents); err != nil {
+			t.Fatal(err)
+		}
+		bags = append(bags, contents...)
+	}
+	return bags
+}
+
+func decodeCertBag(t *testing.T, bag safeBag) *x509.Certificate {
+	t.Helper()
+	var cb certBag
+	if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+		t.Fatal(err)
+	}
+	var der []byte
+	if _, err := asn1.Unmarshal(cb.Value.Bytes, &der); err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+func hasAttribute(bag safeBag, id asn1.ObjectIdentifier) bool {
+	for _, a := range bag.Attributes {
+		if a.ID.Equal(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// decryptPBES2 decrypts the EncryptedPrivateKeyInfo of a shrouded key bag.
+func decryptPBES2(t *testing.T, b []byte, password string) crypto.PrivateKey {
+	t.Helper()
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		t.Fatal(err)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		t.Fatal(err)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		t.Fatal(err)
+	}
+	key, err := pbkdf2.Key(sha256.New, password, kdf.Salt, kdf.Iterations, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Clone(info.EncryptedData)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	data = data[:len(data)-int(data[len(data)-1])]
+	pk, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, root := testChain(t, key)
+	ks, ts, err := Encode(FormatPKCS12, key, chain, []*x509.Certificate{root}, "changeit", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bags := decodePKCS12(t, ks, "changeit")
+	if len(bags) != 3 {
+		t.Fatalf("keystore has %d bags, want the chain and the key", len(bags))
+	}
+	for i, crt := range chain {
+		if got := decodeCertBag(t, bags[i]); !got.Equal(crt) {
+			t.Errorf("certificate %d = %s, want %s", i, got.Subject, crt.Subject)
+		}
+	}
+	if !hasAttribute(bags[0], oidLocalKeyID) || hasAttribute(bags[1], oidLocalKeyID) {
+		t.Error("only the leaf certificate should have the local key ID of the key")
+	}
+	keyBag := bags[2]
+	if !keyBag.ID.Equal(oidShroudedKeyBag) || !hasAttribute(keyBag, oidLocalKeyID) || !hasAttribute(keyBag, oidFriendlyName) {
+		t.Fatalf("key bag = %v", keyBag.ID)
+	}
+	if got := decryptPBES2(t, keyBag.Value.Bytes, "changeit"); !key.Equal(got) {
+		t.Error("decrypted key does not match")
+	}
+
+	bags = decodePKCS12(t, ts, "changeit")
+	if len(bags) != 1 || !decodeCertBag(t, bags[0]).Equal(root) {
+		t.Fatalf("truststore has %d bags, want the root", len(bags))
+	}
+	if !hasAttribute(bags[0], oidJavaTrustedKeyUsage) {
+		t.Error("the root is not trusted by the JDK")
+	}
+}
+
+func TestEncodeJKS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, root := testChain(t, key)
+	now := time.UnixMilli(1700000000000)
+	ks, ts, err := Encode(FormatJKS, key, chain, []*x509.Certificate{root}, "secret", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// checkDigest verifies the digest of the store and returns its entries.
+	checkDigest := func(b []byte) []byte {
+		t.Helper()
+		body, digest := b[:len(b)-sha1.Size], b[len(b)-sha1.Size:]
+		h := sha1.New() //nolint:gosec // the JKS format is defined with SHA-1
+		h.Write(bmpString("secret"))
+		h.Write([]byte(jksWhitener))
+		h.Write(body)
+		if !bytes.Equal(h.Sum(nil), digest) {
+			t.Fatal("digest does not match")
+		}
+		if magic, version := binary.BigEndian.Uint32(body), binary.BigEndian.Uint32(body[4:]); magic != jksMagic || version != jksVersion {
+			t.Fatalf("magic = %x, version = %d", magic, version)
+		}
+		return body[8:]
+	}
+	// next consumes n bytes.
+	next := func(b *[]byte, n int) []byte {
+		v := (*b)[:n]
+		*b = (*b)[n:]
+		return v
+	}
+	utf := func(b *[]byte) string {
+		return string(next(b, int(binary.BigEndian.Uint16(next(b, 2)))))
+	}
+	u32 := func(b *[]byte) int {
+		return int(binary.BigEndian.Uint32(next(b, 4)))
+	}
+
+	b := checkDigest(ks)
+	if n, tag, alias := u32(&b), u32(&b), utf(&b); n != 1 || tag != jksPrivateKey || alias != Alias {
+		t.Fatalf("entries = %d, tag = %d, alias = %s", n, tag, alias)
+	}
+	if ms := int64(binary.BigEndian.Uint64(next(&b, 8))); ms != now.UnixMilli() { //nolint:gosec // test values
+		t.Errorf("date = %d", ms)
+	}
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(next(&b, u32(&b)), &info); err != nil || !info.Algorithm.Algorithm.Equal(oidKeyProtector) {
+		t.Fatalf("protected key = %v, %v", info.Algorithm.Algorithm, err)
+	}
+	// Recover the key like sun.security.provider.KeyProtector.
+	enc := info.EncryptedData
+	salt, encrypted, check := enc[:sha1.Size], enc[sha1.Size:len(enc)-sha1.Size], enc[len(enc)-sha1.Size:]
+	plain := make([]byte, len(encrypted))
+	digest := salt
+	for i := range encrypted {
+		if i%sha1.Size == 0 {
+			sum := sha1.Sum(append(bmpString("secret"), digest...)) //nolint:gosec // the JKS format is defined with SHA-1
+			digest = sum[:]
+		}
+		plain[i] = encrypted[i] ^ digest[i%sha1.Size]
+	}
+	if sum := sha1.Sum(append(bmpString("secret"), plain...)); !bytes.Equal(sum[:], check) { //nolint:gosec // the JKS format is defined with SHA-1
+		t.Fatal("key check does not match")
+	}
+	pk, err := x509.ParsePKCS8PrivateKey(plain)
+	if err != nil || !key.Equal(pk) {
+		t.Fatalf("recovered key does not match: %v", err)
+	}
+	if n := u32(&b); n != len(chain) {
+		t.Fatalf("chain has %d certificates", n)
+	}
+	for _, crt := range chain {
+		if typ, der := utf(&b), next(&b, u32(&b)); typ != "X.509" || !bytes.Equal(der, crt.Raw) {
+			t.Errorf("certificate %s = %s", crt.Subject, typ)
+		}
+	}
+
+	b = checkDigest(ts)
+	if n, tag, alias := u32(&b), u32(&b), utf(&b); n != 1 || tag != jksTrustedCert || alias != Alias {
+		t.Fatalf("entries = %d, tag = %d, alias = %s", n, tag, alias)
+	}
+	next(&b, 8)
+	if typ, der := utf(&b), next(&b, u32(&b)); typ != "X.509" || !bytes.Equal(der, root.Raw) {
+		t.Errorf("trusted certificate = %s", typ)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, root := testChain(t, key)
+	if _, _, err := Encode(FormatPEM, key, chain, []*x509.Certificate{root}, "changeit", time.Now()); err == nil {
+		t.Error("Encode() in PEM succeeded")
+	}
+	if _, _, err := Encode(FormatPKCS12, key, chain, nil, "changeit", time.Now()); err == nil {
+		t.Error("Encode() without roots succeeded")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	tests := []struct {
+		format, certFile     string
+		keyStore, trustStore string
+	}{
+		{FormatPKCS12, "/var/run/autocert.step.sm/site.crt", "/var/run/autocert.step.sm/site.p12", "/var/run/autocert.step.sm/truststore.p12"},
+		{FormatJKS, "/var/run/autocert.step.sm/site.crt", "/var/run/autocert.step.sm/site.jks", "/var/run/autocert.step.sm/truststore.jks"},
+		{FormatPKCS12, "/certs/tls", "/certs/tls.p12", "/certs/truststore.p12"},
+	}
+	for _, tt := range tests {
+		if ks, ts := Files(tt.format, tt.certFile); ks != tt.keyStore || ts != tt.trustStore {
+			t.Errorf("Files(%s, %s) = %s, %s, want %s, %s", tt.format, tt.certFile, ks, ts, tt.keyStore, tt.trustStore)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// PKCS#12 keystores, RFC 7292, with the profile of OpenSSL 3 and the JDK
+// since 8u301: keys encrypted with PBES2, PBKDF2 with HMAC-SHA256 and
+// AES-256-CBC, and an HMAC-SHA256 integrity MAC. Certificates are not
+// encrypted.
+
+// iterations is the iteration count of PBKDF2 and of the MAC key derivation,
+// the default of OpenSSL 3.
+const iterations = 2048
+
+var (
+	oidData                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBES2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidAnyExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+	// oidJavaTrustedKeyUsage marks the certificates of a PKCS#12 truststore
+	// as trusted, the JDK ignores the certificates without it.
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+)
+
+type pfx struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []bagAttribute `asn1:"set,optional"`
+}
+
+type bagAttribute struct {
+	ID     asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type certBag struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	PRF        pkix.AlgorithmIdentifier
+}
+
+// explicit returns the [0] EXPLICIT wrapping of a DER value.
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// dataContent returns a ContentInfo of type data with the DER of v.
+func dataContent(v any) (contentInfo, error) {
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	octets, err := asn1.Marshal(der)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{ContentType: oidData, Content: explicit(octets)}, nil
+}
+
+// attribute returns a bag attribute with a single value.
+func attribute(id asn1.ObjectIdentifier, value any) (bagAttribute, error) {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		return bagAttribute{}, err
+	}
+	return bagAttribute{ID: id, Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: der}}, nil
+}
+
+// bmpString returns s in UTF-16 big endian, the encoding of BMPString.
+func bmpString(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return b
+}
+
+func friendlyName(alias string) (bagAttribute, error) {
+	return attribute(oidFriendlyName, asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(alias)})
+}
+
+// newCertBag returns the bag of a certificate, with the given attributes.
+func newCertBag(crt *x509.Certificate, attrs ...bagAttribute) (safeBag, error) {
+	octets, err := asn1.Marshal(crt.Raw)
+	if err != nil {
+		return safeBag{}, err
+	}
+	der, err := asn1.Marshal(certBag{ID: oidX509Certificate, Value: explicit(octets)})
+	if err != nil {
+		return safeBag{}, err
+	}
+	return safeBag{ID: oidCertBag, Value: explicit(der), Attributes: attrs}, nil
+}
+
+// encodePKCS12 returns a PKCS#12 keystore with the key and its certificate
+// chain, under Alias.
+func encodePKCS12(key crypto.PrivateKey, chain []*x509.Certificate, password string) ([]byte, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal private key")
+	}
+	encrypted, err := encryptPBES2(pkcs8, password)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key and the certificate share a local key ID.
+	keyID := sha256.Sum256(chain[0].Raw)
+	localKeyID, err := attribute(oidLocalKeyID, keyID[:])
+	if err != nil {
+		return nil, err
+	}
+	name, err := friendlyName(Alias)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []safeBag
+	for i, crt := range chain {
+		var attrs []bagAttribute
+		if i == 0 {
+			attrs = []bagAttribute{name, localKeyID}
+		}
+		bag, err := newCertBag(crt, attrs...)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, bag)
+	}
+	keyBag := safeBag{ID: oidShroudedKeyBag, Value: explicit(encrypted), Attributes: []bagAttribute{name, localKeyID}}
+	return encodePFX(password, certs, []safeBag{keyBag})
+}
+
+// encodePKCS12TrustStore returns a PKCS#12 truststore with the roots, trusted
+// by the JDK.
+func encodePKCS12TrustStore(roots []*x509.Certificate, password string) ([]byte, error) {
+	trusted, err := attribute(oidJavaTrustedKeyUsage, oidAnyExtendedKeyUsage)
+	if err != nil {
+		return nil, err
+	}
+	var certs []safeBag
+	for i, crt := range roots {
+		name, err := friendlyName(trustAlias(i))
+		if err != nil {
+			return nil, err
+		}
+		bag, err := newCertBag(crt, name, trusted)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, bag)
+	}
+	return encodePFX(password, certs)
+}
+
+// trustAlias returns the alias of the root i of a truststore: autocert, then
+// autocert-1, autocert-2...
+func trustAlias(i int) string {
+	if i == 0 {
+		return Alias
+	}
+	return fmt.Sprintf("%s-%d", Alias, i)
+}
+
+// encodePFX returns the PFX with the given safe contents, authenticated with
+// the password.
+func encodePFX(password string, contents ...[]safeBag) ([]byte, error) {
+	var authSafe []contentInfo
+	for _, bags := range contents {
+		ci, err := dataContent(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, ci)
+	}
+	data, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	octets, err := asn1.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, pkcs12MACKey(password, salt, iterations))
+	mac.Write(data)
+	return asn1.Marshal(pfx{
+		Version:  3,
+		AuthSafe: contentInfo{ContentType: oidData, Content: explicit(octets)},
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: iterations,
+		},
+	})
+}
+
+// encryptPBES2 returns the EncryptedPrivateKeyInfo of a PKCS#8 key.
+func encryptPBES2(pkcs8 []byte, password string) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(pkcs8)%aes.BlockSize
+	data := append(bytes.Clone(pkcs8), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: iterations,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: data,
+	})
+}
+
+// pkcs12MACKey derives the key of the integrity MAC, with the key derivation
+// of RFC 7292 appendix B and SHA-256. The key is a single SHA-256 block, so
+// only the first block of the derivation is computed.
+func pkcs12MACKey(password string, salt []byte, iterations int) []byte {
+	const v = 64 // the block size of SHA-256
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	h := sha256.New()
+	h.Write(bytes.Repeat([]byte{3}, v)) // the ID of MAC keys
+	h.Write(fill(salt))
+	h.Write(fill(append(bmpString(password), 0, 0)))
+	a := h.Sum(nil)
+	for i := 1; i < iterations; i++ {
+		sum := sha256.Sum256(a)
+		a = sum[:]
+	}
+	return a
+}
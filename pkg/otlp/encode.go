@@ -0,0 +1,264 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The OTLP messages are encoded with protowire, following
+// opentelemetry/proto/collector/{metrics,logs}/v1, to keep the OpenTelemetry
+// SDK out of the controller and the renewer.
+
+// aggregationCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE, Prometheus
+// counters and histograms are cumulative since the start of the process.
+const aggregationCumulative = 2
+
+// Attribute is a string attribute of a resource, data point or log record.
+type Attribute struct {
+	Key, Value string
+}
+
+// sortedAttributes returns the attributes of a map, sorted by key.
+func sortedAttributes(m map[string]string) []Attribute {
+	attrs := make([]Attribute, 0, len(m))
+	for k, v := range m {
+		attrs = append(attrs, Attribute{k, v})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+// appendAttributes appends KeyValue fields with string values.
+func appendAttributes(b []byte, num protowire.Number, attrs []Attribute) []byte {
+	for _, a := range attrs {
+		var kv []byte
+		kv = appendString(kv, 1, a.Key)
+		// The string_value of the AnyValue, set even when empty.
+		value := protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), a.Value)
+		kv = appendMessage(kv, 2, value)
+		b = appendMessage(b, num, kv)
+	}
+	return b
+}
+
+// resource returns a Resource message.
+func resource(attrs []Attribute) []byte {
+	return appendAttributes(nil, 1, attrs)
+}
+
+// scope returns the InstrumentationScope message of the exporter.
+func scope() []byte {
+	return appendString(nil, 1, scopeName)
+}
+
+// metricsRequest returns an ExportMetricsServiceRequest with the gathered
+// Prometheus metrics.
+func metricsRequest(res []Attribute, families []*dto.MetricFamily, start, now time.Time) []byte {
+	var metrics []byte
+	metrics = appendMessage(metrics, 1, scope())
+	for _, mf := range families {
+		if m := metric(mf, start, now); m != nil {
+			metrics = appendMessage(metrics, 2, m)
+		}
+	}
+	var rm []byte
+	rm = appendMessage(rm, 1, resource(res))
+	rm = appendMessage(rm, 2, metrics)
+	return appendMessage(nil, 1, rm)
+}
+
+// metric returns the Metric message of a Prometheus metric family, or nil
+// for the types without an OTLP equivalent.
+func metric(mf *dto.MetricFamily, start, now time.Time) []byte {
+	var data []byte
+	var field protowire.Number
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		field = 7 // sum
+		for _, m := range mf.GetMetric() {
+			data = appendMessage(data, 1, numberPoint(m, m.GetCounter().GetValue(), start, now))
+		}
+		data = appendVarint(data, 2, aggregationCumulative)
+		data = appendVarint(data, 3, 1) // is_monotonic
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		field = 5 // gauge
+		for _, m := range mf.GetMetric() {
+			v := m.GetGauge().GetValue()
+			if mf.GetType() == dto.MetricType_UNTYPED {
+				v = m.GetUntyped().GetValue()
+			}
+			data = appendMessage(data, 1, numberPoint(m, v, start, now))
+		}
+	case dto.MetricType_HISTOGRAM:
+		field = 9 // histogram
+		for _, m := range mf.GetMetric() {
+			data = appendMessage(data, 1, histogramPoint(m, start, now))
+		}
+		data = appendVarint(data, 2, aggregationCumulative)
+	case dto.MetricType_SUMMARY:
+		field = 11 // summary
+		for _, m := range mf.GetMetric() {
+			data = appendMessage(data, 1, summaryPoint(m, start, now))
+		}
+	default:
+		return nil
+	}
+	var b []byte
+	b = appendString(b, 1, mf.GetName())
+	b = appendString(b, 2, mf.GetHelp())
+	return appendMessage(b, field, data)
+}
+
+// appendPointTimes appends the start_time_unix_nano and time_unix_nano of a
+// data point, fields 2 and 3 of all the point messages.
+func appendPointTimes(b []byte, start, now time.Time) []byte {
+	b = appendFixed64(b, 2, uint64(start.UnixNano()))  //nolint:gosec // times after 1970
+	return appendFixed64(b, 3, uint64(now.UnixNano())) //nolint:gosec // times after 1970
+}
+
+// labels returns the labels of a metric as attributes.
+func labels(m *dto.Metric) []Attribute {
+	attrs := make([]Attribute, 0, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		attrs = append(attrs, Attribute{l.GetName(), l.GetValue()})
+	}
+	return attrs
+}
+
+// numberPoint returns a NumberDataPoint.
+func numberPoint(m *dto.Metric, v float64, start, now time.Time) []byte {
+	b := appendPointTimes(nil, start, now)
+	b = appendDouble(b, 4, v)
+	return appendAttributes(b, 7, labels(m))
+}
+
+// histogramPoint returns a HistogramDataPoint. Prometheus buckets are
+// cumulative with an implicit +Inf bucket, OTLP buckets count the samples
+// between two bounds, the last one above the highest bound.
+func histogramPoint(m *dto.Metric, start, now time.Time) []byte {
+	h := m.GetHistogram()
+	var bounds []float64
+	var counts []uint64
+	var previous uint64
+	for _, bucket := range h.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		bounds = append(bounds, bucket.GetUpperBound())
+		counts = append(counts, bucket.GetCumulativeCount()-previous)
+		previous = bucket.GetCumulativeCount()
+	}
+	counts = append(counts, h.GetSampleCount()-previous)
+
+	b := appendPointTimes(nil, start, now)
+	b = appendFixed64(b, 4, h.GetSampleCount())
+	b = appendDouble(b, 5, h.GetSampleSum())
+	var packed []byte
+	for _, c := range counts {
+		packed = protowire.AppendFixed64(packed, c)
+	}
+	b = appendBytes(b, 6, packed)
+	packed = nil
+	for _, bound := range bounds {
+		packed = protowire.AppendFixed64(packed, math.Float64bits(bound))
+	}
+	b = appendBytes(b, 7, packed)
+	return appendAttributes(b, 9, labels(m))
+}
+
+// summaryPoint returns a SummaryDataPoint.
+func summaryPoint(m *dto.Metric, start, now time.Time) []byte {
+	s := m.GetSummary()
+	b := appendPointTimes(nil, start, now)
+	b = appendFixed64(b, 4, s.GetSampleCount())
+	b = appendDouble(b, 5, s.GetSampleSum())
+	for _, q := range s.GetQuantile() {
+		var v []byte
+		v = appendDouble(v, 1, q.GetQuantile())
+		v = appendDouble(v, 2, q.GetValue())
+		b = appendMessage(b, 6, v)
+	}
+	return appendAttributes(b, 7, labels(m))
+}
+
+// logRecord is a log entry waiting to be exported.
+type logRecord struct {
+	time    time.Time
+	level   log.Level
+	message string
+	attrs   []Attribute
+}
+
+// severityNumbers are the OTLP SeverityNumber of the logrus levels.
+var severityNumbers = map[log.Level]uint64{
+	log.TraceLevel: 1,
+	log.DebugLevel: 5,
+	log.InfoLevel:  9,
+	log.WarnLevel:  13,
+	log.ErrorLevel: 17,
+	log.FatalLevel: 21,
+	log.PanicLevel: 24,
+}
+
+// logsRequest returns an ExportLogsServiceRequest with the records.
+func logsRequest(res []Attribute, records []logRecord) []byte {
+	var logs []byte
+	logs = appendMessage(logs, 1, scope())
+	for _, r := range records {
+		var b []byte
+		b = appendFixed64(b, 1, uint64(r.time.UnixNano())) //nolint:gosec // times after 1970
+		b = appendVarint(b, 2, severityNumbers[r.level])
+		b = appendString(b, 3, r.level.String())
+		b = appendMessage(b, 5, appendString(nil, 1, r.message))
+		b = appendAttributes(b, 6, r.attrs)
+		logs = appendMessage(logs, 2, b)
+	}
+	var rl []byte
+	rl = appendMessage(rl, 1, resource(res))
+	rl = appendMessage(rl, 2, logs)
+	return appendMessage(nil, 1, rl)
+}
+
+// appendString appends a string field, omitted when empty like proto3
+// does.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendBytes appends a bytes field, omitted when empty.
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendMessage appends an embedded message field, even when empty.
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	return appendFixed64(b, num, math.Float64bits(v))
+}
@@ -0,0 +1,263 @@
+// Package otlp pushes Prometheus metrics and logrus logs to an OpenTelemetry
+// collector with OTLP/HTTP, for clusters without a Prometheus scraping the
+// controller and the renewers. Metrics are gathered and exported at each
+// interval, logs are buffered in between.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultInterval is how often Run exports the metrics and the logs.
+	DefaultInterval = 30 * time.Second
+	// scopeName is the instrumentation scope of the exported data.
+	scopeName = "github.com/smallstep/autocert"
+	// maxLogs is how many log records are buffered between exports, the
+	// oldest ones are dropped.
+	maxLogs = 4096
+	// exportTimeout bounds each request to the collector.
+	exportTimeout = 10 * time.Second
+	// The environment variables of the OpenTelemetry SDKs configuring the
+	// exporter, also set by the controller in the renewers.
+	EndpointEnvVar = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	HeadersEnvVar  = "OTEL_EXPORTER_OTLP_HEADERS"
+	ResourceEnvVar = "OTEL_RESOURCE_ATTRIBUTES"
+)
+
+// Exporter exports metrics and logs to an OTLP/HTTP endpoint. It's a logrus
+// hook, added with log.AddHook to export the logs.
+type Exporter struct {
+	endpoint string
+	headers  map[string]string
+	resource []Attribute
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	start    time.Time
+	now      func() time.Time
+
+	mu      sync.Mutex
+	logs    []logRecord
+	dropped int
+}
+
+// Option configures an Exporter.
+type Option func(e *Exporter)
+
+// WithHeaders sets the headers of the requests, like the credentials of the
+// collector.
+func WithHeaders(headers map[string]string) Option {
+	return func(e *Exporter) {
+		e.headers = headers
+	}
+}
+
+// WithResource sets the attributes of the resource of the metrics and logs,
+// like service.name and k8s.namespace.name.
+func WithResource(attrs map[string]string) Option {
+	return func(e *Exporter) {
+		e.resource = sortedAttributes(attrs)
+	}
+}
+
+// WithGatherer sets the metrics to export, no metric is exported by default.
+func WithGatherer(g prometheus.Gatherer) Option {
+	return func(e *Exporter) {
+		e.gatherer = g
+	}
+}
+
+// WithHTTPClient sets the client of the requests to the collector.
+func WithHTTPClient(c *http.Client) Option {
+	return func(e *Exporter) {
+		e.client = c
+	}
+}
+
+// New returns an exporter to the OTLP/HTTP endpoint, the base URL of the
+// collector, like http://otel-collector.observability:4318. Metrics are sent
+// to /v1/metrics and logs to /v1/logs.
+func New(endpoint string, opts ...Option) (*Exporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("OTLP endpoint %q is not an http or https URL", endpoint)
+	}
+	e := &Exporter{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Timeout: exportTimeout},
+		start:    time.Now(),
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e, nil
+}
+
+// Levels implements logrus.Hook, all the levels are exported.
+func (e *Exporter) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook, buffering the entry until the next export.
+func (e *Exporter) Fire(entry *log.Entry) error {
+	r := logRecord{time: entry.Time, level: entry.Level, message: entry.Message}
+	fields := make(map[string]string, len(entry.Data))
+	for k, v := range entry.Data {
+		fields[k] = fmt.Sprint(v)
+	}
+	r.attrs = sortedAttributes(fields)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.logs) >= maxLogs {
+		e.logs = e.logs[1:]
+		e.dropped++
+	}
+	e.logs = append(e.logs, r)
+	return nil
+}
+
+// Run exports the metrics and the logs at each interval, and once more when
+// the context is done.
+func (e *Exporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+			defer cancel()
+			if err := e.Export(flushCtx); err != nil {
+				fmt.Fprintln(log.StandardLogger().Out, "Error exporting to OTLP endpoint:", err)
+			}
+			return
+		case <-ticker.C:
+			// Not logged with logrus, the error would be exported again.
+			if err := e.Export(ctx); err != nil {
+				fmt.Fprintln(log.StandardLogger().Out, "Error exporting to OTLP endpoint:", err)
+			}
+		}
+	}
+}
+
+// Start runs the exporter in the background. The returned function stops it
+// and returns after the last export, to call before the process exits.
+func (e *Exporter) Start(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(ctx, interval)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// Export sends the current metrics and the buffered logs. Logs that failed
+// to be sent are dropped.
+func (e *Exporter) Export(ctx context.Context) error {
+	var errs []string
+	if e.gatherer != nil {
+		families, err := e.gatherer.Gather()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		if len(families) > 0 {
+			if err := e.post(ctx, "/v1/metrics", metricsRequest(e.resource, families, e.start, e.now())); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	e.mu.Lock()
+	records, dropped := e.logs, e.dropped
+	e.logs, e.dropped = nil, 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		records = append(records, logRecord{
+			time:    e.now(),
+			level:   log.WarnLevel,
+			message: fmt.Sprintf("Dropped %d log records, the OTLP endpoint is not keeping up", dropped),
+		})
+	}
+	if len(records) > 0 {
+		if err := e.post(ctx, "/v1/logs", logsRequest(e.resource, records)); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// post sends an export request, encoded with protobuf.
+func (e *Exporter) post(ctx context.Context, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "export to %s", path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("export to %s: %s: %s", path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// ParseAttributes parses key=value pairs separated by commas, the format of
+// $OTEL_RESOURCE_ATTRIBUTES and $OTEL_EXPORTER_OTLP_HEADERS. Values are
+// URL-decoded.
+func ParseAttributes(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, errors.Errorf("invalid attribute %q, want key=value", pair)
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid attribute %q", pair)
+		}
+		attrs[k] = value
+	}
+	return attrs, nil
+}
+
+// FormatAttributes formats attributes for ParseAttributes, sorted by key.
+func FormatAttributes(attrs map[string]string) string {
+	pairs := make([]string, 0, len(attrs))
+	for _, a := range sortedAttributes(attrs) {
+		pairs = append(pairs, a.Key+"="+url.PathEscape(a.Value))
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,288 @@
+package otlp
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field is a decoded protobuf field: the bytes of length-delimited fields,
+// or the value of varint and fixed64 ones.
+type field struct {
+	num   protowire.Number
+	bytes []byte
+	value uint64
+}
+
+func decode(t *testing.T, b []byte) []field {
+	t.Helper()
+	var fields []field
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		f := field{num: num}
+		switch typ {
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		default:
+			t.Fatalf("unexpected wire type %v", typ)
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// get returns the fields num, following the path of embedded messages.
+func get(t *testing.T, b []byte, path ...protowire.Number) []field {
+	t.Helper()
+	var result []field
+	for _, f := range decode(t, b) {
+		if f.num != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			result = append(result, f)
+		} else {
+			result = append(result, get(t, f.bytes, path[1:]...)...)
+		}
+	}
+	return result
+}
+
+// attributes decodes the KeyValue fields of a message.
+func attributes(t *testing.T, b []byte, num protowire.Number) map[string]string {
+	t.Helper()
+	attrs := make(map[string]string)
+	for _, kv := range get(t, b, num) {
+		key := string(get(t, kv.bytes, 1)[0].bytes)
+		attrs[key] = string(get(t, kv.bytes, 2, 1)[0].bytes)
+	}
+	return attrs
+}
+
+// collector records the requests of an exporter.
+type collector struct {
+	mu       sync.Mutex
+	requests map[string][][]byte
+	headers  http.Header
+}
+
+func newCollector(t *testing.T) (*collector, *httptest.Server) {
+	c := &collector{requests: make(map[string][][]byte)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.requests[r.URL.Path] = append(c.requests[r.URL.Path], b)
+		c.headers = r.Header.Clone()
+	}))
+	t.Cleanup(srv.Close)
+	return c, srv
+}
+
+func TestExportMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "Test counter."}, []string{"result"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Buckets: []float64{0.1, 1}})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge"})
+	registry.MustRegister(counter, histogram, gauge)
+	counter.WithLabelValues("success").Add(3)
+	for _, v := range []float64{0.05, 0.5, 0.7, 5} {
+		histogram.Observe(v)
+	}
+	gauge.Set(-2)
+
+	c, srv := newCollector(t)
+	e, err := New(srv.URL+"/", WithGatherer(registry), WithHeaders(map[string]string{"Authorization": "Bearer token"}),
+		WithResource(map[string]string{"service.name": "autocert-controller", "k8s.cluster.name": "prod"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.requests["/v1/metrics"]) != 1 || len(c.requests["/v1/logs"]) != 0 {
+		t.Fatalf("requests = %v, want a metrics request", c.requests)
+	}
+	if got := c.headers.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization = %q", got)
+	}
+
+	req := c.requests["/v1/metrics"][0]
+	if got := attributes(t, get(t, req, 1, 1)[0].bytes, 1); !reflect.DeepEqual(got, map[string]string{"service.name": "autocert-controller", "k8s.cluster.name": "prod"}) {
+		t.Errorf("resource = %v", got)
+	}
+	metrics := map[string][]byte{}
+	for _, m := range get(t, req, 1, 2, 2) {
+		metrics[string(get(t, m.bytes, 1)[0].bytes)] = m.bytes
+	}
+
+	// Counters are monotonic cumulative sums.
+	sum := get(t, metrics["test_total"], 7)[0].bytes
+	if temporality, monotonic := get(t, sum, 2)[0].value, get(t, sum, 3)[0].value; temporality != aggregationCumulative || monotonic != 1 {
+		t.Errorf("sum temporality = %d, monotonic = %d", temporality, monotonic)
+	}
+	point := get(t, sum, 1)[0].bytes
+	if v := math.Float64frombits(get(t, point, 4)[0].value); v != 3 {
+		t.Errorf("counter = %v, want 3", v)
+	}
+	if got := attributes(t, point, 7); got["result"] != "success" {
+		t.Errorf("counter attributes = %v", got)
+	}
+	if start, now := get(t, point, 2)[0].value, get(t, point, 3)[0].value; start == 0 || now < start {
+		t.Errorf("start = %d, time = %d", start, now)
+	}
+
+	// Histogram buckets are not cumulative, with an overflow bucket.
+	point = get(t, metrics["test_seconds"], 9, 1)[0].bytes
+	if count := get(t, point, 4)[0].value; count != 4 {
+		t.Errorf("histogram count = %d, want 4", count)
+	}
+	var counts []uint64
+	for b := get(t, point, 6)[0].bytes; len(b) > 0; b = b[8:] {
+		v, _ := protowire.ConsumeFixed64(b)
+		counts = append(counts, v)
+	}
+	if !reflect.DeepEqual(counts, []uint64{1, 2, 1}) {
+		t.Errorf("bucket counts = %v, want [1 2 1]", counts)
+	}
+	if bounds := get(t, point, 7)[0].bytes; len(bounds) != 16 {
+		t.Errorf("explicit bounds = %d bytes, want 2 bounds", len(bounds))
+	}
+
+	point = get(t, metrics["test_gauge"], 5, 1)[0].bytes
+	if v := math.Float64frombits(get(t, point, 4)[0].value); v != -2 {
+		t.Errorf("gauge = %v, want -2", v)
+	}
+}
+
+func TestExportLogs(t *testing.T) {
+	c, srv := newCollector(t)
+	e, err := New(srv.URL, WithResource(map[string]string{"service.name": "autocert-renewer"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	logger.AddHook(e)
+	logger.WithField("namespace", "default").Warn("Renewal failed")
+	logger.Info("Renewed")
+
+	if err := e.Export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records := get(t, c.requests["/v1/logs"][0], 1, 2, 2)
+	if len(records) != 2 {
+		t.Fatalf("exported %d records, want 2", len(records))
+	}
+	r := records[0].bytes
+	if severity, text := get(t, r, 2)[0].value, string(get(t, r, 3)[0].bytes); severity != 13 || text != "warning" {
+		t.Errorf("severity = %d %s", severity, text)
+	}
+	if body := string(get(t, r, 5, 1)[0].bytes); body != "Renewal failed" {
+		t.Errorf("body = %q", body)
+	}
+	if got := attributes(t, r, 6); got["namespace"] != "default" {
+		t.Errorf("attributes = %v", got)
+	}
+
+	// Logs are sent once.
+	if err := e.Export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.requests["/v1/logs"]); n != 1 {
+		t.Errorf("%d logs requests, want 1", n)
+	}
+
+	for range maxLogs + 10 {
+		logger.Info("Renewed")
+	}
+	if err := e.Export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records = get(t, c.requests["/v1/logs"][1], 1, 2, 2)
+	last := records[len(records)-1].bytes
+	if len(records) != maxLogs+1 || !strings.Contains(string(get(t, last, 5, 1)[0].bytes), "Dropped 10 log records") {
+		t.Errorf("exported %d records, want %d and the dropped records", len(records), maxLogs+1)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	if _, err := New("otel-collector:4318"); err == nil {
+		t.Error("New() without scheme succeeded")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total"}))
+	e, err := New(srv.URL, WithGatherer(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export(context.Background()); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("Export() = %v, want the error of the collector", err)
+	}
+}
+
+func TestStart(t *testing.T) {
+	c, srv := newCollector(t)
+	e, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := e.Start(time.Hour)
+	if err := e.Fire(&log.Entry{Time: time.Now(), Level: log.InfoLevel, Message: "Stopping"}); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	if n := len(c.requests["/v1/logs"]); n != 1 {
+		t.Errorf("%d logs requests after stop, want the last export", n)
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	attrs := map[string]string{"k8s.cluster.name": "prod", "deployment.environment": "us east,1"}
+	s := FormatAttributes(attrs)
+	if s != "deployment.environment=us%20east%2C1,k8s.cluster.name=prod" {
+		t.Errorf("FormatAttributes() = %s", s)
+	}
+	got, err := ParseAttributes(s + ", ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, attrs) {
+		t.Errorf("ParseAttributes() = %v, want %v", got, attrs)
+	}
+	if _, err := ParseAttributes("novalue"); err == nil {
+		t.Error("ParseAttributes() without value succeeded")
+	}
+}
@@ -0,0 +1,117 @@
+// Package resolver defines the extension point used by the autocert
+// controller to add names to the certificates requested by pods, so names
+// from non-Kubernetes sources, like a CMDB or a service registry, can be
+// included without forking the controller.
+//
+// Resolvers are registered by name from an init function, like database/sql
+// drivers, and enabled in the controller with the sanResolvers setting:
+//
+//	func init() {
+//		resolver.Register("cmdb", resolver.Func(func(ctx context.Context, req resolver.Request) ([]string, error) {
+//			return cmdb.Lookup(ctx, req.Namespace, req.Pod.Labels["app"])
+//		}))
+//	}
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Request describes the certificate requested by a pod.
+type Request struct {
+	// Pod is the pod being admitted. It must not be modified.
+	Pod *corev1.Pod
+	// Namespace is the namespace of the pod.
+	Namespace string
+	// CommonName is the common name of the certificate.
+	CommonName string
+	// SANs are the names already included in the certificate.
+	SANs []string
+}
+
+// Resolver returns additional names to include in the certificate requested
+// by a pod. Returning an error rejects the pod.
+type Resolver interface {
+	Resolve(ctx context.Context, req Request) ([]string, error)
+}
+
+// Func is an adapter to use ordinary functions as resolvers.
+type Func func(ctx context.Context, req Request) ([]string, error)
+
+// Resolve calls f(ctx, req).
+func (f Func) Resolve(ctx context.Context, req Request) ([]string, error) {
+	return f(ctx, req)
+}
+
+var (
+	mu        sync.RWMutex
+	resolvers = make(map[string]Resolver)
+)
+
+// Register makes a resolver available by the provided name. It panics if
+// Register is called twice with the same name or if r is nil.
+func Register(name string, r Resolver) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if r == nil {
+		panic("resolver: Register resolver is nil")
+	}
+	if _, dup := resolvers[name]; dup {
+		panic("resolver: Register called twice for resolver " + name)
+	}
+	resolvers[name] = r
+}
+
+// Lookup returns the resolver registered with the given name.
+func Lookup(name string) (Resolver, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	r, ok := resolvers[name]
+	if !ok {
+		return nil, fmt.Errorf("resolver %q is not registered", name)
+	}
+	return r, nil
+}
+
+// Names returns the sorted names of the registered resolvers.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(resolvers))
+	for name := range resolvers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Resolve runs the named resolvers in order and returns sans with the names
+// they return appended, skipping duplicates.
+func Resolve(ctx context.Context, names []string, req Request) ([]string, error) {
+	sans := slices.Clone(req.SANs)
+	for _, name := range names {
+		r, err := Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		req.SANs = slices.Clone(sans)
+		extra, err := r.Resolve(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("resolver %q: %w", name, err)
+		}
+		for _, san := range extra {
+			if san != "" && !slices.Contains(sans, san) {
+				sans = append(sans, san)
+			}
+		}
+	}
+	return sans, nil
+}
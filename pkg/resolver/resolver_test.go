@@ -0,0 +1,54 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	Register("test-static", Func(func(ctx context.Context, req Request) ([]string, error) {
+		return []string{"api.example.com", req.CommonName}, nil
+	}))
+	Register("test-seen", Func(func(ctx context.Context, req Request) ([]string, error) {
+		// Later resolvers see the names added by earlier ones.
+		if len(req.SANs) != 2 {
+			return nil, errors.New("unexpected sans")
+		}
+		return []string{"api.example.net"}, nil
+	}))
+	Register("test-error", Func(func(ctx context.Context, req Request) ([]string, error) {
+		return nil, errors.New("cmdb unavailable")
+	}))
+
+	req := Request{CommonName: "api.default.svc", SANs: []string{"api.default.svc"}}
+
+	got, err := Resolve(context.Background(), []string{"test-static", "test-seen"}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"api.default.svc", "api.example.com", "api.example.net"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(req.SANs, []string{"api.default.svc"}) {
+		t.Errorf("Resolve() modified the request SANs: %v", req.SANs)
+	}
+
+	if _, err := Resolve(context.Background(), []string{"test-error"}, req); err == nil {
+		t.Error("Resolve() with a failing resolver should fail")
+	}
+	if _, err := Resolve(context.Background(), []string{"missing"}, req); err == nil {
+		t.Error("Resolve() with an unregistered resolver should fail")
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	Register("test-duplicate", Func(func(context.Context, Request) ([]string, error) { return nil, nil }))
+	defer func() {
+		if recover() == nil {
+			t.Error("Register() twice should panic")
+		}
+	}()
+	Register("test-duplicate", Func(func(context.Context, Request) ([]string, error) { return nil, nil }))
+}
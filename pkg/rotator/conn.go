@@ -0,0 +1,109 @@
+package rotator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// DefaultDrainMargin is the default time before the expiration of a
+// connection at which it is drained.
+const DefaultDrainMargin = time.Minute
+
+// Expiry returns the time at which a long-lived TLS connection stops being
+// backed by valid certificates: the earliest expiration of the peer
+// certificate and of the local certificate, which can be nil. TLS only checks
+// certificates during the handshake, so connections outliving this time keep
+// using expired certificates unless they are closed.
+func Expiry(state tls.ConnectionState, local *x509.Certificate) time.Time {
+	var expiry time.Time
+	if len(state.PeerCertificates) > 0 {
+		expiry = state.PeerCertificates[0].NotAfter
+	}
+	if local != nil && (expiry.IsZero() || local.NotAfter.Before(expiry)) {
+		expiry = local.NotAfter
+	}
+	return expiry
+}
+
+// Tracker tracks long-lived connections, like WebSockets or streaming RPCs,
+// and asks them to drain before the certificates they were established with
+// expire, or when the local certificate is rotated. Draining is up to the
+// application: a server would typically send a GOAWAY-style message asking
+// the client to re-dial, and close the connection after a grace period.
+type Tracker struct {
+	// Margin is how long before the expiration of a connection it's
+	// drained. Defaults to DefaultDrainMargin.
+	Margin time.Duration
+	// Jitter spreads the drains triggered by DrainAll over this duration, so
+	// all clients don't re-dial at once.
+	Jitter time.Duration
+
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+type trackedConn struct {
+	once  sync.Once
+	drain func()
+	timer *time.Timer
+}
+
+func (c *trackedConn) run() {
+	c.once.Do(c.drain)
+}
+
+func (t *Tracker) margin() time.Duration {
+	if t.Margin > 0 {
+		return t.Margin
+	}
+	return DefaultDrainMargin
+}
+
+// Track starts tracking a connection expiring at expiry. The drain function
+// is called at most once, Margin before expiry or on DrainAll. The returned
+// function stops tracking the connection and must be called when it's
+// closed.
+func (t *Tracker) Track(expiry time.Time, drain func()) (untrack func()) {
+	c := &trackedConn{drain: drain}
+
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[*trackedConn]struct{})
+	}
+	t.conns[c] = struct{}{}
+	c.timer = time.AfterFunc(time.Until(expiry.Add(-t.margin())), c.run)
+	t.mu.Unlock()
+
+	return func() {
+		c.timer.Stop()
+		t.mu.Lock()
+		delete(t.conns, c)
+		t.mu.Unlock()
+	}
+}
+
+// DrainAll drains every tracked connection, spread over Jitter. It's
+// typically registered with Rotator.OnRotate, so connections are
+// re-established with the new certificate.
+func (t *Tracker) DrainAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for c := range t.conns {
+		var delay time.Duration
+		if t.Jitter > 0 {
+			delay = rand.N(t.Jitter) //nolint:gosec // jitter doesn't need a secure source
+		}
+		c.timer.Reset(delay)
+	}
+}
+
+// Len returns the number of tracked connections.
+func (t *Tracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
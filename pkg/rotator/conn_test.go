@@ -0,0 +1,66 @@
+package rotator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	peer := &x509.Certificate{NotAfter: now.Add(2 * time.Hour)}
+	local := &x509.Certificate{NotAfter: now.Add(time.Hour)}
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{peer}}
+
+	if got := Expiry(state, local); !got.Equal(local.NotAfter) {
+		t.Errorf("Expiry() = %v, want local expiration %v", got, local.NotAfter)
+	}
+	if got := Expiry(state, nil); !got.Equal(peer.NotAfter) {
+		t.Errorf("Expiry() = %v, want peer expiration %v", got, peer.NotAfter)
+	}
+	if got := Expiry(tls.ConnectionState{}, local); !got.Equal(local.NotAfter) {
+		t.Errorf("Expiry() = %v, want local expiration %v", got, local.NotAfter)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tracker := &Tracker{Margin: time.Hour}
+
+	// Drained at expiration minus the margin.
+	expiring := make(chan struct{})
+	untrack := tracker.Track(time.Now().Add(time.Hour+10*time.Millisecond), func() { close(expiring) })
+	select {
+	case <-expiring:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not drained before expiration")
+	}
+	untrack()
+
+	// Drained by DrainAll, only once.
+	var drains atomic.Int32
+	done := make(chan struct{})
+	untrack = tracker.Track(time.Now().Add(24*time.Hour), func() {
+		drains.Add(1)
+		close(done)
+	})
+	if tracker.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", tracker.Len())
+	}
+	tracker.DrainAll()
+	tracker.DrainAll()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not drained by DrainAll")
+	}
+	untrack()
+	if tracker.Len() != 0 {
+		t.Errorf("Len() = %d after untrack, want 0", tracker.Len())
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := drains.Load(); n != 1 {
+		t.Errorf("drain called %d times, want 1", n)
+	}
+}
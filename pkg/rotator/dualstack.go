@@ -0,0 +1,40 @@
+package rotator
+
+import (
+	"crypto/tls"
+)
+
+// DualStack serves an ECDSA certificate to the clients supporting it and an
+// RSA certificate to the others, for pods serving both modern clients and
+// legacy RSA-only ones. Each certificate is kept up to date by its own
+// Rotator. With the autocert.step.sm/dual-stack annotation, autocert writes
+// the RSA certificate and key next to the ECDSA ones:
+//
+//	ecdsa, _ := rotator.New("/var/run/autocert.step.sm/site.crt", "/var/run/autocert.step.sm/site.key")
+//	rsa, _ := rotator.New("/var/run/autocert.step.sm/site-rsa.crt", "/var/run/autocert.step.sm/site-rsa.key")
+//	ds := rotator.NewDualStack(ecdsa, rsa)
+//	srv.TLSConfig = &tls.Config{GetCertificate: ds.GetCertificate}
+type DualStack struct {
+	ecdsa *Rotator
+	rsa   *Rotator
+}
+
+// NewDualStack returns a DualStack serving the certificate of ecdsa, and the
+// one of rsa to clients that can't use it.
+func NewDualStack(ecdsa, rsa *Rotator) *DualStack {
+	return &DualStack{
+		ecdsa: ecdsa,
+		rsa:   rsa,
+	}
+}
+
+// GetCertificate returns the ECDSA certificate if the client supports it,
+// and the RSA certificate otherwise. It can be used as
+// tls.Config.GetCertificate.
+func (d *DualStack) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := d.ecdsa.Certificate()
+	if hello.SupportsCertificate(cert) == nil {
+		return cert, nil
+	}
+	return d.rsa.Certificate(), nil
+}
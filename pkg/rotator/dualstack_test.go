@@ -0,0 +1,101 @@
+package rotator
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestRSARotator returns a Rotator for a new self-signed RSA certificate.
+func newTestRSARotator(t *testing.T) *Rotator {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "site-rsa.crt"), filepath.Join(dir, "site-rsa.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestDualStack(t *testing.T) {
+	ec := newTestRotator(t, "site")
+	rsa := newTestRSARotator(t)
+	ds := NewDualStack(ec, rsa)
+
+	tests := []struct {
+		name  string
+		hello *tls.ClientHelloInfo
+		want  *Rotator
+	}{
+		{"tls13", &tls.ClientHelloInfo{
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+			SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		}, ec},
+		{"tls12 ecdhe-ecdsa", &tls.ClientHelloInfo{
+			SupportedVersions: []uint16{tls.VersionTLS12},
+			CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PKCS1WithSHA256},
+			SupportedCurves:   []tls.CurveID{tls.CurveP256},
+			SupportedPoints:   []uint8{0},
+		}, ec},
+		{"tls12 rsa only", &tls.ClientHelloInfo{
+			SupportedVersions: []uint16{tls.VersionTLS12},
+			CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes:  []tls.SignatureScheme{tls.PKCS1WithSHA256},
+			SupportedCurves:   []tls.CurveID{tls.CurveP256},
+			SupportedPoints:   []uint8{0},
+		}, rsa},
+		{"tls13 without ecdsa", &tls.ClientHelloInfo{
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.PSSWithSHA256},
+			SupportedCurves:   []tls.CurveID{tls.X25519},
+		}, rsa},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := ds.GetCertificate(tt.hello)
+			if err != nil {
+				t.Fatalf("GetCertificate() error = %v", err)
+			}
+			if cert != tt.want.Certificate() {
+				t.Errorf("GetCertificate() returned the %T certificate", cert.PrivateKey)
+			}
+		})
+	}
+}
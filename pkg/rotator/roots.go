@@ -0,0 +1,139 @@
+package rotator
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Roots holds the pool of root certificates written by autocert, and
+// reloads it when the file changes, so peers issued by a new root are
+// trusted without restarting.
+type Roots struct {
+	file string
+
+	mu      sync.RWMutex
+	raw     []byte
+	pool    *x509.CertPool
+	watcher *watcher
+}
+
+// LoadRoots returns the Roots of the given file. The file is loaded
+// immediately.
+func LoadRoots(file string) (*Roots, error) {
+	r := &Roots{file: file}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the root file and replaces the pool if it has changed. It
+// returns whether the pool was replaced. On error the current pool is kept.
+func (r *Roots) Reload() (bool, error) {
+	b, err := os.ReadFile(r.file)
+	if err != nil {
+		return false, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return false, fmt.Errorf("%s does not contain a PEM certificate", r.file)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if bytes.Equal(r.raw, b) {
+		return false, nil
+	}
+	r.raw, r.pool = b, pool
+	return true, nil
+}
+
+// Pool returns the current pool. It's not modified by later reloads.
+func (r *Roots) Pool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// Watch reloads the pool every time the root file changes, until Close is
+// called. Errors are ignored and the current pool is kept. Calling Watch
+// again has no effect.
+func (r *Roots) Watch() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.watcher == nil {
+		r.watcher = watch([]string{r.file}, r.Reload)
+	}
+}
+
+// Close stops watching the root file.
+func (r *Roots) Close() error {
+	r.mu.Lock()
+	w := r.watcher
+	r.watcher = nil
+	r.mu.Unlock()
+	if w != nil {
+		w.close()
+	}
+	return nil
+}
+
+// ServerConfig returns a server configuration verifying clients with the
+// current pool. Each connection uses a copy of base with the current pool as
+// ClientCAs.
+func (r *Roots) ServerConfig(base *tls.Config) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := base.Clone()
+			config.ClientCAs = r.Pool()
+			return config, nil
+		},
+	}
+}
+
+// ClientConfig returns a copy of base verifying servers with the current
+// pool. The chain and the server name are verified by VerifyConnection, as
+// RootCAs can't be replaced after a configuration is in use.
+func (r *Roots) ClientConfig(base *tls.Config) *tls.Config {
+	config := base.Clone()
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	next := config.VerifyConnection
+	config.InsecureSkipVerify = true //nolint:gosec // verified by VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := r.VerifyConnection(cs); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(cs)
+		}
+		return nil
+	}
+	return config
+}
+
+// VerifyConnection verifies the certificate of a server against the current
+// pool and the server name of the connection. It can be used as
+// tls.Config.VerifyConnection of a client with InsecureSkipVerify set.
+func (r *Roots) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server did not send a certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         r.Pool(),
+		Intermediates: intermediates,
+		DNSName:       cs.ServerName,
+	})
+	return err
+}
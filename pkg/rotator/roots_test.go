@@ -0,0 +1,159 @@
+package rotator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCA returns a root certificate and a server certificate it issued
+// for name.
+func newTestCA(t *testing.T, name string) (root, leaf *x509.Certificate) {
+	t.Helper()
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, root, key.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return root, leaf
+}
+
+func writeRoot(t *testing.T, filename string, root *x509.Certificate) {
+	t.Helper()
+	if err := os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoots(t *testing.T) {
+	rootFile := filepath.Join(t.TempDir(), "root.crt")
+	oldRoot, oldLeaf := newTestCA(t, "hello.default.svc")
+	newRoot, newLeaf := newTestCA(t, "hello.default.svc")
+	writeRoot(t, rootFile, oldRoot)
+
+	if _, err := LoadRoots(filepath.Join(t.TempDir(), "missing.crt")); err == nil {
+		t.Error("LoadRoots() with a missing file should fail")
+	}
+	roots, err := LoadRoots(rootFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := roots.ClientConfig(&tls.Config{MinVersion: tls.VersionTLS13})
+	if !client.InsecureSkipVerify || client.MinVersion != tls.VersionTLS13 {
+		t.Errorf("ClientConfig() = %+v", client)
+	}
+	verify := func(leaf *x509.Certificate, serverName string) error {
+		return client.VerifyConnection(tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf},
+			ServerName:       serverName,
+		})
+	}
+	if err := verify(oldLeaf, "hello.default.svc"); err != nil {
+		t.Errorf("VerifyConnection() error = %v", err)
+	}
+	if err := verify(oldLeaf, "other.default.svc"); err == nil {
+		t.Error("VerifyConnection() with another server name should fail")
+	}
+	if err := verify(newLeaf, "hello.default.svc"); err == nil {
+		t.Error("VerifyConnection() with an unknown root should fail")
+	}
+
+	if ok, err := roots.Reload(); ok || err != nil {
+		t.Errorf("Reload() without changes = %v, %v, want false, nil", ok, err)
+	}
+	writeRoot(t, rootFile, newRoot)
+	if ok, err := roots.Reload(); !ok || err != nil {
+		t.Fatalf("Reload() after rotation = %v, %v, want true, nil", ok, err)
+	}
+	if err := verify(newLeaf, "hello.default.svc"); err != nil {
+		t.Errorf("VerifyConnection() after rotation error = %v", err)
+	}
+	server, err := roots.ServerConfig(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}).GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newLeaf.Verify(x509.VerifyOptions{Roots: server.ClientCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("ServerConfig() ClientCAs don't include the new root: %v", err)
+	}
+
+	// An invalid file keeps the current pool.
+	if err := os.WriteFile(rootFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := roots.Reload(); err == nil {
+		t.Error("Reload() with an invalid root should fail")
+	}
+	if err := verify(newLeaf, "hello.default.svc"); err != nil {
+		t.Errorf("VerifyConnection() after a failed reload error = %v", err)
+	}
+}
+
+func TestRootsWatch(t *testing.T) {
+	rootFile := filepath.Join(t.TempDir(), "root.crt")
+	oldRoot, _ := newTestCA(t, "hello.default.svc")
+	newRoot, newLeaf := newTestCA(t, "hello.default.svc")
+	writeRoot(t, rootFile, oldRoot)
+
+	roots, err := LoadRoots(rootFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots.Watch()
+	defer roots.Close()
+
+	writeRoot(t, rootFile, newRoot)
+	deadline := time.Now().Add(2 * DefaultInterval)
+	for {
+		if _, err := newLeaf.Verify(x509.VerifyOptions{Roots: roots.Pool()}); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("root was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,234 @@
+// Package rotator loads the certificate and key written by autocert and
+// reloads them when they are renewed, so TLS servers and clients rotate
+// certificates without restarting.
+//
+//	r, err := rotator.New("/var/run/autocert.step.sm/site.crt", "/var/run/autocert.step.sm/site.key")
+//	if err != nil {
+//		return err
+//	}
+//	r.Watch()
+//	defer r.Close()
+//	tlsConfig := &tls.Config{GetCertificate: r.GetCertificate}
+//
+// Watch reloads the files as soon as they're written, using inotify on Linux.
+// It polls them on other platforms, on network filesystems like NFS, and when
+// inotify misses a change. Run polls them every interval until a context is
+// done instead.
+//
+// The root certificates are reloaded the same way by Roots, for servers
+// verifying clients and clients verifying servers while the root is rotated:
+//
+//	roots, err := rotator.LoadRoots("/var/run/autocert.step.sm/root.crt")
+//	if err != nil {
+//		return err
+//	}
+//	roots.Watch()
+//	defer roots.Close()
+//	srv.TLSConfig = roots.ServerConfig(&tls.Config{
+//		ClientAuth:     tls.RequireAndVerifyClientCert,
+//		GetCertificate: r.GetCertificate,
+//	})
+//
+// Applications reacting to rotations, for instance to flush connection pools
+// or re-handshake with upstreams, subscribe to rotation events:
+//
+//	events := r.Subscribe()
+//	defer r.Unsubscribe(events)
+//	for e := range events {
+//		log.Printf("rotated %s to %s", e.Previous.Leaf.SerialNumber, e.Current.Leaf.SerialNumber)
+//		pool.CloseIdleConnections()
+//	}
+package rotator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is the default interval between checks for a renewed
+// certificate.
+const DefaultInterval = 15 * time.Second
+
+// Rotator holds the current certificate and key, and reloads them from disk
+// when they change.
+type Rotator struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	onRotate    []func(*tls.Certificate)
+	subscribers []chan RotationEvent
+	watcher     *watcher
+}
+
+// RotationEvent describes a certificate rotation.
+type RotationEvent struct {
+	// Previous is the certificate that was replaced.
+	Previous *tls.Certificate
+	// Current is the new certificate.
+	Current *tls.Certificate
+	// Time is when the rotation was detected.
+	Time time.Time
+}
+
+// New returns a Rotator for the given certificate and key files. The files
+// are loaded immediately.
+func New(certFile, keyFile string) (*Rotator, error) {
+	r := &Rotator{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate and key files and replaces the current
+// certificate if it has changed. It returns whether the certificate was
+// rotated. On error the current certificate is kept.
+func (r *Rotator) Reload() (bool, error) {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false, err
+		}
+	}
+
+	r.mu.Lock()
+	if r.cert != nil && bytes.Equal(r.cert.Certificate[0], cert.Certificate[0]) {
+		r.mu.Unlock()
+		return false, nil
+	}
+	if r.cert != nil {
+		r.notify(RotationEvent{Previous: r.cert, Current: &cert, Time: time.Now()})
+	}
+	r.cert = &cert
+	callbacks := r.onRotate
+	r.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn(&cert)
+	}
+	return true, nil
+}
+
+// Run reloads the certificate every interval until the context is done.
+// Errors are ignored and the current certificate is kept, so a partially
+// written renewal is picked up on the next check.
+func (r *Rotator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _ = r.Reload()
+		}
+	}
+}
+
+// Watch reloads the certificate every time the certificate or key file
+// changes, until Close is called. Errors are ignored and the current
+// certificate is kept, as with Run. Calling Watch again has no effect.
+func (r *Rotator) Watch() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.watcher == nil {
+		r.watcher = watch([]string{r.certFile, r.keyFile}, r.Reload)
+	}
+}
+
+// Close stops watching the files. The current certificate is still served.
+func (r *Rotator) Close() error {
+	r.mu.Lock()
+	w := r.watcher
+	r.watcher = nil
+	r.mu.Unlock()
+	if w != nil {
+		w.close()
+	}
+	return nil
+}
+
+// OnRotate registers a function called with the new certificate every time
+// the certificate is rotated.
+func (r *Rotator) OnRotate(fn func(*tls.Certificate)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onRotate = append(r.onRotate, fn)
+}
+
+// Subscribe returns a channel receiving an event every time the certificate
+// is rotated. Events are never blocked on a slow subscriber: if the previous
+// event hasn't been received yet, it's merged with the new one, so Previous is
+// the certificate the subscriber last knew about. The channel is closed by
+// Unsubscribe.
+func (r *Rotator) Subscribe() <-chan RotationEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch := make(chan RotationEvent, 1)
+	r.subscribers = append(r.subscribers, ch)
+	return ch
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe, and
+// closes it.
+func (r *Rotator) Unsubscribe(events <-chan RotationEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, ch := range r.subscribers {
+		if ch == events {
+			r.subscribers = append(r.subscribers[:i], r.subscribers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// notify sends an event to every subscriber. It must be called with the lock
+// held.
+func (r *Rotator) notify(e RotationEvent) {
+	for _, ch := range r.subscribers {
+		ev := e
+		select {
+		case pending := <-ch:
+			ev.Previous = pending.Previous
+		default:
+		}
+		ch <- ev
+	}
+}
+
+// Certificate returns the current certificate.
+func (r *Rotator) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// Leaf returns the parsed leaf of the current certificate.
+func (r *Rotator) Leaf() *x509.Certificate {
+	return r.Certificate().Leaf
+}
+
+// GetCertificate returns the current certificate. It can be used as
+// tls.Config.GetCertificate.
+func (r *Rotator) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate returns the current certificate. It can be used as
+// tls.Config.GetClientCertificate.
+func (r *Rotator) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
@@ -0,0 +1,144 @@
+package rotator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a new self-signed certificate and key.
+func writeCertificate(t *testing.T, certFile, keyFile string, notAfter time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotator(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "site.crt"), filepath.Join(dir, "site.key")
+	writeCertificate(t, certFile, keyFile, time.Now().Add(time.Hour))
+
+	r, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := r.Leaf()
+	if first == nil || first.Subject.CommonName != "test" {
+		t.Fatalf("Leaf() = %v, want the test certificate", first)
+	}
+
+	var rotated *tls.Certificate
+	r.OnRotate(func(c *tls.Certificate) { rotated = c })
+
+	if ok, err := r.Reload(); err != nil || ok {
+		t.Errorf("Reload() without changes = %v, %v, want false, nil", ok, err)
+	}
+
+	writeCertificate(t, certFile, keyFile, time.Now().Add(2*time.Hour))
+	if ok, err := r.Reload(); err != nil || !ok {
+		t.Fatalf("Reload() after renewal = %v, %v, want true, nil", ok, err)
+	}
+	if rotated == nil || rotated != r.Certificate() {
+		t.Error("OnRotate callback was not called with the new certificate")
+	}
+	if r.Leaf().SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Error("Reload() did not replace the certificate")
+	}
+
+	// A partial write keeps the current certificate.
+	current := r.Certificate()
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reload(); err == nil {
+		t.Error("Reload() with an invalid key should fail")
+	}
+	if c, _ := r.GetCertificate(nil); c != current {
+		t.Error("GetCertificate() should return the last valid certificate")
+	}
+}
+
+func TestRotatorSubscribe(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "site.crt"), filepath.Join(dir, "site.key")
+	writeCertificate(t, certFile, keyFile, time.Now().Add(time.Hour))
+
+	r, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := r.Certificate()
+	events := r.Subscribe()
+
+	writeCertificate(t, certFile, keyFile, time.Now().Add(2*time.Hour))
+	if _, err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	e := <-events
+	if e.Previous != first || e.Current != r.Certificate() || e.Time.IsZero() {
+		t.Errorf("event = %+v, want rotation from the first certificate to the current one", e)
+	}
+
+	// Rotations missed by a slow subscriber are merged.
+	second := r.Certificate()
+	for range 2 {
+		writeCertificate(t, certFile, keyFile, time.Now().Add(2*time.Hour))
+		if _, err := r.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e = <-events
+	if e.Previous != second || e.Current != r.Certificate() {
+		t.Errorf("event = %+v, want rotation from the second certificate to the current one", e)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+
+	r.Unsubscribe(events)
+	if _, ok := <-events; ok {
+		t.Error("Unsubscribe() should close the channel")
+	}
+	writeCertificate(t, certFile, keyFile, time.Now().Add(2*time.Hour))
+	if _, err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+}
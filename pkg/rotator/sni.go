@@ -0,0 +1,94 @@
+package rotator
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SNI serves a different certificate per server name, for gateway-style pods
+// terminating TLS for several internal hostnames. Each certificate is kept
+// up to date by its own Rotator. Use GetConfigForClient as the
+// tls.Config.GetConfigForClient of the listener:
+//
+//	sni := rotator.NewSNI(&tls.Config{MinVersion: tls.VersionTLS12})
+//	sni.Add(api, "api.default.svc")
+//	sni.Add(web, "web.default.svc", "*.web.default.svc")
+//	srv.TLSConfig = &tls.Config{GetConfigForClient: sni.GetConfigForClient}
+type SNI struct {
+	base *tls.Config
+
+	mu       sync.RWMutex
+	names    map[string]*Rotator
+	fallback *Rotator
+}
+
+// NewSNI returns an SNI using base as the configuration of every
+// connection. The certificate fields of base are ignored.
+func NewSNI(base *tls.Config) *SNI {
+	if base == nil {
+		base = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return &SNI{
+		base:  base,
+		names: make(map[string]*Rotator),
+	}
+}
+
+// Add serves the certificate of r for the given server names, which can be
+// wildcards like "*.example.com". If no names are given, the DNS names of the
+// current certificate are used.
+func (s *SNI) Add(r *Rotator, names ...string) {
+	if len(names) == 0 {
+		names = r.Leaf().DNSNames
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		s.names[strings.ToLower(strings.TrimSuffix(name, "."))] = r
+	}
+}
+
+// SetDefault serves the certificate of r to clients not sending a server
+// name or sending an unknown one. Without a default, those handshakes fail.
+func (s *SNI) SetDefault(r *Rotator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = r
+}
+
+// lookup returns the rotator for a server name, trying an exact match first
+// and then a wildcard match of the first label.
+func (s *SNI) lookup(serverName string) *Rotator {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if r, ok := s.names[name]; ok {
+		return r
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if r, ok := s.names["*"+name[i:]]; ok {
+			return r
+		}
+	}
+	return s.fallback
+}
+
+// GetConfigForClient returns the configuration for a connection, with the
+// certificate selected by the server name sent by the client. It can be used
+// as tls.Config.GetConfigForClient.
+func (s *SNI) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	r := s.lookup(hello.ServerName)
+	if r == nil {
+		return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+	}
+
+	config := s.base.Clone()
+	config.Certificates = nil
+	config.GetConfigForClient = nil
+	config.GetCertificate = r.GetCertificate
+	return config, nil
+}
@@ -0,0 +1,70 @@
+package rotator
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRotator(t *testing.T, name string) *Rotator {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writeCertificate(t, certFile, keyFile, time.Now().Add(time.Hour))
+	r, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestSNI(t *testing.T) {
+	api := newTestRotator(t, "api")
+	web := newTestRotator(t, "web")
+
+	sni := NewSNI(&tls.Config{MinVersion: tls.VersionTLS13, GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return nil, nil
+	}})
+	sni.Add(api, "api.default.svc")
+	sni.Add(web, "web.default.svc.", "*.web.default.svc")
+
+	tests := []struct {
+		serverName string
+		want       *Rotator
+	}{
+		{"api.default.svc", api},
+		{"API.default.svc", api},
+		{"web.default.svc", web},
+		{"v1.web.default.svc", web},
+		{"a.b.web.default.svc", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		config, err := sni.GetConfigForClient(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("GetConfigForClient(%q) should fail without a default", tt.serverName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("GetConfigForClient(%q) error = %v", tt.serverName, err)
+		}
+		if config.MinVersion != tls.VersionTLS13 || config.GetConfigForClient != nil {
+			t.Errorf("GetConfigForClient(%q) did not clone the base configuration", tt.serverName)
+		}
+		if c, _ := config.GetCertificate(nil); c != tt.want.Certificate() {
+			t.Errorf("GetConfigForClient(%q) returned the wrong certificate", tt.serverName)
+		}
+	}
+
+	sni.SetDefault(api)
+	config, err := sni.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := config.GetCertificate(nil); c != api.Certificate() {
+		t.Error("GetConfigForClient() without a server name should return the default certificate")
+	}
+}
@@ -0,0 +1,142 @@
+package rotator
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTicketKeyPeriod is the default lifetime of a session ticket key.
+const DefaultTicketKeyPeriod = time.Hour
+
+// minTicketSeedSize is the minimum size of the seed shared by replicas.
+const minTicketSeedSize = 32
+
+// TicketKeys rotates the TLS session ticket keys of a tls.Config, so a leaked
+// key only exposes the sessions resumed within a short window. Keys are
+// rotated every period, and every time the certificate is rotated.
+//
+// Replicas behind the same Service can share their keys, so clients resume
+// sessions with any of them, by mounting the same Secret holding a random
+// seed of at least 32 bytes:
+//
+//	kubectl create secret generic ticket-seed --from-literal=seed=$(openssl rand -hex 32)
+//
+// Keys are then derived from the seed and the current period, and rotate at
+// the same time on every replica. The seed is read again on every rotation,
+// so rotating the Secret also rotates the keys. Without a seed, every replica
+// generates random keys.
+//
+//	tk := rotator.NewTicketKeys(tlsConfig, "/var/run/secrets/ticket-seed/seed", rotator.DefaultTicketKeyPeriod)
+//	go tk.Run(ctx, r)
+type TicketKeys struct {
+	config   *tls.Config
+	seedFile string
+	period   time.Duration
+	now      func() time.Time
+
+	mu     sync.Mutex
+	random [][32]byte
+}
+
+// NewTicketKeys returns a TicketKeys rotating the session ticket keys of
+// config every period, with keys derived from the seed in seedFile, or random
+// keys if seedFile is empty. A zero period defaults to
+// DefaultTicketKeyPeriod.
+func NewTicketKeys(config *tls.Config, seedFile string, period time.Duration) *TicketKeys {
+	if period <= 0 {
+		period = DefaultTicketKeyPeriod
+	}
+	return &TicketKeys{
+		config:   config,
+		seedFile: seedFile,
+		period:   period,
+		now:      time.Now,
+	}
+}
+
+// Rotate sets new session ticket keys on the configuration. The new key
+// encrypts new tickets, and the previous one is kept to decrypt the tickets
+// it encrypted.
+func (t *TicketKeys) Rotate() error {
+	keys, err := t.keys(t.now())
+	if err != nil {
+		return err
+	}
+	t.config.SetSessionTicketKeys(keys)
+	return nil
+}
+
+// keys returns the keys to use at the given time, the current one first.
+func (t *TicketKeys) keys(now time.Time) ([][32]byte, error) {
+	if t.seedFile == "" {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return nil, err
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.random = append([][32]byte{key}, t.random...)[:min(len(t.random)+1, 2)]
+		return t.random, nil
+	}
+
+	seed, err := os.ReadFile(t.seedFile)
+	if err != nil {
+		return nil, err
+	}
+	seed = bytes.TrimSpace(seed)
+	if len(seed) < minTicketSeedSize {
+		return nil, fmt.Errorf("session ticket seed in %s is too short, it must be at least %d bytes", t.seedFile, minTicketSeedSize)
+	}
+	epoch := now.UnixNano() / int64(t.period)
+	return [][32]byte{deriveTicketKey(seed, epoch), deriveTicketKey(seed, epoch-1)}, nil
+}
+
+// deriveTicketKey returns the key of the given period.
+func deriveTicketKey(seed []byte, epoch int64) [32]byte {
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte("autocert session ticket key"))
+	_ = binary.Write(mac, binary.BigEndian, epoch)
+	var key [32]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// next returns when the current period ends. Periods start at multiples of
+// the period since the Unix epoch, so replicas rotate at the same time.
+func (t *TicketKeys) next(now time.Time) time.Time {
+	epoch := now.UnixNano() / int64(t.period)
+	return time.Unix(0, (epoch+1)*int64(t.period))
+}
+
+// Run rotates the keys immediately, then at the end of every period and
+// every time the certificate of r is rotated, until the context is done. r
+// can be nil. Errors are ignored and the current keys are kept until the next
+// rotation.
+func (t *TicketKeys) Run(ctx context.Context, r *Rotator) {
+	var events <-chan RotationEvent
+	if r != nil {
+		events = r.Subscribe()
+		defer r.Unsubscribe(events)
+	}
+	for {
+		_ = t.Rotate()
+		timer := time.NewTimer(t.next(t.now()).Sub(t.now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-events:
+			timer.Stop()
+		}
+	}
+}
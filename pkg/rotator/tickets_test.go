@@ -0,0 +1,91 @@
+package rotator
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTicketKeys(t *testing.T) {
+	dir := t.TempDir()
+	seedFile := filepath.Join(dir, "seed")
+	if err := os.WriteFile(seedFile, []byte("0123456789abcdef0123456789abcdef\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+	a := NewTicketKeys(&tls.Config{}, seedFile, 0)
+	b := NewTicketKeys(&tls.Config{}, seedFile, time.Hour)
+
+	// Replicas sharing the seed use the same keys.
+	ka, err := a.keys(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := b.keys(now.Add(20 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ka) != 2 || ka[0] != kb[0] || ka[1] != kb[1] {
+		t.Error("keys() should return the same keys within a period")
+	}
+	if ka[0] == ka[1] {
+		t.Error("keys() should return the current and previous keys")
+	}
+
+	// The previous key of the next period is the current one.
+	next := a.next(now)
+	if !next.Equal(time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("next() = %s", next)
+	}
+	kn, err := a.keys(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kn[1] != ka[0] || kn[0] == ka[0] {
+		t.Error("keys() should rotate at the end of the period")
+	}
+
+	// Rotating the seed rotates the keys.
+	if err := os.WriteFile(seedFile, []byte("fedcba9876543210fedcba9876543210"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := a.keys(now); k[0] == ka[0] {
+		t.Error("keys() should derive the keys from the current seed")
+	}
+
+	if err := os.WriteFile(seedFile, []byte("short"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Rotate(); err == nil {
+		t.Error("Rotate() should fail with a short seed")
+	}
+	if err := NewTicketKeys(&tls.Config{}, filepath.Join(dir, "missing"), 0).Rotate(); err == nil {
+		t.Error("Rotate() should fail with a missing seed")
+	}
+}
+
+func TestTicketKeysRandom(t *testing.T) {
+	tk := NewTicketKeys(&tls.Config{}, "", time.Hour)
+	k1, err := tk.keys(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := k1[0]
+	k2, err := tk.keys(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k2) != 2 || k2[1] != first || k2[0] == first {
+		t.Errorf("keys() should generate a new key and keep the previous one")
+	}
+	k3, _ := tk.keys(time.Now())
+	if len(k3) != 2 || k3[1] != k2[0] {
+		t.Errorf("keys() should keep only the previous key")
+	}
+	if err := tk.Rotate(); err != nil {
+		t.Errorf("Rotate() error = %v", err)
+	}
+}
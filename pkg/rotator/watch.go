@@ -0,0 +1,195 @@
+package rotator
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Watch modes.
+const (
+	modeNotify = "notify"
+	modePoll   = "poll"
+)
+
+// Reasons to fall back to polling.
+const (
+	fallbackUnsupported = "unsupported"
+	fallbackFilesystem  = "filesystem"
+	fallbackMissedEvent = "missed_event"
+	fallbackError       = "error"
+)
+
+// Watchers is the number of watchers started by Watch, by mode: notify for
+// file system notifications, or poll. Register it to expose it:
+//
+//	prometheus.MustRegister(rotator.Watchers, rotator.WatchFallbacks)
+var Watchers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "autocert_rotator_watchers",
+	Help: "Number of watchers reloading certificates, by mode.",
+}, []string{"mode"})
+
+// WatchFallbacks counts the watchers that poll instead of using file system
+// notifications, by reason: unsupported by the platform, filesystem known
+// not to deliver them, like NFS, missed_event when a change was found
+// without a notification, or error.
+var WatchFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "autocert_rotator_watch_fallbacks_total",
+	Help: "Number of watchers falling back to polling, by reason.",
+}, []string{"reason"})
+
+var (
+	// watchDelay coalesces the events of a renewal, which writes the
+	// certificate and the key separately, into a single reload.
+	watchDelay = 100 * time.Millisecond
+	// verifyInterval is how often watchers using notifications reload the
+	// files anyway. A change found this way was missed by the
+	// notifications, and the watcher falls back to polling.
+	verifyInterval = 4 * DefaultInterval
+	// minPollInterval and maxPollInterval bound the interval of polling
+	// watchers.
+	minPollInterval = time.Second
+	maxPollInterval = DefaultInterval
+)
+
+// notifier reports changes to a set of files.
+type notifier interface {
+	// Events receives a value every time one of the files may have changed.
+	// It's closed if the notifier fails.
+	Events() <-chan struct{}
+	Close() error
+}
+
+// watcher calls reload every time one of its files changes, using the file
+// system notifications of the platform, or polling if they're not available
+// or not reliable.
+type watcher struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// watch starts a watcher calling reload when any of files changes. reload
+// returns whether the files changed.
+func watch(files []string, reload func() (bool, error)) *watcher {
+	w := &watcher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	// The files are watched before returning, so changes made after Watch
+	// are never missed.
+	var n notifier
+	reason := fallbackFilesystem
+	if notifyReliable(files) {
+		var err error
+		switch n, err = newNotifier(files); {
+		case err == errNotifyUnsupported:
+			reason = fallbackUnsupported
+		case err != nil:
+			reason = fallbackError
+		}
+	}
+	go func() {
+		defer close(w.done)
+		if n != nil {
+			if reason = w.notify(n, reload); reason == "" {
+				return
+			}
+		}
+		WatchFallbacks.WithLabelValues(reason).Inc()
+		w.poll(reload)
+	}()
+	return w
+}
+
+// notify reloads on the events of n until the watcher is closed, and returns
+// an empty string. It returns the reason to fall back to polling if n fails
+// or misses a change.
+func (w *watcher) notify(n notifier, reload func() (bool, error)) string {
+	defer n.Close() //nolint:errcheck // nothing to do on error
+	Watchers.WithLabelValues(modeNotify).Inc()
+	defer Watchers.WithLabelValues(modeNotify).Dec()
+
+	timer := time.NewTimer(watchDelay)
+	timer.Stop()
+	defer timer.Stop()
+	verify := time.NewTicker(verifyInterval)
+	defer verify.Stop()
+	events := n.Events()
+	for {
+		select {
+		case <-w.stop:
+			return ""
+		case _, ok := <-events:
+			if !ok {
+				return fallbackError
+			}
+			timer.Reset(watchDelay)
+		case <-timer.C:
+			_, _ = reload()
+		case <-verify.C:
+			if changed, _ := reload(); changed {
+				return fallbackMissedEvent
+			}
+		}
+	}
+}
+
+// poll reloads until the watcher is closed, every minPollInterval after a
+// change and backing off to every maxPollInterval while nothing changes.
+func (w *watcher) poll(reload func() (bool, error)) {
+	Watchers.WithLabelValues(modePoll).Inc()
+	defer Watchers.WithLabelValues(modePoll).Dec()
+
+	interval := maxPollInterval
+	var failed bool
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-timer.C:
+			changed, err := reload()
+			interval = nextPollInterval(interval, changed, err != nil && !failed)
+			failed = err != nil
+			timer.Reset(interval)
+		}
+	}
+}
+
+// nextPollInterval returns the interval until the next poll. A change, or a
+// new error, like a key not matching a certificate being written, is
+// followed by other writes, which are polled for every minPollInterval.
+// Otherwise the interval doubles up to maxPollInterval.
+func nextPollInterval(interval time.Duration, changed, newError bool) time.Duration {
+	if changed || newError {
+		return minPollInterval
+	}
+	return min(2*interval, maxPollInterval)
+}
+
+// close stops the watcher and waits for it to return.
+func (w *watcher) close() {
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// watchedNames returns the directories of files and, for each directory, the
+// names of the files in it.
+func watchedNames(files []string) map[string]map[string]bool {
+	dirs := make(map[string]map[string]bool)
+	for _, f := range files {
+		dir, name := filepath.Split(filepath.Clean(f))
+		if dir == "" {
+			dir = "."
+		}
+		if dirs[dir] == nil {
+			dirs[dir] = make(map[string]bool)
+		}
+		dirs[dir][name] = true
+	}
+	return dirs
+}
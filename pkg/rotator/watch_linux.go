@@ -0,0 +1,144 @@
+//go:build linux
+
+package rotator
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask selects the events of the watched directories: files written
+// in place, renamed into place, created or deleted.
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE
+
+// errNotifyUnsupported is never returned on Linux.
+var errNotifyUnsupported = errors.New("file system notifications are not supported")
+
+// unreliableFilesystems are the filesystems where inotify misses changes made
+// by other clients, like a renewer on another node writing to a shared
+// volume.
+var unreliableFilesystems = map[uint32]string{
+	unix.NFS_SUPER_MAGIC:  "nfs",
+	unix.SMB_SUPER_MAGIC:  "smb",
+	unix.CIFS_SUPER_MAGIC: "cifs",
+	unix.SMB2_SUPER_MAGIC: "smb2",
+	unix.FUSE_SUPER_MAGIC: "fuse",
+	unix.V9FS_MAGIC:       "9p",
+	unix.CEPH_SUPER_MAGIC: "ceph",
+}
+
+// notifyReliable returns whether inotify reports all the changes to files.
+// Directories that can't be checked are assumed to be reliable, the
+// verification of the watcher falls back to polling if they're not.
+func notifyReliable(files []string) bool {
+	for dir := range watchedNames(files) {
+		var st unix.Statfs_t
+		if err := unix.Statfs(dir, &st); err != nil {
+			continue
+		}
+		if !reliableFilesystem(uint32(st.Type)) { //nolint:gosec // magic numbers are 32 bits
+			return false
+		}
+	}
+	return true
+}
+
+// reliableFilesystem returns whether inotify reports all the changes on a
+// filesystem with the given magic number. Overlay and tmpfs volumes are
+// written through the same kernel and are reliable.
+func reliableFilesystem(magic uint32) bool {
+	_, ok := unreliableFilesystems[magic]
+	return !ok
+}
+
+// inotify watches the directories of the files, so files replaced by a
+// rename, like the ones of Secret and ConfigMap volumes, are still watched.
+type inotify struct {
+	f      *os.File
+	dirs   map[int32]map[string]bool
+	events chan struct{}
+}
+
+func newNotifier(files []string) (notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	// The descriptor is non-blocking, so reads go through the runtime
+	// poller and are interrupted by Close.
+	n := &inotify{
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]map[string]bool),
+		events: make(chan struct{}, 1),
+	}
+	for dir, names := range watchedNames(files) {
+		wd, err := unix.InotifyAddWatch(fd, dir, inotifyMask)
+		if err != nil {
+			n.f.Close() //nolint:errcheck // already failing
+			return nil, &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+		}
+		n.dirs[int32(wd)] = names //nolint:gosec // watch descriptors are int32 in events
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotify) Events() <-chan struct{} {
+	return n.events
+}
+
+func (n *inotify) Close() error {
+	return n.f.Close()
+}
+
+// read sends an event for every change to a watched file, until the
+// descriptor is closed or a watched directory is removed.
+func (n *inotify) read() {
+	defer close(n.events)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		size, err := n.f.Read(buf)
+		if err != nil {
+			return
+		}
+		changed, lost := n.parse(buf[:size])
+		if changed {
+			select {
+			case n.events <- struct{}{}:
+			default:
+			}
+		}
+		if lost {
+			return
+		}
+	}
+}
+
+// parse returns whether the events in buf concern a watched file, and
+// whether a watch was lost.
+func (n *inotify) parse(buf []byte) (changed, lost bool) {
+	for len(buf) >= unix.SizeofInotifyEvent {
+		e := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0])) //nolint:gosec // the kernel writes aligned events
+		end := unix.SizeofInotifyEvent + int(e.Len)
+		if end > len(buf) {
+			break
+		}
+		name := strings.TrimRight(string(buf[unix.SizeofInotifyEvent:end]), "\x00")
+		buf = buf[end:]
+		switch {
+		case e.Mask&unix.IN_IGNORED != 0:
+			lost = true
+		case e.Mask&unix.IN_Q_OVERFLOW != 0, n.dirs[e.Wd][name]:
+			changed = true
+		case strings.HasPrefix(name, "..") && n.dirs[e.Wd] != nil:
+			// Kubernetes updates Secret and ConfigMap volumes by swapping
+			// the ..data symlink.
+			changed = true
+		}
+	}
+	return changed, lost
+}
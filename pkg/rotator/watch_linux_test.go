@@ -0,0 +1,32 @@
+//go:build linux
+
+package rotator
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReliableFilesystem(t *testing.T) {
+	tests := []struct {
+		name  string
+		magic uint32
+		want  bool
+	}{
+		{"ext4", unix.EXT4_SUPER_MAGIC, true},
+		{"tmpfs", unix.TMPFS_MAGIC, true},
+		{"overlay", unix.OVERLAYFS_SUPER_MAGIC, true},
+		{"nfs", unix.NFS_SUPER_MAGIC, false},
+		{"cifs", unix.CIFS_SUPER_MAGIC, false},
+		{"fuse", unix.FUSE_SUPER_MAGIC, false},
+		{"ceph", unix.CEPH_SUPER_MAGIC, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reliableFilesystem(tt.magic); got != tt.want {
+				t.Errorf("reliableFilesystem(%#x) = %v, want %v", tt.magic, got, tt.want)
+			}
+		})
+	}
+}
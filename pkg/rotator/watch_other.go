@@ -0,0 +1,19 @@
+//go:build !linux
+
+package rotator
+
+import "errors"
+
+var errNotifyUnsupported = errors.New("file system notifications are not supported on this platform")
+
+// notifyReliable returns true, newNotifier reports that notifications are
+// not supported.
+func notifyReliable([]string) bool {
+	return true
+}
+
+// newNotifier returns an error on platforms without inotify, so watchers
+// poll instead.
+func newNotifier([]string) (notifier, error) {
+	return nil, errNotifyUnsupported
+}
@@ -0,0 +1,220 @@
+package rotator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRotatorWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "site.crt"), filepath.Join(dir, "site.key")
+	writeCertificate(t, certFile, keyFile, time.Now().Add(time.Hour))
+
+	r, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := r.Subscribe()
+	r.Watch()
+	r.Watch()
+	defer r.Close()
+
+	waitRotation := func(what string) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Current != r.Certificate() {
+				t.Errorf("%s: event = %+v, want the current certificate", what, e)
+			}
+		case <-time.After(2 * DefaultInterval):
+			t.Fatalf("%s: certificate was not reloaded", what)
+		}
+	}
+
+	// Written in place.
+	writeCertificate(t, certFile, keyFile, time.Now().Add(2*time.Hour))
+	waitRotation("write")
+
+	// Renamed into place.
+	tmpCert, tmpKey := filepath.Join(dir, ".site.crt"), filepath.Join(dir, ".site.key")
+	writeCertificate(t, tmpCert, tmpKey, time.Now().Add(2*time.Hour))
+	if err := os.Rename(tmpKey, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpCert, certFile); err != nil {
+		t.Fatal(err)
+	}
+	waitRotation("rename")
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() twice error = %v", err)
+	}
+	current := r.Certificate()
+	writeCertificate(t, certFile, keyFile, time.Now().Add(2*time.Hour))
+	time.Sleep(5 * watchDelay)
+	if r.Certificate() != current {
+		t.Error("certificate reloaded after Close()")
+	}
+}
+
+func TestWatchedNames(t *testing.T) {
+	got := watchedNames([]string{"/certs/site.crt", "/certs/site.key", "/roots/root.crt", "local.crt"})
+	want := map[string][]string{
+		"/certs/": {"site.crt", "site.key"},
+		"/roots/": {"root.crt"},
+		".":       {"local.crt"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("watchedNames() = %v, want %v", got, want)
+	}
+	for dir, names := range want {
+		for _, name := range names {
+			if !got[dir][name] {
+				t.Errorf("watchedNames() = %v, missing %s in %s", got, name, dir)
+			}
+		}
+	}
+}
+
+// fakeNotifier is a notifier sending events only when told to.
+type fakeNotifier struct {
+	events chan struct{}
+}
+
+func (n *fakeNotifier) Events() <-chan struct{} {
+	return n.events
+}
+
+func (n *fakeNotifier) Close() error {
+	return nil
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestWatcherNotify(t *testing.T) {
+	defer func(d time.Duration) { verifyInterval = d }(verifyInterval)
+	verifyInterval = 10 * time.Millisecond
+
+	notify := func(n notifier, reload func() (bool, error)) (*watcher, chan string) {
+		w := &watcher{stop: make(chan struct{}), done: make(chan struct{})}
+		reason := make(chan string, 1)
+		go func() {
+			defer close(w.done)
+			reason <- w.notify(n, reload)
+		}()
+		return w, reason
+	}
+	wait := func(reason chan string, want string) {
+		t.Helper()
+		select {
+		case got := <-reason:
+			if got != want {
+				t.Errorf("notify() = %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("notify() did not return, want %q", want)
+		}
+	}
+
+	// Verifications without changes keep the notifier.
+	w, reason := notify(&fakeNotifier{events: make(chan struct{})}, func() (bool, error) { return false, nil })
+	time.Sleep(5 * verifyInterval)
+	w.close()
+	wait(reason, "")
+
+	// Changes found by the verification were missed.
+	_, reason = notify(&fakeNotifier{events: make(chan struct{})}, func() (bool, error) { return true, nil })
+	wait(reason, fallbackMissedEvent)
+
+	// Changes found after an event were not missed.
+	verifyInterval = time.Hour
+	n := &fakeNotifier{events: make(chan struct{})}
+	reloads := make(chan struct{}, 1)
+	w, reason = notify(n, func() (bool, error) {
+		reloads <- struct{}{}
+		return true, nil
+	})
+	n.events <- struct{}{}
+	select {
+	case <-reloads:
+	case <-time.After(time.Second):
+		t.Fatal("notify() did not reload after an event")
+	}
+	w.close()
+	wait(reason, "")
+
+	// Failing notifiers close their events.
+	n = &fakeNotifier{events: make(chan struct{})}
+	_, reason = notify(n, func() (bool, error) { return false, nil })
+	close(n.events)
+	wait(reason, fallbackError)
+}
+
+func TestNextPollInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		changed  bool
+		newError bool
+		want     time.Duration
+	}{
+		{"unchanged", 2 * time.Second, false, false, 4 * time.Second},
+		{"max", maxPollInterval - time.Second, false, false, maxPollInterval},
+		{"changed", maxPollInterval, true, false, minPollInterval},
+		{"new error", maxPollInterval, false, true, minPollInterval},
+		{"min", minPollInterval, false, false, 2 * minPollInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextPollInterval(tt.interval, tt.changed, tt.newError); got != tt.want {
+				t.Errorf("nextPollInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchFallback(t *testing.T) {
+	defer func(minInterval, maxInterval time.Duration) {
+		minPollInterval, maxPollInterval = minInterval, maxInterval
+	}(minPollInterval, maxPollInterval)
+	minPollInterval, maxPollInterval = 10*time.Millisecond, 20*time.Millisecond
+
+	// A directory that doesn't exist can't be watched.
+	dir := filepath.Join(t.TempDir(), "missing")
+	before := counterValue(t, WatchFallbacks.WithLabelValues(fallbackError)) +
+		counterValue(t, WatchFallbacks.WithLabelValues(fallbackUnsupported))
+	reloads := make(chan struct{}, 1)
+	w := watch([]string{filepath.Join(dir, "root.crt")}, func() (bool, error) {
+		select {
+		case reloads <- struct{}{}:
+		default:
+		}
+		return false, os.ErrNotExist
+	})
+	defer w.close()
+	select {
+	case <-reloads:
+	case <-time.After(time.Second):
+		t.Fatal("watcher is not polling")
+	}
+	after := counterValue(t, WatchFallbacks.WithLabelValues(fallbackError)) +
+		counterValue(t, WatchFallbacks.WithLabelValues(fallbackUnsupported))
+	if after != before+1 {
+		t.Errorf("fallbacks = %v, want %v", after, before+1)
+	}
+}
@@ -0,0 +1,226 @@
+// Package autocerttest runs the autocert mutator against golden
+// AdmissionReview files, so users customizing the controller configuration
+// can regression-test their settings.
+//
+// A golden case is a set of files sharing a name in a directory:
+//
+//	<name>.config.yaml    the autocert-config settings, optional
+//	<name>.review.json    the AdmissionReview sent by the API server
+//	<name>.response.json  the expected AdmissionResponse
+//
+// The package is imported as:
+//
+//	import autocerttest "github.com/smallstep/autocert/pkg/testing"
+package autocerttest
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// UpdateEnvVar is the environment variable that, when set to "true", makes
+// RunDir rewrite the expected responses with the actual ones.
+const UpdateEnvVar = "AUTOCERT_UPDATE_GOLDEN"
+
+const (
+	configSuffix   = ".config.yaml"
+	reviewSuffix   = ".review.json"
+	responseSuffix = ".response.json"
+)
+
+//go:embed golden
+var golden embed.FS
+
+// Golden returns the golden cases published with autocert. They cover the
+// admission decisions of the controller: skipped pods, denials and shadow
+// mode.
+func Golden() fs.FS {
+	sub, err := fs.Sub(golden, "golden")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// Case is a golden case.
+type Case struct {
+	// Name is the name shared by the files of the case.
+	Name string
+	// Config is the content of the config file, empty if there is none.
+	Config []byte
+	// Review is the AdmissionReview sent to the mutator.
+	Review *v1beta1.AdmissionReview
+	// Response is the expected response.
+	Response *v1beta1.AdmissionResponse
+}
+
+// Mutator runs the mutator for a case and returns its response.
+type Mutator func(t testing.TB, c Case) *v1beta1.AdmissionResponse
+
+// LoadCases reads the golden cases in the root of fsys, sorted by name.
+func LoadCases(fsys fs.FS) ([]Case, error) {
+	entries, err := fs.Glob(fsys, "*"+reviewSuffix)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(entries)
+
+	cases := make([]Case, 0, len(entries))
+	for _, entry := range entries {
+		name := strings.TrimSuffix(path.Base(entry), reviewSuffix)
+		c := Case{Name: name}
+
+		if c.Config, err = fs.ReadFile(fsys, name+configSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err := readJSON(fsys, name+reviewSuffix, &c.Review); err != nil {
+			return nil, err
+		}
+		if err := readJSON(fsys, name+responseSuffix, &c.Response); err != nil {
+			return nil, err
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+func readJSON(fsys fs.FS, name string, v any) error {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", name, err)
+	}
+	return nil
+}
+
+// Run runs m against every golden case in fsys, as subtests.
+func Run(t *testing.T, fsys fs.FS, m Mutator) {
+	t.Helper()
+	run(t, fsys, "", m)
+}
+
+// RunDir runs m against every golden case in dir, as subtests. If the
+// AUTOCERT_UPDATE_GOLDEN environment variable is "true", the expected
+// responses are replaced with the actual ones instead.
+func RunDir(t *testing.T, dir string, m Mutator) {
+	t.Helper()
+	run(t, os.DirFS(dir), dir, m)
+}
+
+func run(t *testing.T, fsys fs.FS, dir string, m Mutator) {
+	t.Helper()
+
+	cases, err := LoadCases(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("no golden cases found")
+	}
+
+	update := dir != "" && os.Getenv(UpdateEnvVar) == "true"
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			got := m(t, c)
+			if update {
+				if err := writeResponse(filepath.Join(dir, c.Name+responseSuffix), got); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err := Compare(got, c.Response); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func writeResponse(filename string, resp *v1beta1.AdmissionResponse) error {
+	b, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(b, '\n'), 0o600)
+}
+
+// Compare returns an error describing the differences between two
+// responses. Patches are compared as JSON documents, so formatting
+// differences are ignored.
+func Compare(got, want *v1beta1.AdmissionResponse) error {
+	if got == nil || want == nil {
+		if got != want {
+			return fmt.Errorf("response = %v, want %v", got, want)
+		}
+		return nil
+	}
+
+	var diffs []string
+	if got.UID != want.UID {
+		diffs = append(diffs, fmt.Sprintf("uid = %q, want %q", got.UID, want.UID))
+	}
+	if got.Allowed != want.Allowed {
+		diffs = append(diffs, fmt.Sprintf("allowed = %v, want %v", got.Allowed, want.Allowed))
+	}
+	if gotMsg, wantMsg := message(got), message(want); gotMsg != wantMsg {
+		diffs = append(diffs, fmt.Sprintf("status message = %q, want %q", gotMsg, wantMsg))
+	}
+	if !slices.Equal(got.Warnings, want.Warnings) {
+		diffs = append(diffs, fmt.Sprintf("warnings = %q, want %q", got.Warnings, want.Warnings))
+	}
+	if !reflect.DeepEqual(got.PatchType, want.PatchType) {
+		diffs = append(diffs, fmt.Sprintf("patchType = %v, want %v", deref(got.PatchType), deref(want.PatchType)))
+	}
+	if ok, err := jsonEqual(got.Patch, want.Patch); err != nil {
+		diffs = append(diffs, err.Error())
+	} else if !ok {
+		diffs = append(diffs, fmt.Sprintf("patch = %s, want %s", got.Patch, want.Patch))
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("unexpected response:\n  %s", strings.Join(diffs, "\n  "))
+	}
+	return nil
+}
+
+func message(resp *v1beta1.AdmissionResponse) string {
+	if resp.Result == nil {
+		return ""
+	}
+	return resp.Result.Message
+}
+
+func deref(pt *v1beta1.PatchType) string {
+	if pt == nil {
+		return "<nil>"
+	}
+	return string(*pt)
+}
+
+func jsonEqual(a, b []byte) (bool, error) {
+	if len(a) == 0 || len(b) == 0 {
+		return bytes.Equal(a, b), nil
+	}
+	var va, vb any
+	if err := json.Unmarshal(a, &va); err != nil {
+		return false, fmt.Errorf("invalid patch: %w", err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		return false, fmt.Errorf("invalid expected patch: %w", err)
+	}
+	return reflect.DeepEqual(va, vb), nil
+}
@@ -0,0 +1,54 @@
+package autocerttest
+
+import (
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLoadCases(t *testing.T) {
+	cases, err := LoadCases(Golden())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("LoadCases() returned no cases")
+	}
+	for _, c := range cases {
+		if c.Review == nil || c.Review.Request == nil || c.Response == nil {
+			t.Errorf("case %s is incomplete", c.Name)
+			continue
+		}
+		if c.Review.Request.UID != c.Response.UID {
+			t.Errorf("case %s: response uid %q does not match request uid %q", c.Name, c.Response.UID, c.Review.Request.UID)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	jsonPatch := v1beta1.PatchTypeJSONPatch
+	want := &v1beta1.AdmissionResponse{
+		UID:       "uid",
+		Allowed:   true,
+		Patch:     []byte(`[{"op":"add","path":"/a","value":1}]`),
+		PatchType: &jsonPatch,
+	}
+
+	same := want.DeepCopy()
+	same.Patch = []byte(`[ {"value": 1, "path": "/a", "op": "add"} ]`)
+	if err := Compare(same, want); err != nil {
+		t.Errorf("Compare() with a reformatted patch = %v", err)
+	}
+
+	denied := &v1beta1.AdmissionResponse{UID: "uid", Result: &metav1.Status{Message: "denied"}}
+	if err := Compare(denied, want); err == nil {
+		t.Error("Compare() should fail on different responses")
+	}
+
+	other := want.DeepCopy()
+	other.Patch = []byte(`[{"op":"add","path":"/b","value":1}]`)
+	if err := Compare(other, want); err == nil {
+		t.Error("Compare() should fail on different patches")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.step.sm/crypto/pemutil"
+)
+
+// debugFileName is the name of the debug file written next to the
+// certificate when DEBUG_FILE is not set.
+const debugFileName = "cert-debug.txt"
+
+// writeDebugFile replaces the debug file with the fingerprints of the
+// certificate on disk, and the commands to compare them with the certificate
+// an application actually serves. It answers "is my certificate the one I
+// think it is" without decoding PEM files by hand.
+func writeDebugFile(config *Config) error {
+	chain, err := pemutil.ReadCertificateBundle(config.CertFile)
+	if err != nil {
+		return err
+	}
+	roots, err := pemutil.ReadCertificateBundle(config.RootFile)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(config.DebugFile, renderDebugFile(config, chain, roots, time.Now()))
+}
+
+// updateDebugFile writes the debug file, if any, only logging errors: the
+// file is a troubleshooting aid and never fails a renewal.
+func updateDebugFile(config *Config) {
+	if config.DebugFile == "" {
+		return
+	}
+	if err := writeDebugFile(config); err != nil {
+		log.WithFields(log.Fields{"file": config.DebugFile, "error": err}).Warn("Error writing the debug file")
+	}
+}
+
+func renderDebugFile(config *Config, chain, roots []*x509.Certificate, now time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Written by the autocert renewer at %s, and after every renewal.\n\n", now.UTC().Format(time.RFC3339))
+
+	crt := chain[0]
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Certificate:\t%s\n", config.CertFile)
+	fmt.Fprintf(w, "Subject:\t%s\n", crt.Subject)
+	fmt.Fprintf(w, "SANs:\t%s\n", strings.Join(sans(crt), ", "))
+	fmt.Fprintf(w, "Serial:\t%s\n", crt.SerialNumber)
+	fmt.Fprintf(w, "Issuer:\t%s\n", crt.Issuer)
+	fmt.Fprintf(w, "Not before:\t%s\n", crt.NotBefore.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "Not after:\t%s\n", crt.NotAfter.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "SHA-256 fingerprint:\t%s\n", opensslFingerprint(crt))
+	fmt.Fprintf(w, "SHA-256 fingerprint (step):\t%s\n", stepFingerprint(crt))
+	fmt.Fprintf(w, "Public key pin:\tsha256//%s\n", publicKeyPin(crt))
+	for _, root := range roots {
+		fmt.Fprintf(w, "Root:\t%s, SHA-256 fingerprint %s\n", root.Subject, opensslFingerprint(root))
+	}
+	w.Flush()
+
+	host := debugHost(crt)
+	fmt.Fprintf(&buf, `
+# Inspect the certificate on disk:
+step certificate inspect %[1]s
+
+# Print the fingerprint of the certificate served on port 443, to compare
+# with the one above. Change the port to the one of the application; the
+# client certificate is only used by servers requiring mTLS:
+openssl s_client -connect %[2]s -servername %[3]s -CAfile %[4]s -cert %[1]s -key %[5]s </dev/null 2>/dev/null | openssl x509 -noout -fingerprint -sha256
+step certificate fingerprint https://%[2]s --roots %[4]s
+
+# Check that the certificate chains to the root:
+step certificate verify %[1]s --roots %[4]s
+`, config.CertFile, net.JoinHostPort(host, "443"), host, config.RootFile, config.KeyFile)
+	return buf.Bytes()
+}
+
+// debugHost returns the name to connect to in the commands of the debug
+// file: the first DNS or IP SAN, or the common name.
+func debugHost(crt *x509.Certificate) string {
+	switch {
+	case len(crt.DNSNames) > 0:
+		return crt.DNSNames[0]
+	case len(crt.IPAddresses) > 0:
+		return crt.IPAddresses[0].String()
+	case crt.Subject.CommonName != "":
+		return crt.Subject.CommonName
+	default:
+		return "localhost"
+	}
+}
+
+// opensslFingerprint returns the SHA-256 fingerprint of a certificate as
+// printed by `openssl x509 -fingerprint -sha256`.
+func opensslFingerprint(crt *x509.Certificate) string {
+	sum := sha256.Sum256(crt.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// stepFingerprint returns the SHA-256 fingerprint of a certificate as
+// printed by `step certificate fingerprint`.
+func stepFingerprint(crt *x509.Certificate) string {
+	sum := sha256.Sum256(crt.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// publicKeyPin returns the base64 SHA-256 digest of the public key of a
+// certificate, the pin of `curl --pinnedpubkey`. Unlike the fingerprints,
+// it only changes when the key does.
+func publicKeyPin(crt *x509.Certificate) string {
+	sum := sha256.Sum256(crt.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_writeDebugFile(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		CertFile:  filepath.Join(dir, "site.crt"),
+		KeyFile:   filepath.Join(dir, "site.key"),
+		RootFile:  filepath.Join(dir, "root.crt"),
+		DebugFile: filepath.Join(dir, debugFileName),
+	}
+	rootKey, key := mustKey(t), mustKey(t)
+	root := mustCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Root CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, rootKey.Public(), rootKey)
+	crt := mustCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "hello-mtls.default.svc.cluster.local"},
+		DNSNames:    []string{"hello-mtls.default.svc.cluster.local", "hello-mtls"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.7")},
+	}, root, key.Public(), rootKey)
+	for file, c := range map[string]*x509.Certificate{config.CertFile: crt, config.RootFile: root} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writeDebugFile(config); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(config.DebugFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(crt.Raw)
+	want := []string{
+		"SANs:", "10.0.0.7, hello-mtls, hello-mtls.default.svc.cluster.local",
+		"Serial:", crt.SerialNumber.String(),
+		fmt.Sprintf("%02X:%02X:%02X", sum[0], sum[1], sum[2]),
+		hex.EncodeToString(sum[:]),
+		"sha256//" + publicKeyPin(crt),
+		"step certificate inspect " + config.CertFile,
+		"openssl s_client -connect hello-mtls.default.svc.cluster.local:443 -servername hello-mtls.default.svc.cluster.local -CAfile " + config.RootFile,
+		"step certificate fingerprint https://hello-mtls.default.svc.cluster.local:443",
+	}
+	for _, s := range want {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("debug file does not contain %q:\n%s", s, b)
+		}
+	}
+
+	// Errors are only logged.
+	config.DebugFile = filepath.Join(dir, "missing", debugFileName)
+	updateDebugFile(config)
+	if _, err := os.Stat(config.DebugFile); !os.IsNotExist(err) {
+		t.Errorf("Stat() error = %v, want not exist", err)
+	}
+}
+
+func Test_debugHost(t *testing.T) {
+	tests := []struct {
+		name string
+		crt  *x509.Certificate
+		want string
+	}{
+		{"dns", &x509.Certificate{DNSNames: []string{"a.svc", "b.svc"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, "a.svc"},
+		{"ip", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, "10.0.0.1"},
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "legacy"}}, "legacy"},
+		{"none", &x509.Certificate{}, "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := debugHost(tt.crt); got != tt.want {
+				t.Errorf("debugHost() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
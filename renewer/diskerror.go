@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// isDiskError returns whether err is caused by a full or read-only volume,
+// which can clear up on its own, for instance after the kubelet evicts pods
+// under disk pressure.
+func isDiskError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) || errors.Is(err, syscall.EROFS)
+}
+
+// diskError is returned when a renewed certificate can't be written because
+// the volume is full or read-only. It holds the renewed certificate, so the
+// write can be retried without renewing again. The previous certificate is
+// left in place and keeps being used until the write succeeds.
+type diskError struct {
+	config *Config
+	crt    *x509.Certificate
+	chain  []byte
+	err    error
+}
+
+func (e *diskError) Error() string {
+	return e.err.Error()
+}
+
+func (e *diskError) Unwrap() error {
+	return e.err
+}
+
+// retry writes the renewed certificate again.
+func (e *diskError) retry() (*x509.Certificate, error) {
+	return writeCertificate(e.config, e.crt, e.chain)
+}
+
+// writeCertificate replaces the certificate file with a renewed chain, holding
+// the lock of the certificates directory, and bumps its version. Disk errors
+// are returned as a *diskError.
+func writeCertificate(config *Config, crt *x509.Certificate, chain []byte) (*x509.Certificate, error) {
+	dir := filepath.Dir(config.CertFile)
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "lock certificates directory")
+	}
+	defer unlock()
+
+	if err := writeFileAtomic(config.CertFile, chain); err != nil {
+		return nil, wrapDiskError(config, crt, chain, errors.Wrap(err, "write certificate"))
+	}
+	if err := writeKeystores(config); err != nil {
+		return nil, wrapDiskError(config, crt, chain, err)
+	}
+	if _, err := bumpVersion(dir); err != nil {
+		return nil, wrapDiskError(config, crt, chain, errors.Wrap(err, "write version"))
+	}
+	updateDebugFile(config)
+	return crt, nil
+}
+
+// wrapDiskError returns a *diskError holding the renewed certificate if err
+// is a disk error, and err otherwise.
+func wrapDiskError(config *Config, crt *x509.Certificate, chain []byte, err error) error {
+	if !isDiskError(err) {
+		return err
+	}
+	return &diskError{config: config, crt: crt, chain: chain, err: err}
+}
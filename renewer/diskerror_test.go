@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/autocert/pkg/clock/clocktest"
+)
+
+func TestIsDiskError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&fs.PathError{Op: "write", Path: "site.crt", Err: syscall.ENOSPC}, true},
+		{errors.Wrap(&fs.PathError{Op: "open", Path: "site.crt", Err: syscall.EROFS}, "write certificate"), true},
+		{fmt.Errorf("write: %w", syscall.EDQUOT), true},
+		{&fs.PathError{Op: "open", Path: "site.crt", Err: syscall.EACCES}, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := isDiskError(tt.err); got != tt.want {
+			t.Errorf("isDiskError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStageFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "site.key")
+
+	if _, err := stageFile(filename, nil); err == nil {
+		t.Error("stageFile() with empty data succeeded")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("stageFile() left %d files behind", len(entries))
+	}
+
+	tmp, err := stageFile(filename, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(tmp); err != nil || string(b) != "key" {
+		t.Errorf("stageFile() wrote %q, %v", b, err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("stageFile() replaced %s", filename)
+	}
+}
+
+func TestSchedulerDiskError(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	fake := clocktest.NewFake(start)
+	dir := t.TempDir()
+	config := &Config{
+		CertFile:   filepath.Join(dir, "site.crt"),
+		StatusFile: filepath.Join(dir, statusFileName),
+	}
+	crt := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    start,
+		NotAfter:     start.Add(24 * time.Hour),
+	}
+	renewAtTime := start.Add(16 * time.Hour)
+	renewed := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    renewAtTime,
+		NotAfter:     renewAtTime.Add(24 * time.Hour),
+	}
+
+	// The renewal succeeds but the volume is full, the write is retried
+	// without renewing again.
+	var renewals int
+	var reports []string
+	s := &scheduler{
+		config: config,
+		clock:  fake,
+		renew: func(context.Context) (*x509.Certificate, error) {
+			renewals++
+			return nil, &diskError{
+				config: config,
+				crt:    renewed,
+				chain:  []byte("chain\n"),
+				err:    errors.Wrap(&fs.PathError{Op: "write", Path: config.CertFile, Err: syscall.ENOSPC}, "write certificate"),
+			}
+		},
+		checkFreeze: func(context.Context) (freeze, error) {
+			return freeze{}, nil
+		},
+		report: func(_ context.Context, status Status) {
+			reports = append(reports, status.State)
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.run(ctx, crt) }()
+
+	fake.BlockUntil(1)
+	fake.AdvanceTo(renewAtTime)
+	fake.BlockUntil(1)
+	status := readStatus(t, config.StatusFile)
+	if status.State != StateUnwritable || status.Serial != "1" || status.ConsecutiveFailures != 1 {
+		t.Fatalf("status = %+v, want unwritable serial 1 with 1 failure", status)
+	}
+
+	fake.Advance(minBackoff)
+	fake.BlockUntil(1)
+	status = readStatus(t, config.StatusFile)
+	if status.State != StateWaiting || status.Serial != "2" || status.ConsecutiveFailures != 0 || status.Version != 1 {
+		t.Errorf("status = %+v, want waiting serial 2 version 1", status)
+	}
+	if b, err := os.ReadFile(config.CertFile); err != nil || string(b) != "chain\n" {
+		t.Errorf("certificate file = %q, %v", b, err)
+	}
+	if renewals != 1 {
+		t.Errorf("renewals = %d, want 1", renewals)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("run() error = %v", err)
+	}
+
+	want := []string{StateWaiting, StateUnwritable, StateWaiting, StateStopped}
+	if !slices.Equal(reports, want) {
+		t.Errorf("reports = %v, want %v", reports, want)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/clock"
+)
+
+const (
+	// drainPollInterval is how often the renewer checks for the drain file
+	// after SIGTERM.
+	drainPollInterval = time.Second
+	// defaultDrainTimeout is the drain timeout when DRAIN_TIMEOUT is not
+	// set, leaving the renewer time to stop within the default grace period
+	// of 30s.
+	defaultDrainTimeout = 20 * time.Second
+)
+
+// drainContext returns a context cancelled once the application has drained
+// after ctx is cancelled on SIGTERM: once the application writes DrainFile,
+// or after DrainTimeout. Until then the renewer keeps renewing, so the
+// requests the application finishes while draining still use a valid
+// certificate. It returns ctx if DrainFile is not set.
+func drainContext(ctx context.Context, config *Config, clk clock.Clock) context.Context {
+	if config.DrainFile == "" {
+		return ctx
+	}
+	drained, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		defer cancel()
+		<-ctx.Done()
+		waitForDrain(config, clk)
+	}()
+	return drained
+}
+
+// waitForDrain waits until the drain file exists or the drain timeout
+// elapses.
+func waitForDrain(config *Config, clk clock.Clock) {
+	ctxLog := log.WithFields(log.Fields{
+		"file":    config.DrainFile,
+		"timeout": config.DrainTimeout,
+	})
+	ctxLog.Info("Waiting for the application to drain")
+	deadline := clk.Now().Add(config.DrainTimeout)
+	for {
+		if _, err := os.Stat(config.DrainFile); err == nil {
+			ctxLog.Info("Application drained")
+			return
+		}
+		if !clk.Now().Before(deadline) {
+			ctxLog.Warn("Timed out waiting for the application to drain")
+			return
+		}
+		<-clk.NewTimer(drainPollInterval).C()
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/autocert/pkg/clock/clocktest"
+)
+
+func TestDrainContext(t *testing.T) {
+	drainFile := filepath.Join(t.TempDir(), "drained")
+	config := &Config{DrainFile: drainFile, DrainTimeout: 20 * time.Second}
+	clk := clocktest.NewFake(time.Now())
+
+	signalCtx, stop := context.WithCancel(context.Background())
+	ctx := drainContext(signalCtx, config, clk)
+	stop()
+
+	// The renewer keeps running until the application has drained.
+	clk.BlockUntil(1)
+	clk.Advance(drainPollInterval)
+	clk.BlockUntil(1)
+	if ctx.Err() != nil {
+		t.Fatal("drainContext() cancelled before the application drained")
+	}
+	if err := os.WriteFile(drainFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(drainPollInterval)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("drainContext() not cancelled after the application drained")
+	}
+}
+
+func TestDrainContextTimeout(t *testing.T) {
+	config := &Config{DrainFile: filepath.Join(t.TempDir(), "drained"), DrainTimeout: 3 * time.Second}
+	clk := clocktest.NewFake(time.Now())
+
+	signalCtx, stop := context.WithCancel(context.Background())
+	ctx := drainContext(signalCtx, config, clk)
+	stop()
+	for range 3 {
+		clk.BlockUntil(1)
+		clk.Advance(drainPollInterval)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("drainContext() not cancelled after the drain timeout")
+	}
+}
+
+func TestDrainContextDisabled(t *testing.T) {
+	signalCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	if ctx := drainContext(signalCtx, &Config{}, clocktest.NewFake(time.Now())); ctx != signalCtx {
+		t.Error("drainContext() without drain file should return the signal context")
+	}
+}
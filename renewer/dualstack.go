@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+	"go.step.sm/crypto/pemutil"
+)
+
+// rsaKeySize is the size of the key of the RSA certificate of dual-stack
+// pods.
+const rsaKeySize = 2048
+
+// rsaFile returns the default name of the RSA counterpart of a file of a
+// dual-stack pod, "site-rsa.crt" for "site.crt". The bootstrapper uses the
+// same names.
+func rsaFile(filename string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-rsa" + ext
+}
+
+// rsaConfig returns the configuration used to renew and watch the RSA
+// certificate of a dual-stack pod.
+func (c *Config) rsaConfig() *Config {
+	rc := *c
+	rc.CertFile = c.RSACertFile
+	rc.KeyFile = c.RSAKeyFile
+	rc.StatusFile = rsaFile(c.StatusFile)
+	rc.DebugFile = rsaFile(c.DebugFile)
+	// Readiness and keystores only track the ECDSA certificate.
+	rc.ReadyFile = ""
+	rc.KeystoreFormat = ""
+	return &rc
+}
+
+// syncRSA re-keys the RSA certificate of a dual-stack pod when its SANs no
+// longer match the ones of the ECDSA certificate, after the latter was
+// re-issued, or when it's missing. It returns nil if the RSA certificate is up
+// to date.
+func syncRSA(ctx context.Context, client *ca.Client, config *Config) (*x509.Certificate, error) {
+	primary, err := readCertificate(config.CertFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read certificate")
+	}
+	if crt, err := readCertificate(config.RSACertFile); err == nil && sameSANs(primary, crt) {
+		return nil, nil
+	}
+	return rekeyRSA(ctx, client, config)
+}
+
+// rekeyRSA gets an RSA certificate for the identity of the ECDSA certificate
+// on disk, authenticating with it, and writes it with its key next to the
+// ECDSA ones. The CA copies the subject, SANs and lifetime of the ECDSA
+// certificate.
+func rekeyRSA(ctx context.Context, client *ca.Client, config *Config) (*x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load certificate")
+	}
+	primary, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "parse certificate")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate RSA key")
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: primary.Subject.CommonName},
+	}, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "create certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse certificate request")
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      client.GetRootCAs(),
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	sign, err := client.RekeyWithContext(ctx, &api.RekeyRequest{CsrPEM: api.NewCertificateRequest(csr)}, tr)
+	if err != nil {
+		return nil, errors.Wrap(err, "rekey certificate")
+	}
+
+	chain := sign.CertChainPEM
+	if len(chain) == 0 {
+		chain = []api.Certificate{sign.ServerPEM, sign.CaPEM}
+	}
+	var intermediates []*x509.Certificate
+	for _, c := range chain[1:] {
+		intermediates = append(intermediates, c.Certificate)
+	}
+	crt := sign.ServerPEM.Certificate
+	if err := verifyIssued(crt, intermediates, key.Public(), client.GetRootCAs()); err != nil {
+		return nil, errors.Wrap(err, "verify RSA certificate")
+	}
+	if crt.Subject.CommonName != primary.Subject.CommonName || !sameSANs(crt, primary) {
+		return nil, errors.Errorf("RSA certificate subject %q and SANs %v do not match %q and %v", crt.Subject.CommonName, sans(crt), primary.Subject.CommonName, sans(primary))
+	}
+
+	if err := writeKeyPair(config.rsaConfig(), chain, key); err != nil {
+		return nil, err
+	}
+	return crt, nil
+}
+
+// writeKeyPair replaces a certificate and its key with a new chain and key,
+// and the keystores, holding the lock of the certificates directory, and
+// bumps its version.
+func writeKeyPair(config *Config, chain []api.Certificate, key crypto.PrivateKey) error {
+	certFile, keyFile := config.CertFile, config.KeyFile
+	var buf bytes.Buffer
+	for _, c := range chain {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}); err != nil {
+			return errors.Wrap(err, "encode certificate")
+		}
+	}
+	block, err := pemutil.Serialize(key)
+	if err != nil {
+		return errors.Wrap(err, "encode private key")
+	}
+
+	dir := filepath.Dir(certFile)
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "lock certificates directory")
+	}
+	defer unlock()
+
+	// Stage both files before renaming them, so a full volume can't leave a
+	// new key next to the previous certificate.
+	keyTmp, err := stageFile(keyFile, pem.EncodeToMemory(block))
+	if err != nil {
+		return errors.Wrap(err, "write private key")
+	}
+	defer os.Remove(keyTmp) //nolint:errcheck // the file is gone after a successful rename
+	certTmp, err := stageFile(certFile, buf.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "write certificate")
+	}
+	defer os.Remove(certTmp) //nolint:errcheck // the file is gone after a successful rename
+	if err := os.Rename(keyTmp, keyFile); err != nil {
+		return errors.Wrap(err, "write private key")
+	}
+	if err := os.Rename(certTmp, certFile); err != nil {
+		return errors.Wrap(err, "write certificate")
+	}
+	if err := writeKeystores(config); err != nil {
+		return err
+	}
+	if _, err := bumpVersion(dir); err != nil {
+		return errors.Wrap(err, "write version")
+	}
+	updateDebugFile(config)
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestConfig_rsaConfig(t *testing.T) {
+	c := &Config{
+		CertFile:    "/var/run/autocert.step.sm/site.crt",
+		KeyFile:     "/var/run/autocert.step.sm/site.key",
+		StatusFile:  "/var/run/autocert.step.sm/renewal-status.json",
+		DualStack:   true,
+		RSACertFile: rsaFile("/var/run/autocert.step.sm/site.crt"),
+		RSAKeyFile:  "/custom/rsa.key",
+	}
+	rc := c.rsaConfig()
+	if rc.CertFile != "/var/run/autocert.step.sm/site-rsa.crt" {
+		t.Errorf("CertFile = %q", rc.CertFile)
+	}
+	if rc.KeyFile != "/custom/rsa.key" {
+		t.Errorf("KeyFile = %q", rc.KeyFile)
+	}
+	if rc.StatusFile != "/var/run/autocert.step.sm/renewal-status-rsa.json" {
+		t.Errorf("StatusFile = %q", rc.StatusFile)
+	}
+	if c.CertFile != "/var/run/autocert.step.sm/site.crt" {
+		t.Error("rsaConfig() modified the configuration")
+	}
+}
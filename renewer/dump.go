@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stateDump is the state of the renewer written to stdout on SIGUSR1, to
+// debug a renewer without metrics or access to its volume.
+type stateDump struct {
+	Time     time.Time  `json:"time"`
+	Protocol int        `json:"protocol"`
+	Config   dumpConfig `json:"config"`
+	// Certificates holds the scheduling state of each certificate, by
+	// certificate file.
+	Certificates map[string]Status `json:"certificates"`
+}
+
+// dumpConfig is the configuration of the renewer in a state dump. It only
+// holds paths and URLs, never the contents of the token or the key.
+type dumpConfig struct {
+	CaURL               string   `json:"caURL"`
+	FailoverURLs        []string `json:"failoverURLs,omitempty"`
+	CertFile            string   `json:"certFile"`
+	KeyFile             string   `json:"keyFile"`
+	RootFile            string   `json:"rootFile"`
+	StatusFile          string   `json:"statusFile"`
+	DebugFile           string   `json:"debugFile"`
+	ReadyFile           string   `json:"readyFile,omitempty"`
+	FreezeURL           string   `json:"freezeURL,omitempty"`
+	StatusURL           string   `json:"statusURL,omitempty"`
+	ReissueURL          string   `json:"reissueURL,omitempty"`
+	TrustBundleURL      string   `json:"trustBundleURL,omitempty"`
+	Pod                 string   `json:"pod,omitempty"`
+	Namespace           string   `json:"namespace,omitempty"`
+	CriticalWindow      string   `json:"criticalWindow,omitempty"`
+	DualStack           bool     `json:"dualStack,omitempty"`
+	ServiceAccountToken string   `json:"serviceAccountToken,omitempty"`
+	DrainFile           string   `json:"drainFile,omitempty"`
+	KeystoreFormat      string   `json:"keystoreFormat,omitempty"`
+	RenewalHook         string   `json:"renewalHook,omitempty"`
+}
+
+// statusSnapshot holds the last status of a scheduler, read by state dumps
+// while the scheduler runs.
+type statusSnapshot struct {
+	mu     sync.Mutex
+	status Status
+	set    bool
+}
+
+func (s *statusSnapshot) store(status Status) {
+	s.mu.Lock()
+	s.status, s.set = status, true
+	s.mu.Unlock()
+}
+
+func (s *statusSnapshot) load() (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status, s.set
+}
+
+// dumpOnSignal writes the state of the renewer to stdout on SIGUSR1 until the
+// context is cancelled. snapshots holds the status of each certificate, by
+// certificate file.
+func dumpOnSignal(ctx context.Context, config *Config, snapshots map[string]*statusSnapshot) {
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(dump)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-dump:
+				if err := writeDump(os.Stdout, config, snapshots, time.Now()); err != nil {
+					log.WithField("error", err).Warn("Error dumping renewer state")
+				}
+			}
+		}
+	}()
+}
+
+// writeDump writes the state of the renewer and of each certificate to w, as
+// a single JSON line.
+func writeDump(w io.Writer, config *Config, snapshots map[string]*statusSnapshot, now time.Time) error {
+	d := stateDump{
+		Time:     now.UTC(),
+		Protocol: config.Protocol,
+		Config: dumpConfig{
+			CaURL:               config.CaURL,
+			FailoverURLs:        config.FailoverURLs,
+			CertFile:            config.CertFile,
+			KeyFile:             config.KeyFile,
+			RootFile:            config.RootFile,
+			StatusFile:          config.StatusFile,
+			DebugFile:           config.DebugFile,
+			ReadyFile:           config.ReadyFile,
+			FreezeURL:           config.FreezeURL,
+			StatusURL:           config.StatusURL,
+			ReissueURL:          config.ReissueURL,
+			TrustBundleURL:      config.TrustBundleURL,
+			Pod:                 config.PodName,
+			Namespace:           config.Namespace,
+			DualStack:           config.DualStack,
+			ServiceAccountToken: config.ServiceAccountToken,
+			DrainFile:           config.DrainFile,
+			KeystoreFormat:      config.KeystoreFormat,
+		},
+		Certificates: make(map[string]Status, len(snapshots)),
+	}
+	if config.CriticalWindow > 0 {
+		d.Config.CriticalWindow = config.CriticalWindow.String()
+	}
+	if h := newRenewalHook(config); h != nil {
+		d.Config.RenewalHook = h.String()
+	}
+	for certFile, snapshot := range snapshots {
+		if status, ok := snapshot.load(); ok {
+			d.Certificates[certFile] = status
+		}
+	}
+	return json.NewEncoder(w).Encode(d)
+}
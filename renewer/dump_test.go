@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_writeDump(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	config := &Config{
+		CaURL:          "https://ca.step.svc:4443",
+		CertFile:       "/var/run/autocert.step.sm/site.crt",
+		KeyFile:        "/var/run/autocert.step.sm/site.key",
+		CriticalWindow: time.Hour,
+		Protocol:       protocolVersion,
+	}
+	snapshots := map[string]*statusSnapshot{
+		config.CertFile:             {},
+		config.rsaConfig().CertFile: {},
+	}
+	snapshots[config.CertFile].store(Status{State: StateBackoff, Serial: "42", ConsecutiveFailures: 2, LastError: "connection refused"})
+
+	var buf bytes.Buffer
+	if err := writeDump(&buf, config, snapshots, now); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Errorf("writeDump() wrote %d lines, want 1", n)
+	}
+	var d stateDump
+	if err := json.Unmarshal(buf.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Protocol != protocolVersion || d.Config.CaURL != config.CaURL || d.Config.CriticalWindow != "1h0m0s" {
+		t.Errorf("writeDump() = %+v", d)
+	}
+	// Certificates without a status yet are left out.
+	if len(d.Certificates) != 1 {
+		t.Fatalf("writeDump() certificates = %v, want 1", d.Certificates)
+	}
+	if got := d.Certificates[config.CertFile]; got.Serial != "42" || got.ConsecutiveFailures != 2 || got.LastError != "connection refused" {
+		t.Errorf("writeDump() status = %+v", got)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes, shared with the bootstrapper, so kubectl describe tells why the
+// renewer stopped.
+const (
+	exitError  = 1
+	exitConfig = 2
+	// exitStale is only used by the renewer, when its certificate is about
+	// to expire and renewals keep failing.
+	exitStale = 6
+)
+
+// defaultTerminationLog is the default termination message path of
+// containers.
+const defaultTerminationLog = "/dev/termination-log"
+
+// fail logs the reason of a failure, writes it to the termination log, shown
+// by kubectl describe, and exits with the given code.
+func fail(code int, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Error(msg)
+
+	filename := os.Getenv("TERMINATION_LOG")
+	if filename == "" {
+		filename = defaultTerminationLog
+	}
+	if err := os.WriteFile(filename, []byte(msg), 0o644); err != nil { //nolint:gosec // the termination log is not secret
+		log.WithField("error", err).Warn("Error writing termination message")
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/ca"
+)
+
+// freezeRetry is how often a frozen renewer checks whether the freeze has
+// been lifted.
+const freezeRetry = time.Minute
+
+// freeze is the response of the controller /freeze endpoint.
+type freeze struct {
+	Renewal bool      `json:"renewal"`
+	Expires time.Time `json:"expires"`
+	Reason  string    `json:"reason"`
+}
+
+// frozen returns whether renewals are frozen at the given time.
+func (f freeze) frozen(now time.Time) bool {
+	return f.Renewal && now.Before(f.Expires)
+}
+
+// checkFreeze asks the controller whether renewals are currently frozen. An
+// empty url, used by controllers that don't support freezes, means no freeze.
+func checkFreeze(ctx context.Context, client *ca.Client, url string) (freeze, error) {
+	if url == "" {
+		return freeze{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return freeze{}, errors.Wrap(err, "create freeze request")
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    client.GetRootCAs(),
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return freeze{}, errors.Wrap(err, "get freeze")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode != http.StatusOK {
+		return freeze{}, errors.Errorf("get freeze: %s", resp.Status)
+	}
+
+	var f freeze
+	if err := json.NewDecoder(resp.Body).Decode(&f); err != nil {
+		return freeze{}, errors.Wrap(err, "decode freeze")
+	}
+	return f, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/autocert/pkg/keystore"
+)
+
+// loadKeystoreConfig sets the keystores to write next to the certificate,
+// from $KEYSTORE_FORMAT and $KEYSTORE_PASSWORD.
+func loadKeystoreConfig(c *Config) error {
+	format := os.Getenv(keystore.FormatEnvVar)
+	switch {
+	case format == "" || format == keystore.FormatPEM:
+		return nil
+	case !keystore.IsFormat(format):
+		return errors.Errorf("invalid $%s %q, use pkcs12, jks or pem", keystore.FormatEnvVar, format)
+	}
+	c.KeystoreFormat = format
+	c.KeystorePassword = keystore.Password()
+	return nil
+}
+
+// writeKeystores replaces the keystores with the certificate and key on
+// disk. The lock of the certificates directory must be held.
+func writeKeystores(config *Config) error {
+	if config.KeystoreFormat == "" {
+		return nil
+	}
+	key, chain, roots, err := keystore.Load(config.CertFile, config.KeyFile, config.RootFile)
+	if err != nil {
+		return errors.Wrap(err, "read certificate for the keystores")
+	}
+	ks, ts, err := keystore.Encode(config.KeystoreFormat, key, chain, roots, config.KeystorePassword, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "encode keystores")
+	}
+
+	// Stage both files before renaming them, like the certificate and key.
+	keyStore, trustStore := keystore.Files(config.KeystoreFormat, config.CertFile)
+	keyStoreTmp, err := stageFile(keyStore, ks)
+	if err != nil {
+		return errors.Wrap(err, "write keystore")
+	}
+	defer os.Remove(keyStoreTmp) //nolint:errcheck // the file is gone after a successful rename
+	trustStoreTmp, err := stageFile(trustStore, ts)
+	if err != nil {
+		return errors.Wrap(err, "write truststore")
+	}
+	defer os.Remove(trustStoreTmp) //nolint:errcheck // the file is gone after a successful rename
+	if err := os.Rename(trustStoreTmp, trustStore); err != nil {
+		return errors.Wrap(err, "write truststore")
+	}
+	if err := os.Rename(keyStoreTmp, keyStore); err != nil {
+		return errors.Wrap(err, "write keystore")
+	}
+	return nil
+}
+
+// syncKeystores writes the keystores if they are missing or older than the
+// certificate, when the bootstrapper didn't write them.
+func syncKeystores(config *Config) error {
+	if config.KeystoreFormat == "" {
+		return nil
+	}
+	crt, err := os.Stat(config.CertFile)
+	if err != nil {
+		return err
+	}
+	keyStore, _ := keystore.Files(config.KeystoreFormat, config.CertFile)
+	if ks, err := os.Stat(keyStore); err == nil && !ks.ModTime().Before(crt.ModTime()) {
+		return nil
+	}
+	unlock, err := lockDir(filepath.Dir(config.CertFile))
+	if err != nil {
+		return errors.Wrap(err, "lock certificates directory")
+	}
+	defer unlock()
+	return writeKeystores(config)
+}
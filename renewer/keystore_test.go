@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/autocert/pkg/keystore"
+)
+
+func Test_loadKeystoreConfig(t *testing.T) {
+	tests := []struct {
+		name, format, password string
+		want                   Config
+		wantErr                bool
+	}{
+		{"none", "", "", Config{}, false},
+		{"pem", "pem", "", Config{}, false},
+		{"pkcs12", "pkcs12", "", Config{KeystoreFormat: "pkcs12", KeystorePassword: "changeit"}, false},
+		{"jks with password", "jks", "s3cret", Config{KeystoreFormat: "jks", KeystorePassword: "s3cret"}, false},
+		{"invalid", "der", "", Config{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(keystore.FormatEnvVar, tt.format)
+			t.Setenv(keystore.PasswordEnvVar, tt.password)
+			var c Config
+			err := loadKeystoreConfig(&c)
+			if (err != nil) != tt.wantErr || c.KeystoreFormat != tt.want.KeystoreFormat || c.KeystorePassword != tt.want.KeystorePassword {
+				t.Errorf("loadKeystoreConfig() = %q, %q, %v, want %q, %q, wantErr %v", c.KeystoreFormat, c.KeystorePassword, err, tt.want.KeystoreFormat, tt.want.KeystorePassword, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_syncKeystores(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		CertFile:         filepath.Join(dir, "site.crt"),
+		KeyFile:          filepath.Join(dir, "site.key"),
+		RootFile:         filepath.Join(dir, "root.crt"),
+		KeystoreFormat:   keystore.FormatPKCS12,
+		KeystorePassword: "changeit",
+	}
+	rootKey, key := mustKey(t), mustKey(t)
+	root := mustCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Root CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, rootKey.Public(), rootKey)
+	crt := mustCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "legacy.default.svc"}}, root, key.Public(), rootKey)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{
+		config.CertFile: {Type: "CERTIFICATE", Bytes: crt.Raw},
+		config.KeyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+		config.RootFile: {Type: "CERTIFICATE", Bytes: root.Raw},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The bootstrapper didn't write the keystores.
+	if err := syncKeystores(config); err != nil {
+		t.Fatal(err)
+	}
+	keyStore, trustStore := filepath.Join(dir, "site.p12"), filepath.Join(dir, "truststore.p12")
+	for _, f := range []string{keyStore, trustStore} {
+		if fi, err := os.Stat(f); err != nil || fi.Size() == 0 {
+			t.Fatalf("%s was not written: %v", f, err)
+		}
+	}
+	ks, err := os.ReadFile(keyStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keystores are up to date.
+	if err := syncKeystores(config); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(keyStore); string(b) != string(ks) {
+		t.Error("syncKeystores() rewrote an up-to-date keystore")
+	}
+
+	// The certificate was renewed after the keystores were written.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(config.CertFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncKeystores(config); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(keyStore); string(b) == string(ks) {
+		t.Error("syncKeystores() didn't rewrite an outdated keystore")
+	}
+}
+
+func Test_writeKeystores_disabled(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{CertFile: filepath.Join(dir, "site.crt")}
+	if err := writeKeystores(config); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("writeKeystores() wrote %d files without a format", len(entries))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// lockFileName and versionFileName are shared with the bootstrapper.
+	lockFileName    = ".lock"
+	versionFileName = ".version"
+)
+
+// lockDir acquires an exclusive advisory lock on the certificates directory,
+// shared with the bootstrapper, and returns a function to release it.
+func lockDir(dir string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0o644) //nolint:gosec // path comes from trusted configuration
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd()) //nolint:gosec // file descriptors fit in an int
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		f.Close() //nolint:errcheck // the flock error is more relevant
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(fd, syscall.LOCK_UN) //nolint:errcheck // closing the file releases the lock anyway
+		f.Close()                          //nolint:errcheck // nothing to do on close errors
+	}, nil
+}
+
+// readVersion returns the version of the certificates directory, 0 if it
+// has never been written.
+func readVersion(dir string) int {
+	b, err := os.ReadFile(filepath.Join(dir, versionFileName)) //nolint:gosec // path comes from trusted configuration
+	if err != nil {
+		return 0
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// bumpVersion increments the version of the certificates directory after a
+// complete set of files has been written. It must be called with the lock
+// held.
+func bumpVersion(dir string) (int, error) {
+	v := readVersion(dir) + 1
+	if err := writeFileAtomic(filepath.Join(dir, versionFileName), []byte(strconv.Itoa(v)+"\n")); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
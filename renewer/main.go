@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/caclient"
+	"github.com/smallstep/autocert/pkg/clock"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+)
+
+const (
+	// minBackoff and maxBackoff bound the delay between consecutive failed
+	// renewal attempts.
+	minBackoff = 10 * time.Second
+	maxBackoff = 5 * time.Minute
+	// statusFileName is the name of the status file written next to the
+	// certificate when STATUS_FILE is not set.
+	statusFileName = "renewal-status.json"
+)
+
+// Config holds the renewer settings, read from the environment variables
+// set by the controller and the renewer image.
+type Config struct {
+	CaURL      string
+	CertFile   string
+	KeyFile    string
+	RootFile   string
+	StatusFile string
+	FreezeURL  string
+	StatusURL  string
+	ReissueURL string
+	// TrustBundleURL serves the roots the root file is refreshed from,
+	// empty if not enabled.
+	TrustBundleURL string
+	PodName        string
+	Namespace      string
+	// CriticalWindow is the remaining lifetime under which the watchdog
+	// gives up on a certificate that fails to renew, a sixth of its lifetime
+	// if zero.
+	CriticalWindow time.Duration
+	// DualStack is set for pods with an RSA certificate next to the ECDSA
+	// one, written to RSACertFile and RSAKeyFile.
+	DualStack   bool
+	RSACertFile string
+	RSAKeyFile  string
+	// FailoverURLs are the URLs of the passive CAs, used in order while the
+	// CA at CaURL is not healthy.
+	FailoverURLs []string
+	// ServiceAccountToken is the path of a service account token bound to
+	// the pod, sent to the controller along with the certificate when set.
+	ServiceAccountToken string
+	// ReadyFile is written once the certificate is confirmed valid, empty if
+	// the controller doesn't set READY_FILE.
+	ReadyFile string
+	// Protocol is the protocol version of the controller.
+	Protocol int
+	// VerifyOnly is set for certificates issued outside of autocert, only
+	// watched until they expire.
+	VerifyOnly bool
+	// DrainFile is written by the application once it has drained. When
+	// set, the renewer keeps running after SIGTERM until the file exists,
+	// for at most DrainTimeout.
+	DrainFile    string
+	DrainTimeout time.Duration
+	// SDSSocket is the path of the Unix socket serving the certificate with
+	// the Envoy Secret Discovery Service, empty if not enabled.
+	SDSSocket string
+	// MetricsAddr is the address serving the Prometheus metrics of the
+	// renewer, empty if not enabled.
+	MetricsAddr string
+	// OTLPEndpoint is the OTLP/HTTP endpoint the metrics, and the logs if
+	// OTLPLogs, are pushed to every OTLPInterval, empty if not enabled.
+	OTLPEndpoint string
+	OTLPHeaders  map[string]string
+	OTLPResource map[string]string
+	OTLPInterval time.Duration
+	OTLPLogs     bool
+	// KeystoreFormat is the format of the keystores written next to the
+	// certificate, pkcs12 or jks, empty if not enabled. They are protected
+	// by KeystorePassword.
+	KeystoreFormat   string
+	KeystorePassword string
+	// DebugFile holds the fingerprints of the certificate and the commands
+	// to compare them with the certificate served by the application.
+	DebugFile string
+	// RenewalSignal is sent to the processes named RenewalProcess after
+	// every renewal, 0 if not enabled.
+	RenewalSignal  syscall.Signal
+	RenewalProcess string
+	// RenewalExec is run in the container RenewalContainer of the pod
+	// RenewalPod after every renewal, empty if not enabled.
+	RenewalExec      []string
+	RenewalContainer string
+	RenewalPod       string
+}
+
+func loadConfig() (*Config, error) {
+	c := &Config{
+		CaURL:          os.Getenv("STEP_CA_URL"),
+		CertFile:       os.Getenv("CRT"),
+		KeyFile:        os.Getenv("KEY"),
+		RootFile:       os.Getenv("STEP_ROOT"),
+		StatusFile:     os.Getenv("STATUS_FILE"),
+		DebugFile:      os.Getenv("DEBUG_FILE"),
+		FreezeURL:      os.Getenv("AUTOCERT_FREEZE_URL"),
+		StatusURL:      os.Getenv("AUTOCERT_STATUS_URL"),
+		ReissueURL:     os.Getenv("AUTOCERT_REISSUE_URL"),
+		TrustBundleURL: os.Getenv("AUTOCERT_TRUST_BUNDLE_URL"),
+		PodName:        os.Getenv("POD_NAME"),
+		Namespace:      os.Getenv("NAMESPACE"),
+		DualStack:      os.Getenv("DUAL_STACK") == "true",
+		VerifyOnly:     os.Getenv("VERIFY_ONLY") == "true",
+		DrainFile:      os.Getenv("DRAIN_FILE"),
+		SDSSocket:      os.Getenv("SDS_SOCKET"),
+
+		MetricsAddr: os.Getenv("METRICS_ADDR"),
+
+		ServiceAccountToken: os.Getenv("AUTOCERT_SA_TOKEN"),
+	}
+	switch {
+	case c.CaURL == "":
+		return nil, errors.New("$STEP_CA_URL not set")
+	case c.CertFile == "":
+		return nil, errors.New("$CRT not set")
+	case c.KeyFile == "":
+		return nil, errors.New("$KEY not set")
+	case c.RootFile == "":
+		return nil, errors.New("$STEP_ROOT not set")
+	}
+	protocol, err := checkProtocol(os.Getenv("AUTOCERT_PROTOCOL"))
+	if err != nil {
+		return nil, err
+	}
+	c.Protocol = protocol
+	if v := os.Getenv("CRITICAL_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, errors.Errorf("invalid $CRITICAL_WINDOW %q, it must be a positive duration", v)
+		}
+		c.CriticalWindow = d
+	}
+	if c.DrainFile != "" {
+		c.DrainTimeout = defaultDrainTimeout
+		if v := os.Getenv("DRAIN_TIMEOUT"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, errors.Errorf("invalid $DRAIN_TIMEOUT %q, it must be a positive duration", v)
+			}
+			c.DrainTimeout = d
+		}
+	}
+	if err := loadOTLPConfig(c); err != nil {
+		return nil, err
+	}
+	if err := loadKeystoreConfig(c); err != nil {
+		return nil, err
+	}
+	if err := loadRenewalHookConfig(c); err != nil {
+		return nil, err
+	}
+	if c.StatusFile == "" {
+		c.StatusFile = filepath.Join(filepath.Dir(c.CertFile), statusFileName)
+	}
+	if c.DebugFile == "" {
+		c.DebugFile = filepath.Join(filepath.Dir(c.CertFile), debugFileName)
+	}
+	if v := os.Getenv("STEP_CA_FAILOVER_URLS"); v != "" {
+		for _, u := range strings.Split(v, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				c.FailoverURLs = append(c.FailoverURLs, u)
+			}
+		}
+	}
+	if v := os.Getenv("READY_FILE"); v != "" {
+		// Relative paths are in the certificates directory, wherever the
+		// volume is mounted in the renewer.
+		if !filepath.IsAbs(v) {
+			v = filepath.Join(filepath.Dir(c.CertFile), v)
+		}
+		c.ReadyFile = v
+	}
+	if c.DualStack {
+		c.RSACertFile = cmp.Or(os.Getenv("RSA_CRT"), rsaFile(c.CertFile))
+		c.RSAKeyFile = cmp.Or(os.Getenv("RSA_KEY"), rsaFile(c.KeyFile))
+	}
+	return c, nil
+}
+
+// renewAt returns the time at which a certificate should be renewed, once
+// two thirds of its lifetime have elapsed. This matches the default used by
+// `step ca renew --daemon`.
+func renewAt(crt *x509.Certificate) time.Time {
+	lifetime := crt.NotAfter.Sub(crt.NotBefore)
+	return crt.NotBefore.Add(lifetime * 2 / 3)
+}
+
+// backoff returns the delay before the next attempt after the given number
+// of consecutive failures.
+func backoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	d := minBackoff
+	for i := 1; i < failures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// readCertificate reads the leaf certificate from the given PEM file.
+func readCertificate(filename string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(filename) //nolint:gosec // file path comes from trusted configuration
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.Errorf("%s does not contain a PEM certificate", filename)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// renew renews the certificate on disk using mTLS with the current
+// certificate and key, and replaces the certificate file with the new chain.
+// If the volume is full or read-only, the previous certificate is kept and a
+// *diskError holding the new one is returned.
+func renew(ctx context.Context, client *ca.Client, config *Config) (*x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load certificate")
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      client.GetRootCAs(),
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	sign, err := client.RenewWithContext(ctx, tr)
+	if err != nil {
+		return nil, errors.Wrap(err, "renew certificate")
+	}
+
+	chain := sign.CertChainPEM
+	if len(chain) == 0 {
+		chain = []api.Certificate{sign.ServerPEM, sign.CaPEM}
+	}
+
+	previous, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "parse certificate")
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key is not a signer")
+	}
+	var intermediates []*x509.Certificate
+	for _, c := range chain[1:] {
+		intermediates = append(intermediates, c.Certificate)
+	}
+	if err := verifyRenewed(previous, sign.ServerPEM.Certificate, intermediates, signer.Public(), client.GetRootCAs()); err != nil {
+		return nil, errors.Wrap(err, "verify renewed certificate")
+	}
+
+	var buf bytes.Buffer
+	for _, c := range chain {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}); err != nil {
+			return nil, errors.Wrap(err, "encode certificate")
+		}
+	}
+
+	return writeCertificate(config, sign.ServerPEM.Certificate, buf.Bytes())
+}
+
+// run renews the certificate until the context is cancelled, recording each
+// scheduling decision in the status file.
+func run(ctx context.Context, config *Config) error {
+	if config.VerifyOnly {
+		v := &verifier{config: config, clock: clock.Real}
+		snapshots := map[string]*statusSnapshot{config.CertFile: &v.snapshot}
+		dumpOnSignal(ctx, config, snapshots)
+		if config.MetricsAddr != "" {
+			serveMetrics(ctx, config.MetricsAddr, snapshots)
+		}
+		if config.OTLPEndpoint != "" {
+			stop, err := startOTLP(config, snapshots)
+			if err != nil {
+				return err
+			}
+			defer stop()
+		}
+		return v.run(ctx)
+	}
+
+	// Requests go to the first healthy CA. Connection errors mark a CA
+	// unhealthy, so the next attempt goes to the next one.
+	pool, err := caclient.New(append([]string{config.CaURL}, config.FailoverURLs...), ca.WithRootFile(config.RootFile))
+	if err != nil {
+		return errors.Wrap(err, "create CA client")
+	}
+	go pool.Run(ctx, caclient.DefaultInterval)
+	withCA := func(fn func(client *ca.Client) (*x509.Certificate, error)) (*x509.Certificate, error) {
+		client := pool.Client()
+		crt, err := fn(client)
+		pool.Failed(client, err)
+		return crt, err
+	}
+
+	crt, err := readCertificate(config.CertFile)
+	if err != nil {
+		return errors.Wrap(err, "read certificate")
+	}
+	if err := syncKeystores(config); err != nil {
+		log.WithField("error", err).Warn("Error writing the keystores, they are written after the next renewal")
+	}
+	updateDebugFile(config)
+	if config.ReadyFile != "" {
+		if err := markReady(config, time.Now()); err != nil {
+			log.WithField("error", err).Warn("Certificate not confirmed, the readiness file is written after the next renewal")
+		}
+	}
+
+	s := &scheduler{
+		config: config,
+		clock:  clock.Real,
+		renew: func(ctx context.Context) (*x509.Certificate, error) {
+			return withCA(func(client *ca.Client) (*x509.Certificate, error) {
+				return renew(ctx, client, config)
+			})
+		},
+		checkFreeze: func(ctx context.Context) (freeze, error) {
+			return checkFreeze(ctx, pool.Client(), config.FreezeURL)
+		},
+		report: func(ctx context.Context, status Status) {
+			if err := sendReport(ctx, pool.Client(), config, status); err != nil {
+				log.WithField("error", err).Warn("Error reporting renewal status")
+			}
+		},
+	}
+	// Controllers that don't support re-issuance don't set a URL.
+	if config.ReissueURL != "" {
+		s.reissue = func(ctx context.Context) (*x509.Certificate, error) {
+			return withCA(func(client *ca.Client) (*x509.Certificate, error) {
+				return reissue(ctx, client, config)
+			})
+		}
+	}
+
+	// Run a watchdog next to each scheduler. When a certificate goes stale,
+	// stop the schedulers, report the critical state, and let main exit so
+	// the container restarts and the failure shows in the pod status.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// SDS clients get the certificate after every renewal.
+	var sds *sdsServer
+	if config.SDSSocket != "" {
+		sds = newSDSServer(config)
+		s.renew = sds.notify(s.renew)
+		if s.reissue != nil {
+			s.reissue = sds.notify(s.reissue)
+		}
+		go func() {
+			if err := sds.serve(ctx, config.SDSSocket); err != nil {
+				log.WithField("error", err).Error("Error serving SDS, the certificate is only available in files")
+			}
+		}()
+	}
+
+	// The application is notified after the SDS clients, once the files and
+	// the SDS secret are all up to date.
+	hook := newRenewalHook(config)
+	if hook != nil {
+		s.renew = hook.notify(s.renew)
+		if s.reissue != nil {
+			s.reissue = hook.notify(s.reissue)
+		}
+	}
+
+	// New roots are trusted by the CA clients, and sent to the SDS clients
+	// and the application like a new certificate.
+	if config.TrustBundleURL != "" {
+		tb := &trustBundle{
+			config: config,
+			fetch: func(ctx context.Context) ([]byte, error) {
+				return fetchTrustBundle(ctx, pool.Client(), config.TrustBundleURL)
+			},
+			updated: func(ctx context.Context) {
+				if err := pool.Reload(ca.WithRootFile(config.RootFile)); err != nil {
+					log.WithField("error", err).Warn("Error reloading the CA clients with the new roots")
+				}
+				if sds != nil {
+					sds.update()
+				}
+				if hook != nil {
+					hook.run(ctx)
+				}
+			},
+		}
+		go tb.run(ctx, trustBundleInterval)
+	}
+
+	stale := make(chan error, 2)
+	done := make(chan error, 2)
+	var schedulers []*scheduler
+	start := func(s *scheduler, crt *x509.Certificate) {
+		schedulers = append(schedulers, s)
+		w := &watchdog{config: s.config, clock: clock.Real}
+		go func() { stale <- w.run(ctx) }()
+		go func() { done <- s.run(ctx, crt) }()
+	}
+	start(s, crt)
+
+	// The RSA certificate of dual-stack pods is renewed on its own schedule,
+	// and re-keyed from the ECDSA one when it's missing or its SANs changed.
+	// Its state is only reported to the controller when it goes stale.
+	if config.DualStack {
+		rsaConfig := config.rsaConfig()
+		rsaCrt, err := readCertificate(rsaConfig.CertFile)
+		if err != nil {
+			if rsaCrt, err = rekeyRSA(ctx, pool.Client(), config); err != nil {
+				return errors.Wrap(err, "get RSA certificate")
+			}
+		}
+		updateDebugFile(rsaConfig)
+		rs := &scheduler{
+			config: rsaConfig,
+			clock:  clock.Real,
+			renew: func(ctx context.Context) (*x509.Certificate, error) {
+				return withCA(func(client *ca.Client) (*x509.Certificate, error) {
+					return renew(ctx, client, rsaConfig)
+				})
+			},
+			checkFreeze: s.checkFreeze,
+			report:      func(context.Context, Status) {},
+			reissue: func(ctx context.Context) (*x509.Certificate, error) {
+				return withCA(func(client *ca.Client) (*x509.Certificate, error) {
+					return syncRSA(ctx, client, config)
+				})
+			},
+		}
+		if hook != nil {
+			rs.renew, rs.reissue = hook.notify(rs.renew), hook.notify(rs.reissue)
+		}
+		start(rs, rsaCrt)
+	}
+
+	snapshots := make(map[string]*statusSnapshot, len(schedulers))
+	for _, s := range schedulers {
+		snapshots[s.config.CertFile] = &s.snapshot
+	}
+	dumpOnSignal(ctx, config, snapshots)
+	if config.MetricsAddr != "" {
+		serveMetrics(ctx, config.MetricsAddr, snapshots)
+	}
+
+	// stop stops the schedulers and waits for the remaining ones to return.
+	stop := func(remaining int) {
+		cancel()
+		for range remaining {
+			<-done
+		}
+	}
+	if config.OTLPEndpoint != "" {
+		stopOTLP, err := startOTLP(config, snapshots)
+		if err != nil {
+			stop(len(schedulers))
+			return err
+		}
+		// Every return stops the schedulers first, so the last export has
+		// their final state.
+		defer stopOTLP()
+	}
+
+	select {
+	case err := <-done:
+		stop(len(schedulers) - 1)
+		return err
+	case err := <-stale:
+		var se *staleError
+		if !errors.As(err, &se) {
+			err := <-done
+			stop(len(schedulers) - 1)
+			return err
+		}
+		stop(len(schedulers))
+		// Keep the scheduling state, if any, for the post-mortem.
+		status, _ := readStatusFile(se.config.StatusFile)
+		status.setCertificate(se.crt)
+		status.State = StateCritical
+		status.LastError = se.reason
+		if werr := status.write(se.config.StatusFile); werr != nil {
+			log.WithField("error", werr).Warn("Error writing renewal status")
+		}
+		rctx, rcancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+		defer rcancel()
+		if rerr := sendReport(rctx, pool.Client(), se.config, status); rerr != nil {
+			log.WithField("error", rerr).Warn("Error reporting renewal status")
+		}
+		return err
+	}
+}
+
+func main() {
+	config, err := loadConfig()
+	if err != nil {
+		fail(exitConfig, "Error loading configuration: %v", err)
+	}
+
+	log.SetOutput(os.Stdout)
+	if os.Getenv("LOG_FORMAT") == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx := drainContext(signalCtx, config, clock.Real)
+
+	// In-flight requests are cancelled on SIGTERM, but a renewer blocked on
+	// the volume, like a write to a hung NFS mount, must not hold the pod
+	// until the kubelet kills it.
+	go func() {
+		<-ctx.Done()
+		time.Sleep(2 * shutdownTimeout)
+		fail(exitError, "Timed out stopping the renewer after %s", 2*shutdownTimeout)
+	}()
+
+	if err := run(ctx, config); err != nil {
+		stop()
+		var stale *staleError
+		if errors.As(err, &stale) {
+			fail(exitStale, "Certificate is stale: %v", err)
+		}
+		fail(exitError, "Error running renewer: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_renewAt(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	crt := &x509.Certificate{
+		NotBefore: now,
+		NotAfter:  now.Add(24 * time.Hour),
+	}
+	if got, want := renewAt(crt), now.Add(16*time.Hour); !got.Equal(want) {
+		t.Errorf("renewAt() = %v, want %v", got, want)
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{6, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestStatus_write(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), statusFileName)
+	next := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := &Status{
+		State:               StateBackoff,
+		NextAttempt:         next,
+		ConsecutiveFailures: 2,
+		Backoff:             "20s",
+		LastError:           "renew certificate: connection refused",
+	}
+	if err := s.write(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["state"] != StateBackoff || m["nextAttempt"] != "2024-01-02T03:04:05Z" || m["consecutiveFailures"] != float64(2) {
+		t.Errorf("unexpected status file: %s", b)
+	}
+	if _, ok := m["lastSuccess"]; ok {
+		t.Errorf("lastSuccess should be omitted when zero: %s", b)
+	}
+}
+
+func Test_bumpVersion(t *testing.T) {
+	dir := t.TempDir()
+	if v := readVersion(dir); v != 0 {
+		t.Errorf("readVersion() = %d, want 0", v)
+	}
+
+	unlock, err := lockDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	for want := 1; want <= 3; want++ {
+		v, err := bumpVersion(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != want || readVersion(dir) != want {
+			t.Errorf("bumpVersion() = %d, want %d", v, want)
+		}
+	}
+}
+
+func Test_checkProtocol(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", 1, false},
+		{"1", 1, false},
+		{"2", 2, false},
+		{"3", 3, false},
+		{"4", 4, false},
+		{"5", 5, false},
+		{"6", 6, false},
+		{"7", 7, false},
+		{"8", 8, false},
+		{"9", 9, false},
+		{"10", 10, false},
+		{"11", 11, false},
+		{"12", 12, false},
+		{"13", 13, false},
+		{"14", 14, false},
+		{"15", 15, false},
+		{"16", 16, false},
+		{"17", 17, false},
+		{"18", 18, false},
+		{"19", 19, false},
+		{"20", 20, false},
+		{"21", 21, false},
+		{"22", 22, false},
+		{"23", 23, false},
+		{"24", 24, false},
+		{"25", 25, false},
+		{"26", 0, true},
+		{"0", 0, true},
+		{"two", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := checkProtocol(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("checkProtocol(%q) = %d, %v, want %d, wantErr %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
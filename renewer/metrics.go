@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Results of the renewals, the result label of
+// autocert_renewer_renewals_total.
+const (
+	resultSuccess  = "success"
+	resultFailure  = "failure"
+	resultReissued = "reissued"
+)
+
+var (
+	// metricsRegistry holds the metrics served on $METRICS_ADDR.
+	metricsRegistry = prometheus.NewRegistry()
+
+	renewals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autocert_renewer_renewals_total",
+		Help: "Number of renewal attempts, by certificate and result.",
+	}, []string{"certificate", "result"})
+
+	expiryDesc = prometheus.NewDesc("autocert_renewer_certificate_expiry_seconds",
+		"Seconds until the certificate expires, negative once expired.", []string{"certificate"}, nil)
+	failuresDesc = prometheus.NewDesc("autocert_renewer_consecutive_failures",
+		"Number of consecutive failed renewals of the certificate.", []string{"certificate"}, nil)
+)
+
+func init() {
+	metricsRegistry.MustRegister(renewals)
+}
+
+// certificateLabel returns the certificate label of the metrics of a
+// certificate file.
+func certificateLabel(certFile string) string {
+	return filepath.Base(certFile)
+}
+
+// recordRenewal counts a renewal attempt.
+func recordRenewal(certFile, result string) {
+	renewals.WithLabelValues(certificateLabel(certFile), result).Inc()
+}
+
+// statusCollector exports the expiry and the failures of the certificates
+// from the last status of their scheduler, so the expiry is current on every
+// scrape.
+type statusCollector struct {
+	snapshots map[string]*statusSnapshot
+	now       func() time.Time
+}
+
+func (c statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- expiryDesc
+	ch <- failuresDesc
+}
+
+func (c statusCollector) Collect(ch chan<- prometheus.Metric) {
+	now := c.now()
+	for certFile, snapshot := range c.snapshots {
+		status, ok := snapshot.load()
+		if !ok || status.NotAfter.IsZero() {
+			continue
+		}
+		label := certificateLabel(certFile)
+		ch <- prometheus.MustNewConstMetric(expiryDesc, prometheus.GaugeValue, status.NotAfter.Sub(now).Seconds(), label)
+		ch <- prometheus.MustNewConstMetric(failuresDesc, prometheus.GaugeValue, float64(status.ConsecutiveFailures), label)
+	}
+}
+
+// serveMetrics serves the metrics of the certificates on addr until the
+// context is cancelled. snapshots holds the status of each certificate, by
+// certificate file.
+func serveMetrics(ctx context.Context, addr string, snapshots map[string]*statusSnapshot) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsGatherer(snapshots), promhttp.HandlerOpts{}))
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close() //nolint:errcheck // the renewer is stopping
+	}()
+	go func() {
+		log.WithField("address", addr).Info("Serving metrics")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithField("error", err).Error("Error serving metrics")
+		}
+	}()
+}
+
+// metricsGatherer returns the metrics of the renewer and of the certificates,
+// served or pushed with OTLP.
+func metricsGatherer(snapshots map[string]*statusSnapshot) prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(statusCollector{snapshots: snapshots, now: time.Now})
+	return prometheus.Gatherers{metricsRegistry, registry}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gather returns the values of the metrics of the registry by name and
+// certificate label.
+func gather(t *testing.T, g prometheus.Gatherer) map[string]float64 {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			key := f.GetName()
+			for _, l := range m.GetLabel() {
+				key += " " + l.GetValue()
+			}
+			values[key] = m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		}
+	}
+	return values
+}
+
+func TestStatusCollector(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var site, rsa, pending statusSnapshot
+	site.store(Status{NotAfter: now.Add(time.Hour), ConsecutiveFailures: 2})
+	rsa.store(Status{NotAfter: now.Add(-time.Minute)})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(statusCollector{
+		snapshots: map[string]*statusSnapshot{
+			"/var/run/autocert.step.sm/site.crt":     &site,
+			"/var/run/autocert.step.sm/site-rsa.crt": &rsa,
+			"/var/run/autocert.step.sm/other.crt":    &pending,
+		},
+		now: func() time.Time { return now },
+	})
+	want := map[string]float64{
+		"autocert_renewer_certificate_expiry_seconds site.crt":     3600,
+		"autocert_renewer_certificate_expiry_seconds site-rsa.crt": -60,
+		"autocert_renewer_consecutive_failures site.crt":           2,
+		"autocert_renewer_consecutive_failures site-rsa.crt":       0,
+	}
+	if got := gather(t, registry); !maps.Equal(got, want) {
+		t.Errorf("metrics = %v, want %v", got, want)
+	}
+}
+
+func TestRecordRenewal(t *testing.T) {
+	const key = "autocert_renewer_renewals_total site.crt failure"
+	before := gather(t, metricsRegistry)[key]
+	recordRenewal("/var/run/autocert.step.sm/site.crt", resultFailure)
+	if got := gather(t, metricsRegistry)[key] - before; got != 1 {
+		t.Errorf("failures = %v, want 1", got)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var snapshot statusSnapshot
+	snapshot.store(Status{NotAfter: time.Now().Add(time.Hour)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveMetrics(ctx, addr, map[string]*statusSnapshot{"site.crt": &snapshot})
+
+	var body []byte
+	for i := 0; i < 50; i++ {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	if !strings.Contains(string(body), `autocert_renewer_certificate_expiry_seconds{certificate="site.crt"}`) {
+		t.Errorf("metrics = %s, want the expiry of the certificate", body)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"cmp"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/otlp"
+)
+
+// loadOTLPConfig reads the OTLP export settings, set by controllers with
+// otlp.renewers enabled, with the variables of the OpenTelemetry SDKs.
+func loadOTLPConfig(c *Config) error {
+	c.OTLPEndpoint = os.Getenv(otlp.EndpointEnvVar)
+	if c.OTLPEndpoint == "" {
+		return nil
+	}
+	if _, err := otlp.New(c.OTLPEndpoint); err != nil {
+		return errors.Wrapf(err, "invalid $%s", otlp.EndpointEnvVar)
+	}
+	var err error
+	if c.OTLPHeaders, err = otlp.ParseAttributes(os.Getenv(otlp.HeadersEnvVar)); err != nil {
+		return errors.Wrapf(err, "invalid $%s", otlp.HeadersEnvVar)
+	}
+	if c.OTLPResource, err = otlp.ParseAttributes(os.Getenv(otlp.ResourceEnvVar)); err != nil {
+		return errors.Wrapf(err, "invalid $%s", otlp.ResourceEnvVar)
+	}
+	c.OTLPInterval = otlp.DefaultInterval
+	if v := os.Getenv("OTEL_METRIC_EXPORT_INTERVAL"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return errors.Errorf("invalid $OTEL_METRIC_EXPORT_INTERVAL %q, it must be a positive number of milliseconds", v)
+		}
+		c.OTLPInterval = time.Duration(ms) * time.Millisecond
+	}
+	c.OTLPLogs = cmp.Or(os.Getenv("OTEL_LOGS_EXPORTER"), "otlp") == "otlp"
+	return nil
+}
+
+// startOTLP starts pushing the metrics of the certificates, and the logs, to
+// the OTLP endpoint. The returned function stops it after a last export.
+func startOTLP(config *Config, snapshots map[string]*statusSnapshot) (stop func(), err error) {
+	attrs := map[string]string{
+		"service.name":       "autocert-renewer",
+		"k8s.namespace.name": config.Namespace,
+	}
+	if config.PodName != "" {
+		attrs["k8s.pod.name"] = config.PodName
+	}
+	for k, v := range config.OTLPResource {
+		attrs[k] = v
+	}
+	e, err := otlp.New(config.OTLPEndpoint,
+		otlp.WithHeaders(config.OTLPHeaders),
+		otlp.WithResource(attrs),
+		otlp.WithGatherer(metricsGatherer(snapshots)))
+	if err != nil {
+		return nil, err
+	}
+	if config.OTLPLogs {
+		log.AddHook(e)
+	}
+	log.WithFields(log.Fields{
+		"endpoint": config.OTLPEndpoint,
+		"interval": config.OTLPInterval,
+	}).Info("Exporting metrics with OTLP")
+	return e.Start(config.OTLPInterval), nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadOTLPConfig(t *testing.T) {
+	var c Config
+	if err := loadOTLPConfig(&c); err != nil || c.OTLPEndpoint != "" {
+		t.Fatalf("loadOTLPConfig() without endpoint = %+v, %v", c, err)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://otel-agent.observability:4318")
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "k8s.cluster.name=prod")
+	t.Setenv("OTEL_METRIC_EXPORT_INTERVAL", "60000")
+	t.Setenv("OTEL_LOGS_EXPORTER", "none")
+	if err := loadOTLPConfig(&c); err != nil {
+		t.Fatal(err)
+	}
+	if c.OTLPResource["k8s.cluster.name"] != "prod" || c.OTLPInterval != time.Minute || c.OTLPLogs {
+		t.Errorf("loadOTLPConfig() = %+v", c)
+	}
+
+	t.Setenv("OTEL_LOGS_EXPORTER", "")
+	t.Setenv("OTEL_METRIC_EXPORT_INTERVAL", "")
+	if err := loadOTLPConfig(&c); err != nil || !c.OTLPLogs || c.OTLPInterval != 30*time.Second {
+		t.Errorf("loadOTLPConfig() with defaults = %+v, %v", c, err)
+	}
+
+	for name, value := range map[string]string{
+		"OTEL_METRIC_EXPORT_INTERVAL": "1m",
+		"OTEL_RESOURCE_ATTRIBUTES":    "prod",
+		"OTEL_EXPORTER_OTLP_ENDPOINT": "otel-agent:4318",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if err := loadOTLPConfig(&Config{}); err == nil {
+				t.Errorf("loadOTLPConfig() with %s=%s succeeded", name, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// markReady writes the readiness file once the certificate on disk is
+// confirmed: it matches the private key and is valid at the given time.
+// Startup probes of the application containers wait for this file instead of
+// polling for the certificate. The file holds the serial number of the
+// certificate.
+func markReady(config *Config, now time.Time) error {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "load certificate")
+	}
+	crt, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "parse certificate")
+	}
+	if now.Before(crt.NotBefore) || now.After(crt.NotAfter) {
+		return errors.Errorf("certificate is only valid from %s to %s", crt.NotBefore.Format(time.RFC3339), crt.NotAfter.Format(time.RFC3339))
+	}
+	return errors.Wrap(writeFileAtomic(config.ReadyFile, []byte(crt.SerialNumber.String()+"\n")), "write readiness file")
+}
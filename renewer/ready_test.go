@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMarkReady(t *testing.T) {
+	key := mustKey(t)
+	crt := mustCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "app"}}, nil, key.Public(), key)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	config := &Config{
+		CertFile:  filepath.Join(dir, "site.crt"),
+		KeyFile:   filepath.Join(dir, "site.key"),
+		ReadyFile: filepath.Join(dir, "ready"),
+	}
+	if err := os.WriteFile(config.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired certificates are not confirmed.
+	if err := markReady(config, crt.NotAfter.Add(time.Second)); err == nil {
+		t.Error("markReady() with an expired certificate succeeded")
+	}
+	if _, err := os.Stat(config.ReadyFile); !os.IsNotExist(err) {
+		t.Errorf("readiness file written for an expired certificate: %v", err)
+	}
+
+	if err := markReady(config, time.Now()); err != nil {
+		t.Fatalf("markReady() error = %v", err)
+	}
+	b, err := os.ReadFile(config.ReadyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := crt.SerialNumber.String() + "\n"; string(b) != want {
+		t.Errorf("readiness file = %q, want %q", b, want)
+	}
+
+	// A key that doesn't match the certificate is not confirmed.
+	other, err := x509.MarshalECPrivateKey(mustKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: other}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := markReady(config, time.Now()); err == nil {
+		t.Error("markReady() with a mismatched key succeeded")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+)
+
+// reissueInterval is how often the renewer asks the controller whether its
+// certificate must be re-issued with new SANs.
+const reissueInterval = 5 * time.Minute
+
+// reissueRequest is the body of a request to the controller /reissue
+// endpoint.
+type reissueRequest struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+}
+
+// reissueResponse is the response of the controller /reissue endpoint when
+// the certificate must be re-issued.
+type reissueResponse struct {
+	Token string   `json:"token"`
+	SANs  []string `json:"sans"`
+}
+
+// checkReissue asks the controller whether the certificate must be re-issued
+// because the SANs requested by the pod changed. It returns a token for the
+// new SANs, or an empty token if the certificate is up to date. The renewer
+// authenticates with its certificate.
+func checkReissue(ctx context.Context, client *ca.Client, config *Config) (reissueResponse, error) {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return reissueResponse{}, errors.Wrap(err, "load certificate")
+	}
+	body, err := json.Marshal(reissueRequest{
+		Namespace: config.Namespace,
+		Pod:       config.PodName,
+	})
+	if err != nil {
+		return reissueResponse{}, errors.Wrap(err, "encode reissue request")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.ReissueURL, bytes.NewReader(body))
+	if err != nil {
+		return reissueResponse{}, errors.Wrap(err, "create reissue request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := setServiceAccountToken(req, config); err != nil {
+		return reissueResponse{}, err
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      client.GetRootCAs(),
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return reissueResponse{}, errors.Wrap(err, "check reissue")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return reissueResponse{}, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return reissueResponse{}, errors.Errorf("check reissue: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var r reissueResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r.Token == "" {
+		return reissueResponse{}, errors.New("check reissue: invalid response")
+	}
+	return r, nil
+}
+
+// reissue replaces the certificate and key on disk with a new certificate
+// for the SANs given by the controller, keeping the lifetime of the current
+// certificate. It returns nil if the certificate is up to date.
+func reissue(ctx context.Context, client *ca.Client, config *Config) (*x509.Certificate, error) {
+	r, err := checkReissue(ctx, client, config)
+	if err != nil || r.Token == "" {
+		return nil, err
+	}
+
+	previous, err := readCertificate(config.CertFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read certificate")
+	}
+
+	req, _, err := ca.CreateSignRequest(r.Token)
+	if err != nil {
+		return nil, errors.Wrap(err, "create sign request")
+	}
+	// The request is signed with a key like the current one, the pod may
+	// have requested another type than the default P-256 key.
+	signer, err := newKeyLike(previous.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:        req.CsrPEM.Subject,
+		DNSNames:       req.CsrPEM.DNSNames,
+		IPAddresses:    req.CsrPEM.IPAddresses,
+		EmailAddresses: req.CsrPEM.EmailAddresses,
+		URIs:           req.CsrPEM.URIs,
+	}, signer)
+	if err != nil {
+		return nil, errors.Wrap(err, "create certificate request")
+	}
+	if req.CsrPEM.CertificateRequest, err = x509.ParseCertificateRequest(der); err != nil {
+		return nil, errors.Wrap(err, "parse certificate request")
+	}
+	req.NotAfter = api.NewTimeDuration(time.Now().Add(previous.NotAfter.Sub(previous.NotBefore)))
+
+	sign, err := client.SignWithContext(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign certificate")
+	}
+
+	chain := sign.CertChainPEM
+	if len(chain) == 0 {
+		chain = []api.Certificate{sign.ServerPEM, sign.CaPEM}
+	}
+
+	var intermediates []*x509.Certificate
+	for _, c := range chain[1:] {
+		intermediates = append(intermediates, c.Certificate)
+	}
+	if err := verifyReissued(previous, sign.ServerPEM.Certificate, intermediates, signer.Public(), client.GetRootCAs(), r.SANs); err != nil {
+		return nil, errors.Wrap(err, "verify re-issued certificate")
+	}
+
+	if err := writeKeyPair(config, chain, signer); err != nil {
+		return nil, err
+	}
+
+	return sign.ServerPEM.Certificate, nil
+}
+
+// verifyReissued checks a re-issued certificate before it replaces the
+// current one. Like a renewed certificate, it must use the new key and chain
+// to the current roots, but its SANs must be the ones requested.
+func verifyReissued(previous, reissued *x509.Certificate, intermediates []*x509.Certificate, key crypto.PublicKey, roots *x509.CertPool, want []string) error {
+	if err := verifyIssued(reissued, intermediates, key, roots); err != nil {
+		return err
+	}
+	if previous.Subject.CommonName != reissued.Subject.CommonName {
+		return errors.Errorf("certificate subject %q does not match %q", reissued.Subject.CommonName, previous.Subject.CommonName)
+	}
+	want = slices.Compact(slices.Sorted(slices.Values(want)))
+	if got := sans(reissued); !slices.EqualFunc(got, want, strings.EqualFold) {
+		return errors.Errorf("certificate SANs %v do not match %v", got, want)
+	}
+	return nil
+}
+
+// newKeyLike generates a key of the same type and size as a public key.
+func newKeyLike(pub crypto.PublicKey) (crypto.Signer, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.GenerateKey(k.Curve, rand.Reader)
+	case *rsa.PublicKey:
+		return rsa.GenerateKey(rand.Reader, k.N.BitLen())
+	case ed25519.PublicKey:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, errors.Errorf("unsupported key type %T", pub)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func Test_verifyReissued(t *testing.T) {
+	rootKey := mustKey(t)
+	root := mustCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Root CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, rootKey.Public(), rootKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	previousKey, key := mustKey(t), mustKey(t)
+	leaf := func(cn string, dnsNames []string, signer *x509.Certificate) *x509.Certificate {
+		return mustCertificate(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: cn},
+			DNSNames:    dnsNames,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}, signer, key.Public(), rootKey)
+	}
+	previous := mustCertificate(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "test.default.svc"},
+		DNSNames: []string{"test.default.svc"},
+	}, root, previousKey.Public(), rootKey)
+	want := []string{"test.default.svc", "api.example.com"}
+
+	tests := []struct {
+		name     string
+		reissued *x509.Certificate
+		wantErr  bool
+	}{
+		{"ok", leaf("test.default.svc", []string{"api.example.com", "test.default.svc"}, root), false},
+		{"different case", leaf("test.default.svc", []string{"API.example.com", "test.default.svc"}, root), false},
+		{"different subject", leaf("other.default.svc", want, root), true},
+		{"previous sans", leaf("test.default.svc", []string{"test.default.svc"}, root), true},
+		{"extra san", leaf("test.default.svc", append([]string{"evil.example.com"}, want...), root), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyReissued(previous, tt.reissued, nil, key.Public(), roots, want)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyReissued() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The re-issued certificate must use the new key.
+	if err := verifyReissued(previous, leaf("test.default.svc", want, root), nil, previousKey.Public(), roots, want); err == nil {
+		t.Error("verifyReissued() with the previous key should fail")
+	}
+}
+
+func Test_newKeyLike(t *testing.T) {
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		pub  crypto.PublicKey
+		same func(crypto.PublicKey) bool
+	}{
+		{"P-384", p384.Public(), func(k crypto.PublicKey) bool {
+			ec, ok := k.(*ecdsa.PublicKey)
+			return ok && ec.Curve == elliptic.P384()
+		}},
+		{"RSA 3072", rsaKey.Public(), func(k crypto.PublicKey) bool {
+			r, ok := k.(*rsa.PublicKey)
+			return ok && r.N.BitLen() == 3072
+		}},
+		{"Ed25519", edPub, func(k crypto.PublicKey) bool {
+			_, ok := k.(ed25519.PublicKey)
+			return ok
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := newKeyLike(tt.pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.same(key.Public()) {
+				t.Errorf("newKeyLike() = %T, want a key like %T", key.Public(), tt.pub)
+			}
+		})
+	}
+}
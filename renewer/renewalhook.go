@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// renewalHookTimeout bounds a renewal hook, the next renewals wait for
+	// it.
+	renewalHookTimeout = 30 * time.Second
+	// serviceAccountDir holds the service account token of the pod, mounted
+	// in the renewer by the controller for the exec hook.
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// execProtocol is the streaming protocol of the exec API, sending the
+	// exit status of the command in the error channel.
+	execProtocol = "v4.channel.k8s.io"
+	// maxHookOutput bounds the output of a command kept for the logs.
+	maxHookOutput = 1024
+)
+
+// renewalSignals are the signals the controller can configure.
+var renewalSignals = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+// signalName returns the name of a signal, like SIGHUP.
+func signalName(sig syscall.Signal) string {
+	for name, s := range renewalSignals {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+var renewalHooks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "autocert_renewer_renewal_hooks_total",
+	Help: "Number of times the application was notified of a renewal, by result.",
+}, []string{"result"})
+
+func init() {
+	metricsRegistry.MustRegister(renewalHooks)
+}
+
+// loadRenewalHookConfig sets how the application is notified of renewals,
+// from $RENEWAL_SIGNAL and $RENEWAL_PROCESS, or $RENEWAL_EXEC,
+// $RENEWAL_CONTAINER and $RENEWAL_POD.
+func loadRenewalHookConfig(c *Config) error {
+	if v := os.Getenv("RENEWAL_SIGNAL"); v != "" {
+		sig, ok := renewalSignals[v]
+		if !ok {
+			return errors.Errorf("invalid $RENEWAL_SIGNAL %q", v)
+		}
+		c.RenewalSignal = sig
+		if c.RenewalProcess = os.Getenv("RENEWAL_PROCESS"); c.RenewalProcess == "" {
+			return errors.New("$RENEWAL_PROCESS not set")
+		}
+		return nil
+	}
+	if v := os.Getenv("RENEWAL_EXEC"); v != "" {
+		c.RenewalExec = strings.Fields(v)
+		c.RenewalContainer = os.Getenv("RENEWAL_CONTAINER")
+		c.RenewalPod = os.Getenv("RENEWAL_POD")
+		switch {
+		case len(c.RenewalExec) == 0:
+			return errors.Errorf("invalid $RENEWAL_EXEC %q", v)
+		case c.RenewalContainer == "":
+			return errors.New("$RENEWAL_CONTAINER not set")
+		case c.RenewalPod == "":
+			return errors.New("$RENEWAL_POD not set")
+		}
+	}
+	return nil
+}
+
+// renewalHook notifies the application once a new certificate is written,
+// for applications that only read their certificate on startup or on a
+// signal.
+type renewalHook struct {
+	config *Config
+	// signal sends the signal of the configuration to the application, and
+	// exec runs the command in its container.
+	signal func() error
+	exec   func(ctx context.Context) error
+}
+
+// newRenewalHook returns the renewal hook of the configuration, nil if the
+// application is not notified.
+func newRenewalHook(config *Config) *renewalHook {
+	switch {
+	case config.RenewalSignal != 0:
+		return &renewalHook{
+			config: config,
+			signal: func() error {
+				return signalProcesses("/proc", config.RenewalProcess, config.RenewalSignal, os.Getpid(), syscall.Kill)
+			},
+		}
+	case len(config.RenewalExec) > 0:
+		return &renewalHook{
+			config: config,
+			exec: func(ctx context.Context) error {
+				return execInCluster(ctx, config)
+			},
+		}
+	default:
+		return nil
+	}
+}
+
+// String describes the hook, like "SIGHUP nginx" or "exec app: nginx -s
+// reload".
+func (h *renewalHook) String() string {
+	if h.signal != nil {
+		return signalName(h.config.RenewalSignal) + " " + h.config.RenewalProcess
+	}
+	return "exec " + h.config.RenewalContainer + ": " + strings.Join(h.config.RenewalExec, " ")
+}
+
+// notify wraps a renewal function to run the hook after every new
+// certificate. Hook errors are only logged and counted, the new certificate
+// is in place either way.
+func (h *renewalHook) notify(fn func(context.Context) (*x509.Certificate, error)) func(context.Context) (*x509.Certificate, error) {
+	return func(ctx context.Context) (*x509.Certificate, error) {
+		crt, err := fn(ctx)
+		if err == nil && crt != nil {
+			h.run(ctx)
+		}
+		return crt, err
+	}
+}
+
+// run notifies the application.
+func (h *renewalHook) run(ctx context.Context) {
+	var err error
+	ctxLog := log.NewEntry(log.StandardLogger())
+	if h.signal != nil {
+		ctxLog = ctxLog.WithFields(log.Fields{
+			"signal":  signalName(h.config.RenewalSignal),
+			"process": h.config.RenewalProcess,
+		})
+		err = h.signal()
+	} else {
+		ctxLog = ctxLog.WithFields(log.Fields{
+			"command":   strings.Join(h.config.RenewalExec, " "),
+			"container": h.config.RenewalContainer,
+		})
+		ctx, cancel := context.WithTimeout(ctx, renewalHookTimeout)
+		defer cancel()
+		err = h.exec(ctx)
+	}
+	if err != nil {
+		renewalHooks.WithLabelValues("error").Inc()
+		ctxLog.WithField("error", err).Warn("Error notifying the application of the renewal")
+		return
+	}
+	renewalHooks.WithLabelValues("success").Inc()
+	ctxLog.Info("Notified the application of the renewal")
+}
+
+// signalProcesses sends a signal to the processes named name in the process
+// namespace of the pod, but the renewer itself, self. A process matches by
+// the name of its executable or by its first argument. It returns an error
+// if no process matches, or if a signal fails, usually because the renewer
+// runs as another user without CAP_KILL.
+func signalProcesses(procDir, name string, sig syscall.Signal, self int, kill func(pid int, sig syscall.Signal) error) error {
+	pids, err := findProcesses(procDir, name, self)
+	if err != nil {
+		return err
+	}
+	if len(pids) == 0 {
+		return errors.Errorf("no process named %s, is the process namespace of the pod shared?", name)
+	}
+	for _, pid := range pids {
+		if err := kill(pid, sig); err != nil {
+			return errors.Wrapf(err, "signal process %d", pid)
+		}
+	}
+	return nil
+}
+
+// findProcesses returns the processes named name, but self.
+func findProcesses(procDir, name string, self int) ([]int, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list processes")
+	}
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		if processName(filepath.Join(procDir, e.Name())) == name || processArg0(filepath.Join(procDir, e.Name())) == name {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// processName returns the name of the executable of a process, truncated
+// to 15 characters by the kernel, so long names only match with their
+// first argument.
+func processName(dir string) string {
+	b, err := os.ReadFile(filepath.Join(dir, "comm")) //nolint:gosec // path under procDir
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(string(b), "\n")
+}
+
+// processArg0 returns the base name of the first argument of a process.
+func processArg0(dir string) string {
+	b, err := os.ReadFile(filepath.Join(dir, "cmdline")) //nolint:gosec // path under procDir
+	if err != nil || len(b) == 0 {
+		return ""
+	}
+	arg0, _, _ := bytes.Cut(b, []byte{0})
+	return filepath.Base(string(arg0))
+}
+
+// execInCluster runs the command of the configuration in the application
+// container with the exec API, authenticated with the service account token
+// of the pod.
+func execInCluster(ctx context.Context, config *Config) error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return errors.New("$KUBERNETES_SERVICE_HOST and $KUBERNETES_SERVICE_PORT not set")
+	}
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return errors.Wrap(err, "read service account token")
+	}
+	roots, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return errors.Wrap(err, "read service account CA")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(roots) {
+		return errors.New("no certificates in the service account CA")
+	}
+	apiServer := &url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)}
+	return execInContainer(ctx, apiServer, strings.TrimSpace(string(token)), &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}, config.Namespace, config.RenewalPod, config.RenewalContainer, config.RenewalExec)
+}
+
+// execStatus is the exit status of a command, sent by the API server in the
+// error channel as a Status object.
+type execStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// execInContainer runs a command in a container with the exec API of the
+// API server. It returns an error if the command can't run or exits with a
+// non-zero code, with the end of its standard error.
+func execInContainer(ctx context.Context, apiServer *url.URL, token string, tlsConfig *tls.Config, namespace, pod, container string, command []string) error {
+	query := url.Values{
+		"container": {container},
+		"command":   command,
+		"stdout":    {"true"},
+		"stderr":    {"true"},
+	}
+	u := *apiServer
+	u.Scheme = "wss"
+	u.Path = fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/exec", namespace, pod)
+	u.RawQuery = query.Encode()
+
+	wsConfig, err := websocket.NewConfig(u.String(), apiServer.String())
+	if err != nil {
+		return err
+	}
+	wsConfig.Protocol = []string{execProtocol}
+	wsConfig.TlsConfig = tlsConfig
+	wsConfig.Header = http.Header{"Authorization": {"Bearer " + token}}
+	ws, err := wsConfig.DialContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "exec")
+	}
+	defer ws.Close() //nolint:errcheck // close errors are unactionable in defer
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := ws.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	// Each message starts with the number of its channel: 1 for the
+	// standard output, 2 for the standard error and 3 for the status.
+	var stderr []byte
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			return errors.Wrap(err, "exec: connection closed before the command exited")
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case 2:
+			stderr = append(stderr, msg[1:]...)
+			if len(stderr) > maxHookOutput {
+				stderr = stderr[len(stderr)-maxHookOutput:]
+			}
+		case 3:
+			if len(msg) == 1 {
+				continue
+			}
+			var status execStatus
+			if err := json.Unmarshal(msg[1:], &status); err != nil {
+				return errors.Wrap(err, "exec: invalid status")
+			}
+			if status.Status == "Success" {
+				return nil
+			}
+			if out := strings.TrimSpace(string(stderr)); out != "" {
+				return errors.Errorf("%s: %s", status.Message, out)
+			}
+			return errors.New(status.Message)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func Test_loadRenewalHookConfig(t *testing.T) {
+	tests := []struct {
+		name                                  string
+		signal, process, exec, container, pod string
+		wantErr                               bool
+	}{
+		{"none", "", "", "", "", "", false},
+		{"signal", "SIGHUP", "nginx", "", "", "", false},
+		{"signal without process", "SIGHUP", "", "", "", "", true},
+		{"unknown signal", "SIGKILL", "nginx", "", "", "", true},
+		{"exec", "", "", "nginx -s reload", "app", "app-7d9c5b7d4-8xkqz", false},
+		{"exec without pod", "", "", "nginx -s reload", "app", "", true},
+		{"blank exec", "", "", " ", "app", "app-7d9c5b7d4-8xkqz", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RENEWAL_SIGNAL", tt.signal)
+			t.Setenv("RENEWAL_PROCESS", tt.process)
+			t.Setenv("RENEWAL_EXEC", tt.exec)
+			t.Setenv("RENEWAL_CONTAINER", tt.container)
+			t.Setenv("RENEWAL_POD", tt.pod)
+			var c Config
+			if err := loadRenewalHookConfig(&c); (err != nil) != tt.wantErr {
+				t.Errorf("loadRenewalHookConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// writeProc writes a fake /proc entry of a process.
+func writeProc(t *testing.T, procDir, pid, comm, cmdline string) {
+	t.Helper()
+	dir := filepath.Join(procDir, pid)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cmdline"), []byte(cmdline), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_signalProcesses(t *testing.T) {
+	procDir := t.TempDir()
+	writeProc(t, procDir, "1", "pause", "/pause\x00")
+	writeProc(t, procDir, "7", "nginx", "nginx: master process /usr/sbin/nginx\x00")
+	writeProc(t, procDir, "8", "nginx", "nginx: worker process\x00")
+	writeProc(t, procDir, "12", "renewer", "/home/step/bin/renewer\x00")
+	writeProc(t, procDir, "20", "java", "/opt/java/bin/java\x00-jar\x00app.jar\x00")
+	writeProc(t, procDir, "31", "billing-service", "/app/billing-service-server\x00")
+	if err := os.Mkdir(filepath.Join(procDir, "self"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	var signaled []int
+	kill := func(pid int, sig syscall.Signal) error {
+		if sig != syscall.SIGHUP {
+			t.Errorf("kill() signal = %v, want SIGHUP", sig)
+		}
+		signaled = append(signaled, pid)
+		return nil
+	}
+	tests := []struct {
+		name    string
+		process string
+		self    int
+		want    []int
+		wantErr bool
+	}{
+		{"by name", "nginx", 12, []int{7, 8}, false},
+		{"by argument", "billing-service-server", 12, []int{31}, false},
+		{"by executable", "java", 12, []int{20}, false},
+		{"self", "renewer", 12, nil, true},
+		{"missing", "envoy", 12, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signaled = nil
+			err := signalProcesses(procDir, tt.process, syscall.SIGHUP, tt.self, kill)
+			slices.Sort(signaled)
+			if (err != nil) != tt.wantErr || !slices.Equal(signaled, tt.want) {
+				t.Errorf("signalProcesses() = %v, %v, want %v, wantErr %v", signaled, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	eperm := func(int, syscall.Signal) error { return syscall.EPERM }
+	if err := signalProcesses(procDir, "nginx", syscall.SIGHUP, 12, eperm); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("signalProcesses() = %v, want EPERM", err)
+	}
+}
+
+// execServer is an API server answering exec requests with the given
+// messages.
+func execServer(t *testing.T, messages ...[]byte) (*httptest.Server, *http.Request) {
+	t.Helper()
+	var got http.Request
+	srv := httptest.NewTLSServer(websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			got = *req
+			config.Protocol = []string{execProtocol}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			for _, msg := range messages {
+				if err := websocket.Message.Send(ws, msg); err != nil {
+					t.Error(err)
+				}
+			}
+		},
+	})
+	t.Cleanup(srv.Close)
+	return srv, &got
+}
+
+func Test_execInContainer(t *testing.T) {
+	channel := func(n byte, s string) []byte { return append([]byte{n}, s...) }
+	tests := []struct {
+		name     string
+		messages [][]byte
+		wantErr  string
+	}{
+		{"success", [][]byte{
+			channel(1, ""), channel(2, ""), channel(3, ""),
+			channel(2, "nginx: signal process started\n"),
+			channel(3, `{"metadata":{},"status":"Success"}`),
+		}, ""},
+		{"failure", [][]byte{
+			channel(2, `nginx: [error] open() "/run/nginx.pid" failed`),
+			channel(3, `{"metadata":{},"status":"Failure","message":"command terminated with non-zero exit code: error executing command [nginx -s reload], exit code 1","reason":"NonZeroExitCode"}`),
+		}, `exit code 1: nginx: [error] open() "/run/nginx.pid" failed`},
+		{"closed", [][]byte{channel(1, "ok")}, "connection closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, req := execServer(t, tt.messages...)
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+			err = execInContainer(context.Background(), u, "sa-token", tlsConfig, "default", "app-7d9c5b7d4-8xkqz", "app", []string{"nginx", "-s", "reload"})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("execInContainer() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("execInContainer() error = %v, want %q", err, tt.wantErr)
+			}
+
+			if req.URL.Path != "/api/v1/namespaces/default/pods/app-7d9c5b7d4-8xkqz/exec" {
+				t.Errorf("path = %s", req.URL.Path)
+			}
+			q := req.URL.Query()
+			if !slices.Equal(q["command"], []string{"nginx", "-s", "reload"}) || q.Get("container") != "app" || q.Get("stdin") != "" {
+				t.Errorf("query = %v", q)
+			}
+			if got := req.Header.Get("Authorization"); got != "Bearer sa-token" {
+				t.Errorf("Authorization = %q", got)
+			}
+		})
+	}
+}
+
+func Test_renewalHook_notify(t *testing.T) {
+	var calls int
+	h := &renewalHook{
+		config: &Config{RenewalSignal: syscall.SIGHUP, RenewalProcess: "nginx"},
+		signal: func() error {
+			calls++
+			return errors.New("no process named nginx")
+		},
+	}
+	if got := h.String(); got != "SIGHUP nginx" {
+		t.Errorf("String() = %q", got)
+	}
+
+	crt := &x509.Certificate{}
+	results := []struct {
+		crt *x509.Certificate
+		err error
+	}{{crt, nil}, {nil, nil}, {nil, errors.New("connection refused")}}
+	for _, r := range results {
+		got, err := h.notify(func(context.Context) (*x509.Certificate, error) { return r.crt, r.err })(context.Background())
+		if got != r.crt || !errors.Is(err, r.err) {
+			t.Errorf("notify() = %v, %v, want %v, %v", got, err, r.crt, r.err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("signal called %d times, want once after the new certificate", calls)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/ca"
+)
+
+// startTime is used to compute the uptime of the renewer.
+var startTime = time.Now()
+
+// report is the body of a request to the controller /status endpoint.
+type report struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Status    Status `json:"status"`
+	Usage     *Usage `json:"usage,omitempty"`
+}
+
+// Usage is the resource usage of the renewer, used by the controller to
+// recommend the requests of the renewer sidecars.
+type Usage struct {
+	CPUSeconds    float64 `json:"cpuSeconds"`
+	MaxRSSBytes   int64   `json:"maxRSSBytes"`
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+}
+
+// currentUsage returns the resource usage of the renewer since it started,
+// or nil if it's not available.
+func currentUsage() *Usage {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return nil
+	}
+	cpu := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	return &Usage{
+		CPUSeconds: cpu.Seconds(),
+		// Maxrss is in kilobytes on Linux.
+		MaxRSSBytes:   ru.Maxrss * 1024,
+		UptimeSeconds: time.Since(startTime).Seconds(),
+	}
+}
+
+// sendReport reports the renewer status to the controller, which aggregates
+// the status of every renewer into per-namespace stats. The renewer
+// authenticates with its certificate. An empty url, used by controllers that
+// don't collect stats, disables reports.
+func sendReport(ctx context.Context, client *ca.Client, config *Config, status Status) error {
+	if config.StatusURL == "" {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "load certificate")
+	}
+	body, err := json.Marshal(report{
+		Namespace: config.Namespace,
+		Pod:       config.PodName,
+		Status:    status,
+		Usage:     currentUsage(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "encode report")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.StatusURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "create report request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := setServiceAccountToken(req, config); err != nil {
+		return err
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      client.GetRootCAs(),
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return errors.Wrap(err, "send report")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("send report: %s", resp.Status)
+	}
+	return nil
+}
+
+// setServiceAccountToken authenticates a request to the controller with the
+// service account token of the pod, if the controller requires it. The token
+// is read on every request, as the kubelet rotates it.
+func setServiceAccountToken(req *http.Request, config *Config) error {
+	if config.ServiceAccountToken == "" {
+		return nil
+	}
+	b, err := os.ReadFile(config.ServiceAccountToken) //nolint:gosec // file path comes from trusted configuration
+	if err != nil {
+		return errors.Wrap(err, "read service account token")
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(b)))
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/clock"
+)
+
+// shutdownTimeout bounds the work done once the renewer is stopped, like
+// reporting its state to the controller, so it exits well within the default
+// termination grace period of 30s of the pod.
+const shutdownTimeout = 5 * time.Second
+
+// scheduler runs the renewal loop. The clock and the calls to the CA and
+// the controller are injected, so the scheduling can be tested
+// deterministically.
+type scheduler struct {
+	config      *Config
+	clock       clock.Clock
+	renew       func(ctx context.Context) (*x509.Certificate, error)
+	checkFreeze func(ctx context.Context) (freeze, error)
+	report      func(ctx context.Context, status Status)
+	// reissue re-issues the certificate if the SANs requested by the pod
+	// changed, and returns nil if it's up to date. It's nil if the controller
+	// doesn't support re-issuance.
+	reissue func(ctx context.Context) (*x509.Certificate, error)
+	// snapshot is the last status written, for state dumps.
+	snapshot statusSnapshot
+}
+
+// run renews the certificate crt until the context is cancelled, recording
+// each scheduling decision in the status file.
+func (s *scheduler) run(ctx context.Context, crt *x509.Certificate) error {
+	status := &Status{}
+	status.setCertificate(crt)
+	status.Version = readVersion(filepath.Dir(s.config.CertFile))
+	status.NextAttempt = renewAt(crt)
+
+	// pending holds a renewed certificate that couldn't be written to a full
+	// or read-only volume, written again on the next attempt.
+	var pending *diskError
+
+	for {
+		switch {
+		case pending != nil:
+			status.State = StateUnwritable
+		case !status.FrozenUntil.IsZero():
+			status.State = StateFrozen
+		case status.ConsecutiveFailures > 0:
+			status.State = StateBackoff
+		default:
+			status.State = StateWaiting
+		}
+		s.save(status)
+		s.report(ctx, *status)
+
+		ctxLog := log.WithFields(log.Fields{
+			"nextAttempt": status.NextAttempt.Format(time.RFC3339),
+			"failures":    status.ConsecutiveFailures,
+		})
+		ctxLog.Info("Waiting for next renewal")
+
+		reissued, ok := s.wait(ctx, status)
+		if !ok {
+			s.stop(ctx, status)
+			return nil
+		}
+		if reissued != nil {
+			recordRenewal(s.config.CertFile, resultReissued)
+			status.LastSuccess = s.clock.Now()
+			status.setCertificate(reissued)
+			status.Version = readVersion(filepath.Dir(s.config.CertFile))
+			status.NextAttempt = renewAt(reissued)
+			log.WithFields(log.Fields{
+				"serial":   status.Serial,
+				"notAfter": status.NotAfter.Format(time.RFC3339),
+			}).Info("Re-issued certificate with new SANs")
+			s.markReady()
+			continue
+		}
+
+		if pending != nil {
+			status.LastAttempt = s.clock.Now()
+			written, err := pending.retry()
+			if err != nil {
+				pending = s.failed(status, err)
+				continue
+			}
+			pending = nil
+			s.renewed(status, written)
+			continue
+		}
+
+		if freeze, err := s.checkFreeze(ctx); ctx.Err() != nil {
+			s.stop(ctx, status)
+			return nil
+		} else if err != nil {
+			log.WithField("error", err).Warn("Error checking renewal freeze, renewing anyway")
+		} else if freeze.frozen(s.clock.Now()) {
+			status.FrozenUntil = freeze.Expires
+			status.NextAttempt = s.clock.Now().Add(freezeRetry)
+			if freeze.Expires.Before(status.NextAttempt) {
+				status.NextAttempt = freeze.Expires
+			}
+			log.WithFields(log.Fields{
+				"reason":  freeze.Reason,
+				"expires": freeze.Expires.Format(time.RFC3339),
+			}).Warn("Renewals are frozen, postponing renewal")
+			continue
+		}
+		status.FrozenUntil = time.Time{}
+
+		status.State = StateRenewing
+		status.LastAttempt = s.clock.Now()
+		s.save(status)
+
+		renewed, err := s.renew(ctx)
+		if err != nil && ctx.Err() != nil {
+			// The renewal was cancelled, it's not a failure.
+			s.stop(ctx, status)
+			return nil
+		}
+		if err != nil {
+			pending = s.failed(status, err)
+			continue
+		}
+		s.renewed(status, renewed)
+	}
+}
+
+// stop records that the renewer stopped in the status file, and reports it
+// so the controller forgets this renewer right away, instead of when its
+// certificate expires. The context is cancelled, the report gets
+// shutdownTimeout.
+func (s *scheduler) stop(ctx context.Context, status *Status) {
+	status.State = StateStopped
+	s.save(status)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+	s.report(ctx, *status)
+	log.Info("Renewer stopped")
+}
+
+// save writes the status file, and keeps the status for state dumps.
+func (s *scheduler) save(status *Status) {
+	s.snapshot.store(*status)
+	if err := status.write(s.config.StatusFile); err != nil {
+		log.WithField("error", err).Warn("Error writing renewal status")
+	}
+}
+
+// failed records a failed renewal attempt, and schedules the next one after
+// a backoff. It returns the renewed certificate to write on the next attempt
+// if the failure is a disk error.
+func (s *scheduler) failed(status *Status, err error) *diskError {
+	recordRenewal(s.config.CertFile, resultFailure)
+	status.ConsecutiveFailures++
+	status.LastError = err.Error()
+	d := backoff(status.ConsecutiveFailures)
+	status.Backoff = d.String()
+	status.NextAttempt = s.clock.Now().Add(d)
+	ctxLog := log.WithFields(log.Fields{
+		"error":    err,
+		"failures": status.ConsecutiveFailures,
+		"backoff":  status.Backoff,
+	})
+
+	var de *diskError
+	if errors.As(err, &de) {
+		ctxLog.Error("Error writing renewed certificate, keeping the previous one")
+		return de
+	}
+	ctxLog.Error("Error renewing certificate")
+	return nil
+}
+
+// renewed records a successful renewal, and schedules the next one.
+func (s *scheduler) renewed(status *Status, crt *x509.Certificate) {
+	recordRenewal(s.config.CertFile, resultSuccess)
+	status.ConsecutiveFailures = 0
+	status.LastError = ""
+	status.Backoff = ""
+	status.LastSuccess = s.clock.Now()
+	status.setCertificate(crt)
+	status.Version = readVersion(filepath.Dir(s.config.CertFile))
+	status.NextAttempt = renewAt(crt)
+	log.WithFields(log.Fields{
+		"serial":   status.Serial,
+		"notAfter": status.NotAfter.Format(time.RFC3339),
+	}).Info("Renewed certificate")
+	s.markReady()
+}
+
+// markReady updates the readiness file, if any, after the certificate
+// changed. It's written here when the certificate couldn't be confirmed at
+// startup, for instance because it had expired.
+func (s *scheduler) markReady() {
+	if s.config.ReadyFile == "" {
+		return
+	}
+	if err := markReady(s.config, s.clock.Now()); err != nil {
+		log.WithField("error", err).Warn("Error writing readiness file")
+	}
+}
+
+// wait blocks until the next renewal attempt is due, and returns false if the
+// context is cancelled first. While waiting for a scheduled renewal, it
+// periodically asks the controller whether the certificate must be re-issued
+// with new SANs, and returns early with the re-issued certificate.
+func (s *scheduler) wait(ctx context.Context, status *Status) (*x509.Certificate, bool) {
+	for {
+		d := status.NextAttempt.Sub(s.clock.Now())
+		check := s.reissue != nil && status.State == StateWaiting && d > reissueInterval
+		if check {
+			d = reissueInterval
+		}
+
+		timer := s.clock.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, false
+		case <-timer.C():
+		}
+		if !check {
+			return nil, true
+		}
+
+		reissued, err := s.reissue(ctx)
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		if err != nil {
+			log.WithField("error", err).Warn("Error re-issuing certificate with new SANs")
+			continue
+		}
+		if reissued != nil {
+			return reissued, true
+		}
+	}
+}
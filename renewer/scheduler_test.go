@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/smallstep/autocert/pkg/clock/clocktest"
+)
+
+func readStatus(t *testing.T, filename string) Status {
+	t.Helper()
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s Status
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScheduler(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	fake := clocktest.NewFake(start)
+	dir := t.TempDir()
+	config := &Config{
+		CertFile:   filepath.Join(dir, "site.crt"),
+		StatusFile: filepath.Join(dir, statusFileName),
+	}
+	crt := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    start,
+		NotAfter:     start.Add(24 * time.Hour),
+	}
+
+	// Each call to renew or checkFreeze consumes the next scripted result.
+	var renewals []error
+	var freezes []freeze
+	var reports []string
+	s := &scheduler{
+		config: config,
+		clock:  fake,
+		renew: func(context.Context) (*x509.Certificate, error) {
+			err := renewals[0]
+			renewals = renewals[1:]
+			if err != nil {
+				return nil, err
+			}
+			now := fake.Now()
+			return &x509.Certificate{SerialNumber: big.NewInt(2), NotBefore: now, NotAfter: now.Add(24 * time.Hour)}, nil
+		},
+		checkFreeze: func(context.Context) (freeze, error) {
+			if len(freezes) == 0 {
+				return freeze{}, nil
+			}
+			f := freezes[0]
+			freezes = freezes[1:]
+			return f, nil
+		},
+		report: func(_ context.Context, status Status) {
+			reports = append(reports, status.State)
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.run(ctx, crt) }()
+
+	// expect waits for the scheduler to wait for its next attempt, and
+	// checks the status it reported.
+	expect := func(state string, next time.Time, failures int) {
+		t.Helper()
+		fake.BlockUntil(1)
+		status := readStatus(t, config.StatusFile)
+		if status.State != state || !status.NextAttempt.Equal(next) || status.ConsecutiveFailures != failures {
+			t.Fatalf("status = %s next %v failures %d, want %s next %v failures %d",
+				status.State, status.NextAttempt, status.ConsecutiveFailures, state, next, failures)
+		}
+	}
+
+	// Renews after two thirds of the lifetime.
+	renewAtTime := start.Add(16 * time.Hour)
+	expect(StateWaiting, renewAtTime, 0)
+
+	// Failures back off exponentially.
+	renewals = []error{errors.New("connection refused"), errors.New("connection refused"), nil}
+	fake.AdvanceTo(renewAtTime)
+	expect(StateBackoff, renewAtTime.Add(10*time.Second), 1)
+	fake.Advance(10 * time.Second)
+	expect(StateBackoff, renewAtTime.Add(30*time.Second), 2)
+
+	// A success resets the backoff and schedules the next renewal.
+	fake.Advance(20 * time.Second)
+	renewedAt := renewAtTime.Add(30 * time.Second)
+	expect(StateWaiting, renewedAt.Add(16*time.Hour), 0)
+	if status := readStatus(t, config.StatusFile); status.Serial != "2" || !status.LastSuccess.Equal(renewedAt) {
+		t.Errorf("status = %+v, want serial 2 renewed at %v", status, renewedAt)
+	}
+
+	// A freeze postpones the renewal until it's lifted.
+	frozenAt := renewedAt.Add(16 * time.Hour)
+	freezes = []freeze{{Renewal: true, Expires: frozenAt.Add(30 * time.Second)}}
+	fake.AdvanceTo(frozenAt)
+	expect(StateFrozen, frozenAt.Add(30*time.Second), 0)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("run() error = %v", err)
+	}
+
+	// Every state change is reported to the controller.
+	want := []string{StateWaiting, StateBackoff, StateBackoff, StateWaiting, StateFrozen, StateStopped}
+	if !slices.Equal(reports, want) {
+		t.Errorf("reports = %v, want %v", reports, want)
+	}
+}
+
+func TestSchedulerReissue(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	fake := clocktest.NewFake(start)
+	dir := t.TempDir()
+	config := &Config{
+		CertFile:   filepath.Join(dir, "site.crt"),
+		StatusFile: filepath.Join(dir, statusFileName),
+	}
+	crt := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    start,
+		NotAfter:     start.Add(24 * time.Hour),
+	}
+
+	// The certificate is up to date on the first check, the second check
+	// fails, and the third one re-issues it.
+	var calls int
+	var reports []string
+	s := &scheduler{
+		config: config,
+		clock:  fake,
+		renew: func(context.Context) (*x509.Certificate, error) {
+			t.Error("unexpected renewal")
+			return nil, errors.New("unexpected renewal")
+		},
+		checkFreeze: func(context.Context) (freeze, error) {
+			return freeze{}, nil
+		},
+		report: func(_ context.Context, status Status) {
+			reports = append(reports, status.State)
+		},
+		reissue: func(context.Context) (*x509.Certificate, error) {
+			calls++
+			switch calls {
+			case 1:
+				return nil, nil
+			case 2:
+				return nil, errors.New("connection refused")
+			default:
+				now := fake.Now()
+				return &x509.Certificate{
+					SerialNumber: big.NewInt(2),
+					NotBefore:    now,
+					NotAfter:     now.Add(24 * time.Hour),
+				}, nil
+			}
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.run(ctx, crt) }()
+
+	// Checks are done every reissueInterval while waiting for the renewal.
+	fake.BlockUntil(1)
+	fake.Advance(reissueInterval)
+	fake.BlockUntil(1)
+	fake.Advance(reissueInterval)
+	fake.BlockUntil(1)
+	if status := readStatus(t, config.StatusFile); calls != 2 || status.Serial != "1" {
+		t.Fatalf("calls = %d serial %s, want 2 calls serial 1", calls, status.Serial)
+	}
+
+	// A re-issued certificate replaces the current one and reschedules the
+	// renewal.
+	fake.Advance(reissueInterval)
+	fake.BlockUntil(1)
+	reissuedAt := start.Add(3 * reissueInterval)
+	status := readStatus(t, config.StatusFile)
+	if status.State != StateWaiting || status.Serial != "2" || !status.NextAttempt.Equal(reissuedAt.Add(16*time.Hour)) {
+		t.Errorf("status = %+v, want serial 2 waiting until %v", status, reissuedAt.Add(16*time.Hour))
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("run() error = %v", err)
+	}
+
+	// Checks don't report the status again unless the certificate changes.
+	want := []string{StateWaiting, StateWaiting, StateStopped}
+	if !slices.Equal(reports, want) {
+		t.Errorf("reports = %v, want %v", reports, want)
+	}
+}
+
+func TestSchedulerStopDuringRenewal(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	fake := clocktest.NewFake(start)
+	dir := t.TempDir()
+	config := &Config{
+		CertFile:   filepath.Join(dir, "site.crt"),
+		StatusFile: filepath.Join(dir, statusFileName),
+	}
+	crt := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    start,
+		NotAfter:     start.Add(24 * time.Hour),
+	}
+
+	// renew blocks like a request to an unresponsive CA, until the context
+	// is cancelled.
+	renewing := make(chan struct{})
+	var reports []string
+	var deadline bool
+	s := &scheduler{
+		config: config,
+		clock:  fake,
+		renew: func(ctx context.Context) (*x509.Certificate, error) {
+			close(renewing)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		checkFreeze: func(context.Context) (freeze, error) { return freeze{}, nil },
+		report: func(ctx context.Context, status Status) {
+			reports = append(reports, status.State)
+			_, deadline = ctx.Deadline()
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.run(ctx, crt) }()
+
+	fake.BlockUntil(1)
+	fake.AdvanceTo(start.Add(16 * time.Hour))
+	<-renewing
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("run() error = %v", err)
+	}
+
+	// The cancelled renewal is not a failure, and the stopped state is
+	// written and reported with a deadline.
+	status := readStatus(t, config.StatusFile)
+	if status.State != StateStopped || status.ConsecutiveFailures != 0 || status.LastError != "" {
+		t.Errorf("status = %+v, want stopped without failures", status)
+	}
+	if want := []string{StateWaiting, StateStopped}; !slices.Equal(reports, want) {
+		t.Errorf("reports = %v, want %v", reports, want)
+	}
+	if !deadline {
+		t.Error("stopped state reported without a deadline")
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// sdsServiceName is the gRPC service of the Envoy Secret Discovery
+	// Service.
+	sdsServiceName = "envoy.service.secret.v3.SecretDiscoveryService"
+	// sdsSecretType is the type URL of the secrets served by SDS.
+	sdsSecretType = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret"
+	// sdsRootName is the name of the secret holding the roots, the one Istio
+	// uses. Any other name gets the certificate and key.
+	sdsRootName = "ROOTCA"
+	// sdsDefaultName is the name of the certificate sent to clients
+	// requesting every secret.
+	sdsDefaultName = "default"
+)
+
+// sdsServer serves the certificate, key and roots to Envoy and gRPC xDS
+// clients with the Secret Discovery Service, on a Unix socket in the
+// certificates volume. Streams get the new secrets every time update is
+// called.
+//
+// Only the few fields of the SDS messages needed to serve TLS secrets are
+// encoded, with protowire, to keep the Envoy API out of the renewer.
+type sdsServer struct {
+	config *Config
+
+	mu sync.Mutex
+	// changed is closed and replaced on every update.
+	changed chan struct{}
+}
+
+func newSDSServer(config *Config) *sdsServer {
+	return &sdsServer{config: config, changed: make(chan struct{})}
+}
+
+// sdsService is the handler type of the SDS service description.
+type sdsService interface {
+	streamSecrets(stream grpc.ServerStream) error
+}
+
+var sdsServiceDesc = grpc.ServiceDesc{
+	ServiceName: sdsServiceName,
+	HandlerType: (*sdsService)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "FetchSecrets",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+			req := new(discoveryRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			return srv.(*sdsServer).fetchSecrets(req)
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName: "StreamSecrets",
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			return srv.(*sdsServer).streamSecrets(stream)
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}, {
+		StreamName: "DeltaSecrets",
+		Handler: func(any, grpc.ServerStream) error {
+			return status.Error(codes.Unimplemented, "incremental SDS is not supported, use StreamSecrets")
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+}
+
+// serve listens on the socket until the context is done. The socket gets the
+// mode and owner of the key, so whoever can read the key can connect.
+func (s *sdsServer) serve(ctx context.Context, socket string) error {
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove SDS socket")
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return errors.Wrap(err, "listen on SDS socket")
+	}
+	if fi, err := os.Stat(s.config.KeyFile); err == nil {
+		if err := os.Chmod(socket, fi.Mode().Perm()); err != nil {
+			log.WithField("error", err).Warn("Error setting the mode of the SDS socket")
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if err := os.Chown(socket, int(st.Uid), int(st.Gid)); err != nil {
+				log.WithField("error", err).Warn("Error setting the owner of the SDS socket")
+			}
+		}
+	}
+
+	srv := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+	srv.RegisterService(&sdsServiceDesc, s)
+	go func() {
+		<-ctx.Done()
+		srv.Stop()
+	}()
+	log.WithField("socket", socket).Info("Serving secrets with SDS")
+	if err := srv.Serve(l); err != nil && ctx.Err() == nil {
+		return errors.Wrap(err, "serve SDS")
+	}
+	return nil
+}
+
+// update pushes the current secrets to the open streams. It's called after
+// every renewal.
+func (s *sdsServer) update() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// notify returns a function calling fn, and update after it succeeds.
+func (s *sdsServer) notify(fn func(context.Context) (*x509.Certificate, error)) func(context.Context) (*x509.Certificate, error) {
+	return func(ctx context.Context) (*x509.Certificate, error) {
+		crt, err := fn(ctx)
+		if err == nil {
+			s.update()
+		}
+		return crt, err
+	}
+}
+
+// watch returns a channel closed on the next update.
+func (s *sdsServer) watch() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+func (s *sdsServer) fetchSecrets(req *discoveryRequest) (*discoveryResponse, error) {
+	if err := checkSecretType(req); err != nil {
+		return nil, err
+	}
+	resp, err := s.response(req.ResourceNames, "")
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return resp, nil
+}
+
+// streamSecrets sends the requested secrets on every request changing the
+// requested names, and on every update. Acknowledgements are not answered,
+// and rejections are logged.
+func (s *sdsServer) streamSecrets(stream grpc.ServerStream) error {
+	requests := make(chan *discoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req := new(discoveryRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	var names []string
+	var sent int
+	changed := s.watch()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case err := <-errs:
+			if status.Code(err) == codes.Canceled || errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		case req := <-requests:
+			if err := checkSecretType(req); err != nil {
+				return err
+			}
+			if req.ErrorDetail != "" {
+				log.WithFields(log.Fields{
+					"node":    req.NodeID,
+					"version": req.VersionInfo,
+					"error":   req.ErrorDetail,
+				}).Warn("SDS client rejected the secrets")
+			}
+			if sent > 0 && slices.Equal(names, req.ResourceNames) {
+				continue
+			}
+			names = slices.Clone(req.ResourceNames)
+		case <-changed:
+			changed = s.watch()
+			if sent == 0 {
+				continue
+			}
+		}
+		sent++
+		resp, err := s.response(names, strconv.Itoa(sent))
+		if err != nil {
+			log.WithField("error", err).Warn("Error reading the secrets served by SDS")
+			continue
+		}
+		if err := stream.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// checkSecretType returns an error if a request is not for TLS secrets.
+// Clients may omit the type on stream requests after the first one.
+func checkSecretType(req *discoveryRequest) error {
+	if req.TypeURL != "" && req.TypeURL != sdsSecretType {
+		return status.Errorf(codes.InvalidArgument, "unsupported type %s, use %s", req.TypeURL, sdsSecretType)
+	}
+	return nil
+}
+
+// response returns the requested secrets, read from the files. A request
+// without names gets the default certificate and the roots.
+func (s *sdsServer) response(names []string, nonce string) (*discoveryResponse, error) {
+	crt, err := os.ReadFile(s.config.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := os.ReadFile(s.config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := os.ReadFile(s.config.RootFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		names = []string{sdsDefaultName, sdsRootName}
+	}
+
+	h := sha256.New()
+	resp := &discoveryResponse{TypeURL: sdsSecretType, Nonce: nonce}
+	for _, name := range names {
+		var secret []byte
+		if name == sdsRootName {
+			secret = validationContextSecret(name, roots)
+		} else {
+			secret = tlsCertificateSecret(name, crt, key)
+		}
+		h.Write(secret)
+		resp.Resources = append(resp.Resources, secret)
+	}
+	resp.VersionInfo = hex.EncodeToString(h.Sum(nil))[:16]
+	return resp, nil
+}
+
+// wireMessage is a message encoded with protowire.
+type wireMessage interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+// wireCodec encodes the wireMessages of the SDS service.
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("unsupported message %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (wireCodec) Unmarshal(b []byte, v any) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("unsupported message %T", v)
+	}
+	return m.unmarshal(b)
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
+
+// discoveryRequest holds the fields of an
+// envoy.service.discovery.v3.DiscoveryRequest used by the server.
+type discoveryRequest struct {
+	VersionInfo   string
+	NodeID        string
+	ResourceNames []string
+	TypeURL       string
+	ResponseNonce string
+	// ErrorDetail is the message of the error of a rejection.
+	ErrorDetail string
+}
+
+func (r *discoveryRequest) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, r.VersionInfo)
+	if r.NodeID != "" {
+		b = appendMessage(b, 2, appendString(nil, 1, r.NodeID))
+	}
+	for _, name := range r.ResourceNames {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, name)
+	}
+	b = appendString(b, 4, r.TypeURL)
+	b = appendString(b, 5, r.ResponseNonce)
+	if r.ErrorDetail != "" {
+		b = appendMessage(b, 6, appendString(nil, 2, r.ErrorDetail))
+	}
+	return b
+}
+
+func (r *discoveryRequest) unmarshal(b []byte) error {
+	*r = discoveryRequest{}
+	return parseMessage(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1:
+			r.VersionInfo = string(v)
+		case 2:
+			return parseMessage(v, func(num protowire.Number, v []byte) error {
+				if num == 1 {
+					r.NodeID = string(v)
+				}
+				return nil
+			})
+		case 3:
+			r.ResourceNames = append(r.ResourceNames, string(v))
+		case 4:
+			r.TypeURL = string(v)
+		case 5:
+			r.ResponseNonce = string(v)
+		case 6:
+			return parseMessage(v, func(num protowire.Number, v []byte) error {
+				if num == 2 {
+					r.ErrorDetail = string(v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// discoveryResponse holds the fields of an
+// envoy.service.discovery.v3.DiscoveryResponse set by the server.
+type discoveryResponse struct {
+	VersionInfo string
+	// Resources are encoded secrets, of type TypeURL.
+	Resources [][]byte
+	TypeURL   string
+	Nonce     string
+}
+
+func (r *discoveryResponse) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, r.VersionInfo)
+	for _, res := range r.Resources {
+		// google.protobuf.Any
+		any := appendString(nil, 1, r.TypeURL)
+		any = protowire.AppendTag(any, 2, protowire.BytesType)
+		any = protowire.AppendBytes(any, res)
+		b = appendMessage(b, 2, any)
+	}
+	b = appendString(b, 4, r.TypeURL)
+	b = appendString(b, 5, r.Nonce)
+	return b
+}
+
+func (r *discoveryResponse) unmarshal(b []byte) error {
+	*r = discoveryResponse{}
+	return parseMessage(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1:
+			r.VersionInfo = string(v)
+		case 2:
+			return parseMessage(v, func(num protowire.Number, v []byte) error {
+				if num == 2 {
+					r.Resources = append(r.Resources, v)
+				}
+				return nil
+			})
+		case 4:
+			r.TypeURL = string(v)
+		case 5:
+			r.Nonce = string(v)
+		}
+		return nil
+	})
+}
+
+// tlsCertificateSecret returns an envoy.extensions.transport_sockets.tls.v3.Secret
+// with a TlsCertificate holding the inline certificate chain and key.
+func tlsCertificateSecret(name string, chain, key []byte) []byte {
+	var tlsCertificate []byte
+	tlsCertificate = appendMessage(tlsCertificate, 1, inlineBytes(chain))
+	tlsCertificate = appendMessage(tlsCertificate, 2, inlineBytes(key))
+	return appendMessage(appendString(nil, 1, name), 2, tlsCertificate)
+}
+
+// validationContextSecret returns an
+// envoy.extensions.transport_sockets.tls.v3.Secret with a
+// CertificateValidationContext trusting the inline roots.
+func validationContextSecret(name string, roots []byte) []byte {
+	validationContext := appendMessage(nil, 1, inlineBytes(roots))
+	return appendMessage(appendString(nil, 1, name), 4, validationContext)
+}
+
+// inlineBytes returns an envoy.config.core.v3.DataSource with inline bytes.
+func inlineBytes(b []byte) []byte {
+	return protowire.AppendBytes(protowire.AppendTag(nil, 2, protowire.BytesType), b)
+}
+
+// appendString appends a string field, unless it's empty.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendMessage appends an encoded message field.
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// parseMessage calls fn with every length-delimited field of an encoded
+// message. Other fields are skipped.
+func parseMessage(b []byte, fn func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func writeSDSFiles(t *testing.T, config *Config, crt, key, roots string) {
+	t.Helper()
+	for file, data := range map[string]string{config.CertFile: crt, config.KeyFile: key, config.RootFile: roots} {
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sdsSecret is a decoded secret of a discoveryResponse.
+type sdsSecret struct {
+	name, chain, key, roots string
+}
+
+func decodeSecret(t *testing.T, b []byte) sdsSecret {
+	t.Helper()
+	var s sdsSecret
+	// dataSource returns the inline bytes of the DataSource field num.
+	dataSource := func(b []byte, num protowire.Number) (v string) {
+		_ = parseMessage(b, func(n protowire.Number, b []byte) error {
+			if n == num {
+				_ = parseMessage(b, func(n protowire.Number, b []byte) error {
+					if n == 2 {
+						v = string(b)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		return v
+	}
+	err := parseMessage(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1:
+			s.name = string(v)
+		case 2:
+			s.chain, s.key = dataSource(v, 1), dataSource(v, 2)
+		case 4:
+			s.roots = dataSource(v, 1)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSDSResponse(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		CertFile: filepath.Join(dir, "site.crt"),
+		KeyFile:  filepath.Join(dir, "site.key"),
+		RootFile: filepath.Join(dir, "root.crt"),
+	}
+	writeSDSFiles(t, config, "chain", "key", "roots")
+	s := newSDSServer(config)
+
+	tests := []struct {
+		name  string
+		names []string
+		want  []sdsSecret
+	}{
+		{"all", nil, []sdsSecret{{name: "default", chain: "chain", key: "key"}, {name: "ROOTCA", roots: "roots"}}},
+		{"certificate", []string{"server"}, []sdsSecret{{name: "server", chain: "chain", key: "key"}}},
+		{"roots", []string{"ROOTCA"}, []sdsSecret{{name: "ROOTCA", roots: "roots"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.response(tt.names, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.TypeURL != sdsSecretType || resp.Nonce != "1" || resp.VersionInfo == "" {
+				t.Errorf("response = %+v", resp)
+			}
+			var got []sdsSecret
+			for _, r := range resp.Resources {
+				got = append(got, decodeSecret(t, r))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("secrets = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// The version changes with the files.
+	before, _ := s.response(nil, "")
+	writeSDSFiles(t, config, "new chain", "new key", "roots")
+	after, _ := s.response(nil, "")
+	if before.VersionInfo == after.VersionInfo {
+		t.Errorf("version %s didn't change with the certificate", after.VersionInfo)
+	}
+}
+
+func TestDiscoveryRequestRoundTrip(t *testing.T) {
+	want := discoveryRequest{
+		VersionInfo:   "v1",
+		NodeID:        "sidecar~10.0.0.1~app",
+		ResourceNames: []string{"default", "ROOTCA"},
+		TypeURL:       sdsSecretType,
+		ResponseNonce: "2",
+		ErrorDetail:   "bad certificate",
+	}
+	var got discoveryRequest
+	if err := got.unmarshal(want.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("request = %+v, want %+v", got, want)
+	}
+
+	if err := got.unmarshal([]byte{0x0a, 0x05, 'a'}); err == nil {
+		t.Error("unmarshal of a truncated message succeeded")
+	}
+}
+
+func TestSDSNotify(t *testing.T) {
+	s := newSDSServer(&Config{})
+	changed := s.watch()
+	fail := s.notify(func(context.Context) (*x509.Certificate, error) {
+		return nil, errors.New("renewal failed")
+	})
+	if _, err := fail(context.Background()); err == nil {
+		t.Fatal("error not returned")
+	}
+	select {
+	case <-changed:
+		t.Fatal("failed renewal pushed secrets")
+	default:
+	}
+	ok := s.notify(func(context.Context) (*x509.Certificate, error) {
+		return &x509.Certificate{}, nil
+	})
+	if _, err := ok(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fatal("renewal didn't push secrets")
+	}
+}
+
+func TestSDSServe(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		CertFile: filepath.Join(dir, "site.crt"),
+		KeyFile:  filepath.Join(dir, "site.key"),
+		RootFile: filepath.Join(dir, "root.crt"),
+	}
+	writeSDSFiles(t, config, "chain", "key", "roots")
+	socket := filepath.Join(dir, "sds.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newSDSServer(config)
+	served := make(chan error, 1)
+	go func() { served <- s.serve(ctx, socket) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn, err := grpc.NewClient("unix://"+socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(wireCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	callCtx, callCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer callCancel()
+
+	// FetchSecrets
+	resp := new(discoveryResponse)
+	req := &discoveryRequest{ResourceNames: []string{"ROOTCA"}, TypeURL: sdsSecretType}
+	if err := conn.Invoke(callCtx, "/"+sdsServiceName+"/FetchSecrets", req, resp, grpc.WaitForReady(true)); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Resources) != 1 || decodeSecret(t, resp.Resources[0]).roots != "roots" {
+		t.Fatalf("FetchSecrets = %+v", resp)
+	}
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode = %v, %v, want the mode of the key", fi.Mode(), err)
+	}
+
+	// StreamSecrets
+	stream, err := conn.NewStream(callCtx, &sdsServiceDesc.Streams[0], "/"+sdsServiceName+"/StreamSecrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func() *discoveryResponse {
+		t.Helper()
+		resp := new(discoveryResponse)
+		if err := stream.RecvMsg(resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if err := stream.SendMsg(&discoveryRequest{ResourceNames: []string{"default"}, TypeURL: sdsSecretType}); err != nil {
+		t.Fatal(err)
+	}
+	first := recv()
+	if got := decodeSecret(t, first.Resources[0]); got.chain != "chain" || first.Nonce != "1" {
+		t.Fatalf("first response = %+v, secret %+v", first, got)
+	}
+	// The acknowledgement gets no response, the renewal gets the new
+	// certificate.
+	if err := stream.SendMsg(&discoveryRequest{
+		VersionInfo:   first.VersionInfo,
+		ResourceNames: []string{"default"},
+		ResponseNonce: first.Nonce,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writeSDSFiles(t, config, "renewed chain", "renewed key", "roots")
+	s.update()
+	second := recv()
+	got := decodeSecret(t, second.Resources[0])
+	if got.chain != "renewed chain" || got.key != "renewed key" || second.Nonce != "2" {
+		t.Errorf("pushed response = %+v, secret %+v", second, got)
+	}
+	if second.VersionInfo == first.VersionInfo {
+		t.Error("version didn't change")
+	}
+}
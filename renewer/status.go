@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Renewer states reported in the status file.
+const (
+	StateWaiting  = "waiting"
+	StateRenewing = "renewing"
+	StateBackoff  = "backoff"
+	StateFrozen   = "frozen"
+	// StateStopped is only reported to the controller, when the renewer
+	// shuts down.
+	StateStopped = "stopped"
+	// StateCritical is reported when the watchdog finds the certificate
+	// stale, before the renewer exits.
+	StateCritical = "critical"
+	// StateUnwritable is reported when a renewed certificate can't be written
+	// because the volume is full or read-only. The previous certificate is
+	// kept, and the write is retried with a backoff.
+	StateUnwritable = "unwritable"
+	// StateExternal is reported by verify-only renewers, watching a
+	// certificate issued outside of autocert.
+	StateExternal = "external"
+	// StateExpiring is reported by verify-only renewers once the certificate
+	// is in its critical window.
+	StateExpiring = "expiring"
+)
+
+// Status is the renewer scheduling state written to the status file. It lets
+// probes and operators answer "why hasn't this certificate renewed" without
+// reading the renewer logs.
+type Status struct {
+	State               string    `json:"state"`
+	Serial              string    `json:"serial"`
+	NotAfter            time.Time `json:"notAfter"`
+	Version             int       `json:"version"`
+	NextAttempt         time.Time `json:"nextAttempt"`
+	LastAttempt         time.Time `json:"lastAttempt,omitzero"`
+	LastSuccess         time.Time `json:"lastSuccess,omitzero"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	Backoff             string    `json:"backoff,omitempty"`
+	FrozenUntil         time.Time `json:"frozenUntil,omitzero"`
+	LastError           string    `json:"lastError,omitempty"`
+}
+
+func (s *Status) setCertificate(crt *x509.Certificate) {
+	s.Serial = crt.SerialNumber.String()
+	s.NotAfter = crt.NotAfter
+}
+
+// write atomically replaces the status file with the current state.
+func (s *Status) write(filename string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(b, '\n'))
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it over filename, so readers never observe a partial write. The
+// mode and ownership of an existing file are preserved; new files are created
+// with mode 0644.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := stageFile(filename, data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp) //nolint:errcheck // the rename error is more relevant
+		return err
+	}
+	return nil
+}
+
+// stageFile writes data to a temporary file in the same directory as
+// filename, with the mode and ownership of filename, and returns its name.
+// The temporary file is removed on errors, so a full volume never leaves an
+// empty or truncated file behind, and empty data is refused.
+func stageFile(filename string, data []byte) (tmp string, err error) {
+	if len(data) == 0 {
+		return "", errors.Errorf("refusing to write an empty %s", filename)
+	}
+
+	mode := os.FileMode(0o644)
+	uid, gid := -1, -1
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return "", err
+	}
+	tmp = f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp) //nolint:errcheck // nothing else to do on a full volume
+		}
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close() //nolint:errcheck // the write error is more relevant
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close() //nolint:errcheck // the sync error is more relevant
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return "", err
+	}
+	if uid >= 0 {
+		if err := os.Chown(tmp, uid, gid); err != nil {
+			return "", err
+		}
+	}
+	return tmp, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/certificates/ca"
+)
+
+const (
+	// trustBundleInterval is how often the roots of the pod are refreshed.
+	trustBundleInterval = 5 * time.Minute
+	// maxTrustBundleSize bounds the bundle served by the controller.
+	maxTrustBundleSize = 1 << 20
+)
+
+// errBundleRejected is returned for bundles that would not trust the
+// current certificate of the pod.
+var errBundleRejected = errors.New("trust bundle rejected")
+
+var trustBundleUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "autocert_renewer_trust_bundle_updates_total",
+	Help: "Number of refreshes of the roots of the pod that changed them or failed, by result.",
+}, []string{"result"})
+
+func init() {
+	metricsRegistry.MustRegister(trustBundleUpdates)
+}
+
+// trustBundle keeps the roots of the pod in sync with the trust bundle of
+// the controller, so a new root is trusted before the CA signs with it.
+type trustBundle struct {
+	config *Config
+	// fetch returns the PEM encoded roots of the bundle.
+	fetch func(ctx context.Context) ([]byte, error)
+	// updated is called after the roots changed.
+	updated func(ctx context.Context)
+}
+
+// run refreshes the roots every interval until the context is canceled.
+func (t *trustBundle) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		changed, err := t.refresh(ctx)
+		switch {
+		case errors.Is(err, errBundleRejected):
+			trustBundleUpdates.WithLabelValues("rejected").Inc()
+			log.WithField("error", err).Warn("Trust bundle rejected, keeping the current roots")
+		case err != nil:
+			trustBundleUpdates.WithLabelValues("error").Inc()
+			log.WithField("error", err).Warn("Error refreshing the trust bundle")
+		case changed:
+			trustBundleUpdates.WithLabelValues("updated").Inc()
+			log.WithField("rootFile", t.config.RootFile).Info("Updated the roots from the trust bundle")
+			t.updated(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh replaces the root file with the roots of the bundle, and returns
+// whether they changed. Bundles not trusting the current certificate are
+// rejected: the roots being rotated out must stay in the bundle until the
+// pods have certificates from the new ones.
+func (t *trustBundle) refresh(ctx context.Context) (bool, error) {
+	b, err := t.fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+	roots, err := parseRoots(b)
+	if err != nil {
+		return false, err
+	}
+	var data []byte
+	for _, root := range roots {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})...)
+	}
+	if current, err := os.ReadFile(t.config.RootFile); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	if err := verifyChain(t.config.CertFile, roots); err != nil {
+		return false, errors.Wrapf(errBundleRejected, "%v", err)
+	}
+
+	dir := filepath.Dir(t.config.CertFile)
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return false, errors.Wrap(err, "lock certificates directory")
+	}
+	defer unlock()
+	if err := writeFileAtomic(t.config.RootFile, data); err != nil {
+		return false, errors.Wrap(err, "write roots")
+	}
+	if err := writeKeystores(t.config); err != nil {
+		return true, err
+	}
+	if _, err := bumpVersion(dir); err != nil {
+		return true, errors.Wrap(err, "write version")
+	}
+	return true, nil
+}
+
+// parseRoots returns the CA certificates of a PEM bundle, or an error if it
+// holds anything else or nothing.
+func parseRoots(b []byte) ([]*x509.Certificate, error) {
+	var roots []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, errors.Errorf("trust bundle holds a %s", block.Type)
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse trust bundle")
+		}
+		if !crt.IsCA {
+			return nil, errors.Errorf("trust bundle holds %s, which is not a CA", crt.Subject)
+		}
+		roots = append(roots, crt)
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("trust bundle is empty")
+	}
+	return roots, nil
+}
+
+// verifyChain returns an error if the chain in certFile is not trusted by
+// roots.
+func verifyChain(certFile string, roots []*x509.Certificate) error {
+	b, err := os.ReadFile(certFile) //nolint:gosec // file path comes from trusted configuration
+	if err != nil {
+		return err
+	}
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, crt)
+	}
+	if len(chain) == 0 {
+		return errors.Errorf("%s does not contain a PEM certificate", certFile)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		// Only the roots are checked, an expiring certificate is the
+		// scheduler's business.
+		CurrentTime: chain[0].NotBefore.Add(time.Second),
+	}
+	for _, root := range roots {
+		opts.Roots.AddCert(root)
+	}
+	for _, crt := range chain[1:] {
+		opts.Intermediates.AddCert(crt)
+	}
+	_, err = chain[0].Verify(opts)
+	return err
+}
+
+// fetchTrustBundle gets the roots of the trust bundle from the controller.
+func fetchTrustBundle(ctx context.Context, client *ca.Client, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "create trust bundle request")
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    client.GetRootCAs(),
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "get trust bundle")
+	}
+	defer resp.Body.Close() //nolint:errcheck // close errors are unactionable in defer
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("get trust bundle: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxTrustBundleSize))
+}
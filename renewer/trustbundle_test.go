@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_trustBundle_refresh(t *testing.T) {
+	newRoot := func(name string) (*x509.Certificate, []byte) {
+		key := mustKey(t)
+		root := mustCertificate(t, &x509.Certificate{
+			Subject:               pkix.Name{CommonName: name},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}, nil, key.Public(), key)
+		return root, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+	}
+	rootKey := mustKey(t)
+	root := mustCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Root CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, rootKey.Public(), rootKey)
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+	leafKey := mustKey(t)
+	leaf := mustCertificate(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "web.default.svc"},
+		DNSNames: []string{"web.default.svc"},
+	}, root, leafKey.Public(), rootKey)
+	_, incomingPEM := newRoot("Incoming Root CA")
+	_, otherPEM := newRoot("Other Root CA")
+
+	dir := t.TempDir()
+	config := &Config{
+		CertFile: filepath.Join(dir, "site.crt"),
+		KeyFile:  filepath.Join(dir, "site.key"),
+		RootFile: filepath.Join(dir, "root.crt"),
+	}
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	bothPEM := append(append([]byte{}, rootPEM...), incomingPEM...)
+	if err := os.WriteFile(config.CertFile, leafPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.RootFile, rootPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		bundle      []byte
+		wantChanged bool
+		wantErr     bool
+		wantReject  bool
+		wantRoots   []byte
+	}{
+		{"unchanged", rootPEM, false, false, false, rootPEM},
+		{"incoming root", bothPEM, true, false, false, bothPEM},
+		{"current root removed", otherPEM, false, true, true, bothPEM},
+		{"incoming root removed", rootPEM, true, false, false, rootPEM},
+		{"empty", nil, false, true, false, rootPEM},
+		{"not a CA", leafPEM, false, true, false, rootPEM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := &trustBundle{
+				config: config,
+				fetch:  func(context.Context) ([]byte, error) { return tt.bundle, nil },
+			}
+			changed, err := tb.refresh(context.Background())
+			switch {
+			case (err != nil) != tt.wantErr || errors.Is(err, errBundleRejected) != tt.wantReject:
+				t.Fatalf("refresh() error = %v, wantErr %v, wantReject %v", err, tt.wantErr, tt.wantReject)
+			case changed != tt.wantChanged:
+				t.Errorf("refresh() changed = %v, want %v", changed, tt.wantChanged)
+			}
+			if b, err := os.ReadFile(config.RootFile); err != nil || string(b) != string(tt.wantRoots) {
+				t.Errorf("root file = %s, want %s", b, tt.wantRoots)
+			}
+		})
+	}
+}
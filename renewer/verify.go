@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// verifyRenewed checks a renewed certificate before it replaces the current
+// one. The new certificate must use the current key, chain to the current
+// roots, and have the same subject and SANs as the previous certificate. A
+// mismatch usually means the CA is misconfigured, and writing the certificate
+// would take down the traffic of the workload.
+func verifyRenewed(previous, renewed *x509.Certificate, intermediates []*x509.Certificate, key crypto.PublicKey, roots *x509.CertPool) error {
+	if err := verifyIssued(renewed, intermediates, key, roots); err != nil {
+		return errors.Wrap(err, "renewed certificate")
+	}
+
+	if previous.Subject.CommonName != renewed.Subject.CommonName {
+		return errors.Errorf("renewed certificate subject %q does not match %q", renewed.Subject.CommonName, previous.Subject.CommonName)
+	}
+	if !sameSANs(previous, renewed) {
+		return errors.Errorf("renewed certificate SANs %v do not match %v", sans(renewed), sans(previous))
+	}
+
+	return nil
+}
+
+// verifyIssued checks that a certificate matches the given key and chains to
+// the given roots.
+func verifyIssued(crt *x509.Certificate, intermediates []*x509.Certificate, key crypto.PublicKey, roots *x509.CertPool) error {
+	pub, ok := crt.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(key) {
+		return errors.New("certificate does not match the private key")
+	}
+
+	pool := x509.NewCertPool()
+	for _, c := range intermediates {
+		pool.AddCert(c)
+	}
+	if _, err := crt.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: pool,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return errors.Wrap(err, "certificate does not chain to the current roots")
+	}
+	return nil
+}
+
+// sans returns the sorted list of SANs of a certificate.
+func sans(crt *x509.Certificate) []string {
+	var result []string
+	result = append(result, crt.DNSNames...)
+	result = append(result, crt.EmailAddresses...)
+	for _, ip := range crt.IPAddresses {
+		result = append(result, ip.String())
+	}
+	for _, u := range crt.URIs {
+		result = append(result, u.String())
+	}
+	slices.Sort(result)
+	return result
+}
+
+func sameSANs(a, b *x509.Certificate) bool {
+	return slices.Equal(sans(a), sans(b))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func mustKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func mustCertificate(t *testing.T, template, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) *x509.Certificate {
+	t.Helper()
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+func Test_verifyRenewed(t *testing.T) {
+	rootKey := mustKey(t)
+	root := mustCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Root CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, rootKey.Public(), rootKey)
+	otherKey := mustKey(t)
+	other := mustCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Other CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, otherKey.Public(), otherKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	key := mustKey(t)
+	leaf := func(cn string, dnsNames []string, pub crypto.PublicKey, parent *x509.Certificate, signer crypto.Signer) *x509.Certificate {
+		return mustCertificate(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: cn},
+			DNSNames:    dnsNames,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}, parent, pub, signer)
+	}
+	names := []string{"test.default.svc", "test.default.svc.cluster.local"}
+	previous := leaf("test.default.svc", names, key.Public(), root, rootKey)
+
+	tests := []struct {
+		name    string
+		renewed *x509.Certificate
+		wantErr bool
+	}{
+		{"ok", leaf("test.default.svc", []string{names[1], names[0]}, key.Public(), root, rootKey), false},
+		{"different key", leaf("test.default.svc", names, mustKey(t).Public(), root, rootKey), true},
+		{"untrusted root", leaf("test.default.svc", names, key.Public(), other, otherKey), true},
+		{"different subject", leaf("other.default.svc", names, key.Public(), root, rootKey), true},
+		{"missing san", leaf("test.default.svc", names[:1], key.Public(), root, rootKey), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyRenewed(previous, tt.renewed, nil, key.Public(), roots)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyRenewed() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/clock"
+)
+
+// expiryWarnInterval is how often a verify-only renewer logs that its
+// certificate is about to expire.
+const expiryWarnInterval = time.Hour
+
+// verifier watches a certificate issued outside of autocert, mounted from a
+// Secret, without renewing it. It logs warnings once the certificate is in
+// its critical window, and returns a staleError when it expires, so the
+// container restarts and the expiry shows in the pod status.
+type verifier struct {
+	config *Config
+	clock  clock.Clock
+	// snapshot is the last status written, for state dumps.
+	snapshot statusSnapshot
+}
+
+// run checks the certificate at startup, then every watchdogInterval, until
+// the context is cancelled. The certificate is read on every check, as the
+// kubelet updates the files when the Secret changes.
+func (v *verifier) run(ctx context.Context) error {
+	var serial string
+	var warned time.Time
+	for {
+		now := v.clock.Now()
+		status := Status{State: StateExternal, NextAttempt: now.Add(watchdogInterval)}
+		crt, err := readCertificate(v.config.CertFile)
+		switch {
+		case err != nil:
+			status.LastError = err.Error()
+			log.WithField("error", err).Warn("Error reading certificate")
+		default:
+			status.setCertificate(crt)
+			if status.Serial != serial {
+				if serial != "" {
+					log.WithField("serial", status.Serial).Info("Certificate updated")
+				}
+				serial = status.Serial
+				warned = time.Time{}
+			}
+			remaining := crt.NotAfter.Sub(now)
+			if remaining <= 0 {
+				reason := fmt.Sprintf("certificate %s expired at %s, renew the Secret it's mounted from", status.Serial, crt.NotAfter.Format(time.RFC3339))
+				status.State = StateCritical
+				status.LastError = reason
+				v.save(&status)
+				return &staleError{config: v.config, crt: crt, reason: reason}
+			}
+			if remaining <= criticalWindow(crt, v.config.CriticalWindow) {
+				status.State = StateExpiring
+				status.LastError = fmt.Sprintf("certificate %s expires in %s", status.Serial, remaining.Round(time.Second))
+				if now.Sub(warned) >= expiryWarnInterval {
+					warned = now
+					log.WithFields(log.Fields{
+						"serial":   status.Serial,
+						"notAfter": crt.NotAfter.Format(time.RFC3339),
+					}).Warn("Certificate is about to expire, renew the Secret it's mounted from")
+				}
+			}
+		}
+		v.save(&status)
+
+		timer := v.clock.NewTimer(watchdogInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			status.State = StateStopped
+			v.save(&status)
+			return nil
+		case <-timer.C():
+		}
+	}
+}
+
+// save writes the status file, and keeps the status for state dumps.
+func (v *verifier) save(status *Status) {
+	v.snapshot.store(*status)
+	if err := status.write(v.config.StatusFile); err != nil {
+		log.WithField("error", err).Warn("Error writing renewal status")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/autocert/pkg/clock/clocktest"
+)
+
+func TestVerifier(t *testing.T) {
+	key := mustKey(t)
+	crt := mustCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test.default.svc"}}, nil, key.Public(), key)
+	dir := t.TempDir()
+	config := &Config{
+		CertFile:       filepath.Join(dir, "site.crt"),
+		StatusFile:     filepath.Join(dir, statusFileName),
+		CriticalWindow: 30 * time.Minute,
+		VerifyOnly:     true,
+	}
+	if err := os.WriteFile(config.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate expires in an hour, it's expiring after 30 minutes,
+	// and the verifier gives up when it expires.
+	fake := clocktest.NewFake(time.Now())
+	v := &verifier{config: config, clock: fake}
+	done := make(chan error)
+	go func() { done <- v.run(context.Background()) }()
+
+	fake.BlockUntil(1)
+	if status := readStatus(t, config.StatusFile); status.State != StateExternal || status.Serial != crt.SerialNumber.String() {
+		t.Errorf("status = %+v, want external", status)
+	}
+	fake.AdvanceTo(crt.NotAfter.Add(-20 * time.Minute))
+	fake.BlockUntil(1)
+	if status := readStatus(t, config.StatusFile); status.State != StateExpiring || status.LastError == "" {
+		t.Errorf("status = %+v, want expiring", status)
+	}
+
+	fake.AdvanceTo(crt.NotAfter.Add(time.Minute))
+	var stale *staleError
+	if err := <-done; !errors.As(err, &stale) {
+		t.Errorf("run() error = %v, want stale certificate", err)
+	}
+	if status := readStatus(t, config.StatusFile); status.State != StateCritical {
+		t.Errorf("status = %+v, want critical", status)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// protocolVersion is the latest version of the environment variables set
+	// by the controller that this renewer understands.
+	protocolVersion = 25
+	// minProtocolVersion is the oldest supported version. Controllers before
+	// the protocol was introduced don't set AUTOCERT_PROTOCOL and are treated
+	// as version 1.
+	minProtocolVersion = 1
+)
+
+// checkProtocol returns an error if the renewer was configured by a
+// controller using an unsupported protocol version.
+func checkProtocol(value string) (int, error) {
+	if value == "" {
+		return minProtocolVersion, nil
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Errorf("invalid $AUTOCERT_PROTOCOL %q", value)
+	}
+	switch {
+	case v > protocolVersion:
+		return 0, errors.Errorf("the controller uses protocol version %d but this renewer only supports versions %d to %d, upgrade the renewer image", v, minProtocolVersion, protocolVersion)
+	case v < minProtocolVersion:
+		return 0, errors.Errorf("the controller uses protocol version %d but this renewer only supports versions %d to %d, upgrade the controller", v, minProtocolVersion, protocolVersion)
+	}
+	return v, nil
+}
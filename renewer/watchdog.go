@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/smallstep/autocert/pkg/clock"
+)
+
+const (
+	// watchdogInterval is how often the watchdog checks the certificate on
+	// disk.
+	watchdogInterval = time.Minute
+	// stuckGrace is how late a renewal attempt can be before the renewer is
+	// considered stuck.
+	stuckGrace = 5 * time.Minute
+)
+
+// staleError is returned by the watchdog when the certificate on disk is
+// about to expire and the renewer is unable to renew it.
+type staleError struct {
+	config *Config
+	crt    *x509.Certificate
+	reason string
+}
+
+func (e *staleError) Error() string {
+	return e.reason
+}
+
+// criticalWindow returns the remaining lifetime under which a certificate
+// that fails to renew is critical: the configured window, or a sixth of its
+// lifetime, half the time left when renewals start.
+func criticalWindow(crt *x509.Certificate, configured time.Duration) time.Duration {
+	if configured > 0 {
+		return configured
+	}
+	return crt.NotAfter.Sub(crt.NotBefore) / 6
+}
+
+// staleReason returns why a certificate is stale, or an empty string if it
+// isn't. A certificate is stale when it's within the critical window and its
+// renewals keep failing, or no renewal was attempted when it was due.
+func staleReason(crt *x509.Certificate, status Status, now time.Time, window time.Duration) string {
+	remaining := crt.NotAfter.Sub(now)
+	switch {
+	case remaining > window:
+		return ""
+	case remaining <= 0:
+		return fmt.Sprintf("certificate %s expired at %s", crt.SerialNumber, crt.NotAfter.Format(time.RFC3339))
+	case status.ConsecutiveFailures > 0:
+		return fmt.Sprintf("certificate %s expires in %s and the last %d renewals failed: %s", crt.SerialNumber, remaining.Round(time.Second), status.ConsecutiveFailures, status.LastError)
+	case !status.NextAttempt.IsZero() && now.Sub(status.NextAttempt) > stuckGrace:
+		return fmt.Sprintf("certificate %s expires in %s and no renewal was attempted since %s", crt.SerialNumber, remaining.Round(time.Second), status.NextAttempt.Format(time.RFC3339))
+	default:
+		return ""
+	}
+}
+
+// readStatusFile reads the status file written by the scheduler.
+func readStatusFile(filename string) (Status, error) {
+	var s Status
+	b, err := os.ReadFile(filename) //nolint:gosec // file path comes from trusted configuration
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
+// watchdog checks the certificate on disk independently of the scheduler,
+// so a renewer that keeps failing, or is stuck, doesn't go unnoticed until
+// handshakes fail.
+type watchdog struct {
+	config *Config
+	clock  clock.Clock
+}
+
+// run checks the certificate on disk every watchdogInterval until the context
+// is cancelled, and returns a staleError as soon as it's stale.
+func (w *watchdog) run(ctx context.Context) error {
+	for {
+		timer := w.clock.NewTimer(watchdogInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C():
+		}
+
+		crt, err := readCertificate(w.config.CertFile)
+		if err != nil {
+			log.WithField("error", err).Warn("Watchdog error reading certificate")
+			continue
+		}
+		// A missing status file means the scheduler is not running yet or
+		// can't write it, rely on the certificate alone.
+		status, err := readStatusFile(w.config.StatusFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.WithField("error", err).Warn("Watchdog error reading renewal status")
+		}
+		if reason := staleReason(crt, status, w.clock.Now(), criticalWindow(crt, w.config.CriticalWindow)); reason != "" {
+			return &staleError{config: w.config, crt: crt, reason: reason}
+		}
+	}
+}
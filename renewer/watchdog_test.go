@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/autocert/pkg/clock/clocktest"
+)
+
+func Test_staleReason(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	crt := func(remaining time.Duration) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			NotBefore:    now.Add(remaining - 24*time.Hour),
+			NotAfter:     now.Add(remaining),
+		}
+	}
+	window := criticalWindow(crt(0), 0)
+	if window != 4*time.Hour {
+		t.Fatalf("criticalWindow() = %v, want 4h", window)
+	}
+
+	tests := []struct {
+		name   string
+		crt    *x509.Certificate
+		status Status
+		want   bool
+	}{
+		{"healthy", crt(8 * time.Hour), Status{NextAttempt: now.Add(time.Hour)}, false},
+		{"failing outside the window", crt(8 * time.Hour), Status{ConsecutiveFailures: 5, NextAttempt: now.Add(time.Minute)}, false},
+		{"failing within the window", crt(time.Hour), Status{ConsecutiveFailures: 5, NextAttempt: now.Add(time.Minute)}, true},
+		{"frozen within the window", crt(time.Hour), Status{State: StateFrozen, NextAttempt: now.Add(time.Minute)}, false},
+		{"stuck within the window", crt(time.Hour), Status{State: StateRenewing, NextAttempt: now.Add(-time.Hour)}, true},
+		{"renewing within the window", crt(time.Hour), Status{State: StateRenewing, NextAttempt: now.Add(-time.Minute)}, false},
+		{"expired", crt(-time.Minute), Status{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := staleReason(tt.crt, tt.status, now, window); (got != "") != tt.want {
+				t.Errorf("staleReason() = %q, want stale %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	key := mustKey(t)
+	crt := mustCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test.default.svc"}}, nil, key.Public(), key)
+	dir := t.TempDir()
+	config := &Config{
+		CertFile:       filepath.Join(dir, "site.crt"),
+		StatusFile:     filepath.Join(dir, statusFileName),
+		CriticalWindow: 30 * time.Minute,
+	}
+	if err := os.WriteFile(config.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	status := &Status{ConsecutiveFailures: 3, LastError: "connection refused", NextAttempt: time.Now()}
+	if err := status.write(config.StatusFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate expires in an hour, it goes stale after 30 minutes.
+	fake := clocktest.NewFake(time.Now())
+	w := &watchdog{config: config, clock: fake}
+	done := make(chan error)
+	go func() { done <- w.run(context.Background()) }()
+	start := fake.Now()
+	for {
+		select {
+		case err := <-done:
+			var stale *staleError
+			if !errors.As(err, &stale) || stale.crt.SerialNumber.Cmp(crt.SerialNumber) != 0 {
+				t.Errorf("run() error = %v, want stale certificate", err)
+			}
+			if d := fake.Now().Sub(start); d < 29*time.Minute || d > 31*time.Minute {
+				t.Errorf("run() returned after %v, want 30m", d)
+			}
+			return
+		default:
+		}
+		if fake.Pending() > 0 {
+			fake.Advance(watchdogInterval)
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
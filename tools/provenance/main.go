@@ -0,0 +1,179 @@
+// Command provenance writes the SLSA provenance of Go binaries as an in-toto
+// statement. The statement only depends on the binaries and on
+// SOURCE_DATE_EPOCH, so reproducible builds get the same provenance:
+//
+//	go run ./tools/provenance -o bin/autocert.intoto.json bin/autocert
+//
+// The controller verifies the statement on startup when buildVerification is
+// enabled, see the README.
+package main
+
+import (
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	statementType = "https://in-toto.io/Statement/v1"
+	predicateType = "https://slsa.dev/provenance/v1"
+	buildType     = "https://github.com/smallstep/autocert/Makefile@v1"
+	repository    = "https://github.com/smallstep/autocert"
+)
+
+type statement struct {
+	Type          string     `json:"_type"`
+	Subject       []resource `json:"subject"`
+	PredicateType string     `json:"predicateType"`
+	Predicate     predicate  `json:"predicate"`
+}
+
+type resource struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+type predicate struct {
+	BuildDefinition struct {
+		BuildType            string            `json:"buildType"`
+		ExternalParameters   map[string]string `json:"externalParameters"`
+		InternalParameters   map[string]string `json:"internalParameters"`
+		ResolvedDependencies []resource        `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn string `json:"startedOn,omitempty"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+func main() {
+	output := flag.String("o", "", "write the statement to `file` instead of stdout")
+	builder := flag.String("builder", envOr("BUILDER_ID", repository+"/Makefile"), "the `id` of the builder")
+	allowDirty := flag.Bool("allow-dirty", false, "allow binaries built from a modified tree")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: provenance [-o file] [-builder id] [-allow-dirty] binary...")
+		os.Exit(2)
+	}
+
+	s, err := newStatement(flag.Args(), *builder, os.Getenv("SOURCE_DATE_EPOCH"), *allowDirty)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	data = append(data, '\n')
+	if *output == "" {
+		os.Stdout.Write(data) //nolint:errcheck // nothing to do on write errors to stdout
+		return
+	}
+	if err := os.WriteFile(*output, data, 0o644); err != nil { //nolint:gosec // provenance is public
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// newStatement returns the statement of the given binaries, built from the
+// same revision with the same toolchain. Binaries built from a modified tree
+// can't be reproduced and are rejected unless allowDirty is set.
+func newStatement(binaries []string, builder, sourceDateEpoch string, allowDirty bool) (*statement, error) {
+	s := &statement{
+		Type:          statementType,
+		PredicateType: predicateType,
+	}
+	s.Predicate.BuildDefinition.BuildType = buildType
+	s.Predicate.BuildDefinition.ExternalParameters = map[string]string{}
+	s.Predicate.BuildDefinition.InternalParameters = map[string]string{}
+	s.Predicate.RunDetails.Builder.ID = builder
+	if sourceDateEpoch != "" {
+		sec, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", sourceDateEpoch, err)
+		}
+		s.Predicate.RunDetails.Metadata.StartedOn = time.Unix(sec, 0).UTC().Format(time.RFC3339)
+		s.Predicate.BuildDefinition.ExternalParameters["sourceDateEpoch"] = sourceDateEpoch
+	}
+
+	seen := map[string]bool{}
+	for _, binary := range binaries {
+		data, err := os.ReadFile(binary) //nolint:gosec // path given on the command line
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		s.Subject = append(s.Subject, resource{
+			Name:   filepath.Base(binary),
+			Digest: map[string]string{"sha256": hex.EncodeToString(sum[:])},
+		})
+
+		info, err := buildinfo.ReadFile(binary)
+		if err != nil {
+			return nil, fmt.Errorf("error reading build information of %s: %w", binary, err)
+		}
+		params := s.Predicate.BuildDefinition.InternalParameters
+		params["goVersion"] = info.GoVersion
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if !seen[setting.Value] {
+					seen[setting.Value] = true
+					s.Predicate.BuildDefinition.ResolvedDependencies = append(s.Predicate.BuildDefinition.ResolvedDependencies, resource{
+						URI:    "git+" + repository + "@" + setting.Value,
+						Digest: map[string]string{"gitCommit": setting.Value},
+					})
+				}
+			case "vcs.modified":
+				if setting.Value == "true" && !allowDirty {
+					return nil, fmt.Errorf("%s was built from a modified tree", binary)
+				}
+				params[setting.Key] = setting.Value
+			case "-trimpath", "-ldflags", "CGO_ENABLED", "GOOS", "GOARCH", "GOAMD64", "GOARM64":
+				params[setting.Key] = setting.Value
+			}
+		}
+		for _, dep := range info.Deps {
+			if seen[dep.Path+"@"+dep.Version] {
+				continue
+			}
+			seen[dep.Path+"@"+dep.Version] = true
+			r := resource{
+				URI:    "pkg:golang/" + dep.Path + "@" + dep.Version,
+				Digest: map[string]string{},
+			}
+			// Go checksums are the base64 SHA-256 of the module tree,
+			// prefixed by h1:.
+			if sum, ok := strings.CutPrefix(dep.Sum, "h1:"); ok {
+				if h, err := base64.StdEncoding.DecodeString(sum); err == nil && len(h) == sha256.Size {
+					r.Digest["dirhash1"] = hex.EncodeToString(h)
+				}
+			}
+			s.Predicate.BuildDefinition.ResolvedDependencies = append(s.Predicate.BuildDefinition.ResolvedDependencies, r)
+		}
+	}
+	return s, nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
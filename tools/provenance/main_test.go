@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNewStatement(t *testing.T) {
+	binary, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+
+	s, err := newStatement([]string{binary}, "https://builder.example.com", "1700000000", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Type != statementType || s.PredicateType != predicateType {
+		t.Errorf("newStatement() types = %q, %q", s.Type, s.PredicateType)
+	}
+	if len(s.Subject) != 1 || s.Subject[0].Digest["sha256"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("newStatement() subject = %v, want the digest of %s", s.Subject, binary)
+	}
+	if got := s.Predicate.RunDetails.Metadata.StartedOn; got != "2023-11-14T22:13:20Z" {
+		t.Errorf("newStatement() startedOn = %q, want the time of SOURCE_DATE_EPOCH", got)
+	}
+	if got := s.Predicate.RunDetails.Builder.ID; got != "https://builder.example.com" {
+		t.Errorf("newStatement() builder = %q", got)
+	}
+	if s.Predicate.BuildDefinition.InternalParameters["goVersion"] == "" {
+		t.Error("newStatement() did not record the Go version")
+	}
+
+	// The statement only depends on its inputs.
+	again, err := newStatement([]string{binary}, "https://builder.example.com", "1700000000", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, again) {
+		t.Error("newStatement() is not deterministic")
+	}
+
+	if _, err := newStatement([]string{binary}, "", "yesterday", true); err == nil {
+		t.Error("newStatement() with an invalid SOURCE_DATE_EPOCH: expected an error")
+	}
+}